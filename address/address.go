@@ -0,0 +1,120 @@
+package address
+
+// address.go contains the pluggable validation of posted addresses. A
+// Validator checks an address and returns it normalized, the basic validator
+// only tidies it up locally while the Loqate and Google validators ask those
+// services whether the address exists. A validator is picked with the
+// -address-validator flag.
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"user/users"
+)
+
+var (
+	validator string
+	key       string
+	//ErrNoValidatorFound is returned when the selected validator is unknown
+	ErrNoValidatorFound = "No address validator with name %v"
+)
+
+func init() {
+	flag.StringVar(&validator, "address-validator", os.Getenv("ADDRESS_VALIDATOR"), "Address validator to use: basic, loqate or google")
+	flag.StringVar(&key, "address-validator-key", os.Getenv("ADDRESS_VALIDATOR_KEY"), "API key of the address validator")
+}
+
+// Validator checks an address and returns it normalized. Validated is set on
+// the returned address when the validator confirmed the address exists.
+// Addresses that can't be accepted return an *InvalidError, any other error
+// means the validator itself failed.
+type Validator interface {
+	Validate(a users.Address) (users.Address, error)
+}
+
+// ValidatorFunc adapts a function to the Validator interface.
+type ValidatorFunc func(a users.Address) (users.Address, error)
+
+// Validate calls f(a).
+func (f ValidatorFunc) Validate(a users.Address) (users.Address, error) {
+	return f(a)
+}
+
+// InvalidError is returned for addresses a validator rejects.
+type InvalidError struct {
+	Field  string
+	Reason string
+}
+
+func (e *InvalidError) Error() string {
+	return fmt.Sprintf("Invalid address %v: %v", e.Field, e.Reason)
+}
+
+// New returns the validator selected by the flags, the basic one by default.
+func New() (Validator, error) {
+	switch validator {
+	case "", "basic":
+		return Basic, nil
+	case "loqate":
+		return NewLoqate(key), nil
+	case "google":
+		return NewGoogle(key), nil
+	}
+	return nil, fmt.Errorf(ErrNoValidatorFound, validator)
+}
+
+// Basic trims and collapses whitespace, upper cases post codes, states and
+// two letter country codes, requires a street, city and country and checks
+// the rules of the country. It never sets Validated.
+var Basic = ValidatorFunc(func(a users.Address) (users.Address, error) {
+	a.Street = tidy(a.Street)
+	a.Number = tidy(a.Number)
+	a.Building = tidy(a.Building)
+	a.City = tidy(a.City)
+	a.Prefecture = tidy(a.Prefecture)
+	a.PostCode = strings.ToUpper(tidy(a.PostCode))
+	a.Country = tidy(a.Country)
+	if len(a.Country) == 2 {
+		a.Country = strings.ToUpper(a.Country)
+	}
+	a.State = tidy(a.State)
+	if len(Rules[a.Country].States) > 0 {
+		a.State = strings.ToUpper(a.State)
+	}
+	a.Validated = false
+	for _, f := range []struct{ name, value string }{
+		{"street", a.Street},
+		{"city", a.City},
+		{"country", a.Country},
+	} {
+		if f.value == "" {
+			return a, &InvalidError{Field: f.name, Reason: "missing"}
+		}
+	}
+	return a, checkCountry(a)
+})
+
+// region returns the state, or the prefecture of Japanese addresses.
+func region(a users.Address) string {
+	if a.Country == "JP" {
+		return a.Prefecture
+	}
+	return a.State
+}
+
+// setRegion sets the state, or the prefecture of Japanese addresses, unless
+// r is empty.
+func setRegion(a *users.Address, r string) {
+	if a.Country == "JP" {
+		a.Prefecture = pick(r, a.Prefecture)
+		return
+	}
+	a.State = pick(r, a.State)
+}
+
+func tidy(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
@@ -0,0 +1,153 @@
+package address
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"user/users"
+)
+
+func TestBasic(t *testing.T) {
+	a, err := Basic(users.Address{Street: "  Downing   Street ", Number: "10", City: "London", PostCode: "sw1a 2aa", Country: "gb", Validated: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Street != "Downing Street" || a.PostCode != "SW1A 2AA" || a.Country != "GB" || a.Validated {
+		t.Errorf("unexpected normalized address %+v", a)
+	}
+	_, err = Basic(users.Address{Street: "Downing Street", Country: "GB"})
+	if e, ok := err.(*InvalidError); !ok || e.Field != "city" {
+		t.Errorf("expected missing city, got %v", err)
+	}
+}
+
+func TestCountryRules(t *testing.T) {
+	valid := []users.Address{
+		{Street: "Main St", City: "Springfield", State: "il", PostCode: "62701", Country: "us"},
+		{Street: "Chiyoda", Number: "1-1", Building: "Palace Tower 5F", Prefecture: "Tokyo", City: "Chiyoda-ku", PostCode: "100-0001", Country: "JP"},
+		{Street: "Rue de Rivoli", City: "Paris", PostCode: "75001", Country: "FR"},
+		{Street: "MG Road", City: "Bengaluru", State: "Karnataka", PostCode: "560001", Country: "IN"},
+		{Street: "Main Street", City: "Nowhere", Country: "Atlantis"},
+	}
+	for _, a := range valid {
+		if _, err := Basic(a); err != nil {
+			t.Errorf("expected %+v to be valid, got %v", a, err)
+		}
+	}
+	invalid := map[string]users.Address{
+		"postcode":   {Street: "Main St", City: "Springfield", State: "IL", PostCode: "6270", Country: "US"},
+		"state":      {Street: "Main St", City: "Springfield", State: "XX", PostCode: "62701", Country: "US"},
+		"prefecture": {Street: "Chiyoda", City: "Chiyoda-ku", PostCode: "100-0001", Country: "JP"},
+	}
+	for field, a := range invalid {
+		if _, err := Basic(a); err == nil || err.(*InvalidError).Field != field {
+			t.Errorf("expected invalid %v, got %v", field, err)
+		}
+	}
+	if _, err := Basic(users.Address{Street: "High Street", City: "Leeds", PostCode: "LS1 1AA", Prefecture: "Tokyo", Country: "GB"}); err == nil {
+		t.Error("expected prefecture outside JP to be rejected")
+	}
+}
+
+func TestLoqate(t *testing.T) {
+	avc := "V44-I44-P6-100"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Key       string
+			Addresses []loqateAddress
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Key != "k" || req.Addresses[0].Address1 != "10 downing st" {
+			t.Errorf("unexpected request %+v", req)
+		}
+		json.NewEncoder(w).Encode([]interface{}{map[string]interface{}{
+			"Matches": []loqateAddress{{AVC: avc, Premise: "10", Thoroughfare: "Downing Street", Locality: "London", PostalCode: "SW1A 2AA", Country: "GB"}},
+		}})
+	}))
+	defer ts.Close()
+	l := NewLoqate("k")
+	l.URL = ts.URL
+	in := users.Address{Number: "10", Street: "downing st", City: "london", PostCode: "SW1A 2AA", Country: "GB"}
+	a, err := l.Validate(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !a.Validated || a.Street != "Downing Street" || a.PostCode != "SW1A 2AA" {
+		t.Errorf("unexpected validated address %+v", a)
+	}
+	avc = "P22-I22-P3-050"
+	if a, _ = l.Validate(in); a.Validated || a.Street != "downing st" {
+		t.Errorf("expected partial match to be ignored, got %+v", a)
+	}
+}
+
+func TestGoogle(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("key") != "k" {
+			t.Error("expected key in query")
+		}
+		w.Write([]byte(`{"result":{"verdict":{"addressComplete":true,"validationGranularity":"PREMISE"},
+			"address":{"postalAddress":{"regionCode":"US","postalCode":"94043-1351","locality":"Mountain View"},
+			"addressComponents":[{"componentName":{"text":"1600"},"componentType":"street_number"},
+			{"componentName":{"text":"Amphitheatre Parkway"},"componentType":"route"}]}}}`))
+	}))
+	defer ts.Close()
+	g := NewGoogle("k")
+	g.URL = ts.URL
+	a, err := g.Validate(users.Address{Number: "1600", Street: "amphitheatre pkwy", City: "mountain view", State: "ca", PostCode: "94043", Country: "US"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !a.Validated || a.Street != "Amphitheatre Parkway" || a.PostCode != "94043-1351" || a.City != "Mountain View" {
+		t.Errorf("unexpected validated address %+v", a)
+	}
+}
+
+func TestNew(t *testing.T) {
+	validator = "nope"
+	defer func() { validator = "" }()
+	if _, err := New(); err == nil {
+		t.Error("expected unknown validator to fail")
+	}
+}
+
+func TestGoogleGeocoder(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("address") != "10 Downing Street London SW1A 2AA" || q.Get("components") != "country:GB" {
+			t.Errorf("unexpected query %v", q)
+		}
+		w.Write([]byte(`{"status":"OK","results":[{"geometry":{"location":{"lat":51.5034,"lng":-0.1276}}}]}`))
+	}))
+	defer ts.Close()
+	g := NewGoogleGeocoder("k")
+	g.URL = ts.URL
+	l, err := g.Geocode(users.Address{Number: "10", Street: "Downing Street", City: "London", PostCode: "SW1A 2AA", Country: "GB"})
+	if err != nil || l.Lat != 51.5034 || l.Lng != -0.1276 {
+		t.Errorf("unexpected location %v %v", l, err)
+	}
+}
+
+func TestGeocoding(t *testing.T) {
+	g := GeocoderFunc(func(a users.Address) (users.Location, error) {
+		if a.Street == "" {
+			return users.Location{}, ErrNoLocation
+		}
+		return users.Location{Lat: 1, Lng: 2}, nil
+	})
+	q := NewGeocoding(g, 2)
+	saved := map[string]string{}
+	save := func(_ context.Context, id string, l *users.Location, status string) error {
+		saved[id] = status
+		return nil
+	}
+	q.Enqueue(users.Address{ID: "a", Street: "High Street"}, save)
+	q.Enqueue(users.Address{ID: "b"}, save)
+	q.Close()
+	if saved["a"] != users.GeocodeDone || saved["b"] != users.GeocodeFailed {
+		t.Errorf("unexpected geocodes %v", saved)
+	}
+}
@@ -0,0 +1,74 @@
+package address
+
+import (
+	"regexp"
+	"strings"
+
+	"user/users"
+)
+
+// Rule is the address format of a country.
+type Rule struct {
+	// PostCode is the post code format, nil for countries without post
+	// codes. Post codes are optional unless RequirePostCode is set.
+	PostCode        *regexp.Regexp
+	RequirePostCode bool
+	// RequireState requires the state or province.
+	RequireState bool
+	// States are the accepted state codes, any state when empty.
+	States []string
+	// RequirePrefecture requires the prefecture, only Japanese addresses
+	// have one.
+	RequirePrefecture bool
+}
+
+// Rules are the formats of the countries we know, by ISO 3166-1 alpha-2
+// code. Addresses of other countries only get the basic checks.
+var Rules = map[string]Rule{
+	"AU": {PostCode: regexp.MustCompile(`^\d{4}$`), RequirePostCode: true, RequireState: true, States: []string{"ACT", "NSW", "NT", "QLD", "SA", "TAS", "VIC", "WA"}},
+	"CA": {PostCode: regexp.MustCompile(`^[A-Z]\d[A-Z] ?\d[A-Z]\d$`), RequirePostCode: true, RequireState: true, States: []string{"AB", "BC", "MB", "NB", "NL", "NS", "NT", "NU", "ON", "PE", "QC", "SK", "YT"}},
+	"DE": {PostCode: regexp.MustCompile(`^\d{5}$`), RequirePostCode: true},
+	"FR": {PostCode: regexp.MustCompile(`^\d{5}$`), RequirePostCode: true},
+	"GB": {PostCode: regexp.MustCompile(`^[A-Z]{1,2}\d[A-Z\d]? ?\d[A-Z]{2}$`), RequirePostCode: true},
+	"IE": {PostCode: regexp.MustCompile(`^[A-Z]\d[\dW] ?[A-Z\d]{4}$`)},
+	"IN": {PostCode: regexp.MustCompile(`^\d{6}$`), RequirePostCode: true, RequireState: true},
+	"JP": {PostCode: regexp.MustCompile(`^\d{3}-?\d{4}$`), RequirePostCode: true, RequirePrefecture: true},
+	"NL": {PostCode: regexp.MustCompile(`^\d{4} ?[A-Z]{2}$`), RequirePostCode: true},
+	"US": {PostCode: regexp.MustCompile(`^\d{5}(-\d{4})?$`), RequirePostCode: true, RequireState: true, States: []string{
+		"AK", "AL", "AR", "AZ", "CA", "CO", "CT", "DC", "DE", "FL", "GA", "HI", "IA", "ID", "IL", "IN", "KS", "KY", "LA", "MA", "MD", "ME", "MI", "MN", "MO", "MS", "MT",
+		"NC", "ND", "NE", "NH", "NJ", "NM", "NV", "NY", "OH", "OK", "OR", "PA", "RI", "SC", "SD", "TN", "TX", "UT", "VA", "VT", "WA", "WI", "WV", "WY",
+	}},
+}
+
+// checkCountry applies the rule of the country of a, if there is one.
+func checkCountry(a users.Address) error {
+	if a.Prefecture != "" && a.Country != "JP" {
+		return &InvalidError{Field: "prefecture", Reason: "only used in JP"}
+	}
+	r, ok := Rules[a.Country]
+	if !ok {
+		return nil
+	}
+	switch {
+	case a.PostCode == "" && r.RequirePostCode:
+		return &InvalidError{Field: "postcode", Reason: "missing"}
+	case a.PostCode != "" && r.PostCode != nil && !r.PostCode.MatchString(a.PostCode):
+		return &InvalidError{Field: "postcode", Reason: "not a " + a.Country + " post code"}
+	case a.State == "" && r.RequireState:
+		return &InvalidError{Field: "state", Reason: "missing"}
+	case a.State != "" && len(r.States) > 0 && !contains(r.States, a.State):
+		return &InvalidError{Field: "state", Reason: "not a " + a.Country + " state"}
+	case a.Prefecture == "" && r.RequirePrefecture:
+		return &InvalidError{Field: "prefecture", Reason: "missing"}
+	}
+	return nil
+}
+
+func contains(ss []string, s string) bool {
+	for _, v := range ss {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,180 @@
+package address
+
+// geocode.go contains the optional geocoding of new addresses. Addresses are
+// stored pending and a background worker looks up their location, so writes
+// are never held up by the geocoder. A geocoder is picked with the -geocoder
+// flag, none by default.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"user/users"
+)
+
+var (
+	geocoder    string
+	geocoderKey string
+	//ErrNoGeocoderFound is returned when the selected geocoder is unknown
+	ErrNoGeocoderFound = "No geocoder with name %v"
+	//ErrNoLocation is returned by geocoders that found no location for an address
+	ErrNoLocation = errors.New("No location found")
+
+	// DroppedGeocodes counts addresses not geocoded because the queue was full.
+	DroppedGeocodes = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "address_geocodes_dropped_total",
+		Help: "Addresses not geocoded because the geocoding queue was full.",
+	})
+)
+
+func init() {
+	flag.StringVar(&geocoder, "geocoder", os.Getenv("GEOCODER"), "Geocoder locating new addresses: google, none when empty")
+	flag.StringVar(&geocoderKey, "geocoder-key", os.Getenv("GEOCODER_KEY"), "API key of the geocoder")
+}
+
+// Geocoder returns the location of an address.
+type Geocoder interface {
+	Geocode(a users.Address) (users.Location, error)
+}
+
+// GeocoderFunc adapts a function to the Geocoder interface.
+type GeocoderFunc func(a users.Address) (users.Location, error)
+
+// Geocode calls f(a).
+func (f GeocoderFunc) Geocode(a users.Address) (users.Location, error) {
+	return f(a)
+}
+
+// NewGeocoder returns the geocoder selected by the flags, nil when
+// geocoding is off.
+func NewGeocoder() (Geocoder, error) {
+	switch geocoder {
+	case "", "none":
+		return nil, nil
+	case "google":
+		return NewGoogleGeocoder(geocoderKey), nil
+	}
+	return nil, fmt.Errorf(ErrNoGeocoderFound, geocoder)
+}
+
+// GoogleGeocodeURL is the Google Geocoding API endpoint.
+const GoogleGeocodeURL = "https://maps.googleapis.com/maps/api/geocode/json"
+
+// GoogleGeocoder locates addresses with the Google Geocoding API.
+type GoogleGeocoder struct {
+	Key    string
+	URL    string
+	Client *http.Client
+}
+
+// NewGoogleGeocoder returns a GoogleGeocoder using key.
+func NewGoogleGeocoder(key string) *GoogleGeocoder {
+	return &GoogleGeocoder{Key: key, URL: GoogleGeocodeURL, Client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Geocode returns the location of the first result for a.
+func (g *GoogleGeocoder) Geocode(a users.Address) (users.Location, error) {
+	q := url.Values{}
+	q.Set("address", strings.Join(strings.Fields(strings.Join([]string{a.Building, a.Number, a.Street, a.City, region(a), a.PostCode}, " ")), " "))
+	q.Set("components", "country:"+a.Country)
+	q.Set("key", g.Key)
+	resp, err := g.Client.Get(g.URL + "?" + q.Encode())
+	if err != nil {
+		return users.Location{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return users.Location{}, fmt.Errorf("google: returned %v", resp.Status)
+	}
+	var r struct {
+		Status  string `json:"status"`
+		Results []struct {
+			Geometry struct {
+				Location users.Location `json:"location"`
+			} `json:"geometry"`
+		} `json:"results"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return users.Location{}, err
+	}
+	switch r.Status {
+	case "OK":
+	case "ZERO_RESULTS":
+		return users.Location{}, ErrNoLocation
+	default:
+		return users.Location{}, fmt.Errorf("google: geocoding returned %v", r.Status)
+	}
+	if len(r.Results) == 0 {
+		return users.Location{}, ErrNoLocation
+	}
+	return r.Results[0].Geometry.Location, nil
+}
+
+// Geocoding geocodes queued addresses in the background and hands the
+// outcome to the save function queued with them.
+type Geocoding struct {
+	jobs     chan geocodeJob
+	geocoder Geocoder
+	dropped  prometheus.Counter
+	done     chan struct{}
+}
+
+type geocodeJob struct {
+	address users.Address
+	save    func(ctx context.Context, id string, l *users.Location, status string) error
+}
+
+// NewGeocoding starts a worker geocoding with g, queuing up to buffer
+// addresses.
+func NewGeocoding(g Geocoder, buffer int) *Geocoding {
+	q := &Geocoding{
+		jobs:     make(chan geocodeJob, buffer),
+		geocoder: g,
+		dropped:  DroppedGeocodes,
+		done:     make(chan struct{}),
+	}
+	go q.run()
+	return q
+}
+
+// Enqueue queues a for geocoding, save is called with its location or
+// GeocodeFailed, and a context of its own as the request queuing a is long
+// done by then. Enqueue reports false, without blocking, when the queue is
+// full.
+func (q *Geocoding) Enqueue(a users.Address, save func(ctx context.Context, id string, l *users.Location, status string) error) bool {
+	select {
+	case q.jobs <- geocodeJob{address: a, save: save}:
+		return true
+	default:
+		q.dropped.Inc()
+		return false
+	}
+}
+
+// Close geocodes the queued addresses and stops the worker.
+func (q *Geocoding) Close() {
+	close(q.jobs)
+	<-q.done
+}
+
+func (q *Geocoding) run() {
+	defer close(q.done)
+	ctx := context.Background()
+	for j := range q.jobs {
+		l, err := q.geocoder.Geocode(j.address)
+		if err != nil {
+			j.save(ctx, j.address.ID, nil, users.GeocodeFailed)
+			continue
+		}
+		j.save(ctx, j.address.ID, &l, users.GeocodeDone)
+	}
+}
@@ -0,0 +1,115 @@
+package address
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"user/users"
+)
+
+// GoogleURL is the Google Address Validation API endpoint.
+const GoogleURL = "https://addressvalidation.googleapis.com/v1:validateAddress"
+
+// Google validates addresses with the Google Address Validation API.
+// Addresses are first checked by Basic, complete addresses confirmed down to
+// the premise replace the posted fields and are marked validated.
+type Google struct {
+	Key    string
+	URL    string
+	Client *http.Client
+}
+
+// NewGoogle returns a Google validator using key.
+func NewGoogle(key string) *Google {
+	return &Google{Key: key, URL: GoogleURL, Client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+type googleResult struct {
+	Result struct {
+		Verdict struct {
+			AddressComplete          bool   `json:"addressComplete"`
+			ValidationGranularity    string `json:"validationGranularity"`
+			HasUnconfirmedComponents bool   `json:"hasUnconfirmedComponents"`
+		} `json:"verdict"`
+		Address struct {
+			PostalAddress struct {
+				RegionCode         string `json:"regionCode"`
+				PostalCode         string `json:"postalCode"`
+				AdministrativeArea string `json:"administrativeArea"`
+				Locality           string `json:"locality"`
+			} `json:"postalAddress"`
+			AddressComponents []struct {
+				ComponentName struct {
+					Text string `json:"text"`
+				} `json:"componentName"`
+				ComponentType string `json:"componentType"`
+			} `json:"addressComponents"`
+		} `json:"address"`
+	} `json:"result"`
+}
+
+// lines returns the street lines of a.
+func lines(a users.Address) []string {
+	ls := []string{strings.TrimSpace(a.Number + " " + a.Street)}
+	if a.Building != "" {
+		ls = append(ls, a.Building)
+	}
+	return ls
+}
+
+// Validate asks Google to validate a.
+func (g *Google) Validate(a users.Address) (users.Address, error) {
+	a, err := Basic(a)
+	if err != nil {
+		return a, err
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"address": map[string]interface{}{
+			"regionCode":         a.Country,
+			"postalCode":         a.PostCode,
+			"administrativeArea": region(a),
+			"locality":           a.City,
+			"addressLines":       lines(a),
+		},
+	})
+	if err != nil {
+		return a, err
+	}
+	resp, err := g.Client.Post(g.URL+"?key="+url.QueryEscape(g.Key), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return a, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return a, fmt.Errorf("google: returned %v", resp.Status)
+	}
+	var r googleResult
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return a, err
+	}
+	v := r.Result.Verdict
+	if !v.AddressComplete || v.HasUnconfirmedComponents ||
+		(v.ValidationGranularity != "PREMISE" && v.ValidationGranularity != "SUB_PREMISE") {
+		return a, nil
+	}
+	p := r.Result.Address.PostalAddress
+	for _, c := range r.Result.Address.AddressComponents {
+		switch c.ComponentType {
+		case "street_number":
+			a.Number = pick(c.ComponentName.Text, a.Number)
+		case "route":
+			a.Street = pick(c.ComponentName.Text, a.Street)
+		}
+	}
+	a.City = pick(p.Locality, a.City)
+	setRegion(&a, p.AdministrativeArea)
+	a.PostCode = pick(p.PostalCode, a.PostCode)
+	a.Country = pick(p.RegionCode, a.Country)
+	a.Validated = true
+	return a, nil
+}
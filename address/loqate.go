@@ -0,0 +1,105 @@
+package address
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"user/users"
+)
+
+// LoqateURL is the Loqate international batch cleansing endpoint.
+const LoqateURL = "https://api.addressy.com/Cleansing/International/Batch/v1.00/json4.ws"
+
+// Loqate validates addresses with the Loqate address verification service.
+// Addresses are first checked by Basic, a match with a verified AVC replaces
+// the posted fields and marks the address validated.
+type Loqate struct {
+	Key    string
+	URL    string
+	Client *http.Client
+}
+
+// NewLoqate returns a Loqate validator using key.
+func NewLoqate(key string) *Loqate {
+	return &Loqate{Key: key, URL: LoqateURL, Client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+type loqateAddress struct {
+	Address1           string `json:",omitempty"`
+	Address2           string `json:",omitempty"`
+	Building           string `json:",omitempty"`
+	Premise            string `json:",omitempty"`
+	Thoroughfare       string `json:",omitempty"`
+	Locality           string `json:",omitempty"`
+	AdministrativeArea string `json:",omitempty"`
+	PostalCode         string `json:",omitempty"`
+	Country            string `json:",omitempty"`
+	AVC                string `json:",omitempty"`
+}
+
+// Validate asks Loqate for the best match of a.
+func (l *Loqate) Validate(a users.Address) (users.Address, error) {
+	a, err := Basic(a)
+	if err != nil {
+		return a, err
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"Key":     l.Key,
+		"Geocode": false,
+		"Addresses": []loqateAddress{{
+			Address1:           strings.TrimSpace(a.Number + " " + a.Street),
+			Address2:           a.Building,
+			Locality:           a.City,
+			AdministrativeArea: region(a),
+			PostalCode:         a.PostCode,
+			Country:            a.Country,
+		}},
+	})
+	if err != nil {
+		return a, err
+	}
+	resp, err := l.Client.Post(l.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return a, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return a, fmt.Errorf("loqate: returned %v", resp.Status)
+	}
+	var results []struct {
+		Matches []loqateAddress
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+		return a, err
+	}
+	if len(results) == 0 || len(results[0].Matches) == 0 {
+		return a, nil
+	}
+	m := results[0].Matches[0]
+	// The first letter of the AVC is the verification status, V for
+	// verified, anything else is at best a partial match.
+	if !strings.HasPrefix(m.AVC, "V") {
+		return a, nil
+	}
+	a.Number = pick(m.Premise, a.Number)
+	a.Street = pick(m.Thoroughfare, a.Street)
+	a.Building = pick(m.Building, a.Building)
+	a.City = pick(m.Locality, a.City)
+	setRegion(&a, m.AdministrativeArea)
+	a.PostCode = pick(m.PostalCode, a.PostCode)
+	a.Country = pick(m.Country, a.Country)
+	a.Validated = true
+	return a, nil
+}
+
+// pick returns s unless it's empty.
+func pick(s, otherwise string) string {
+	if s == "" {
+		return otherwise
+	}
+	return s
+}
@@ -0,0 +1,59 @@
+package api
+
+// bootstrap.go contains the startup routine making sure a fresh deployment
+// has a privileged user to administer it with.
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+
+	"github.com/go-kit/kit/log"
+	"user/db"
+	"user/users"
+)
+
+// DefaultAdminUsername is used when no admin username is configured.
+const DefaultAdminUsername = "admin"
+
+// BootstrapAdmin creates an admin account in store unless one exists
+// already. Without a configured password one is generated and logged once,
+// so it must be changed after the first login.
+func BootstrapAdmin(ctx context.Context, store Store, username, password string, logger log.Logger) error {
+	us, err := store.GetUsers(ctx, db.UserQuery{Role: users.RoleAdmin, Limit: 1})
+	if err != nil {
+		return err
+	}
+	if len(us) > 0 {
+		return nil
+	}
+	if username == "" {
+		username = DefaultAdminUsername
+	}
+	generated := password == ""
+	if generated {
+		password = generatePassword()
+	}
+	u := users.New()
+	u.Username = username
+	u.FirstName = "Admin"
+	u.LastName = "User"
+	u.Password = calculatePassHash(password, u.Salt)
+	u.Roles = []string{users.RoleAdmin}
+	if err := store.CreateUser(ctx, &u); err != nil {
+		return err
+	}
+	if generated {
+		logger.Log("bootstrap", "admin", "username", username, "password", password,
+			"msg", "generated one-time admin password, change it after first login")
+		return nil
+	}
+	logger.Log("bootstrap", "admin", "username", username)
+	return nil
+}
+
+func generatePassword() string {
+	b := make([]byte, 18)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
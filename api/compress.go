@@ -0,0 +1,219 @@
+package api
+
+// compress.go contains the gzip and deflate compression of responses. Only
+// responses of compressible content types reaching the size threshold are
+// compressed, small ones aren't worth the CPU.
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// DefaultCompressMinSize is the smallest response body compressed by default.
+const DefaultCompressMinSize = 1024
+
+// DefaultCompressTypes are the content types compressed by default.
+var DefaultCompressTypes = []string{
+	"application/hal+json",
+	"application/json",
+	"application/x-msgpack",
+	"application/protobuf",
+	"text/csv",
+	"text/html",
+}
+
+// Compression configures CompressHandler.
+type Compression struct {
+	// MinSize is the smallest body compressed, in bytes.
+	MinSize int
+	// Types are the content types compressed, without parameters.
+	Types []string
+	// Level is the compression level, flate.DefaultCompression if zero.
+	Level int
+}
+
+// CompressHandler compresses the responses of next with gzip or deflate,
+// whichever the request's Accept-Encoding prefers.
+func CompressHandler(c Compression, next http.Handler) http.Handler {
+	if c.Level == 0 {
+		c.Level = flate.DefaultCompression
+	}
+	types := make([]string, len(c.Types))
+	for i, t := range c.Types {
+		types[i] = strings.ToLower(strings.TrimSpace(t))
+	}
+	c.Types = types
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		enc := acceptedEncoding(r.Header.Get("Accept-Encoding"))
+		if enc == "" || r.Method == "HEAD" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, c: c, encoding: enc}
+		defer cw.Close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// acceptedEncoding returns the encoding we compress with for an
+// Accept-Encoding header, gzip on ties, or "" for none.
+func acceptedEncoding(header string) string {
+	best, bestQ := "", 0.0
+	for _, e := range strings.Split(header, ",") {
+		params := strings.Split(e, ";")
+		name := strings.ToLower(strings.TrimSpace(params[0]))
+		if name != "gzip" && name != "deflate" {
+			continue
+		}
+		q := 1.0
+		for _, p := range params[1:] {
+			k, v, _ := strings.Cut(strings.TrimSpace(p), "=")
+			if strings.EqualFold(k, "q") {
+				if f, err := strconv.ParseFloat(v, 64); err == nil {
+					q = f
+				}
+			}
+		}
+		if q > bestQ || (q == bestQ && q > 0 && name == "gzip") {
+			best, bestQ = name, q
+		}
+	}
+	return best
+}
+
+// compressWriter buffers the body until it reaches the size threshold or is
+// complete, and then writes it compressed or as is.
+type compressWriter struct {
+	http.ResponseWriter
+	c        Compression
+	encoding string
+	code     int
+	buf      bytes.Buffer
+	decided  bool
+	w        io.WriteCloser
+}
+
+func (cw *compressWriter) WriteHeader(code int) {
+	if cw.code == 0 {
+		cw.code = code
+	}
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if cw.decided {
+		if cw.w != nil {
+			return cw.w.Write(b)
+		}
+		return cw.ResponseWriter.Write(b)
+	}
+	cw.buf.Write(b)
+	if cw.buf.Len() >= cw.c.MinSize {
+		if err := cw.decide(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// decide starts writing the response, compressing it if it is large
+// enough and of a compressible type.
+func (cw *compressWriter) decide(large bool) error {
+	cw.decided = true
+	h := cw.Header()
+	if cw.code == 0 {
+		cw.code = http.StatusOK
+	}
+	if large && cw.compressible() {
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", cw.encoding)
+		if cw.encoding == "gzip" {
+			cw.w, _ = gzip.NewWriterLevel(cw.ResponseWriter, cw.c.Level)
+		} else {
+			cw.w, _ = flate.NewWriter(cw.ResponseWriter, cw.c.Level)
+		}
+	}
+	if cw.typeCompressible() {
+		h.Add("Vary", "Accept-Encoding")
+	}
+	cw.ResponseWriter.WriteHeader(cw.code)
+	b := cw.buf.Bytes()
+	cw.buf = bytes.Buffer{}
+	if cw.w != nil {
+		_, err := cw.w.Write(b)
+		return err
+	}
+	_, err := cw.ResponseWriter.Write(b)
+	return err
+}
+
+func (cw *compressWriter) compressible() bool {
+	h := cw.Header()
+	if h.Get("Content-Encoding") != "" || cw.code == http.StatusNoContent || cw.code == http.StatusNotModified || cw.code < 200 {
+		return false
+	}
+	return cw.typeCompressible()
+}
+
+func (cw *compressWriter) typeCompressible() bool {
+	ct := cw.Header().Get("Content-Type")
+	if ct == "" {
+		ct = http.DetectContentType(cw.buf.Bytes())
+	}
+	ct = strings.ToLower(strings.TrimSpace(strings.Split(ct, ";")[0]))
+	for _, t := range cw.c.Types {
+		if t == ct {
+			return true
+		}
+	}
+	return false
+}
+
+// Flush writes what is buffered, so streamed responses don't wait for the
+// threshold.
+func (cw *compressWriter) Flush() {
+	if !cw.decided {
+		cw.decide(cw.buf.Len() >= cw.c.MinSize)
+	}
+	if f, ok := cw.w.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the server's writer, for http.ResponseController.
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// Hijack lets websocket upgrades through.
+func (cw *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := cw.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, http.ErrNotSupported
+}
+
+// Close finishes the response once the handler returned.
+func (cw *compressWriter) Close() error {
+	if !cw.decided {
+		if cw.code == 0 && cw.buf.Len() == 0 {
+			return nil
+		}
+		if err := cw.decide(false); err != nil {
+			return err
+		}
+	}
+	if cw.w != nil {
+		return cw.w.Close()
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package api
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAcceptedEncoding(t *testing.T) {
+	for header, expected := range map[string]string{
+		"":                        "",
+		"br":                      "",
+		"gzip":                    "gzip",
+		"deflate, gzip":           "gzip",
+		"deflate":                 "deflate",
+		"gzip;q=0.5, deflate":     "deflate",
+		"gzip;q=0, deflate;q=0":   "",
+		"br, GZIP;q=0.8, *;q=0.1": "gzip",
+	} {
+		if enc := acceptedEncoding(header); enc != expected {
+			t.Errorf("%q: expected %q, got %q", header, expected, enc)
+		}
+	}
+}
+
+func TestCompressHandler(t *testing.T) {
+	large := strings.Repeat(`{"username":"eve"}`, 100)
+	h := CompressHandler(Compression{MinSize: 1024, Types: DefaultCompressTypes}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", r.URL.Query().Get("type"))
+		w.WriteHeader(http.StatusCreated)
+		if body := r.URL.Query().Get("body"); body != "" {
+			io.WriteString(w, body)
+			return
+		}
+		io.WriteString(w, large)
+	}))
+	for _, c := range []struct {
+		encoding, query, expected string
+	}{
+		{"gzip", "type=application/hal%2Bjson", "gzip"},
+		{"deflate", "type=application/hal%2Bjson%3B%20charset=utf-8", "deflate"},
+		{"", "type=application/hal%2Bjson", ""},
+		{"gzip", "type=image/png", ""},
+		{"gzip", "type=application/hal%2Bjson&body=small", ""},
+	} {
+		r := httptest.NewRequest("GET", "/customers?"+c.query, nil)
+		r.Header.Set("Accept-Encoding", c.encoding)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusCreated {
+			t.Errorf("%v: expected status kept, got %v", c.query, w.Code)
+		}
+		if enc := w.Header().Get("Content-Encoding"); enc != c.expected {
+			t.Errorf("%v %v: expected encoding %q, got %q", c.encoding, c.query, c.expected, enc)
+			continue
+		}
+		var body io.Reader = w.Body
+		switch c.expected {
+		case "gzip":
+			gr, err := gzip.NewReader(w.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body = gr
+		case "deflate":
+			body = flate.NewReader(w.Body)
+		}
+		b, _ := io.ReadAll(body)
+		expected := large
+		if strings.Contains(c.query, "body=") {
+			expected = "small"
+		}
+		if string(b) != expected {
+			t.Errorf("%v %v: expected the body to round trip, got %v", c.encoding, c.query, string(b))
+		}
+	}
+}
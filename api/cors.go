@@ -0,0 +1,89 @@
+package api
+
+// cors.go contains the CORS handling letting browser based storefronts call
+// the API directly. Preflight requests are answered here, actual requests
+// get the headers allowing the browser to read their response.
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORS configures CORSHandler.
+type CORS struct {
+	// Origins are the origins allowed to call the API, "*" for any. An
+	// origin may wildcard its leftmost subdomain, as in
+	// https://*.example.com.
+	Origins []string
+	// Methods are the methods allowed in preflight requests.
+	Methods []string
+	// Headers are the request headers allowed in preflight requests, "*"
+	// for any.
+	Headers []string
+	// ExposedHeaders are the response headers browsers may read.
+	ExposedHeaders []string
+	// MaxAge is how long browsers may cache a preflight response.
+	MaxAge time.Duration
+}
+
+// CORSHandler adds the CORS headers to the responses of next to the origins
+// allowed by c and answers their preflight requests.
+func CORSHandler(c CORS, next http.Handler) http.Handler {
+	methods := strings.Join(c.Methods, ", ")
+	headers := strings.Join(c.Headers, ", ")
+	exposed := strings.Join(c.ExposedHeaders, ", ")
+	anyHeader := false
+	for _, h := range c.Headers {
+		anyHeader = anyHeader || h == "*"
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		h := w.Header()
+		h.Add("Vary", "Origin")
+		if origin == "" || !c.allowed(origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		h.Set("Access-Control-Allow-Origin", origin)
+		if r.Method != "OPTIONS" || r.Header.Get("Access-Control-Request-Method") == "" {
+			if exposed != "" {
+				h.Set("Access-Control-Expose-Headers", exposed)
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		h.Add("Vary", "Access-Control-Request-Method")
+		h.Add("Vary", "Access-Control-Request-Headers")
+		h.Set("Access-Control-Allow-Methods", methods)
+		if anyHeader {
+			if req := r.Header.Get("Access-Control-Request-Headers"); req != "" {
+				h.Set("Access-Control-Allow-Headers", req)
+			}
+		} else if headers != "" {
+			h.Set("Access-Control-Allow-Headers", headers)
+		}
+		if c.MaxAge > 0 {
+			h.Set("Access-Control-Max-Age", strconv.Itoa(int(c.MaxAge.Seconds())))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func (c CORS) allowed(origin string) bool {
+	origin = strings.ToLower(origin)
+	for _, o := range c.Origins {
+		o = strings.ToLower(strings.TrimSpace(o))
+		if o == "*" || o == origin {
+			return true
+		}
+		if scheme, host, ok := strings.Cut(o, "://*."); ok {
+			prefix := scheme + "://"
+			if strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, "."+host) && len(origin) > len(prefix)+len(host)+1 {
+				return true
+			}
+		}
+	}
+	return false
+}
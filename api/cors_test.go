@@ -0,0 +1,80 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCORSAllowed(t *testing.T) {
+	c := CORS{Origins: []string{"https://shop.example.com", "https://*.storefront.io"}}
+	for origin, expected := range map[string]bool{
+		"https://shop.example.com":     true,
+		"https://SHOP.example.com":     true,
+		"http://shop.example.com":      false,
+		"https://eu.storefront.io":     true,
+		"https://a.eu.storefront.io":   true,
+		"https://storefront.io":        false,
+		"https://.storefront.io":       false,
+		"https://evilstorefront.io":    false,
+		"https://storefront.io.evil.c": false,
+	} {
+		if c.allowed(origin) != expected {
+			t.Errorf("%v: expected allowed %v", origin, expected)
+		}
+	}
+	if !(CORS{Origins: []string{"*"}}).allowed("https://anything.test") {
+		t.Error("expected * to allow any origin")
+	}
+}
+
+func TestCORSHandler(t *testing.T) {
+	reached := false
+	h := CORSHandler(CORS{
+		Origins:        []string{"https://shop.example.com"},
+		Methods:        []string{"GET", "POST"},
+		Headers:        []string{"Authorization", "Content-Type"},
+		ExposedHeaders: []string{"Location"},
+		MaxAge:         10 * time.Minute,
+	}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached = true
+	}))
+
+	r := httptest.NewRequest("OPTIONS", "/customers", nil)
+	r.Header.Set("Origin", "https://shop.example.com")
+	r.Header.Set("Access-Control-Request-Method", "POST")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if reached || w.Code != http.StatusNoContent {
+		t.Errorf("expected preflight answered, got %v", w.Code)
+	}
+	for k, v := range map[string]string{
+		"Access-Control-Allow-Origin":  "https://shop.example.com",
+		"Access-Control-Allow-Methods": "GET, POST",
+		"Access-Control-Allow-Headers": "Authorization, Content-Type",
+		"Access-Control-Max-Age":       "600",
+	} {
+		if w.Header().Get(k) != v {
+			t.Errorf("expected %v %v, got %v", k, v, w.Header().Get(k))
+		}
+	}
+
+	r = httptest.NewRequest("GET", "/customers", nil)
+	r.Header.Set("Origin", "https://shop.example.com")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if !reached || w.Header().Get("Access-Control-Allow-Origin") != "https://shop.example.com" || w.Header().Get("Access-Control-Expose-Headers") != "Location" {
+		t.Errorf("expected request passed with CORS headers, got %v", w.Header())
+	}
+
+	reached = false
+	r = httptest.NewRequest("OPTIONS", "/customers", nil)
+	r.Header.Set("Origin", "https://evil.example.com")
+	r.Header.Set("Access-Control-Request-Method", "POST")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if !reached || w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("expected other origins passed without CORS headers, got %v", w.Header())
+	}
+}
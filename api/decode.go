@@ -0,0 +1,82 @@
+package api
+
+// decode.go contains the decoding of JSON request bodies. By default
+// unknown members are ignored, as they always were. Deployments can opt in
+// to strict decoding, rejecting unknown members, mistyped values and
+// trailing data with the offending field, to catch client bugs such as a
+// misspelled userID early.
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+
+	"user/users"
+)
+
+// strictJSON rejects request bodies with unknown members.
+var strictJSON bool
+
+func init() {
+	flag.BoolVar(&strictJSON, "strict-json", os.Getenv("STRICT_JSON") == "true", "Reject request bodies with unknown members or mistyped values")
+}
+
+// decodeJSON decodes the request body r into v, strictly if the deployment
+// asks for it.
+func decodeJSON(r io.Reader, v interface{}) error {
+	return decodeBody(r, v, strictJSON)
+}
+
+// decodeBody decodes r into v. Strict decoding fails with an invalid
+// request naming the field at fault.
+func decodeBody(r io.Reader, v interface{}, strict bool) error {
+	d := json.NewDecoder(r)
+	if !strict {
+		return d.Decode(v)
+	}
+	d.DisallowUnknownFields()
+	if err := d.Decode(v); err != nil {
+		return invalid(fieldError(err))
+	}
+	if _, err := d.Token(); err != io.EOF {
+		return invalid(errors.New("unexpected data after the JSON document"))
+	}
+	return nil
+}
+
+// fieldError returns the users.FieldError of unknown members and mistyped
+// values, other errors as they are.
+func fieldError(err error) error {
+	var te *json.UnmarshalTypeError
+	if errors.As(err, &te) && te.Field != "" {
+		return &users.FieldError{Field: te.Field, Reason: fmt.Sprintf("expected %v, got %v", jsonKind(te.Type), te.Value)}
+	}
+	if f, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		return &users.FieldError{Field: strings.Trim(f, `"`), Reason: "unknown field"}
+	}
+	return err
+}
+
+// jsonKind names the JSON type a Go type is decoded from.
+func jsonKind(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	case reflect.Ptr:
+		return jsonKind(t.Elem())
+	}
+	return "an object"
+}
@@ -0,0 +1,39 @@
+package api
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"user/users"
+)
+
+func TestDecodeStrictJSON(t *testing.T) {
+	body := `{"street":"Main","number":"1","user_id":"57a98d98e4b00679b4a830af"}`
+	if _, err := decodeAddressRequest(nil, httptest.NewRequest("POST", "/addresses", strings.NewReader(body))); err != nil {
+		t.Errorf("expected unknown members ignored by default, got %v", err)
+	}
+
+	strictJSON = true
+	defer func() { strictJSON = false }()
+	for body, field := range map[string]string{
+		`{"street":"Main","user_id":"57a98d98e4b00679b4a830af"}`: "user_id",
+		`{"street":"Main","default":"yes"}`:                      "default",
+		`{"street":"Main","location":{"lat":"north"}}`:           "location.lat",
+	} {
+		_, err := decodeAddressRequest(nil, httptest.NewRequest("POST", "/addresses", strings.NewReader(body)))
+		var fe *users.FieldError
+		if !errors.Is(err, ErrInvalidRequest) || !errors.As(err, &fe) || fe.Field != field {
+			t.Errorf("expected %v rejected, got %v", field, err)
+		}
+	}
+	_, err := decodeAddressRequest(nil, httptest.NewRequest("POST", "/addresses", strings.NewReader(`{"street":"Main"} {}`)))
+	if !errors.Is(err, ErrInvalidRequest) {
+		t.Errorf("expected trailing data rejected, got %v", err)
+	}
+	req, err := decodeAddressRequest(nil, httptest.NewRequest("POST", "/addresses", strings.NewReader(`{"street":"Main","userID":"1"}`)))
+	if err != nil || req.(addressPostRequest).UserID != "1" {
+		t.Errorf("expected a valid body decoded, got %v %v", req, err)
+	}
+}
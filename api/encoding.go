@@ -0,0 +1,236 @@
+package api
+
+// encoding.go contains the response encodings negotiated through the Accept
+// header. Browsers and most clients get JSON, internal callers can ask for
+// MessagePack or Protocol Buffers to save on serialization overhead. Both
+// binary encodings carry the same document as the JSON one.
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+const (
+	// MediaTypeJSON is the default media type of our responses.
+	MediaTypeJSON = "application/hal+json"
+	// MediaTypeMsgPack is the media type of MessagePack encoded responses.
+	MediaTypeMsgPack = "application/x-msgpack"
+	// MediaTypeProtobuf is the media type of responses encoded as a
+	// google.protobuf.Value message.
+	MediaTypeProtobuf = "application/protobuf"
+)
+
+// mediaTypes maps the accepted media types to the one we respond with.
+var mediaTypes = map[string]string{
+	"application/hal+json":   MediaTypeJSON,
+	"application/json":       MediaTypeJSON,
+	"application/*":          MediaTypeJSON,
+	"*/*":                    MediaTypeJSON,
+	"application/x-msgpack":  MediaTypeMsgPack,
+	"application/msgpack":    MediaTypeMsgPack,
+	"application/protobuf":   MediaTypeProtobuf,
+	"application/x-protobuf": MediaTypeProtobuf,
+}
+
+// AcceptToContext moves the Accept header into the request context for the
+// response encoders.
+func AcceptToContext(ctx context.Context, r *http.Request) context.Context {
+	if a := r.Header.Get("Accept"); a != "" {
+		return context.WithValue(ctx, acceptContextKey, a)
+	}
+	return ctx
+}
+
+// negotiate returns the media type to respond with for an Accept header,
+// preferring the highest quality and then the first listed. Requests
+// accepting nothing we support get JSON.
+func negotiate(accept string) string {
+	best, bestQ := MediaTypeJSON, 0.0
+	for _, r := range strings.Split(accept, ",") {
+		params := strings.Split(r, ";")
+		mt, ok := mediaTypes[strings.ToLower(strings.TrimSpace(params[0]))]
+		if !ok {
+			continue
+		}
+		q := 1.0
+		for _, p := range params[1:] {
+			k, v, _ := strings.Cut(strings.TrimSpace(p), "=")
+			if strings.EqualFold(k, "q") {
+				if f, err := strconv.ParseFloat(v, 64); err == nil {
+					q = f
+				}
+			}
+		}
+		if q > bestQ {
+			best, bestQ = mt, q
+		}
+	}
+	return best
+}
+
+// writeResponse writes v with status code in the media type negotiated from
+// the Accept header in ctx.
+func writeResponse(ctx context.Context, w http.ResponseWriter, code int, v interface{}) error {
+	accept, _ := ctx.Value(acceptContextKey).(string)
+	mt := negotiate(accept)
+	w.Header().Add("Vary", "Accept")
+	if mt == MediaTypeJSON {
+		if plainJSON {
+			mt = "application/json"
+		}
+		w.Header().Set("Content-Type", mt)
+		if code != 0 {
+			w.WriteHeader(code)
+		}
+		return json.NewEncoder(w).Encode(v)
+	}
+	var (
+		b   []byte
+		err error
+	)
+	switch mt {
+	case MediaTypeMsgPack:
+		b, err = marshalMsgPack(v)
+	case MediaTypeProtobuf:
+		b, err = marshalProtobuf(v)
+	}
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", mt)
+	if code != 0 {
+		w.WriteHeader(code)
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// generic returns v as decoded from its JSON encoding, so the binary
+// encodings follow the json tags and marshalers of our types.
+func generic(v interface{}, useNumber bool) (interface{}, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	if useNumber {
+		d.UseNumber()
+	}
+	var g interface{}
+	err = d.Decode(&g)
+	return g, err
+}
+
+func marshalProtobuf(v interface{}) ([]byte, error) {
+	g, err := generic(v, false)
+	if err != nil {
+		return nil, err
+	}
+	pv, err := structpb.NewValue(g)
+	if err != nil {
+		return nil, err
+	}
+	return proto.MarshalOptions{Deterministic: true}.Marshal(pv)
+}
+
+func marshalMsgPack(v interface{}) ([]byte, error) {
+	g, err := generic(v, true)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	writeMsgPack(&buf, g)
+	return buf.Bytes(), nil
+}
+
+// writeMsgPack appends the MessagePack encoding of a decoded JSON value,
+// using the smallest representation of every value. Map keys are sorted.
+func writeMsgPack(buf *bytes.Buffer, v interface{}) {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if v {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			writeMsgPackInt(buf, i)
+			return
+		}
+		f, _ := v.Float64()
+		buf.WriteByte(0xcb)
+		binary.Write(buf, binary.BigEndian, math.Float64bits(f))
+	case string:
+		writeMsgPackHeader(buf, len(v), 0xa0, 32, 0xd9, 0xda, 0xdb)
+		buf.WriteString(v)
+	case []interface{}:
+		writeMsgPackHeader(buf, len(v), 0x90, 16, 0, 0xdc, 0xdd)
+		for _, e := range v {
+			writeMsgPack(buf, e)
+		}
+	case map[string]interface{}:
+		writeMsgPackHeader(buf, len(v), 0x80, 16, 0, 0xde, 0xdf)
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			writeMsgPack(buf, k)
+			writeMsgPack(buf, v[k])
+		}
+	}
+}
+
+// writeMsgPackHeader writes the type and length of a string, array or map:
+// the fix format below fixMax, else the 8, 16 or 32 bit one. Arrays and maps
+// have no 8 bit format.
+func writeMsgPackHeader(buf *bytes.Buffer, n int, fix byte, fixMax int, f8, f16, f32 byte) {
+	switch {
+	case n < fixMax:
+		buf.WriteByte(fix | byte(n))
+	case f8 != 0 && n <= math.MaxUint8:
+		buf.WriteByte(f8)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(f16)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(f32)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+}
+
+func writeMsgPackInt(buf *bytes.Buffer, i int64) {
+	switch {
+	case i >= 0 && i < 128:
+		buf.WriteByte(byte(i))
+	case i < 0 && i >= -32:
+		buf.WriteByte(byte(int8(i)))
+	case i >= math.MinInt8 && i <= math.MaxInt8:
+		buf.WriteByte(0xd0)
+		buf.WriteByte(byte(int8(i)))
+	case i >= math.MinInt16 && i <= math.MaxInt16:
+		buf.WriteByte(0xd1)
+		binary.Write(buf, binary.BigEndian, int16(i))
+	case i >= math.MinInt32 && i <= math.MaxInt32:
+		buf.WriteByte(0xd2)
+		binary.Write(buf, binary.BigEndian, int32(i))
+	default:
+		buf.WriteByte(0xd3)
+		binary.Write(buf, binary.BigEndian, i)
+	}
+}
@@ -0,0 +1,91 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+	"user/users"
+)
+
+func TestNegotiate(t *testing.T) {
+	for accept, expected := range map[string]string{
+		"":                                  MediaTypeJSON,
+		"*/*":                               MediaTypeJSON,
+		"text/html":                         MediaTypeJSON,
+		"application/json":                  MediaTypeJSON,
+		"application/x-msgpack":             MediaTypeMsgPack,
+		"Application/MsgPack":               MediaTypeMsgPack,
+		"application/x-protobuf, */*;q=0.1": MediaTypeProtobuf,
+		"application/json;q=0.5, application/protobuf":      MediaTypeProtobuf,
+		"application/x-msgpack;q=0, application/json":       MediaTypeJSON,
+		"application/protobuf, application/x-msgpack":       MediaTypeProtobuf,
+		"text/html, application/x-msgpack;q=0.9, */*;q=0.8": MediaTypeMsgPack,
+	} {
+		if mt := negotiate(accept); mt != expected {
+			t.Errorf("%q: expected %v, got %v", accept, expected, mt)
+		}
+	}
+}
+
+func TestMarshalMsgPack(t *testing.T) {
+	for _, c := range []struct {
+		v        interface{}
+		expected []byte
+	}{
+		{nil, []byte{0xc0}},
+		{true, []byte{0xc3}},
+		{5, []byte{0x05}},
+		{-1, []byte{0xff}},
+		{200, []byte{0xd1, 0x00, 0xc8}},
+		{1.5, []byte{0xcb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0}},
+		{"eve", []byte{0xa3, 'e', 'v', 'e'}},
+		{strings.Repeat("a", 40), append([]byte{0xd9, 40}, strings.Repeat("a", 40)...)},
+		{[]int{1, 2}, []byte{0x92, 0x01, 0x02}},
+		{map[string]bool{"b": false, "a": true}, []byte{0x82, 0xa1, 'a', 0xc3, 0xa1, 'b', 0xc2}},
+	} {
+		b, err := marshalMsgPack(c.v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, c.expected) {
+			t.Errorf("%v: expected %x, got %x", c.v, c.expected, b)
+		}
+	}
+}
+
+func TestEncodeResponseProtobuf(t *testing.T) {
+	ctx := context.WithValue(context.Background(), acceptContextKey, "application/protobuf")
+	w := httptest.NewRecorder()
+	resp := EmbedStruct{usersResponse{Users: []users.User{{Username: "eve"}}}}
+	if err := V2.encodeResponse(ctx, w, resp); err != nil {
+		t.Fatal(err)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != MediaTypeProtobuf {
+		t.Errorf("expected protobuf content type, got %v", ct)
+	}
+	var v structpb.Value
+	if err := proto.Unmarshal(w.Body.Bytes(), &v); err != nil {
+		t.Fatal(err)
+	}
+	customers := v.GetStructValue().Fields["_embedded"].GetStructValue().Fields["customers"].GetListValue()
+	if customers == nil || customers.Values[0].GetStructValue().Fields["username"].GetStringValue() != "eve" {
+		t.Errorf("expected the v2 document, got %v", &v)
+	}
+}
+
+func TestEncodeErrorMsgPack(t *testing.T) {
+	ctx := context.WithValue(context.Background(), acceptContextKey, "application/x-msgpack")
+	w := httptest.NewRecorder()
+	encodeError(ctx, ErrForbidden, w)
+	if w.Code != 403 || w.Header().Get("Content-Type") != MediaTypeMsgPack {
+		t.Errorf("expected msgpack 403, got %v %v", w.Code, w.Header().Get("Content-Type"))
+	}
+	if !bytes.Contains(w.Body.Bytes(), []byte("\xa5error\xa9Forbidden")) {
+		t.Errorf("expected msgpack error body, got %x", w.Body.Bytes())
+	}
+}
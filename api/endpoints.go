@@ -5,43 +5,135 @@ package api
 // transport.
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
+	"io"
+	"net/http"
+	"time"
 
 	"github.com/go-kit/kit/endpoint"
+	"user/auth"
+	"user/changes"
 	"user/db"
+	"user/graphql"
+	"user/patch"
+	"user/risk"
 	"user/users"
 )
 
 // Endpoints collects the endpoints that comprise the Service.
 type Endpoints struct {
-	LoginEndpoint       endpoint.Endpoint
-	RegisterEndpoint    endpoint.Endpoint
-	UserGetEndpoint     endpoint.Endpoint
-	UserPostEndpoint    endpoint.Endpoint
-	AddressGetEndpoint  endpoint.Endpoint
-	AddressPostEndpoint endpoint.Endpoint
-	CardGetEndpoint     endpoint.Endpoint
-	CardPostEndpoint    endpoint.Endpoint
-	DeleteEndpoint      endpoint.Endpoint
-	HealthEndpoint      endpoint.Endpoint
+	LoginEndpoint             endpoint.Endpoint
+	RegisterEndpoint          endpoint.Endpoint
+	GuestEndpoint             endpoint.Endpoint
+	AvailableEndpoint         endpoint.Endpoint
+	UserGetEndpoint           endpoint.Endpoint
+	UserPostEndpoint          endpoint.Endpoint
+	UserPutEndpoint           endpoint.Endpoint
+	UserPatchEndpoint         endpoint.Endpoint
+	AvatarPutEndpoint         endpoint.Endpoint
+	PreferencesPutEndpoint    endpoint.Endpoint
+	PhoneCodeEndpoint         endpoint.Endpoint
+	PhoneVerifyEndpoint       endpoint.Endpoint
+	StatusPutEndpoint         endpoint.Endpoint
+	TagPutEndpoint            endpoint.Endpoint
+	RenameEndpoint            endpoint.Endpoint
+	AdminListEndpoint         endpoint.Endpoint
+	AdminCardsEndpoint        endpoint.Endpoint
+	ExportEndpoint            endpoint.Endpoint
+	EventStreamEndpoint       endpoint.Endpoint
+	NotificationsEndpoint     endpoint.Endpoint
+	StatsEndpoint             endpoint.Endpoint
+	MergeEndpoint             endpoint.Endpoint
+	ResetPasswordEndpoint     endpoint.Endpoint
+	GroupPostEndpoint         endpoint.Endpoint
+	GroupGetEndpoint          endpoint.Endpoint
+	UserGroupsEndpoint        endpoint.Endpoint
+	ActivityEndpoint          endpoint.Endpoint
+	GroupMemberPostEndpoint   endpoint.Endpoint
+	GroupMemberDeleteEndpoint endpoint.Endpoint
+	TagDeleteEndpoint         endpoint.Endpoint
+	WebhookPostEndpoint       endpoint.Endpoint
+	WebhooksGetEndpoint       endpoint.Endpoint
+	WebhookDeleteEndpoint     endpoint.Endpoint
+	WebhookDeliveriesEndpoint endpoint.Endpoint
+	AddressGetEndpoint        endpoint.Endpoint
+	AddressPostEndpoint       endpoint.Endpoint
+	AddressPatchEndpoint      endpoint.Endpoint
+	AddressImportEndpoint     endpoint.Endpoint
+	BatchEndpoint             endpoint.Endpoint
+	CardGetEndpoint           endpoint.Endpoint
+	CardPostEndpoint          endpoint.Endpoint
+	CardPutEndpoint           endpoint.Endpoint
+	CardDefaultEndpoint       endpoint.Endpoint
+	DeleteEndpoint            endpoint.Endpoint
+	BulkDeleteEndpoint        endpoint.Endpoint
+	BatchGetEndpoint          endpoint.Endpoint
+	IntrospectEndpoint        endpoint.Endpoint
+	GraphQLEndpoint           endpoint.Endpoint
+	HealthEndpoint            endpoint.Endpoint
+	LiveEndpoint              endpoint.Endpoint
+	ReadyEndpoint             endpoint.Endpoint
 }
 
 // MakeEndpoints returns an Endpoints structure, where each endpoint is
 // backed by the given service.
 func MakeEndpoints(s Service) Endpoints {
 	return Endpoints{
-		LoginEndpoint:       MakeLoginEndpoint(s),
-		RegisterEndpoint:    MakeRegisterEndpoint(s),
-		HealthEndpoint:      MakeHealthEndpoint(s),
-		UserGetEndpoint:     MakeUserGetEndpoint(s),
-		UserPostEndpoint:    MakeUserPostEndpoint(s),
-		AddressGetEndpoint:  MakeAddressGetEndpoint(s),
-		AddressPostEndpoint: MakeAddressPostEndpoint(s),
-		CardGetEndpoint:     MakeCardGetEndpoint(s),
-		DeleteEndpoint:      MakeDeleteEndpoint(s),
-		CardPostEndpoint:    MakeCardPostEndpoint(s),
+		LoginEndpoint:             MakeLoginEndpoint(s),
+		RegisterEndpoint:          ValidationMiddleware(IdempotencyMiddleware(s, "register")(MakeRegisterEndpoint(s))),
+		GuestEndpoint:             MakeGuestEndpoint(s),
+		AvailableEndpoint:         MakeAvailableEndpoint(s),
+		HealthEndpoint:            MakeHealthEndpoint(s),
+		LiveEndpoint:              MakeLiveEndpoint(s),
+		ReadyEndpoint:             MakeReadyEndpoint(s),
+		UserGetEndpoint:           ScopeMiddleware(s, "customers")(MakeUserGetEndpoint(s)),
+		UserPostEndpoint:          IdempotencyMiddleware(s, "customers")(MakeUserPostEndpoint(s)),
+		UserPutEndpoint:           ScopeMiddleware(s, "customers")(MakeUserPutEndpoint(s)),
+		UserPatchEndpoint:         ScopeMiddleware(s, "customers")(MakeUserPatchEndpoint(s)),
+		AvatarPutEndpoint:         ScopeMiddleware(s, "customers")(MakeAvatarPutEndpoint(s)),
+		PreferencesPutEndpoint:    ScopeMiddleware(s, "customers")(MakePreferencesPutEndpoint(s)),
+		PhoneCodeEndpoint:         ScopeMiddleware(s, "customers")(MakePhoneCodeEndpoint(s)),
+		PhoneVerifyEndpoint:       ScopeMiddleware(s, "customers")(MakePhoneVerifyEndpoint(s)),
+		StatusPutEndpoint:         ScopeMiddleware(s, "customers")(MakeStatusPutEndpoint(s)),
+		TagPutEndpoint:            ScopeMiddleware(s, "customers")(MakeTagPutEndpoint(s)),
+		RenameEndpoint:            ScopeMiddleware(s, "customers")(MakeRenameEndpoint(s)),
+		AdminListEndpoint:         AdminMiddleware(s)(MakeAdminListEndpoint(s)),
+		AdminCardsEndpoint:        AdminMiddleware(s)(MakeAdminCardsEndpoint(s)),
+		ExportEndpoint:            AdminMiddleware(s)(MakeExportEndpoint(s)),
+		EventStreamEndpoint:       ScopeMiddleware(s, "")(MakeEventStreamEndpoint(s)),
+		NotificationsEndpoint:     ScopeMiddleware(s, "customers")(MakeNotificationsEndpoint(s)),
+		StatsEndpoint:             AdminMiddleware(s)(MakeStatsEndpoint(s)),
+		MergeEndpoint:             AdminMiddleware(s)(MakeMergeEndpoint(s)),
+		ResetPasswordEndpoint:     AdminMiddleware(s)(MakeResetPasswordEndpoint(s)),
+		GroupPostEndpoint:         ScopeMiddleware(s, "groups")(MakeGroupPostEndpoint(s)),
+		GroupGetEndpoint:          ScopeMiddleware(s, "groups")(MakeGroupGetEndpoint(s)),
+		UserGroupsEndpoint:        ScopeMiddleware(s, "customers")(MakeUserGroupsEndpoint(s)),
+		ActivityEndpoint:          ScopeMiddleware(s, "customers")(MakeActivityEndpoint(s)),
+		GroupMemberPostEndpoint:   ScopeMiddleware(s, "groups")(MakeGroupMemberPostEndpoint(s)),
+		GroupMemberDeleteEndpoint: ScopeMiddleware(s, "groups")(MakeGroupMemberDeleteEndpoint(s)),
+		TagDeleteEndpoint:         ScopeMiddleware(s, "customers")(MakeTagDeleteEndpoint(s)),
+		WebhookPostEndpoint:       AdminMiddleware(s)(MakeWebhookPostEndpoint(s)),
+		WebhooksGetEndpoint:       AdminMiddleware(s)(MakeWebhooksGetEndpoint(s)),
+		WebhookDeleteEndpoint:     AdminMiddleware(s)(MakeWebhookDeleteEndpoint(s)),
+		WebhookDeliveriesEndpoint: AdminMiddleware(s)(MakeWebhookDeliveriesEndpoint(s)),
+		AddressGetEndpoint:        ScopeMiddleware(s, "addresses")(MakeAddressGetEndpoint(s)),
+		AddressPatchEndpoint:      ScopeMiddleware(s, "addresses")(MakeAddressPatchEndpoint(s)),
+		AddressPostEndpoint:       ScopeMiddleware(s, "addresses")(ValidationMiddleware(IdempotencyMiddleware(s, "addresses")(MakeAddressPostEndpoint(s)))),
+		AddressImportEndpoint:     ScopeMiddleware(s, "customers")(MakeAddressImportEndpoint(s)),
+		BatchEndpoint:             ScopeMiddleware(s, "customers")(MakeBatchEndpoint(s)),
+		CardGetEndpoint:           ScopeMiddleware(s, "cards")(MakeCardGetEndpoint(s)),
+		DeleteEndpoint:            ScopeMiddleware(s, "")(MakeDeleteEndpoint(s)),
+		BulkDeleteEndpoint:        AdminMiddleware(s)(MakeBulkDeleteEndpoint(s)),
+		BatchGetEndpoint:          AdminMiddleware(s)(MakeBatchGetEndpoint(s)),
+		CardPostEndpoint:          ScopeMiddleware(s, "cards")(ValidationMiddleware(IdempotencyMiddleware(s, "cards")(MakeCardPostEndpoint(s)))),
+		CardPutEndpoint:           ScopeMiddleware(s, "cards")(MakeCardPutEndpoint(s)),
+		CardDefaultEndpoint:       ScopeMiddleware(s, "cards")(MakeCardDefaultEndpoint(s)),
+		IntrospectEndpoint:        MakeIntrospectEndpoint(s),
+		GraphQLEndpoint:           MakeGraphQLEndpoint(s),
 	}
 }
 
@@ -49,12 +141,16 @@ func MakeEndpoints(s Service) Endpoints {
 func MakeLoginEndpoint(s Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
 		tr := otel.Tracer("Login")
-		_, span := tr.Start(ctx, "Login")
+		ctx, span := tr.Start(ctx, "Login")
 		span.SetAttributes(attribute.Key("service").String("user"))
 		defer span.End()
 		req := request.(loginRequest)
-		u, err := s.Login(req.Username, req.Password)
-		return userResponse{User: u}, err
+		u, err := s.Login(ctx, req.Username, req.Password, req.Client)
+		if err != nil {
+			return userResponse{User: u}, err
+		}
+		tok, err := s.IssueToken(u, req.Scopes)
+		return userResponse{User: u, Token: tok}, err
 	}
 }
 
@@ -62,15 +158,43 @@ func MakeLoginEndpoint(s Service) endpoint.Endpoint {
 func MakeRegisterEndpoint(s Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
 		tr := otel.Tracer("Register")
-		_, span := tr.Start(ctx, "register")
+		ctx, span := tr.Start(ctx, "register")
 		span.SetAttributes(attribute.Key("service").String("user"))
 		defer span.End()
 		req := request.(registerRequest)
-		id, err := s.Register(req.Username, req.Password, req.Email, req.FirstName, req.LastName)
+		if req.UpgradeToken != "" {
+			id, err := s.Upgrade(ctx, req.UpgradeToken, req.Username, req.Password, req.Email, req.FirstName, req.LastName)
+			return postResponse{ID: id}, err
+		}
+		id, err := s.Register(ctx, req.Username, req.Password, req.Email, req.FirstName, req.LastName, req.Phone)
 		return postResponse{ID: id}, err
 	}
 }
 
+// MakeGuestEndpoint returns an endpoint via the given service.
+func MakeGuestEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		tr := otel.Tracer("Guest")
+		ctx, span := tr.Start(ctx, "guest")
+		span.SetAttributes(attribute.Key("service").String("user"))
+		defer span.End()
+		u, tok, err := s.CreateGuest(ctx)
+		return userResponse{User: u, Token: tok}, err
+	}
+}
+
+// MakeAvailableEndpoint returns an endpoint via the given service.
+func MakeAvailableEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		tr := otel.Tracer("Available")
+		ctx, span := tr.Start(ctx, "Available")
+		span.SetAttributes(attribute.Key("service").String("user"))
+		defer span.End()
+		req := request.(availableRequest)
+		return s.Available(ctx, req.Username, req.Email)
+	}
+}
+
 // MakeUserGetEndpoint returns an endpoint via the given service.
 func MakeUserGetEndpoint(s Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
@@ -82,11 +206,22 @@ func MakeUserGetEndpoint(s Service) endpoint.Endpoint {
 		req := request.(GetRequest)
 
 		ctx, userspan := tr.Start(ctx, "users from db")
-		usrs, err := s.GetUsers(req.ID)
-		userspan.End()
 		if req.ID == "" {
+			usrs, err := s.FindUsers(ctx, req.Query)
+			userspan.End()
+			if err == nil && len(req.Expand) > 0 {
+				ctx, expandspan := tr.Start(ctx, "expand from db")
+				defer expandspan.End()
+				docs, err := expandUsers(ctx, s, usrs, req)
+				return EmbedStruct{expandedUsersResponse{Users: docs}}, err
+			}
+			if err == nil && len(req.Fields) > 0 {
+				return sparseUsers(usrs, req.Fields)
+			}
 			return EmbedStruct{usersResponse{Users: usrs}}, err
 		}
+		usrs, err := s.GetUsers(ctx, req.ID)
+		userspan.End()
 		if len(usrs) == 0 {
 			if req.Attr == "addresses" {
 				return EmbedStruct{addressesResponse{Addresses: make([]users.Address, 0)}}, err
@@ -97,11 +232,22 @@ func MakeUserGetEndpoint(s Service) endpoint.Endpoint {
 			return users.User{}, err
 		}
 		user := usrs[0]
+		if req.Attr == "preferences" {
+			return user.GetPreferences(), err
+		}
+		if req.Attr == "" && err == nil && len(req.Expand) > 0 {
+			ctx, expandspan := tr.Start(ctx, "expand from db")
+			defer expandspan.End()
+			return expandUser(ctx, s, user, req)
+		}
+		if req.Attr == "" && err == nil && len(req.Fields) > 0 {
+			return user.Select(req.Fields)
+		}
 		ctx, attributespan := tr.Start(ctx, "attributes from db")
-		db.GetUserAttributes(&user)
+		s.GetUserAttributes(ctx, &user)
 		attributespan.End()
 		if req.Attr == "addresses" {
-			return EmbedStruct{addressesResponse{Addresses: user.Addresses}}, err
+			return EmbedStruct{addressesResponse{Addresses: users.FilterAddresses(user.Addresses, req.Type)}}, err
 		}
 		if req.Attr == "cards" {
 			return EmbedStruct{cardsResponse{Cards: user.Cards}}, err
@@ -110,6 +256,52 @@ func MakeUserGetEndpoint(s Service) endpoint.Endpoint {
 	}
 }
 
+// expandUser returns the user, its fields selected, with the attributes
+// named by expand embedded.
+func expandUser(ctx context.Context, s Service, u users.User, req GetRequest) (expandedUser, error) {
+	docs, err := expandUsers(ctx, s, []users.User{u}, req)
+	if err != nil {
+		return nil, err
+	}
+	return docs[0], nil
+}
+
+// expandUsers returns the users as for expandUser. The attributes of all of
+// them are loaded together, not user by user.
+func expandUsers(ctx context.Context, s Service, us []users.User, req GetRequest) ([]expandedUser, error) {
+	if err := s.ExpandUsers(ctx, us, req.Expand); err != nil {
+		return nil, err
+	}
+	docs := make([]expandedUser, 0, len(us))
+	for _, u := range us {
+		var doc map[string]interface{}
+		var err error
+		if len(req.Fields) > 0 {
+			doc, err = u.Select(req.Fields)
+		} else {
+			var b []byte
+			if b, err = json.Marshal(u); err == nil {
+				err = json.Unmarshal(b, &doc)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		embedded := map[string]interface{}{}
+		for _, a := range req.Expand {
+			switch a {
+			case "addresses":
+				embedded["address"] = u.Addresses
+			case "cards":
+				embedded["card"] = u.Cards
+			}
+		}
+		doc["_embedded"] = embedded
+		docs = append(docs, doc)
+	}
+	return docs, nil
+}
+
 // MakeUserPostEndpoint returns an endpoint via the given service.
 func MakeUserPostEndpoint(s Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
@@ -118,11 +310,380 @@ func MakeUserPostEndpoint(s Service) endpoint.Endpoint {
 		span.SetAttributes(attribute.Key("service").String("user"))
 		defer span.End()
 		req := request.(users.User)
-		id, err := s.PostUser(req)
+		id, err := s.PostUser(ctx, req)
 		return postResponse{ID: id}, err
 	}
 }
 
+// MakeUserPutEndpoint returns an endpoint via the given service.
+func MakeUserPutEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		tr := otel.Tracer("Put User")
+		ctx, span := tr.Start(ctx, "Put User")
+		span.SetAttributes(attribute.Key("service").String("user"))
+		defer span.End()
+		req := request.(userUpdateRequest)
+		if err := req.Update.Complete(); err != nil {
+			return nil, invalid(err)
+		}
+		return s.UpdateUser(ctx, req.ID, req.Update)
+	}
+}
+
+// MakeUserPatchEndpoint returns an endpoint via the given service.
+func MakeUserPatchEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		tr := otel.Tracer("Patch User")
+		ctx, span := tr.Start(ctx, "Patch User")
+		span.SetAttributes(attribute.Key("service").String("user"))
+		defer span.End()
+		req := request.(userUpdateRequest)
+		if req.Patch != nil {
+			return s.PatchUser(ctx, req.ID, req.Patch)
+		}
+		return s.UpdateUser(ctx, req.ID, req.Update)
+	}
+}
+
+// MakeAvatarPutEndpoint returns an endpoint via the given service.
+func MakeAvatarPutEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		tr := otel.Tracer("Put Avatar")
+		ctx, span := tr.Start(ctx, "Put Avatar")
+		span.SetAttributes(attribute.Key("service").String("user"))
+		defer span.End()
+		req := request.(avatarPutRequest)
+		return s.SetAvatar(ctx, req.ID, bytes.NewReader(req.Image))
+	}
+}
+
+// MakePreferencesPutEndpoint returns an endpoint via the given service.
+func MakePreferencesPutEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		tr := otel.Tracer("Put Preferences")
+		ctx, span := tr.Start(ctx, "Put Preferences")
+		span.SetAttributes(attribute.Key("service").String("user"))
+		defer span.End()
+		req := request.(preferencesPutRequest)
+		return s.SetPreferences(ctx, req.ID, req.Preferences)
+	}
+}
+
+// MakePhoneCodeEndpoint returns an endpoint via the given service.
+func MakePhoneCodeEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		tr := otel.Tracer("Send Phone Code")
+		ctx, span := tr.Start(ctx, "Send Phone Code")
+		span.SetAttributes(attribute.Key("service").String("user"))
+		defer span.End()
+		req := request.(phoneVerifyRequest)
+		err = s.SendPhoneCode(ctx, req.ID)
+		return statusResponse{Status: err == nil}, err
+	}
+}
+
+// MakePhoneVerifyEndpoint returns an endpoint via the given service.
+func MakePhoneVerifyEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		tr := otel.Tracer("Verify Phone")
+		ctx, span := tr.Start(ctx, "Verify Phone")
+		span.SetAttributes(attribute.Key("service").String("user"))
+		defer span.End()
+		req := request.(phoneVerifyRequest)
+		return s.VerifyPhone(ctx, req.ID, req.Code)
+	}
+}
+
+// MakeStatusPutEndpoint returns an endpoint via the given service.
+func MakeStatusPutEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		tr := otel.Tracer("Put Status")
+		ctx, span := tr.Start(ctx, "Put Status")
+		span.SetAttributes(attribute.Key("service").String("user"))
+		defer span.End()
+		req := request.(statusPutRequest)
+		return s.SetStatus(ctx, req.ID, req.Status)
+	}
+}
+
+// MakeExportEndpoint returns an endpoint via the given service. The export
+// itself is streamed by the response encoder.
+func MakeExportEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		tr := otel.Tracer("Export Users")
+		ctx, span := tr.Start(ctx, "Export Users")
+		span.SetAttributes(attribute.Key("service").String("user"))
+		defer span.End()
+		req := request.(exportRequest)
+		return exportResponse{Write: func(w io.Writer) error {
+			return s.ExportUsers(ctx, w, req.Mask)
+		}}, nil
+	}
+}
+
+// MakeEventStreamEndpoint returns an endpoint via the given service. The
+// events are streamed by the response encoder.
+func MakeEventStreamEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		tr := otel.Tracer("Event Stream")
+		ctx, span := tr.Start(ctx, "Event Stream")
+		span.SetAttributes(attribute.Key("service").String("user"))
+		defer span.End()
+		req := request.(eventStreamRequest)
+		return eventStreamResponse{Subscription: s.Changes(req.LastEventID)}, nil
+	}
+}
+
+// MakeNotificationsEndpoint returns an endpoint via the given service. The
+// WebSocket is served by the response encoder.
+func MakeNotificationsEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		tr := otel.Tracer("Notifications")
+		ctx, span := tr.Start(ctx, "Notifications")
+		span.SetAttributes(attribute.Key("service").String("user"))
+		defer span.End()
+		req := request.(notificationsRequest)
+		return notificationsResponse{Subscription: s.Notifications(req.ID), upgrade: req.upgrade}, nil
+	}
+}
+
+// MakeAdminListEndpoint returns an endpoint via the given service.
+func MakeAdminListEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		tr := otel.Tracer("Admin List Users")
+		ctx, span := tr.Start(ctx, "Admin List Users")
+		span.SetAttributes(attribute.Key("service").String("user"))
+		defer span.End()
+		req := request.(adminListRequest)
+		us, next, err := s.ListUsers(ctx, req.Cursor, req.Limit)
+		resp := adminListResponse{Next: next}
+		resp.Embed.Customers = make([]adminUser, 0, len(us))
+		for _, u := range us {
+			resp.Embed.Customers = append(resp.Embed.Customers, newAdminUser(u))
+		}
+		return resp, err
+	}
+}
+
+// MakeAdminCardsEndpoint returns an endpoint via the given service.
+func MakeAdminCardsEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		tr := otel.Tracer("Admin List Cards")
+		ctx, span := tr.Start(ctx, "Admin List Cards")
+		span.SetAttributes(attribute.Key("service").String("user"))
+		defer span.End()
+		req := request.(adminListRequest)
+		cs, next, err := s.ListCards(ctx, req.Cursor, req.Limit)
+		resp := adminCardsResponse{Next: next}
+		resp.Embed.Cards = make([]adminCard, 0, len(cs))
+		for _, c := range cs {
+			resp.Embed.Cards = append(resp.Embed.Cards, newAdminCard(c))
+		}
+		return resp, err
+	}
+}
+
+// MakeStatsEndpoint returns an endpoint via the given service.
+func MakeStatsEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		tr := otel.Tracer("Stats")
+		ctx, span := tr.Start(ctx, "Stats")
+		span.SetAttributes(attribute.Key("service").String("user"))
+		defer span.End()
+		req := request.(statsRequest)
+		return s.Stats(ctx, req.Days)
+	}
+}
+
+// MakeGroupPostEndpoint returns an endpoint via the given service.
+func MakeGroupPostEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		tr := otel.Tracer("Post Group")
+		ctx, span := tr.Start(ctx, "Post Group")
+		span.SetAttributes(attribute.Key("service").String("user"))
+		defer span.End()
+		req := request.(groupPostRequest)
+		return s.CreateGroup(ctx, req.Group)
+	}
+}
+
+// MakeGroupGetEndpoint returns an endpoint via the given service.
+func MakeGroupGetEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		tr := otel.Tracer("Get Group")
+		ctx, span := tr.Start(ctx, "Get Group")
+		span.SetAttributes(attribute.Key("service").String("user"))
+		defer span.End()
+		req := request.(groupGetRequest)
+		return s.GetGroup(ctx, req.ID)
+	}
+}
+
+// MakeUserGroupsEndpoint returns an endpoint via the given service.
+func MakeUserGroupsEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		tr := otel.Tracer("Get User Groups")
+		ctx, span := tr.Start(ctx, "Get User Groups")
+		span.SetAttributes(attribute.Key("service").String("user"))
+		defer span.End()
+		req := request.(GetRequest)
+		gs, err := s.GetUserGroups(ctx, req.ID)
+		return EmbedStruct{groupsResponse{Groups: gs}}, err
+	}
+}
+
+// MakeActivityEndpoint returns an endpoint via the given service.
+func MakeActivityEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		tr := otel.Tracer("Get Activity")
+		ctx, span := tr.Start(ctx, "Get Activity")
+		span.SetAttributes(attribute.Key("service").String("user"))
+		defer span.End()
+		req := request.(activityRequest)
+		as, next, err := s.Activity(ctx, req.ID, req.Cursor, req.Limit)
+		resp := activityResponse{Next: next}
+		resp.Embed.Activity = as
+		return resp, err
+	}
+}
+
+// MakeGroupMemberPostEndpoint returns an endpoint via the given service.
+func MakeGroupMemberPostEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		tr := otel.Tracer("Post Group Member")
+		ctx, span := tr.Start(ctx, "Post Group Member")
+		span.SetAttributes(attribute.Key("service").String("user"))
+		defer span.End()
+		req := request.(groupMemberRequest)
+		return s.AddGroupMember(ctx, req.GroupID, req.UserID)
+	}
+}
+
+// MakeGroupMemberDeleteEndpoint returns an endpoint via the given service.
+func MakeGroupMemberDeleteEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		tr := otel.Tracer("Delete Group Member")
+		ctx, span := tr.Start(ctx, "Delete Group Member")
+		span.SetAttributes(attribute.Key("service").String("user"))
+		defer span.End()
+		req := request.(groupMemberRequest)
+		return s.RemoveGroupMember(ctx, req.GroupID, req.UserID)
+	}
+}
+
+// MakeWebhookPostEndpoint returns an endpoint via the given service.
+func MakeWebhookPostEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		tr := otel.Tracer("Post Webhook")
+		ctx, span := tr.Start(ctx, "Post Webhook")
+		span.SetAttributes(attribute.Key("service").String("user"))
+		defer span.End()
+		req := request.(webhookPostRequest)
+		return s.CreateWebhook(ctx, req.Webhook)
+	}
+}
+
+// MakeWebhooksGetEndpoint returns an endpoint via the given service.
+func MakeWebhooksGetEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		tr := otel.Tracer("Get Webhooks")
+		ctx, span := tr.Start(ctx, "Get Webhooks")
+		span.SetAttributes(attribute.Key("service").String("user"))
+		defer span.End()
+		ws, err := s.GetWebhooks(ctx)
+		return EmbedStruct{webhooksResponse{Webhooks: ws}}, err
+	}
+}
+
+// MakeWebhookDeleteEndpoint returns an endpoint via the given service.
+func MakeWebhookDeleteEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		tr := otel.Tracer("Delete Webhook")
+		ctx, span := tr.Start(ctx, "Delete Webhook")
+		span.SetAttributes(attribute.Key("service").String("user"))
+		defer span.End()
+		req := request.(webhookDeleteRequest)
+		err = s.DeleteWebhook(ctx, req.ID)
+		return statusResponse{Status: err == nil}, err
+	}
+}
+
+// MakeWebhookDeliveriesEndpoint returns an endpoint via the given service.
+func MakeWebhookDeliveriesEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		tr := otel.Tracer("Get Webhook Deliveries")
+		ctx, span := tr.Start(ctx, "Get Webhook Deliveries")
+		span.SetAttributes(attribute.Key("service").String("user"))
+		defer span.End()
+		req := request.(webhookDeliveriesRequest)
+		ds, next, err := s.WebhookDeliveries(ctx, req.ID, req.Cursor, req.Limit)
+		resp := webhookDeliveriesResponse{Next: next}
+		resp.Embed.Deliveries = ds
+		return resp, err
+	}
+}
+
+// MakeMergeEndpoint returns an endpoint via the given service.
+func MakeMergeEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		tr := otel.Tracer("Merge Users")
+		ctx, span := tr.Start(ctx, "Merge Users")
+		span.SetAttributes(attribute.Key("service").String("user"))
+		defer span.End()
+		req := request.(mergeRequest)
+		return s.Merge(ctx, req.Target, req.Source, req.Prefer)
+	}
+}
+
+// MakeResetPasswordEndpoint returns an endpoint via the given service.
+func MakeResetPasswordEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		tr := otel.Tracer("Reset Password")
+		ctx, span := tr.Start(ctx, "Reset Password")
+		span.SetAttributes(attribute.Key("service").String("user"))
+		defer span.End()
+		req := request.(passwordResetRequest)
+		password, err := s.ResetPassword(ctx, req.ID, req.Password)
+		return passwordResetResponse{Password: password}, err
+	}
+}
+
+// MakeRenameEndpoint returns an endpoint via the given service.
+func MakeRenameEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		tr := otel.Tracer("Rename")
+		ctx, span := tr.Start(ctx, "Rename")
+		span.SetAttributes(attribute.Key("service").String("user"))
+		defer span.End()
+		req := request.(renameRequest)
+		return s.Rename(ctx, req.ID, req.Username)
+	}
+}
+
+// MakeTagPutEndpoint returns an endpoint via the given service.
+func MakeTagPutEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		tr := otel.Tracer("Put Tag")
+		ctx, span := tr.Start(ctx, "Put Tag")
+		span.SetAttributes(attribute.Key("service").String("user"))
+		defer span.End()
+		req := request.(tagRequest)
+		return s.AddTag(ctx, req.ID, req.Tag)
+	}
+}
+
+// MakeTagDeleteEndpoint returns an endpoint via the given service.
+func MakeTagDeleteEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		tr := otel.Tracer("Delete Tag")
+		ctx, span := tr.Start(ctx, "Delete Tag")
+		span.SetAttributes(attribute.Key("service").String("user"))
+		defer span.End()
+		req := request.(tagRequest)
+		return s.RemoveTag(ctx, req.ID, req.Tag)
+	}
+}
+
 // MakeAddressGetEndpoint returns an endpoint via the given service.
 func MakeAddressGetEndpoint(s Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
@@ -135,10 +696,10 @@ func MakeAddressGetEndpoint(s Service) endpoint.Endpoint {
 
 		ctx, addrspan := tr.Start(ctx, "address from db")
 
-		adds, err := s.GetAddresses(req.ID)
+		adds, err := s.GetAddresses(ctx, req.ID)
 		addrspan.End()
 		if req.ID == "" {
-			return EmbedStruct{addressesResponse{Addresses: adds}}, err
+			return EmbedStruct{addressesResponse{Addresses: users.FilterAddresses(adds, req.Type)}}, err
 		}
 		if len(adds) == 0 {
 			return users.Address{}, err
@@ -155,11 +716,23 @@ func MakeAddressPostEndpoint(s Service) endpoint.Endpoint {
 		span.SetAttributes(attribute.Key("service").String("user"))
 		defer span.End()
 		req := request.(addressPostRequest)
-		id, err := s.PostAddress(req.Address, req.UserID)
+		id, err := s.PostAddress(ctx, req.Address, req.UserID)
 		return postResponse{ID: id}, err
 	}
 }
 
+// MakeAddressPatchEndpoint returns an endpoint via the given service.
+func MakeAddressPatchEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		tr := otel.Tracer("Patch Address")
+		ctx, span := tr.Start(ctx, "Patch Address")
+		span.SetAttributes(attribute.Key("service").String("user"))
+		defer span.End()
+		req := request.(addressPatchRequest)
+		return s.PatchAddress(ctx, req.ID, req.Patch)
+	}
+}
+
 // MakeUserGetEndpoint returns an endpoint via the given service.
 func MakeCardGetEndpoint(s Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
@@ -170,7 +743,7 @@ func MakeCardGetEndpoint(s Service) endpoint.Endpoint {
 
 		req := request.(GetRequest)
 		ctx, cardspan := tr.Start(ctx, "card from db")
-		cards, err := s.GetCards(req.ID)
+		cards, err := s.GetCards(ctx, req.ID)
 		cardspan.End()
 		if req.ID == "" {
 			return EmbedStruct{cardsResponse{Cards: cards}}, err
@@ -190,11 +763,35 @@ func MakeCardPostEndpoint(s Service) endpoint.Endpoint {
 		span.SetAttributes(attribute.Key("service").String("user"))
 		defer span.End()
 		req := request.(cardPostRequest)
-		id, err := s.PostCard(req.Card, req.UserID)
+		id, err := s.PostCard(ctx, req.Card, req.UserID)
 		return postResponse{ID: id}, err
 	}
 }
 
+// MakeCardPutEndpoint returns an endpoint via the given service.
+func MakeCardPutEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		tr := otel.Tracer("Put Card")
+		ctx, span := tr.Start(ctx, "Put Card")
+		span.SetAttributes(attribute.Key("service").String("user"))
+		defer span.End()
+		req := request.(cardPutRequest)
+		return s.UpdateCard(ctx, req.ID, req.Update)
+	}
+}
+
+// MakeCardDefaultEndpoint returns an endpoint via the given service.
+func MakeCardDefaultEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		tr := otel.Tracer("Put Default Card")
+		ctx, span := tr.Start(ctx, "Put Default Card")
+		span.SetAttributes(attribute.Key("service").String("user"))
+		defer span.End()
+		req := request.(cardDefaultRequest)
+		return s.SetDefaultCard(ctx, req.ID)
+	}
+}
+
 // MakeLoginEndpoint returns an endpoint via the given service.
 func MakeDeleteEndpoint(s Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
@@ -203,7 +800,7 @@ func MakeDeleteEndpoint(s Service) endpoint.Endpoint {
 		span.SetAttributes(attribute.Key("service").String("user"))
 		defer span.End()
 		req := request.(deleteRequest)
-		err = s.Delete(req.Entity, req.ID)
+		err = s.Delete(ctx, req.Entity, req.ID)
 		if err == nil {
 			return statusResponse{Status: true}, err
 		}
@@ -211,6 +808,134 @@ func MakeDeleteEndpoint(s Service) endpoint.Endpoint {
 	}
 }
 
+// MakeAddressImportEndpoint returns an endpoint via the given service.
+func MakeAddressImportEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		tr := otel.Tracer("Import Addresses")
+		ctx, span := tr.Start(ctx, "Import Addresses")
+		span.SetAttributes(attribute.Key("service").String("user"))
+		defer span.End()
+		req := request.(addressImportRequest)
+		res, err := s.ImportAddresses(ctx, req.UserID, req.Addresses)
+		return addressImportResponse{Results: res}, err
+	}
+}
+
+// MakeBatchEndpoint returns an endpoint via the given service.
+func MakeBatchEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		tr := otel.Tracer("Batch")
+		ctx, span := tr.Start(ctx, "Batch")
+		span.SetAttributes(attribute.Key("service").String("user"))
+		defer span.End()
+		req := request.(batchRequest)
+		span.SetAttributes(attribute.Key("operations").Int(len(req.Operations)))
+		res, err := s.Batch(ctx, req.Operations)
+		if err != nil {
+			return nil, err
+		}
+		resp := batchResponse{Committed: true, Results: res}
+		for _, r := range res {
+			resp.Committed = resp.Committed && r.Status == BatchCreated
+		}
+		return resp, nil
+	}
+}
+
+// MakeBatchGetEndpoint returns an endpoint via the given service.
+func MakeBatchGetEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		tr := otel.Tracer("Batch Get Users")
+		ctx, span := tr.Start(ctx, "Batch Get Users")
+		span.SetAttributes(attribute.Key("service").String("user"))
+		defer span.End()
+		req := request.(batchGetRequest)
+		us, missing, err := s.BatchGetUsers(ctx, req.IDs)
+		resp := batchGetResponse{Missing: missing}
+		resp.Embed.Customers = us
+		return resp, err
+	}
+}
+
+// MakeBulkDeleteEndpoint returns an endpoint via the given service.
+func MakeBulkDeleteEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		tr := otel.Tracer("Bulk Delete")
+		ctx, span := tr.Start(ctx, "Bulk Delete")
+		span.SetAttributes(attribute.Key("service").String("user"))
+		defer span.End()
+		req := request.(bulkDeleteRequest)
+		res, err := s.DeleteUsers(ctx, req.IDs)
+		if err != nil {
+			return nil, err
+		}
+		resp := bulkDeleteResponse{Results: make([]bulkDeleteResult, 0, len(req.IDs))}
+		for _, id := range req.IDs {
+			r := bulkDeleteResult{ID: id, Status: res[id] == nil}
+			if res[id] != nil {
+				r.Error = res[id].Error()
+			}
+			resp.Results = append(resp.Results, r)
+		}
+		return resp, nil
+	}
+}
+
+// MakeIntrospectEndpoint returns an endpoint via the given service. Callers
+// authenticate, as RFC 7662 requires, with the credentials of an
+// introspection client or an admin token.
+func MakeIntrospectEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		tr := otel.Tracer("Introspect")
+		ctx, span := tr.Start(ctx, "Introspect")
+		span.SetAttributes(attribute.Key("service").String("user"))
+		defer span.End()
+		req := request.(introspectRequest)
+		if !introspectionAllowed(ctx, s, req) {
+			return nil, ErrUnauthorized
+		}
+		return s.Introspect(req.Token), nil
+	}
+}
+
+// introspectionAllowed reports whether the caller of req authenticated as
+// an introspection client or with an admin token.
+func introspectionAllowed(ctx context.Context, s Service, req introspectRequest) bool {
+	if req.ClientID != "" {
+		return s.AuthenticateClient(req.ClientID, req.ClientSecret)
+	}
+	tok, ok := ctx.Value(tokenContextKey).(string)
+	if !ok {
+		return false
+	}
+	i := s.Introspect(tok)
+	return i.Active && auth.HasScope(i.Scope, auth.ScopeAdmin)
+}
+
+// MakeGraphQLEndpoint returns an endpoint executing GraphQL queries against
+// the given service. Requests need a token, they are authorized per
+// resolved resource rather than by ScopeMiddleware.
+func MakeGraphQLEndpoint(s Service) endpoint.Endpoint {
+	schema := newGraphQLSchema(s)
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		tr := otel.Tracer("GraphQL")
+		ctx, span := tr.Start(ctx, "GraphQL")
+		span.SetAttributes(attribute.Key("service").String("user"))
+		defer span.End()
+		req := request.(graphqlRequest)
+		tok, ok := ctx.Value(tokenContextKey).(string)
+		if !ok {
+			return nil, ErrUnauthorized
+		}
+		i := s.Introspect(tok)
+		if !i.Active {
+			return nil, ErrUnauthorized
+		}
+		ctx = context.WithValue(ctx, introspectionContextKey, i)
+		return schema.Execute(ctx, req.Request), nil
+	}
+}
+
 // MakeHealthEndpoint returns current health of the given service.
 func MakeHealthEndpoint(s Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
@@ -218,32 +943,340 @@ func MakeHealthEndpoint(s Service) endpoint.Endpoint {
 		ctx, span := tr.Start(ctx, "Health Check")
 		span.SetAttributes(attribute.Key("service").String("user"))
 		defer span.End()
-		health := s.Health()
+		req := request.(healthRequest)
+		span.SetAttributes(attribute.Key("deep").Bool(req.Deep))
+		health := s.Health(ctx, req.Deep)
 		return healthResponse{Health: health}, nil
 	}
 }
 
+// MakeLiveEndpoint returns whether the process is up. It checks no
+// dependencies, so failing ones never get the process restarted.
+func MakeLiveEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		return healthResponse{Health: []Health{{Service: "user", Status: "OK", Time: time.Now().UTC().Format(time.RFC3339)}}}, nil
+	}
+}
+
+// MakeReadyEndpoint returns whether the service is ready to take requests.
+func MakeReadyEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		tr := otel.Tracer("Readiness Check")
+		ctx, span := tr.Start(ctx, "Readiness Check")
+		span.SetAttributes(attribute.Key("service").String("user"))
+		defer span.End()
+		health := s.Ready(ctx)
+		return healthResponse{Health: health}, nil
+	}
+}
+
+type graphqlRequest struct {
+	graphql.Request
+}
+
 type GetRequest struct {
-	ID   string
-	Attr string
+	ID    string
+	Attr  string
+	Query db.UserQuery
+	// Type filters addresses by type.
+	Type string
+	// Fields limits the returned user fields, all when empty.
+	Fields []string
+	// Expand names the attributes inlined in the returned user.
+	Expand []string
 }
 
 type loginRequest struct {
 	Username string
 	Password string
+	Scopes   []string
+	Client   risk.Client
 }
 
 type userResponse struct {
-	User users.User `json:"user"`
+	User  users.User `json:"user"`
+	Token string     `json:"token,omitempty"`
 }
 
 type usersResponse struct {
 	Users []users.User `json:"customer"`
 }
 
+// expandedUsersResponse is the listing of users with their attributes
+// embedded.
+type expandedUsersResponse struct {
+	Users []expandedUser `json:"customer"`
+}
+
+type sparseUsersResponse struct {
+	Users []map[string]interface{} `json:"customer"`
+}
+
+// sparseUsers embeds the users reduced to the given fields.
+func sparseUsers(us []users.User, fields []string) (EmbedStruct, error) {
+	sel := make([]map[string]interface{}, 0, len(us))
+	for _, u := range us {
+		m, err := u.Select(fields)
+		if err != nil {
+			return EmbedStruct{}, err
+		}
+		sel = append(sel, m)
+	}
+	return EmbedStruct{sparseUsersResponse{Users: sel}}, nil
+}
+
+type userUpdateRequest struct {
+	ID     string
+	Update users.ProfileUpdate
+	// Patch is set instead of Update for JSON Patch documents.
+	Patch patch.Patch
+}
+
+type addressPatchRequest struct {
+	ID    string
+	Patch patch.Patch
+}
+
+type avatarPutRequest struct {
+	ID    string
+	Image []byte
+}
+
+type cardPutRequest struct {
+	ID     string
+	Update users.CardUpdate
+}
+
+type cardDefaultRequest struct {
+	ID string
+}
+
+type phoneVerifyRequest struct {
+	ID   string `json:"-"`
+	Code string `json:"code"`
+}
+
+type preferencesPutRequest struct {
+	ID          string
+	Preferences users.Preferences
+}
+
+// statusPutRequest is only authorized for admins, customers can't suspend or
+// reactivate themselves.
+type statusPutRequest struct {
+	ID     string `json:"-"`
+	Status string `json:"status"`
+}
+
+// exportRequest is only authorized for admins.
+type exportRequest struct {
+	Mask []string
+}
+
+// exportResponse writes the export as it is read.
+type exportResponse struct {
+	Write func(io.Writer) error
+}
+
+// eventStreamRequest is only authorized for admins.
+type eventStreamRequest struct {
+	LastEventID string
+}
+
+// eventStreamResponse is written until the client goes away.
+type eventStreamResponse struct {
+	Subscription *changes.Subscription
+}
+
+// notificationsRequest keeps the upgrade request for the response encoder.
+type notificationsRequest struct {
+	ID      string
+	upgrade *http.Request
+}
+
+// notificationsResponse is written until either side closes the WebSocket.
+type notificationsResponse struct {
+	Subscription *changes.Subscription
+	upgrade      *http.Request
+}
+
+// adminListRequest is only authorized for admins.
+type adminListRequest struct {
+	Cursor string
+	Limit  int
+}
+
+type activityRequest struct {
+	ID     string
+	Cursor string
+	Limit  int
+}
+
+type activityResponse struct {
+	Embed struct {
+		Activity []users.Activity `json:"activity"`
+	} `json:"_embedded"`
+	Next string `json:"next,omitempty"`
+}
+
+// webhookPostRequest is only authorized for admins, like the other
+// webhook requests.
+type webhookPostRequest struct {
+	users.Webhook
+}
+
+type webhooksGetRequest struct{}
+
+type webhookDeleteRequest struct {
+	ID string
+}
+
+type webhookDeliveriesRequest struct {
+	ID     string
+	Cursor string
+	Limit  int
+}
+
+type webhooksResponse struct {
+	Webhooks []users.Webhook `json:"webhook"`
+}
+
+type webhookDeliveriesResponse struct {
+	Embed struct {
+		Deliveries []users.WebhookDelivery `json:"delivery"`
+	} `json:"_embedded"`
+	Next string `json:"next,omitempty"`
+}
+
+type groupPostRequest struct {
+	users.Group
+}
+
+type groupGetRequest struct {
+	ID string
+}
+
+type groupMemberRequest struct {
+	GroupID string `json:"-"`
+	UserID  string `json:"userId"`
+	// Removing marks requests taking the user out of the group.
+	Removing bool `json:"-"`
+}
+
+type groupsResponse struct {
+	Groups []users.Group `json:"group"`
+}
+
+// mergeRequest is only authorized for admins.
+type mergeRequest struct {
+	Target string `json:"target"`
+	Source string `json:"source"`
+	Prefer string `json:"prefer"`
+}
+
+// passwordResetRequest is only authorized for admins.
+type passwordResetRequest struct {
+	ID       string `json:"-"`
+	Password string `json:"password"`
+}
+
+type passwordResetResponse struct {
+	// Password is the generated password, if any.
+	Password string `json:"password,omitempty"`
+}
+
+// statsRequest is only authorized for admins.
+type statsRequest struct {
+	Days int
+}
+
+type adminListResponse struct {
+	Embed struct {
+		Customers []adminUser `json:"customer"`
+	} `json:"_embedded"`
+	Next string `json:"next,omitempty"`
+}
+
+// adminUser is the projection of a user in admin listings.
+type adminUser struct {
+	ID          string     `json:"id"`
+	Username    string     `json:"username"`
+	Email       string     `json:"email"`
+	FirstName   string     `json:"firstName"`
+	LastName    string     `json:"lastName"`
+	Status      string     `json:"status"`
+	Roles       []string   `json:"roles,omitempty"`
+	Tags        []string   `json:"tags,omitempty"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	LastLoginAt *time.Time `json:"lastLoginAt,omitempty"`
+	LoginCount  int        `json:"loginCount"`
+}
+
+func newAdminUser(u users.User) adminUser {
+	return adminUser{
+		ID:          u.UserID,
+		Username:    u.Username,
+		Email:       u.Email,
+		FirstName:   u.FirstName,
+		LastName:    u.LastName,
+		Status:      u.GetStatus(),
+		Roles:       u.Roles,
+		Tags:        u.Tags,
+		CreatedAt:   u.CreatedAt,
+		LastLoginAt: u.LastLoginAt,
+		LoginCount:  u.LoginCount,
+	}
+}
+
+type adminCardsResponse struct {
+	Embed struct {
+		Cards []adminCard `json:"card"`
+	} `json:"_embedded"`
+	Next string `json:"next,omitempty"`
+}
+
+// adminCard is the projection of a card in admin listings, its number is
+// always masked.
+type adminCard struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"userId,omitempty"`
+	LongNum   string    `json:"longNum"`
+	Brand     string    `json:"brand,omitempty"`
+	Expires   string    `json:"expires"`
+	Holder    string    `json:"holder,omitempty"`
+	Vault     string    `json:"vault,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func newAdminCard(c db.OwnedCard) adminCard {
+	c.MaskCC()
+	return adminCard{
+		ID:        c.ID,
+		UserID:    c.UserID,
+		LongNum:   c.LongNum,
+		Brand:     c.Brand,
+		Expires:   c.Expires,
+		Holder:    c.Holder,
+		Vault:     c.Vault,
+		CreatedAt: c.CreatedAt,
+	}
+}
+
+type renameRequest struct {
+	ID       string `json:"-"`
+	Username string `json:"username"`
+}
+
+// tagRequest is only authorized for admins, tags are for support and
+// marketing.
+type tagRequest struct {
+	ID  string
+	Tag string
+}
+
 type addressPostRequest struct {
 	users.Address
-	UserID string `json:"userID"`
+	UserID string `json:"userID" validate:"required"`
 }
 
 type addressesResponse struct {
@@ -252,7 +1285,7 @@ type addressesResponse struct {
 
 type cardPostRequest struct {
 	users.Card
-	UserID string `json:"userID"`
+	UserID string `json:"userID" validate:"required"`
 }
 
 type cardsResponse struct {
@@ -260,11 +1293,20 @@ type cardsResponse struct {
 }
 
 type registerRequest struct {
-	Username  string `json:"username"`
-	Password  string `json:"password"`
-	Email     string `json:"email"`
-	FirstName string `json:"firstName"`
-	LastName  string `json:"lastName"`
+	Username  string `json:"username" validate:"required,max=64"`
+	Password  string `json:"password" validate:"required"`
+	Email     string `json:"email" validate:"omitempty,email"`
+	FirstName string `json:"firstName" validate:"max=100"`
+	LastName  string `json:"lastName" validate:"max=100"`
+	Phone     string `json:"phone"`
+	// UpgradeToken turns the guest it was issued to into the registered
+	// user instead of creating a new one.
+	UpgradeToken string `json:"upgradeToken"`
+}
+
+type availableRequest struct {
+	Username string
+	Email    string
 }
 
 type statusResponse struct {
@@ -280,14 +1322,95 @@ type deleteRequest struct {
 	ID     string
 }
 
+type bulkDeleteRequest struct {
+	IDs []string `json:"ids"`
+}
+
+type addressImportRequest struct {
+	UserID    string
+	Addresses []users.Address
+}
+
+type addressImportResponse struct {
+	Results []AddressImportResult `json:"results"`
+}
+
+type batchRequest struct {
+	Operations []BatchOperation
+}
+
+// batchOperationBody is an operation of a batch as posted: the route it
+// would take on its own and the body it would send there.
+type batchOperationBody struct {
+	Ref    string          `json:"ref,omitempty"`
+	Method string          `json:"method"`
+	Path   string          `json:"path"`
+	Body   json.RawMessage `json:"body"`
+}
+
+type batchBody struct {
+	Operations []batchOperationBody `json:"operations"`
+}
+
+type batchResponse struct {
+	// Committed is false when an operation failed and the batch was undone.
+	Committed bool          `json:"committed"`
+	Results   []BatchResult `json:"results"`
+}
+
+// batchGetRequest is only authorized for admins.
+type batchGetRequest struct {
+	IDs []string `json:"ids"`
+}
+
+type batchGetResponse struct {
+	Embed struct {
+		Customers []users.User `json:"customer"`
+	} `json:"_embedded"`
+	Missing []string `json:"missing,omitempty"`
+}
+
+type bulkDeleteResult struct {
+	ID     string `json:"id"`
+	Status bool   `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type bulkDeleteResponse struct {
+	Results []bulkDeleteResult `json:"results"`
+}
+
+type introspectRequest struct {
+	Token string
+	// ClientID and ClientSecret are the HTTP Basic credentials of the
+	// introspection client.
+	ClientID     string
+	ClientSecret string
+}
+
 type healthRequest struct {
-	//
+	// Deep pings the dependencies too.
+	Deep bool
 }
 
 type healthResponse struct {
 	Health []Health `json:"health"`
 }
 
+// ok reports whether every part of the service is OK.
+func (r healthResponse) ok() bool {
+	for _, h := range r.Health {
+		if h.Status != "OK" {
+			return false
+		}
+	}
+	return true
+}
+
+// expandedUser is a user as a JSON object, with the attributes asked for by
+// expand in its _embedded member.
+type expandedUser map[string]interface{}
+
 type EmbedStruct struct {
 	Embed interface{} `json:"_embedded"`
 }
@@ -0,0 +1,62 @@
+package api
+
+// events.go contains the server-sent events stream of changes to customers,
+// addresses and cards for admin dashboards. Every event carries its id, so
+// EventSource clients reconnecting send it back as Last-Event-ID and resume.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"user/changes"
+)
+
+// EventStreamHeartbeat is how often an idle stream gets a comment, keeping
+// proxies from closing the connection.
+var EventStreamHeartbeat = 15 * time.Second
+
+// writeEvents writes the events of sub as they come, until the client goes
+// away, sub is dropped for falling behind or the server shuts down.
+func writeEvents(ctx context.Context, w http.ResponseWriter, sub *changes.Subscription) error {
+	defer sub.Close()
+	flusher, _ := w.(http.Flusher)
+	flush := func() {
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flush()
+	heartbeat := time.NewTicker(EventStreamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-draining:
+			return nil
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return err
+			}
+		case e, ok := <-sub.Events:
+			if !ok {
+				return nil
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				return err
+			}
+			if _, err := fmt.Fprintf(w, "id: %v\nevent: %v\ndata: %s\n\n", e.ID, e.Type, data); err != nil {
+				return err
+			}
+		}
+		flush()
+	}
+}
@@ -0,0 +1,112 @@
+package api
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+	"user/auth"
+	"user/changes"
+)
+
+type eventStub struct {
+	Service
+	b *changes.Broker
+}
+
+func (s eventStub) Changes(lastEventID string) *changes.Subscription {
+	return s.b.Subscribe(lastEventID)
+}
+
+func (s eventStub) Introspect(token string) auth.Introspection {
+	return auth.Introspection{Active: true, Subject: "1", Scope: token}
+}
+
+func TestEventStream(t *testing.T) {
+	b := changes.NewBroker(10)
+	b.Publish(changes.UserCreated, "1", "1")
+	last := b.Subscribe("").Events
+	b.Publish(changes.AddressCreated, "2", "1")
+	seen := (<-last).ID
+	b.Publish(changes.CardCreated, "3", "1")
+	srv := httptest.NewServer(mountRoutes(mux.NewRouter(), MakeEndpoints(eventStub{b: b}), V1, log.NewNopLogger()))
+	defer srv.Close()
+
+	req, _ := http.NewRequest("GET", srv.URL+"/events/stream", nil)
+	req.Header.Set("Authorization", "Bearer "+auth.ScopeCustomer)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected customers forbidden, got %v", resp.StatusCode)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+auth.ScopeAdmin)
+	req.Header.Set("Last-Event-ID", seen)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("expected an event stream, got %v", ct)
+	}
+	r := bufio.NewReader(resp.Body)
+	next := func() string {
+		var lines []string
+		for {
+			l, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if l == "\n" {
+				return strings.Join(lines, "")
+			}
+			lines = append(lines, l)
+		}
+	}
+	// Only the card was published after the address seen.
+	if e := next(); !strings.Contains(e, "event: card.created\n") || !strings.Contains(e, `"resourceId":"3"`) {
+		t.Errorf("expected the card created after the last event id, got %q", e)
+	}
+	b.Publish(changes.UserDeleted, "1", "1")
+	if e := next(); !strings.Contains(e, "event: user.deleted\n") {
+		t.Errorf("expected the live user deleted event, got %q", e)
+	}
+}
+
+func TestEventStreamDrain(t *testing.T) {
+	defer func() { draining, drainOnce = make(chan struct{}), sync.Once{} }()
+	b := changes.NewBroker(10)
+	srv := httptest.NewServer(mountRoutes(mux.NewRouter(), MakeEndpoints(eventStub{b: b}), V1, log.NewNopLogger()))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/events/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	Drain()
+	Drain()
+	done := make(chan error)
+	go func() {
+		_, err := io.ReadAll(resp.Body)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("expected the stream ended cleanly, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("expected the stream ended on shutdown")
+	}
+}
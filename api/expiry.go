@@ -0,0 +1,46 @@
+package api
+
+// expiry.go contains the scheduled removal of the accounts nobody is going
+// to use: guests who never registered.
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+// AccountExpiry removes the guests older than Guests through Service, which
+// publishes their deletion. A zero duration keeps them.
+type AccountExpiry struct {
+	Service Service
+	Guests  time.Duration
+	Logger  log.Logger
+	now     func() time.Time
+}
+
+// Run removes the expired accounts and returns how many it removed.
+func (j *AccountExpiry) Run(ctx context.Context) (int, error) {
+	now := time.Now
+	if j.now != nil {
+		now = j.now
+	}
+	if j.Guests <= 0 {
+		return 0, nil
+	}
+	return j.Service.ExpireGuests(ctx, now().Add(-j.Guests))
+}
+
+// Every runs the job every interval until stop is closed.
+func (j *AccountExpiry) Every(interval time.Duration, stop <-chan struct{}) {
+	ctx := context.Background()
+	for {
+		n, err := j.Run(ctx)
+		j.Logger.Log("job", "account_expiry", "expired", n, "err", err)
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package api
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"user/changes"
+	"user/db"
+	"user/db/inmem"
+	"user/users"
+)
+
+func TestAccountExpiry(t *testing.T) {
+	ctx := context.Background()
+	m := &inmem.Memory{}
+	if err := m.Init(); err != nil {
+		t.Fatal(err)
+	}
+	pending := users.User{Username: "pending", Status: users.StatusPending}
+	active := users.User{Username: "active", Status: users.StatusActive}
+	guest := users.NewGuest()
+	for _, u := range []*users.User{&pending, &active, &guest} {
+		if err := m.CreateUser(ctx, u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b := changes.NewBroker(10)
+	sub := b.Subscribe("")
+	j := &AccountExpiry{
+		Service: NewFixedService(WithTenant("", db.NewStore(m)), WithChanges(b)),
+		Logger:  log.NewNopLogger(),
+		now:     func() time.Time { return time.Now().Add(36 * time.Hour) },
+	}
+	if n, err := j.Run(ctx); err != nil || n != 0 {
+		t.Fatalf("expected the guest kept without a guest TTL, got %v %v", n, err)
+	}
+
+	j.Guests = 48 * time.Hour
+	if n, err := j.Run(ctx); err != nil || n != 0 {
+		t.Errorf("expected the guest too recent, got %v %v", n, err)
+	}
+	j.Guests = 24 * time.Hour
+	if n, err := j.Run(ctx); err != nil || n != 1 {
+		t.Errorf("expected the guest expired, got %v %v", n, err)
+	}
+	for _, u := range []users.User{pending, active} {
+		if _, err := m.GetUser(ctx, u.UserID); err != nil {
+			t.Errorf("expected the %v account kept, got %v", u.Username, err)
+		}
+	}
+	var deleted []string
+	for len(sub.Events) > 0 {
+		if e := <-sub.Events; e.Type == changes.UserDeleted {
+			deleted = append(deleted, e.UserID)
+		}
+	}
+	if len(deleted) != 1 || deleted[0] != guest.UserID {
+		t.Errorf("expected the expired guest deleted event, got %v", deleted)
+	}
+}
@@ -0,0 +1,34 @@
+package api
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"user/users"
+)
+
+func TestExportRow(t *testing.T) {
+	u := users.User{UserID: "1", Username: "eve", Email: "eve@example.com", FirstName: "Eve", Roles: []string{"admin"}}
+	row := exportRow(u, []string{"email", "firstName", "lastName"})
+	if len(row) != len(ExportColumns) {
+		t.Fatalf("expected a value per column, got %v", row)
+	}
+	if row[1] != "eve" || row[2] != "e***@example.com" || row[3] != "E***" || row[4] != "" || row[5] != users.StatusActive || row[6] != "admin" {
+		t.Errorf("unexpected row %v", row)
+	}
+}
+
+func TestDecodeExportRequest(t *testing.T) {
+	for url, mask := range map[string]int{"/admin/customers/export": len(DefaultExportMask), "/admin/customers/export?mask=": 0, "/admin/customers/export?format=csv&mask=email": 1} {
+		req, err := decodeExportRequest(context.Background(), httptest.NewRequest("GET", url, nil))
+		if err != nil || len(req.(exportRequest).Mask) != mask {
+			t.Errorf("%v: expected %v masked columns, got %v %v", url, mask, req, err)
+		}
+	}
+	for _, bad := range []string{"/admin/customers/export?format=xml", "/admin/customers/export?mask=password"} {
+		if _, err := decodeExportRequest(context.Background(), httptest.NewRequest("GET", bad, nil)); err == nil {
+			t.Errorf("expected %v to be rejected", bad)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package api
+
+// graphql.go contains the GraphQL schema served at /graphql. It exposes
+// customers with their addresses and cards as one graph, so a profile page
+// is a single round-trip. Addresses and cards are loaded in one query per
+// level for all customers of a response, and card numbers are always masked.
+
+import (
+	"context"
+
+	"user/auth"
+	"user/db"
+	"user/graphql"
+	"user/users"
+)
+
+// authorizeGraph applies the scope rules of the REST routes to the resource
+// of entity with the given id reached through the graph.
+func authorizeGraph(ctx context.Context, s Service, entity, id string) error {
+	i, ok := ctx.Value(introspectionContextKey).(auth.Introspection)
+	if !ok {
+		return ErrUnauthorized
+	}
+	if auth.HasScope(i.Scope, auth.ScopeAdmin) {
+		return nil
+	}
+	if id != "" && auth.HasScope(i.Scope, auth.ResourceScope(entity, id)) {
+		return nil
+	}
+	return ownedByCustomer(ctx, s, i, entity, id)
+}
+
+// newGraphQLSchema returns the schema resolving against s.
+func newGraphQLSchema(s Service) *graphql.Schema {
+	location := &graphql.Object{Name: "Location", Fields: map[string]*graphql.Field{
+		"lat": {Type: graphql.Float},
+		"lng": {Type: graphql.Float},
+	}}
+	address := &graphql.Object{Name: "Address", Fields: map[string]*graphql.Field{
+		"id":         {Type: graphql.NonNullOf(graphql.ID)},
+		"street":     {Type: graphql.String},
+		"number":     {Type: graphql.String},
+		"building":   {Type: graphql.String},
+		"city":       {Type: graphql.String},
+		"state":      {Type: graphql.String},
+		"prefecture": {Type: graphql.String},
+		"postcode":   {Type: graphql.String},
+		"country":    {Type: graphql.String},
+		"type":       {Type: graphql.String},
+		"default":    {Type: graphql.Boolean},
+		"validated":  {Type: graphql.Boolean},
+		"location":   {Type: location},
+		"createdAt":  {Type: graphql.DateTime},
+		"updatedAt":  {Type: graphql.DateTime},
+	}}
+	card := &graphql.Object{Name: "Card", Fields: map[string]*graphql.Field{
+		"id":           {Type: graphql.NonNullOf(graphql.ID)},
+		"longNum":      {Type: graphql.String},
+		"expires":      {Type: graphql.String},
+		"holder":       {Type: graphql.String},
+		"brand":        {Type: graphql.String},
+		"default":      {Type: graphql.Boolean},
+		"verification": {Type: graphql.String},
+		"createdAt":    {Type: graphql.DateTime},
+		"updatedAt":    {Type: graphql.DateTime},
+	}}
+	preferences := &graphql.Object{Name: "Preferences", Fields: map[string]*graphql.Field{
+		"newsletter": {Type: graphql.Boolean},
+		"currency":   {Type: graphql.String},
+		"theme":      {Type: graphql.String},
+	}}
+	user := &graphql.Object{Name: "User", Fields: map[string]*graphql.Field{
+		"id":            {Type: graphql.NonNullOf(graphql.ID)},
+		"username":      {Type: graphql.String},
+		"firstName":     {Type: graphql.String},
+		"lastName":      {Type: graphql.String},
+		"phone":         {Type: graphql.String},
+		"phoneVerified": {Type: graphql.Boolean},
+		"status":        {Type: graphql.String},
+		"locale":        {Type: graphql.String},
+		"timezone":      {Type: graphql.String},
+		"tags":          {Type: graphql.ListOf(graphql.String)},
+		"roles":         {Type: graphql.ListOf(graphql.String)},
+		"loginCount":    {Type: graphql.Int},
+		"lastLoginAt":   {Type: graphql.DateTime},
+		"createdAt":     {Type: graphql.DateTime},
+		"updatedAt":     {Type: graphql.DateTime},
+		"preferences": {
+			Type: preferences,
+			Resolve: func(ctx context.Context, p graphql.ResolveParams) (interface{}, error) {
+				u := p.Source.(users.User)
+				return u.GetPreferences(), nil
+			},
+		},
+		"addresses": {
+			Type: graphql.ListOf(address),
+			Args: map[string]graphql.Type{"type": graphql.String},
+			Batch: func(ctx context.Context, p graphql.BatchParams) ([]interface{}, error) {
+				return loadAddresses(ctx, s, p)
+			},
+		},
+		"cards": {
+			Type: graphql.ListOf(card),
+			Batch: func(ctx context.Context, p graphql.BatchParams) ([]interface{}, error) {
+				return loadCards(ctx, s, p)
+			},
+		},
+	}}
+	return &graphql.Schema{Query: &graphql.Object{Name: "Query", Fields: map[string]*graphql.Field{
+		"user": {
+			Type: user,
+			Args: map[string]graphql.Type{"id": graphql.NonNullOf(graphql.ID)},
+			Resolve: func(ctx context.Context, p graphql.ResolveParams) (interface{}, error) {
+				id := p.Args["id"].(string)
+				if err := authorizeGraph(ctx, s, "customers", id); err != nil {
+					return nil, err
+				}
+				us, err := s.GetUsers(ctx, id)
+				if err != nil {
+					return nil, err
+				}
+				return us[0], nil
+			},
+		},
+		"users": {
+			Type: graphql.ListOf(user),
+			Args: map[string]graphql.Type{
+				"email":    graphql.String,
+				"lastName": graphql.String,
+				"status":   graphql.String,
+				"tag":      graphql.String,
+				"sort":     graphql.String,
+			},
+			Resolve: func(ctx context.Context, p graphql.ResolveParams) (interface{}, error) {
+				// Searching across customers is for admins only.
+				if err := authorizeGraph(ctx, s, "customers", ""); err != nil {
+					return nil, err
+				}
+				q := db.UserQuery{}
+				q.Email, _ = p.Args["email"].(string)
+				q.LastName, _ = p.Args["lastName"].(string)
+				q.Status, _ = p.Args["status"].(string)
+				q.Tag, _ = p.Args["tag"].(string)
+				q.Sort, _ = p.Args["sort"].(string)
+				return s.FindUsers(ctx, q)
+			},
+		},
+		"address": {
+			Type: address,
+			Args: map[string]graphql.Type{"id": graphql.NonNullOf(graphql.ID)},
+			Resolve: func(ctx context.Context, p graphql.ResolveParams) (interface{}, error) {
+				id := p.Args["id"].(string)
+				if err := authorizeGraph(ctx, s, "addresses", id); err != nil {
+					return nil, err
+				}
+				as, err := s.GetAddresses(ctx, id)
+				if err != nil {
+					return nil, err
+				}
+				return as[0], nil
+			},
+		},
+		"card": {
+			Type: card,
+			Args: map[string]graphql.Type{"id": graphql.NonNullOf(graphql.ID)},
+			Resolve: func(ctx context.Context, p graphql.ResolveParams) (interface{}, error) {
+				id := p.Args["id"].(string)
+				if err := authorizeGraph(ctx, s, "cards", id); err != nil {
+					return nil, err
+				}
+				cs, err := s.GetCards(ctx, id)
+				if err != nil {
+					return nil, err
+				}
+				c := cs[0]
+				c.MaskCC()
+				return c, nil
+			},
+		},
+	}}}
+}
+
+// loadAddresses loads the addresses of every user in p.Sources with one
+// query, keeping those of the type asked for.
+func loadAddresses(ctx context.Context, s Service, p graphql.BatchParams) ([]interface{}, error) {
+	var ids []string
+	for _, src := range p.Sources {
+		for _, a := range src.(users.User).Addresses {
+			ids = append(ids, a.ID)
+		}
+	}
+	as, err := s.GetAddressesByID(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[string]users.Address, len(as))
+	for _, a := range as {
+		byID[a.ID] = a
+	}
+	typ, _ := p.Args["type"].(string)
+	out := make([]interface{}, len(p.Sources))
+	for k, src := range p.Sources {
+		l := make([]users.Address, 0)
+		for _, ref := range src.(users.User).Addresses {
+			if a, ok := byID[ref.ID]; ok && (typ == "" || a.Type == typ) {
+				l = append(l, a)
+			}
+		}
+		out[k] = l
+	}
+	return out, nil
+}
+
+// loadCards loads the cards of every user in p.Sources with one query,
+// masked and with the default card first.
+func loadCards(ctx context.Context, s Service, p graphql.BatchParams) ([]interface{}, error) {
+	var ids []string
+	for _, src := range p.Sources {
+		for _, c := range src.(users.User).Cards {
+			ids = append(ids, c.ID)
+		}
+	}
+	cs, err := s.GetCardsByID(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[string]users.Card, len(cs))
+	for _, c := range cs {
+		c.MaskCC()
+		c.StripCVV()
+		byID[c.ID] = c
+	}
+	out := make([]interface{}, len(p.Sources))
+	for k, src := range p.Sources {
+		u := src.(users.User)
+		u.Cards = make([]users.Card, 0, len(u.Cards))
+		for _, ref := range src.(users.User).Cards {
+			if c, ok := byID[ref.ID]; ok {
+				u.Cards = append(u.Cards, c)
+			}
+		}
+		u.MarkDefaultCard()
+		out[k] = u.Cards
+	}
+	return out, nil
+}
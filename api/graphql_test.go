@@ -0,0 +1,93 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"user/auth"
+	"user/db"
+	"user/users"
+)
+
+// graphStub serves two customers and counts the attribute loads.
+type graphStub struct {
+	Service
+	loads int
+}
+
+func (s *graphStub) FindUsers(ctx context.Context, q db.UserQuery) ([]users.User, error) {
+	return []users.User{
+		{UserID: "1", Addresses: []users.Address{{ID: "a1"}, {ID: "a2"}}, Cards: []users.Card{{ID: "c1"}, {ID: "c2"}}, DefaultCard: "c2"},
+		{UserID: "2", Addresses: []users.Address{{ID: "a3"}}},
+	}, nil
+}
+
+func (s *graphStub) GetAddressesByID(ctx context.Context, ids []string) ([]users.Address, error) {
+	s.loads++
+	as := make([]users.Address, len(ids))
+	for k, id := range ids {
+		as[k] = users.Address{ID: id, City: "City " + id, Type: users.AddressShipping}
+	}
+	as[0].Type = users.AddressBilling
+	return as, nil
+}
+
+func (s *graphStub) GetCardsByID(ctx context.Context, ids []string) ([]users.Card, error) {
+	s.loads++
+	cs := make([]users.Card, len(ids))
+	for k, id := range ids {
+		cs[k] = users.Card{ID: id, LongNum: "4111111111111111", CCV: "123"}
+	}
+	return cs, nil
+}
+
+func (s *graphStub) Introspect(token string) auth.Introspection {
+	if token == "admin" {
+		return auth.Introspection{Active: true, Subject: "9", Scope: auth.ScopeAdmin}
+	}
+	return auth.Introspection{Active: token == "customer-1", Subject: "1", Scope: auth.ScopeCustomer}
+}
+
+func TestGraphQLBatchesAttributes(t *testing.T) {
+	s := &graphStub{}
+	req := graphqlRequest{}
+	req.Query = `{ users { id addresses(type: "shipping") { id city } cards { id longNum default } } }`
+	resp, err := MakeGraphQLEndpoint(s)(context.WithValue(context.Background(), tokenContextKey, "admin"), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := json.Marshal(resp)
+	expected := `{"data":{"users":[` +
+		`{"id":"1","addresses":[{"id":"a2","city":"City a2"}],"cards":[{"id":"c2","longNum":"************1111","default":true},{"id":"c1","longNum":"************1111","default":false}]},` +
+		`{"id":"2","addresses":[{"id":"a3","city":"City a3"}],"cards":[]}]}}`
+	if string(b) != expected {
+		t.Errorf("expected %v, got %s", expected, b)
+	}
+	if s.loads != 2 {
+		t.Errorf("expected one load per attribute, got %v", s.loads)
+	}
+}
+
+func TestGraphQLScopes(t *testing.T) {
+	s := &graphStub{}
+	if _, err := MakeGraphQLEndpoint(s)(context.Background(), graphqlRequest{}); err != ErrUnauthorized {
+		t.Errorf("expected requests without a token to be unauthorized, got %v", err)
+	}
+	ctx := context.WithValue(context.Background(), tokenContextKey, "expired")
+	if _, err := MakeGraphQLEndpoint(s)(ctx, graphqlRequest{}); err != ErrUnauthorized {
+		t.Errorf("expected inactive token to be unauthorized, got %v", err)
+	}
+	ctx = context.WithValue(context.Background(), tokenContextKey, "customer-1")
+	req := graphqlRequest{}
+	req.Query = `{ other: user(id: "2") { id } users { id } }`
+	resp, err := MakeGraphQLEndpoint(s)(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := json.Marshal(resp)
+	expected := `{"data":{"other":null,"users":null},"errors":[{"message":"Forbidden","path":["other"]},{"message":"Forbidden","path":["users"]}]}`
+	if string(b) != expected {
+		t.Errorf("expected %v, got %s", expected, b)
+	}
+}
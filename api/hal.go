@@ -0,0 +1,152 @@
+package api
+
+// hal.go contains the HAL encoding of responses. Resources carry their
+// _links, collections are _embedded with a link to themselves and templated
+// links to search them. In plain mode both are left out for clients that
+// just want JSON.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"net/http"
+	"os"
+
+	"user/users"
+)
+
+// plainJSON switches responses to plain JSON without _links and _embedded.
+var plainJSON bool
+
+func init() {
+	flag.BoolVar(&plainJSON, "plain-json", os.Getenv("PLAIN_JSON") == "true", "Respond with plain JSON instead of HAL, without _links and _embedded")
+}
+
+// collectionLinks are the links of the collections embedded in responses
+// besides self, by their _embedded member.
+var collectionLinks = map[string]map[string]string{
+	"customer": {"find": "/customers{?email,lastName,status,tag,createdAfter,updatedAfter,sort,fields}"},
+	"address":  {"find": "/addresses{?type}"},
+	"card":     {"find": "/cards"},
+}
+
+// RequestURIToContext keeps the URI of the request in its context for the
+// self link of collections. It is the URI as requested, with the version
+// prefix.
+func RequestURIToContext(ctx context.Context, r *http.Request) context.Context {
+	return context.WithValue(ctx, requestURIContextKey, r.RequestURI)
+}
+
+// document returns response as v encodes it: with the _embedded members
+// renamed for v and the links of the collection, or as plain JSON.
+func (v APIVersion) document(ctx context.Context, response interface{}) (interface{}, error) {
+	if e, ok := response.(expandedUser); ok && !plainJSON {
+		embedded, _ := e["_embedded"].(map[string]interface{})
+		renamed := make(map[string]interface{}, len(embedded))
+		for k, m := range embedded {
+			renamed[v.embeddedName(k)] = m
+		}
+		e["_embedded"] = renamed
+		return e, nil
+	}
+	_, collection := response.(EmbedStruct)
+	if !collection && !plainJSON {
+		return response, nil
+	}
+	b, err := json.Marshal(response)
+	if err != nil {
+		return nil, err
+	}
+	if plainJSON {
+		return v.plain(b)
+	}
+	var doc map[string]json.RawMessage
+	var embedded map[string]json.RawMessage
+	if json.Unmarshal(b, &doc) != nil || json.Unmarshal(doc["_embedded"], &embedded) != nil || embedded == nil {
+		return json.RawMessage(b), nil
+	}
+	links := users.Links{}
+	if uri, ok := ctx.Value(requestURIContextKey).(string); ok {
+		links["self"] = users.Expand(uri, nil)
+	}
+	renamed := make(map[string]json.RawMessage, len(embedded))
+	for k, m := range embedded {
+		if m, err = v.renameItems(m); err != nil {
+			return nil, err
+		}
+		renamed[v.embeddedName(k)] = m
+		for rel, t := range collectionLinks[k] {
+			links[rel] = users.Expand(t, nil)
+		}
+	}
+	if doc["_embedded"], err = json.Marshal(renamed); err != nil {
+		return nil, err
+	}
+	if len(links) > 0 {
+		if doc["_links"], err = json.Marshal(links); err != nil {
+			return nil, err
+		}
+	}
+	return doc, nil
+}
+
+// renameItems renames the _embedded members of the items of collection for
+// v, those of expanded users. Collections without are returned as they are.
+func (v APIVersion) renameItems(collection json.RawMessage) (json.RawMessage, error) {
+	if !bytes.Contains(collection, []byte(`"_embedded"`)) {
+		return collection, nil
+	}
+	var items []map[string]json.RawMessage
+	if json.Unmarshal(collection, &items) != nil {
+		return collection, nil
+	}
+	for _, item := range items {
+		var embedded map[string]json.RawMessage
+		if json.Unmarshal(item["_embedded"], &embedded) != nil || embedded == nil {
+			continue
+		}
+		renamed := make(map[string]json.RawMessage, len(embedded))
+		for k, m := range embedded {
+			renamed[v.embeddedName(k)] = m
+		}
+		var err error
+		if item["_embedded"], err = json.Marshal(renamed); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(items)
+}
+
+// plain returns the JSON document b without _links, and with the members of
+// _embedded, named for v, in its place.
+func (v APIVersion) plain(b []byte) (interface{}, error) {
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var doc interface{}
+	if err := d.Decode(&doc); err != nil {
+		return nil, err
+	}
+	return v.stripHAL(doc), nil
+}
+
+func (v APIVersion) stripHAL(doc interface{}) interface{} {
+	switch doc := doc.(type) {
+	case map[string]interface{}:
+		delete(doc, "_links")
+		if embedded, ok := doc["_embedded"].(map[string]interface{}); ok {
+			delete(doc, "_embedded")
+			for k, m := range embedded {
+				doc[v.embeddedName(k)] = m
+			}
+		}
+		for k, m := range doc {
+			doc[k] = v.stripHAL(m)
+		}
+	case []interface{}:
+		for k, m := range doc {
+			doc[k] = v.stripHAL(m)
+		}
+	}
+	return doc
+}
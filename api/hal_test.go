@@ -0,0 +1,87 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"user/users"
+)
+
+func TestEncodeCollectionLinks(t *testing.T) {
+	ctx := context.WithValue(context.Background(), requestURIContextKey, "/v2/customers?tag=vip")
+	w := httptest.NewRecorder()
+	u := users.User{UserID: "1", Username: "eve"}
+	u.AddLinks()
+	if err := V2.encodeResponse(ctx, w, EmbedStruct{usersResponse{Users: []users.User{u}}}); err != nil {
+		t.Fatal(err)
+	}
+	var doc struct {
+		Embedded map[string][]map[string]interface{} `json:"_embedded"`
+		Links    users.Links                         `json:"_links"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(doc.Links["self"].Url, "/v2/customers?tag=vip") || doc.Links["self"].Templated {
+		t.Errorf("expected self link of the request, got %v", doc.Links["self"])
+	}
+	if find := doc.Links["find"]; !find.Templated || !strings.HasSuffix(find.Url, "/customers{?email,lastName,status,tag,createdAfter,updatedAfter,sort,fields}") {
+		t.Errorf("expected templated find link, got %v", find)
+	}
+	if len(doc.Embedded["customers"]) != 1 || doc.Embedded["customers"][0]["_links"] == nil {
+		t.Errorf("expected embedded customers with links, got %v", doc.Embedded)
+	}
+}
+
+func TestEncodePlainJSON(t *testing.T) {
+	plainJSON = true
+	defer func() { plainJSON = false }()
+	u := users.User{UserID: "1", Username: "eve"}
+	u.AddLinks()
+	for _, c := range []struct {
+		v        APIVersion
+		response interface{}
+		expected string
+	}{
+		{V1, EmbedStruct{usersResponse{Users: []users.User{u}}}, `{"customer":[{`},
+		{V2, EmbedStruct{usersResponse{Users: []users.User{u}}}, `{"customers":[{`},
+		{V1, u, `{`},
+	} {
+		w := httptest.NewRecorder()
+		if err := c.v.encodeResponse(context.Background(), w, c.response); err != nil {
+			t.Fatal(err)
+		}
+		body := w.Body.String()
+		if !strings.HasPrefix(body, c.expected) || strings.Contains(body, "_links") || strings.Contains(body, "_embedded") || !strings.Contains(body, `"username":"eve"`) {
+			t.Errorf("%v: expected plain JSON, got %v", c.v.Name, body)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("expected application/json, got %v", ct)
+		}
+	}
+}
+
+func TestEncodeExpandedUser(t *testing.T) {
+	w := httptest.NewRecorder()
+	doc := expandedUser{"id": "1", "_embedded": map[string]interface{}{"address": []users.Address{}}}
+	if err := V2.encodeResponse(context.Background(), w, doc); err != nil {
+		t.Fatal(err)
+	}
+	if body := w.Body.String(); !strings.Contains(body, `"_embedded":{"addresses":[]}`) {
+		t.Errorf("expected the embedded addresses named for v2, got %v", body)
+	}
+}
+
+func TestEncodeExpandedUsers(t *testing.T) {
+	w := httptest.NewRecorder()
+	docs := []expandedUser{{"id": "1", "_embedded": map[string]interface{}{"address": []users.Address{}}}}
+	if err := V2.encodeResponse(context.Background(), w, EmbedStruct{expandedUsersResponse{Users: docs}}); err != nil {
+		t.Fatal(err)
+	}
+	if body := w.Body.String(); !strings.Contains(body, `"_embedded":{"addresses":[]}`) {
+		t.Errorf("expected the addresses embedded in the users named for v2, got %v", body)
+	}
+}
@@ -0,0 +1,99 @@
+package api
+
+// idempotency.go contains the Idempotency-Key handling of the endpoints
+// creating resources. A retried request with the same key gets the id of
+// the resource the first one created instead of creating another.
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/go-kit/kit/endpoint"
+	"user/users"
+)
+
+// IdempotencyHeader names the client chosen key of a request creating a
+// resource.
+const IdempotencyHeader = "Idempotency-Key"
+
+// maxIdempotencyKey is the longest key accepted, UUIDs and the like fit.
+const maxIdempotencyKey = 255
+
+// ErrInvalidIdempotencyKey is returned for keys longer than
+// maxIdempotencyKey.
+var ErrInvalidIdempotencyKey = errors.New("Idempotency key too long")
+
+// IdempotencyKeyToContext moves the Idempotency-Key header into the request
+// context.
+func IdempotencyKeyToContext(ctx context.Context, r *http.Request) context.Context {
+	if k := r.Header.Get(IdempotencyHeader); k != "" {
+		return context.WithValue(ctx, idempotencyContextKey, k)
+	}
+	return ctx
+}
+
+// IdempotencyMiddleware makes the endpoint of operation, which responds
+// with the id of the resource it created, idempotent for requests with an
+// Idempotency-Key header. Keys are per token subject, so clients can't see
+// each other's results. A key that can't be settled fails the request, a
+// retry couldn't return the same response.
+func IdempotencyMiddleware(s Service, operation string) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			key, ok := ctx.Value(idempotencyContextKey).(string)
+			if !ok {
+				return next(ctx, request)
+			}
+			if len(key) > maxIdempotencyKey {
+				return nil, invalid(ErrInvalidIdempotencyKey)
+			}
+			subject := ""
+			if tok, ok := ctx.Value(tokenContextKey).(string); ok {
+				subject = s.Introspect(tok).Subject
+			}
+			key = operation + ":" + subject + ":" + key
+			id, err := s.ClaimIdempotencyKey(ctx, key, idempotencyFingerprint(request))
+			if err != nil || id != "" {
+				return postResponse{ID: id}, err
+			}
+			response, err := next(ctx, request)
+			created := ""
+			if r, ok := response.(postResponse); ok && err == nil {
+				created = r.ID
+			}
+			if serr := s.SettleIdempotencyKey(ctx, key, created); serr != nil && err == nil {
+				return nil, serr
+			}
+			return response, err
+		}
+	}
+}
+
+// idempotencyFingerprint hashes request to recognize a key reused with
+// another request. Passwords and card numbers are left out, the hash is
+// stored.
+func idempotencyFingerprint(request interface{}) string {
+	switch r := request.(type) {
+	case registerRequest:
+		r.Password = ""
+		request = r
+	case cardPostRequest:
+		r.MaskCC()
+		r.StripCVV()
+		request = r
+	case users.User:
+		r.Cards = append([]users.Card(nil), r.Cards...)
+		for i := range r.Cards {
+			r.Cards[i].MaskCC()
+			r.Cards[i].StripCVV()
+		}
+		request = r
+	}
+	b, _ := json.Marshal(request)
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
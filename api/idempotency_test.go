@@ -0,0 +1,142 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"user/auth"
+	"user/users"
+)
+
+// idempotencyStub keeps the claimed keys in memory the way fixedService
+// does in the database.
+type idempotencyStub struct {
+	Service
+	keys      map[string][2]string
+	settled   int
+	settleErr error
+}
+
+func (s *idempotencyStub) ClaimIdempotencyKey(ctx context.Context, key, fingerprint string) (string, error) {
+	k, ok := s.keys[key]
+	switch {
+	case !ok:
+		s.keys[key] = [2]string{fingerprint, ""}
+		return "", nil
+	case k[0] != fingerprint:
+		return "", ErrIdempotencyKeyReused
+	case k[1] == "":
+		return "", ErrIdempotencyKeyInUse
+	}
+	return k[1], nil
+}
+
+func (s *idempotencyStub) SettleIdempotencyKey(ctx context.Context, key, resultID string) error {
+	s.settled++
+	if s.settleErr != nil {
+		return s.settleErr
+	}
+	if resultID == "" {
+		delete(s.keys, key)
+		return nil
+	}
+	s.keys[key] = [2]string{s.keys[key][0], resultID}
+	return nil
+}
+
+func (s *idempotencyStub) Introspect(token string) auth.Introspection {
+	return auth.Introspection{Active: true, Subject: token}
+}
+
+func TestIdempotencyMiddleware(t *testing.T) {
+	s := &idempotencyStub{keys: map[string][2]string{}}
+	created := 0
+	fail := false
+	e := IdempotencyMiddleware(s, "cards")(func(ctx context.Context, request interface{}) (interface{}, error) {
+		if fail {
+			return postResponse{}, errors.New("declined")
+		}
+		created++
+		return postResponse{ID: "card-" + strings.Repeat("1", created)}, nil
+	})
+	ctx := context.WithValue(context.Background(), idempotencyContextKey, "retry-1")
+	req := cardPostRequest{Card: users.Card{LongNum: "4111111111111111", Expires: "12/30"}, UserID: "1"}
+
+	first, err := e(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := e(ctx, req)
+	if err != nil || again != first || created != 1 {
+		t.Errorf("expected retry to return %v without creating, got %v %v after %v", first, again, err, created)
+	}
+
+	other := req
+	other.LongNum = "5555555555554444"
+	if _, err := e(ctx, other); !errors.Is(err, ErrIdempotencyKeyReused) {
+		t.Errorf("expected key reused with another card rejected, got %v", err)
+	}
+
+	if _, err := e(context.WithValue(ctx, tokenContextKey, "2"), req); err != nil || created != 2 {
+		t.Errorf("expected keys apart per subject, got %v after %v", err, created)
+	}
+
+	fail = true
+	ctx = context.WithValue(context.Background(), idempotencyContextKey, "retry-2")
+	if _, err := e(ctx, req); err == nil {
+		t.Fatal("expected failure")
+	}
+	fail = false
+	if _, err := e(ctx, req); err != nil || created != 3 {
+		t.Errorf("expected key of failed request released, got %v after %v", err, created)
+	}
+
+	if _, err := e(context.Background(), req); err != nil || created != 4 || s.settled != 4 {
+		t.Errorf("expected requests without key passed through, got %v", err)
+	}
+
+	ctx = context.WithValue(context.Background(), idempotencyContextKey, strings.Repeat("k", 256))
+	if _, err := e(ctx, req); !errors.Is(err, ErrInvalidRequest) {
+		t.Errorf("expected too long key rejected, got %v", err)
+	}
+
+	s.settleErr = errors.New("db down")
+	ctx = context.WithValue(context.Background(), idempotencyContextKey, "retry-3")
+	if _, err := e(ctx, req); err != s.settleErr {
+		t.Errorf("expected the error settling the key, got %v", err)
+	}
+	fail = true
+	if _, err := e(context.WithValue(ctx, idempotencyContextKey, "retry-4"), req); err == nil || err == s.settleErr {
+		t.Errorf("expected the error of the failed request, got %v", err)
+	}
+}
+
+func TestIdempotencyFingerprintOmitsSecrets(t *testing.T) {
+	a := registerRequest{Username: "eve", Password: "one"}
+	b := registerRequest{Username: "eve", Password: "two"}
+	if idempotencyFingerprint(a) != idempotencyFingerprint(b) {
+		t.Error("expected passwords left out of the fingerprint")
+	}
+	c := cardPostRequest{Card: users.Card{LongNum: "4111111111111111", CCV: "123"}}
+	d := cardPostRequest{Card: users.Card{LongNum: "4111111111111111"}}
+	if idempotencyFingerprint(c) != idempotencyFingerprint(d) {
+		t.Error("expected CVVs left out of the fingerprint")
+	}
+	d.LongNum = "5555555555554444"
+	if idempotencyFingerprint(c) == idempotencyFingerprint(d) {
+		t.Error("expected other cards to differ")
+	}
+}
+
+func TestEncodeIdempotencyErrors(t *testing.T) {
+	for err, code := range map[error]int{ErrIdempotencyKeyReused: 422, ErrIdempotencyKeyInUse: 409} {
+		w := httptest.NewRecorder()
+		encodeError(context.Background(), err, w)
+		if w.Code != code {
+			t.Errorf("%v: expected %v, got %v", err, code, w.Code)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package api
+
+// limits.go contains the limits protecting the server from slow or
+// malicious clients: the size of request bodies and how long reading the
+// request and writing the response may take. Routes needing more, like
+// avatar uploads, exports and event streams, have their own limits.
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultMaxBodySize is the largest request body read by default.
+	DefaultMaxBodySize = 1 << 20
+	// DefaultReadTimeout bounds reading a request by default.
+	DefaultReadTimeout = 10 * time.Second
+	// DefaultWriteTimeout bounds serving a request by default.
+	DefaultWriteTimeout = 30 * time.Second
+)
+
+// Limits configures LimitHandler. Zero values are unlimited.
+type Limits struct {
+	MaxBodySize  int64
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	// Routes override the limits above for single routes, the last
+	// matching one applies.
+	Routes []RouteLimit
+}
+
+// RouteLimit overrides the limits of the requests with Method on Path, a
+// route template like /customers/{id}/avatar. Zero values keep the general
+// limit, negative ones lift it.
+type RouteLimit struct {
+	Method       string
+	Path         string
+	MaxBodySize  int64
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+}
+
+// DefaultRouteLimits give uploads and exports more time and lift the
+// deadlines of the streams.
+var DefaultRouteLimits = []RouteLimit{
+	{Method: "PUT", Path: "/customers/{id}/avatar", MaxBodySize: MaxAvatarSize + 64<<10, ReadTimeout: time.Minute},
+	{Method: "GET", Path: "/admin/customers/export", WriteTimeout: 10 * time.Minute},
+	{Method: "GET", Path: "/events/stream", ReadTimeout: -1, WriteTimeout: -1},
+	{Method: "GET", Path: "/customers/{id}/events", ReadTimeout: -1, WriteTimeout: -1},
+}
+
+// ParseRouteTimeouts parses comma separated "METHOD /path=duration" route
+// timeouts, setting both the read and write timeout. A zero duration lifts
+// them.
+func ParseRouteTimeouts(s string) ([]RouteLimit, error) {
+	var rls []RouteLimit
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e == "" {
+			continue
+		}
+		route, d, ok := strings.Cut(e, "=")
+		method, path, ok2 := strings.Cut(strings.TrimSpace(route), " ")
+		if !ok || !ok2 {
+			return nil, fmt.Errorf("expected METHOD /path=duration, got %q", e)
+		}
+		t, err := time.ParseDuration(strings.TrimSpace(d))
+		if err != nil {
+			return nil, err
+		}
+		if t == 0 {
+			t = -1
+		}
+		rls = append(rls, RouteLimit{Method: strings.ToUpper(method), Path: strings.TrimSpace(path), ReadTimeout: t, WriteTimeout: t})
+	}
+	return rls, nil
+}
+
+// LimitHandler enforces l on the requests to next. It must wrap the
+// server's own ResponseWriter, or one unwrapping to it, for the deadlines
+// to apply.
+func LimitHandler(l Limits, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		max, read, write := l.MaxBodySize, l.ReadTimeout, l.WriteTimeout
+		for _, rl := range l.Routes {
+			if rl.Method != r.Method || !matchRoute(rl.Path, r.URL.Path) {
+				continue
+			}
+			if rl.MaxBodySize != 0 {
+				max = rl.MaxBodySize
+			}
+			if rl.ReadTimeout != 0 {
+				read = rl.ReadTimeout
+			}
+			if rl.WriteTimeout != 0 {
+				write = rl.WriteTimeout
+			}
+		}
+		if max > 0 && r.Body != nil {
+			r.Body = http.MaxBytesReader(w, r.Body, max)
+		}
+		// Servers not supporting deadlines, like the test recorder, just
+		// don't enforce them.
+		rc := http.NewResponseController(w)
+		rc.SetReadDeadline(deadline(read))
+		rc.SetWriteDeadline(deadline(write))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// deadline is d from now, no deadline for lifted limits.
+func deadline(d time.Duration) time.Time {
+	if d <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(d)
+}
+
+// matchRoute reports whether path, with or without a version prefix, is on
+// the route template.
+func matchRoute(template, path string) bool {
+	ts := strings.Split(strings.Trim(template, "/"), "/")
+	ps := strings.Split(strings.Trim(path, "/"), "/")
+	for _, v := range Versions {
+		if len(ps) > len(ts) && ps[0] == v.Name {
+			ps = ps[1:]
+			break
+		}
+	}
+	if len(ts) != len(ps) {
+		return false
+	}
+	for k, t := range ts {
+		if t != ps[k] && !(strings.HasPrefix(t, "{") && strings.HasSuffix(t, "}")) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,96 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMatchRoute(t *testing.T) {
+	for _, c := range []struct {
+		template, path string
+		match          bool
+	}{
+		{"/customers/{id}/avatar", "/customers/1/avatar", true},
+		{"/customers/{id}/avatar", "/v2/customers/1/avatar", true},
+		{"/customers/{id}/avatar", "/customers/1", false},
+		{"/customers/{id}/avatar", "/customers/1/avatar/2", false},
+		{"/events/stream", "/events/stream/", true},
+		{"/events/stream", "/v3/events/stream", false},
+	} {
+		if got := matchRoute(c.template, c.path); got != c.match {
+			t.Errorf("expected %v on %v %v, got %v", c.path, c.template, c.match, got)
+		}
+	}
+}
+
+func TestParseRouteTimeouts(t *testing.T) {
+	rls, err := ParseRouteTimeouts("GET /admin/customers=1m, post /login=0s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rls) != 2 || rls[0] != (RouteLimit{Method: "GET", Path: "/admin/customers", ReadTimeout: time.Minute, WriteTimeout: time.Minute}) || rls[1].Method != "POST" || rls[1].WriteTimeout >= 0 {
+		t.Errorf("expected both routes parsed, got %+v", rls)
+	}
+	if _, err := ParseRouteTimeouts("/login=1s"); err == nil {
+		t.Error("expected routes without method rejected")
+	}
+}
+
+func TestLimitHandler(t *testing.T) {
+	l := Limits{
+		MaxBodySize:  16,
+		WriteTimeout: 50 * time.Millisecond,
+		Routes: []RouteLimit{
+			{Method: "PUT", Path: "/customers/{id}/avatar", MaxBodySize: 64},
+			{Method: "GET", Path: "/slow", WriteTimeout: -1},
+		},
+	}
+	srv := httptest.NewServer(LimitHandler(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			time.Sleep(100 * time.Millisecond)
+			w.Write([]byte("done"))
+			return
+		}
+		if _, err := io.ReadAll(r.Body); err != nil {
+			encodeError(context.Background(), invalid(err), w)
+		}
+	})))
+	defer srv.Close()
+
+	body := bytes.Repeat([]byte("a"), 32)
+	resp, err := http.Post(srv.URL+"/register", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected large bodies rejected, got %v", resp.StatusCode)
+	}
+	req, _ := http.NewRequest("PUT", srv.URL+"/v1/customers/1/avatar", bytes.NewReader(body))
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected the route limit to allow the body, got %v", resp.StatusCode)
+	}
+
+	if resp, err := http.Get(srv.URL + "/export"); err == nil {
+		resp.Body.Close()
+		t.Error("expected the response cut at the write deadline")
+	}
+	resp, err = http.Get(srv.URL + "/slow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected the lifted deadline to let the response through, got %v", resp.StatusCode)
+	}
+}
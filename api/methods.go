@@ -0,0 +1,120 @@
+package api
+
+// methods.go contains the HEAD and OPTIONS handling of every route. HEAD
+// requests are served by the GET route of their path without the body,
+// OPTIONS requests and requests of methods a path has no route for are
+// answered with its Allow header.
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// ErrMethodNotAllowed is returned for methods a path has no route for.
+var ErrMethodNotAllowed = errors.New("Method not allowed")
+
+// routedMethods are the methods routes are mounted for, in the order the
+// Allow header lists them.
+var routedMethods = []string{"GET", "POST", "PUT", "PATCH", "DELETE"}
+
+// methodsHandler is the handler r calls when a path has routes, but none
+// for the method of the request.
+func methodsHandler(r *mux.Router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		allowed := allowedMethods(r, req)
+		if req.Method == "HEAD" && allowed[0] == "GET" {
+			serveHead(r, w, req)
+			return
+		}
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		if req.Method == "OPTIONS" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		encodeError(req.Context(), ErrMethodNotAllowed, w)
+	})
+}
+
+// allowedMethods returns the methods r routes the path of req for, with
+// HEAD after GET and OPTIONS last.
+func allowedMethods(r *mux.Router, req *http.Request) []string {
+	var allowed []string
+	for _, m := range routedMethods {
+		c := req.Clone(req.Context())
+		c.Method = m
+		// r matches mismatched methods too, with methodsHandler.
+		var match mux.RouteMatch
+		if !r.Match(c, &match) || match.MatchErr != nil {
+			continue
+		}
+		allowed = append(allowed, m)
+		if m == "GET" {
+			allowed = append(allowed, "HEAD")
+		}
+	}
+	return append(allowed, "OPTIONS")
+}
+
+// serveHead serves req as a GET request, writing only the headers of the
+// response and the length of its body. Streamed responses end at their
+// first flush, without a length.
+func serveHead(r *mux.Router, w http.ResponseWriter, req *http.Request) {
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+	get := req.Clone(ctx)
+	get.Method = "GET"
+	hw := &headWriter{ResponseWriter: w, cancel: cancel}
+	r.ServeHTTP(hw, get)
+	hw.writeHeader(true)
+}
+
+// headWriter counts the body instead of writing it.
+type headWriter struct {
+	http.ResponseWriter
+	cancel context.CancelFunc
+	status int
+	length int
+	sent   bool
+}
+
+func (hw *headWriter) WriteHeader(code int) {
+	if hw.status == 0 {
+		hw.status = code
+	}
+}
+
+func (hw *headWriter) Write(p []byte) (int, error) {
+	if hw.status == 0 {
+		hw.status = http.StatusOK
+	}
+	hw.length += len(p)
+	return len(p), nil
+}
+
+// Flush sends the headers of a streamed response and ends it.
+func (hw *headWriter) Flush() {
+	hw.writeHeader(false)
+	hw.cancel()
+}
+
+// writeHeader sends the headers once, with the length of the body if it is
+// complete and no handler set one.
+func (hw *headWriter) writeHeader(complete bool) {
+	if hw.sent {
+		return
+	}
+	hw.sent = true
+	if hw.status == 0 {
+		hw.status = http.StatusOK
+	}
+	h := hw.Header()
+	if complete && h.Get("Content-Length") == "" && hw.status != http.StatusNoContent && hw.status != http.StatusNotModified {
+		h.Set("Content-Length", strconv.Itoa(hw.length))
+	}
+	hw.ResponseWriter.WriteHeader(hw.status)
+}
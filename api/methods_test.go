@@ -0,0 +1,76 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"user/users"
+)
+
+func TestHead(t *testing.T) {
+	h := MakeHTTPHandler(MakeEndpoints(TestService), log.NewNopLogger())
+	for _, path := range []string{"/openapi.json", "/v2/openapi.json", "/live"} {
+		get := httptest.NewRecorder()
+		h.ServeHTTP(get, httptest.NewRequest("GET", path, nil))
+		head := httptest.NewRecorder()
+		h.ServeHTTP(head, httptest.NewRequest("HEAD", path, nil))
+		if head.Code != get.Code || head.Body.Len() != 0 {
+			t.Errorf("%v: expected %v without a body, got %v %q", path, get.Code, head.Code, head.Body)
+		}
+		if l := head.Header().Get("Content-Length"); l != strconv.Itoa(get.Body.Len()) {
+			t.Errorf("%v: expected Content-Length %v, got %q", path, get.Body.Len(), l)
+		}
+		if head.Header().Get("Content-Type") != get.Header().Get("Content-Type") {
+			t.Errorf("%v: expected the headers of GET, got %v", path, head.Header())
+		}
+	}
+}
+
+func TestHeadStream(t *testing.T) {
+	h := MakeHTTPHandler(MakeEndpoints(TestService), log.NewNopLogger())
+	tok, err := TestService.IssueToken(users.User{UserID: "1", Roles: []string{users.RoleAdmin}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("HEAD", "/events/stream", nil)
+		r.Header.Set("Authorization", "Bearer "+tok)
+		h.ServeHTTP(w, r)
+		done <- w
+	}()
+	select {
+	case w := <-done:
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "text/event-stream" || w.Header().Get("Content-Length") != "" {
+			t.Errorf("expected the stream headers without a length, got %v %v", w.Code, w.Header())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected HEAD of the event stream to end")
+	}
+}
+
+func TestAllow(t *testing.T) {
+	h := MakeHTTPHandler(MakeEndpoints(TestService), log.NewNopLogger())
+	for path, allow := range map[string]string{
+		"/login":                                 "GET, HEAD, OPTIONS",
+		"/v2/customers/57a98d98e4b00679b4a830af": "GET, HEAD, PUT, PATCH, DELETE, OPTIONS",
+		"/webhooks":                              "GET, HEAD, POST, OPTIONS",
+		"/graphql":                               "GET, HEAD, POST, OPTIONS",
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("OPTIONS", path, nil))
+		if w.Code != http.StatusNoContent || w.Header().Get("Allow") != allow {
+			t.Errorf("%v: expected %q, got %v %q", path, allow, w.Code, w.Header().Get("Allow"))
+		}
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/login", nil))
+	if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "GET, HEAD, OPTIONS" {
+		t.Errorf("expected 405 with the allowed methods, got %v %v", w.Code, w.Header())
+	}
+}
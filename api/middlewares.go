@@ -1,10 +1,18 @@
 package api
 
 import (
+	"context"
+	"io"
+	"strings"
 	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/metrics"
+	"user/auth"
+	"user/changes"
+	"user/db"
+	"user/patch"
+	"user/risk"
 	"user/users"
 )
 
@@ -26,240 +34,1318 @@ type loggingMiddleware struct {
 	logger log.Logger
 }
 
-func (mw loggingMiddleware) Login(username, password string) (user users.User, err error) {
+func (mw loggingMiddleware) Login(ctx context.Context, username, password string, client risk.Client) (user users.User, err error) {
 	defer func(begin time.Time) {
 		mw.logger.Log(
 			"method", "Login",
+			"ip", client.IP,
 			"took", time.Since(begin),
 		)
 	}(time.Now())
-	return mw.next.Login(username, password)
+	return mw.next.Login(ctx, username, password, client)
 }
 
-func (mw loggingMiddleware) Register(username, password, email, first, last string) (string, error) {
+func (mw loggingMiddleware) Register(ctx context.Context, username, password, email, first, last, phone string) (id string, err error) {
 	defer func(begin time.Time) {
 		mw.logger.Log(
 			"method", "Register",
+			"id", id,
+			"username", username,
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.Register(ctx, username, password, email, first, last, phone)
+}
+
+func (mw loggingMiddleware) Upgrade(ctx context.Context, token, username, password, email, first, last string) (id string, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "Upgrade",
+			"id", id,
+			"username", username,
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.Upgrade(ctx, token, username, password, email, first, last)
+}
+
+func (mw loggingMiddleware) CreateGuest(ctx context.Context) (u users.User, token string, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "CreateGuest",
+			"id", u.UserID,
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.CreateGuest(ctx)
+}
+
+func (mw loggingMiddleware) Available(ctx context.Context, username, email string) (a Availability, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "Available",
 			"username", username,
-			"email", email,
+			"err", err,
 			"took", time.Since(begin),
 		)
 	}(time.Now())
-	return mw.next.Register(username, password, email, first, last)
+	return mw.next.Available(ctx, username, email)
 }
 
-func (mw loggingMiddleware) PostUser(user users.User) (id string, err error) {
+func (mw loggingMiddleware) PostUser(ctx context.Context, user users.User) (id string, err error) {
 	defer func(begin time.Time) {
 		mw.logger.Log(
 			"method", "PostUser",
 			"username", user.Username,
-			"email", user.Email,
 			"result", id,
 			"took", time.Since(begin),
 		)
 	}(time.Now())
-	return mw.next.PostUser(user)
+	return mw.next.PostUser(ctx, user)
 }
 
-func (mw loggingMiddleware) GetUsers(id string) (u []users.User, err error) {
+func (mw loggingMiddleware) UpdateUser(ctx context.Context, id string, p users.ProfileUpdate) (u users.User, err error) {
 	defer func(begin time.Time) {
-		who := id
-		if who == "" {
-			who = "all"
-		}
 		mw.logger.Log(
-			"method", "GetUsers",
-			"id", who,
-			"result", len(u),
+			"method", "UpdateUser",
+			"id", id,
+			"err", err,
 			"took", time.Since(begin),
 		)
 	}(time.Now())
-	return mw.next.GetUsers(id)
+	return mw.next.UpdateUser(ctx, id, p)
 }
 
-func (mw loggingMiddleware) PostAddress(add users.Address, id string) (string, error) {
+func (mw loggingMiddleware) PatchUser(ctx context.Context, id string, p patch.Patch) (u users.User, err error) {
 	defer func(begin time.Time) {
 		mw.logger.Log(
-			"method", "PostAddress",
-			"street", add.Street,
-			"number", add.Number,
-			"user", id,
+			"method", "PatchUser",
+			"id", id,
+			"err", err,
 			"took", time.Since(begin),
 		)
 	}(time.Now())
-	return mw.next.PostAddress(add, id)
+	return mw.next.PatchUser(ctx, id, p)
 }
 
-func (mw loggingMiddleware) GetAddresses(id string) (a []users.Address, err error) {
+func (mw loggingMiddleware) SetAvatar(ctx context.Context, id string, img io.Reader) (u users.User, err error) {
 	defer func(begin time.Time) {
-		who := id
-		if who == "" {
-			who = "all"
-		}
 		mw.logger.Log(
-			"method", "GetAddresses",
-			"id", who,
-			"result", len(a),
+			"method", "SetAvatar",
+			"id", id,
+			"err", err,
 			"took", time.Since(begin),
 		)
 	}(time.Now())
-	return mw.next.GetAddresses(id)
+	return mw.next.SetAvatar(ctx, id, img)
 }
 
-func (mw loggingMiddleware) PostCard(card users.Card, id string) (string, error) {
+func (mw loggingMiddleware) SetPreferences(ctx context.Context, id string, p users.Preferences) (prefs users.Preferences, err error) {
 	defer func(begin time.Time) {
-		cc := card
-		cc.MaskCC()
 		mw.logger.Log(
-			"method", "PostCard",
-			"card", cc.LongNum,
-			"user", id,
+			"method", "SetPreferences",
+			"id", id,
+			"err", err,
 			"took", time.Since(begin),
 		)
 	}(time.Now())
-	return mw.next.PostCard(card, id)
+	return mw.next.SetPreferences(ctx, id, p)
 }
 
-func (mw loggingMiddleware) GetCards(id string) (a []users.Card, err error) {
+func (mw loggingMiddleware) SetStatus(ctx context.Context, id, status string) (u users.User, err error) {
 	defer func(begin time.Time) {
-		who := id
-		if who == "" {
-			who = "all"
-		}
 		mw.logger.Log(
-			"method", "GetCards",
-			"id", who,
-			"result", len(a),
+			"method", "SetStatus",
+			"id", id,
+			"status", status,
+			"err", err,
 			"took", time.Since(begin),
 		)
 	}(time.Now())
-	return mw.next.GetCards(id)
+	return mw.next.SetStatus(ctx, id, status)
 }
 
-func (mw loggingMiddleware) Delete(entity, id string) (err error) {
+func (mw loggingMiddleware) Stats(ctx context.Context, days int) (st db.Stats, err error) {
 	defer func(begin time.Time) {
 		mw.logger.Log(
-			"method", "Delete",
-			"entity", entity,
+			"method", "Stats",
+			"days", days,
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.Stats(ctx, days)
+}
+
+func (mw loggingMiddleware) ListCards(ctx context.Context, cursor string, limit int) (cs []db.OwnedCard, next string, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "ListCards",
+			"cursor", cursor,
+			"limit", limit,
+			"result", len(cs),
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.ListCards(ctx, cursor, limit)
+}
+
+func (mw loggingMiddleware) ListUsers(ctx context.Context, cursor string, limit int) (us []users.User, next string, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "ListUsers",
+			"cursor", cursor,
+			"limit", limit,
+			"result", len(us),
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.ListUsers(ctx, cursor, limit)
+}
+
+func (mw loggingMiddleware) CreateGroup(ctx context.Context, g users.Group) (group users.Group, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "CreateGroup",
+			"name", g.Name,
+			"result", group.ID,
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.CreateGroup(ctx, g)
+}
+
+func (mw loggingMiddleware) GetGroup(ctx context.Context, id string) (g users.Group, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "GetGroup",
 			"id", id,
+			"err", err,
 			"took", time.Since(begin),
 		)
 	}(time.Now())
-	return mw.next.Delete(entity, id)
+	return mw.next.GetGroup(ctx, id)
 }
 
-func (mw loggingMiddleware) Health() (health []Health) {
+func (mw loggingMiddleware) Activity(ctx context.Context, id, cursor string, limit int) (as []users.Activity, next string, err error) {
 	defer func(begin time.Time) {
 		mw.logger.Log(
-			"method", "Health",
-			"result", len(health),
+			"method", "Activity",
+			"id", id,
+			"result", len(as),
+			"err", err,
 			"took", time.Since(begin),
 		)
 	}(time.Now())
-	return mw.next.Health()
+	return mw.next.Activity(ctx, id, cursor, limit)
 }
 
-type instrumentingService struct {
-	requestCount   metrics.Counter
-	requestLatency metrics.Histogram
-	Service
+func (mw loggingMiddleware) GetUserGroups(ctx context.Context, userID string) (gs []users.Group, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "GetUserGroups",
+			"user", userID,
+			"result", len(gs),
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.GetUserGroups(ctx, userID)
 }
 
-// NewInstrumentingService returns an instance of an instrumenting Service.
-func NewInstrumentingService(requestCount metrics.Counter, requestLatency metrics.Histogram, s Service) Service {
-	return &instrumentingService{
-		requestCount:   requestCount,
-		requestLatency: requestLatency,
-		Service:        s,
-	}
+func (mw loggingMiddleware) AddGroupMember(ctx context.Context, groupID, userID string) (g users.Group, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "AddGroupMember",
+			"group", groupID,
+			"user", userID,
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.AddGroupMember(ctx, groupID, userID)
 }
 
-func (s *instrumentingService) Login(username, password string) (users.User, error) {
+func (mw loggingMiddleware) RemoveGroupMember(ctx context.Context, groupID, userID string) (g users.Group, err error) {
 	defer func(begin time.Time) {
-		s.requestCount.With("method", "login").Add(1)
-		s.requestLatency.With("method", "login").Observe(time.Since(begin).Seconds())
+		mw.logger.Log(
+			"method", "RemoveGroupMember",
+			"group", groupID,
+			"user", userID,
+			"err", err,
+			"took", time.Since(begin),
+		)
 	}(time.Now())
+	return mw.next.RemoveGroupMember(ctx, groupID, userID)
+}
 
-	return s.Service.Login(username, password)
+func (mw loggingMiddleware) CreateWebhook(ctx context.Context, w users.Webhook) (created users.Webhook, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "CreateWebhook",
+			"url", w.URL,
+			"result", created.ID,
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.CreateWebhook(ctx, w)
 }
 
-func (s *instrumentingService) Register(username, password, email, first, last string) (string, error) {
+func (mw loggingMiddleware) GetWebhooks(ctx context.Context) (ws []users.Webhook, err error) {
 	defer func(begin time.Time) {
-		s.requestCount.With("method", "register").Add(1)
-		s.requestLatency.With("method", "register").Observe(time.Since(begin).Seconds())
+		mw.logger.Log(
+			"method", "GetWebhooks",
+			"result", len(ws),
+			"err", err,
+			"took", time.Since(begin),
+		)
 	}(time.Now())
+	return mw.next.GetWebhooks(ctx)
+}
 
-	return s.Service.Register(username, password, email, first, last)
+func (mw loggingMiddleware) DeleteWebhook(ctx context.Context, id string) (err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "DeleteWebhook",
+			"id", id,
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.DeleteWebhook(ctx, id)
 }
 
-func (s *instrumentingService) PostUser(user users.User) (string, error) {
+func (mw loggingMiddleware) WebhookDeliveries(ctx context.Context, id, cursor string, limit int) (ds []users.WebhookDelivery, next string, err error) {
 	defer func(begin time.Time) {
-		s.requestCount.With("method", "postUser").Add(1)
-		s.requestLatency.With("method", "postUser").Observe(time.Since(begin).Seconds())
+		mw.logger.Log(
+			"method", "WebhookDeliveries",
+			"id", id,
+			"result", len(ds),
+			"err", err,
+			"took", time.Since(begin),
+		)
 	}(time.Now())
+	return mw.next.WebhookDeliveries(ctx, id, cursor, limit)
+}
 
-	return s.Service.PostUser(user)
+func (mw loggingMiddleware) ResetPassword(ctx context.Context, id, password string) (generated string, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "ResetPassword",
+			"id", id,
+			"generated", password == "",
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.ResetPassword(ctx, id, password)
 }
 
-func (s *instrumentingService) GetUsers(id string) (u []users.User, err error) {
+func (mw loggingMiddleware) Merge(ctx context.Context, target, source, prefer string) (u users.User, err error) {
 	defer func(begin time.Time) {
-		s.requestCount.With("method", "getUsers").Add(1)
-		s.requestLatency.With("method", "getUsers").Observe(time.Since(begin).Seconds())
+		mw.logger.Log(
+			"method", "Merge",
+			"target", target,
+			"source", source,
+			"prefer", prefer,
+			"err", err,
+			"took", time.Since(begin),
+		)
 	}(time.Now())
+	return mw.next.Merge(ctx, target, source, prefer)
+}
 
-	return s.Service.GetUsers(id)
+func (mw loggingMiddleware) ImportAddresses(ctx context.Context, userid string, as []users.Address) (res []AddressImportResult, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "ImportAddresses",
+			"user", userid,
+			"addresses", len(as),
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.ImportAddresses(ctx, userid, as)
 }
 
-func (s *instrumentingService) PostAddress(add users.Address, id string) (string, error) {
+func (mw loggingMiddleware) Batch(ctx context.Context, ops []BatchOperation) (res []BatchResult, err error) {
 	defer func(begin time.Time) {
-		s.requestCount.With("method", "postAddress").Add(1)
-		s.requestLatency.With("method", "postAddress").Observe(time.Since(begin).Seconds())
+		mw.logger.Log(
+			"method", "Batch",
+			"operations", len(ops),
+			"err", err,
+			"took", time.Since(begin),
+		)
 	}(time.Now())
+	return mw.next.Batch(ctx, ops)
+}
 
-	return s.Service.PostAddress(add, id)
+func (mw loggingMiddleware) SendPhoneCode(ctx context.Context, id string) (err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "SendPhoneCode",
+			"id", id,
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.SendPhoneCode(ctx, id)
 }
 
-func (s *instrumentingService) GetAddresses(id string) ([]users.Address, error) {
+func (mw loggingMiddleware) VerifyPhone(ctx context.Context, id, code string) (u users.User, err error) {
 	defer func(begin time.Time) {
-		s.requestCount.With("method", "getAddresses").Add(1)
-		s.requestLatency.With("method", "getAddresses").Observe(time.Since(begin).Seconds())
+		mw.logger.Log(
+			"method", "VerifyPhone",
+			"id", id,
+			"err", err,
+			"took", time.Since(begin),
+		)
 	}(time.Now())
+	return mw.next.VerifyPhone(ctx, id, code)
+}
 
-	return s.Service.GetAddresses(id)
+func (mw loggingMiddleware) Rename(ctx context.Context, id, username string) (u users.User, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "Rename",
+			"id", id,
+			"username", username,
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.Rename(ctx, id, username)
 }
 
-func (s *instrumentingService) PostCard(card users.Card, id string) (string, error) {
+func (mw loggingMiddleware) AddTag(ctx context.Context, id, tag string) (u users.User, err error) {
 	defer func(begin time.Time) {
-		s.requestCount.With("method", "postCard").Add(1)
-		s.requestLatency.With("method", "postCard").Observe(time.Since(begin).Seconds())
+		mw.logger.Log(
+			"method", "AddTag",
+			"id", id,
+			"tag", tag,
+			"err", err,
+			"took", time.Since(begin),
+		)
 	}(time.Now())
+	return mw.next.AddTag(ctx, id, tag)
+}
 
-	return s.Service.PostCard(card, id)
+func (mw loggingMiddleware) RemoveTag(ctx context.Context, id, tag string) (u users.User, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "RemoveTag",
+			"id", id,
+			"tag", tag,
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.RemoveTag(ctx, id, tag)
 }
 
-func (s *instrumentingService) GetCards(id string) ([]users.Card, error) {
+func (mw loggingMiddleware) GetUsers(ctx context.Context, id string) (u []users.User, err error) {
 	defer func(begin time.Time) {
-		s.requestCount.With("method", "getCards").Add(1)
-		s.requestLatency.With("method", "getCards").Observe(time.Since(begin).Seconds())
+		who := id
+		if who == "" {
+			who = "all"
+		}
+		mw.logger.Log(
+			"method", "GetUsers",
+			"id", who,
+			"result", len(u),
+			"took", time.Since(begin),
+		)
 	}(time.Now())
+	return mw.next.GetUsers(ctx, id)
+}
 
-	return s.Service.GetCards(id)
+func (mw loggingMiddleware) GetUserAttributes(ctx context.Context, u *users.User) (err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "GetUserAttributes",
+			"id", u.UserID,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.GetUserAttributes(ctx, u)
 }
 
-func (s *instrumentingService) Delete(entity, id string) error {
+func (mw loggingMiddleware) ExpandUsers(ctx context.Context, us []users.User, expand []string) (err error) {
 	defer func(begin time.Time) {
-		s.requestCount.With("method", "delete").Add(1)
-		s.requestLatency.With("method", "delete").Observe(time.Since(begin).Seconds())
+		mw.logger.Log(
+			"method", "ExpandUsers",
+			"users", len(us),
+			"expand", strings.Join(expand, ","),
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.ExpandUsers(ctx, us, expand)
+}
+
+func (mw loggingMiddleware) BatchGetUsers(ctx context.Context, ids []string) (us []users.User, missing []string, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "BatchGetUsers",
+			"ids", len(ids),
+			"result", len(us),
+			"missing", len(missing),
+			"err", err,
+			"took", time.Since(begin),
+		)
 	}(time.Now())
+	return mw.next.BatchGetUsers(ctx, ids)
+}
 
-	return s.Service.Delete(entity, id)
+func (mw loggingMiddleware) ExportUsers(ctx context.Context, w io.Writer, mask []string) (err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "ExportUsers",
+			"mask", strings.Join(mask, ","),
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.ExportUsers(ctx, w, mask)
 }
 
-func (s *instrumentingService) Health() []Health {
+func (mw loggingMiddleware) FindUsers(ctx context.Context, q db.UserQuery) (u []users.User, err error) {
 	defer func(begin time.Time) {
-		s.requestCount.With("method", "health").Add(1)
-		s.requestLatency.With("method", "health").Observe(time.Since(begin).Seconds())
+		mw.logger.Log(
+			"method", "FindUsers",
+			"lastName", q.LastName,
+			"createdAfter", q.CreatedAfter,
+			"sort", q.Sort,
+			"result", len(u),
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.FindUsers(ctx, q)
+}
+
+func (mw loggingMiddleware) PostAddress(ctx context.Context, add users.Address, id string) (string, error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "PostAddress",
+			"street", add.Street,
+			"number", add.Number,
+			"user", id,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.PostAddress(ctx, add, id)
+}
+
+func (mw loggingMiddleware) PatchAddress(ctx context.Context, id string, p patch.Patch) (a users.Address, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "PatchAddress",
+			"id", id,
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.PatchAddress(ctx, id, p)
+}
+
+func (mw loggingMiddleware) GetAddresses(ctx context.Context, id string) (a []users.Address, err error) {
+	defer func(begin time.Time) {
+		who := id
+		if who == "" {
+			who = "all"
+		}
+		mw.logger.Log(
+			"method", "GetAddresses",
+			"id", who,
+			"result", len(a),
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.GetAddresses(ctx, id)
+}
+
+func (mw loggingMiddleware) GetAddressesByID(ctx context.Context, ids []string) (a []users.Address, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "GetAddressesByID",
+			"ids", len(ids),
+			"result", len(a),
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.GetAddressesByID(ctx, ids)
+}
+
+func (mw loggingMiddleware) PostCard(ctx context.Context, card users.Card, id string) (string, error) {
+	defer func(begin time.Time) {
+		cc := card
+		cc.MaskCC()
+		mw.logger.Log(
+			"method", "PostCard",
+			"card", cc.LongNum,
+			"user", id,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.PostCard(ctx, card, id)
+}
+
+func (mw loggingMiddleware) UpdateCard(ctx context.Context, id string, u users.CardUpdate) (c users.Card, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "UpdateCard",
+			"id", id,
+			"fields", strings.Join(u.Fields(), ","),
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.UpdateCard(ctx, id, u)
+}
+
+func (mw loggingMiddleware) SetDefaultCard(ctx context.Context, id string) (c users.Card, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "SetDefaultCard",
+			"id", id,
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.SetDefaultCard(ctx, id)
+}
+
+func (mw loggingMiddleware) GetCards(ctx context.Context, id string) (a []users.Card, err error) {
+	defer func(begin time.Time) {
+		who := id
+		if who == "" {
+			who = "all"
+		}
+		mw.logger.Log(
+			"method", "GetCards",
+			"id", who,
+			"result", len(a),
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.GetCards(ctx, id)
+}
+
+func (mw loggingMiddleware) ClaimIdempotencyKey(ctx context.Context, key, fingerprint string) (id string, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "ClaimIdempotencyKey",
+			"replayed", id != "",
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.ClaimIdempotencyKey(ctx, key, fingerprint)
+}
+
+func (mw loggingMiddleware) SettleIdempotencyKey(ctx context.Context, key, resultID string) (err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "SettleIdempotencyKey",
+			"result", resultID,
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.SettleIdempotencyKey(ctx, key, resultID)
+}
+
+func (mw loggingMiddleware) GetCardsByID(ctx context.Context, ids []string) (c []users.Card, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "GetCardsByID",
+			"ids", len(ids),
+			"result", len(c),
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.GetCardsByID(ctx, ids)
+}
+
+func (mw loggingMiddleware) Delete(ctx context.Context, entity, id string) (err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "Delete",
+			"entity", entity,
+			"id", id,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.Delete(ctx, entity, id)
+}
+
+func (mw loggingMiddleware) IssueToken(u users.User, scopes []string) (token string, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "IssueToken",
+			"user", u.UserID,
+			"scopes", strings.Join(scopes, " "),
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.IssueToken(u, scopes)
+}
+
+func (mw loggingMiddleware) Introspect(token string) (i auth.Introspection) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "Introspect",
+			"active", i.Active,
+			"sub", i.Subject,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.Introspect(token)
+}
+
+func (mw loggingMiddleware) AuthenticateClient(id, secret string) (ok bool) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "AuthenticateClient",
+			"client", id,
+			"ok", ok,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.AuthenticateClient(id, secret)
+}
+
+func (mw loggingMiddleware) Changes(lastEventID string) *changes.Subscription {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "Changes",
+			"lastEventId", lastEventID,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.Changes(lastEventID)
+}
+
+func (mw loggingMiddleware) Notifications(id string) *changes.Subscription {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "Notifications",
+			"id", id,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.Notifications(id)
+}
+
+func (mw loggingMiddleware) DeleteUsers(ctx context.Context, ids []string) (res map[string]error, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "DeleteUsers",
+			"ids", len(ids),
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.DeleteUsers(ctx, ids)
+}
+
+func (mw loggingMiddleware) ExpireGuests(ctx context.Context, before time.Time) (n int, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "ExpireGuests",
+			"before", before,
+			"expired", n,
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.ExpireGuests(ctx, before)
+}
+
+func (mw loggingMiddleware) Health(ctx context.Context, deep bool) (health []Health) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "Health",
+			"deep", deep,
+			"result", len(health),
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.Health(ctx, deep)
+}
+
+func (mw loggingMiddleware) Ready(ctx context.Context) (health []Health) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "Ready",
+			"result", len(health),
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.Ready(ctx)
+}
+
+type instrumentingService struct {
+	requestCount   metrics.Counter
+	requestLatency metrics.Histogram
+	Service
+}
+
+// NewInstrumentingService returns an instance of an instrumenting Service.
+func NewInstrumentingService(requestCount metrics.Counter, requestLatency metrics.Histogram, s Service) Service {
+	return &instrumentingService{
+		requestCount:   requestCount,
+		requestLatency: requestLatency,
+		Service:        s,
+	}
+}
+
+func (s *instrumentingService) Login(ctx context.Context, username, password string, client risk.Client) (users.User, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "login").Add(1)
+		s.requestLatency.With("method", "login").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.Login(ctx, username, password, client)
+}
+
+func (s *instrumentingService) Register(ctx context.Context, username, password, email, first, last, phone string) (string, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "register").Add(1)
+		s.requestLatency.With("method", "register").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.Register(ctx, username, password, email, first, last, phone)
+}
+
+func (s *instrumentingService) Upgrade(ctx context.Context, token, username, password, email, first, last string) (string, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "upgrade").Add(1)
+		s.requestLatency.With("method", "upgrade").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.Upgrade(ctx, token, username, password, email, first, last)
+}
+
+func (s *instrumentingService) CreateGuest(ctx context.Context) (users.User, string, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "createGuest").Add(1)
+		s.requestLatency.With("method", "createGuest").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.CreateGuest(ctx)
+}
+
+func (s *instrumentingService) Available(ctx context.Context, username, email string) (Availability, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "available").Add(1)
+		s.requestLatency.With("method", "available").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.Available(ctx, username, email)
+}
+
+func (s *instrumentingService) PostUser(ctx context.Context, user users.User) (string, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "postUser").Add(1)
+		s.requestLatency.With("method", "postUser").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.PostUser(ctx, user)
+}
+
+func (s *instrumentingService) UpdateUser(ctx context.Context, id string, p users.ProfileUpdate) (users.User, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "updateUser").Add(1)
+		s.requestLatency.With("method", "updateUser").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.UpdateUser(ctx, id, p)
+}
+
+func (s *instrumentingService) PatchUser(ctx context.Context, id string, p patch.Patch) (users.User, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "patchUser").Add(1)
+		s.requestLatency.With("method", "patchUser").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.PatchUser(ctx, id, p)
+}
+
+func (s *instrumentingService) SetAvatar(ctx context.Context, id string, img io.Reader) (users.User, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "setAvatar").Add(1)
+		s.requestLatency.With("method", "setAvatar").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.SetAvatar(ctx, id, img)
+}
+
+func (s *instrumentingService) SetPreferences(ctx context.Context, id string, p users.Preferences) (users.Preferences, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "setPreferences").Add(1)
+		s.requestLatency.With("method", "setPreferences").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.SetPreferences(ctx, id, p)
+}
+
+func (s *instrumentingService) SetStatus(ctx context.Context, id, status string) (users.User, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "setStatus").Add(1)
+		s.requestLatency.With("method", "setStatus").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.SetStatus(ctx, id, status)
+}
+
+func (s *instrumentingService) Stats(ctx context.Context, days int) (db.Stats, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "stats").Add(1)
+		s.requestLatency.With("method", "stats").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.Stats(ctx, days)
+}
+
+func (s *instrumentingService) ListCards(ctx context.Context, cursor string, limit int) ([]db.OwnedCard, string, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "listCards").Add(1)
+		s.requestLatency.With("method", "listCards").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.ListCards(ctx, cursor, limit)
+}
+
+func (s *instrumentingService) ListUsers(ctx context.Context, cursor string, limit int) ([]users.User, string, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "listUsers").Add(1)
+		s.requestLatency.With("method", "listUsers").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.ListUsers(ctx, cursor, limit)
+}
+
+func (s *instrumentingService) CreateGroup(ctx context.Context, g users.Group) (users.Group, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "createGroup").Add(1)
+		s.requestLatency.With("method", "createGroup").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.CreateGroup(ctx, g)
+}
+
+func (s *instrumentingService) GetGroup(ctx context.Context, id string) (users.Group, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "getGroup").Add(1)
+		s.requestLatency.With("method", "getGroup").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.GetGroup(ctx, id)
+}
+
+func (s *instrumentingService) Activity(ctx context.Context, id, cursor string, limit int) ([]users.Activity, string, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "activity").Add(1)
+		s.requestLatency.With("method", "activity").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.Activity(ctx, id, cursor, limit)
+}
+
+func (s *instrumentingService) GetUserGroups(ctx context.Context, userID string) ([]users.Group, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "getUserGroups").Add(1)
+		s.requestLatency.With("method", "getUserGroups").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.GetUserGroups(ctx, userID)
+}
+
+func (s *instrumentingService) AddGroupMember(ctx context.Context, groupID, userID string) (users.Group, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "addGroupMember").Add(1)
+		s.requestLatency.With("method", "addGroupMember").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.AddGroupMember(ctx, groupID, userID)
+}
+
+func (s *instrumentingService) RemoveGroupMember(ctx context.Context, groupID, userID string) (users.Group, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "removeGroupMember").Add(1)
+		s.requestLatency.With("method", "removeGroupMember").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.RemoveGroupMember(ctx, groupID, userID)
+}
+
+func (s *instrumentingService) CreateWebhook(ctx context.Context, w users.Webhook) (users.Webhook, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "createWebhook").Add(1)
+		s.requestLatency.With("method", "createWebhook").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.CreateWebhook(ctx, w)
+}
+
+func (s *instrumentingService) GetWebhooks(ctx context.Context) ([]users.Webhook, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "getWebhooks").Add(1)
+		s.requestLatency.With("method", "getWebhooks").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.GetWebhooks(ctx)
+}
+
+func (s *instrumentingService) DeleteWebhook(ctx context.Context, id string) error {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "deleteWebhook").Add(1)
+		s.requestLatency.With("method", "deleteWebhook").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.DeleteWebhook(ctx, id)
+}
+
+func (s *instrumentingService) WebhookDeliveries(ctx context.Context, id, cursor string, limit int) ([]users.WebhookDelivery, string, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "webhookDeliveries").Add(1)
+		s.requestLatency.With("method", "webhookDeliveries").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.WebhookDeliveries(ctx, id, cursor, limit)
+}
+
+func (s *instrumentingService) ResetPassword(ctx context.Context, id, password string) (string, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "resetPassword").Add(1)
+		s.requestLatency.With("method", "resetPassword").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.ResetPassword(ctx, id, password)
+}
+
+func (s *instrumentingService) Merge(ctx context.Context, target, source, prefer string) (users.User, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "merge").Add(1)
+		s.requestLatency.With("method", "merge").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.Merge(ctx, target, source, prefer)
+}
+
+func (s *instrumentingService) ImportAddresses(ctx context.Context, userid string, as []users.Address) ([]AddressImportResult, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "importAddresses").Add(1)
+		s.requestLatency.With("method", "importAddresses").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.ImportAddresses(ctx, userid, as)
+}
+
+func (s *instrumentingService) Batch(ctx context.Context, ops []BatchOperation) ([]BatchResult, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "batch").Add(1)
+		s.requestLatency.With("method", "batch").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.Batch(ctx, ops)
+}
+
+func (s *instrumentingService) SendPhoneCode(ctx context.Context, id string) error {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "sendPhoneCode").Add(1)
+		s.requestLatency.With("method", "sendPhoneCode").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.SendPhoneCode(ctx, id)
+}
+
+func (s *instrumentingService) VerifyPhone(ctx context.Context, id, code string) (users.User, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "verifyPhone").Add(1)
+		s.requestLatency.With("method", "verifyPhone").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.VerifyPhone(ctx, id, code)
+}
+
+func (s *instrumentingService) Rename(ctx context.Context, id, username string) (users.User, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "rename").Add(1)
+		s.requestLatency.With("method", "rename").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.Rename(ctx, id, username)
+}
+
+func (s *instrumentingService) AddTag(ctx context.Context, id, tag string) (users.User, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "addTag").Add(1)
+		s.requestLatency.With("method", "addTag").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.AddTag(ctx, id, tag)
+}
+
+func (s *instrumentingService) RemoveTag(ctx context.Context, id, tag string) (users.User, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "removeTag").Add(1)
+		s.requestLatency.With("method", "removeTag").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.RemoveTag(ctx, id, tag)
+}
+
+func (s *instrumentingService) GetUsers(ctx context.Context, id string) (u []users.User, err error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "getUsers").Add(1)
+		s.requestLatency.With("method", "getUsers").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.GetUsers(ctx, id)
+}
+
+func (s *instrumentingService) GetUserAttributes(ctx context.Context, u *users.User) error {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "getUserAttributes").Add(1)
+		s.requestLatency.With("method", "getUserAttributes").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.GetUserAttributes(ctx, u)
+}
+
+func (s *instrumentingService) ExpandUsers(ctx context.Context, us []users.User, expand []string) error {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "expandUsers").Add(1)
+		s.requestLatency.With("method", "expandUsers").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.ExpandUsers(ctx, us, expand)
+}
+
+func (s *instrumentingService) BatchGetUsers(ctx context.Context, ids []string) ([]users.User, []string, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "batchGetUsers").Add(1)
+		s.requestLatency.With("method", "batchGetUsers").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.BatchGetUsers(ctx, ids)
+}
+
+func (s *instrumentingService) ExportUsers(ctx context.Context, w io.Writer, mask []string) error {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "exportUsers").Add(1)
+		s.requestLatency.With("method", "exportUsers").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.ExportUsers(ctx, w, mask)
+}
+
+func (s *instrumentingService) FindUsers(ctx context.Context, q db.UserQuery) ([]users.User, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "findUsers").Add(1)
+		s.requestLatency.With("method", "findUsers").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.FindUsers(ctx, q)
+}
+
+func (s *instrumentingService) PostAddress(ctx context.Context, add users.Address, id string) (string, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "postAddress").Add(1)
+		s.requestLatency.With("method", "postAddress").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.PostAddress(ctx, add, id)
+}
+
+func (s *instrumentingService) PatchAddress(ctx context.Context, id string, p patch.Patch) (users.Address, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "patchAddress").Add(1)
+		s.requestLatency.With("method", "patchAddress").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.PatchAddress(ctx, id, p)
+}
+
+func (s *instrumentingService) GetAddresses(ctx context.Context, id string) ([]users.Address, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "getAddresses").Add(1)
+		s.requestLatency.With("method", "getAddresses").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.GetAddresses(ctx, id)
+}
+
+func (s *instrumentingService) GetAddressesByID(ctx context.Context, ids []string) ([]users.Address, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "getAddressesByID").Add(1)
+		s.requestLatency.With("method", "getAddressesByID").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.GetAddressesByID(ctx, ids)
+}
+
+func (s *instrumentingService) PostCard(ctx context.Context, card users.Card, id string) (string, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "postCard").Add(1)
+		s.requestLatency.With("method", "postCard").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.PostCard(ctx, card, id)
+}
+
+func (s *instrumentingService) UpdateCard(ctx context.Context, id string, u users.CardUpdate) (users.Card, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "updateCard").Add(1)
+		s.requestLatency.With("method", "updateCard").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.UpdateCard(ctx, id, u)
+}
+
+func (s *instrumentingService) SetDefaultCard(ctx context.Context, id string) (users.Card, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "setDefaultCard").Add(1)
+		s.requestLatency.With("method", "setDefaultCard").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.SetDefaultCard(ctx, id)
+}
+
+func (s *instrumentingService) GetCards(ctx context.Context, id string) ([]users.Card, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "getCards").Add(1)
+		s.requestLatency.With("method", "getCards").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.GetCards(ctx, id)
+}
+
+func (s *instrumentingService) ClaimIdempotencyKey(ctx context.Context, key, fingerprint string) (string, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "claimIdempotencyKey").Add(1)
+		s.requestLatency.With("method", "claimIdempotencyKey").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.ClaimIdempotencyKey(ctx, key, fingerprint)
+}
+
+func (s *instrumentingService) SettleIdempotencyKey(ctx context.Context, key, resultID string) error {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "settleIdempotencyKey").Add(1)
+		s.requestLatency.With("method", "settleIdempotencyKey").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.SettleIdempotencyKey(ctx, key, resultID)
+}
+
+func (s *instrumentingService) GetCardsByID(ctx context.Context, ids []string) ([]users.Card, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "getCardsByID").Add(1)
+		s.requestLatency.With("method", "getCardsByID").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.GetCardsByID(ctx, ids)
+}
+
+func (s *instrumentingService) Delete(ctx context.Context, entity, id string) error {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "delete").Add(1)
+		s.requestLatency.With("method", "delete").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.Delete(ctx, entity, id)
+}
+
+func (s *instrumentingService) IssueToken(u users.User, scopes []string) (string, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "issueToken").Add(1)
+		s.requestLatency.With("method", "issueToken").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.IssueToken(u, scopes)
+}
+
+func (s *instrumentingService) Introspect(token string) auth.Introspection {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "introspect").Add(1)
+		s.requestLatency.With("method", "introspect").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.Introspect(token)
+}
+
+func (s *instrumentingService) AuthenticateClient(id, secret string) bool {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "authenticateClient").Add(1)
+		s.requestLatency.With("method", "authenticateClient").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.AuthenticateClient(id, secret)
+}
+
+func (s *instrumentingService) Changes(lastEventID string) *changes.Subscription {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "changes").Add(1)
+		s.requestLatency.With("method", "changes").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.Changes(lastEventID)
+}
+
+func (s *instrumentingService) Notifications(id string) *changes.Subscription {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "notifications").Add(1)
+		s.requestLatency.With("method", "notifications").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.Notifications(id)
+}
+
+func (s *instrumentingService) DeleteUsers(ctx context.Context, ids []string) (map[string]error, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "deleteUsers").Add(1)
+		s.requestLatency.With("method", "deleteUsers").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.DeleteUsers(ctx, ids)
+}
+
+func (s *instrumentingService) ExpireGuests(ctx context.Context, before time.Time) (int, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "expireGuests").Add(1)
+		s.requestLatency.With("method", "expireGuests").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.ExpireGuests(ctx, before)
+}
+
+func (s *instrumentingService) Health(ctx context.Context, deep bool) []Health {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "health").Add(1)
+		s.requestLatency.With("method", "health").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.Health(ctx, deep)
+}
+
+func (s *instrumentingService) Ready(ctx context.Context) []Health {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "ready").Add(1)
+		s.requestLatency.With("method", "ready").Observe(time.Since(begin).Seconds())
 	}(time.Now())
 
-	return s.Service.Health()
+	return s.Service.Ready(ctx)
 }
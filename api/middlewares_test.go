@@ -1,8 +1,14 @@
 package api
 
 import (
+	"context"
 	"fmt"
+	"strings"
 	"testing"
+
+	"user/db"
+	"user/db/inmem"
+	"user/users"
 )
 
 var (
@@ -18,9 +24,58 @@ func newBogusLogger() bogusLogger {
 }
 
 func (bl bogusLogger) Log(v ...interface{}) error {
-	_, err := fmt.Println(v)
+	_, err := fmt.Println(v...)
 	return err
 }
 
+type recordingLogger struct {
+	lines *[]string
+}
+
+func (rl recordingLogger) Log(v ...interface{}) error {
+	*rl.lines = append(*rl.lines, fmt.Sprintln(v...))
+	return nil
+}
+
+func TestPostCardNeverLogsCVV(t *testing.T) {
+	ctx := context.Background()
+	var lines []string
+	s := LoggingMiddleware(recordingLogger{&lines})(NewFixedService(WithCardVault(declining{})))
+	s.PostCard(ctx, users.Card{LongNum: "4111111111111111", Expires: "01/99", CCV: "737"}, "")
+	if len(lines) == 0 {
+		t.Fatal("expected PostCard to be logged")
+	}
+	for _, l := range lines {
+		if strings.Contains(l, "737") || strings.Contains(l, "4111111111111111") {
+			t.Errorf("expected card secrets kept out of the log, got %q", l)
+		}
+	}
+}
+
+func TestRegisterNeverLogsEmail(t *testing.T) {
+	ctx := context.Background()
+	m := &inmem.Memory{}
+	if err := m.Init(); err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	s := LoggingMiddleware(recordingLogger{&lines})(NewFixedService(WithTenant("", db.NewStore(m))))
+	id, err := s.Register(ctx, "jane", "secret-password", "jane@example.com", "Jane", "Doe", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) == 0 {
+		t.Fatal("expected Register to be logged")
+	}
+	for _, l := range lines {
+		if strings.Contains(l, "jane@example.com") {
+			t.Errorf("expected the email kept out of the log, got %q", l)
+		}
+		if !strings.Contains(l, id) {
+			t.Errorf("expected the user id logged, got %q", l)
+		}
+	}
+}
+
 func TestLoginMiddleWare(t *testing.T) {
 }
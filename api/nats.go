@@ -0,0 +1,149 @@
+package api
+
+// nats.go contains the NATS transport. Services in the mesh call the user
+// endpoints by request-reply on NATS subjects where an HTTP hop is
+// undesirable. Requests are decoded and validated like their HTTP routes,
+// replies carry the JSON bodies the HTTP transport responds with.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+	natstransport "github.com/go-kit/kit/transport/nats"
+	"github.com/nats-io/nats.go"
+
+	"user/users"
+)
+
+// Subjects of the endpoints served over NATS.
+const (
+	// SubjectGet gets a customer: {"id":"...","fields":[...],"expand":[...]}.
+	SubjectGet = "user.get"
+	// SubjectLogin logs in: {"username":"...","password":"...","scope":"..."}.
+	SubjectLogin = "user.login"
+)
+
+// natsGetRequest is the request of SubjectGet, the id, fields and expand of
+// GET /customers/{id}.
+type natsGetRequest struct {
+	ID     string   `json:"id"`
+	Fields []string `json:"fields,omitempty"`
+	Expand []string `json:"expand,omitempty"`
+}
+
+// natsLoginRequest is the request of SubjectLogin, the credentials and
+// scope of GET /login.
+type natsLoginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Scope    string `json:"scope,omitempty"`
+}
+
+// MountNATS subscribes the endpoints to their subjects on nc in the queue
+// group, so the replicas of the service share the requests. Draining nc
+// ends the subscriptions.
+func MountNATS(nc *nats.Conn, e Endpoints, queue string, logger log.Logger) error {
+	options := []natstransport.SubscriberOption{
+		natstransport.SubscriberBefore(natsHeadersToContext),
+		natstransport.SubscriberErrorEncoder(encodeNATSError),
+		natstransport.SubscriberErrorHandler(RequestIDErrorHandler(logger)),
+	}
+	subscribers := map[string]*natstransport.Subscriber{
+		SubjectGet:   natstransport.NewSubscriber(e.UserGetEndpoint, decodeNATSGetRequest, encodeNATSResponse, options...),
+		SubjectLogin: natstransport.NewSubscriber(e.LoginEndpoint, decodeNATSLoginRequest, encodeNATSResponse, options...),
+	}
+	for subject, s := range subscribers {
+		if _, err := nc.QueueSubscribe(subject, queue, s.ServeMsg(nc)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// natsHeadersToContext moves the bearer token and request id of the message
+// headers into the context, as the HTTP transport does.
+func natsHeadersToContext(ctx context.Context, msg *nats.Msg) context.Context {
+	ctx = TokenToContext(ctx, &http.Request{Header: http.Header(msg.Header)})
+	id := msg.Header.Get(RequestIDHeader)
+	if !validRequestID(id) {
+		id = newRequestID()
+	}
+	return context.WithValue(ctx, requestIDContextKey, id)
+}
+
+// decodeNATSGetRequest decodes the request as decodeUserGetRequest decodes
+// GET /customers/{id}. Only single customers are served.
+func decodeNATSGetRequest(ctx context.Context, msg *nats.Msg) (interface{}, error) {
+	var req natsGetRequest
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		return nil, invalid(err)
+	}
+	if req.ID == "" || strings.Contains(req.ID, "/") {
+		return nil, invalid(fmt.Errorf(users.ErrInvalidField, "id"))
+	}
+	q := url.Values{}
+	if len(req.Fields) > 0 {
+		q.Set("fields", strings.Join(req.Fields, ","))
+	}
+	if len(req.Expand) > 0 {
+		q.Set("expand", strings.Join(req.Expand, ","))
+	}
+	r, err := http.NewRequestWithContext(ctx, "GET", "/customers/"+url.PathEscape(req.ID)+"?"+q.Encode(), nil)
+	if err != nil {
+		return nil, invalid(err)
+	}
+	return decodeUserGetRequest(ctx, r)
+}
+
+// decodeNATSLoginRequest decodes the request as decodeLoginRequest decodes
+// GET /login.
+func decodeNATSLoginRequest(ctx context.Context, msg *nats.Msg) (interface{}, error) {
+	var req natsLoginRequest
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		return nil, invalid(err)
+	}
+	r, err := http.NewRequestWithContext(ctx, "GET", "/login?"+url.Values{"scope": {req.Scope}}.Encode(), nil)
+	if err != nil {
+		return nil, invalid(err)
+	}
+	r.SetBasicAuth(req.Username, req.Password)
+	return decodeLoginRequest(ctx, r)
+}
+
+// encodeNATSResponse replies with the JSON body of API version 1.
+func encodeNATSResponse(ctx context.Context, reply string, nc *nats.Conn, response interface{}) error {
+	doc, err := V1.document(ctx, response)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return publishNATS(ctx, nc, reply, b)
+}
+
+// encodeNATSError replies with the error body of the HTTP transport, whose
+// status_code tells the kind of error.
+func encodeNATSError(ctx context.Context, err error, reply string, nc *nats.Conn) {
+	_, body := errorResponse(ctx, err)
+	b, err := json.Marshal(body)
+	if err != nil {
+		return
+	}
+	publishNATS(ctx, nc, reply, b)
+}
+
+func publishNATS(ctx context.Context, nc *nats.Conn, reply string, data []byte) error {
+	msg := nats.NewMsg(reply)
+	msg.Data = data
+	if id := RequestID(ctx); id != "" {
+		msg.Header.Set(RequestIDHeader, id)
+	}
+	return nc.PublishMsg(msg)
+}
@@ -0,0 +1,59 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestDecodeNATSGetRequest(t *testing.T) {
+	msg := &nats.Msg{Data: []byte(`{"id":"57a98d98e4b00679b4a830af","fields":["username","status"],"expand":["cards"]}`)}
+	req, err := decodeNATSGetRequest(context.Background(), msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := req.(GetRequest)
+	if g.ID != "57a98d98e4b00679b4a830af" || g.Attr != "" {
+		t.Errorf("unexpected id %q and attribute %q", g.ID, g.Attr)
+	}
+	if !reflect.DeepEqual(g.Fields, []string{"username", "status"}) || !reflect.DeepEqual(g.Expand, []string{"cards"}) {
+		t.Errorf("unexpected fields %v and expand %v", g.Fields, g.Expand)
+	}
+	for _, data := range []string{``, `{}`, `{"id":"1/cards"}`, `{"id":"1","expand":["groups"]}`, `{"id":1}`} {
+		_, err := decodeNATSGetRequest(context.Background(), &nats.Msg{Data: []byte(data)})
+		if !errors.Is(err, ErrInvalidRequest) {
+			t.Errorf("%s: expected invalid request, got %v", data, err)
+		}
+	}
+}
+
+func TestDecodeNATSLoginRequest(t *testing.T) {
+	msg := &nats.Msg{Data: []byte(`{"username":"user","password":"password","scope":"profile cards"}`)}
+	req, err := decodeNATSLoginRequest(context.Background(), msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := req.(loginRequest)
+	if l.Username != "user" || l.Password != "password" || !reflect.DeepEqual(l.Scopes, []string{"profile", "cards"}) {
+		t.Errorf("unexpected login %+v", l)
+	}
+}
+
+func TestNATSHeadersToContext(t *testing.T) {
+	msg := nats.NewMsg("user.get")
+	msg.Header.Set("Authorization", "Bearer abc")
+	msg.Header.Set(RequestIDHeader, "req-1")
+	ctx := natsHeadersToContext(context.Background(), msg)
+	if tok, _ := ctx.Value(tokenContextKey).(string); tok != "abc" {
+		t.Errorf("expected the token, got %q", tok)
+	}
+	if RequestID(ctx) != "req-1" {
+		t.Errorf("expected the request id, got %q", RequestID(ctx))
+	}
+	if RequestID(natsHeadersToContext(context.Background(), &nats.Msg{})) == "" {
+		t.Error("expected a new request id")
+	}
+}
@@ -0,0 +1,88 @@
+package api
+
+// notifications.go contains the WebSocket pushing a logged-in user their own
+// changes as they happen: logins, profile changes, new addresses and cards.
+// Browsers can't set headers on WebSockets, so the token may also be passed
+// as the access_token query parameter.
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"user/changes"
+)
+
+const (
+	// NotificationsPingInterval is how often idle sockets are pinged.
+	NotificationsPingInterval = 30 * time.Second
+	// notificationsWriteWait bounds every write to the socket.
+	notificationsWriteWait = 10 * time.Second
+)
+
+// upgrader only accepts same origin WebSockets, tokens in query strings
+// must not be usable from other sites.
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// QueryTokenToContext moves the access_token query parameter into the
+// request context, unless an Authorization header already did.
+func QueryTokenToContext(ctx context.Context, r *http.Request) context.Context {
+	if _, ok := ctx.Value(tokenContextKey).(string); ok {
+		return ctx
+	}
+	if t := r.URL.Query().Get("access_token"); t != "" {
+		return context.WithValue(ctx, tokenContextKey, t)
+	}
+	return ctx
+}
+
+// serveNotifications upgrades r and writes the events of sub as JSON text
+// messages until either side closes the socket or the server shuts down.
+// Messages from the client are discarded.
+func serveNotifications(w http.ResponseWriter, r *http.Request, sub *changes.Subscription) error {
+	defer sub.Close()
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has already answered.
+		return nil
+	}
+	defer conn.Close()
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+	ping := time.NewTicker(NotificationsPingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case <-closed:
+			return nil
+		case <-draining:
+			conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "shutting down"), time.Now().Add(notificationsWriteWait))
+			return nil
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(notificationsWriteWait)); err != nil {
+				return nil
+			}
+		case e, ok := <-sub.Events:
+			if !ok {
+				// Fell too far behind, the client reconnects.
+				conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "too slow"), time.Now().Add(notificationsWriteWait))
+				return nil
+			}
+			conn.SetWriteDeadline(time.Now().Add(notificationsWriteWait))
+			if err := conn.WriteJSON(e); err != nil {
+				return nil
+			}
+		}
+	}
+}
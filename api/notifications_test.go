@@ -0,0 +1,57 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"user/auth"
+	"user/changes"
+)
+
+func (s eventStub) Notifications(id string) *changes.Subscription {
+	return s.b.SubscribeUser(id)
+}
+
+func TestNotifications(t *testing.T) {
+	b := changes.NewBroker(10)
+	srv := httptest.NewServer(mountRoutes(mux.NewRouter(), MakeEndpoints(eventStub{b: b}), V1, log.NewNopLogger()))
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	_, resp, err := websocket.DefaultDialer.Dial(url+"/customers/2/events?access_token="+auth.ScopeCustomer, nil)
+	if err == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected another customer's events forbidden, got %v", resp.StatusCode)
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(url+"/customers/1/events?access_token="+auth.ScopeCustomer, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// The subscription is made before the upgrade is answered.
+	b.Publish(changes.UserUpdated, "2", "2")
+	b.PublishEvent(changes.Event{Type: changes.UserLoggedIn, ResourceID: "1", UserID: "1", Details: map[string]string{"device": "phone"}})
+	var e changes.Event
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := conn.ReadJSON(&e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Type != changes.UserLoggedIn || e.Details["device"] != "phone" {
+		t.Errorf("expected the login of customer 1, got %v", e)
+	}
+
+	resp, err = http.Get(srv.URL + "/customers/1/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected plain requests rejected, got %v", resp.StatusCode)
+	}
+}
@@ -0,0 +1,458 @@
+package api
+
+// openapi.go contains the OpenAPI 3 document of the HTTP API. Schemas are
+// generated from the request and response structs by reflection, so they
+// can't drift from what the endpoints encode, and a test checks every route
+// of MakeHTTPHandler is described by an operation.
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+	"unicode"
+
+	"user/auth"
+	"user/db"
+	"user/graphql"
+	"user/patch"
+	"user/users"
+)
+
+// operation describes a route of MakeHTTPHandler.
+type operation struct {
+	Method  string
+	Path    string
+	Summary string
+	// Query names the query parameters read by the decoder.
+	Query []string
+	// Headers names the request headers read besides Authorization.
+	Headers []string
+	// Body is a value of the request body type, nil without a body.
+	Body interface{}
+	// Form is the media type of bodies that aren't JSON.
+	Form string
+	// JSONPatch accepts a JSON Patch of Body too.
+	JSONPatch bool
+	// Response is a value of the response type, nil for bodies that aren't
+	// JSON.
+	Response interface{}
+	// Produces is the media type of the response, application/hal+json when
+	// empty.
+	Produces string
+}
+
+// errorBody documents the body written by encodeError.
+type errorBody struct {
+	Error      string `json:"error"`
+	StatusCode int    `json:"status_code"`
+	StatusText string `json:"status_text"`
+	Field      string `json:"field,omitempty"`
+	// Fields lists every invalid field of requests failing validation.
+	Fields    []users.FieldError `json:"fields,omitempty"`
+	Resource  string             `json:"resource,omitempty"`
+	Limit     int                `json:"limit,omitempty"`
+	RequestID string             `json:"request_id,omitempty"`
+}
+
+// avatarForm documents the multipart avatar upload.
+type avatarForm struct {
+	Avatar []byte `json:"avatar"`
+}
+
+// introspectForm documents the RFC 7662 introspection form.
+type introspectForm struct {
+	Token string `json:"token"`
+}
+
+var listQuery = []string{"cursor", "limit"}
+
+// operations lists the routes of MakeHTTPHandler. Routes mounted by prefix
+// are listed by each path they serve.
+var operations = []operation{
+	{Method: "GET", Path: "/login", Summary: "Log in with basic auth", Query: []string{"scope"}, Response: userResponse{}},
+	{Method: "POST", Path: "/register", Summary: "Register a customer", Body: registerRequest{}, Headers: []string{IdempotencyHeader}, Response: postResponse{}},
+	{Method: "GET", Path: "/register/available", Summary: "Check a username and email are free", Query: []string{"username", "email"}, Response: Availability{}},
+	{Method: "GET", Path: "/events/stream", Summary: "Stream changes to customers, addresses and cards as server-sent events", Headers: []string{"Last-Event-ID"}, Produces: "text/event-stream"},
+	{Method: "GET", Path: "/admin/customers/export", Summary: "Export customers as CSV", Query: []string{"format", "mask"}, Produces: "text/csv"},
+	{Method: "GET", Path: "/admin/customers", Summary: "Page through customers", Query: listQuery, Response: adminListResponse{}},
+	{Method: "GET", Path: "/admin/cards", Summary: "Page through masked cards", Query: listQuery, Response: adminCardsResponse{}},
+	{Method: "GET", Path: "/admin/stats", Summary: "Customer statistics", Query: []string{"days"}, Response: db.Stats{}},
+	{Method: "POST", Path: "/admin/customers/merge", Summary: "Merge duplicate customers", Body: mergeRequest{}, Response: users.User{}},
+	{Method: "PUT", Path: "/admin/customers/{id}/password", Summary: "Reset a password, generating one when none is given", Body: passwordResetRequest{}, Response: passwordResetResponse{}},
+	{Method: "GET", Path: "/customers", Summary: "Find customers", Query: []string{"email", "lastName", "status", "tag", "createdAfter", "updatedAfter", "sort", "fields", "expand"}, Response: EmbedStruct{usersResponse{}}},
+	{Method: "GET", Path: "/customers/{id}", Summary: "Get a customer, with its addresses and cards when expanded", Query: []string{"fields", "expand"}, Response: users.User{}},
+	{Method: "GET", Path: "/customers/{id}/addresses", Summary: "Get the addresses of a customer", Query: []string{"type"}, Response: EmbedStruct{addressesResponse{}}},
+	{Method: "GET", Path: "/customers/{id}/cards", Summary: "Get the cards of a customer", Response: EmbedStruct{cardsResponse{}}},
+	{Method: "GET", Path: "/customers/{id}/preferences", Summary: "Get the preferences of a customer", Response: users.Preferences{}},
+	{Method: "GET", Path: "/customers/{id}/groups", Summary: "Get the groups of a customer", Response: EmbedStruct{groupsResponse{}}},
+	{Method: "GET", Path: "/customers/{id}/events", Summary: "WebSocket of the changes to a customer, its addresses and cards", Query: []string{"access_token"}, Produces: "application/json"},
+	{Method: "GET", Path: "/customers/{id}/activity", Summary: "Get the activity feed of a customer", Query: listQuery, Response: activityResponse{}},
+	{Method: "POST", Path: "/customers", Summary: "Create a customer", Body: users.User{}, Headers: []string{IdempotencyHeader}, Response: postResponse{}},
+	{Method: "POST", Path: "/customers/guest", Summary: "Create a guest", Response: userResponse{}},
+	{Method: "POST", Path: "/customers/batch", Summary: "Get customers by id", Body: batchGetRequest{}, Response: batchGetResponse{}},
+	{Method: "POST", Path: "/customers/delete", Summary: "Delete customers", Body: bulkDeleteRequest{}, Response: bulkDeleteResponse{}},
+	{Method: "PUT", Path: "/customers/{id}", Summary: "Update a profile", Body: users.ProfileUpdate{}, Response: users.User{}},
+	{Method: "PATCH", Path: "/customers/{id}", Summary: "Merge patch or JSON Patch a profile", Body: users.ProfileUpdate{}, Form: patch.MediaTypeMergePatch, JSONPatch: true, Response: users.User{}},
+	{Method: "PUT", Path: "/customers/{id}/avatar", Summary: "Upload an avatar", Body: avatarForm{}, Form: "multipart/form-data", Response: users.User{}},
+	{Method: "PUT", Path: "/customers/{id}/preferences", Summary: "Set the preferences of a customer", Body: users.Preferences{}, Response: users.Preferences{}},
+	{Method: "POST", Path: "/customers/{id}/phone/verification", Summary: "Text a verification code", Response: statusResponse{}},
+	{Method: "PUT", Path: "/customers/{id}/phone/verification", Summary: "Verify the phone with a code", Body: phoneVerifyRequest{}, Response: users.User{}},
+	{Method: "PUT", Path: "/customers/{id}/status", Summary: "Set the status of a customer", Body: statusPutRequest{}, Response: users.User{}},
+	{Method: "POST", Path: "/customers/{id}/username", Summary: "Rename a customer", Body: renameRequest{}, Response: users.User{}},
+	{Method: "POST", Path: "/customers/{id}/addresses/import", Summary: "Import addresses", Body: []users.Address{}, Response: addressImportResponse{}},
+	{Method: "POST", Path: "/batch", Summary: "Create customers, addresses and cards all at once or not at all, 422 when undone", Body: batchBody{}, Response: batchResponse{}},
+	{Method: "PUT", Path: "/customers/{id}/tags/{tag}", Summary: "Tag a customer", Response: users.User{}},
+	{Method: "DELETE", Path: "/customers/{id}/tags/{tag}", Summary: "Untag a customer", Response: users.User{}},
+	{Method: "DELETE", Path: "/customers/{id}", Summary: "Delete a customer", Response: statusResponse{}},
+	{Method: "GET", Path: "/addresses", Summary: "List addresses", Query: []string{"type"}, Response: EmbedStruct{addressesResponse{}}},
+	{Method: "GET", Path: "/addresses/{id}", Summary: "Get an address", Response: users.Address{}},
+	{Method: "POST", Path: "/addresses", Summary: "Add an address", Body: addressPostRequest{}, Headers: []string{IdempotencyHeader}, Response: postResponse{}},
+	{Method: "PATCH", Path: "/addresses/{id}", Summary: "Merge patch or JSON Patch an address", Body: users.Address{}, Form: patch.MediaTypeMergePatch, JSONPatch: true, Response: users.Address{}},
+	{Method: "DELETE", Path: "/addresses/{id}", Summary: "Delete an address", Response: statusResponse{}},
+	{Method: "GET", Path: "/cards", Summary: "List cards", Response: EmbedStruct{cardsResponse{}}},
+	{Method: "GET", Path: "/cards/{id}", Summary: "Get a card", Response: users.Card{}},
+	{Method: "POST", Path: "/cards", Summary: "Add a card", Body: cardPostRequest{}, Headers: []string{IdempotencyHeader}, Response: postResponse{}},
+	{Method: "PUT", Path: "/cards/{id}", Summary: "Update a card", Body: users.CardUpdate{}, Response: users.Card{}},
+	{Method: "PUT", Path: "/cards/{id}/default", Summary: "Make a card the default", Response: users.Card{}},
+	{Method: "DELETE", Path: "/cards/{id}", Summary: "Delete a card", Response: statusResponse{}},
+	{Method: "POST", Path: "/groups", Summary: "Create a group", Body: users.Group{}, Response: users.Group{}},
+	{Method: "GET", Path: "/groups/{id}", Summary: "Get a group", Response: users.Group{}},
+	{Method: "DELETE", Path: "/groups/{id}", Summary: "Delete a group", Response: statusResponse{}},
+	{Method: "POST", Path: "/groups/{id}/members", Summary: "Add a group member", Body: groupMemberRequest{}, Response: users.Group{}},
+	{Method: "DELETE", Path: "/groups/{id}/members/{userId}", Summary: "Remove a group member", Response: users.Group{}},
+	{Method: "POST", Path: "/webhooks", Summary: "Subscribe a webhook to change events", Body: users.Webhook{}, Response: users.Webhook{}},
+	{Method: "GET", Path: "/webhooks", Summary: "List webhooks, without their secrets", Response: EmbedStruct{webhooksResponse{}}},
+	{Method: "DELETE", Path: "/webhooks/{id}", Summary: "Delete a webhook", Response: statusResponse{}},
+	{Method: "GET", Path: "/webhooks/{id}/deliveries", Summary: "Page through the delivery attempts of a webhook", Query: listQuery, Response: webhookDeliveriesResponse{}},
+	{Method: "POST", Path: "/oauth/introspect", Summary: "Introspect a token", Body: introspectForm{}, Form: "application/x-www-form-urlencoded", Response: auth.Introspection{}, Produces: "application/json"},
+	{Method: "GET", Path: "/graphql", Summary: "Run a GraphQL query", Query: []string{"query", "variables", "operationName"}, Response: graphql.Response{}, Produces: "application/json"},
+	{Method: "POST", Path: "/graphql", Summary: "Run a GraphQL query", Body: graphql.Request{}, Response: graphql.Response{}, Produces: "application/json"},
+	{Method: "GET", Path: "/health", Summary: "Health of the service, with its dependencies when deep", Query: []string{"deep"}, Response: healthResponse{}},
+	{Method: "GET", Path: "/live", Summary: "Whether the process is up", Response: healthResponse{}},
+	{Method: "GET", Path: "/ready", Summary: "Whether the service is ready to take requests, 503 while not", Response: healthResponse{}},
+	{Method: "GET", Path: "/openapi.json", Summary: "This document", Produces: "application/json"},
+	{Method: "GET", Path: "/docs", Summary: "Swagger UI of this document", Produces: "text/html"},
+	{Method: "GET", Path: "/metrics", Summary: "Prometheus metrics", Produces: "text/plain"},
+}
+
+// OpenAPI returns the OpenAPI 3 document of version v of the HTTP API.
+func OpenAPI(v APIVersion) map[string]interface{} {
+	g := &schemaGenerator{version: v, schemas: map[string]interface{}{}, names: map[reflect.Type]string{}}
+	errorSchema := g.schema(reflect.ValueOf(errorBody{}))
+	paths := map[string]map[string]interface{}{}
+	for _, o := range operations {
+		op := map[string]interface{}{
+			"summary":     o.Summary,
+			"operationId": operationID(o),
+		}
+		var params []interface{}
+		for _, seg := range strings.Split(o.Path, "/") {
+			if strings.HasPrefix(seg, "{") {
+				params = append(params, parameter(strings.Trim(seg, "{}"), "path"))
+			}
+		}
+		for _, q := range o.Query {
+			params = append(params, parameter(q, "query"))
+		}
+		for _, h := range o.Headers {
+			params = append(params, parameter(h, "header"))
+		}
+		if params != nil {
+			op["parameters"] = params
+		}
+		if o.Body != nil {
+			form := o.Form
+			if form == "" {
+				form = "application/json"
+			}
+			var schema map[string]interface{}
+			if form == "multipart/form-data" {
+				schema = uploadSchema(o.Body)
+			} else {
+				schema = g.schema(reflect.ValueOf(o.Body))
+			}
+			content := map[string]interface{}{form: map[string]interface{}{"schema": schema}}
+			if o.JSONPatch {
+				content[patch.MediaTypeJSONPatch] = map[string]interface{}{"schema": g.schema(reflect.ValueOf(patch.JSONPatch{}))}
+			}
+			op["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content":  content,
+			}
+		}
+		produces := o.Produces
+		if produces == "" {
+			produces = "application/hal+json"
+		}
+		ok := map[string]interface{}{"description": "OK"}
+		if o.Response != nil {
+			ok["content"] = map[string]interface{}{produces: map[string]interface{}{"schema": g.schema(reflect.ValueOf(o.Response))}}
+		} else {
+			ok["content"] = map[string]interface{}{produces: map[string]interface{}{}}
+		}
+		op["responses"] = map[string]interface{}{
+			"200": ok,
+			"default": map[string]interface{}{
+				"description": "Error",
+				"content":     map[string]interface{}{"application/hal+json": map[string]interface{}{"schema": errorSchema}},
+			},
+		}
+		if paths[o.Path] == nil {
+			paths[o.Path] = map[string]interface{}{}
+		}
+		paths[o.Path][strings.ToLower(o.Method)] = op
+	}
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":       "User",
+			"description": "Customer accounts with their addresses and cards.",
+			"version":     v.Name,
+		},
+		"servers": []interface{}{map[string]interface{}{"url": "/" + v.Name}},
+		"paths":   paths,
+		"components": map[string]interface{}{
+			"schemas": g.schemas,
+			"securitySchemes": map[string]interface{}{
+				"bearer": map[string]interface{}{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+				"basic":  map[string]interface{}{"type": "http", "scheme": "basic"},
+			},
+		},
+		"security": []interface{}{map[string]interface{}{}, map[string]interface{}{"bearer": []string{}}},
+	}
+}
+
+// operationID names o after its method and path, e.g. getCustomersIdCards.
+func operationID(o operation) string {
+	id := strings.ToLower(o.Method)
+	for _, seg := range strings.FieldsFunc(o.Path, func(r rune) bool {
+		return r == '/' || r == '{' || r == '}' || r == '.'
+	}) {
+		id += exportedName(seg)
+	}
+	return id
+}
+
+func parameter(name, in string) map[string]interface{} {
+	return map[string]interface{}{
+		"name":     name,
+		"in":       in,
+		"required": in == "path",
+		"schema":   map[string]interface{}{"type": "string"},
+	}
+}
+
+// schemaGenerator collects the schemas of named structs as components.
+type schemaGenerator struct {
+	version APIVersion
+	schemas map[string]interface{}
+	names   map[reflect.Type]string
+}
+
+var (
+	timeType    = reflect.TypeOf(time.Time{})
+	rawJSONType = reflect.TypeOf(json.RawMessage{})
+)
+
+// schema returns the schema of v, a reference for named structs. Values are
+// used rather than types so interface fields such as the _embedded member
+// of EmbedStruct get the schema of what they hold.
+func (g *schemaGenerator) schema(v reflect.Value) map[string]interface{} {
+	t := v.Type()
+	if t.Kind() == reflect.Ptr {
+		return g.schema(reflect.Zero(t.Elem()))
+	}
+	if t.Kind() != reflect.Struct || t == timeType || t.Name() == "" || holdsInterface(t) {
+		return g.inline(v)
+	}
+	name, ok := g.names[t]
+	if !ok {
+		name = g.componentName(t)
+		g.names[t] = name
+		g.schemas[name] = g.inline(v)
+	}
+	return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+}
+
+// inline returns the schema of v written out.
+func (g *schemaGenerator) inline(v reflect.Value) map[string]interface{} {
+	t := v.Type()
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t == rawJSONType:
+		return map[string]interface{}{}
+	case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8:
+		return map[string]interface{}{"type": "string", "format": "byte"}
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Int64, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": g.schema(reflect.Zero(t.Elem()))}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": g.schema(reflect.Zero(t.Elem()))}
+	case reflect.Interface:
+		if !v.IsNil() {
+			return g.schema(v.Elem())
+		}
+	case reflect.Struct:
+		props := map[string]interface{}{}
+		g.properties(v, props)
+		return map[string]interface{}{"type": "object", "properties": props}
+	}
+	return map[string]interface{}{}
+}
+
+// properties adds the JSON members of struct v to props. Members of
+// embedded structs are promoted unless v has one of the same name, the way
+// encoding/json does.
+func (g *schemaGenerator) properties(v reflect.Value, props map[string]interface{}) {
+	t := v.Type()
+	var embedded []reflect.Value
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := strings.Split(f.Tag.Get("json"), ",")
+		if tag[0] == "-" || f.PkgPath != "" && !f.Anonymous {
+			continue
+		}
+		if f.Anonymous && tag[0] == "" && f.Type.Kind() == reflect.Struct {
+			embedded = append(embedded, v.Field(i))
+			continue
+		}
+		name := tag[0]
+		if name == "" {
+			name = f.Name
+		}
+		if name == "_embedded" {
+			props[name] = g.embedded(v.Field(i))
+			// Added by the HAL encoding.
+			props["_links"] = g.schema(reflect.ValueOf(users.Links{}))
+			continue
+		}
+		props[name] = g.schema(v.Field(i))
+	}
+	for _, e := range embedded {
+		promoted := map[string]interface{}{}
+		g.properties(e, promoted)
+		for name, p := range promoted {
+			if _, ok := props[name]; !ok {
+				props[name] = p
+			}
+		}
+	}
+}
+
+// embedded returns the schema of an _embedded member written out, with its
+// members named the way the version encodes them.
+func (g *schemaGenerator) embedded(v reflect.Value) map[string]interface{} {
+	if v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return map[string]interface{}{}
+		}
+		v = v.Elem()
+	}
+	s := g.inline(v)
+	if props, ok := s["properties"].(map[string]interface{}); ok {
+		renamed := make(map[string]interface{}, len(props))
+		for name, p := range props {
+			renamed[g.version.embeddedName(name)] = p
+		}
+		s["properties"] = renamed
+	}
+	return s
+}
+
+// uploadSchema documents a multipart form whose file parts are named after
+// the json names of the fields of v.
+func uploadSchema(v interface{}) map[string]interface{} {
+	props := map[string]interface{}{}
+	t := reflect.TypeOf(v)
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		props[name] = map[string]interface{}{"type": "string", "format": "binary"}
+	}
+	return map[string]interface{}{"type": "object", "properties": props}
+}
+
+// holdsInterface reports whether struct t has interface members, whose
+// schema depends on the value.
+func holdsInterface(t reflect.Type) bool {
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Type.Kind() == reflect.Interface && t.Field(i).Tag.Get("json") != "-" {
+			return true
+		}
+	}
+	return false
+}
+
+// componentName names the schema of t after its type, prefixed with the
+// package when another package has a type of the same name.
+func (g *schemaGenerator) componentName(t reflect.Type) string {
+	name := exportedName(t.Name())
+	for other, n := range g.names {
+		if n == name && other != t {
+			pkg := t.PkgPath()[strings.LastIndex(t.PkgPath(), "/")+1:]
+			return exportedName(pkg) + name
+		}
+	}
+	return name
+}
+
+func exportedName(s string) string {
+	if s == "" {
+		return s
+	}
+	r := []rune(s)
+	r[0] = unicode.ToUpper(r[0])
+	return string(r)
+}
+
+// OpenAPIHandler serves the OpenAPI document of v as JSON.
+func OpenAPIHandler(v APIVersion) http.Handler {
+	doc, err := json.Marshal(OpenAPI(v))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(doc)
+	})
+}
+
+// swaggerUI renders the document next to it with the Swagger UI bundle.
+const swaggerUI = `<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <title>User API</title>
+  <link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+  <script>
+    window.ui = SwaggerUIBundle({url: "openapi.json", dom_id: "#swagger-ui"});
+  </script>
+</body>
+</html>
+`
+
+// SwaggerUIHandler serves Swagger UI over the document at /openapi.json.
+func SwaggerUIHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(swaggerUI))
+	})
+}
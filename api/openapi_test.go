@@ -0,0 +1,80 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+)
+
+func TestOperationsCoverRoutes(t *testing.T) {
+	r := mountRoutes(mux.NewRouter(), MakeEndpoints(TestService), V1, log.NewNopLogger())
+	err := r.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		tpl, _ := route.GetPathTemplate()
+		re, _ := route.GetPathRegexp()
+		methods, err := route.GetMethods()
+		if err != nil {
+			methods = []string{"GET"}
+		}
+		prefix := !strings.HasSuffix(re, "$")
+		for _, m := range methods {
+			found := false
+			for _, o := range operations {
+				if o.Method == m && (o.Path == tpl || prefix && strings.HasPrefix(o.Path, tpl)) {
+					found = true
+				}
+			}
+			if !found {
+				t.Errorf("route %v %v has no operation", m, tpl)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, o := range operations {
+		req := httptest.NewRequest(o.Method, strings.NewReplacer("{", "", "}", "").Replace(o.Path), nil)
+		var match mux.RouteMatch
+		if !r.Match(req, &match) || match.MatchErr != nil {
+			t.Errorf("operation %v %v is not routed", o.Method, o.Path)
+		}
+	}
+}
+
+func TestOpenAPI(t *testing.T) {
+	w := httptest.NewRecorder()
+	OpenAPIHandler(V1).ServeHTTP(w, httptest.NewRequest("GET", "/openapi.json", nil))
+	var doc struct {
+		Paths      map[string]map[string]json.RawMessage
+		Components struct {
+			Schemas map[string]struct {
+				Properties map[string]json.RawMessage
+			}
+		}
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &doc); w.Code != http.StatusOK || err != nil {
+		t.Fatalf("unexpected response %v %v", w.Code, err)
+	}
+	if _, ok := doc.Paths["/customers/{id}/cards"]["get"]; !ok {
+		t.Error("expected the cards of a customer to be documented")
+	}
+	card := doc.Components.Schemas["Card"].Properties
+	if _, ok := card["longNum"]; !ok {
+		t.Errorf("expected card schema from the struct, got %v", card)
+	}
+	if _, ok := card["remindedFor"]; ok {
+		t.Error("expected members hidden from JSON to be left out")
+	}
+	post := doc.Components.Schemas["CardPostRequest"].Properties
+	if _, ok := post["userID"]; !ok || post["expires"] == nil {
+		t.Errorf("expected embedded card members to be promoted, got %v", post)
+	}
+	if !strings.Contains(string(doc.Paths["/customers"]["get"]), `"_embedded":{"properties":{"customer":`) {
+		t.Error("expected the embedded customers to be documented")
+	}
+}
@@ -0,0 +1,98 @@
+package api
+
+// proxy.go contains the address of the client behind the proxies in front of
+// the service. X-Forwarded-For is only believed when the request comes from
+// one of the configured proxies, anyone else can write anything into it.
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// TrustedProxies are the networks of the proxies whose X-Forwarded-For
+// headers are believed.
+type TrustedProxies []*net.IPNet
+
+// ParseTrustedProxies parses comma separated CIDRs, single addresses stand
+// for themselves.
+func ParseTrustedProxies(s string) (TrustedProxies, error) {
+	var t TrustedProxies
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		if !strings.Contains(f, "/") {
+			ip := net.ParseIP(f)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", f)
+			}
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			t = append(t, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(f)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %v", f, err)
+		}
+		t = append(t, n)
+	}
+	return t, nil
+}
+
+// trusts reports whether addr is the address of a trusted proxy.
+func (t TrustedProxies) trusts(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range t {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the address of the client of r. Requests from a trusted
+// proxy are traced back through X-Forwarded-For to the right-most hop that
+// isn't a trusted proxy, the hops left of it are whatever the client sent.
+// Other requests come from their peer.
+func (t TrustedProxies) ClientIP(r *http.Request) string {
+	ip := r.RemoteAddr
+	if h, _, err := net.SplitHostPort(ip); err == nil {
+		ip = h
+	}
+	if !t.trusts(ip) {
+		return ip
+	}
+	var hops []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(v, ",")...)
+	}
+	for k := len(hops) - 1; k >= 0; k-- {
+		hop := strings.TrimSpace(hops[k])
+		if hop == "" {
+			continue
+		}
+		ip = hop
+		if !t.trusts(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// ProxyHandler resolves the client address of every request with t, see
+// ClientIP.
+func ProxyHandler(t TrustedProxies, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientIPContextKey, t.ClientIP(r))))
+	})
+}
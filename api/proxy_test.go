@@ -0,0 +1,53 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	trusted, err := ParseTrustedProxies("10.0.0.0/8, 192.168.1.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		name, remote string
+		forwarded    []string
+		expected     string
+	}{
+		{"untrusted peer", "203.0.113.9:4000", []string{"1.2.3.4"}, "203.0.113.9"},
+		{"trusted peer", "10.1.2.3:4000", []string{"198.51.100.7"}, "198.51.100.7"},
+		{"spoofed hops", "10.1.2.3:4000", []string{"1.2.3.4, 198.51.100.7"}, "198.51.100.7"},
+		{"chained proxies", "10.1.2.3:4000", []string{"198.51.100.7, 192.168.1.1", "10.9.9.9"}, "198.51.100.7"},
+		{"only proxies", "10.1.2.3:4000", []string{"10.2.2.2"}, "10.2.2.2"},
+		{"no header", "10.1.2.3:4000", nil, "10.1.2.3"},
+	} {
+		r := httptest.NewRequest("POST", "/login", nil)
+		r.RemoteAddr = c.remote
+		for _, f := range c.forwarded {
+			r.Header.Add("X-Forwarded-For", f)
+		}
+		if ip := trusted.ClientIP(r); ip != c.expected {
+			t.Errorf("%v: expected %v, got %v", c.name, c.expected, ip)
+		}
+	}
+
+	r := httptest.NewRequest("POST", "/login", nil)
+	r.RemoteAddr = "10.1.2.3:4000"
+	r.Header.Set("X-Forwarded-For", "198.51.100.7")
+	if ip := TrustedProxies(nil).ClientIP(r); ip != "10.1.2.3" {
+		t.Errorf("expected the peer without trusted proxies, got %v", ip)
+	}
+	var seen string
+	ProxyHandler(trusted, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = clientInfo(r).IP
+	})).ServeHTTP(httptest.NewRecorder(), r)
+	if seen != "198.51.100.7" {
+		t.Errorf("expected the resolved client, got %v", seen)
+	}
+
+	if _, err := ParseTrustedProxies("10.0.0.0/33"); err == nil {
+		t.Error("expected an invalid CIDR rejected")
+	}
+}
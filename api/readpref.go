@@ -0,0 +1,86 @@
+package api
+
+// readpref.go contains the read preferences of single endpoints. Endpoints
+// that only read can be served by replicas of the database, taking load off
+// the primary; logins and writes always go to the primary.
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/go-kit/kit/endpoint"
+	"user/db"
+)
+
+// ReadOnlyEndpoints are the endpoints a read preference may be set on.
+var ReadOnlyEndpoints = []string{
+	"UserGet", "AdminList", "AdminCards", "AddressGet", "CardGet", "BatchGet", "Export",
+	"GroupGet", "UserGroups", "Activity", "Stats", "WebhooksGet", "WebhookDeliveries",
+}
+
+// DefaultReadPreferenceEndpoints are the read heavy endpoints the
+// -read-preference applies to: the listing of customers and the addresses
+// and cards.
+var DefaultReadPreferenceEndpoints = []string{"AdminList", "AdminCards", "AddressGet", "CardGet"}
+
+// ParseEndpointReadPreferences parses comma separated "Name=preference"
+// endpoint read preferences, Name being one of ReadOnlyEndpoints and
+// preference as for db.ParseReadPreference.
+func ParseEndpointReadPreferences(s string) (map[string]db.ReadPreference, error) {
+	prefs := map[string]db.ReadPreference{}
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e == "" {
+			continue
+		}
+		name, p, ok := strings.Cut(e, "=")
+		if !ok {
+			return nil, fmt.Errorf("expected Name=preference, got %q", e)
+		}
+		name = strings.TrimSpace(name)
+		if !readOnly(name) {
+			return nil, fmt.Errorf("endpoint %q doesn't only read", name)
+		}
+		pref, err := db.ParseReadPreference(strings.TrimSpace(p))
+		if err != nil {
+			return nil, err
+		}
+		prefs[name] = pref
+	}
+	return prefs, nil
+}
+
+func readOnly(name string) bool {
+	for _, n := range ReadOnlyEndpoints {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// WithReadPreferences returns e with the endpoints named in prefs, as for
+// ParseEndpointReadPreferences, wrapped in a ReadPreferenceMiddleware.
+// Endpoints not in ReadOnlyEndpoints are left alone.
+func (e Endpoints) WithReadPreferences(prefs map[string]db.ReadPreference) Endpoints {
+	v := reflect.ValueOf(&e).Elem()
+	for name, p := range prefs {
+		f := v.FieldByName(name + "Endpoint")
+		if !f.IsValid() || !readOnly(name) || p == db.Primary {
+			continue
+		}
+		f.Set(reflect.ValueOf(ReadPreferenceMiddleware(p)(f.Interface().(endpoint.Endpoint))))
+	}
+	return e
+}
+
+// ReadPreferenceMiddleware has the reads of next made with the read
+// preference p.
+func ReadPreferenceMiddleware(p db.ReadPreference) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			return next(db.WithReadPreference(ctx, p), request)
+		}
+	}
+}
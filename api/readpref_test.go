@@ -0,0 +1,45 @@
+package api
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-kit/kit/endpoint"
+	"user/db"
+)
+
+func TestParseEndpointReadPreferences(t *testing.T) {
+	prefs, err := ParseEndpointReadPreferences("UserGet=secondaryPreferred, CardGet=primary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prefs) != 2 || prefs["UserGet"] != db.SecondaryPreferred || prefs["CardGet"] != db.Primary {
+		t.Errorf("expected both endpoints parsed, got %v", prefs)
+	}
+	for _, s := range []string{"UserGet", "UserGet=replica", "Login=secondary", "UserPut=nearest"} {
+		if _, err := ParseEndpointReadPreferences(s); err == nil {
+			t.Errorf("expected %q rejected", s)
+		}
+	}
+}
+
+func TestWithReadPreferences(t *testing.T) {
+	var read endpoint.Endpoint = func(ctx context.Context, _ interface{}) (interface{}, error) {
+		return db.ReadPreferenceFrom(ctx), nil
+	}
+	e := Endpoints{AdminListEndpoint: read, CardGetEndpoint: read, LoginEndpoint: read}.WithReadPreferences(map[string]db.ReadPreference{
+		"AdminList": db.Secondary, "CardGet": db.Primary, "Login": db.Secondary,
+	})
+	for name, c := range map[string]struct {
+		e        endpoint.Endpoint
+		expected db.ReadPreference
+	}{
+		"AdminList": {e.AdminListEndpoint, db.Secondary},
+		"CardGet":   {e.CardGetEndpoint, db.Primary},
+		"Login":     {e.LoginEndpoint, db.Primary},
+	} {
+		if got, _ := c.e(context.Background(), nil); got != c.expected {
+			t.Errorf("%v: expected %v, got %v", name, c.expected, got)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package api
+
+// redaction.go contains the redaction policies shaping responses to their
+// caller. A policy declares per scope or role which fields of the responses
+// callers see in full, masked or not at all, so an internal fraud service
+// may see emails and masked cards while storefronts only get names. Callers
+// no rule matches, such as those without a token, are not redacted.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+
+	"github.com/go-kit/kit/endpoint"
+	"user/auth"
+)
+
+// Action is what a redaction rule does to a field.
+type Action string
+
+const (
+	// ActionShow keeps the field as it is.
+	ActionShow Action = "show"
+	// ActionMask keeps the first character of strings, and the domain of
+	// emails. Other values are removed.
+	ActionMask Action = "mask"
+	// ActionHide removes the field.
+	ActionHide Action = "hide"
+)
+
+// RedactionRule shapes the responses to callers whose token has Scope, or
+// whose account has Role. Fields maps the JSON names of fields, at any
+// depth, to their action. The "*" action applies to the fields without one
+// except id and _links, fields are shown without either. The collections
+// of _embedded are redacted like the rest of the document.
+type RedactionRule struct {
+	Scope  string            `json:"scope,omitempty"`
+	Role   string            `json:"role,omitempty"`
+	Fields map[string]Action `json:"fields"`
+}
+
+// RedactionPolicy is a list of rules, the first one matching a caller
+// applies.
+type RedactionPolicy []RedactionRule
+
+// LoadRedactionPolicy reads a policy from the JSON file at path:
+//
+//	[
+//	  {"role": "fraud", "fields": {"email": "show", "longNum": "mask", "*": "hide"}},
+//	  {"role": "storefront", "fields": {"firstName": "show", "lastName": "show", "*": "hide"}}
+//	]
+func LoadRedactionPolicy(path string) (RedactionPolicy, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var p RedactionPolicy
+	if err := json.Unmarshal(b, &p); err != nil {
+		return nil, fmt.Errorf("redaction policy %v: %w", path, err)
+	}
+	if err := p.Validate(); err != nil {
+		return nil, fmt.Errorf("redaction policy %v: %w", path, err)
+	}
+	return p, nil
+}
+
+// Validate reports rules matching no or two kinds of callers and unknown
+// actions.
+func (p RedactionPolicy) Validate() error {
+	for k, r := range p {
+		if (r.Scope == "") == (r.Role == "") {
+			return fmt.Errorf("rule %v: expected either a scope or a role", k)
+		}
+		for f, a := range r.Fields {
+			if a != ActionShow && a != ActionMask && a != ActionHide {
+				return fmt.Errorf("rule %v: unknown action %q of %v", k, a, f)
+			}
+		}
+	}
+	return nil
+}
+
+// rule returns the rule of the caller with introspection i, nil for none.
+// The roles of the caller are only looked up for policies with role rules.
+func (p RedactionPolicy) rule(ctx context.Context, s Service, i auth.Introspection) *RedactionRule {
+	var roles []string
+	looked := false
+	for k, r := range p {
+		if r.Scope != "" {
+			if auth.HasScope(i.Scope, r.Scope) {
+				return &p[k]
+			}
+			continue
+		}
+		if !looked {
+			looked = true
+			if i.Subject != "" {
+				if us, err := s.GetUsers(ctx, i.Subject); err == nil && len(us) == 1 {
+					roles = us[0].Roles
+				}
+			}
+		}
+		if contains(roles, r.Role) {
+			return &p[k]
+		}
+	}
+	return nil
+}
+
+// RedactionMiddleware redacts the responses of next by the rule of p
+// matching the caller.
+func RedactionMiddleware(s Service, p RedactionPolicy) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			response, err := next(ctx, request)
+			tok, ok := ctx.Value(tokenContextKey).(string)
+			if err != nil || !ok || response == nil {
+				return response, err
+			}
+			i := s.Introspect(tok)
+			if !i.Active {
+				return response, nil
+			}
+			r := p.rule(ctx, s, i)
+			if r == nil {
+				return response, nil
+			}
+			return r.redactResponse(response)
+		}
+	}
+}
+
+// unredacted are the endpoints whose responses are not documents, and the
+// probes and introspection describing the service rather than customers.
+var unredacted = map[string]bool{
+	"Export":        true,
+	"EventStream":   true,
+	"Notifications": true,
+	"Health":        true,
+	"Live":          true,
+	"Ready":         true,
+	"Introspect":    true,
+}
+
+// WithRedaction returns e with the endpoints responding with documents
+// wrapped in a RedactionMiddleware.
+func (e Endpoints) WithRedaction(s Service, p RedactionPolicy) Endpoints {
+	v := reflect.ValueOf(&e).Elem()
+	for k := 0; k < v.NumField(); k++ {
+		name := v.Type().Field(k).Name
+		f := v.Field(k)
+		if unredacted[name[:len(name)-len("Endpoint")]] || f.IsNil() {
+			continue
+		}
+		f.Set(reflect.ValueOf(RedactionMiddleware(s, p)(f.Interface().(endpoint.Endpoint))))
+	}
+	return e
+}
+
+// redactResponse returns the redacted document of response, keeping the
+// types the HAL encoding looks for.
+func (r *RedactionRule) redactResponse(response interface{}) (interface{}, error) {
+	g, err := generic(response, true)
+	if err != nil {
+		return nil, err
+	}
+	g = r.redact(g)
+	m, _ := g.(map[string]interface{})
+	switch response.(type) {
+	case EmbedStruct:
+		return EmbedStruct{m["_embedded"]}, nil
+	case expandedUser:
+		return expandedUser(m), nil
+	}
+	return g, nil
+}
+
+// redact applies the rule to the fields of the decoded JSON value v.
+func (r *RedactionRule) redact(v interface{}) interface{} {
+	switch v := v.(type) {
+	case []interface{}:
+		for k := range v {
+			v[k] = r.redact(v[k])
+		}
+	case map[string]interface{}:
+		for name, f := range v {
+			if embedded, ok := f.(map[string]interface{}); ok && name == "_embedded" {
+				// The members are collections, not fields.
+				for m := range embedded {
+					embedded[m] = r.redact(embedded[m])
+				}
+				continue
+			}
+			switch r.action(name) {
+			case ActionHide:
+				delete(v, name)
+			case ActionMask:
+				if s, ok := f.(string); ok {
+					v[name] = maskValue(s)
+				} else {
+					delete(v, name)
+				}
+			default:
+				v[name] = r.redact(f)
+			}
+		}
+	}
+	return v
+}
+
+func (r *RedactionRule) action(name string) Action {
+	if a, ok := r.Fields[name]; ok {
+		return a
+	}
+	if name == "_links" || name == "id" {
+		return ActionShow
+	}
+	if a, ok := r.Fields["*"]; ok {
+		return a
+	}
+	return ActionShow
+}
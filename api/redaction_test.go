@@ -0,0 +1,92 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"user/auth"
+	"user/users"
+)
+
+type redactionStub struct {
+	Service
+	roles []string
+}
+
+func (s redactionStub) Introspect(token string) auth.Introspection {
+	return auth.Introspection{Active: token != "", Subject: "1", Scope: token}
+}
+
+func (s redactionStub) GetUsers(ctx context.Context, id string) ([]users.User, error) {
+	return []users.User{{UserID: id, Roles: s.roles}}, nil
+}
+
+func TestRedactionMiddleware(t *testing.T) {
+	p := RedactionPolicy{
+		{Scope: "addresses:1", Fields: map[string]Action{"street": "hide"}},
+		{Role: "fraud", Fields: map[string]Action{"username": "mask", "*": "hide"}},
+		{Role: "storefront", Fields: map[string]Action{"firstName": "show", "lastName": "show", "*": "hide"}},
+	}
+	if err := p.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	u := users.User{UserID: "1", Username: "eve", FirstName: "Eve", LastName: "Doe"}
+	next := func(context.Context, interface{}) (interface{}, error) {
+		return EmbedStruct{usersResponse{Users: []users.User{u}}}, nil
+	}
+	for _, c := range []struct {
+		roles    []string
+		token    string
+		expected map[string]interface{}
+	}{
+		{[]string{"storefront"}, "customer admin", map[string]interface{}{"id": "1", "firstName": "Eve", "lastName": "Doe"}},
+		{[]string{"fraud", "storefront"}, "customer", map[string]interface{}{"id": "1", "username": "e***"}},
+	} {
+		e := RedactionMiddleware(redactionStub{roles: c.roles}, p)(next)
+		resp, err := e(context.WithValue(context.Background(), tokenContextKey, c.token), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := json.Marshal(resp.(EmbedStruct).Embed)
+		var doc map[string][]map[string]interface{}
+		json.Unmarshal(b, &doc)
+		got := doc["customer"][0]
+		delete(got, "_links")
+		if len(got) != len(c.expected) {
+			t.Errorf("%v: expected %v, got %v", c.roles, c.expected, got)
+		}
+		for k, v := range c.expected {
+			if got[k] != v {
+				t.Errorf("%v: expected %v %v, got %v", c.roles, k, v, got[k])
+			}
+		}
+	}
+
+	// Callers no rule matches get the response as it is.
+	e := RedactionMiddleware(redactionStub{}, p)(next)
+	for _, ctx := range []context.Context{context.Background(), context.WithValue(context.Background(), tokenContextKey, "customer")} {
+		resp, _ := e(ctx, nil)
+		if _, ok := resp.(EmbedStruct).Embed.(usersResponse); !ok {
+			t.Errorf("expected the response unchanged, got %v", resp)
+		}
+	}
+}
+
+func TestLoadRedactionPolicy(t *testing.T) {
+	dir := t.TempDir()
+	for policy, valid := range map[string]bool{
+		`[{"role":"fraud","fields":{"email":"show","*":"hide"}}]`: true,
+		`[{"fields":{"email":"show"}}]`:                           false,
+		`[{"scope":"customer","role":"fraud","fields":{}}]`:       false,
+		`[{"scope":"customer","fields":{"email":"scramble"}}]`:    false,
+	} {
+		path := filepath.Join(dir, "policy.json")
+		os.WriteFile(path, []byte(policy), 0600)
+		if _, err := LoadRedactionPolicy(path); (err == nil) != valid {
+			t.Errorf("%v: expected valid %v, got %v", policy, valid, err)
+		}
+	}
+}
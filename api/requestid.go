@@ -0,0 +1,87 @@
+package api
+
+// requestid.go contains the X-Request-ID every request is tagged with. Ids
+// set by the edge proxy or the caller are kept, others are generated, and
+// the id is echoed in the response, error bodies, error logs and spans so a
+// single complaint can be followed through every service.
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/transport"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// RequestIDHeader carries the request id in both directions.
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestID is the longest request id propagated, longer ones are
+// replaced.
+const maxRequestID = 128
+
+// RequestIDHandler tags every request with an id, from RequestIDHeader when
+// the caller sent a valid one, and echoes it in the response.
+func RequestIDHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+			r.Header.Set(RequestIDHeader, id)
+		}
+		w.Header().Set(RequestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDContextKey, id)))
+	})
+}
+
+// RequestID returns the id of the request of ctx, "" outside of requests.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey).(string)
+	return id
+}
+
+// validRequestID accepts printable ASCII ids up to maxRequestID, so they
+// can't inject anything into logs or headers.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestID {
+		return false
+	}
+	for _, c := range []byte(id) {
+		if c < 0x21 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// RequestIDErrorHandler logs the errors of requests with their id.
+func RequestIDErrorHandler(logger log.Logger) transport.ErrorHandler {
+	return transport.ErrorHandlerFunc(func(ctx context.Context, err error) {
+		logger.Log("request_id", RequestID(ctx), "err", err)
+	})
+}
+
+// RequestIDSpanProcessor sets the request.id attribute of the spans started
+// during requests.
+type RequestIDSpanProcessor struct{}
+
+// OnStart tags s with the request id of parent.
+func (RequestIDSpanProcessor) OnStart(parent context.Context, s sdktrace.ReadWriteSpan) {
+	if id := RequestID(parent); id != "" {
+		s.SetAttributes(attribute.String("request.id", id))
+	}
+}
+
+func (RequestIDSpanProcessor) OnEnd(sdktrace.ReadOnlySpan)      {}
+func (RequestIDSpanProcessor) Shutdown(context.Context) error   { return nil }
+func (RequestIDSpanProcessor) ForceFlush(context.Context) error { return nil }
@@ -0,0 +1,60 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestRequestIDHandler(t *testing.T) {
+	var seen string
+	h := RequestIDHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = RequestID(r.Context())
+		encodeError(r.Context(), ErrForbidden, w)
+	}))
+
+	r := httptest.NewRequest("GET", "/customers", nil)
+	r.Header.Set(RequestIDHeader, "edge-1234")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	var body errorBody
+	json.NewDecoder(w.Body).Decode(&body)
+	if seen != "edge-1234" || w.Header().Get(RequestIDHeader) != "edge-1234" || body.RequestID != "edge-1234" {
+		t.Errorf("expected the id propagated, got %q %q %q", seen, w.Header().Get(RequestIDHeader), body.RequestID)
+	}
+
+	for _, id := range []string{"", "two words", strings.Repeat("a", maxRequestID+1)} {
+		r := httptest.NewRequest("GET", "/customers", nil)
+		r.Header.Set(RequestIDHeader, id)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if got := w.Header().Get(RequestIDHeader); got == id || len(got) != 32 || seen != got {
+			t.Errorf("expected a generated id for %q, got %q", id, got)
+		}
+	}
+}
+
+func TestRequestIDSpanProcessor(t *testing.T) {
+	rec := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(RequestIDSpanProcessor{}), sdktrace.WithSpanProcessor(rec))
+	ctx := context.WithValue(context.Background(), requestIDContextKey, "edge-1234")
+	_, span := tp.Tracer("test").Start(ctx, "Get Users")
+	span.End()
+	spans := rec.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("expected one span, got %v", len(spans))
+	}
+	for _, a := range spans[0].Attributes() {
+		if a == attribute.String("request.id", "edge-1234") {
+			return
+		}
+	}
+	t.Errorf("expected the request.id attribute, got %v", spans[0].Attributes())
+}
@@ -0,0 +1,220 @@
+package api
+
+// scopes.go contains the endpoint middleware enforcing token scopes. Scoped
+// endpoints need a bearer token and only reach what it was scoped to, the
+// endpoints open to anonymous callers, like login and register, are the ones
+// not wrapped in ScopeMiddleware.
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/go-kit/kit/endpoint"
+	"user/auth"
+)
+
+type contextKey int
+
+const (
+	tokenContextKey contextKey = iota
+	// introspectionContextKey holds the introspected token of GraphQL
+	// requests, whose resolvers authorize each resource they reach.
+	introspectionContextKey
+	// acceptContextKey holds the Accept header the response is negotiated by.
+	acceptContextKey
+	// idempotencyContextKey holds the Idempotency-Key header.
+	idempotencyContextKey
+	// requestURIContextKey holds the URI collections link to as self.
+	requestURIContextKey
+	// requestIDContextKey holds the X-Request-ID of the request.
+	requestIDContextKey
+	// clientIPContextKey holds the client address ProxyHandler resolved.
+	clientIPContextKey
+)
+
+// TokenToContext moves a bearer token from the Authorization header into the
+// request context.
+func TokenToContext(ctx context.Context, r *http.Request) context.Context {
+	h := r.Header.Get("Authorization")
+	if len(h) > 7 && strings.EqualFold(h[:7], "Bearer ") {
+		return context.WithValue(ctx, tokenContextKey, strings.TrimSpace(h[7:]))
+	}
+	return ctx
+}
+
+// ScopeMiddleware rejects requests whose token does not grant access to the
+// requested resource of the given entity. Resource scopes such as
+// "addresses:<id>" grant read access to that single resource, the customer
+// scope grants access to everything owned by the token subject and the admin
+// scope to everything. Requests without a token are unauthorized.
+func ScopeMiddleware(s Service, entity string) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			tok, ok := ctx.Value(tokenContextKey).(string)
+			if !ok {
+				return nil, ErrUnauthorized
+			}
+			i := s.Introspect(tok)
+			if !i.Active {
+				return nil, ErrUnauthorized
+			}
+			if auth.HasScope(i.Scope, auth.ScopeAdmin) {
+				return next(ctx, request)
+			}
+			if err := authorize(ctx, s, i, entity, request); err != nil {
+				return nil, err
+			}
+			return next(ctx, request)
+		}
+	}
+}
+
+// AdminMiddleware rejects requests whose token doesn't carry the admin
+// scope. Requests without a token are unauthorized.
+func AdminMiddleware(s Service) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			tok, ok := ctx.Value(tokenContextKey).(string)
+			if !ok {
+				return nil, ErrUnauthorized
+			}
+			i := s.Introspect(tok)
+			if !i.Active {
+				return nil, ErrUnauthorized
+			}
+			if !auth.HasScope(i.Scope, auth.ScopeAdmin) {
+				return nil, ErrForbidden
+			}
+			return next(ctx, request)
+		}
+	}
+}
+
+func authorize(ctx context.Context, s Service, i auth.Introspection, entity string, request interface{}) error {
+	switch req := request.(type) {
+	case GetRequest:
+		if req.ID != "" && auth.HasScope(i.Scope, auth.ResourceScope(entity, req.ID)) {
+			return nil
+		}
+		err := ownedByCustomer(ctx, s, i, entity, req.ID)
+		if err != nil && entity == "customers" && (req.Attr == "" || req.Attr == "groups") {
+			return ownedByGroupOwner(ctx, s, i, req.ID)
+		}
+		return err
+	case userUpdateRequest:
+		return ownedByCustomer(ctx, s, i, "customers", req.ID)
+	case avatarPutRequest:
+		return ownedByCustomer(ctx, s, i, "customers", req.ID)
+	case phoneVerifyRequest:
+		return ownedByCustomer(ctx, s, i, "customers", req.ID)
+	case preferencesPutRequest:
+		return ownedByCustomer(ctx, s, i, "customers", req.ID)
+	case renameRequest:
+		return ownedByCustomer(ctx, s, i, "customers", req.ID)
+	case activityRequest:
+		return ownedByCustomer(ctx, s, i, "customers", req.ID)
+	case notificationsRequest:
+		return ownedByCustomer(ctx, s, i, "customers", req.ID)
+	case addressImportRequest:
+		return ownedByCustomer(ctx, s, i, "customers", req.UserID)
+	case batchRequest:
+		// Anyone may create customers, addresses and cards are only added
+		// to the subject or to customers created by the same batch.
+		for _, op := range req.Operations {
+			if op.Customer != nil || strings.HasPrefix(op.UserID, "$") {
+				continue
+			}
+			if err := ownedByCustomer(ctx, s, i, "customers", op.UserID); err != nil {
+				return err
+			}
+		}
+		return nil
+	case addressPatchRequest:
+		return ownedByCustomer(ctx, s, i, "addresses", req.ID)
+	case addressPostRequest:
+		return ownedByCustomer(ctx, s, i, "customers", req.UserID)
+	case cardPostRequest:
+		return ownedByCustomer(ctx, s, i, "customers", req.UserID)
+	case cardPutRequest:
+		return ownedByCustomer(ctx, s, i, "cards", req.ID)
+	case cardDefaultRequest:
+		return ownedByCustomer(ctx, s, i, "cards", req.ID)
+	case deleteRequest:
+		if req.Entity == "groups" {
+			return groupOwner(ctx, s, i, req.ID)
+		}
+		return ownedByCustomer(ctx, s, i, req.Entity, req.ID)
+	case groupPostRequest:
+		// Customers can only create groups they own.
+		if len(req.Owners) != 1 {
+			return ErrForbidden
+		}
+		return ownedByCustomer(ctx, s, i, "customers", req.Owners[0])
+	case groupGetRequest:
+		g, err := s.GetGroup(ctx, req.ID)
+		if err != nil || !g.IsMember(i.Subject) {
+			return ErrForbidden
+		}
+		return nil
+	case groupMemberRequest:
+		// Members can leave, owners manage the rest.
+		if req.Removing && req.UserID == i.Subject && auth.HasScope(i.Scope, auth.ScopeCustomer) {
+			return nil
+		}
+		return groupOwner(ctx, s, i, req.GroupID)
+	}
+	return ErrForbidden
+}
+
+// groupOwner allows customer scoped tokens of the group owners.
+func groupOwner(ctx context.Context, s Service, i auth.Introspection, id string) error {
+	if !auth.HasScope(i.Scope, auth.ScopeCustomer) {
+		return ErrForbidden
+	}
+	g, err := s.GetGroup(ctx, id)
+	if err != nil || !g.IsOwner(i.Subject) {
+		return ErrForbidden
+	}
+	return nil
+}
+
+// ownedByGroupOwner allows owners of a group to read the profiles and
+// groups of its members.
+func ownedByGroupOwner(ctx context.Context, s Service, i auth.Introspection, id string) error {
+	if id == "" || !auth.HasScope(i.Scope, auth.ScopeCustomer) {
+		return ErrForbidden
+	}
+	gs, err := s.GetUserGroups(ctx, id)
+	if err != nil {
+		return ErrForbidden
+	}
+	for _, g := range gs {
+		if g.IsOwner(i.Subject) {
+			return nil
+		}
+	}
+	return ErrForbidden
+}
+
+// ownedByCustomer allows customer scoped tokens to reach the resources
+// belonging to their subject.
+func ownedByCustomer(ctx context.Context, s Service, i auth.Introspection, entity, id string) error {
+	if id == "" || !auth.HasScope(i.Scope, auth.ScopeCustomer) {
+		return ErrForbidden
+	}
+	if entity == "customers" {
+		if id == i.Subject {
+			return nil
+		}
+		return ErrForbidden
+	}
+	us, err := s.GetUsers(ctx, i.Subject)
+	if err != nil || len(us) == 0 {
+		return ErrForbidden
+	}
+	if ownsResource(us[0], auth.ResourceScope(entity, id)) {
+		return nil
+	}
+	return ErrForbidden
+}
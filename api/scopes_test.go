@@ -0,0 +1,107 @@
+package api
+
+import (
+	"context"
+	"testing"
+
+	"user/auth"
+)
+
+// scopeStub introspects tokens named after their scope, "inactive" being
+// expired.
+type scopeStub struct {
+	Service
+}
+
+func (scopeStub) Introspect(token string) auth.Introspection {
+	if token == "inactive" {
+		return auth.Introspection{}
+	}
+	return auth.Introspection{Active: true, Subject: "1", Scope: token}
+}
+
+func (scopeStub) AuthenticateClient(id, secret string) bool {
+	return id == "orders" && secret == "s3cret"
+}
+
+func TestScopeMiddleware(t *testing.T) {
+	e := ScopeMiddleware(scopeStub{}, "addresses")(func(context.Context, interface{}) (interface{}, error) {
+		return "ok", nil
+	})
+	for _, c := range []struct {
+		name  string
+		token string
+		id    string
+		err   error
+	}{
+		{"no token", "", "a1", ErrUnauthorized},
+		{"inactive token", "inactive", "a1", ErrUnauthorized},
+		{"admin", auth.ScopeAdmin, "a1", nil},
+		{"resource scope", auth.ResourceScope("addresses", "a1"), "a1", nil},
+		{"other resource scope", auth.ResourceScope("addresses", "a2"), "a1", ErrForbidden},
+		{"scope of another entity", auth.ResourceScope("cards", "a1"), "a1", ErrForbidden},
+	} {
+		ctx := context.Background()
+		if c.token != "" {
+			ctx = context.WithValue(ctx, tokenContextKey, c.token)
+		}
+		resp, err := e(ctx, GetRequest{ID: c.id})
+		if err != c.err || err == nil && resp != "ok" {
+			t.Errorf("%v: expected %v, got %v %v", c.name, c.err, resp, err)
+		}
+	}
+}
+
+func TestAdminMiddleware(t *testing.T) {
+	e := AdminMiddleware(scopeStub{})(func(context.Context, interface{}) (interface{}, error) {
+		return "ok", nil
+	})
+	for _, c := range []struct {
+		name  string
+		token string
+		err   error
+	}{
+		{"no token", "", ErrUnauthorized},
+		{"inactive token", "inactive", ErrUnauthorized},
+		{"customer", auth.ScopeCustomer, ErrForbidden},
+		{"resource scope", auth.ResourceScope("webhooks", "w1"), ErrForbidden},
+		{"admin", auth.ScopeAdmin, nil},
+	} {
+		ctx := context.Background()
+		if c.token != "" {
+			ctx = context.WithValue(ctx, tokenContextKey, c.token)
+		}
+		resp, err := e(ctx, GetRequest{ID: "w1"})
+		if err != c.err || err == nil && resp != "ok" {
+			t.Errorf("%v: expected %v, got %v %v", c.name, c.err, resp, err)
+		}
+	}
+}
+
+func TestIntrospectionAuthentication(t *testing.T) {
+	e := MakeIntrospectEndpoint(scopeStub{})
+	for _, c := range []struct {
+		name  string
+		token string
+		req   introspectRequest
+		err   error
+	}{
+		{"anonymous", "", introspectRequest{Token: "customer"}, ErrUnauthorized},
+		{"client", "", introspectRequest{Token: "customer", ClientID: "orders", ClientSecret: "s3cret"}, nil},
+		{"wrong secret", "", introspectRequest{Token: "customer", ClientID: "orders", ClientSecret: "guess"}, ErrUnauthorized},
+		{"customer token", auth.ScopeCustomer, introspectRequest{Token: "customer"}, ErrUnauthorized},
+		{"admin token", auth.ScopeAdmin, introspectRequest{Token: "customer"}, nil},
+	} {
+		ctx := context.Background()
+		if c.token != "" {
+			ctx = context.WithValue(ctx, tokenContextKey, c.token)
+		}
+		resp, err := e(ctx, c.req)
+		if err != c.err {
+			t.Errorf("%v: expected %v, got %v", c.name, c.err, err)
+		}
+		if i, _ := resp.(auth.Introspection); err == nil && (!i.Active || i.Scope != "customer") {
+			t.Errorf("%v: expected the introspection of the token, got %+v", c.name, resp)
+		}
+	}
+}
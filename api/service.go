@@ -4,151 +4,2108 @@ package api
 // user service. Everything here is agnostic to the transport (HTTP).
 
 import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"math/big"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/go-kit/kit/log"
+	"user/address"
+	"user/auth"
+	"user/avatar"
+	"user/blob"
+	"user/cardvault"
+	"user/changes"
 	"user/db"
+	"user/patch"
+	"user/risk"
+	"user/security"
+	"user/sms"
 	"user/users"
 )
 
 var (
-	ErrUnauthorized = errors.New("Unauthorized")
+	ErrUnauthorized  = errors.New("Unauthorized")
+	ErrForbidden     = errors.New("Forbidden")
+	ErrInvalidScope  = errors.New("Invalid scope")
+	ErrMFARequired   = errors.New("Multi-factor authentication required")
+	ErrLoginBlocked  = errors.New("Login blocked")
+	ErrAccountLocked = errors.New("Account locked")
+	ErrInactive      = errors.New("Account not active")
+	ErrQuotaExceeded = errors.New("Quota exceeded")
+	// ErrNoPhoneVerification is returned when no SMS provider is set up.
+	ErrNoPhoneVerification = errors.New("Phone verification is not enabled")
+	// ErrIdempotencyKeyReused is returned for an idempotency key sent again
+	// with another request.
+	ErrIdempotencyKeyReused = errors.New("Idempotency key reused with another request")
+	// ErrIdempotencyKeyInUse is returned while the first request of an
+	// idempotency key is in progress.
+	ErrIdempotencyKeyInUse = errors.New("Request with this idempotency key in progress")
 )
 
+// QuotaError is returned when a user already has the maximum number of
+// addresses or cards. It matches ErrQuotaExceeded with errors.Is.
+type QuotaError struct {
+	Resource string
+	Limit    int
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("At most %v %v per customer", e.Limit, e.Resource)
+}
+
+// Is reports whether target is ErrQuotaExceeded.
+func (e *QuotaError) Is(target error) bool {
+	return target == ErrQuotaExceeded
+}
+
 // Service is the user service, providing operations for users to login, register, and retrieve customer information.
 type Service interface {
-	Login(username, password string) (users.User, error) // GET /login
-	Register(username, password, email, first, last string) (string, error)
-	GetUsers(id string) ([]users.User, error)
-	PostUser(u users.User) (string, error)
-	GetAddresses(id string) ([]users.Address, error)
-	PostAddress(u users.Address, userid string) (string, error)
-	GetCards(id string) ([]users.Card, error)
-	PostCard(u users.Card, userid string) (string, error)
-	Delete(entity, id string) error
-	Health() []Health // GET /health
+	Login(ctx context.Context, username, password string, client risk.Client) (users.User, error) // GET /login
+	Register(ctx context.Context, username, password, email, first, last, phone string) (string, error)
+	Upgrade(ctx context.Context, token, username, password, email, first, last string) (string, error) // POST /register with upgradeToken
+	CreateGuest(ctx context.Context) (users.User, string, error)                                       // POST /customers/guest
+	Available(ctx context.Context, username, email string) (Availability, error)                       // GET /register/available
+	GetUsers(ctx context.Context, id string) ([]users.User, error)
+	GetUserAttributes(ctx context.Context, u *users.User) error
+	ExpandUsers(ctx context.Context, us []users.User, expand []string) error // GET /customers/{id}?expand=
+	FindUsers(ctx context.Context, q db.UserQuery) ([]users.User, error)
+	BatchGetUsers(ctx context.Context, ids []string) ([]users.User, []string, error)         // POST /customers/batch
+	ListUsers(ctx context.Context, cursor string, limit int) ([]users.User, string, error)   // GET /admin/customers
+	ListCards(ctx context.Context, cursor string, limit int) ([]db.OwnedCard, string, error) // GET /admin/cards
+	ExportUsers(ctx context.Context, w io.Writer, mask []string) error                       // GET /admin/customers/export
+	Stats(ctx context.Context, days int) (db.Stats, error)                                   // GET /admin/stats
+	PostUser(ctx context.Context, u users.User) (string, error)
+	UpdateUser(ctx context.Context, id string, p users.ProfileUpdate) (users.User, error)
+	PatchUser(ctx context.Context, id string, p patch.Patch) (users.User, error)                   // PATCH /customers/{id} with a JSON Patch
+	SetAvatar(ctx context.Context, id string, img io.Reader) (users.User, error)                   // PUT /customers/{id}/avatar
+	SetPreferences(ctx context.Context, id string, p users.Preferences) (users.Preferences, error) // PUT /customers/{id}/preferences
+	SetStatus(ctx context.Context, id, status string) (users.User, error)                          // PUT /customers/{id}/status
+	SendPhoneCode(ctx context.Context, id string) error                                            // POST /customers/{id}/phone/verification
+	VerifyPhone(ctx context.Context, id, code string) (users.User, error)                          // PUT /customers/{id}/phone/verification
+	AddTag(ctx context.Context, id, tag string) (users.User, error)                                // PUT /customers/{id}/tags/{tag}
+	Rename(ctx context.Context, id, username string) (users.User, error)                           // POST /customers/{id}/username
+	Merge(ctx context.Context, target, source, prefer string) (users.User, error)                  // POST /admin/customers/merge
+	ResetPassword(ctx context.Context, id, password string) (string, error)                        // PUT /admin/customers/{id}/password
+	RemoveTag(ctx context.Context, id, tag string) (users.User, error)                             // DELETE /customers/{id}/tags/{tag}
+	GetAddresses(ctx context.Context, id string) ([]users.Address, error)
+	GetAddressesByID(ctx context.Context, ids []string) ([]users.Address, error) // POST /graphql
+	PostAddress(ctx context.Context, u users.Address, userid string) (string, error)
+	PatchAddress(ctx context.Context, id string, p patch.Patch) (users.Address, error)                     // PATCH /addresses/{id}
+	ImportAddresses(ctx context.Context, userid string, as []users.Address) ([]AddressImportResult, error) // POST /customers/{id}/addresses/import
+	Batch(ctx context.Context, ops []BatchOperation) ([]BatchResult, error)                                // POST /batch
+	GetCards(ctx context.Context, id string) ([]users.Card, error)
+	GetCardsByID(ctx context.Context, ids []string) ([]users.Card, error) // POST /graphql
+	PostCard(ctx context.Context, u users.Card, userid string) (string, error)
+	UpdateCard(ctx context.Context, id string, u users.CardUpdate) (users.Card, error) // PUT /cards/{id}
+	SetDefaultCard(ctx context.Context, id string) (users.Card, error)                 // PUT /cards/{id}/default
+	Delete(ctx context.Context, entity, id string) error
+	CreateGroup(ctx context.Context, g users.Group) (users.Group, error)                                          // POST /groups
+	GetGroup(ctx context.Context, id string) (users.Group, error)                                                 // GET /groups/{id}
+	GetUserGroups(ctx context.Context, userID string) ([]users.Group, error)                                      // GET /customers/{id}/groups
+	Activity(ctx context.Context, id, cursor string, limit int) ([]users.Activity, string, error)                 // GET /customers/{id}/activity
+	AddGroupMember(ctx context.Context, groupID, userID string) (users.Group, error)                              // POST /groups/{id}/members
+	RemoveGroupMember(ctx context.Context, groupID, userID string) (users.Group, error)                           // DELETE /groups/{id}/members/{userId}
+	CreateWebhook(ctx context.Context, w users.Webhook) (users.Webhook, error)                                    // POST /webhooks
+	GetWebhooks(ctx context.Context) ([]users.Webhook, error)                                                     // GET /webhooks
+	DeleteWebhook(ctx context.Context, id string) error                                                           // DELETE /webhooks/{id}
+	WebhookDeliveries(ctx context.Context, id, cursor string, limit int) ([]users.WebhookDelivery, string, error) // GET /webhooks/{id}/deliveries
+	DeleteUsers(ctx context.Context, ids []string) (map[string]error, error)
+	ExpireGuests(ctx context.Context, before time.Time) (int, error)
+	IssueToken(u users.User, scopes []string) (string, error)
+	ClaimIdempotencyKey(ctx context.Context, key, fingerprint string) (string, error) // Idempotency-Key of POST /register, /customers, /addresses, /cards
+	SettleIdempotencyKey(ctx context.Context, key, resultID string) error
+	Introspect(token string) auth.Introspection       // POST /oauth/introspect
+	AuthenticateClient(id, secret string) bool        // POST /oauth/introspect
+	Changes(lastEventID string) *changes.Subscription // GET /events/stream
+	Notifications(id string) *changes.Subscription    // GET /customers/{id}/events
+	Health(ctx context.Context, deep bool) []Health   // GET /health
+	Ready(ctx context.Context) []Health               // GET /ready
+}
+
+// ServiceOption configures the service returned by NewFixedService.
+type ServiceOption func(*fixedService)
+
+// WithSigner sets the signer used to issue and introspect tokens.
+func WithSigner(signer *auth.Signer) ServiceOption {
+	return func(s *fixedService) {
+		s.signer = signer
+	}
+}
+
+// WithIntrospectionClients sets the clients allowed to introspect tokens.
+func WithIntrospectionClients(c auth.Clients) ServiceOption {
+	return func(s *fixedService) {
+		s.clients = c
+	}
+}
+
+// WithRiskEvaluator sets the evaluator scoring logins and the policy acting
+// on its scores.
+func WithRiskEvaluator(e risk.Evaluator, p risk.Policy) ServiceOption {
+	return func(s *fixedService) {
+		s.evaluator = e
+		s.policy = p
+	}
+}
+
+// WithAuditLogger sets the logger receiving security relevant decisions.
+func WithAuditLogger(logger log.Logger) ServiceOption {
+	return func(s *fixedService) {
+		s.audit = logger
+	}
+}
+
+// WithSecurityEvents sets the emitter receiving security events.
+func WithSecurityEvents(e security.Emitter) ServiceOption {
+	return func(s *fixedService) {
+		s.events = e
+	}
+}
+
+// WithChanges sets the broker streaming the changes to users, addresses and
+// cards.
+func WithChanges(b *changes.Broker) ServiceOption {
+	return func(s *fixedService) {
+		s.changes = b
+	}
+}
+
+// WithReadinessCheck adds the dependency name, like a cache that has to be
+// warm, to the readiness of the service. The service is not ready while
+// check fails.
+func WithReadinessCheck(name string, check func() error) ServiceOption {
+	return func(s *fixedService) {
+		s.readiness = append(s.readiness, readinessCheck{name, check})
+	}
+}
+
+// WithLockout sets the failed login lockout policy.
+func WithLockout(l *security.Lockout) ServiceOption {
+	return func(s *fixedService) {
+		s.lockout = l
+	}
+}
+
+// WithRenameGrace sets how long a username given up by a rename keeps
+// logging in to the account and can't be taken by anyone else.
+func WithRenameGrace(d time.Duration) ServiceOption {
+	return func(s *fixedService) {
+		s.renameGrace = d
+	}
+}
+
+// WithBlobStore sets where uploaded avatars are stored.
+func WithBlobStore(store blob.Store) ServiceOption {
+	return func(s *fixedService) {
+		s.blobs = store
+	}
+}
+
+// Archiver keeps a record of the users purged, like *archive.Archive.
+type Archiver interface {
+	Put(tenant string, u users.User) error
+}
+
+// WithArchive archives the users before bulk deletion purges them. Users
+// failing to be archived aren't purged.
+func WithArchive(a Archiver) ServiceOption {
+	return func(s *fixedService) {
+		s.archive = a
+	}
+}
+
+// WithAddressValidator sets the validator checking and normalizing posted
+// addresses.
+func WithAddressValidator(v address.Validator) ServiceOption {
+	return func(s *fixedService) {
+		s.addresses = v
+	}
+}
+
+// WithGeocoding geocodes new addresses in the background with q.
+func WithGeocoding(q *address.Geocoding) ServiceOption {
+	return func(s *fixedService) {
+		s.geocoding = q
+	}
+}
+
+// WithCardVault stores new cards with the vault, keeping only the token and
+// masked number.
+func WithCardVault(v cardvault.CardVault) ServiceOption {
+	return func(s *fixedService) {
+		s.vault = v
+	}
+}
+
+// WithCardVerifier verifies new cards once they are stored, in the
+// background when async is set.
+func WithCardVerifier(v cardvault.CardVerifier, async bool) ServiceOption {
+	return func(s *fixedService) {
+		s.verifier = v
+		s.verifyAsync = async
+	}
+}
+
+// WithSMS texts phone verification codes with sender.
+func WithSMS(sender sms.Sender) ServiceOption {
+	return func(s *fixedService) {
+		s.sms = sender
+	}
+}
+
+// WithLimits sets the maximum number of addresses and cards of a user, zero
+// for no limit.
+func WithLimits(addresses, cards int) ServiceOption {
+	return func(s *fixedService) {
+		s.maxAddresses = addresses
+		s.maxCards = cards
+	}
+}
+
+// WithTenant makes the service serve a single tenant from its store. Its
+// tokens carry the tenant and tokens of other tenants are rejected. The
+// service has no store without it.
+func WithTenant(tenant string, store Store) ServiceOption {
+	return func(s *fixedService) {
+		s.tenant = tenant
+		s.db = store
+	}
 }
 
 // NewFixedService returns a simple implementation of the Service interface,
-func NewFixedService() Service {
-	return &fixedService{}
+// tokens are signed with a random key unless WithSigner is given.
+func NewFixedService(opts ...ServiceOption) Service {
+	s := &fixedService{
+		evaluator:    risk.None,
+		policy:       risk.DefaultPolicy,
+		audit:        log.NewNopLogger(),
+		events:       security.Discard,
+		changes:      changes.NewBroker(DefaultChangesRetained),
+		lockout:      security.NewLockout(5, 15*time.Minute, 15*time.Minute),
+		renameGrace:  DefaultRenameGrace,
+		addresses:    address.Basic,
+		maxAddresses: DefaultMaxAddresses,
+		maxCards:     DefaultMaxCards,
+		replays:      auth.NewReplayDetector(),
+	}
+	s.blobs, _ = blob.New()
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.signer == nil {
+		key := make([]byte, 32)
+		rand.Read(key)
+		s.signer, _ = auth.NewSigner(key, DefaultTokenTTL)
+	}
+	return s
+}
+
+const (
+	// DefaultTokenTTL is how long tokens issued on login stay valid.
+	DefaultTokenTTL = time.Hour
+	// DefaultChangesRetained is how many changes are kept for event stream
+	// subscribers resuming.
+	DefaultChangesRetained = 1024
+	// DefaultRenameGrace is how long old usernames redirect after a rename.
+	DefaultRenameGrace = 30 * 24 * time.Hour
+	// DefaultMaxAddresses is how many addresses a user may have.
+	DefaultMaxAddresses = 20
+	// DefaultMaxCards is how many cards a user may have.
+	DefaultMaxCards = 10
+)
+
+type fixedService struct {
+	signer       *auth.Signer
+	clients      auth.Clients
+	replays      *auth.ReplayDetector
+	evaluator    risk.Evaluator
+	policy       risk.Policy
+	audit        log.Logger
+	events       security.Emitter
+	changes      *changes.Broker
+	lockout      *security.Lockout
+	blobs        blob.Store
+	archive      Archiver
+	renameGrace  time.Duration
+	addresses    address.Validator
+	geocoding    *address.Geocoding
+	vault        cardvault.CardVault
+	verifier     cardvault.CardVerifier
+	verifyAsync  bool
+	sms          sms.Sender
+	maxAddresses int
+	maxCards     int
+	db           Store
+	tenant       string
+	readiness    []readinessCheck
 }
 
-type fixedService struct{}
+// readinessCheck is a dependency the service needs to be ready.
+type readinessCheck struct {
+	name  string
+	check func() error
+}
 
 type Health struct {
 	Service string `json:"service"`
 	Status  string `json:"status"`
 	Time    string `json:"time"`
+	// Latency is how long pinging the dependency took.
+	Latency string `json:"latency,omitempty"`
 }
 
-func (s *fixedService) Login(username, password string) (users.User, error) {
-	u, err := db.GetUserByName(username)
+func (s *fixedService) Login(ctx context.Context, username, password string, client risk.Client) (users.User, error) {
+	// Failures count against the account, whatever case it's typed in.
+	key := users.NormalizeUsername(username)
+	if s.lockout.Locked(key) {
+		s.emit(security.LockedAttempt, users.User{Username: username}, client, "")
+		return users.New(), ErrAccountLocked
+	}
+	u, err := s.userByName(ctx, username)
 	if err != nil {
+		s.emit(security.LoginFailed, users.User{Username: username}, client, err.Error())
 		return users.New(), err
 	}
 	if u.Password != calculatePassHash(password, u.Salt) {
+		s.emit(security.LoginFailed, u, client, "bad password")
+		if s.lockout.Fail(key) {
+			s.emit(security.AccountLocked, u, client, "too many failed logins")
+		}
 		return users.New(), ErrUnauthorized
 	}
-	db.GetUserAttributes(&u)
+	if u.GetStatus() != users.StatusActive {
+		s.emit(security.LoginFailed, u, client, "status "+u.GetStatus())
+		return users.New(), ErrInactive
+	}
+	if err := s.assessLogin(u, client); err != nil {
+		return users.New(), err
+	}
+	s.lockout.Succeed(key)
+	s.emit(security.LoginSucceeded, u, client, "")
+	s.changes.PublishEvent(changes.Event{
+		Type:       changes.UserLoggedIn,
+		ResourceID: u.UserID,
+		UserID:     u.UserID,
+		Details: map[string]string{
+			"ip":        client.IP,
+			"country":   client.Country,
+			"userAgent": client.UserAgent,
+			"device":    client.DeviceID,
+		},
+	})
+	now := time.Now()
+	if err := s.db.RecordLogin(ctx, u.UserID, now); err == nil {
+		u.LastLoginAt = &now
+		u.LoginCount++
+	}
+	s.db.GetUserAttributes(ctx, &u)
 	u.MaskCCs()
 	return u, nil
 }
 
-func (s *fixedService) Register(username, password, email, first, last string) (string, error) {
+// assessLogin scores a login with valid credentials and records the outcome
+// in the audit log. Evaluator failures let the login through.
+func (s *fixedService) assessLogin(u users.User, client risk.Client) error {
+	a, err := s.evaluator.Evaluate(risk.Attempt{
+		UserID:   u.UserID,
+		Username: u.Username,
+		Client:   client,
+		Time:     time.Now(),
+	})
+	d := s.policy.Decide(a)
+	if err != nil {
+		d = risk.Allow
+	}
+	s.audit.Log(
+		"event", "login_risk",
+		"user", u.UserID,
+		"ip", client.IP,
+		"country", client.Country,
+		"device", client.DeviceID,
+		"score", a.Score,
+		"reasons", strings.Join(a.Reasons, ","),
+		"decision", d,
+		"err", err,
+	)
+	reason := strings.Join(a.Reasons, ",")
+	switch d {
+	case risk.Block:
+		s.emit(security.LoginBlocked, u, client, reason)
+		return ErrLoginBlocked
+	case risk.RequireMFA:
+		s.emit(security.MFARequired, u, client, reason)
+		return ErrMFARequired
+	}
+	return nil
+}
+
+func (s *fixedService) emit(t security.Type, u users.User, client risk.Client, reason string) {
+	e := security.NewEvent(t)
+	e.UserID = u.UserID
+	e.Username = u.Username
+	e.Locale = u.Locale
+	e.Timezone = u.Timezone
+	e.IP = client.IP
+	e.Reason = reason
+	s.events.Emit(e)
+}
+
+func (s *fixedService) Register(ctx context.Context, username, password, email, first, last, phone string) (string, error) {
+	phone = users.NormalizePhone(phone)
+	if phone != "" {
+		if err := users.ValidatePhone(phone); err != nil {
+			return "", invalid(err)
+		}
+	}
 	u := users.New()
+	u.Phone = phone
 	u.Username = username
 	u.Password = calculatePassHash(password, u.Salt)
 	u.Email = email
 	u.FirstName = first
 	u.LastName = last
-	err := db.CreateUser(&u)
-	return u.UserID, err
+	u.Status = users.StatusActive
+	if err := s.db.CreateUser(ctx, &u); err != nil {
+		return "", err
+	}
+	s.changes.Publish(changes.UserCreated, u.UserID, u.UserID)
+	return u.UserID, nil
 }
 
-func (s *fixedService) GetUsers(id string) ([]users.User, error) {
-	if id == "" {
-		us, err := db.GetUsers()
-		for k, u := range us {
-			u.AddLinks()
-			us[k] = u
+// CreateGuest creates an anonymous user for guest checkout and returns it
+// with a customer token, which also serves as its upgrade token.
+func (s *fixedService) CreateGuest(ctx context.Context) (users.User, string, error) {
+	u := users.NewGuest()
+	if err := s.db.CreateUser(ctx, &u); err != nil {
+		return users.User{}, "", err
+	}
+	s.changes.Publish(changes.UserCreated, u.UserID, u.UserID)
+	tok, err := s.IssueToken(u, nil)
+	return u, tok, err
+}
+
+// Upgrade turns the guest holding token into a registered user, keeping its
+// id, addresses and cards.
+func (s *fixedService) Upgrade(ctx context.Context, token, username, password, email, first, last string) (string, error) {
+	if username == "" || password == "" {
+		return "", invalid(errors.New("expected username and password"))
+	}
+	i := s.Introspect(token)
+	if !i.Active || !auth.HasScope(i.Scope, auth.ScopeCustomer) {
+		return "", ErrUnauthorized
+	}
+	g, err := s.db.GetUser(ctx, i.Subject)
+	if err != nil {
+		return "", err
+	}
+	if !g.HasRole(users.RoleGuest) {
+		return "", invalid(users.ErrNotGuest)
+	}
+	u := users.New()
+	u.Username = username
+	u.Password = calculatePassHash(password, u.Salt)
+	u.Email = email
+	u.FirstName = first
+	u.LastName = last
+	if err := s.db.UpgradeUser(ctx, g.UserID, u); err != nil {
+		return "", err
+	}
+	s.changes.Publish(changes.UserUpdated, g.UserID, g.UserID)
+	return g.UserID, nil
+}
+
+// Availability reports whether the requested username and email are free,
+// fields that weren't asked for are nil.
+type Availability struct {
+	Username *bool `json:"username,omitempty"`
+	Email    *bool `json:"email,omitempty"`
+}
+
+// userByName finds the user by username, or by one they gave up within the
+// rename grace period.
+func (s *fixedService) userByName(ctx context.Context, username string) (users.User, error) {
+	u, err := s.db.GetUserByName(ctx, username)
+	if err == nil {
+		return u, nil
+	}
+	if prev, perr := s.db.GetUserByPreviousName(ctx, username, time.Now().Add(-s.renameGrace)); perr == nil {
+		return prev, nil
+	}
+	return u, err
+}
+
+// Merge winners for fields both accounts have set.
+const (
+	PreferTarget = "target"
+	PreferSource = "source"
+)
+
+// ResetPassword sets a new password of the customer, a generated one when
+// password is empty. Only a generated password is returned, to be handed to
+// the customer once.
+func (s *fixedService) ResetPassword(ctx context.Context, id, password string) (string, error) {
+	u, err := s.db.GetUser(ctx, id)
+	if err != nil {
+		return "", err
+	}
+	generated := password == ""
+	if generated {
+		password = generatePassword()
+	}
+	u.NewSalt()
+	hash := calculatePassHash(password, u.Salt)
+	if err := s.db.UpdateUser(ctx, u.UserID, users.ProfileUpdate{Password: &hash, Salt: &u.Salt}); err != nil {
+		return "", err
+	}
+	s.audit.Log(
+		"event", "password_reset",
+		"user", u.UserID,
+		"generated", generated,
+	)
+	if generated {
+		return password, nil
+	}
+	return "", nil
+}
+
+// Merge folds the source account into the target. Addresses, cards and tags
+// are combined. Profile fields set on one account only are kept, for fields
+// set on both prefer picks the account that wins. The target keeps its
+// username and roles; the source username and id keep resolving to it.
+func (s *fixedService) Merge(ctx context.Context, target, source, prefer string) (users.User, error) {
+	if prefer == "" {
+		prefer = PreferTarget
+	}
+	if prefer != PreferTarget && prefer != PreferSource {
+		return users.User{}, invalid(fmt.Errorf("prefer must be %v or %v", PreferTarget, PreferSource))
+	}
+	if target == "" || source == "" || target == source {
+		return users.User{}, invalid(errors.New("expected two distinct accounts"))
+	}
+	t, err := s.db.GetUser(ctx, target)
+	if err != nil {
+		return users.User{}, err
+	}
+	src, err := s.db.GetUser(ctx, source)
+	if err != nil {
+		return users.User{}, err
+	}
+	if src.UserID == t.UserID {
+		// source was already merged into target
+		return users.User{}, invalid(errors.New("expected two distinct accounts"))
+	}
+	win, lose := t, src
+	if prefer == PreferSource {
+		win, lose = src, t
+	}
+	pick := func(w, l string) *string {
+		if w == "" {
+			return &l
 		}
-		return us, err
+		return &w
+	}
+	p := users.ProfileUpdate{
+		FirstName:   pick(win.FirstName, lose.FirstName),
+		LastName:    pick(win.LastName, lose.LastName),
+		Email:       pick(win.Email, lose.Email),
+		Avatar:      win.Avatar,
+		Preferences: win.Preferences,
+	}
+	if p.Avatar == nil {
+		p.Avatar = lose.Avatar
 	}
-	u, err := db.GetUser(id)
+	if p.Preferences == nil {
+		p.Preferences = lose.Preferences
+	}
+	if err := s.db.MergeUsers(ctx, t.UserID, src.UserID, p); err != nil {
+		return users.User{}, err
+	}
+	s.audit.Log(
+		"event", "users_merged",
+		"target", t.UserID,
+		"source", src.UserID,
+		"prefer", prefer,
+	)
+	s.changes.Publish(changes.UserDeleted, src.UserID, src.UserID)
+	s.changes.Publish(changes.UserUpdated, t.UserID, t.UserID)
+	u, err := s.db.GetUser(ctx, t.UserID)
 	u.AddLinks()
-	return []users.User{u}, err
+	return u, err
 }
 
-func (s *fixedService) PostUser(u users.User) (string, error) {
-	u.NewSalt()
-	u.Password = calculatePassHash(u.Password, u.Salt)
-	err := db.CreateUser(&u)
-	return u.UserID, err
+// Rename changes the username. The old one stays reserved for the user
+// during the grace period.
+func (s *fixedService) Rename(ctx context.Context, id, username string) (users.User, error) {
+	if username == "" {
+		return users.User{}, invalid(fmt.Errorf(users.ErrMissingField, "Username"))
+	}
+	u, err := s.db.GetUser(ctx, id)
+	if err != nil {
+		return users.User{}, err
+	}
+	if u.Username == username {
+		u.AddLinks()
+		return u, nil
+	}
+	if held, err := s.db.GetUserByPreviousName(ctx, username, time.Now().Add(-s.renameGrace)); err == nil && held.UserID != id {
+		return users.User{}, &db.ConflictError{Field: "username"}
+	}
+	if err := s.db.RenameUser(ctx, id, username); err != nil {
+		return users.User{}, err
+	}
+	s.audit.Log(
+		"event", "username_changed",
+		"user", id,
+		"from", u.Username,
+		"to", username,
+	)
+	s.record(ctx, id, users.ActivityUsernameChanged, map[string]string{"from": u.Username, "to": username})
+	s.changes.Publish(changes.UserUpdated, id, id)
+	u, err = s.db.GetUser(ctx, id)
+	u.AddLinks()
+	return u, err
 }
 
-func (s *fixedService) GetAddresses(id string) ([]users.Address, error) {
+func (s *fixedService) Available(ctx context.Context, username, email string) (Availability, error) {
+	var a Availability
+	var err error
+	if username == "" && email == "" {
+		return a, invalid(errors.New("expected username or email"))
+	}
+	if username != "" {
+		if a.Username, err = s.available(ctx, "username", username); err != nil {
+			return Availability{}, err
+		}
+		if _, err := s.db.GetUserByPreviousName(ctx, username, time.Now().Add(-s.renameGrace)); err == nil {
+			*a.Username = false
+		}
+	}
+	if email != "" {
+		if a.Email, err = s.available(ctx, "email", email); err != nil {
+			return Availability{}, err
+		}
+	}
+	return a, nil
+}
+
+func (s *fixedService) available(ctx context.Context, field, value string) (*bool, error) {
+	exists, err := s.db.UserExists(ctx, field, value)
+	free := !exists
+	return &free, err
+}
+
+func (s *fixedService) GetUsers(ctx context.Context, id string) ([]users.User, error) {
 	if id == "" {
-		as, err := db.GetAddresses()
-		for k, a := range as {
-			a.AddLinks()
-			as[k] = a
+		return s.FindUsers(ctx, db.UserQuery{})
+	}
+	u, err := s.db.GetUser(ctx, id)
+	u.AddLinks()
+	return []users.User{u}, err
+}
+
+// GetUserAttributes loads the addresses and cards of u.
+func (s *fixedService) GetUserAttributes(ctx context.Context, u *users.User) error {
+	return s.db.GetUserAttributes(ctx, u)
+}
+
+// ExpandUsers loads the attributes named by expand of the users, batching
+// the lookups of all of them. Cards are masked.
+func (s *fixedService) ExpandUsers(ctx context.Context, us []users.User, expand []string) error {
+	if err := s.db.ExpandUsers(ctx, us, expand); err != nil {
+		return err
+	}
+	for k := range us {
+		us[k].MaskCCs()
+	}
+	return nil
+}
+
+// MaxBatchGet is the most users a single batch get may fetch.
+const MaxBatchGet = 100
+
+// BatchGetUsers returns the users with the given ids, in the order asked
+// for, and the ids that weren't found.
+func (s *fixedService) BatchGetUsers(ctx context.Context, ids []string) ([]users.User, []string, error) {
+	if len(ids) == 0 || len(ids) > MaxBatchGet {
+		return nil, nil, invalid(fmt.Errorf("expected 1 to %v ids", MaxBatchGet))
+	}
+	us, err := s.db.GetUsersByID(ctx, ids)
+	if err != nil {
+		return nil, nil, err
+	}
+	byID := make(map[string]users.User, len(us))
+	for _, u := range us {
+		byID[u.UserID] = u
+	}
+	found := make([]users.User, 0, len(us))
+	missing := make([]string, 0)
+	for _, id := range ids {
+		u, ok := byID[id]
+		if !ok {
+			missing = append(missing, id)
+			continue
 		}
-		return as, err
+		// Asked for twice, returned once.
+		delete(byID, id)
+		found = append(found, u)
 	}
-	a, err := db.GetAddress(id)
-	a.AddLinks()
-	return []users.Address{a}, err
+	return found, missing, nil
 }
 
-func (s *fixedService) PostAddress(add users.Address, userid string) (string, error) {
+func (s *fixedService) FindUsers(ctx context.Context, q db.UserQuery) ([]users.User, error) {
+	us, err := s.db.GetUsers(ctx, q)
+	if err == db.ErrInvalidSort || err == db.ErrEncryptedField {
+		return us, invalid(err)
+	}
+	for k, u := range us {
+		u.AddLinks()
+		us[k] = u
+	}
+	return us, err
+}
+
+const (
+	// DefaultPageSize is the admin listing page size when none is asked for.
+	DefaultPageSize = 100
+	// MaxPageSize is the largest admin listing page.
+	MaxPageSize = 1000
+)
 
-	err := db.CreateAddress(&add, userid)
-	return add.ID, err
+// ListUsers returns the page of users after cursor, and the cursor of the
+// next page, empty on the last one. Cursors are opaque to clients.
+func (s *fixedService) ListUsers(ctx context.Context, cursor string, limit int) ([]users.User, string, error) {
+	if limit == 0 {
+		limit = DefaultPageSize
+	}
+	if limit < 0 || limit > MaxPageSize {
+		return nil, "", invalid(fmt.Errorf("limit must be between 1 and %v", MaxPageSize))
+	}
+	after, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, "", invalid(errors.New("invalid cursor"))
+	}
+	us, err := s.db.ListUsers(ctx, string(after), limit)
+	if err != nil {
+		return nil, "", err
+	}
+	next := ""
+	if len(us) == limit {
+		next = base64.RawURLEncoding.EncodeToString([]byte(us[len(us)-1].UserID))
+	}
+	return us, next, nil
 }
 
-func (s *fixedService) GetCards(id string) ([]users.Card, error) {
-	if id == "" {
-		cs, err := db.GetCards()
-		for k, c := range cs {
-			c.AddLinks()
-			cs[k] = c
+// ListCards returns the page of cards after cursor, with their numbers
+// masked, and the cursor of the next page, empty on the last one.
+func (s *fixedService) ListCards(ctx context.Context, cursor string, limit int) ([]db.OwnedCard, string, error) {
+	if limit == 0 {
+		limit = DefaultPageSize
+	}
+	if limit < 0 || limit > MaxPageSize {
+		return nil, "", invalid(fmt.Errorf("limit must be between 1 and %v", MaxPageSize))
+	}
+	after, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, "", invalid(errors.New("invalid cursor"))
+	}
+	cs, err := s.db.ListCards(ctx, string(after), limit)
+	if err != nil {
+		return nil, "", err
+	}
+	next := ""
+	if len(cs) == limit {
+		next = base64.RawURLEncoding.EncodeToString([]byte(cs[len(cs)-1].ID))
+	}
+	return cs, next, nil
+}
+
+// MaxStatsDays is the longest signup history served.
+const MaxStatsDays = 365
+
+// Stats aggregates the totals, signups over the last days and active
+// sessions. Tokens are stateless, so a session counts as active when its
+// user logged in within the token lifetime.
+func (s *fixedService) Stats(ctx context.Context, days int) (db.Stats, error) {
+	if days < 1 || days > MaxStatsDays {
+		return db.Stats{}, invalid(fmt.Errorf("days must be between 1 and %v", MaxStatsDays))
+	}
+	now := time.Now()
+	today := now.UTC().Truncate(24 * time.Hour)
+	return s.db.GetStats(ctx, today.AddDate(0, 0, 1-days), now.Add(-s.signer.TTL()))
+}
+
+func (s *fixedService) PostUser(ctx context.Context, u users.User) (string, error) {
+	// Roles are never taken from the request body, nor is a verified phone.
+	u.Roles = nil
+	u.PhoneVerified, u.PhoneCode = false, nil
+	u.Phone = users.NormalizePhone(u.Phone)
+	if u.Phone != "" {
+		if err := users.ValidatePhone(u.Phone); err != nil {
+			return "", invalid(err)
 		}
-		return cs, err
 	}
-	c, err := db.GetCard(id)
-	c.AddLinks()
-	return []users.Card{c}, err
+	if err := users.ValidateAddresses(u.Addresses); err != nil {
+		return "", invalid(err)
+	}
+	u.Status = users.StatusActive
+	u.NewSalt()
+	u.Password = calculatePassHash(u.Password, u.Salt)
+	if err := s.db.CreateUser(ctx, &u); err != nil {
+		return "", err
+	}
+	s.changes.Publish(changes.UserCreated, u.UserID, u.UserID)
+	return u.UserID, nil
 }
 
-func (s *fixedService) PostCard(card users.Card, userid string) (string, error) {
-	err := db.CreateCard(&card, userid)
-	return card.ID, err
+func (s *fixedService) UpdateUser(ctx context.Context, id string, p users.ProfileUpdate) (users.User, error) {
+	if err := p.Validate(); err != nil {
+		return users.User{}, invalid(err)
+	}
+	if p.Metadata != nil {
+		u, err := s.db.GetUser(ctx, id)
+		if err != nil {
+			return users.User{}, err
+		}
+		if _, err := users.MergeMetadata(u.Metadata, p.Metadata); err != nil {
+			return users.User{}, invalid(err)
+		}
+	}
+	if err := s.db.UpdateUser(ctx, id, p); err != nil {
+		return users.User{}, err
+	}
+	s.record(ctx, id, users.ActivityProfileUpdated, map[string]string{"fields": strings.Join(p.Fields(), ",")})
+	if p.Status != nil && *p.Status == users.StatusDeleted {
+		s.changes.Publish(changes.UserDeleted, id, id)
+	} else {
+		s.changes.Publish(changes.UserUpdated, id, id)
+	}
+	u, err := s.db.GetUser(ctx, id)
+	u.AddLinks()
+	return u, err
 }
 
-func (s *fixedService) Delete(entity, id string) error {
-	return db.Delete(entity, id)
+// profileDocument is the profile of a user as patched by PatchUser, the
+// fields PATCH /customers/{id} may change.
+type profileDocument struct {
+	FirstName string            `json:"firstName"`
+	LastName  string            `json:"lastName"`
+	Email     string            `json:"email"`
+	Locale    string            `json:"locale"`
+	Timezone  string            `json:"timezone"`
+	Metadata  map[string]string `json:"metadata"`
 }
 
-func (s *fixedService) Health() []Health {
-	var health []Health
-	dbstatus := "OK"
+// PatchUser applies p to the profile of the user and updates the fields it
+// changed like UpdateUser does. Removed fields are cleared.
+func (s *fixedService) PatchUser(ctx context.Context, id string, p patch.Patch) (users.User, error) {
+	u, err := s.db.GetUser(ctx, id)
+	if err != nil {
+		return users.User{}, err
+	}
+	before := profileDocument{u.FirstName, u.LastName, u.Email, u.Locale, u.Timezone, u.Metadata}
+	if before.Metadata == nil {
+		before.Metadata = map[string]string{}
+	}
+	var after profileDocument
+	if err := applyPatch(p, before, &after); err != nil {
+		return users.User{}, err
+	}
+	var update users.ProfileUpdate
+	for _, f := range []struct {
+		before, after string
+		update        **string
+	}{
+		{before.FirstName, after.FirstName, &update.FirstName},
+		{before.LastName, after.LastName, &update.LastName},
+		{before.Email, after.Email, &update.Email},
+		{before.Locale, after.Locale, &update.Locale},
+		{before.Timezone, after.Timezone, &update.Timezone},
+	} {
+		if f.before != f.after {
+			v := f.after
+			*f.update = &v
+		}
+	}
+	for k, v := range after.Metadata {
+		if old, ok := before.Metadata[k]; !ok || old != v {
+			if update.Metadata == nil {
+				update.Metadata = map[string]*string{}
+			}
+			v := v
+			update.Metadata[k] = &v
+		}
+	}
+	for k := range before.Metadata {
+		if _, ok := after.Metadata[k]; !ok {
+			if update.Metadata == nil {
+				update.Metadata = map[string]*string{}
+			}
+			update.Metadata[k] = nil
+		}
+	}
+	if len(update.Fields()) == 0 {
+		u.AddLinks()
+		return u, nil
+	}
+	return s.UpdateUser(ctx, id, update)
+}
 
-	err := db.Ping()
+// applyPatch applies p to the JSON document of v and decodes the result
+// into patched, rejecting members v doesn't have. Failed patch tests are
+// returned as they are, other patch errors make the request invalid.
+func applyPatch(p patch.Patch, v, patched interface{}) error {
+	doc, err := json.Marshal(v)
 	if err != nil {
-		dbstatus = "err"
+		return err
+	}
+	if doc, err = p.Apply(doc); err != nil {
+		if errors.Is(err, patch.ErrTestFailed) {
+			return err
+		}
+		return invalid(err)
 	}
+	return decodeBody(bytes.NewReader(doc), patched, true)
+}
+
+const (
+	// PhoneCodeTTL is how long a texted verification code can be used.
+	PhoneCodeTTL = 10 * time.Minute
+	// MaxPhoneCodeAttempts is how often a code can be tried.
+	MaxPhoneCodeAttempts = 5
+)
 
-	app := Health{"user", "OK", time.Now().String()}
-	db := Health{"user-db", dbstatus, time.Now().String()}
+// SendPhoneCode texts a new verification code to the phone of the user.
+func (s *fixedService) SendPhoneCode(ctx context.Context, id string) error {
+	if s.sms == nil {
+		return invalid(ErrNoPhoneVerification)
+	}
+	u, err := s.db.GetUser(ctx, id)
+	if err != nil {
+		return err
+	}
+	if u.Phone == "" {
+		return invalid(&users.FieldError{Field: "phone", Reason: "no phone number to verify"})
+	}
+	code, err := newPhoneCode()
+	if err != nil {
+		return err
+	}
+	pc := &users.PhoneCode{Hash: hashPhoneCode(code, u.Salt), Expires: time.Now().Add(PhoneCodeTTL)}
+	if err := s.db.UpdateUser(ctx, id, users.ProfileUpdate{PhoneCode: pc}); err != nil {
+		return err
+	}
+	return s.sms.Send(u.Phone, fmt.Sprintf("Your verification code is %v", code))
+}
 
-	health = append(health, app)
-	health = append(health, db)
+// VerifyPhone marks the phone of the user verified when code is the one
+// last texted to it.
+func (s *fixedService) VerifyPhone(ctx context.Context, id, code string) (users.User, error) {
+	u, err := s.db.GetUser(ctx, id)
+	if err != nil {
+		return users.User{}, err
+	}
+	pc := u.PhoneCode
+	if pc.Expired(time.Now(), MaxPhoneCodeAttempts) {
+		return users.User{}, invalid(&users.FieldError{Field: "code", Reason: "expired, request a new one"})
+	}
+	if !hmac.Equal([]byte(hashPhoneCode(code, u.Salt)), []byte(pc.Hash)) {
+		tried := *pc
+		tried.Attempts++
+		if err := s.db.UpdateUser(ctx, id, users.ProfileUpdate{PhoneCode: &tried}); err != nil {
+			return users.User{}, err
+		}
+		return users.User{}, invalid(&users.FieldError{Field: "code", Reason: "does not match"})
+	}
+	verified := true
+	if err := s.db.UpdateUser(ctx, id, users.ProfileUpdate{PhoneVerified: &verified}); err != nil {
+		return users.User{}, err
+	}
+	s.record(ctx, id, users.ActivityPhoneVerified, nil)
+	s.changes.Publish(changes.UserUpdated, id, id)
+	u, err = s.db.GetUser(ctx, id)
+	u.AddLinks()
+	return u, err
+}
 
-	return health
+// newPhoneCode returns a random six digit code.
+func newPhoneCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%06d", n), nil
+}
+
+func hashPhoneCode(code, salt string) string {
+	h := sha256.Sum256([]byte(salt + code))
+	return hex.EncodeToString(h[:])
+}
+
+// SetAvatar renders img in every avatar size, stores the renditions and
+// points the user at them. Keys are versioned so caches pick up changes.
+func (s *fixedService) SetAvatar(ctx context.Context, id string, img io.Reader) (users.User, error) {
+	if _, err := s.db.GetUser(ctx, id); err != nil {
+		return users.User{}, err
+	}
+	rendered, err := avatar.Render(img)
+	if err != nil {
+		return users.User{}, invalid(err)
+	}
+	version := strconv.FormatInt(time.Now().UnixNano(), 36)
+	urls := make(map[string]string, len(rendered))
+	for name, data := range rendered {
+		u, err := s.blobs.Put(fmt.Sprintf("avatars/%v/%v-%v.jpg", id, version, name), "image/jpeg", data)
+		if err != nil {
+			return users.User{}, err
+		}
+		urls[name] = u
+	}
+	return s.UpdateUser(ctx, id, users.ProfileUpdate{Avatar: urls})
+}
+
+func (s *fixedService) SetPreferences(ctx context.Context, id string, p users.Preferences) (users.Preferences, error) {
+	if err := p.Validate(); err != nil {
+		return users.Preferences{}, invalid(err)
+	}
+	u, err := s.UpdateUser(ctx, id, users.ProfileUpdate{Preferences: &p})
+	if err != nil {
+		return users.Preferences{}, err
+	}
+	return u.GetPreferences(), nil
+}
+
+func (s *fixedService) GetAddresses(ctx context.Context, id string) ([]users.Address, error) {
+	if id == "" {
+		as, err := s.db.GetAddresses(ctx)
+		for k, a := range as {
+			a.AddLinks()
+			as[k] = a
+		}
+		return as, err
+	}
+	a, err := s.db.GetAddress(ctx, id)
+	a.AddLinks()
+	return []users.Address{a}, err
+}
+
+// GetAddressesByID returns the addresses with the given ids in one query,
+// unknown ids are left out.
+func (s *fixedService) GetAddressesByID(ctx context.Context, ids []string) ([]users.Address, error) {
+	if len(ids) == 0 {
+		return []users.Address{}, nil
+	}
+	return s.db.GetAddressesByID(ctx, ids)
+}
+
+func (s *fixedService) PostAddress(ctx context.Context, add users.Address, userid string) (string, error) {
+	if err := add.Validate(); err != nil {
+		return "", invalid(err)
+	}
+	if err := s.checkQuota(ctx, userid, "addresses", s.maxAddresses); err != nil {
+		return "", err
+	}
+	add, err := s.validateAddress(add)
+	if err != nil {
+		return "", err
+	}
+	add.Location, add.Geocode = nil, ""
+	if s.geocoding != nil {
+		add.Geocode = users.GeocodePending
+	}
+	err = s.db.CreateAddress(ctx, &add, userid)
+	if err != nil {
+		return add.ID, err
+	}
+	s.record(ctx, userid, users.ActivityAddressAdded, map[string]string{"addressId": add.ID})
+	s.changes.Publish(changes.AddressCreated, add.ID, userid)
+	if s.geocoding != nil && !s.geocoding.Enqueue(add, s.db.SetAddressLocation) {
+		s.db.SetAddressLocation(ctx, add.ID, nil, users.GeocodeFailed)
+	}
+	return add.ID, nil
+}
+
+// PatchAddress applies p to the address, which then has to validate like a
+// new address. The id and creation time are kept, the location geocoded
+// again.
+func (s *fixedService) PatchAddress(ctx context.Context, id string, p patch.Patch) (users.Address, error) {
+	a, err := s.db.GetAddress(ctx, id)
+	if err != nil {
+		return users.Address{}, err
+	}
+	var patched users.Address
+	if err := applyPatch(p, a, &patched); err != nil {
+		return users.Address{}, err
+	}
+	if err := validateRequest(patched); err != nil {
+		return users.Address{}, invalid(err)
+	}
+	if err := patched.Validate(); err != nil {
+		return users.Address{}, invalid(err)
+	}
+	if patched, err = s.validateAddress(patched); err != nil {
+		return users.Address{}, err
+	}
+	patched.ID, patched.CreatedAt, patched.Links = id, a.CreatedAt, nil
+	patched.Location, patched.Geocode = nil, ""
+	if s.geocoding != nil {
+		patched.Geocode = users.GeocodePending
+	}
+	if err := s.db.UpdateAddress(ctx, id, &patched); err != nil {
+		return users.Address{}, err
+	}
+	owner, _ := s.db.OwnerOf(ctx, "addresses", id)
+	s.record(ctx, owner, users.ActivityAddressUpdated, map[string]string{"addressId": id})
+	s.changes.Publish(changes.AddressUpdated, id, owner)
+	if s.geocoding != nil && !s.geocoding.Enqueue(patched, s.db.SetAddressLocation) {
+		s.db.SetAddressLocation(ctx, id, nil, users.GeocodeFailed)
+	}
+	patched.AddLinks()
+	return patched, nil
+}
+
+// MaxAddressImport is the most addresses a single import may carry.
+const MaxAddressImport = 100
+
+// AddressImportResult is the outcome of importing one address: the id it was
+// created with, or why it was rejected.
+type AddressImportResult struct {
+	Index  int    `json:"index"`
+	ID     string `json:"id,omitempty"`
+	Status bool   `json:"status"`
+	Field  string `json:"field,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// ImportAddresses adds the addresses migrated from another system to the
+// user in one batch. Each is validated like a new address, the invalid ones
+// are skipped and reported in their result.
+func (s *fixedService) ImportAddresses(ctx context.Context, userid string, as []users.Address) ([]AddressImportResult, error) {
+	if len(as) == 0 || len(as) > MaxAddressImport {
+		return nil, invalid(fmt.Errorf("expected 1 to %v addresses", MaxAddressImport))
+	}
+	u, err := s.db.GetUser(ctx, userid)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]AddressImportResult, len(as))
+	valid := make([]users.Address, 0, len(as))
+	index := make([]int, 0, len(as))
+	defaults := map[string]bool{}
+	for i, a := range as {
+		res[i].Index = i
+		err := a.Validate()
+		if err == nil && a.Default && defaults[a.Type] {
+			err = &users.FieldError{Field: "default", Reason: "more than one default " + a.Type + " address"}
+		}
+		if err == nil {
+			a, err = s.validateAddress(a)
+		}
+		if err != nil {
+			res[i].Field, res[i].Error = importError(err)
+			continue
+		}
+		defaults[a.Type] = defaults[a.Type] || a.Default
+		a.Location, a.Geocode = nil, ""
+		if s.geocoding != nil {
+			a.Geocode = users.GeocodePending
+		}
+		valid = append(valid, a)
+		index = append(index, i)
+	}
+	if s.maxAddresses > 0 && len(u.Addresses)+len(valid) > s.maxAddresses {
+		return nil, &QuotaError{Resource: "addresses", Limit: s.maxAddresses}
+	}
+	if len(valid) == 0 {
+		return res, nil
+	}
+	if err := s.db.CreateAddresses(ctx, valid, userid); err != nil {
+		return nil, err
+	}
+	for k, a := range valid {
+		res[index[k]].ID, res[index[k]].Status = a.ID, true
+		s.record(ctx, userid, users.ActivityAddressAdded, map[string]string{"addressId": a.ID})
+		s.changes.Publish(changes.AddressCreated, a.ID, userid)
+		if s.geocoding != nil && !s.geocoding.Enqueue(a, s.db.SetAddressLocation) {
+			s.db.SetAddressLocation(ctx, a.ID, nil, users.GeocodeFailed)
+		}
+	}
+	return res, nil
+}
+
+// importError returns the field an address was rejected for, if known, and
+// why.
+func importError(err error) (string, string) {
+	var fe *users.FieldError
+	if errors.As(err, &fe) {
+		return fe.Field, fe.Reason
+	}
+	var ie *address.InvalidError
+	if errors.As(err, &ie) {
+		return ie.Field, ie.Reason
+	}
+	return "", strings.TrimPrefix(err.Error(), ErrInvalidRequest.Error()+": ")
+}
+
+// MaxBatchOperations is the most operations a single batch may carry.
+const MaxBatchOperations = 20
+
+// Statuses of the operations of a batch.
+const (
+	BatchCreated    = "created"
+	BatchFailed     = "failed"
+	BatchRolledBack = "rolled_back"
+	BatchSkipped    = "skipped"
+)
+
+// BatchOperation creates a customer, or an address or card of the customer
+// UserID. A UserID of "$" and a Ref names a customer created earlier in the
+// same batch.
+type BatchOperation struct {
+	Ref      string
+	Customer *users.User
+	Address  *users.Address
+	Card     *users.Card
+	UserID   string
+}
+
+// BatchResult is the outcome of one operation of a batch: the id it created
+// with, or why it failed, was undone or never ran.
+type BatchResult struct {
+	Index  int    `json:"index"`
+	Ref    string `json:"ref,omitempty"`
+	ID     string `json:"id,omitempty"`
+	Status string `json:"status"`
+	Field  string `json:"field,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Batch runs the operations in order, all of them or none: once one fails,
+// the ones before it are undone newest first and the rest skipped. The
+// database has no transactions, so undoing deletes what was created, and
+// subscribers to changes see it created and deleted again.
+func (s *fixedService) Batch(ctx context.Context, ops []BatchOperation) ([]BatchResult, error) {
+	if len(ops) == 0 || len(ops) > MaxBatchOperations {
+		return nil, invalid(fmt.Errorf("expected 1 to %v operations", MaxBatchOperations))
+	}
+	refs := map[string]bool{}
+	for i, op := range ops {
+		if err := checkBatchOperation(op, refs); err != nil {
+			return nil, invalid(fmt.Errorf("operation %v: %w", i, err))
+		}
+		if op.Customer != nil && op.Ref != "" {
+			refs[op.Ref] = true
+		}
+	}
+	res := make([]BatchResult, len(ops))
+	for i, op := range ops {
+		res[i] = BatchResult{Index: i, Ref: op.Ref, Status: BatchSkipped}
+	}
+	created := map[string]string{}
+	owners := make([]string, len(ops))
+	for i, op := range ops {
+		owners[i] = op.UserID
+		if ref, ok := strings.CutPrefix(op.UserID, "$"); ok {
+			owners[i] = created[ref]
+		}
+		var id string
+		var err error
+		switch {
+		case op.Customer != nil:
+			id, err = s.PostUser(ctx, *op.Customer)
+			owners[i] = id
+		case op.Address != nil:
+			id, err = s.PostAddress(ctx, *op.Address, owners[i])
+		default:
+			id, err = s.PostCard(ctx, *op.Card, owners[i])
+		}
+		if err != nil {
+			res[i].Status = BatchFailed
+			res[i].Field, res[i].Error = importError(err)
+			s.undoBatch(ctx, ops[:i], owners, res)
+			return res, nil
+		}
+		res[i].ID, res[i].Status = id, BatchCreated
+		if op.Customer != nil && op.Ref != "" {
+			created[op.Ref] = id
+		}
+	}
+	return res, nil
+}
+
+// checkBatchOperation checks op before any operation of the batch runs,
+// refs holding the customers created before it.
+func checkBatchOperation(op BatchOperation, refs map[string]bool) error {
+	n := 0
+	for _, set := range []bool{op.Customer != nil, op.Address != nil, op.Card != nil} {
+		if set {
+			n++
+		}
+	}
+	if n != 1 {
+		return errors.New("expected one of a customer, address or card")
+	}
+	if op.Customer != nil {
+		if op.Ref != "" && refs[op.Ref] {
+			return &users.FieldError{Field: "ref", Reason: "used by another customer"}
+		}
+		return nil
+	}
+	// Replacing deletes the old card, which undoing couldn't bring back.
+	if op.Card != nil && op.Card.Replaces != "" {
+		return &users.FieldError{Field: "replaces", Reason: "not supported in a batch"}
+	}
+	if op.UserID == "" {
+		return &users.FieldError{Field: "userID", Reason: "required"}
+	}
+	if ref, ok := strings.CutPrefix(op.UserID, "$"); ok && !refs[ref] {
+		return &users.FieldError{Field: "userID", Reason: "no customer " + ref + " earlier in the batch"}
+	}
+	return nil
+}
+
+// undoBatch deletes what the operations created, newest first. Deletions
+// failing are audited and leave their result created.
+func (s *fixedService) undoBatch(ctx context.Context, ops []BatchOperation, owners []string, res []BatchResult) {
+	for i := len(ops) - 1; i >= 0; i-- {
+		entity, t := "customers", changes.UserDeleted
+		activity, key := "", ""
+		switch {
+		case ops[i].Address != nil:
+			entity, t = "addresses", changes.AddressDeleted
+			activity, key = users.ActivityAddressRemoved, "addressId"
+		case ops[i].Card != nil:
+			entity, t = "cards", changes.CardDeleted
+			activity, key = users.ActivityCardRemoved, "cardId"
+		}
+		id := res[i].ID
+		if err := s.db.Delete(ctx, entity, id); err != nil {
+			s.audit.Log("event", "batch_undo", "entity", entity, "id", id, "err", err)
+			res[i].Error = "not undone: " + err.Error()
+			continue
+		}
+		res[i].Status = BatchRolledBack
+		if activity != "" {
+			s.record(ctx, owners[i], activity, map[string]string{key: id})
+		}
+		s.changes.Publish(t, id, owners[i])
+	}
+}
+
+// checkQuota fails with a *QuotaError when the user already has limit
+// addresses or cards. Anonymous resources have no limit.
+func (s *fixedService) checkQuota(ctx context.Context, userid, resource string, limit int) error {
+	if userid == "" || limit <= 0 {
+		return nil
+	}
+	u, err := s.db.GetUser(ctx, userid)
+	if err != nil {
+		return err
+	}
+	n := len(u.Addresses)
+	if resource == "cards" {
+		n = len(u.Cards)
+	}
+	if n >= limit {
+		return &QuotaError{Resource: resource, Limit: limit}
+	}
+	return nil
+}
+
+// validateAddress normalizes add with the address validator. Addresses it
+// rejects are invalid, when the validator itself fails the address is only
+// checked by the basic validator and stored unvalidated.
+func (s *fixedService) validateAddress(add users.Address) (users.Address, error) {
+	v, err := s.addresses.Validate(add)
+	if _, ok := err.(*address.InvalidError); ok {
+		return add, invalid(err)
+	}
+	if err != nil {
+		s.audit.Log("event", "address_validation", "err", err)
+		v, err = address.Basic(add)
+		if err != nil {
+			return add, invalid(err)
+		}
+	}
+	return v, nil
+}
+
+func (s *fixedService) GetCards(ctx context.Context, id string) ([]users.Card, error) {
+	if id == "" {
+		cs, err := s.db.GetCards(ctx)
+		for k, c := range cs {
+			c.AddLinks()
+			cs[k] = c
+		}
+		return cs, err
+	}
+	c, err := s.db.GetCard(ctx, id)
+	c.AddLinks()
+	return []users.Card{c}, err
+}
+
+// GetCardsByID returns the cards with the given ids in one query, unknown
+// ids and deleted cards are left out.
+func (s *fixedService) GetCardsByID(ctx context.Context, ids []string) ([]users.Card, error) {
+	if len(ids) == 0 {
+		return []users.Card{}, nil
+	}
+	return s.db.GetCardsByID(ctx, ids)
+}
+
+// ownsCard reports whether the card id belongs to the customer userid.
+func (s *fixedService) ownsCard(ctx context.Context, userid, id string) bool {
+	if userid == "" {
+		return false
+	}
+	owner, err := s.db.OwnerOf(ctx, "cards", id)
+	return err == nil && owner == userid
+}
+
+func (s *fixedService) PostCard(ctx context.Context, card users.Card, userid string) (string, error) {
+	card.LongNum = users.NormalizePAN(card.LongNum)
+	if err := card.Validate(); err != nil {
+		return "", invalid(err)
+	}
+	// A replacement takes the place of the old card, so it does not count
+	// towards the quota.
+	if card.Replaces != "" {
+		if !s.ownsCard(ctx, userid, card.Replaces) {
+			return "", invalid(&users.FieldError{Field: "replaces", Reason: "not a card of the customer"})
+		}
+	} else if err := s.checkQuota(ctx, userid, "cards", s.maxCards); err != nil {
+		return "", err
+	}
+	card.Brand = users.CardBrand(card.LongNum)
+	card.Token, card.Vault = "", ""
+	card.ReplacedBy, card.DeletedAt = "", nil
+	card.Verification = ""
+	if s.verifier != nil {
+		card.Verification = users.VerificationPending
+	}
+	// The verifier gets the card as posted, number and CVV included.
+	posted := card
+	if s.vault != nil {
+		token, err := s.vault.Tokenize(card, userid)
+		if errors.Is(err, cardvault.ErrDeclined) {
+			return "", invalid(&users.FieldError{Field: "longNum", Reason: err.Error()})
+		}
+		if err != nil {
+			return "", err
+		}
+		card.Token, card.Vault = token, s.vault.Name()
+		posted.Token, posted.Vault = card.Token, card.Vault
+		card.MaskCC()
+	}
+	card.StripCVV()
+	err := s.db.CreateCard(ctx, &card, userid)
+	if err != nil {
+		return "", err
+	}
+	s.record(ctx, userid, users.ActivityCardAdded, map[string]string{"cardId": card.ID})
+	s.changes.Publish(changes.CardCreated, card.ID, userid)
+	if card.Replaces != "" {
+		if err := s.db.DeleteCard(ctx, card.Replaces, card.ID); err != nil {
+			return card.ID, err
+		}
+		s.record(ctx, userid, users.ActivityCardRemoved, map[string]string{"cardId": card.Replaces, "replacedBy": card.ID})
+		s.changes.Publish(changes.CardDeleted, card.Replaces, userid)
+	}
+	if s.verifier != nil {
+		if s.verifyAsync {
+			// The request context is cancelled once the response is
+			// sent, the outcome is stored after that.
+			go s.verifyCard(context.WithoutCancel(ctx), posted, card.ID, userid)
+		} else {
+			s.verifyCard(ctx, posted, card.ID, userid)
+		}
+	}
+	return card.ID, nil
+}
+
+// verifyCard runs the zero amount authorisation of the new card id and
+// stores the outcome. Failures are emitted as security events.
+func (s *fixedService) verifyCard(ctx context.Context, c users.Card, id, userid string) {
+	status := users.VerificationDone
+	if err := s.verifier.Verify(c, userid); err != nil {
+		status = users.VerificationFailed
+		c.MaskCC()
+		e := security.NewEvent(security.CardVerificationFailed)
+		e.UserID = userid
+		e.Reason = err.Error()
+		e.Details = map[string]string{"cardId": id, "brand": c.Brand, "last4": strings.TrimLeft(c.LongNum, "*")}
+		s.events.Emit(e)
+	}
+	if err := s.db.SetCardVerification(ctx, id, status); err != nil {
+		s.audit.Log("event", "card_verification", "card", id, "err", err)
+	}
+}
+
+// UpdateCard changes the expiry or holder of a card and returns it masked.
+func (s *fixedService) UpdateCard(ctx context.Context, id string, u users.CardUpdate) (users.Card, error) {
+	if err := u.Validate(); err != nil {
+		return users.Card{}, invalid(err)
+	}
+	if err := s.db.UpdateCard(ctx, id, u); err != nil {
+		return users.Card{}, err
+	}
+	fields := strings.Join(u.Fields(), ",")
+	owner, _ := s.db.OwnerOf(ctx, "cards", id)
+	s.audit.Log("event", "card_updated", "card", id, "user", owner, "fields", fields)
+	s.record(ctx, owner, users.ActivityCardUpdated, map[string]string{"cardId": id, "fields": fields})
+	s.changes.Publish(changes.CardUpdated, id, owner)
+	c, err := s.db.GetCard(ctx, id)
+	if err != nil {
+		return users.Card{}, err
+	}
+	c.AddLinks()
+	c.MaskCC()
+	return c, nil
+}
+
+// SetDefaultCard makes the card the default of its owner, the card payments
+// pick unless told otherwise. It is returned masked.
+func (s *fixedService) SetDefaultCard(ctx context.Context, id string) (users.Card, error) {
+	owner, err := s.db.OwnerOf(ctx, "cards", id)
+	if err != nil {
+		return users.Card{}, err
+	}
+	if err := s.db.SetDefaultCard(ctx, owner, id); err != nil {
+		return users.Card{}, err
+	}
+	s.changes.Publish(changes.CardUpdated, id, owner)
+	c, err := s.db.GetCard(ctx, id)
+	if err != nil {
+		return users.Card{}, err
+	}
+	c.AddLinks()
+	c.MaskCC()
+	c.Default = true
+	return c, nil
+}
+
+// Delete removes addresses and cards. Customers are moved to the deleted
+// state instead, bulk deletion purges them.
+func (s *fixedService) Delete(ctx context.Context, entity, id string) error {
+	if entity == "customers" {
+		_, err := s.SetStatus(ctx, id, users.StatusDeleted)
+		return err
+	}
+	owner, _ := s.db.OwnerOf(ctx, entity, id)
+	del := s.db.Delete
+	if entity == "cards" {
+		// Cards are kept as masked tombstones for the orders referencing them.
+		del = func(ctx context.Context, _, id string) error { return s.db.DeleteCard(ctx, id, "") }
+	}
+	if err := del(ctx, entity, id); err != nil {
+		return err
+	}
+	switch entity {
+	case "addresses":
+		s.record(ctx, owner, users.ActivityAddressRemoved, map[string]string{"addressId": id})
+		s.changes.Publish(changes.AddressDeleted, id, owner)
+	case "cards":
+		s.record(ctx, owner, users.ActivityCardRemoved, map[string]string{"cardId": id})
+		s.changes.Publish(changes.CardDeleted, id, owner)
+	}
+	return nil
+}
+
+// record adds to the activity feed of the user. The feed is best effort,
+// failing to record doesn't fail the change itself.
+func (s *fixedService) record(ctx context.Context, userID, t string, details map[string]string) {
+	if userID == "" {
+		return
+	}
+	s.db.AddActivity(ctx, &users.Activity{UserID: userID, Type: t, Details: details})
+}
+
+// Activity pages through the activity feed of the user, newest first. The
+// cursor is the next value of the previous page.
+func (s *fixedService) Activity(ctx context.Context, id, cursor string, limit int) ([]users.Activity, string, error) {
+	if limit == 0 {
+		limit = DefaultPageSize
+	}
+	if limit < 0 || limit > MaxPageSize {
+		return nil, "", invalid(fmt.Errorf("limit must be between 1 and %v", MaxPageSize))
+	}
+	before, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, "", invalid(errors.New("invalid cursor"))
+	}
+	u, err := s.db.GetUser(ctx, id)
+	if err != nil {
+		return nil, "", err
+	}
+	as, err := s.db.GetActivity(ctx, u.UserID, string(before), limit)
+	if err != nil {
+		return nil, "", err
+	}
+	next := ""
+	if len(as) == limit {
+		next = base64.RawURLEncoding.EncodeToString([]byte(as[len(as)-1].ID))
+	}
+	return as, next, nil
+}
+
+// CreateWebhook subscribes the webhook to the events it lists, every one
+// of them for "*". Its secret is never returned again.
+func (s *fixedService) CreateWebhook(ctx context.Context, w users.Webhook) (users.Webhook, error) {
+	if err := w.Validate(); err != nil {
+		return users.Webhook{}, invalid(err)
+	}
+	for _, e := range w.Events {
+		if e != "*" && !knownEventType(e) {
+			return users.Webhook{}, invalid(&users.FieldError{Field: "events", Reason: "unknown event type " + e})
+		}
+	}
+	if err := s.db.CreateWebhook(ctx, &w); err != nil {
+		return users.Webhook{}, err
+	}
+	s.audit.Log(
+		"event", "webhook_created",
+		"webhook", w.ID,
+		"url", w.URL,
+	)
+	w.Secret = ""
+	return w, nil
+}
+
+func knownEventType(t string) bool {
+	for _, k := range changes.Types {
+		if string(k) == t {
+			return true
+		}
+	}
+	return false
+}
+
+// GetWebhooks returns every webhook, without their secrets.
+func (s *fixedService) GetWebhooks(ctx context.Context) ([]users.Webhook, error) {
+	ws, err := s.db.GetWebhooks(ctx)
+	for k := range ws {
+		ws[k].Secret = ""
+	}
+	return ws, err
+}
+
+func (s *fixedService) DeleteWebhook(ctx context.Context, id string) error {
+	if err := s.db.DeleteWebhook(ctx, id); err != nil {
+		return err
+	}
+	s.audit.Log(
+		"event", "webhook_deleted",
+		"webhook", id,
+	)
+	return nil
+}
+
+// WebhookDeliveries pages through the delivery log of the webhook, newest
+// first. The cursor is the next value of the previous page.
+func (s *fixedService) WebhookDeliveries(ctx context.Context, id, cursor string, limit int) ([]users.WebhookDelivery, string, error) {
+	if limit == 0 {
+		limit = DefaultPageSize
+	}
+	if limit < 0 || limit > MaxPageSize {
+		return nil, "", invalid(fmt.Errorf("limit must be between 1 and %v", MaxPageSize))
+	}
+	before, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, "", invalid(errors.New("invalid cursor"))
+	}
+	ds, err := s.db.GetWebhookDeliveries(ctx, id, string(before), limit)
+	if err != nil {
+		return nil, "", err
+	}
+	next := ""
+	if len(ds) == limit {
+		next = base64.RawURLEncoding.EncodeToString([]byte(ds[len(ds)-1].ID))
+	}
+	return ds, next, nil
+}
+
+func (s *fixedService) AddTag(ctx context.Context, id, tag string) (users.User, error) {
+	if err := users.ValidateTag(tag); err != nil {
+		return users.User{}, invalid(err)
+	}
+	if err := s.db.AddUserTag(ctx, id, tag); err != nil {
+		return users.User{}, err
+	}
+	s.changes.Publish(changes.UserUpdated, id, id)
+	u, err := s.db.GetUser(ctx, id)
+	u.AddLinks()
+	return u, err
+}
+
+func (s *fixedService) RemoveTag(ctx context.Context, id, tag string) (users.User, error) {
+	if err := s.db.RemoveUserTag(ctx, id, tag); err != nil {
+		return users.User{}, err
+	}
+	s.changes.Publish(changes.UserUpdated, id, id)
+	u, err := s.db.GetUser(ctx, id)
+	u.AddLinks()
+	return u, err
+}
+
+// SetStatus moves the user to status if the lifecycle allows it.
+func (s *fixedService) SetStatus(ctx context.Context, id, status string) (users.User, error) {
+	u, err := s.db.GetUser(ctx, id)
+	if err != nil {
+		return users.User{}, err
+	}
+	if err := u.CanTransition(status); err != nil {
+		if errors.Is(err, users.ErrInvalidStatus) {
+			return users.User{}, invalid(err)
+		}
+		return users.User{}, err
+	}
+	return s.UpdateUser(ctx, id, users.ProfileUpdate{Status: &status})
+}
+
+func (s *fixedService) CreateGroup(ctx context.Context, g users.Group) (users.Group, error) {
+	if err := g.Validate(); err != nil {
+		return users.Group{}, invalid(err)
+	}
+	for _, id := range append(g.Owners, g.Members...) {
+		if _, err := s.db.GetUser(ctx, id); err != nil {
+			return users.Group{}, invalid(fmt.Errorf("unknown user %v", id))
+		}
+	}
+	if err := s.db.CreateGroup(ctx, &g); err != nil {
+		return users.Group{}, err
+	}
+	g.AddLinks()
+	return g, nil
+}
+
+func (s *fixedService) GetGroup(ctx context.Context, id string) (users.Group, error) {
+	return s.db.GetGroup(ctx, id)
+}
+
+func (s *fixedService) GetUserGroups(ctx context.Context, userID string) ([]users.Group, error) {
+	return s.db.GetUserGroups(ctx, userID)
+}
+
+func (s *fixedService) AddGroupMember(ctx context.Context, groupID, userID string) (users.Group, error) {
+	if _, err := s.db.GetUser(ctx, userID); err != nil {
+		return users.Group{}, err
+	}
+	if err := s.db.AddGroupMember(ctx, groupID, userID); err != nil {
+		return users.Group{}, err
+	}
+	return s.db.GetGroup(ctx, groupID)
+}
+
+func (s *fixedService) RemoveGroupMember(ctx context.Context, groupID, userID string) (users.Group, error) {
+	if err := s.db.RemoveGroupMember(ctx, groupID, userID); err != nil {
+		return users.Group{}, err
+	}
+	return s.db.GetGroup(ctx, groupID)
+}
+
+// IssueToken signs a token for u. Without scopes the token grants full
+// customer access, plus admin access for admins. Otherwise every scope must
+// name a resource owned by u, or be the admin scope of an admin.
+func (s *fixedService) IssueToken(u users.User, scopes []string) (string, error) {
+	if len(scopes) == 0 {
+		scopes = []string{auth.ScopeCustomer}
+		if u.HasRole(users.RoleAdmin) {
+			scopes = append(scopes, auth.ScopeAdmin)
+		}
+	}
+	for _, sc := range scopes {
+		if sc == auth.ScopeAdmin && u.HasRole(users.RoleAdmin) {
+			continue
+		}
+		if sc != auth.ScopeCustomer && !ownsResource(u, sc) {
+			return "", ErrInvalidScope
+		}
+	}
+	tok, _, err := s.signer.IssueFor(s.tenant, u.UserID, u.Username, scopes)
+	return tok, err
+}
+
+func ownsResource(u users.User, scope string) bool {
+	entity, id, ok := auth.ParseResourceScope(scope)
+	if !ok {
+		return false
+	}
+	switch entity {
+	case "customers":
+		return id == u.UserID
+	case "addresses":
+		for _, a := range u.Addresses {
+			if a.ID == id {
+				return true
+			}
+		}
+	case "cards":
+		for _, c := range u.Cards {
+			if c.ID == id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// idempotencyLease is how long a request may hold its idempotency key
+// before retries take it over, in case it never finished.
+const idempotencyLease = time.Minute
+
+// ClaimIdempotencyKey claims key for the request with fingerprint. It
+// returns the id created by the earlier request with the key, or "" when the
+// caller goes ahead and settles the key afterwards.
+func (s *fixedService) ClaimIdempotencyKey(ctx context.Context, key, fingerprint string) (string, error) {
+	for attempt := 0; attempt < 2; attempt++ {
+		err := s.db.CreateIdempotencyKey(ctx, &db.IdempotencyKey{Key: key, Fingerprint: fingerprint})
+		if !errors.Is(err, db.ErrConflict) {
+			return "", err
+		}
+		k, err := s.db.GetIdempotencyKey(ctx, key)
+		if err != nil {
+			// Released by a failed request in the meantime.
+			continue
+		}
+		age := time.Since(k.CreatedAt)
+		switch {
+		case age > db.IdempotencyKeyTTL:
+		case k.Fingerprint != fingerprint:
+			return "", ErrIdempotencyKeyReused
+		case k.ResultID != "":
+			return k.ResultID, nil
+		case age < idempotencyLease:
+			return "", ErrIdempotencyKeyInUse
+		}
+		// Expired, or held by a request that never finished.
+		if err := s.db.DeleteIdempotencyKey(ctx, key); err != nil {
+			return "", err
+		}
+	}
+	return "", ErrIdempotencyKeyInUse
+}
+
+// SettleIdempotencyKey records the id created under a claimed key, an empty
+// resultID releases the key for retries of a failed request.
+func (s *fixedService) SettleIdempotencyKey(ctx context.Context, key, resultID string) error {
+	if resultID == "" {
+		return s.db.DeleteIdempotencyKey(ctx, key)
+	}
+	return s.db.SetIdempotencyResult(ctx, key, resultID)
+}
+
+// Introspect reports on token. A token carrying the id of another token is
+// reported as a replay and inactive, expired tokens as expired, badly signed
+// ones and those of other tenants as invalid.
+func (s *fixedService) Introspect(token string) auth.Introspection {
+	c, err := s.signer.Parse(token)
+	if err == nil && c.Tenant != s.tenant {
+		err = auth.ErrWrongTenant
+	}
+	if err == nil && !s.replays.Reused(token, c, time.Now()) {
+		return c.Introspection()
+	}
+	e := security.NewEvent(security.TokenInvalid)
+	switch err {
+	case nil:
+		e = security.NewEvent(security.TokenReplay)
+		err = auth.ErrReusedToken
+	case auth.ErrExpiredToken:
+		e = security.NewEvent(security.TokenExpired)
+	}
+	if e.Type != security.TokenInvalid {
+		e.UserID = c.Subject
+		e.Username = c.Username
+		e.Details = map[string]string{"jti": c.ID}
+	}
+	e.Reason = err.Error()
+	s.events.Emit(e)
+	return auth.Introspection{Active: false}
+}
+
+// AuthenticateClient reports whether the client may introspect tokens.
+func (s *fixedService) AuthenticateClient(id, secret string) bool {
+	return s.clients.Authenticate(id, secret)
+}
+
+// MaxBulkDelete is the most users a single bulk delete may remove.
+const MaxBulkDelete = 1000
+
+func (s *fixedService) DeleteUsers(ctx context.Context, ids []string) (map[string]error, error) {
+	if len(ids) == 0 || len(ids) > MaxBulkDelete {
+		return nil, invalid(fmt.Errorf("expected 1 to %v ids", MaxBulkDelete))
+	}
+	failed, ids, err := s.archiveUsers(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	errs := map[string]error{}
+	if len(ids) > 0 {
+		if errs, err = s.db.DeleteUsers(ctx, ids); err != nil {
+			return errs, err
+		}
+	}
+	for _, id := range ids {
+		if errs[id] == nil {
+			s.changes.Publish(changes.UserDeleted, id, id)
+		}
+	}
+	for id, err := range failed {
+		errs[id] = err
+	}
+	return errs, nil
+}
+
+// archiveUsers archives the users with ids, with their addresses and
+// cards, and returns the errors of those that failed to be archived and the
+// ids of the others, unknown ones included.
+func (s *fixedService) archiveUsers(ctx context.Context, ids []string) (map[string]error, []string, error) {
+	if s.archive == nil {
+		return nil, ids, nil
+	}
+	us, err := s.db.GetUsersByID(ctx, ids)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := s.db.ExpandUsers(ctx, us, db.Expandable); err != nil {
+		return nil, nil, err
+	}
+	failed := map[string]error{}
+	for _, u := range us {
+		if err := s.archive.Put(s.tenant, u); err != nil {
+			failed[u.UserID] = err
+		}
+	}
+	if len(failed) == 0 {
+		return nil, ids, nil
+	}
+	archived := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if _, ok := failed[id]; !ok {
+			archived = append(archived, id)
+		}
+	}
+	return failed, archived, nil
+}
+
+// ExpireGuests removes the guests created before before and returns how
+// many it removed. Each gets a user.deleted event.
+func (s *fixedService) ExpireGuests(ctx context.Context, before time.Time) (int, error) {
+	expired, err := s.db.GetUsers(ctx, db.UserQuery{Role: users.RoleGuest, CreatedBefore: before, Fields: []string{"id"}})
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for len(expired) > 0 {
+		batch := expired
+		if len(batch) > MaxBulkDelete {
+			batch = batch[:MaxBulkDelete]
+		}
+		expired = expired[len(batch):]
+		ids := make([]string, 0, len(batch))
+		for _, u := range batch {
+			ids = append(ids, u.UserID)
+		}
+		errs, err := s.DeleteUsers(ctx, ids)
+		if err != nil {
+			return n, err
+		}
+		for _, id := range ids {
+			if errs[id] == nil {
+				n++
+			}
+		}
+	}
+	return n, nil
+}
+
+// Changes subscribes to the changes after lastEventID, see
+// changes.Broker.Subscribe.
+func (s *fixedService) Changes(lastEventID string) *changes.Subscription {
+	return s.changes.Subscribe(lastEventID)
+}
+
+// Notifications subscribes to the new changes of the user with id.
+func (s *fixedService) Notifications(id string) *changes.Subscription {
+	return s.changes.SubscribeUser(id)
+}
+
+// Health returns the health of the service. The shallow health only says
+// the service is up, the deep health also pings its dependencies and how
+// long each took: the database, the event broker and the readiness checks.
+func (s *fixedService) Health(ctx context.Context, deep bool) []Health {
+	health := []Health{{Service: "user", Status: "OK", Time: time.Now().String()}}
+	if !deep {
+		return health
+	}
+	health = append(health,
+		probe("user-db", func() error { return s.db.Ping(ctx) }),
+		probe("user-events", func() error {
+			s.changes.Subscribe("").Close()
+			return nil
+		}),
+	)
+	for _, c := range s.readiness {
+		health = append(health, probe(c.name, c.check))
+	}
+	return health
+}
+
+// Ready returns the readiness of the service to take requests: it is not
+// shutting down, its database is reachable and migrated and the readiness
+// checks pass. It is ready when all of them are OK. Migrations are pending
+// until applied, or failed when one could not be, like a unique index over
+// duplicate accounts.
+func (s *fixedService) Ready(ctx context.Context) []Health {
+	now := time.Now().String()
+	app := Health{Service: "user", Status: "OK", Time: now}
+	if shuttingDown() {
+		app.Status = "draining"
+	}
+	migrations := Health{Service: "user-db-migrations", Status: "OK", Time: now}
+	if !s.db.Migrated() {
+		migrations.Status = "pending"
+		if s.db.MigrationFailure() != nil {
+			migrations.Status = "failed"
+		}
+	}
+	health := []Health{app, probe("user-db", func() error { return s.db.Ping(ctx) }), migrations}
+	for _, c := range s.readiness {
+		health = append(health, probe(c.name, c.check))
+	}
+	return health
+}
+
+// probe returns the health of the dependency name as check finds it, with
+// how long check took.
+func probe(name string, check func() error) Health {
+	begin := time.Now()
+	err := check()
+	h := Health{Service: name, Status: "OK", Time: begin.String(), Latency: time.Since(begin).String()}
+	if err != nil {
+		h.Status = "err"
+	}
+	return h
+}
+
+// invalid marks err as caused by a bad request, unless it already is.
+func invalid(err error) error {
+	if errors.Is(err, ErrInvalidRequest) {
+		return err
+	}
+	return fmt.Errorf("%w: %w", ErrInvalidRequest, err)
 }
 
 func calculatePassHash(pass, salt string) string {
@@ -1,9 +1,22 @@
 package api
 
 import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
-	"github.com/microservices-demo/user/users"
+	"user/address"
+	"user/auth"
+	"user/cardvault"
+	"user/db"
+	"user/db/inmem"
+	"user/patch"
+	"user/security"
+	"user/users"
 )
 
 var (
@@ -37,3 +50,588 @@ func TestCalculatePassHash(t *testing.T) {
 		t.Error("user1's password failed hash test")
 	}
 }
+
+func TestRegisterPhone(t *testing.T) {
+	ctx := context.Background()
+	if _, err := TestService.Register(ctx, "eve", "password", "", "", "", "020 7183 8750"); !errors.Is(err, ErrInvalidRequest) {
+		t.Errorf("expected a phone without country code to be rejected, got %v", err)
+	}
+}
+
+func TestSendPhoneCodeDisabled(t *testing.T) {
+	ctx := context.Background()
+	if err := TestService.SendPhoneCode(ctx, "57a98d98e4b00679b4a830af"); !errors.Is(err, ErrNoPhoneVerification) {
+		t.Errorf("expected phone verification to be off, got %v", err)
+	}
+}
+
+func TestPhoneCode(t *testing.T) {
+	code, err := newPhoneCode()
+	if err != nil || len(code) != 6 {
+		t.Fatalf("unexpected code %q %v", code, err)
+	}
+	if hashPhoneCode(code, "salt") == hashPhoneCode(code, "pepper") {
+		t.Error("expected codes hashed with the user salt")
+	}
+}
+
+func TestListCardsLimits(t *testing.T) {
+	ctx := context.Background()
+	for _, l := range []int{-1, MaxPageSize + 1} {
+		if _, _, err := TestService.ListCards(ctx, "", l); !errors.Is(err, ErrInvalidRequest) {
+			t.Errorf("expected limit %v to be rejected", l)
+		}
+	}
+	if _, _, err := TestService.ListCards(ctx, "not base64!", 1); !errors.Is(err, ErrInvalidRequest) {
+		t.Error("expected invalid cursor to be rejected")
+	}
+}
+
+func TestMergeValidation(t *testing.T) {
+	ctx := context.Background()
+	for _, c := range [][3]string{
+		{"a", "a", ""},
+		{"a", "", ""},
+		{"a", "b", "newest"},
+	} {
+		if _, err := TestService.Merge(ctx, c[0], c[1], c[2]); !errors.Is(err, ErrInvalidRequest) {
+			t.Errorf("expected merge %v to be rejected", c)
+		}
+	}
+}
+
+func TestListUsersLimits(t *testing.T) {
+	ctx := context.Background()
+	for _, l := range []int{-1, MaxPageSize + 1} {
+		if _, _, err := TestService.ListUsers(ctx, "", l); !errors.Is(err, ErrInvalidRequest) {
+			t.Errorf("expected limit %v to be rejected", l)
+		}
+	}
+	if _, _, err := TestService.ListUsers(ctx, "not base64!", 1); !errors.Is(err, ErrInvalidRequest) {
+		t.Error("expected invalid cursor to be rejected")
+	}
+}
+
+func TestUpgradeValidation(t *testing.T) {
+	ctx := context.Background()
+	if _, err := TestService.Upgrade(ctx, "token", "", "password", "", "", ""); !errors.Is(err, ErrInvalidRequest) {
+		t.Error("expected upgrade without username to be rejected")
+	}
+	if _, err := TestService.Upgrade(ctx, "not a token", "eve", "password", "", "", ""); err != ErrUnauthorized {
+		t.Error("expected upgrade with a bad token to be unauthorized")
+	}
+}
+
+func TestActivityLimits(t *testing.T) {
+	ctx := context.Background()
+	if _, _, err := TestService.Activity(ctx, "1", "", MaxPageSize+1); !errors.Is(err, ErrInvalidRequest) {
+		t.Error("expected limit to be rejected")
+	}
+	if _, _, err := TestService.Activity(ctx, "1", "not base64!", 1); !errors.Is(err, ErrInvalidRequest) {
+		t.Error("expected invalid cursor to be rejected")
+	}
+}
+
+func TestBatchGetUsersLimits(t *testing.T) {
+	ctx := context.Background()
+	ids := make([]string, MaxBatchGet+1)
+	for _, bad := range [][]string{nil, ids} {
+		if _, _, err := TestService.BatchGetUsers(ctx, bad); !errors.Is(err, ErrInvalidRequest) {
+			t.Errorf("expected %v ids to be rejected", len(bad))
+		}
+	}
+}
+
+func TestImportAddressesLimits(t *testing.T) {
+	ctx := context.Background()
+	as := make([]users.Address, MaxAddressImport+1)
+	for _, bad := range [][]users.Address{nil, as} {
+		if _, err := TestService.ImportAddresses(ctx, "57a98d98e4b00679b4a830af", bad); !errors.Is(err, ErrInvalidRequest) {
+			t.Errorf("expected %v addresses to be rejected", len(bad))
+		}
+	}
+}
+
+func TestValidateAddress(t *testing.T) {
+	ctx := context.Background()
+	failing := address.ValidatorFunc(func(users.Address) (users.Address, error) {
+		return users.Address{}, errors.New("unavailable")
+	})
+	s := NewFixedService(WithAddressValidator(failing)).(*fixedService)
+	a, err := s.validateAddress(users.Address{Street: " High Street", City: "Leeds", PostCode: "ls1 1aa", Country: "gb"})
+	if err != nil || a.Country != "GB" || a.Validated {
+		t.Errorf("expected fallback to the basic validator, got %+v %v", a, err)
+	}
+	if _, err := TestService.PostAddress(ctx, users.Address{Street: "High Street"}, ""); !errors.Is(err, ErrInvalidRequest) {
+		t.Error("expected incomplete address to be rejected")
+	}
+}
+
+func TestPostCardDeclined(t *testing.T) {
+	ctx := context.Background()
+	s := NewFixedService(WithCardVault(declining{}))
+	_, err := s.PostCard(ctx, users.Card{LongNum: "4000 0000 0000 0002", Expires: "01/99"}, "")
+	if !errors.Is(err, ErrInvalidRequest) {
+		t.Errorf("expected declined card to be invalid, got %v", err)
+	}
+}
+
+func TestPostCardReplacesOthersCard(t *testing.T) {
+	ctx := context.Background()
+	_, err := TestService.PostCard(ctx, users.Card{LongNum: "4111111111111111", Expires: "01/99", Replaces: "57a98d98e4b00679b4a830b1"}, "")
+	var fe *users.FieldError
+	if !errors.As(err, &fe) || fe.Field != "replaces" {
+		t.Errorf("expected replacing a card of another customer to be rejected, got %v", err)
+	}
+}
+
+type declining struct{}
+
+func (declining) Name() string { return "declining" }
+
+func (declining) Tokenize(users.Card, string) (string, error) {
+	return "", cardvault.ErrDeclined
+}
+
+type probedDB struct {
+	db.Database
+	err      error
+	migrated bool
+	failure  error
+}
+
+func (d probedDB) Ping(ctx context.Context) error {
+	return d.err
+}
+
+func (d probedDB) Migrated() bool {
+	return d.migrated
+}
+
+func (d probedDB) Migrate(ctx context.Context) error {
+	return nil
+}
+
+func (d probedDB) MigrationStatus(ctx context.Context) ([]db.MigrationStatus, error) {
+	return nil, nil
+}
+
+func (d probedDB) MigrationFailure() error {
+	return d.failure
+}
+
+func TestReady(t *testing.T) {
+	ctx := context.Background()
+	defer func() { draining, drainOnce = make(chan struct{}), sync.Once{} }()
+	status := func(s Service) map[string]string {
+		m := map[string]string{}
+		for _, h := range s.Ready(ctx) {
+			m[h.Service] = h.Status
+		}
+		return m
+	}
+	cache := errors.New("cold")
+	s := NewFixedService(WithTenant("", db.NewStore(probedDB{migrated: true})), WithReadinessCheck("cache", func() error { return cache }))
+	if got := status(s); got["user"] != "OK" || got["user-db"] != "OK" || got["user-db-migrations"] != "OK" || got["cache"] != "err" {
+		t.Errorf("expected only the cold cache failing, got %v", got)
+	}
+	cache = nil
+	if got := status(s); !(healthResponse{Health: s.Ready(ctx)}).ok() {
+		t.Errorf("expected ready, got %v", got)
+	}
+	s = NewFixedService(WithTenant("", db.NewStore(probedDB{err: errors.New("down")})))
+	if got := status(s); got["user-db"] != "err" || got["user-db-migrations"] != "pending" {
+		t.Errorf("expected the database failing, got %v", got)
+	}
+	s = NewFixedService(WithTenant("", db.NewStore(probedDB{failure: &db.MigrationError{Version: 2, Name: "unique emails"}})))
+	if got := status(s); got["user-db-migrations"] != "failed" {
+		t.Errorf("expected the failed migration reported, got %v", got)
+	}
+	Drain()
+	if got := status(s); got["user"] != "draining" {
+		t.Errorf("expected not ready on shutdown, got %v", got)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	ctx := context.Background()
+	s := NewFixedService(WithTenant("", db.NewStore(probedDB{err: errors.New("down")})), WithReadinessCheck("cache", func() error { return nil }))
+	if h := s.Health(ctx, false); len(h) != 1 || h[0].Service != "user" || h[0].Latency != "" {
+		t.Errorf("expected only the service in the shallow health, got %v", h)
+	}
+	status := map[string]Health{}
+	for _, h := range s.Health(ctx, true) {
+		status[h.Service] = h
+	}
+	if status["user-db"].Status != "err" || status["user-events"].Status != "OK" || status["cache"].Status != "OK" {
+		t.Errorf("expected every dependency pinged, got %v", status)
+	}
+	if status["user-db"].Latency == "" || status["cache"].Latency == "" {
+		t.Errorf("expected the latency of the pings, got %v", status)
+	}
+}
+
+// patchedDB stores the one user and address patched.
+type patchedDB struct {
+	db.Database
+	user    users.User
+	update  *users.ProfileUpdate
+	address users.Address
+}
+
+func (d *patchedDB) GetUser(ctx context.Context, id string) (users.User, error) {
+	return d.user, nil
+}
+
+func (d *patchedDB) UpdateUser(ctx context.Context, id string, p users.ProfileUpdate) error {
+	d.update = &p
+	return nil
+}
+
+func (d *patchedDB) AddActivity(context.Context, *users.Activity) error {
+	return nil
+}
+
+func (d *patchedDB) GetAddress(ctx context.Context, id string) (users.Address, error) {
+	return d.address, nil
+}
+
+func (d *patchedDB) UpdateAddress(ctx context.Context, id string, a *users.Address) error {
+	d.address = *a
+	return nil
+}
+
+func (d *patchedDB) OwnerOf(ctx context.Context, entity, id string) (string, error) {
+	return "1", nil
+}
+
+func TestPatchUser(t *testing.T) {
+	ctx := context.Background()
+	d := &patchedDB{user: users.User{FirstName: "Eve", LastName: "Smith", Email: "eve@example.com", Metadata: map[string]string{"crm": "1", "old": "x"}}}
+	s := NewFixedService(WithTenant("", db.NewStore(d)))
+	ops := patch.JSONPatch{
+		{Op: "test", Path: "/firstName", Value: []byte(`"Eve"`)},
+		{Op: "replace", Path: "/lastName", Value: []byte(`"Jones"`)},
+		{Op: "remove", Path: "/metadata/old"},
+		{Op: "add", Path: "/metadata/tier", Value: []byte(`"gold"`)},
+	}
+	if _, err := s.PatchUser(ctx, "1", ops); err != nil {
+		t.Fatal(err)
+	}
+	u := d.update
+	if u == nil || u.FirstName != nil || u.Email != nil || *u.LastName != "Jones" || u.Metadata["old"] != nil || *u.Metadata["tier"] != "gold" || len(u.Metadata) != 2 {
+		t.Errorf("expected only the patched fields updated, got %+v", u)
+	}
+
+	d.update = nil
+	if _, err := s.PatchUser(ctx, "1", patch.JSONPatch{{Op: "test", Path: "/firstName", Value: []byte(`"Bob"`)}}); !errors.Is(err, patch.ErrTestFailed) || d.update != nil {
+		t.Errorf("expected the failed test to leave the user, got %v", err)
+	}
+	if _, err := s.PatchUser(ctx, "1", patch.JSONPatch{{Op: "add", Path: "/username", Value: []byte(`"eve"`)}}); !errors.Is(err, ErrInvalidRequest) {
+		t.Errorf("expected fields that can't be patched rejected, got %v", err)
+	}
+	if _, err := s.PatchUser(ctx, "1", patch.JSONPatch{{Op: "replace", Path: "/email", Value: []byte(`"nope"`)}}); !errors.Is(err, ErrInvalidRequest) {
+		t.Errorf("expected the patched profile validated, got %v", err)
+	}
+}
+
+func TestPatchAddress(t *testing.T) {
+	ctx := context.Background()
+	d := &patchedDB{address: users.Address{ID: "a1", Street: "Main", Number: "1", City: "Springfield", PostCode: "12345", State: "IL", Country: "US"}}
+	s := NewFixedService(WithTenant("", db.NewStore(d)))
+	a, err := s.PatchAddress(ctx, "a1", patch.MergePatch(`{"number":"12","type":"shipping","id":"other"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.ID != "a1" || a.Number != "12" || a.Type != users.AddressShipping || d.address.Street != "Main" {
+		t.Errorf("expected the address patched, got %+v", a)
+	}
+	var ve *ValidationError
+	if _, err := s.PatchAddress(ctx, "a1", patch.JSONPatch{{Op: "remove", Path: "/city"}}); !errors.As(err, &ve) || ve.Fields[0].Field != "city" {
+		t.Errorf("expected the patched address validated, got %v", err)
+	}
+	if _, err := s.PatchAddress(ctx, "a1", patch.MergePatch(`{"street":"`+strings.Repeat("x", 201)+`"}`)); !errors.Is(err, ErrInvalidRequest) {
+		t.Errorf("expected a too long street rejected, got %v", err)
+	}
+}
+
+// batchDB creates everything and records what was deleted.
+type batchDB struct {
+	db.Database
+	created []string
+	deleted []string
+}
+
+func (d *batchDB) CreateUser(ctx context.Context, u *users.User) error {
+	u.UserID = "u" + strconv.Itoa(len(d.created))
+	d.created = append(d.created, u.UserID)
+	return nil
+}
+
+func (d *batchDB) GetUser(ctx context.Context, id string) (users.User, error) {
+	return users.User{UserID: id}, nil
+}
+
+func (d *batchDB) CreateAddress(ctx context.Context, a *users.Address, userid string) error {
+	a.ID = "a" + strconv.Itoa(len(d.created))
+	d.created = append(d.created, a.ID)
+	return nil
+}
+
+func (d *batchDB) AddActivity(context.Context, *users.Activity) error {
+	return nil
+}
+
+func (d *batchDB) Delete(ctx context.Context, entity, id string) error {
+	d.deleted = append(d.deleted, id)
+	return nil
+}
+
+func TestBatch(t *testing.T) {
+	ctx := context.Background()
+	d := &batchDB{}
+	s := NewFixedService(WithTenant("", db.NewStore(d)))
+	a := users.Address{Street: "Main", Number: "1", City: "Springfield", PostCode: "12345", State: "IL", Country: "US"}
+	res, err := s.Batch(ctx, []BatchOperation{
+		{Ref: "eve", Customer: &users.User{Username: "eve"}},
+		{Address: &a, UserID: "$eve"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res[0].ID != "u0" || res[0].Status != BatchCreated || res[1].ID != "a1" || res[1].Status != BatchCreated {
+		t.Errorf("expected the customer and its address created, got %+v", res)
+	}
+
+	d.created = nil
+	res, err = s.Batch(ctx, []BatchOperation{
+		{Ref: "eve", Customer: &users.User{Username: "eve"}},
+		{Address: &a, UserID: "$eve"},
+		{Card: &users.Card{LongNum: "4111111111111112", Expires: "12/99"}, UserID: "$eve"},
+		{Address: &a, UserID: "$eve"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{BatchRolledBack, BatchRolledBack, BatchFailed, BatchSkipped}
+	for k, r := range res {
+		if r.Status != want[k] {
+			t.Errorf("expected operation %v %v, got %+v", k, want[k], r)
+		}
+	}
+	if res[2].Field != "longNum" || strings.Join(d.deleted, ",") != "a1,u0" {
+		t.Errorf("expected the created undone newest first, got %+v and %v", res, d.deleted)
+	}
+
+	for _, ops := range [][]BatchOperation{
+		nil,
+		make([]BatchOperation, MaxBatchOperations+1),
+		{{Address: &a, UserID: "$eve"}, {Ref: "eve", Customer: &users.User{}}},
+		{{Ref: "eve", Customer: &users.User{}}, {Ref: "eve", Customer: &users.User{}}},
+		{{Customer: &users.User{}, Address: &a}},
+		{{Card: &users.Card{Replaces: "c1"}, UserID: "u0"}},
+	} {
+		if _, err := s.Batch(ctx, ops); !errors.Is(err, ErrInvalidRequest) {
+			t.Errorf("expected %+v rejected before running, got %v", ops, err)
+		}
+	}
+}
+
+// expandDB expands every user with one address and card.
+type expandDB struct {
+	db.Database
+	calls *int
+}
+
+func (expandDB) GetUsers(ctx context.Context, q db.UserQuery) ([]users.User, error) {
+	return []users.User{{UserID: "1", Username: "eve"}, {UserID: "2", Username: "bob"}}, nil
+}
+
+func (d expandDB) ExpandUsers(ctx context.Context, us []users.User, attrs []string) error {
+	if d.calls != nil {
+		*d.calls++
+	}
+	for k := range us {
+		us[k].Addresses = []users.Address{{ID: "a1", City: "Springfield"}}
+		us[k].Cards = []users.Card{{ID: "c1", LongNum: "4111111111111111"}}
+	}
+	return nil
+}
+
+func TestExpandUser(t *testing.T) {
+	ctx := context.Background()
+	s := NewFixedService(WithTenant("", db.NewStore(expandDB{})))
+	doc, err := expandUser(ctx, s, users.User{UserID: "1", Username: "eve"}, GetRequest{ID: "1", Expand: []string{"cards"}, Fields: []string{"username"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	embedded := doc["_embedded"].(map[string]interface{})
+	cs, _ := embedded["card"].([]users.Card)
+	if doc["username"] != "eve" || doc["status"] != nil || embedded["address"] != nil || len(cs) != 1 || cs[0].LongNum != "************1111" {
+		t.Errorf("expected the selected fields and the masked cards, got %v", doc)
+	}
+}
+
+func TestExpandUsers(t *testing.T) {
+	var calls int
+	s := NewFixedService(WithTenant("", db.NewStore(expandDB{calls: &calls})))
+	resp, err := MakeUserGetEndpoint(s)(context.Background(), GetRequest{Expand: []string{"addresses"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	docs := resp.(EmbedStruct).Embed.(expandedUsersResponse).Users
+	if len(docs) != 2 || calls != 1 {
+		t.Fatalf("expected both users expanded at once, got %v in %v calls", docs, calls)
+	}
+	for _, doc := range docs {
+		embedded := doc["_embedded"].(map[string]interface{})
+		if as, _ := embedded["address"].([]users.Address); len(as) != 1 || embedded["card"] != nil {
+			t.Errorf("expected the addresses embedded, got %v", doc)
+		}
+	}
+}
+
+type passwordDB struct {
+	db.Database
+	update *users.ProfileUpdate
+}
+
+func (passwordDB) GetUser(ctx context.Context, id string) (users.User, error) {
+	return users.User{UserID: id, Username: "eve"}, nil
+}
+
+func (d passwordDB) UpdateUser(ctx context.Context, id string, p users.ProfileUpdate) error {
+	*d.update = p
+	return nil
+}
+
+func TestResetPassword(t *testing.T) {
+	ctx := context.Background()
+	d := passwordDB{update: &users.ProfileUpdate{}}
+	s := NewFixedService(WithTenant("", db.NewStore(d)))
+	generated, err := s.ResetPassword(ctx, "1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if generated == "" || d.update.Password == nil || *d.update.Password != calculatePassHash(generated, *d.update.Salt) {
+		t.Errorf("expected the hash of the generated password, got %+v", d.update)
+	}
+	salt := *d.update.Salt
+	generated, err = s.ResetPassword(ctx, "1", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if generated != "" || *d.update.Password != calculatePassHash("secret", *d.update.Salt) || *d.update.Salt == salt {
+		t.Errorf("expected the hash of the given password with a new salt, got %q %+v", generated, d.update)
+	}
+}
+
+type webhookDB struct {
+	db.Database
+	webhooks []users.Webhook
+}
+
+func (d *webhookDB) CreateWebhook(ctx context.Context, w *users.Webhook) error {
+	w.ID = "w1"
+	d.webhooks = append(d.webhooks, *w)
+	return nil
+}
+
+func (d *webhookDB) GetWebhooks(ctx context.Context) ([]users.Webhook, error) {
+	return append([]users.Webhook(nil), d.webhooks...), nil
+}
+
+func TestCreateWebhook(t *testing.T) {
+	ctx := context.Background()
+	d := &webhookDB{}
+	s := NewFixedService(WithTenant("", db.NewStore(d)))
+	for _, bad := range []users.Webhook{
+		{URL: "ftp://example.com", Secret: "0123456789abcdef", Events: []string{"*"}},
+		{URL: "https://example.com", Secret: "short", Events: []string{"*"}},
+		{URL: "https://example.com", Secret: "0123456789abcdef", Events: []string{"user.exploded"}},
+	} {
+		if _, err := s.CreateWebhook(ctx, bad); !errors.Is(err, ErrInvalidRequest) {
+			t.Errorf("expected %+v to be rejected, got %v", bad, err)
+		}
+	}
+	w, err := s.CreateWebhook(ctx, users.Webhook{URL: "https://example.com", Secret: "0123456789abcdef", Events: []string{"user.created", "*"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.ID != "w1" || w.Secret != "" {
+		t.Errorf("expected the webhook without its secret, got %+v", w)
+	}
+	ws, err := s.GetWebhooks(ctx)
+	if err != nil || len(ws) != 1 || ws[0].Secret != "" {
+		t.Errorf("expected webhooks without secrets, got %+v %v", ws, err)
+	}
+}
+
+type archiver struct {
+	fail     string
+	archived []users.User
+}
+
+func (a *archiver) Put(tenant string, u users.User) error {
+	if u.UserID == a.fail {
+		return errors.New("bucket down")
+	}
+	a.archived = append(a.archived, u)
+	return nil
+}
+
+func TestDeleteUsersArchives(t *testing.T) {
+	ctx := context.Background()
+	m := &inmem.Memory{}
+	if err := m.Init(); err != nil {
+		t.Fatal(err)
+	}
+	kept := users.User{Username: "kept"}
+	purged := users.User{
+		Username:  "purged",
+		Addresses: []users.Address{{Street: "Main St", City: "Springfield", Country: "US"}},
+		Cards:     []users.Card{{LongNum: "4111111111111111", Expires: "01/99"}},
+	}
+	for _, u := range []*users.User{&kept, &purged} {
+		if err := m.CreateUser(ctx, u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a := &archiver{fail: kept.UserID}
+	s := NewFixedService(WithTenant("", db.NewStore(m)), WithArchive(a))
+	errs, err := s.DeleteUsers(ctx, []string{kept.UserID, purged.UserID})
+	if err != nil || errs[purged.UserID] != nil || errs[kept.UserID] == nil {
+		t.Fatalf("expected only the archived user purged, got %v %v", errs, err)
+	}
+	if _, err := m.GetUser(ctx, kept.UserID); err != nil {
+		t.Errorf("expected the user failing to be archived kept, got %v", err)
+	}
+	if len(a.archived) != 1 || len(a.archived[0].Addresses) != 1 || len(a.archived[0].Cards) != 1 {
+		t.Errorf("expected the purged user archived with its address and card, got %+v", a.archived)
+	}
+}
+
+type recordedEvents []security.Event
+
+func (r *recordedEvents) Emit(e security.Event) {
+	*r = append(*r, e)
+}
+
+func TestIntrospectEvents(t *testing.T) {
+	signer, _ := auth.NewSigner([]byte("secret"), time.Hour)
+	var events recordedEvents
+	s := NewFixedService(WithSigner(signer), WithSecurityEvents(&events))
+	tok, _, _ := signer.Issue("1", "eve", []string{auth.ScopeCustomer})
+	if !s.Introspect(tok).Active || !s.Introspect(tok).Active || len(events) != 0 {
+		t.Errorf("expected a token used twice active without events, got %v", events)
+	}
+
+	expired, _ := auth.NewSigner([]byte("secret"), -time.Minute)
+	tok, _, _ = expired.Issue("1", "eve", nil)
+	if s.Introspect(tok).Active || len(events) != 1 || events[0].Type != security.TokenExpired {
+		t.Errorf("expected an expired token reported as expired, got %v", events)
+	}
+	if s.Introspect("not.a.token").Active || len(events) != 2 || events[1].Type != security.TokenInvalid {
+		t.Errorf("expected a garbage token reported as invalid, got %v", events)
+	}
+}
@@ -0,0 +1,30 @@
+package api
+
+// shutdown.go contains what the server does when it shuts down. Requests in
+// flight are drained by the HTTP server, but event streams and WebSockets
+// never finish by themselves and are told to end here.
+
+import "sync"
+
+var (
+	// draining is closed once the server starts shutting down.
+	draining  = make(chan struct{})
+	drainOnce sync.Once
+)
+
+// Drain ends the event streams and WebSockets, their clients reconnect to
+// another instance, and makes the service not ready. It is safe to call
+// more than once.
+func Drain() {
+	drainOnce.Do(func() { close(draining) })
+}
+
+// shuttingDown reports whether Drain has been called.
+func shuttingDown() bool {
+	select {
+	case <-draining:
+		return true
+	default:
+		return false
+	}
+}
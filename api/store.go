@@ -0,0 +1,79 @@
+package api
+
+import (
+	"context"
+	"time"
+
+	"user/db"
+	"user/users"
+)
+
+// Store is the part of *db.Store the service uses. The service is given
+// its Store with WithTenant, so tests and callers serving several
+// databases from one process each pass their own.
+type Store interface {
+	// Users
+	CreateUser(ctx context.Context, u *users.User) error
+	GetUser(ctx context.Context, id string) (users.User, error)
+	GetUserByName(ctx context.Context, name string) (users.User, error)
+	GetUserByPreviousName(ctx context.Context, name string, since time.Time) (users.User, error)
+	GetUsers(ctx context.Context, q db.UserQuery) ([]users.User, error)
+	GetUsersByID(ctx context.Context, ids []string) ([]users.User, error)
+	GetUserAttributes(ctx context.Context, u *users.User) error
+	ExpandUsers(ctx context.Context, us []users.User, attrs []string) error
+	ListUsers(ctx context.Context, after string, limit int) ([]users.User, error)
+	GetStats(ctx context.Context, signupsSince, activeSince time.Time) (db.Stats, error)
+	UserExists(ctx context.Context, field, value string) (bool, error)
+	UpdateUser(ctx context.Context, id string, p users.ProfileUpdate) error
+	UpgradeUser(ctx context.Context, id string, u users.User) error
+	RenameUser(ctx context.Context, id, username string) error
+	MergeUsers(ctx context.Context, target, source string, p users.ProfileUpdate) error
+	RecordLogin(ctx context.Context, id string, at time.Time) error
+	AddUserTag(ctx context.Context, id, tag string) error
+	RemoveUserTag(ctx context.Context, id, tag string) error
+	DeleteUsers(ctx context.Context, ids []string) (map[string]error, error)
+	Delete(ctx context.Context, entity, id string) error
+	OwnerOf(ctx context.Context, entity, id string) (string, error)
+
+	// Addresses and cards
+	CreateAddress(ctx context.Context, a *users.Address, userID string) error
+	CreateAddresses(ctx context.Context, as []users.Address, userID string) error
+	GetAddress(ctx context.Context, id string) (users.Address, error)
+	GetAddresses(ctx context.Context) ([]users.Address, error)
+	GetAddressesByID(ctx context.Context, ids []string) ([]users.Address, error)
+	UpdateAddress(ctx context.Context, id string, a *users.Address) error
+	SetAddressLocation(ctx context.Context, id string, l *users.Location, status string) error
+	CreateCard(ctx context.Context, c *users.Card, userID string) error
+	GetCard(ctx context.Context, id string) (users.Card, error)
+	GetCards(ctx context.Context) ([]users.Card, error)
+	GetCardsByID(ctx context.Context, ids []string) ([]users.Card, error)
+	ListCards(ctx context.Context, after string, limit int) ([]db.OwnedCard, error)
+	UpdateCard(ctx context.Context, id string, u users.CardUpdate) error
+	SetDefaultCard(ctx context.Context, userID, cardID string) error
+	SetCardVerification(ctx context.Context, id, status string) error
+	DeleteCard(ctx context.Context, id, replacedBy string) error
+
+	// Groups and activity
+	CreateGroup(ctx context.Context, g *users.Group) error
+	GetGroup(ctx context.Context, id string) (users.Group, error)
+	GetUserGroups(ctx context.Context, userID string) ([]users.Group, error)
+	AddGroupMember(ctx context.Context, groupID, userID string) error
+	RemoveGroupMember(ctx context.Context, groupID, userID string) error
+	AddActivity(ctx context.Context, a *users.Activity) error
+	GetActivity(ctx context.Context, userID, before string, limit int) ([]users.Activity, error)
+
+	// Idempotency keys and webhooks
+	CreateIdempotencyKey(ctx context.Context, k *db.IdempotencyKey) error
+	GetIdempotencyKey(ctx context.Context, key string) (db.IdempotencyKey, error)
+	SetIdempotencyResult(ctx context.Context, key, resultID string) error
+	DeleteIdempotencyKey(ctx context.Context, key string) error
+	CreateWebhook(ctx context.Context, w *users.Webhook) error
+	GetWebhooks(ctx context.Context) ([]users.Webhook, error)
+	DeleteWebhook(ctx context.Context, id string) error
+	GetWebhookDeliveries(ctx context.Context, webhookID, before string, limit int) ([]users.WebhookDelivery, error)
+
+	// Health
+	Ping(ctx context.Context) error
+	Migrated() bool
+	MigrationFailure() error
+}
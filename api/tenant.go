@@ -0,0 +1,106 @@
+package api
+
+// tenant.go contains the routing of requests to the tenant they belong to.
+// Every tenant gets its own service and router over its own store, so
+// storefronts sharing a deployment never see each other's users. Only the
+// configured tenants are served, a header can't conjure up another one.
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+
+	"user/auth"
+	"user/db"
+)
+
+// TenantHeader names the tenant of a request without a tenant token.
+const TenantHeader = "X-Tenant-ID"
+
+// ErrUnknownTenant is returned for requests of tenants not configured.
+var ErrUnknownTenant = errors.New("Unknown tenant")
+
+// TenantOf returns the tenant of r, taken from the tenant claim of its bearer
+// token or else the X-Tenant-ID header. A header naming another tenant than
+// the token is unauthorized, an empty tenant is the default one.
+func TenantOf(r *http.Request) (string, error) {
+	tenant := r.Header.Get(TenantHeader)
+	h := r.Header.Get("Authorization")
+	if len(h) > 7 && strings.EqualFold(h[:7], "Bearer ") {
+		claim, err := auth.TenantOf(strings.TrimSpace(h[7:]))
+		if err != nil {
+			return "", ErrUnauthorized
+		}
+		if tenant != "" && tenant != claim {
+			return "", ErrUnauthorized
+		}
+		tenant = claim
+	}
+	if tenant != "" && !db.ValidTenant(tenant) {
+		return "", invalid(db.ErrInvalidTenant)
+	}
+	return tenant, nil
+}
+
+// tenantHandler is the handler of a tenant, ready once built.
+type tenantHandler struct {
+	ready chan struct{}
+	h     http.Handler
+	err   error
+}
+
+// TenantHandler passes requests to the handler of their tenant, built by
+// build on the first request of each tenant. Besides the default tenant only
+// those in tenants are served. Tenants are built one at a time each, without
+// holding up the requests of the others; a failed build is tried again by
+// the next request.
+func TenantHandler(tenants []string, build func(tenant string) (http.Handler, error)) http.Handler {
+	allowed := map[string]bool{"": true}
+	for _, t := range tenants {
+		allowed[t] = true
+	}
+	var mu sync.Mutex
+	handlers := map[string]*tenantHandler{}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenant, err := TenantOf(r)
+		if err == nil && !allowed[tenant] {
+			err = invalid(ErrUnknownTenant)
+		}
+		if err != nil {
+			encodeError(r.Context(), err, w)
+			return
+		}
+		mu.Lock()
+		t, ok := handlers[tenant]
+		if !ok {
+			t = &tenantHandler{ready: make(chan struct{})}
+			handlers[tenant] = t
+		}
+		mu.Unlock()
+		if !ok {
+			t.h, t.err = build(tenant)
+			if t.err != nil {
+				mu.Lock()
+				delete(handlers, tenant)
+				mu.Unlock()
+			}
+			close(t.ready)
+		}
+		select {
+		case <-t.ready:
+		case <-r.Context().Done():
+			encodeError(r.Context(), r.Context().Err(), w)
+			return
+		}
+		err = t.err
+		if err == db.ErrNoTenancy {
+			err = invalid(err)
+		}
+		if err != nil {
+			encodeError(r.Context(), err, w)
+			return
+		}
+		t.h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,138 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"user/auth"
+	"user/db"
+	"user/db/inmem"
+)
+
+func TestTenantOf(t *testing.T) {
+	s, _ := auth.NewSigner([]byte("secret"), time.Hour)
+	tok, _, _ := s.IssueFor("shop", "id", "eve", nil)
+	for _, c := range []struct {
+		header, token, tenant string
+		err                   error
+	}{
+		{"", "", "", nil},
+		{"shop", "", "shop", nil},
+		{"", tok, "shop", nil},
+		{"shop", tok, "shop", nil},
+		{"other", tok, "", ErrUnauthorized},
+		{"Shop!", "", "", ErrInvalidRequest},
+	} {
+		r := httptest.NewRequest("GET", "/customers", nil)
+		if c.header != "" {
+			r.Header.Set(TenantHeader, c.header)
+		}
+		if c.token != "" {
+			r.Header.Set("Authorization", "Bearer "+c.token)
+		}
+		tenant, err := TenantOf(r)
+		if tenant != c.tenant || !errors.Is(err, c.err) {
+			t.Errorf("%+v: got %q %v", c, tenant, err)
+		}
+	}
+}
+
+func TestTenantHandler(t *testing.T) {
+	built := map[string]int{}
+	h := TenantHandler([]string{"shop", "none"}, func(tenant string) (http.Handler, error) {
+		built[tenant]++
+		if tenant == "none" {
+			return nil, db.ErrNoTenancy
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), nil
+	})
+	for _, tenant := range []string{"shop", "shop", ""} {
+		r := httptest.NewRequest("GET", "/customers", nil)
+		r.Header.Set(TenantHeader, tenant)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Errorf("expected 200 for %q, got %v", tenant, w.Code)
+		}
+	}
+	if built["shop"] != 1 || built[""] != 1 {
+		t.Errorf("expected each tenant built once, got %v", built)
+	}
+	r := httptest.NewRequest("GET", "/customers", nil)
+	r.Header.Set(TenantHeader, "none")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 without tenancy, got %v", w.Code)
+	}
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	if built["none"] != 2 {
+		t.Errorf("expected a failed build tried again, got %v", built)
+	}
+
+	r = httptest.NewRequest("GET", "/customers", nil)
+	r.Header.Set(TenantHeader, "unknown")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusBadRequest || built["unknown"] != 0 {
+		t.Errorf("expected 400 for a tenant not configured, got %v %v", w.Code, built)
+	}
+}
+
+func TestTenantHandlerBuildsApart(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	var builds sync.Map
+	h := TenantHandler([]string{"slow", "fast"}, func(tenant string) (http.Handler, error) {
+		n, _ := builds.LoadOrStore(tenant, new(int32))
+		atomic.AddInt32(n.(*int32), 1)
+		if tenant == "slow" {
+			close(started)
+			<-release
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), nil
+	})
+	serve := func(tenant string) int {
+		r := httptest.NewRequest("GET", "/customers", nil)
+		r.Header.Set(TenantHeader, tenant)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+	var wg sync.WaitGroup
+	for k := 0; k < 3; k++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if code := serve("slow"); code != http.StatusOK {
+				t.Errorf("expected 200 for slow, got %v", code)
+			}
+		}()
+	}
+	<-started
+	if code := serve("fast"); code != http.StatusOK {
+		t.Errorf("expected 200 for fast while slow builds, got %v", code)
+	}
+	close(release)
+	wg.Wait()
+	if n, _ := builds.Load("slow"); atomic.LoadInt32(n.(*int32)) != 1 {
+		t.Errorf("expected slow built once, got %v", atomic.LoadInt32(n.(*int32)))
+	}
+}
+
+func TestIntrospectOtherTenant(t *testing.T) {
+	s, _ := auth.NewSigner([]byte("secret"), time.Hour)
+	svc := NewFixedService(WithSigner(s), WithTenant("shop", db.NewStore(&inmem.Memory{})))
+	tok, _, _ := s.IssueFor("other", "id", "eve", nil)
+	if svc.Introspect(tok).Active {
+		t.Error("expected token of another tenant to be inactive")
+	}
+	tok, _, _ = s.IssueFor("shop", "id", "eve", nil)
+	if i := svc.Introspect(tok); !i.Active || i.Tenant != "shop" {
+		t.Errorf("expected token of the tenant to be active, got %+v", i)
+	}
+}
@@ -0,0 +1,107 @@
+package api
+
+// timeout.go contains the deadlines of single endpoints. Requests taking
+// longer than their endpoint may are answered with a 504 instead of keeping
+// the client waiting, and the deadline is set on the context of the work
+// still running so it can give up too.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+)
+
+// ErrTimeout is returned by endpoints taking longer than their timeout.
+var ErrTimeout = errors.New("Request timed out")
+
+// DefaultEndpointTimeouts bound the endpoints clients wait on the most.
+var DefaultEndpointTimeouts = map[string]time.Duration{
+	"Login":     500 * time.Millisecond,
+	"AdminList": 3 * time.Second,
+}
+
+// ParseEndpointTimeouts parses comma separated "Name=duration" endpoint
+// timeouts, Name being the Endpoints field without the Endpoint suffix, like
+// Login or AdminList. A zero duration lifts the timeout.
+func ParseEndpointTimeouts(s string) (map[string]time.Duration, error) {
+	timeouts := map[string]time.Duration{}
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e == "" {
+			continue
+		}
+		name, d, ok := strings.Cut(e, "=")
+		if !ok {
+			return nil, fmt.Errorf("expected Name=duration, got %q", e)
+		}
+		name = strings.TrimSpace(name)
+		if _, ok := reflect.TypeOf(Endpoints{}).FieldByName(name + "Endpoint"); !ok {
+			return nil, fmt.Errorf("no endpoint %q", name)
+		}
+		t, err := time.ParseDuration(strings.TrimSpace(d))
+		if err != nil {
+			return nil, err
+		}
+		timeouts[name] = t
+	}
+	return timeouts, nil
+}
+
+// WithTimeouts returns e with the endpoints named in timeouts, as for
+// ParseEndpointTimeouts, wrapped in a TimeoutMiddleware. Unknown names are
+// ignored.
+func (e Endpoints) WithTimeouts(timeouts map[string]time.Duration) Endpoints {
+	v := reflect.ValueOf(&e).Elem()
+	for name, d := range timeouts {
+		f := v.FieldByName(name + "Endpoint")
+		if !f.IsValid() || d <= 0 {
+			continue
+		}
+		f.Set(reflect.ValueOf(TimeoutMiddleware(d)(f.Interface().(endpoint.Endpoint))))
+	}
+	return e
+}
+
+// TimeoutMiddleware answers with ErrTimeout once next took longer than d.
+// The context next runs with is cancelled then, so work taking it can give
+// up; the rest finishes in the background.
+func TimeoutMiddleware(d time.Duration) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			ctx, cancel := context.WithTimeout(ctx, d)
+			defer cancel()
+			type result struct {
+				response interface{}
+				err      error
+				panic    interface{}
+			}
+			done := make(chan result, 1)
+			go func() {
+				// Panics are handed back so the server still recovers them.
+				defer func() {
+					if p := recover(); p != nil {
+						done <- result{panic: p}
+					}
+				}()
+				response, err := next(ctx, request)
+				done <- result{response: response, err: err}
+			}()
+			select {
+			case r := <-done:
+				if r.panic != nil {
+					panic(r.panic)
+				}
+				return r.response, r.err
+			case <-ctx.Done():
+				if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+					return nil, ErrTimeout
+				}
+				return nil, ctx.Err()
+			}
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+)
+
+func TestParseEndpointTimeouts(t *testing.T) {
+	ts, err := ParseEndpointTimeouts("Login=250ms, AdminList=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ts) != 2 || ts["Login"] != 250*time.Millisecond || ts["AdminList"] != 0 {
+		t.Errorf("expected both endpoints parsed, got %v", ts)
+	}
+	for _, s := range []string{"Login", "Login=soon", "Logout=1s"} {
+		if _, err := ParseEndpointTimeouts(s); err == nil {
+			t.Errorf("expected %q rejected", s)
+		}
+	}
+}
+
+func TestTimeoutMiddleware(t *testing.T) {
+	cancelled := make(chan struct{})
+	slow := TimeoutMiddleware(10 * time.Millisecond)(func(ctx context.Context, _ interface{}) (interface{}, error) {
+		<-ctx.Done()
+		close(cancelled)
+		return "late", nil
+	})
+	if _, err := slow(context.Background(), nil); !errors.Is(err, ErrTimeout) {
+		t.Errorf("expected a timeout, got %v", err)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Error("expected the context of the slow endpoint cancelled")
+	}
+
+	fast := TimeoutMiddleware(time.Second)(func(context.Context, interface{}) (interface{}, error) {
+		return "on time", nil
+	})
+	if r, err := fast(context.Background(), nil); r != "on time" || err != nil {
+		t.Errorf("expected the response, got %v %v", r, err)
+	}
+
+	panicking := TimeoutMiddleware(time.Second)(func(context.Context, interface{}) (interface{}, error) {
+		panic("boom")
+	})
+	defer func() {
+		if p := recover(); p != "boom" {
+			t.Errorf("expected the panic handed back, got %v", p)
+		}
+	}()
+	panicking(context.Background(), nil)
+}
+
+func TestWithTimeouts(t *testing.T) {
+	var slow endpoint.Endpoint = func(ctx context.Context, _ interface{}) (interface{}, error) {
+		<-ctx.Done()
+		return nil, nil
+	}
+	e := Endpoints{LoginEndpoint: slow, AdminListEndpoint: slow}.WithTimeouts(map[string]time.Duration{"Login": time.Millisecond, "AdminList": 0})
+	if _, err := e.LoginEndpoint(context.Background(), nil); !errors.Is(err, ErrTimeout) {
+		t.Errorf("expected login timed out, got %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := e.AdminListEndpoint(ctx, nil); err != nil {
+		t.Errorf("expected the lifted timeout left out, got %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	encodeError(context.Background(), ErrTimeout, w)
+	if w.Code != 504 {
+		t.Errorf("expected a gateway timeout, got %v", w.Code)
+	}
+}
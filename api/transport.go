@@ -4,16 +4,27 @@ package api
 // In our case we just use a REST-y HTTP transport.
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"mime"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-kit/kit/log"
 	httptransport "github.com/go-kit/kit/transport/http"
 	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"user/db"
+	"user/patch"
+	"user/risk"
 	"user/users"
 )
 
@@ -21,85 +32,416 @@ var (
 	ErrInvalidRequest = errors.New("Invalid request")
 )
 
-// MakeHTTPHandler mounts the endpoints into a REST-y HTTP handler.
+// MakeHTTPHandler mounts the endpoints into a REST-y HTTP handler, every
+// API version under its own /<version> prefix. Unversioned paths keep
+// serving the first version for existing consumers.
 func MakeHTTPHandler(e Endpoints, logger log.Logger) *mux.Router {
 	r := mux.NewRouter().StrictSlash(false)
-	//options := []httptransport.ServerOption{
-	//	httptransport.ServerErrorLogger(logger),
-	//	httptransport.ServerErrorEncoder(encodeError),
-	//}
+	for _, v := range Versions {
+		prefix := "/" + v.Name
+		vr := mountRoutes(mux.NewRouter().StrictSlash(false), e, v, logger)
+		r.PathPrefix(prefix + "/").Handler(http.StripPrefix(prefix, vr))
+	}
+	return mountRoutes(r, e, Versions[0], logger)
+}
 
+// mountRoutes mounts the endpoints on r, encoding responses the way v does.
+func mountRoutes(r *mux.Router, e Endpoints, v APIVersion, logger log.Logger) *mux.Router {
+	options := []httptransport.ServerOption{
+		httptransport.ServerBefore(TokenToContext, AcceptToContext, IdempotencyKeyToContext, RequestURIToContext),
+		httptransport.ServerErrorEncoder(encodeError),
+		httptransport.ServerErrorHandler(RequestIDErrorHandler(logger)),
+	}
+	r.Use(canonicalIDs)
+
+	// GET /admin/stats  Admin statistics
 	// GET /login       Login
 	// GET /register    Register
 	// GET /health      Health Check
+	// GET /live        Liveness
+	// GET /ready       Readiness
+	// POST /oauth/introspect  Token introspection
+	// POST /graphql    GraphQL queries
+	// GET /openapi.json  OpenAPI document, browsable at /docs
 
 	r.Methods("GET").Path("/login").Handler(httptransport.NewServer(
 		e.LoginEndpoint,
 		decodeLoginRequest,
-		encodeResponse,
+		v.encodeResponse,
+		options...,
 	))
 	r.Methods("POST").Path("/register").Handler(httptransport.NewServer(
 		e.RegisterEndpoint,
 		decodeRegisterRequest,
-		encodeResponse,
+		v.encodeResponse,
+		options...,
+	))
+	r.Methods("GET").Path("/register/available").Handler(httptransport.NewServer(
+		e.AvailableEndpoint,
+		decodeAvailableRequest,
+		v.encodeResponse,
+		options...,
+	))
+	r.Methods("GET").Path("/admin/customers/export").Handler(httptransport.NewServer(
+		e.ExportEndpoint,
+		decodeExportRequest,
+		encodeExportResponse,
+		options...,
+	))
+	r.Methods("GET").Path("/events/stream").Handler(httptransport.NewServer(
+		e.EventStreamEndpoint,
+		decodeEventStreamRequest,
+		encodeEventStreamResponse,
+		options...,
+	))
+	r.Methods("GET").Path("/admin/customers").Handler(httptransport.NewServer(
+		e.AdminListEndpoint,
+		decodeAdminListRequest,
+		v.encodeResponse,
+		options...,
+	))
+	r.Methods("GET").Path("/admin/cards").Handler(httptransport.NewServer(
+		e.AdminCardsEndpoint,
+		decodeAdminListRequest,
+		v.encodeResponse,
+		options...,
+	))
+	r.Methods("GET").Path("/admin/stats").Handler(httptransport.NewServer(
+		e.StatsEndpoint,
+		decodeStatsRequest,
+		v.encodeResponse,
+		options...,
+	))
+	r.Methods("GET").Path("/customers/{id}/groups").Handler(httptransport.NewServer(
+		e.UserGroupsEndpoint,
+		decodeGetRequest,
+		v.encodeResponse,
+		options...,
+	))
+	r.Methods("GET").Path("/customers/{id}/activity").Handler(httptransport.NewServer(
+		e.ActivityEndpoint,
+		decodeActivityRequest,
+		v.encodeResponse,
+		options...,
+	))
+	r.Methods("GET").Path("/customers/{id}/events").Handler(httptransport.NewServer(
+		e.NotificationsEndpoint,
+		decodeNotificationsRequest,
+		encodeNotificationsResponse,
+		append(options, httptransport.ServerBefore(QueryTokenToContext))...,
 	))
 	r.Methods("GET").PathPrefix("/customers").Handler(httptransport.NewServer(
 		e.UserGetEndpoint,
-		decodeGetRequest,
-		encodeResponse,
+		decodeUserGetRequest,
+		v.encodeResponse,
+		options...,
 	))
 	r.Methods("GET").PathPrefix("/cards").Handler(httptransport.NewServer(
 		e.CardGetEndpoint,
 		decodeGetRequest,
-		encodeResponse,
+		v.encodeResponse,
+		options...,
 	))
 	r.Methods("GET").PathPrefix("/addresses").Handler(httptransport.NewServer(
 		e.AddressGetEndpoint,
 		decodeGetRequest,
-		encodeResponse,
+		v.encodeResponse,
+		options...,
+	))
+	r.Methods("POST").Path("/customers/guest").Handler(httptransport.NewServer(
+		e.GuestEndpoint,
+		decodeGuestRequest,
+		v.encodeResponse,
+		options...,
 	))
 	r.Methods("POST").Path("/customers").Handler(httptransport.NewServer(
 		e.UserPostEndpoint,
 		decodeUserRequest,
-		encodeResponse,
+		v.encodeResponse,
+		options...,
+	))
+	r.Methods("PUT").Path("/customers/{id}").Handler(httptransport.NewServer(
+		e.UserPutEndpoint,
+		decodeUserPutRequest,
+		v.encodeResponse,
+		options...,
+	))
+	r.Methods("PATCH").Path("/customers/{id}").Handler(httptransport.NewServer(
+		e.UserPatchEndpoint,
+		decodeUserPatchRequest,
+		v.encodeResponse,
+		options...,
+	))
+	r.Methods("PUT").Path("/customers/{id}/avatar").Handler(httptransport.NewServer(
+		e.AvatarPutEndpoint,
+		decodeAvatarPutRequest,
+		v.encodeResponse,
+		options...,
+	))
+	r.Methods("PUT").Path("/customers/{id}/preferences").Handler(httptransport.NewServer(
+		e.PreferencesPutEndpoint,
+		decodePreferencesPutRequest,
+		v.encodeResponse,
+		options...,
+	))
+	r.Methods("POST").Path("/customers/{id}/phone/verification").Handler(httptransport.NewServer(
+		e.PhoneCodeEndpoint,
+		decodePhoneCodeRequest,
+		v.encodeResponse,
+		options...,
+	))
+	r.Methods("PUT").Path("/customers/{id}/phone/verification").Handler(httptransport.NewServer(
+		e.PhoneVerifyEndpoint,
+		decodePhoneVerifyRequest,
+		v.encodeResponse,
+		options...,
+	))
+	r.Methods("PUT").Path("/customers/{id}/status").Handler(httptransport.NewServer(
+		e.StatusPutEndpoint,
+		decodeStatusPutRequest,
+		v.encodeResponse,
+		options...,
+	))
+	r.Methods("POST").Path("/admin/customers/merge").Handler(httptransport.NewServer(
+		e.MergeEndpoint,
+		decodeMergeRequest,
+		v.encodeResponse,
+		options...,
+	))
+	r.Methods("PUT").Path("/admin/customers/{id}/password").Handler(httptransport.NewServer(
+		e.ResetPasswordEndpoint,
+		decodePasswordResetRequest,
+		v.encodeResponse,
+		options...,
+	))
+	r.Methods("POST").Path("/customers/{id}/username").Handler(httptransport.NewServer(
+		e.RenameEndpoint,
+		decodeRenameRequest,
+		v.encodeResponse,
+		options...,
+	))
+	r.Methods("POST").Path("/customers/{id}/addresses/import").Handler(httptransport.NewServer(
+		e.AddressImportEndpoint,
+		decodeAddressImportRequest,
+		v.encodeResponse,
+		options...,
+	))
+	r.Methods("PUT").Path("/customers/{id}/tags/{tag}").Handler(httptransport.NewServer(
+		e.TagPutEndpoint,
+		decodeTagRequest,
+		v.encodeResponse,
+		options...,
+	))
+	r.Methods("DELETE").Path("/customers/{id}/tags/{tag}").Handler(httptransport.NewServer(
+		e.TagDeleteEndpoint,
+		decodeTagRequest,
+		v.encodeResponse,
+		options...,
+	))
+	r.Methods("POST").Path("/customers/batch").Handler(httptransport.NewServer(
+		e.BatchGetEndpoint,
+		decodeBatchGetRequest,
+		v.encodeResponse,
+		options...,
+	))
+	r.Methods("POST").Path("/customers/delete").Handler(httptransport.NewServer(
+		e.BulkDeleteEndpoint,
+		decodeBulkDeleteRequest,
+		v.encodeResponse,
+		options...,
+	))
+	r.Methods("POST").Path("/batch").Handler(httptransport.NewServer(
+		e.BatchEndpoint,
+		decodeBatchRequest,
+		encodeBatchResponse,
+		options...,
 	))
 	r.Methods("POST").Path("/addresses").Handler(httptransport.NewServer(
 		e.AddressPostEndpoint,
 		decodeAddressRequest,
-		encodeResponse,
+		v.encodeResponse,
+		options...,
+	))
+	r.Methods("PATCH").Path("/addresses/{id}").Handler(httptransport.NewServer(
+		e.AddressPatchEndpoint,
+		decodeAddressPatchRequest,
+		v.encodeResponse,
+		options...,
 	))
 	r.Methods("POST").Path("/cards").Handler(httptransport.NewServer(
 		e.CardPostEndpoint,
 		decodeCardRequest,
-		encodeResponse,
+		v.encodeResponse,
+		options...,
+	))
+	r.Methods("PUT").Path("/cards/{id}").Handler(httptransport.NewServer(
+		e.CardPutEndpoint,
+		decodeCardPutRequest,
+		v.encodeResponse,
+		options...,
+	))
+	r.Methods("PUT").Path("/cards/{id}/default").Handler(httptransport.NewServer(
+		e.CardDefaultEndpoint,
+		decodeCardDefaultRequest,
+		v.encodeResponse,
+		options...,
 	))
-	r.Methods("DELETE").PathPrefix("/").Handler(httptransport.NewServer(
+	r.Methods("POST").Path("/groups").Handler(httptransport.NewServer(
+		e.GroupPostEndpoint,
+		decodeGroupPostRequest,
+		v.encodeResponse,
+		options...,
+	))
+	r.Methods("GET").Path("/groups/{id}").Handler(httptransport.NewServer(
+		e.GroupGetEndpoint,
+		decodeGroupGetRequest,
+		v.encodeResponse,
+		options...,
+	))
+	r.Methods("POST").Path("/groups/{id}/members").Handler(httptransport.NewServer(
+		e.GroupMemberPostEndpoint,
+		decodeGroupMemberPostRequest,
+		v.encodeResponse,
+		options...,
+	))
+	r.Methods("DELETE").Path("/groups/{id}/members/{userId}").Handler(httptransport.NewServer(
+		e.GroupMemberDeleteEndpoint,
+		decodeGroupMemberDeleteRequest,
+		v.encodeResponse,
+		options...,
+	))
+	r.Methods("POST").Path("/webhooks").Handler(httptransport.NewServer(
+		e.WebhookPostEndpoint,
+		decodeWebhookPostRequest,
+		v.encodeResponse,
+		options...,
+	))
+	r.Methods("GET").Path("/webhooks").Handler(httptransport.NewServer(
+		e.WebhooksGetEndpoint,
+		decodeWebhooksGetRequest,
+		v.encodeResponse,
+		options...,
+	))
+	r.Methods("GET").Path("/webhooks/{id}/deliveries").Handler(httptransport.NewServer(
+		e.WebhookDeliveriesEndpoint,
+		decodeWebhookDeliveriesRequest,
+		v.encodeResponse,
+		options...,
+	))
+	r.Methods("DELETE").Path("/webhooks/{id}").Handler(httptransport.NewServer(
+		e.WebhookDeleteEndpoint,
+		decodeWebhookDeleteRequest,
+		v.encodeResponse,
+		options...,
+	))
+	deleteHandler := httptransport.NewServer(
 		e.DeleteEndpoint,
 		decodeDeleteRequest,
-		encodeResponse,
+		v.encodeResponse,
+		options...,
+	)
+	for _, entity := range []string{"customers", "addresses", "cards", "groups"} {
+		r.Methods("DELETE").Path("/" + entity + "/{id}").Handler(deleteHandler)
+	}
+	r.Methods("POST").Path("/oauth/introspect").Handler(httptransport.NewServer(
+		e.IntrospectEndpoint,
+		decodeIntrospectRequest,
+		encodeIntrospectResponse,
+		options...,
+	))
+	r.Methods("GET", "POST").Path("/graphql").Handler(httptransport.NewServer(
+		e.GraphQLEndpoint,
+		decodeGraphQLRequest,
+		encodeGraphQLResponse,
+		options...,
 	))
 	r.Methods("GET").PathPrefix("/health").Handler(httptransport.NewServer(
 		e.HealthEndpoint,
 		decodeHealthRequest,
 		encodeHealthResponse,
+		options...,
 	))
+	r.Methods("GET").Path("/live").Handler(httptransport.NewServer(
+		e.LiveEndpoint,
+		decodeHealthRequest,
+		encodeHealthResponse,
+		options...,
+	))
+	r.Methods("GET").Path("/ready").Handler(httptransport.NewServer(
+		e.ReadyEndpoint,
+		decodeHealthRequest,
+		encodeReadyResponse,
+		options...,
+	))
+	r.Methods("GET").Path("/openapi.json").Handler(OpenAPIHandler(v))
+	r.Methods("GET").Path("/docs").Handler(SwaggerUIHandler())
 	r.Handle("/metrics", promhttp.Handler())
+	r.MethodNotAllowedHandler = methodsHandler(r)
 	return r
 }
 
-func encodeError(_ context.Context, err error, w http.ResponseWriter) {
+func encodeError(ctx context.Context, err error, w http.ResponseWriter) {
+	if errors.Is(err, ErrMFARequired) {
+		w.Header().Set("WWW-Authenticate", `MFA realm="user"`)
+	}
+	code, body := errorResponse(ctx, err)
+	writeResponse(ctx, w, code, body)
+}
+
+// errorResponse returns the status code of err and the body describing it,
+// the same for every transport.
+func errorResponse(ctx context.Context, err error) (int, map[string]interface{}) {
 	code := http.StatusInternalServerError
-	switch err {
-	case ErrUnauthorized:
+	var mbe *http.MaxBytesError
+	switch {
+	case errors.As(err, &mbe):
+		code = http.StatusRequestEntityTooLarge
+	case errors.Is(err, ErrUnauthorized):
 		code = http.StatusUnauthorized
+	case errors.Is(err, ErrForbidden), errors.Is(err, ErrLoginBlocked), errors.Is(err, ErrInactive):
+		code = http.StatusForbidden
+	case errors.Is(err, ErrMFARequired):
+		code = http.StatusUnauthorized
+	case errors.Is(err, ErrAccountLocked):
+		code = http.StatusTooManyRequests
+	case errors.Is(err, users.ErrInvalidTransition), errors.Is(err, db.ErrConflict), errors.Is(err, ErrQuotaExceeded), errors.Is(err, ErrIdempotencyKeyInUse), errors.Is(err, patch.ErrTestFailed):
+		code = http.StatusConflict
+	case errors.Is(err, ErrInvalidScope), errors.Is(err, ErrInvalidRequest):
+		code = http.StatusBadRequest
+	case errors.Is(err, ErrIdempotencyKeyReused):
+		code = http.StatusUnprocessableEntity
+	case errors.Is(err, ErrTimeout):
+		code = http.StatusGatewayTimeout
+	case errors.Is(err, ErrMethodNotAllowed):
+		code = http.StatusMethodNotAllowed
 	}
-	w.WriteHeader(code)
-	w.Header().Set("Content-Type", "application/hal+json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
+	body := map[string]interface{}{
 		"error":       err.Error(),
 		"status_code": code,
 		"status_text": http.StatusText(code),
-	})
+	}
+	var ce *db.ConflictError
+	if errors.As(err, &ce) && ce.Field != "" {
+		body["field"] = ce.Field
+	}
+	var fe *users.FieldError
+	if errors.As(err, &fe) {
+		body["field"] = fe.Field
+	}
+	var ve *ValidationError
+	if errors.As(err, &ve) && len(ve.Fields) > 0 {
+		body["field"] = ve.Fields[0].Field
+		body["fields"] = ve.Fields
+	}
+	var qe *QuotaError
+	if errors.As(err, &qe) {
+		body["resource"] = qe.Resource
+		body["limit"] = qe.Limit
+	}
+	if id := RequestID(ctx); id != "" {
+		body["request_id"] = id
+	}
+	return code, body
 }
 
 func decodeLoginRequest(_ context.Context, r *http.Request) (interface{}, error) {
@@ -111,18 +453,97 @@ func decodeLoginRequest(_ context.Context, r *http.Request) (interface{}, error)
 	return loginRequest{
 		Username: u,
 		Password: p,
+		Scopes:   strings.Fields(r.URL.Query().Get("scope")),
+		Client:   clientInfo(r),
 	}, nil
 }
 
+// clientInfo collects what we know about the caller. The address is the one
+// ProxyHandler resolved, the peer's without it. The country is set by the
+// edge proxy, the device id by our own clients.
+func clientInfo(r *http.Request) risk.Client {
+	ip, ok := r.Context().Value(clientIPContextKey).(string)
+	if !ok {
+		ip = TrustedProxies(nil).ClientIP(r)
+	}
+	return risk.Client{
+		IP:        ip,
+		Country:   r.Header.Get("X-Country-Code"),
+		UserAgent: r.UserAgent(),
+		DeviceID:  r.Header.Get("X-Device-ID"),
+	}
+}
+
 func decodeRegisterRequest(_ context.Context, r *http.Request) (interface{}, error) {
 	reg := registerRequest{}
-	err := json.NewDecoder(r.Body).Decode(&reg)
+	err := decodeJSON(r.Body, &reg)
 	if err != nil {
 		return nil, err
 	}
 	return reg, nil
 }
 
+func decodeGuestRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	return struct{}{}, nil
+}
+
+func decodeAvailableRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	v := r.URL.Query()
+	return availableRequest{
+		Username: v.Get("username"),
+		Email:    v.Get("email"),
+	}, nil
+}
+
+// rejectCVVQuery rejects filtering, sorting or selecting by the card
+// verification value, which is never stored.
+func rejectCVVQuery(v url.Values) error {
+	for k := range v {
+		if users.IsCVVField(k) {
+			return invalid(fmt.Errorf(users.ErrInvalidField, k))
+		}
+	}
+	for _, k := range []string{"fields", "sort"} {
+		for _, f := range strings.Split(v.Get(k), ",") {
+			if users.IsCVVField(f) {
+				return invalid(fmt.Errorf(users.ErrInvalidField, f))
+			}
+		}
+	}
+	return nil
+}
+
+// canonicalIDs spells the ids in the path the way they are stored, see
+// db.CanonicalID, so ids of every format are found however they are
+// typed.
+func canonicalIDs(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		segments := strings.Split(r.URL.Path, "/")
+		changed := false
+		for _, name := range []string{"id", "userId"} {
+			id, ok := vars[name]
+			if !ok || db.CanonicalID(id) == id {
+				continue
+			}
+			vars[name] = db.CanonicalID(id)
+			for k, s := range segments {
+				if s == id {
+					segments[k] = vars[name]
+				}
+			}
+			changed = true
+		}
+		if changed {
+			u := *r.URL
+			u.Path, u.RawPath = strings.Join(segments, "/"), ""
+			r = mux.SetURLVars(r, vars)
+			r.URL = &u
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 func decodeDeleteRequest(_ context.Context, r *http.Request) (interface{}, error) {
 	d := deleteRequest{}
 	u := strings.Split(r.URL.Path, "/")
@@ -134,8 +555,16 @@ func decodeDeleteRequest(_ context.Context, r *http.Request) (interface{}, error
 	return d, ErrInvalidRequest
 }
 
+// decodeGetRequest reads the entity id and attribute from the path, and
+// ?type= to filter addresses by.
 func decodeGetRequest(_ context.Context, r *http.Request) (interface{}, error) {
-	g := GetRequest{}
+	if err := rejectCVVQuery(r.URL.Query()); err != nil {
+		return nil, err
+	}
+	g := GetRequest{Type: r.URL.Query().Get("type")}
+	if !users.ValidAddressType(g.Type) {
+		return nil, invalid(fmt.Errorf(users.ErrInvalidField, "type"))
+	}
 	u := strings.Split(r.URL.Path, "/")
 	if len(u) > 2 {
 		g.ID = u[2]
@@ -146,20 +575,481 @@ func decodeGetRequest(_ context.Context, r *http.Request) (interface{}, error) {
 	return g, nil
 }
 
+// decodeUserGetRequest also reads the listing filters and the fields to
+// return:
+// ?email=&lastName=&status=&tag=&metadata.<key>=&createdAfter=&updatedAfter=<RFC 3339>&sort=[-]<field>&fields=<field>,...
+func decodeUserGetRequest(ctx context.Context, r *http.Request) (interface{}, error) {
+	req, err := decodeGetRequest(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	g := req.(GetRequest)
+	v := r.URL.Query()
+	if f := v.Get("fields"); f != "" {
+		g.Fields = strings.Split(f, ",")
+	}
+	if e := v.Get("expand"); e != "" {
+		g.Expand = strings.Split(e, ",")
+		for _, a := range g.Expand {
+			if !contains(db.Expandable, a) {
+				return nil, invalid(&users.FieldError{Field: "expand", Reason: a + " is not one of " + strings.Join(db.Expandable, ", ")})
+			}
+		}
+	}
+	g.Query = db.UserQuery{
+		Email:    v.Get("email"),
+		LastName: v.Get("lastName"),
+		Status:   v.Get("status"),
+		Tag:      v.Get("tag"),
+		Sort:     v.Get("sort"),
+		Fields:   g.Fields,
+	}
+	for k := range v {
+		if strings.HasPrefix(k, "metadata.") {
+			if g.Query.Metadata == nil {
+				g.Query.Metadata = map[string]string{}
+			}
+			g.Query.Metadata[strings.TrimPrefix(k, "metadata.")] = v.Get(k)
+		}
+	}
+	for k, f := range map[string]*time.Time{
+		"createdAfter": &g.Query.CreatedAfter,
+		"updatedAfter": &g.Query.UpdatedAfter,
+	} {
+		if s := v.Get(k); s != "" {
+			t, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				return nil, invalid(err)
+			}
+			*f = t
+		}
+	}
+	if err := g.Query.Validate(); err != nil {
+		return nil, invalid(err)
+	}
+	return g, nil
+}
+
 func decodeUserRequest(_ context.Context, r *http.Request) (interface{}, error) {
 	defer r.Body.Close()
 	u := users.User{}
-	err := json.NewDecoder(r.Body).Decode(&u)
+	err := decodeJSON(r.Body, &u)
 	if err != nil {
 		return nil, err
 	}
 	return u, nil
 }
 
+func decodeUserPutRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	defer r.Body.Close()
+	u := userUpdateRequest{ID: mux.Vars(r)["id"]}
+	err := decodeJSON(r.Body, &u.Update)
+	if err != nil {
+		return nil, invalid(err)
+	}
+	return u, nil
+}
+
+// decodeUserPatchRequest reads a JSON merge patch (RFC 7396) of the profile.
+// A null member clears the field, unknown members are rejected. JSON Patch
+// documents are applied by the service to the stored profile instead.
+func decodeUserPatchRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	defer r.Body.Close()
+	if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt == patch.MediaTypeJSONPatch {
+		p, err := patch.Decode(mt, r.Body)
+		if err != nil {
+			return nil, invalid(err)
+		}
+		return userUpdateRequest{ID: mux.Vars(r)["id"], Patch: p}, nil
+	}
+	var patch map[string]json.RawMessage
+	if err := decodeJSON(r.Body, &patch); err != nil {
+		return nil, invalid(err)
+	}
+	u := userUpdateRequest{ID: mux.Vars(r)["id"]}
+	fields := map[string]**string{
+		"firstName": &u.Update.FirstName,
+		"lastName":  &u.Update.LastName,
+		"email":     &u.Update.Email,
+		"locale":    &u.Update.Locale,
+		"timezone":  &u.Update.Timezone,
+	}
+	for k, v := range patch {
+		if k == "metadata" {
+			if string(v) == "null" {
+				return nil, invalid(errors.New("metadata can't be removed as a whole"))
+			}
+			if err := json.Unmarshal(v, &u.Update.Metadata); err != nil {
+				return nil, invalid(err)
+			}
+			continue
+		}
+		f, ok := fields[k]
+		if !ok {
+			return nil, invalid(fmt.Errorf("unknown field %v", k))
+		}
+		s := ""
+		if string(v) != "null" {
+			if err := json.Unmarshal(v, &s); err != nil {
+				return nil, invalid(err)
+			}
+		}
+		*f = &s
+	}
+	return u, nil
+}
+
+// decodePreferencesPutRequest reads the full preferences document. Omitted
+// members fall back to their defaults, unknown members are rejected.
+func decodePreferencesPutRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	defer r.Body.Close()
+	req := preferencesPutRequest{ID: mux.Vars(r)["id"]}
+	if err := decodeBody(r.Body, &req.Preferences, true); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// decodeCardPutRequest reads the expiry and holder to set. The number can't
+// be changed, a longNum member is rejected like any other unknown member.
+func decodeCardPutRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	defer r.Body.Close()
+	req := cardPutRequest{ID: mux.Vars(r)["id"]}
+	if err := decodeBody(r.Body, &req.Update, true); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+func decodeAddressPatchRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	defer r.Body.Close()
+	p, err := patch.Decode(r.Header.Get("Content-Type"), r.Body)
+	if err != nil {
+		return nil, invalid(err)
+	}
+	return addressPatchRequest{ID: mux.Vars(r)["id"], Patch: p}, nil
+}
+
+func decodeCardDefaultRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	return cardDefaultRequest{ID: mux.Vars(r)["id"]}, nil
+}
+
+func decodePhoneCodeRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	return phoneVerifyRequest{ID: mux.Vars(r)["id"]}, nil
+}
+
+func decodePhoneVerifyRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	defer r.Body.Close()
+	req := phoneVerifyRequest{ID: mux.Vars(r)["id"]}
+	if err := decodeJSON(r.Body, &req); err != nil {
+		return nil, invalid(err)
+	}
+	return req, nil
+}
+
+func decodeStatusPutRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	defer r.Body.Close()
+	req := statusPutRequest{ID: mux.Vars(r)["id"]}
+	if err := decodeJSON(r.Body, &req); err != nil {
+		return nil, invalid(err)
+	}
+	return req, nil
+}
+
+// decodeAdminListRequest reads ?cursor=&limit=
+func decodeAdminListRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	v := r.URL.Query()
+	req := adminListRequest{Cursor: v.Get("cursor")}
+	if l := v.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil {
+			return nil, invalid(err)
+		}
+		req.Limit = n
+	}
+	return req, nil
+}
+
+// decodeActivityRequest reads ?cursor=&limit=
+func decodeActivityRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	v := r.URL.Query()
+	req := activityRequest{ID: mux.Vars(r)["id"], Cursor: v.Get("cursor")}
+	if l := v.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil {
+			return nil, invalid(err)
+		}
+		req.Limit = n
+	}
+	return req, nil
+}
+
+// decodeExportRequest reads ?format=csv&mask=<column>,... Without mask the
+// DefaultExportMask applies, an empty one masks nothing.
+func decodeExportRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	v := r.URL.Query()
+	if f := v.Get("format"); f != "" && f != "csv" {
+		return nil, invalid(fmt.Errorf("unsupported format %v", f))
+	}
+	req := exportRequest{Mask: DefaultExportMask}
+	if m, ok := v["mask"]; ok {
+		req.Mask = nil
+		if m[0] != "" {
+			req.Mask = strings.Split(m[0], ",")
+		}
+	}
+	if err := validExportMask(req.Mask); err != nil {
+		return nil, invalid(err)
+	}
+	return req, nil
+}
+
+func encodeExportResponse(_ context.Context, w http.ResponseWriter, response interface{}) error {
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", `attachment; filename="customers.csv"`)
+	return response.(exportResponse).Write(w)
+}
+
+// decodeEventStreamRequest reads the Last-Event-ID header sent by
+// reconnecting EventSource clients.
+func decodeEventStreamRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	return eventStreamRequest{LastEventID: r.Header.Get("Last-Event-ID")}, nil
+}
+
+func encodeEventStreamResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	return writeEvents(ctx, w, response.(eventStreamResponse).Subscription)
+}
+
+// decodeNotificationsRequest only accepts WebSocket upgrades.
+func decodeNotificationsRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	if !websocket.IsWebSocketUpgrade(r) {
+		return nil, invalid(errors.New("expected a WebSocket upgrade"))
+	}
+	return notificationsRequest{ID: mux.Vars(r)["id"], upgrade: r}, nil
+}
+
+func encodeNotificationsResponse(_ context.Context, w http.ResponseWriter, response interface{}) error {
+	resp := response.(notificationsResponse)
+	return serveNotifications(w, resp.upgrade, resp.Subscription)
+}
+
+// DefaultStatsDays is the signup history served without ?days=
+const DefaultStatsDays = 30
+
+func decodeStatsRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	req := statsRequest{Days: DefaultStatsDays}
+	if d := r.URL.Query().Get("days"); d != "" {
+		n, err := strconv.Atoi(d)
+		if err != nil {
+			return nil, invalid(err)
+		}
+		req.Days = n
+	}
+	return req, nil
+}
+
+func decodeGroupPostRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	defer r.Body.Close()
+	var req groupPostRequest
+	if err := decodeJSON(r.Body, &req.Group); err != nil {
+		return nil, invalid(err)
+	}
+	return req, nil
+}
+
+func decodeWebhookPostRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	defer r.Body.Close()
+	var req webhookPostRequest
+	if err := decodeJSON(r.Body, &req.Webhook); err != nil {
+		return nil, invalid(err)
+	}
+	return req, nil
+}
+
+func decodeWebhooksGetRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	return webhooksGetRequest{}, nil
+}
+
+func decodeWebhookDeleteRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	return webhookDeleteRequest{ID: mux.Vars(r)["id"]}, nil
+}
+
+// decodeWebhookDeliveriesRequest reads ?cursor=&limit=
+func decodeWebhookDeliveriesRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	v := r.URL.Query()
+	req := webhookDeliveriesRequest{ID: mux.Vars(r)["id"], Cursor: v.Get("cursor")}
+	if l := v.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil {
+			return nil, invalid(err)
+		}
+		req.Limit = n
+	}
+	return req, nil
+}
+
+func decodeGroupGetRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	return groupGetRequest{ID: mux.Vars(r)["id"]}, nil
+}
+
+func decodeGroupMemberPostRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	defer r.Body.Close()
+	req := groupMemberRequest{GroupID: mux.Vars(r)["id"]}
+	if err := decodeJSON(r.Body, &req); err != nil {
+		return nil, invalid(err)
+	}
+	return req, nil
+}
+
+func decodeGroupMemberDeleteRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	v := mux.Vars(r)
+	return groupMemberRequest{GroupID: v["id"], UserID: v["userId"], Removing: true}, nil
+}
+
+func decodeMergeRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	defer r.Body.Close()
+	var req mergeRequest
+	if err := decodeJSON(r.Body, &req); err != nil {
+		return nil, invalid(err)
+	}
+	return req, nil
+}
+
+func decodePasswordResetRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	defer r.Body.Close()
+	req := passwordResetRequest{ID: mux.Vars(r)["id"]}
+	if err := decodeJSON(r.Body, &req); err != nil {
+		return nil, invalid(err)
+	}
+	return req, nil
+}
+
+func decodeRenameRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	defer r.Body.Close()
+	req := renameRequest{ID: mux.Vars(r)["id"]}
+	if err := decodeJSON(r.Body, &req); err != nil {
+		return nil, invalid(err)
+	}
+	return req, nil
+}
+
+// decodeAddressImportRequest reads a JSON array of addresses.
+func decodeAddressImportRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	defer r.Body.Close()
+	req := addressImportRequest{UserID: mux.Vars(r)["id"]}
+	if err := decodeJSON(r.Body, &req.Addresses); err != nil {
+		return nil, invalid(err)
+	}
+	return req, nil
+}
+
+// decodeBatchRequest reads the operations of a batch. Each names the POST
+// route it stands for and carries the body that route takes.
+func decodeBatchRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	defer r.Body.Close()
+	var b batchBody
+	if err := decodeJSON(r.Body, &b); err != nil {
+		return nil, invalid(err)
+	}
+	req := batchRequest{Operations: make([]BatchOperation, len(b.Operations))}
+	for i, o := range b.Operations {
+		op, err := decodeBatchOperation(o)
+		if err != nil {
+			return nil, invalid(fmt.Errorf("operation %v: %w", i, err))
+		}
+		req.Operations[i] = op
+	}
+	return req, nil
+}
+
+func decodeBatchOperation(o batchOperationBody) (BatchOperation, error) {
+	op := BatchOperation{Ref: o.Ref}
+	if o.Method != "POST" {
+		return op, &users.FieldError{Field: "method", Reason: "only POST is supported"}
+	}
+	if len(o.Body) == 0 {
+		return op, &users.FieldError{Field: "body", Reason: "required"}
+	}
+	body := bytes.NewReader(o.Body)
+	switch o.Path {
+	case "/customers":
+		var u users.User
+		if err := decodeJSON(body, &u); err != nil {
+			return op, err
+		}
+		op.Customer = &u
+	case "/addresses":
+		var a addressPostRequest
+		if err := decodeJSON(body, &a); err != nil {
+			return op, err
+		}
+		if err := validateRequest(a); err != nil {
+			return op, err
+		}
+		op.Address, op.UserID = &a.Address, a.UserID
+	case "/cards":
+		var c cardPostRequest
+		if err := decodeJSON(body, &c); err != nil {
+			return op, err
+		}
+		if err := validateRequest(c); err != nil {
+			return op, err
+		}
+		op.Card, op.UserID = &c.Card, c.UserID
+	default:
+		return op, &users.FieldError{Field: "path", Reason: "not one of /customers /addresses /cards"}
+	}
+	return op, nil
+}
+
+func decodeTagRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	v := mux.Vars(r)
+	return tagRequest{ID: v["id"], Tag: v["tag"]}, nil
+}
+
+// MaxAvatarSize is the largest avatar upload accepted, in bytes.
+const MaxAvatarSize = 10 << 20
+
+// decodeAvatarPutRequest reads the image from the "avatar" part of a
+// multipart form.
+func decodeAvatarPutRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	r.Body = http.MaxBytesReader(nil, r.Body, MaxAvatarSize)
+	defer r.Body.Close()
+	f, _, err := r.FormFile("avatar")
+	if err != nil {
+		return nil, invalid(err)
+	}
+	defer f.Close()
+	img, err := io.ReadAll(f)
+	if err != nil {
+		return nil, invalid(err)
+	}
+	return avatarPutRequest{ID: mux.Vars(r)["id"], Image: img}, nil
+}
+
+func decodeBulkDeleteRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	defer r.Body.Close()
+	d := bulkDeleteRequest{}
+	err := decodeJSON(r.Body, &d)
+	if err != nil {
+		return nil, invalid(err)
+	}
+	return d, nil
+}
+
+func decodeBatchGetRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	defer r.Body.Close()
+	b := batchGetRequest{}
+	if err := decodeJSON(r.Body, &b); err != nil {
+		return nil, invalid(err)
+	}
+	return b, nil
+}
+
 func decodeAddressRequest(_ context.Context, r *http.Request) (interface{}, error) {
 	defer r.Body.Close()
 	a := addressPostRequest{}
-	err := json.NewDecoder(r.Body).Decode(&a)
+	err := decodeJSON(r.Body, &a)
 	if err != nil {
 		return nil, err
 	}
@@ -169,23 +1059,100 @@ func decodeAddressRequest(_ context.Context, r *http.Request) (interface{}, erro
 func decodeCardRequest(_ context.Context, r *http.Request) (interface{}, error) {
 	defer r.Body.Close()
 	c := cardPostRequest{}
-	err := json.NewDecoder(r.Body).Decode(&c)
+	err := decodeJSON(r.Body, &c)
 	if err != nil {
 		return nil, err
 	}
 	return c, nil
 }
 
+func decodeIntrospectRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	// RFC 7662 requests are form encoded.
+	if err := r.ParseForm(); err != nil {
+		return nil, err
+	}
+	t := r.PostForm.Get("token")
+	if t == "" {
+		return nil, ErrInvalidRequest
+	}
+	req := introspectRequest{Token: t}
+	req.ClientID, req.ClientSecret, _ = r.BasicAuth()
+	return req, nil
+}
+
+func encodeIntrospectResponse(_ context.Context, w http.ResponseWriter, response interface{}) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	return json.NewEncoder(w).Encode(response)
+}
+
+// decodeGraphQLRequest reads a query posted as JSON or, on GET, from the
+// query, variables and operationName parameters.
+func decodeGraphQLRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	g := graphqlRequest{}
+	if r.Method == "GET" {
+		q := r.URL.Query()
+		g.Query, g.OperationName = q.Get("query"), q.Get("operationName")
+		if v := q.Get("variables"); v != "" {
+			if err := json.Unmarshal([]byte(v), &g.Variables); err != nil {
+				return nil, invalid(err)
+			}
+		}
+	} else {
+		defer r.Body.Close()
+		if err := decodeJSON(r.Body, &g); err != nil {
+			return nil, invalid(err)
+		}
+	}
+	if g.Query == "" {
+		return nil, invalid(errors.New("missing query"))
+	}
+	return g, nil
+}
+
+func encodeGraphQLResponse(_ context.Context, w http.ResponseWriter, response interface{}) error {
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(response)
+}
+
 func decodeHealthRequest(_ context.Context, r *http.Request) (interface{}, error) {
-	return struct{}{}, nil
+	var req healthRequest
+	if d := r.URL.Query().Get("deep"); d != "" {
+		deep, err := strconv.ParseBool(d)
+		if err != nil {
+			return nil, invalid(err)
+		}
+		req.Deep = deep
+	}
+	return req, nil
 }
 
 func encodeHealthResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
 	return encodeResponse(ctx, w, response.(healthResponse))
 }
 
-func encodeResponse(_ context.Context, w http.ResponseWriter, response interface{}) error {
-	// All of our response objects are JSON serializable, so we just do that.
-	w.Header().Set("Content-Type", "application/hal+json")
-	return json.NewEncoder(w).Encode(response)
+// encodeReadyResponse answers 503 Service Unavailable while the service is
+// not ready, so load balancers send its requests elsewhere.
+func encodeReadyResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	health := response.(healthResponse)
+	if !health.ok() {
+		return writeResponse(ctx, w, http.StatusServiceUnavailable, health)
+	}
+	return encodeResponse(ctx, w, health)
+}
+
+// encodeBatchResponse answers 422 Unprocessable Entity when the batch was
+// undone, the results telling which operation failed.
+func encodeBatchResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	resp := response.(batchResponse)
+	if !resp.Committed {
+		return writeResponse(ctx, w, http.StatusUnprocessableEntity, resp)
+	}
+	return encodeResponse(ctx, w, resp)
+}
+
+func encodeResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	// All of our response objects are JSON serializable, the binary encodings
+	// are derived from that.
+	return writeResponse(ctx, w, 0, response)
 }
@@ -0,0 +1,336 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+	"user/db"
+	"user/patch"
+	"user/users"
+)
+
+func TestDecodeUserPatchRequest(t *testing.T) {
+	r := httptest.NewRequest("PATCH", "/customers/57a98d98e4b00679b4a830af", strings.NewReader(`{"lastName":"Smith","email":null}`))
+	r = mux.SetURLVars(r, map[string]string{"id": "57a98d98e4b00679b4a830af"})
+	req, err := decodeUserPatchRequest(context.Background(), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := req.(userUpdateRequest)
+	if u.ID != "57a98d98e4b00679b4a830af" {
+		t.Error("expected id from path")
+	}
+	if u.Update.FirstName != nil || *u.Update.LastName != "Smith" || *u.Update.Email != "" {
+		t.Errorf("unexpected update %+v", u.Update)
+	}
+	r = httptest.NewRequest("PATCH", "/customers/1", strings.NewReader(`{"username":"x"}`))
+	if _, err := decodeUserPatchRequest(context.Background(), r); err == nil {
+		t.Error("expected unknown field to be rejected")
+	}
+}
+
+func TestDecodeUserPatchMetadata(t *testing.T) {
+	r := httptest.NewRequest("PATCH", "/customers/1", strings.NewReader(`{"metadata":{"crm_id":"42","legacy":null}}`))
+	req, err := decodeUserPatchRequest(context.Background(), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := req.(userUpdateRequest).Update.Metadata
+	if len(m) != 2 || *m["crm_id"] != "42" || m["legacy"] != nil {
+		t.Errorf("unexpected metadata patch %v", m)
+	}
+	r = httptest.NewRequest("PATCH", "/customers/1", strings.NewReader(`{"metadata":null}`))
+	if _, err := decodeUserPatchRequest(context.Background(), r); err == nil {
+		t.Error("expected null metadata to be rejected")
+	}
+}
+
+func TestDecodeUserGetRequest(t *testing.T) {
+	r := httptest.NewRequest("GET", "/customers?lastName=Smith&createdAfter=2016-08-01T00:00:00Z&sort=-createdAt", nil)
+	req, err := decodeUserGetRequest(context.Background(), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := req.(GetRequest).Query
+	if q.LastName != "Smith" || q.CreatedAfter.Year() != 2016 || q.Sort != "-createdAt" {
+		t.Errorf("unexpected query %+v", q)
+	}
+	r = httptest.NewRequest("GET", "/customers?metadata.crm_id=42", nil)
+	req, _ = decodeUserGetRequest(context.Background(), r)
+	if q := req.(GetRequest).Query; q.Metadata["crm_id"] != "42" {
+		t.Errorf("expected metadata filter, got %+v", q)
+	}
+	r = httptest.NewRequest("GET", "/customers/1?fields=username,status", nil)
+	req, err = decodeUserGetRequest(context.Background(), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g := req.(GetRequest); len(g.Fields) != 2 || g.Fields[1] != "status" || len(g.Query.Fields) != 2 {
+		t.Errorf("unexpected fields %+v", g)
+	}
+	r = httptest.NewRequest("GET", "/customers/1?expand=addresses,cards", nil)
+	req, _ = decodeUserGetRequest(context.Background(), r)
+	if g := req.(GetRequest); len(g.Expand) != 2 || g.Expand[1] != "cards" {
+		t.Errorf("expected addresses and cards expanded, got %+v", g)
+	}
+	r = httptest.NewRequest("GET", "/customers/1/addresses?type=billing", nil)
+	req, _ = decodeUserGetRequest(context.Background(), r)
+	if g := req.(GetRequest); g.Type != "billing" {
+		t.Errorf("expected address type filter, got %+v", g)
+	}
+	for _, bad := range []string{"/customers?createdAfter=yesterday", "/customers?sort=password", "/customers?fields=password", "/addresses?type=home", "/cards?ccv=123", "/cards/1?fields=cvv", "/customers?sort=-cards.cvc", "/customers/1?expand=groups"} {
+		if _, err := decodeUserGetRequest(context.Background(), httptest.NewRequest("GET", bad, nil)); err == nil {
+			t.Errorf("expected %v to be rejected", bad)
+		}
+	}
+}
+
+func TestDecodePreferencesPutRequest(t *testing.T) {
+	r := httptest.NewRequest("PUT", "/customers/1/preferences", strings.NewReader(`{"newsletter":true,"theme":"dark"}`))
+	r = mux.SetURLVars(r, map[string]string{"id": "1"})
+	req, err := decodePreferencesPutRequest(context.Background(), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := req.(preferencesPutRequest)
+	if p.ID != "1" || !p.Preferences.Newsletter || p.Preferences.Theme != "dark" || p.Preferences.Currency != "" {
+		t.Errorf("unexpected request %+v", p)
+	}
+	r = httptest.NewRequest("PUT", "/customers/1/preferences", strings.NewReader(`{"font":"serif"}`))
+	if _, err := decodePreferencesPutRequest(context.Background(), r); err == nil {
+		t.Error("expected unknown field to be rejected")
+	}
+}
+
+func TestDecodeAddressImportRequest(t *testing.T) {
+	r := httptest.NewRequest("POST", "/customers/1/addresses/import", strings.NewReader(`[{"street":"High Street"},{"street":"Low Street","type":"billing"}]`))
+	r = mux.SetURLVars(r, map[string]string{"id": "1"})
+	req, err := decodeAddressImportRequest(context.Background(), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a := req.(addressImportRequest); a.UserID != "1" || len(a.Addresses) != 2 || a.Addresses[1].Type != "billing" {
+		t.Errorf("unexpected request %+v", a)
+	}
+	r = httptest.NewRequest("POST", "/customers/1/addresses/import", strings.NewReader(`{"street":"High Street"}`))
+	if _, err := decodeAddressImportRequest(context.Background(), r); !errors.Is(err, ErrInvalidRequest) {
+		t.Error("expected a single address to be rejected")
+	}
+}
+
+func TestDecodePhoneVerifyRequest(t *testing.T) {
+	r := httptest.NewRequest("PUT", "/customers/1/phone/verification", strings.NewReader(`{"code":"123456"}`))
+	r = mux.SetURLVars(r, map[string]string{"id": "1"})
+	req, err := decodePhoneVerifyRequest(context.Background(), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := req.(phoneVerifyRequest); p.ID != "1" || p.Code != "123456" {
+		t.Errorf("unexpected request %+v", p)
+	}
+}
+
+func TestDecodeGraphQLRequest(t *testing.T) {
+	r := httptest.NewRequest("POST", "/graphql", strings.NewReader(`{"query":"query U($id: ID!) { user(id: $id) { id } }","variables":{"id":"1"}}`))
+	req, err := decodeGraphQLRequest(context.Background(), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g := req.(graphqlRequest); g.Variables["id"] != "1" || !strings.HasPrefix(g.Query, "query U") {
+		t.Errorf("unexpected request %+v", g)
+	}
+	r = httptest.NewRequest("GET", `/graphql?query={user(id:"1"){id}}&operationName=U&variables={"a":1}`, nil)
+	req, err = decodeGraphQLRequest(context.Background(), r)
+	if g, _ := req.(graphqlRequest); err != nil || g.OperationName != "U" || g.Variables["a"] != 1.0 {
+		t.Errorf("unexpected request %+v %v", g, err)
+	}
+	r = httptest.NewRequest("GET", "/graphql", nil)
+	if _, err := decodeGraphQLRequest(context.Background(), r); !errors.Is(err, ErrInvalidRequest) {
+		t.Error("expected a request without query to be rejected")
+	}
+}
+
+func TestDecodeCardPutRequest(t *testing.T) {
+	r := httptest.NewRequest("PUT", "/cards/1", strings.NewReader(`{"expires":"01/29","holder":"Eve Smith"}`))
+	r = mux.SetURLVars(r, map[string]string{"id": "1"})
+	req, err := decodeCardPutRequest(context.Background(), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := req.(cardPutRequest)
+	if c.ID != "1" || *c.Update.Expires != "01/29" || *c.Update.Holder != "Eve Smith" {
+		t.Errorf("unexpected request %+v", c)
+	}
+	r = httptest.NewRequest("PUT", "/cards/1", strings.NewReader(`{"longNum":"4111111111111111"}`))
+	if _, err := decodeCardPutRequest(context.Background(), r); err == nil {
+		t.Error("expected number change to be rejected")
+	}
+}
+
+func TestEncodeConflictError(t *testing.T) {
+	w := httptest.NewRecorder()
+	encodeError(context.Background(), &db.ConflictError{Field: "email"}, w)
+	if w.Code != http.StatusConflict {
+		t.Errorf("expected 409, got %v", w.Code)
+	}
+	var body map[string]interface{}
+	json.NewDecoder(w.Body).Decode(&body)
+	if body["field"] != "email" {
+		t.Errorf("expected conflicting field in body, got %v", body)
+	}
+}
+
+func TestEncodeQuotaError(t *testing.T) {
+	w := httptest.NewRecorder()
+	encodeError(context.Background(), &QuotaError{Resource: "cards", Limit: 10}, w)
+	if w.Code != http.StatusConflict {
+		t.Errorf("expected 409, got %v", w.Code)
+	}
+	var body map[string]interface{}
+	json.NewDecoder(w.Body).Decode(&body)
+	if body["resource"] != "cards" || body["limit"] != float64(10) {
+		t.Errorf("expected quota in body, got %v", body)
+	}
+}
+
+func TestEncodeFieldError(t *testing.T) {
+	w := httptest.NewRecorder()
+	encodeError(context.Background(), invalid(&users.FieldError{Field: "longNum", Reason: "not a card number"}), w)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %v", w.Code)
+	}
+	var body map[string]interface{}
+	json.NewDecoder(w.Body).Decode(&body)
+	if body["field"] != "longNum" {
+		t.Errorf("expected invalid field in body, got %v", body)
+	}
+}
+
+type readyStub struct {
+	Service
+	health []Health
+}
+
+func (s readyStub) Ready(ctx context.Context) []Health {
+	return s.health
+}
+
+func TestProbes(t *testing.T) {
+	stub := readyStub{health: []Health{{Service: "user", Status: "OK"}, {Service: "user-db", Status: "err"}}}
+	r := mountRoutes(mux.NewRouter(), MakeEndpoints(stub), V1, log.NewNopLogger())
+	for path, code := range map[string]int{"/live": http.StatusOK, "/ready": http.StatusServiceUnavailable} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != code || !strings.Contains(w.Body.String(), `"service":"user"`) {
+			t.Errorf("expected %v from %v, got %v %v", code, path, w.Code, w.Body)
+		}
+	}
+	stub.health[1].Status = "OK"
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/ready", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected ready, got %v %v", w.Code, w.Body)
+	}
+}
+
+func TestDecodeHealthRequest(t *testing.T) {
+	req, err := decodeHealthRequest(context.Background(), httptest.NewRequest("GET", "/health?deep=true", nil))
+	if err != nil || !req.(healthRequest).Deep {
+		t.Errorf("expected a deep health request, got %v %v", req, err)
+	}
+	if req, _ := decodeHealthRequest(context.Background(), httptest.NewRequest("GET", "/health", nil)); req.(healthRequest).Deep {
+		t.Error("expected shallow health by default")
+	}
+	if _, err := decodeHealthRequest(context.Background(), httptest.NewRequest("GET", "/health?deep=maybe", nil)); !errors.Is(err, ErrInvalidRequest) {
+		t.Errorf("expected an invalid deep to be rejected, got %v", err)
+	}
+}
+
+func TestDecodePatchRequests(t *testing.T) {
+	r := httptest.NewRequest("PATCH", "/customers/1", strings.NewReader(`[{"op":"remove","path":"/email"}]`))
+	r.Header.Set("Content-Type", patch.MediaTypeJSONPatch)
+	req, err := decodeUserPatchRequest(context.Background(), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, ok := req.(userUpdateRequest).Patch.(patch.JSONPatch); !ok || p[0].Op != "remove" {
+		t.Errorf("expected a JSON patch, got %+v", req)
+	}
+	r = httptest.NewRequest("PATCH", "/customers/1", strings.NewReader(`{"lastName":"Smith"}`))
+	r.Header.Set("Content-Type", patch.MediaTypeMergePatch)
+	if req, err := decodeUserPatchRequest(context.Background(), r); err != nil || req.(userUpdateRequest).Patch != nil || *req.(userUpdateRequest).Update.LastName != "Smith" {
+		t.Errorf("expected a merge patch to update the profile, got %+v %v", req, err)
+	}
+
+	r = httptest.NewRequest("PATCH", "/addresses/1", strings.NewReader(`{"number":"2"}`))
+	r = mux.SetURLVars(r, map[string]string{"id": "1"})
+	if req, err := decodeAddressPatchRequest(context.Background(), r); err != nil || req.(addressPatchRequest).ID != "1" {
+		t.Errorf("expected a merge patch of the address, got %+v %v", req, err)
+	}
+	r = httptest.NewRequest("PATCH", "/addresses/1", strings.NewReader(`<number>2</number>`))
+	r.Header.Set("Content-Type", "application/xml")
+	if _, err := decodeAddressPatchRequest(context.Background(), r); !errors.Is(err, ErrInvalidRequest) {
+		t.Errorf("expected other media types rejected, got %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	encodeError(context.Background(), patch.ErrTestFailed, w)
+	if w.Code != http.StatusConflict {
+		t.Errorf("expected a failed patch test to conflict, got %v", w.Code)
+	}
+}
+
+func TestDecodeBatchRequest(t *testing.T) {
+	body := `{"operations":[
+		{"ref":"eve","method":"POST","path":"/customers","body":{"username":"eve","password":"pw"}},
+		{"method":"POST","path":"/addresses","body":{"street":"Main","number":"1","city":"Springfield","country":"US","userID":"$eve"}},
+		{"method":"POST","path":"/cards","body":{"longNum":"4111111111111111","expires":"12/99","userID":"$eve"}}]}`
+	req, err := decodeBatchRequest(context.Background(), httptest.NewRequest("POST", "/batch", strings.NewReader(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ops := req.(batchRequest).Operations
+	if len(ops) != 3 || ops[0].Ref != "eve" || ops[0].Customer.Username != "eve" || ops[1].Address.City != "Springfield" || ops[2].Card.LongNum != "4111111111111111" || ops[2].UserID != "$eve" {
+		t.Errorf("unexpected operations %+v", ops)
+	}
+	for _, op := range []string{
+		`{"method":"DELETE","path":"/customers/1","body":{}}`,
+		`{"method":"POST","path":"/groups","body":{}}`,
+		`{"method":"POST","path":"/cards"}`,
+		`{"method":"POST","path":"/cards","body":{"longNum":"4111111111111111"}}`,
+	} {
+		r := httptest.NewRequest("POST", "/batch", strings.NewReader(`{"operations":[`+op+`]}`))
+		if _, err := decodeBatchRequest(context.Background(), r); !errors.Is(err, ErrInvalidRequest) {
+			t.Errorf("expected %v rejected, got %v", op, err)
+		}
+	}
+}
+
+func TestCanonicalIDs(t *testing.T) {
+	var got GetRequest
+	var vars map[string]string
+	r := mux.NewRouter()
+	r.Use(canonicalIDs)
+	r.Methods("GET").Path("/customers/{id}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req, _ := decodeGetRequest(context.Background(), r)
+		got, vars = req.(GetRequest), mux.Vars(r)
+	})
+	for path, want := range map[string]string{
+		"/customers/01j1x8ybqk3e4f5g6h7j8k9mn0":           "01J1X8YBQK3E4F5G6H7J8K9MN0",
+		"/customers/0190E8C5-3B1A-7C2D-8E3F-0123456789AB": "0190e8c5-3b1a-7c2d-8e3f-0123456789ab",
+		"/customers/57A98D98E4B00679B4A830AF":             "57a98d98e4b00679b4a830af",
+		"/customers/57a98d98e4b00679b4a830af":             "57a98d98e4b00679b4a830af",
+	} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+		if got.ID != want || vars["id"] != want {
+			t.Errorf("%v: expected %v in path and vars, got %v and %v", path, want, got.ID, vars["id"])
+		}
+	}
+}
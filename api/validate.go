@@ -0,0 +1,91 @@
+package api
+
+// validate.go contains the declarative validation of request bodies. Request
+// types tag their fields, e.g. `validate:"required,email"`, and the
+// validation middleware rejects requests breaking them with every failing
+// field at once, before the service is called.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-playground/validator/v10"
+	"user/users"
+)
+
+// validate checks the validate tags, naming fields by their JSON member.
+var validate = func() *validator.Validate {
+	v := validator.New()
+	v.RegisterTagNameFunc(func(f reflect.StructField) string {
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			return ""
+		}
+		if name == "" {
+			return f.Name
+		}
+		return name
+	})
+	return v
+}()
+
+// ValidationError lists every field of a request breaking its validation
+// tags.
+type ValidationError struct {
+	Fields []users.FieldError
+}
+
+func (e *ValidationError) Error() string {
+	s := make([]string, len(e.Fields))
+	for k := range e.Fields {
+		s[k] = e.Fields[k].Error()
+	}
+	return strings.Join(s, "; ")
+}
+
+// ValidationMiddleware rejects requests whose fields break their validate
+// tags as invalid, with a ValidationError.
+func ValidationMiddleware(next endpoint.Endpoint) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		if err := validateRequest(request); err != nil {
+			return nil, invalid(err)
+		}
+		return next(ctx, request)
+	}
+}
+
+// validateRequest returns the ValidationError of request, nil when it is
+// valid.
+func validateRequest(request interface{}) error {
+	err := validate.Struct(request)
+	var ves validator.ValidationErrors
+	if !errors.As(err, &ves) {
+		return err
+	}
+	ve := &ValidationError{Fields: make([]users.FieldError, len(ves))}
+	for k, fe := range ves {
+		ve.Fields[k] = users.FieldError{Field: fe.Field(), Reason: validationReason(fe)}
+	}
+	return ve
+}
+
+// validationReason explains the tags we use.
+func validationReason(fe validator.FieldError) string {
+	switch fe.Tag() {
+	case "required":
+		return "required"
+	case "email":
+		return "not an email address"
+	case "max":
+		return fmt.Sprintf("longer than %v", fe.Param())
+	case "min":
+		return fmt.Sprintf("shorter than %v", fe.Param())
+	case "oneof":
+		return fmt.Sprintf("not one of %v", fe.Param())
+	}
+	return "breaks " + fe.Tag()
+}
@@ -0,0 +1,67 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"user/users"
+)
+
+func TestValidationMiddleware(t *testing.T) {
+	called := 0
+	e := ValidationMiddleware(func(context.Context, interface{}) (interface{}, error) {
+		called++
+		return postResponse{ID: "1"}, nil
+	})
+	for _, c := range []struct {
+		request interface{}
+		fields  []string
+	}{
+		{registerRequest{Username: "alice", Password: "secret", Email: "alice@example.com"}, nil},
+		{registerRequest{Email: "alice", LastName: strings.Repeat("a", 101)}, []string{"username", "password", "email", "lastName"}},
+		{addressPostRequest{Address: users.Address{Street: "Main", City: "Leeds", Country: "UK"}, UserID: "1"}, nil},
+		{addressPostRequest{Address: users.Address{Street: "Main", Type: "home"}}, []string{"country", "city", "type", "userID"}},
+		{cardPostRequest{Card: users.Card{Expires: "12/30"}, UserID: "1"}, []string{"longNum"}},
+	} {
+		_, err := e(context.Background(), c.request)
+		var ve *ValidationError
+		if c.fields == nil {
+			if err != nil {
+				t.Errorf("expected %v valid, got %v", c.request, err)
+			}
+			continue
+		}
+		if !errors.Is(err, ErrInvalidRequest) || !errors.As(err, &ve) {
+			t.Errorf("expected %v invalid, got %v", c.request, err)
+			continue
+		}
+		var fields []string
+		for _, f := range ve.Fields {
+			fields = append(fields, f.Field)
+		}
+		if !reflect.DeepEqual(fields, c.fields) {
+			t.Errorf("expected %v invalid, got %v", c.fields, fields)
+		}
+	}
+	if called != 2 {
+		t.Errorf("expected only the valid requests through, got %v", called)
+	}
+}
+
+func TestEncodeValidationError(t *testing.T) {
+	w := httptest.NewRecorder()
+	encodeError(context.Background(), invalid(validateRequest(registerRequest{Username: "alice"})), w)
+	var body errorBody
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	want := []users.FieldError{{Field: "password", Reason: "required"}}
+	if w.Code != 400 || body.Field != "password" || !reflect.DeepEqual(body.Fields, want) {
+		t.Errorf("expected a 400 listing the fields, got %v %+v", w.Code, body)
+	}
+}
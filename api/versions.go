@@ -0,0 +1,51 @@
+package api
+
+// versions.go contains the versions of the HTTP API. Versions share the
+// endpoints and differ only in the shape of their responses, so a shape can
+// be fixed under a new version while the old one stays stable.
+
+import (
+	"context"
+	"net/http"
+)
+
+// APIVersion is a version of the HTTP API, served under /<Name>.
+type APIVersion struct {
+	Name string
+	// Embedded renames the members of _embedded in responses.
+	Embedded map[string]string
+}
+
+var (
+	// V1 is the original API, also served on unversioned paths.
+	V1 = APIVersion{Name: "v1"}
+	// V2 names embedded collections in the plural.
+	V2 = APIVersion{Name: "v2", Embedded: map[string]string{
+		"customer": "customers",
+		"address":  "addresses",
+		"card":     "cards",
+		"group":    "groups",
+		"webhook":  "webhooks",
+	}}
+	// Versions lists the versions served, the first one on unversioned
+	// paths too.
+	Versions = []APIVersion{V1, V2}
+)
+
+// embeddedName returns what v names the _embedded member name.
+func (v APIVersion) embeddedName(name string) string {
+	if n, ok := v.Embedded[name]; ok {
+		return n
+	}
+	return name
+}
+
+// encodeResponse encodes response like encodeResponse does, as the
+// document of v.
+func (v APIVersion) encodeResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	doc, err := v.document(ctx, response)
+	if err != nil {
+		return err
+	}
+	return encodeResponse(ctx, w, doc)
+}
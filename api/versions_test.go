@@ -0,0 +1,55 @@
+package api
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"user/users"
+)
+
+func TestEncodeResponseVersions(t *testing.T) {
+	resp := EmbedStruct{usersResponse{Users: []users.User{{Username: "eve"}}}}
+	for _, c := range []struct {
+		v        APIVersion
+		embedded string
+	}{
+		{V1, `"_embedded":{"customer":[`},
+		{V2, `"_embedded":{"customers":[`},
+	} {
+		w := httptest.NewRecorder()
+		if err := c.v.encodeResponse(context.Background(), w, resp); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(w.Body.String(), c.embedded) || !strings.Contains(w.Body.String(), `"username":"eve"`) {
+			t.Errorf("%v: expected %v, got %v", c.v.Name, c.embedded, w.Body.String())
+		}
+	}
+	w := httptest.NewRecorder()
+	V2.encodeResponse(context.Background(), w, statusResponse{Status: true})
+	if strings.TrimSpace(w.Body.String()) != `{"status":true}` {
+		t.Errorf("expected responses without _embedded unchanged, got %v", w.Body.String())
+	}
+}
+
+func TestVersionedRoutes(t *testing.T) {
+	h := MakeHTTPHandler(MakeEndpoints(TestService), log.NewNopLogger())
+	for path, expected := range map[string]string{
+		"/openapi.json":    `"url":"/v1"`,
+		"/v1/openapi.json": `"url":"/v1"`,
+		"/v2/openapi.json": `"url":"/v2"`,
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != 200 || !strings.Contains(w.Body.String(), expected) {
+			t.Errorf("%v: expected %v, got %v", path, expected, w.Code)
+		}
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/v2/openapi.json", nil))
+	if !strings.Contains(w.Body.String(), `"_embedded":{"properties":{"customers":`) {
+		t.Error("expected the v2 document to name embedded customers in the plural")
+	}
+}
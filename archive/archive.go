@@ -0,0 +1,264 @@
+// Package archive keeps a record of the users purged from the database in
+// cold storage, so finance and fraud can still resolve the customers,
+// addresses and cards orders refer to. Each record is compacted to what
+// identifies them, gzipped and encrypted with the ARCHIVE_ENCRYPTION_KEY
+// secret. Records are removed once their retention ran out.
+package archive
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"user/blob"
+	"user/pii"
+	"user/secrets"
+	"user/users"
+)
+
+// DefaultRetention is how long records are kept, the seven years tax
+// records are commonly kept for.
+const DefaultRetention = 7 * 365 * 24 * time.Hour
+
+var (
+	store     string
+	dir       string
+	bucket    string
+	retention time.Duration
+
+	//ErrNoKey is returned by New when the archive has no encryption key
+	ErrNoKey = errors.New("archive: no " + secrets.ArchiveEncryptionKey)
+	//ErrNotFound is returned by Get for users not archived
+	ErrNotFound = errors.New("archive: user not archived")
+)
+
+func init() {
+	flag.StringVar(&store, "archive-store", os.Getenv("ARCHIVE_STORE"), "Store purged users are archived in: local or s3, no archive when empty")
+	flag.StringVar(&dir, "archive-dir", os.Getenv("ARCHIVE_DIR"), "Directory of the local archive")
+	flag.StringVar(&bucket, "archive-bucket", os.Getenv("ARCHIVE_BUCKET"), "Bucket of the s3 archive, on the -s3-endpoint")
+	flag.DurationVar(&retention, "archive-retention", DefaultRetention, "How long purged users stay archived")
+}
+
+// New returns the archive selected by the flags, encrypted with the
+// ARCHIVE_ENCRYPTION_KEY secret. Without a store it returns nil.
+func New() (*Archive, error) {
+	var b blob.Bucket
+	switch store {
+	case "":
+		return nil, nil
+	case "local":
+		if dir == "" {
+			return nil, errors.New("archive: no -archive-dir")
+		}
+		b = &blob.Local{Dir: dir}
+	case "s3":
+		s := blob.NewS3("")
+		s.Bucket = bucket
+		b = s
+	default:
+		return nil, fmt.Errorf(blob.ErrNoStoreFound, store)
+	}
+	key := secrets.Value(secrets.ArchiveEncryptionKey)
+	if key == "" {
+		return nil, ErrNoKey
+	}
+	c, err := pii.New([]byte(key))
+	if err != nil {
+		return nil, err
+	}
+	return &Archive{Bucket: b, Cipher: c, Retention: retention}, nil
+}
+
+// Record is what is kept of a purged user.
+type Record struct {
+	UserID    string    `json:"userId"`
+	Tenant    string    `json:"tenant,omitempty"`
+	Username  string    `json:"username"`
+	Email     string    `json:"email,omitempty"`
+	FirstName string    `json:"firstName,omitempty"`
+	LastName  string    `json:"lastName,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	DeletedAt time.Time `json:"deletedAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	Addresses []Address `json:"addresses,omitempty"`
+	Cards     []Card    `json:"cards,omitempty"`
+}
+
+// Address is what is kept of an address of a purged user.
+type Address struct {
+	ID       string `json:"id"`
+	Street   string `json:"street"`
+	Number   string `json:"number,omitempty"`
+	Building string `json:"building,omitempty"`
+	City     string `json:"city"`
+	Region   string `json:"region,omitempty"`
+	PostCode string `json:"postcode,omitempty"`
+	Country  string `json:"country"`
+}
+
+// Card is what is kept of a card of a purged user, never its number.
+type Card struct {
+	ID      string `json:"id"`
+	Last4   string `json:"last4"`
+	Brand   string `json:"brand,omitempty"`
+	Expires string `json:"expires"`
+	Holder  string `json:"holder,omitempty"`
+}
+
+// NewRecord compacts u, with its addresses and cards, to its Record.
+func NewRecord(tenant string, u users.User, deletedAt time.Time, retention time.Duration) Record {
+	r := Record{
+		UserID:    u.UserID,
+		Tenant:    tenant,
+		Username:  u.Username,
+		Email:     u.Email,
+		FirstName: u.FirstName,
+		LastName:  u.LastName,
+		CreatedAt: u.CreatedAt,
+		DeletedAt: deletedAt,
+		ExpiresAt: deletedAt.Add(retention),
+	}
+	for _, a := range u.Addresses {
+		region := a.State
+		if region == "" {
+			region = a.Prefecture
+		}
+		r.Addresses = append(r.Addresses, Address{
+			ID: a.ID, Street: a.Street, Number: a.Number, Building: a.Building,
+			City: a.City, Region: region, PostCode: a.PostCode, Country: a.Country,
+		})
+	}
+	for _, c := range u.Cards {
+		last4 := c.LongNum
+		if len(last4) > 4 {
+			last4 = last4[len(last4)-4:]
+		}
+		r.Cards = append(r.Cards, Card{ID: c.ID, Last4: last4, Brand: c.Brand, Expires: c.Expires, Holder: c.Holder})
+	}
+	return r
+}
+
+// Archive stores the Records of purged users in Bucket, sealed by Cipher,
+// for Retention.
+type Archive struct {
+	Bucket    blob.Bucket
+	Cipher    *pii.Cipher
+	Retention time.Duration
+	Logger    log.Logger
+	now       func() time.Time
+}
+
+// dateLayout is the expiry date ending the keys of records.
+const dateLayout = "20060102"
+
+// prefix starts the keys of the records of the tenant, or of the user id
+// of the tenant when given.
+func prefix(tenant, id string) string {
+	p := "users/"
+	if tenant != "" {
+		p = "tenants/" + tenant + "/" + p
+	}
+	if id != "" {
+		p += id + "/"
+	}
+	return p
+}
+
+// Put archives u, which has to come with its addresses and cards, as
+// purged by the tenant now. The key of the record ends in its expiry date,
+// so Expire finds the expired records without reading them.
+func (a *Archive) Put(tenant string, u users.User) error {
+	now := time.Now
+	if a.now != nil {
+		now = a.now
+	}
+	r := NewRecord(tenant, u, now().UTC(), a.Retention)
+	var b bytes.Buffer
+	z := gzip.NewWriter(&b)
+	if err := json.NewEncoder(z).Encode(r); err != nil {
+		return err
+	}
+	if err := z.Close(); err != nil {
+		return err
+	}
+	_, err := a.Bucket.Put(prefix(tenant, u.UserID)+r.ExpiresAt.Format(dateLayout), "application/octet-stream", a.Cipher.Seal(b.Bytes()))
+	return err
+}
+
+// Get returns the record of the user with id purged by the tenant.
+func (a *Archive) Get(tenant, id string) (Record, error) {
+	keys, err := a.Bucket.List(prefix(tenant, id))
+	if err != nil {
+		return Record{}, err
+	}
+	if len(keys) == 0 {
+		return Record{}, ErrNotFound
+	}
+	b, err := a.Bucket.Get(keys[len(keys)-1])
+	if err != nil {
+		return Record{}, err
+	}
+	if b, err = a.Cipher.Open(b); err != nil {
+		return Record{}, err
+	}
+	z, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return Record{}, err
+	}
+	var r Record
+	err = json.NewDecoder(io.LimitReader(z, 1<<20)).Decode(&r)
+	return r, err
+}
+
+// Expire removes the records of every tenant whose retention ran out and
+// returns how many it removed.
+func (a *Archive) Expire(ctx context.Context) (int, error) {
+	now := time.Now
+	if a.now != nil {
+		now = a.now
+	}
+	today := now().UTC().Format(dateLayout)
+	keys, err := a.Bucket.List("")
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, k := range keys {
+		if ctx.Err() != nil {
+			return n, ctx.Err()
+		}
+		// The dates sort like the days they name.
+		expires := k[strings.LastIndex(k, "/")+1:]
+		if len(expires) != len(dateLayout) || expires >= today {
+			continue
+		}
+		if err := a.Bucket.Delete(k); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// Every expires records every interval until stop is closed.
+func (a *Archive) Every(interval time.Duration, stop <-chan struct{}) {
+	ctx := context.Background()
+	for {
+		n, err := a.Expire(ctx)
+		a.Logger.Log("job", "archive_expiry", "expired", n, "err", err)
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package archive
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"user/blob"
+	"user/pii"
+	"user/users"
+)
+
+func TestArchive(t *testing.T) {
+	ctx := context.Background()
+	c, _ := pii.New([]byte("archivekey"))
+	b := &blob.Local{Dir: t.TempDir()}
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	a := &Archive{Bucket: b, Cipher: c, Retention: 30 * 24 * time.Hour, Logger: log.NewNopLogger(), now: func() time.Time { return now }}
+	u := users.User{
+		UserID:    "57a98d98e4b00679b4a830af",
+		Username:  "eve",
+		Email:     "eve@example.com",
+		Addresses: []users.Address{{ID: "57a98d98e4b00679b4a830b0", Street: "Main St", City: "Springfield", State: "IL", Country: "US"}},
+		Cards:     []users.Card{{ID: "57a98d98e4b00679b4a830b1", LongNum: "4111111111111111", Expires: "01/99"}},
+	}
+	if err := a.Put("shop", u); err != nil {
+		t.Fatal(err)
+	}
+	keys, _ := b.List("")
+	if len(keys) != 1 || keys[0] != "tenants/shop/users/57a98d98e4b00679b4a830af/20261115" {
+		t.Fatalf("expected the record keyed by tenant, id and expiry, got %v", keys)
+	}
+	stored, _ := b.Get(keys[0])
+	if strings.Contains(string(stored), "eve") {
+		t.Error("expected the record encrypted")
+	}
+	if _, err := a.Get("", u.UserID); err != ErrNotFound {
+		t.Errorf("expected the record of another tenant not found, got %v", err)
+	}
+	r, err := a.Get("shop", u.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Email != "eve@example.com" || !r.DeletedAt.Equal(now) || len(r.Addresses) != 1 || r.Addresses[0].Region != "IL" {
+		t.Errorf("unexpected record %+v", r)
+	}
+	if len(r.Cards) != 1 || r.Cards[0].Last4 != "1111" || r.Cards[0].ID != "57a98d98e4b00679b4a830b1" {
+		t.Errorf("expected the card kept by its last digits, got %+v", r.Cards)
+	}
+
+	if n, err := a.Expire(ctx); n != 0 || err != nil {
+		t.Errorf("expected the record retained, got %v %v", n, err)
+	}
+	now = now.Add(31 * 24 * time.Hour)
+	if n, err := a.Expire(ctx); n != 1 || err != nil {
+		t.Errorf("expected the record expired, got %v %v", n, err)
+	}
+	if _, err := a.Get("shop", u.UserID); err != ErrNotFound {
+		t.Errorf("expected the expired record gone, got %v", err)
+	}
+}
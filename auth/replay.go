@@ -0,0 +1,59 @@
+package auth
+
+// replay.go contains the detection of replayed token ids. Every token we
+// issue gets an id of its own, a second token carrying an id we've seen
+// before was put together by someone else.
+
+import (
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+// minReplaySweep is the fewest ids remembered before expired ones are
+// swept.
+const minReplaySweep = 1024
+
+// ReplayDetector remembers the ids of the tokens it saw until they expire.
+type ReplayDetector struct {
+	mu    sync.Mutex
+	seen  map[string]seenToken
+	sweep int
+}
+
+type seenToken struct {
+	sum       [sha256.Size]byte
+	expiresAt int64
+}
+
+// NewReplayDetector returns an empty ReplayDetector.
+func NewReplayDetector() *ReplayDetector {
+	return &ReplayDetector{seen: map[string]seenToken{}, sweep: minReplaySweep}
+}
+
+// Reused reports whether the id of c was seen on a token other than token,
+// remembering it otherwise. Presenting the same token again is no replay.
+func (d *ReplayDetector) Reused(token string, c Claims, now time.Time) bool {
+	if c.ID == "" {
+		return false
+	}
+	sum := sha256.Sum256([]byte(token))
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if s, ok := d.seen[c.ID]; ok && s.expiresAt > now.Unix() {
+		return s.sum != sum
+	}
+	if len(d.seen) >= d.sweep {
+		for id, s := range d.seen {
+			if s.expiresAt <= now.Unix() {
+				delete(d.seen, id)
+			}
+		}
+		d.sweep = 2 * len(d.seen)
+		if d.sweep < minReplaySweep {
+			d.sweep = minReplaySweep
+		}
+	}
+	d.seen[c.ID] = seenToken{sum: sum, expiresAt: c.ExpiresAt}
+	return false
+}
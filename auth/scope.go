@@ -0,0 +1,29 @@
+package auth
+
+import "strings"
+
+// ResourceScope returns the scope granting read access to a single
+// resource, e.g. "addresses:57a98d98e4b00679b4a830b1".
+func ResourceScope(entity, id string) string {
+	return entity + ":" + id
+}
+
+// ParseResourceScope splits a resource scope into entity and id. ok is false
+// for scopes that do not name a single resource.
+func ParseResourceScope(scope string) (entity, id string, ok bool) {
+	i := strings.Index(scope, ":")
+	if i <= 0 || i == len(scope)-1 {
+		return "", "", false
+	}
+	return scope[:i], scope[i+1:], true
+}
+
+// HasScope reports whether the space delimited scope list contains scope.
+func HasScope(scopes, scope string) bool {
+	for _, s := range strings.Fields(scopes) {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,38 @@
+package auth
+
+import "testing"
+
+func TestResourceScope(t *testing.T) {
+	s := ResourceScope("addresses", "57a98d98e4b00679b4a830b1")
+	e, id, ok := ParseResourceScope(s)
+	if !ok || e != "addresses" || id != "57a98d98e4b00679b4a830b1" {
+		t.Errorf("unexpected parse of %v", s)
+	}
+	for _, bad := range []string{"customer", ":id", "cards:"} {
+		if _, _, ok := ParseResourceScope(bad); ok {
+			t.Errorf("expected %v not to be a resource scope", bad)
+		}
+	}
+}
+
+func TestHasScope(t *testing.T) {
+	if !HasScope("customer cards:1", "cards:1") {
+		t.Error("expected cards:1 in scope list")
+	}
+	if HasScope("cards:12", "cards:1") {
+		t.Error("expected no partial scope match")
+	}
+}
+
+func TestClients(t *testing.T) {
+	c, err := ParseClients("orders:s3cret, shipping:other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.Authenticate("orders", "s3cret") || c.Authenticate("orders", "other") || c.Authenticate("nobody", "s3cret") {
+		t.Errorf("unexpected authentication by %v", c)
+	}
+	if _, err := ParseClients("orders"); err == nil {
+		t.Error("expected a client without a secret to be rejected")
+	}
+}
@@ -0,0 +1,159 @@
+package auth
+
+// token.go contains issuing and verification of the signed bearer tokens
+// handed out on login. Tokens are compact HS256 JWTs so that other services
+// can either verify them locally or ask us via the introspection endpoint.
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	//ErrInvalidToken is returned when a token is malformed or its signature does not match
+	ErrInvalidToken = errors.New("Invalid token")
+	//ErrExpiredToken is returned when a token is past its expiry
+	ErrExpiredToken = errors.New("Token expired")
+	//ErrNoSigningKey is returned when a Signer is created without a key
+	ErrNoSigningKey = errors.New("No signing key")
+	//ErrWrongTenant is returned for tokens issued to another tenant
+	ErrWrongTenant = errors.New("Token of another tenant")
+	//ErrReusedToken is reported for tokens carrying the id of another token
+	ErrReusedToken = errors.New("Token id reused")
+
+	header = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+)
+
+const (
+	// Issuer is set as the iss claim on every token we sign.
+	Issuer = "user"
+	// ScopeCustomer grants full access to the customer's own resources.
+	ScopeCustomer = "customer"
+	// ScopeAdmin grants access to every resource.
+	ScopeAdmin = "admin"
+)
+
+// Claims is the payload carried by a token.
+type Claims struct {
+	ID        string `json:"jti"`
+	Issuer    string `json:"iss"`
+	Subject   string `json:"sub"`
+	Tenant    string `json:"tid,omitempty"`
+	Username  string `json:"username,omitempty"`
+	Scope     string `json:"scope,omitempty"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// Scopes returns the space delimited scope claim as a slice.
+func (c Claims) Scopes() []string {
+	return strings.Fields(c.Scope)
+}
+
+// Signer issues and verifies tokens with a shared HMAC key.
+type Signer struct {
+	key []byte
+	ttl time.Duration
+	now func() time.Time
+}
+
+// NewSigner returns a Signer using key, issuing tokens valid for ttl.
+func NewSigner(key []byte, ttl time.Duration) (*Signer, error) {
+	if len(key) == 0 {
+		return nil, ErrNoSigningKey
+	}
+	return &Signer{key: key, ttl: ttl, now: time.Now}, nil
+}
+
+// TTL returns how long issued tokens are valid.
+func (s *Signer) TTL() time.Duration {
+	return s.ttl
+}
+
+// Issue signs a new token for the given subject and scopes.
+func (s *Signer) Issue(subject, username string, scopes []string) (string, Claims, error) {
+	return s.IssueFor("", subject, username, scopes)
+}
+
+// IssueFor signs a new token for the given subject of tenant, the empty
+// tenant being the default one.
+func (s *Signer) IssueFor(tenant, subject, username string, scopes []string) (string, Claims, error) {
+	now := s.now()
+	c := Claims{
+		ID:        newTokenID(),
+		Issuer:    Issuer,
+		Subject:   subject,
+		Tenant:    tenant,
+		Username:  username,
+		Scope:     strings.Join(scopes, " "),
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(s.ttl).Unix(),
+	}
+	payload, err := json.Marshal(c)
+	if err != nil {
+		return "", Claims{}, err
+	}
+	unsigned := header + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return unsigned + "." + s.sign(unsigned), c, nil
+}
+
+// Parse verifies the token signature and expiry and returns its claims.
+func (s *Signer) Parse(token string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != header {
+		return Claims{}, ErrInvalidToken
+	}
+	unsigned := parts[0] + "." + parts[1]
+	if !hmac.Equal([]byte(parts[2]), []byte(s.sign(unsigned))) {
+		return Claims{}, ErrInvalidToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return Claims{}, ErrInvalidToken
+	}
+	var c Claims
+	if err := json.Unmarshal(payload, &c); err != nil {
+		return Claims{}, ErrInvalidToken
+	}
+	if s.now().Unix() >= c.ExpiresAt {
+		return c, ErrExpiredToken
+	}
+	return c, nil
+}
+
+// TenantOf returns the tenant claim of token without verifying it, so
+// requests can be routed to their tenant before the token is checked there.
+func TenantOf(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", ErrInvalidToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", ErrInvalidToken
+	}
+	var c Claims
+	if err := json.Unmarshal(payload, &c); err != nil {
+		return "", ErrInvalidToken
+	}
+	return c.Tenant, nil
+}
+
+func (s *Signer) sign(unsigned string) string {
+	h := hmac.New(sha256.New, s.key)
+	h.Write([]byte(unsigned))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+func newTokenID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
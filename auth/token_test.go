@@ -0,0 +1,105 @@
+package auth
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestNewSigner(t *testing.T) {
+	_, err := NewSigner(nil, time.Hour)
+	if err != ErrNoSigningKey {
+		t.Error("expected no signing key error")
+	}
+}
+
+func TestIssueParse(t *testing.T) {
+	s, _ := NewSigner([]byte("secret"), time.Hour)
+	tok, c, err := s.Issue("57a98d98e4b00679b4a830af", "eve", []string{ScopeCustomer})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := s.Parse(tok)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p != c {
+		t.Errorf("expected %v received %v", c, p)
+	}
+	if len(p.Scopes()) != 1 || p.Scopes()[0] != ScopeCustomer {
+		t.Error("expected customer scope")
+	}
+}
+
+func TestParseTampered(t *testing.T) {
+	s, _ := NewSigner([]byte("secret"), time.Hour)
+	o, _ := NewSigner([]byte("other"), time.Hour)
+	tok, _, _ := o.Issue("id", "eve", nil)
+	if _, err := s.Parse(tok); err != ErrInvalidToken {
+		t.Error("expected invalid token error for foreign key")
+	}
+	if _, err := s.Parse("not.a.token"); err != ErrInvalidToken {
+		t.Error("expected invalid token error for garbage")
+	}
+}
+
+func TestParseExpired(t *testing.T) {
+	s, _ := NewSigner([]byte("secret"), time.Minute)
+	s.now = func() time.Time { return time.Now().Add(-time.Hour) }
+	tok, _, _ := s.Issue("id", "eve", nil)
+	s.now = time.Now
+	if _, err := s.Parse(tok); err != ErrExpiredToken {
+		t.Error("expected expired token error")
+	}
+	if s.Introspect(tok).Active {
+		t.Error("expected expired token to be inactive")
+	}
+}
+
+func TestIntrospect(t *testing.T) {
+	s, _ := NewSigner([]byte("secret"), time.Hour)
+	tok, c, _ := s.Issue("id", "eve", []string{ScopeCustomer})
+	i := s.Introspect(tok)
+	if !i.Active || i.Subject != c.Subject || i.Scope != ScopeCustomer {
+		t.Errorf("unexpected introspection %v", i)
+	}
+	if (s.Introspect("bogus") != Introspection{}) {
+		t.Error("expected empty inactive introspection")
+	}
+}
+
+func TestIssueForTenant(t *testing.T) {
+	s, _ := NewSigner([]byte("secret"), time.Hour)
+	tok, _, _ := s.IssueFor("shop-1", "id", "eve", nil)
+	p, err := s.Parse(tok)
+	if err != nil || p.Tenant != "shop-1" || p.Introspection().Tenant != "shop-1" {
+		t.Errorf("expected tenant claim, got %v %v", p, err)
+	}
+	if tenant, err := TenantOf(tok); err != nil || tenant != "shop-1" {
+		t.Errorf("expected tenant shop-1, got %v %v", tenant, err)
+	}
+	if _, err := TenantOf("not a token"); err != ErrInvalidToken {
+		t.Error("expected invalid token error")
+	}
+}
+
+func TestReplayDetector(t *testing.T) {
+	s, _ := NewSigner([]byte("secret"), time.Hour)
+	tok, c, _ := s.Issue("id", "eve", []string{ScopeCustomer})
+	d := NewReplayDetector()
+	now := time.Now()
+	if d.Reused(tok, c, now) || d.Reused(tok, c, now) {
+		t.Error("expected the same token presented again not to be a replay")
+	}
+	forged := c
+	forged.Scope = ScopeAdmin
+	payload, _ := json.Marshal(forged)
+	unsigned := header + "." + base64.RawURLEncoding.EncodeToString(payload)
+	if !d.Reused(unsigned+"."+s.sign(unsigned), forged, now) {
+		t.Error("expected another token with the same id to be a replay")
+	}
+	if d.Reused(unsigned+"."+s.sign(unsigned), forged, time.Unix(c.ExpiresAt, 0)) {
+		t.Error("expected ids forgotten once their token expired")
+	}
+}
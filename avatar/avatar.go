@@ -0,0 +1,95 @@
+package avatar
+
+// avatar.go turns uploaded images into the square avatar sizes we serve.
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+
+	// Formats accepted for upload.
+	_ "image/gif"
+	_ "image/png"
+)
+
+// Sizes are the square edge lengths, in pixels, avatars are rendered at.
+var Sizes = map[string]int{
+	"small":  64,
+	"medium": 128,
+	"large":  256,
+}
+
+// MaxPixels limits the decoded size of uploads.
+const MaxPixels = 25000000
+
+var (
+	//ErrTooLarge is returned for images with more than MaxPixels
+	ErrTooLarge = errors.New("Image too large")
+)
+
+// Render decodes an uploaded image and returns a JPEG for every size.
+func Render(r io.Reader) (map[string][]byte, error) {
+	var buf bytes.Buffer
+	cfg, _, err := image.DecodeConfig(io.TeeReader(r, &buf))
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Width*cfg.Height > MaxPixels {
+		return nil, ErrTooLarge
+	}
+	src, _, err := image.Decode(io.MultiReader(&buf, r))
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string][]byte, len(Sizes))
+	for name, size := range Sizes {
+		var b bytes.Buffer
+		if err := jpeg.Encode(&b, Square(src, size), &jpeg.Options{Quality: 85}); err != nil {
+			return nil, err
+		}
+		out[name] = b.Bytes()
+	}
+	return out, nil
+}
+
+// Square crops the centre square of src and scales it to size, averaging
+// the source pixels covered by each destination pixel.
+func Square(src image.Image, size int) image.Image {
+	b := src.Bounds()
+	side := b.Dx()
+	if b.Dy() < side {
+		side = b.Dy()
+	}
+	x0 := b.Min.X + (b.Dx()-side)/2
+	y0 := b.Min.Y + (b.Dy()-side)/2
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		sy0, sy1 := span(y0, y, side, size)
+		for x := 0; x < size; x++ {
+			sx0, sx1 := span(x0, x, side, size)
+			var r, g, bl, a, n uint64
+			for sy := sy0; sy < sy1; sy++ {
+				for sx := sx0; sx < sx1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, bl, a, n = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca), n+1
+				}
+			}
+			dst.Set(x, y, color.RGBA64{uint16(r / n), uint16(g / n), uint16(bl / n), uint16(a / n)})
+		}
+	}
+	return dst
+}
+
+// span returns the source range covered by destination pixel i, at least
+// one pixel wide so upscaling repeats pixels.
+func span(origin, i, side, size int) (int, int) {
+	s0 := origin + i*side/size
+	s1 := origin + (i+1)*side/size
+	if s1 <= s0 {
+		s1 = s0 + 1
+	}
+	return s0, s1
+}
@@ -0,0 +1,47 @@
+package avatar
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func TestSquare(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 300, 200))
+	for x := 0; x < 300; x++ {
+		for y := 0; y < 200; y++ {
+			src.Set(x, y, color.RGBA{255, 0, 0, 255})
+		}
+	}
+	for _, size := range []int{64, 256} {
+		d := Square(src, size)
+		if d.Bounds().Dx() != size || d.Bounds().Dy() != size {
+			t.Errorf("expected %v square received %v", size, d.Bounds())
+		}
+		if r, _, _, _ := d.At(size/2, size/2).RGBA(); r>>8 != 255 {
+			t.Error("expected colour preserved")
+		}
+	}
+}
+
+func TestRender(t *testing.T) {
+	var b bytes.Buffer
+	png.Encode(&b, image.NewGray(image.Rect(0, 0, 10, 20)))
+	out, err := Render(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != len(Sizes) {
+		t.Errorf("expected %v sizes received %v", len(Sizes), len(out))
+	}
+	cfg, err := jpeg.DecodeConfig(bytes.NewReader(out["large"]))
+	if err != nil || cfg.Width != Sizes["large"] {
+		t.Errorf("expected large jpeg, %v %v", cfg, err)
+	}
+	if _, err := Render(bytes.NewReader([]byte("not an image"))); err == nil {
+		t.Error("expected decode error")
+	}
+}
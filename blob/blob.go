@@ -0,0 +1,149 @@
+package blob
+
+// blob.go contains the pluggable store for uploaded files such as avatars.
+// A store is picked with the -blob-store flag.
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Store saves blobs and hands out the URL they can be fetched from.
+type Store interface {
+	Put(key, contentType string, data []byte) (url string, err error)
+	Delete(key string) error
+}
+
+// Bucket is a Store blobs can be read back from and listed, like the
+// archive of deleted users.
+type Bucket interface {
+	Store
+	Get(key string) ([]byte, error)
+	// List returns the keys starting with prefix in lexical order.
+	List(prefix string) ([]string, error)
+}
+
+var (
+	store     string
+	dir       string
+	publicURL string
+	//ErrNoStoreFound is returned when the selected store is unknown
+	ErrNoStoreFound = "No blob store with name %v"
+	//ErrInvalidKey is returned for keys escaping the store
+	ErrInvalidKey = errors.New("Invalid blob key")
+	//ErrNotFound is returned by Get for keys not stored
+	ErrNotFound = errors.New("Blob not found")
+)
+
+func init() {
+	flag.StringVar(&store, "blob-store", os.Getenv("BLOB_STORE"), "Blob store to use: local or s3")
+	flag.StringVar(&dir, "blob-dir", os.Getenv("BLOB_DIR"), "Directory of the local blob store")
+	flag.StringVar(&publicURL, "blob-url", os.Getenv("BLOB_URL"), "Base URL blobs are served from")
+}
+
+// New returns the store selected by the flags, the local store by default.
+func New() (Store, error) {
+	switch store {
+	case "", "local":
+		d := dir
+		if d == "" {
+			d = filepath.Join(os.TempDir(), "user-blobs")
+		}
+		u := publicURL
+		if u == "" {
+			u = LocalPath
+		}
+		return &Local{Dir: d, BaseURL: u}, nil
+	case "s3":
+		return NewS3(publicURL), nil
+	}
+	return nil, fmt.Errorf(ErrNoStoreFound, store)
+}
+
+// LocalPath is where the local store is served by default.
+const LocalPath = "/blobs"
+
+// Local stores blobs on disk and serves them itself.
+type Local struct {
+	Dir     string
+	BaseURL string
+}
+
+// Put writes data to Dir/key.
+func (l *Local) Put(key, _ string, data []byte) (string, error) {
+	p, err := l.path(key)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(p, data, 0644); err != nil {
+		return "", err
+	}
+	return strings.TrimRight(l.BaseURL, "/") + "/" + key, nil
+}
+
+// Delete removes Dir/key.
+func (l *Local) Delete(key string) error {
+	p, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(p)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Get reads Dir/key.
+func (l *Local) Get(key string) ([]byte, error) {
+	p, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(p)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return b, err
+}
+
+// List walks Dir for the keys starting with prefix.
+func (l *Local) List(prefix string) ([]string, error) {
+	var keys []string
+	err := filepath.WalkDir(l.Dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(l.Dir, p)
+		if key := filepath.ToSlash(rel); err == nil && strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return err
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	return keys, err
+}
+
+// ServeHTTP serves the stored blobs, mount it under LocalPath.
+func (l *Local) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	http.StripPrefix(LocalPath, http.FileServer(http.Dir(l.Dir))).ServeHTTP(w, r)
+}
+
+func (l *Local) path(key string) (string, error) {
+	c := filepath.Clean("/" + key)
+	if c == "/" || strings.Contains(key, "..") {
+		return "", ErrInvalidKey
+	}
+	return filepath.Join(l.Dir, c), nil
+}
@@ -0,0 +1,94 @@
+package blob
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLocal(t *testing.T) {
+	l := &Local{Dir: t.TempDir(), BaseURL: LocalPath}
+	u, err := l.Put("avatars/1/large.jpg", "image/jpeg", []byte("jpeg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u != "/blobs/avatars/1/large.jpg" {
+		t.Errorf("unexpected url %v", u)
+	}
+	w := httptest.NewRecorder()
+	l.ServeHTTP(w, httptest.NewRequest("GET", u, nil))
+	if w.Body.String() != "jpeg" {
+		t.Error("expected stored blob to be served")
+	}
+	l.Put("avatars/2/large.jpg", "image/jpeg", []byte("jpeg"))
+	if keys, err := l.List("avatars/"); err != nil || len(keys) != 2 || keys[1] != "avatars/2/large.jpg" {
+		t.Errorf("expected the stored keys listed, got %v %v", keys, err)
+	}
+	if b, err := l.Get("avatars/1/large.jpg"); err != nil || string(b) != "jpeg" {
+		t.Errorf("expected the stored blob read, got %q %v", b, err)
+	}
+	if err := l.Delete("avatars/1/large.jpg"); err != nil {
+		t.Error(err)
+	}
+	if _, err := l.Get("avatars/1/large.jpg"); err != ErrNotFound {
+		t.Errorf("expected the deleted blob not found, got %v", err)
+	}
+	if _, err := l.Put("../escape", "", nil); err != ErrInvalidKey {
+		t.Error("expected invalid key error")
+	}
+}
+
+func TestS3(t *testing.T) {
+	var got string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		b, _ := io.ReadAll(r.Body)
+		got = r.Method + " " + r.URL.Path + " " + string(b)
+	}))
+	defer srv.Close()
+	s := NewS3("")
+	s.Endpoint = srv.URL
+	s.Bucket = "bucket"
+	s.BaseURL = "https://cdn.example.com"
+	u, err := s.Put("avatars/1/large.jpg", "image/jpeg", []byte("jpeg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "PUT /bucket/avatars/1/large.jpg jpeg" {
+		t.Errorf("unexpected request %v", got)
+	}
+	if u != "https://cdn.example.com/avatars/1/large.jpg" {
+		t.Errorf("unexpected url %v", u)
+	}
+}
+
+func TestS3List(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if r.URL.Path != "/bucket" || q.Get("list-type") != "2" || q.Get("prefix") != "users/" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if q.Get("continuation-token") == "" {
+			io.WriteString(w, `<ListBucketResult><Contents><Key>users/1</Key></Contents><IsTruncated>true</IsTruncated><NextContinuationToken>next</NextContinuationToken></ListBucketResult>`)
+			return
+		}
+		io.WriteString(w, `<ListBucketResult><Contents><Key>users/2</Key></Contents><IsTruncated>false</IsTruncated></ListBucketResult>`)
+	}))
+	defer srv.Close()
+	s := NewS3("")
+	s.Endpoint = srv.URL
+	s.Bucket = "bucket"
+	keys, err := s.List("users/")
+	if err != nil || len(keys) != 2 || keys[0] != "users/1" || keys[1] != "users/2" {
+		t.Errorf("expected the keys of both pages, got %v %v", keys, err)
+	}
+	if _, err := s.Get("users/3"); err == nil {
+		t.Error("expected a failing get to fail")
+	}
+}
@@ -0,0 +1,144 @@
+package blob
+
+import (
+	"bytes"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"user/sigv4"
+)
+
+var (
+	s3Endpoint string
+	s3Bucket   string
+	s3Region   string
+)
+
+func init() {
+	flag.StringVar(&s3Endpoint, "s3-endpoint", os.Getenv("S3_ENDPOINT"), "S3 or minio endpoint, e.g. https://s3.eu-west-1.amazonaws.com")
+	flag.StringVar(&s3Bucket, "s3-bucket", os.Getenv("S3_BUCKET"), "Bucket blobs are stored in")
+	flag.StringVar(&s3Region, "s3-region", os.Getenv("AWS_REGION"), "Region of the bucket")
+}
+
+// S3 stores blobs in an S3 compatible bucket, addressed path style so minio
+// works too. Credentials come from the standard AWS environment variables.
+type S3 struct {
+	Endpoint string
+	Bucket   string
+	Region   string
+	BaseURL  string
+	Creds    sigv4.Credentials
+	Client   *http.Client
+}
+
+// NewS3 returns a store for the configured bucket. Blob URLs start with
+// baseURL, or point at the bucket when it's empty.
+func NewS3(baseURL string) *S3 {
+	s := &S3{
+		Endpoint: strings.TrimRight(s3Endpoint, "/"),
+		Bucket:   s3Bucket,
+		Region:   s3Region,
+		BaseURL:  baseURL,
+		Creds: sigv4.Credentials{
+			AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		},
+		Client: &http.Client{Timeout: 30 * time.Second},
+	}
+	if s.BaseURL == "" {
+		s.BaseURL = s.Endpoint + "/" + s.Bucket
+	}
+	return s
+}
+
+// Put uploads data as key.
+func (s *S3) Put(key, contentType string, data []byte) (string, error) {
+	if _, err := s.do("PUT", key, nil, contentType, data); err != nil {
+		return "", err
+	}
+	return strings.TrimRight(s.BaseURL, "/") + "/" + key, nil
+}
+
+// Delete removes key from the bucket.
+func (s *S3) Delete(key string) error {
+	_, err := s.do("DELETE", key, nil, "", nil)
+	return err
+}
+
+// Get downloads key.
+func (s *S3) Get(key string) ([]byte, error) {
+	return s.do("GET", key, nil, "", nil)
+}
+
+// listResult is the part of a ListObjectsV2 response List reads.
+type listResult struct {
+	Contents []struct {
+		Key string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// List lists the keys starting with prefix, a page of up to 1000 at a time.
+func (s *S3) List(prefix string) ([]string, error) {
+	var keys []string
+	q := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	for {
+		b, err := s.do("GET", "", q, "", nil)
+		if err != nil {
+			return nil, err
+		}
+		var r listResult
+		if err := xml.Unmarshal(b, &r); err != nil {
+			return nil, err
+		}
+		for _, c := range r.Contents {
+			keys = append(keys, c.Key)
+		}
+		if !r.IsTruncated {
+			return keys, nil
+		}
+		q.Set("continuation-token", r.NextContinuationToken)
+	}
+}
+
+// do sends the signed request for key, the bucket itself for an empty key,
+// and returns the response body.
+func (s *S3) do(method, key string, query url.Values, contentType string, data []byte) ([]byte, error) {
+	u := s.Endpoint + "/" + s.Bucket
+	if key != "" {
+		u += "/" + key
+	}
+	if len(query) > 0 {
+		// Encoded sorted by key, the way the signature expects.
+		u += "?" + strings.ReplaceAll(query.Encode(), "+", "%20")
+	}
+	req, err := http.NewRequest(method, u, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	sigv4.Sign(req, data, s.Creds, s.Region, "s3", time.Now())
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound && method == "GET" && key != "" {
+		return nil, ErrNotFound
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("s3: %v %v returned %v", method, key, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
@@ -0,0 +1,72 @@
+package cardvault
+
+// cardvault.go contains the exchange of card numbers for tokens of a payment
+// provider. With a vault configured only the provider token and the masked
+// number are stored, without one numbers are stored locally, encrypted with
+// the card encryption key. A vault is picked with the -card-vault flag.
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"user/users"
+)
+
+var (
+	vault           string
+	vaultKey        string
+	vaultURL        string
+	merchantAccount string
+	//ErrNoVaultFound is returned when the selected vault is unknown
+	ErrNoVaultFound = "No card vault with name %v"
+	//ErrDeclined is returned when the provider refuses to store the card
+	ErrDeclined = errors.New("Card declined")
+)
+
+func init() {
+	flag.StringVar(&vault, "card-vault", os.Getenv("CARD_VAULT"), "Provider tokenizing cards: stripe or adyen, cards are stored locally encrypted when empty")
+	flag.StringVar(&vaultKey, "card-vault-key", os.Getenv("CARD_VAULT_KEY"), "API key of the card vault")
+	flag.StringVar(&vaultURL, "card-vault-url", os.Getenv("CARD_VAULT_URL"), "Base URL of the card vault API, the provider's production URL by default")
+	flag.StringVar(&merchantAccount, "adyen-merchant-account", os.Getenv("ADYEN_MERCHANT_ACCOUNT"), "Adyen merchant account cards are stored for")
+}
+
+// CardVault exchanges cards for provider tokens. The token is all that's
+// needed to charge the card later.
+type CardVault interface {
+	// Name names the provider, it is stored with the card.
+	Name() string
+	// Tokenize stores the card with the provider for the given user.
+	Tokenize(c users.Card, userID string) (string, error)
+}
+
+// New returns the vault selected by the flags, nil when cards are stored
+// locally.
+func New() (CardVault, error) {
+	switch vault {
+	case "", "local":
+		return nil, nil
+	case "stripe":
+		s := NewStripe(vaultKey)
+		if vaultURL != "" {
+			s.URL = vaultURL
+		}
+		return s, nil
+	case "adyen":
+		a := NewAdyen(vaultKey, merchantAccount)
+		if vaultURL != "" {
+			a.URL = vaultURL
+		}
+		return a, nil
+	}
+	return nil, fmt.Errorf(ErrNoVaultFound, vault)
+}
+
+// expiry splits a MM/YY expiry into the month and four digit year.
+func expiry(expires string) (string, string) {
+	if len(expires) != 5 {
+		return "", ""
+	}
+	return expires[:2], "20" + expires[3:]
+}
@@ -0,0 +1,106 @@
+package cardvault
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"user/users"
+)
+
+var testCard = users.Card{LongNum: "4111111111111111", Expires: "01/29", CCV: "123", Holder: "Eve Smith"}
+
+func TestStripe(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.URL.Path != "/payment_methods" || r.Header.Get("Authorization") != "Bearer sk" {
+			t.Errorf("unexpected request %v %v", r.URL.Path, r.Header)
+		}
+		if r.Form.Get("card[number]") == "4000000000000002" {
+			w.WriteHeader(http.StatusPaymentRequired)
+			w.Write([]byte(`{"error":{"type":"card_error","message":"Your card was declined."}}`))
+			return
+		}
+		if r.Form.Get("card[exp_month]") != "01" || r.Form.Get("card[exp_year]") != "2029" || r.Form.Get("metadata[userId]") != "u1" {
+			t.Errorf("unexpected form %v", r.Form)
+		}
+		w.Write([]byte(`{"id":"pm_123"}`))
+	}))
+	defer ts.Close()
+	s := NewStripe("sk")
+	s.URL = ts.URL
+	tok, err := s.Tokenize(testCard, "u1")
+	if err != nil || tok != "pm_123" {
+		t.Errorf("unexpected token %v %v", tok, err)
+	}
+	declined := testCard
+	declined.LongNum = "4000000000000002"
+	if _, err := s.Tokenize(declined, "u1"); !errors.Is(err, ErrDeclined) {
+		t.Errorf("expected declined card, got %v", err)
+	}
+}
+
+func TestAdyen(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			MerchantAccount  string
+			ShopperReference string
+			PaymentMethod    map[string]string
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		if r.Header.Get("X-API-Key") != "key" || req.MerchantAccount != "Shop" || req.ShopperReference != "u1" || req.PaymentMethod["expiryYear"] != "2029" {
+			t.Errorf("unexpected request %+v", req)
+		}
+		w.Write([]byte(`{"resultCode":"Authorised","additionalData":{"tokenization.storedPaymentMethodId":"M5N7TQ4TG5PFWR50"}}`))
+	}))
+	defer ts.Close()
+	a := NewAdyen("key", "Shop")
+	a.URL = ts.URL
+	tok, err := a.Tokenize(testCard, "u1")
+	if err != nil || tok != "M5N7TQ4TG5PFWR50" {
+		t.Errorf("unexpected token %v %v", tok, err)
+	}
+}
+
+func TestNew(t *testing.T) {
+	if v, err := New(); v != nil || err != nil {
+		t.Errorf("expected local storage by default, got %v %v", v, err)
+	}
+	vault = "nope"
+	defer func() { vault = "" }()
+	if _, err := New(); err == nil {
+		t.Error("expected unknown vault to fail")
+	}
+}
+
+func TestPayment(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Card     map[string]string
+			Customer map[string]string
+			Amount   float64
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Amount != 0 || req.Customer["id"] != "u1" {
+			t.Errorf("unexpected request %+v", req)
+		}
+		if req.Card["longNum"] == "4000000000000002" {
+			w.Write([]byte(`{"authorisation":{"authorised":false,"message":"Payment declined"}}`))
+			return
+		}
+		w.Write([]byte(`{"authorisation":{"authorised":true,"message":"Payment authorised"}}`))
+	}))
+	defer ts.Close()
+	p := NewPayment()
+	p.URL = ts.URL
+	if err := p.Verify(testCard, "u1"); err != nil {
+		t.Errorf("expected card verified, got %v", err)
+	}
+	declined := testCard
+	declined.LongNum = "4000000000000002"
+	if err := p.Verify(declined, "u1"); !errors.Is(err, ErrDeclined) {
+		t.Errorf("expected declined card, got %v", err)
+	}
+}
@@ -0,0 +1,78 @@
+package cardvault
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"user/users"
+)
+
+// StripeURL is the Stripe API.
+const StripeURL = "https://api.stripe.com/v1"
+
+// Stripe stores cards as Stripe payment methods.
+type Stripe struct {
+	Key    string
+	URL    string
+	Client *http.Client
+}
+
+// NewStripe returns a Stripe vault using the secret key.
+func NewStripe(key string) *Stripe {
+	return &Stripe{Key: key, URL: StripeURL, Client: &http.Client{Timeout: 30 * time.Second}}
+}
+
+// Name returns "stripe".
+func (s *Stripe) Name() string {
+	return "stripe"
+}
+
+// Tokenize creates a payment method for c and returns its id.
+func (s *Stripe) Tokenize(c users.Card, userID string) (string, error) {
+	month, year := expiry(c.Expires)
+	form := url.Values{
+		"type":             {"card"},
+		"card[number]":     {c.LongNum},
+		"card[exp_month]":  {month},
+		"card[exp_year]":   {year},
+		"metadata[userId]": {userID},
+	}
+	if c.CCV != "" {
+		form.Set("card[cvc]", c.CCV)
+	}
+	if c.Holder != "" {
+		form.Set("billing_details[name]", c.Holder)
+	}
+	req, err := http.NewRequest("POST", s.URL+"/payment_methods", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer "+s.Key)
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var r struct {
+		ID    string `json:"id"`
+		Error struct {
+			Type    string `json:"type"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return "", err
+	}
+	if r.Error.Type == "card_error" {
+		return "", fmt.Errorf("%w: %v", ErrDeclined, r.Error.Message)
+	}
+	if resp.StatusCode/100 != 2 || r.ID == "" {
+		return "", fmt.Errorf("stripe: returned %v: %v", resp.Status, r.Error.Message)
+	}
+	return r.ID, nil
+}
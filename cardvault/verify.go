@@ -0,0 +1,105 @@
+package cardvault
+
+// verify.go contains the zero amount authorisation of new cards, so cards
+// that can't be charged are noticed before the first order is placed with
+// them. A verifier is picked with the -card-verifier flag.
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"user/users"
+)
+
+// PaymentURL is the authorisation endpoint of the payment service.
+const PaymentURL = "http://payment/paymentAuth"
+
+var (
+	verifier   string
+	paymentURL string
+	//ErrNoVerifierFound is returned when the selected verifier is unknown
+	ErrNoVerifierFound = "No card verifier with name %v"
+)
+
+func init() {
+	flag.StringVar(&verifier, "card-verifier", os.Getenv("CARD_VERIFIER"), "Service verifying new cards with a zero amount authorisation: payment, cards aren't verified when empty")
+	flag.StringVar(&paymentURL, "payment-url", os.Getenv("PAYMENT_URL"), "Authorisation endpoint of the payment service")
+}
+
+// CardVerifier checks that a card can be charged. Cards refused by their
+// issuer fail with ErrDeclined.
+type CardVerifier interface {
+	Verify(c users.Card, userID string) error
+}
+
+// NewVerifier returns the verifier selected by the flags, nil when cards
+// aren't verified.
+func NewVerifier() (CardVerifier, error) {
+	switch verifier {
+	case "":
+		return nil, nil
+	case "payment":
+		p := NewPayment()
+		if paymentURL != "" {
+			p.URL = paymentURL
+		}
+		return p, nil
+	}
+	return nil, fmt.Errorf(ErrNoVerifierFound, verifier)
+}
+
+// Payment verifies cards with a zero amount authorisation of the payment
+// service.
+type Payment struct {
+	URL    string
+	Client *http.Client
+}
+
+// NewPayment returns a verifier using the payment service at PaymentURL.
+func NewPayment() *Payment {
+	return &Payment{URL: PaymentURL, Client: &http.Client{Timeout: 30 * time.Second}}
+}
+
+// Verify asks the payment service to authorise nothing on c.
+func (p *Payment) Verify(c users.Card, userID string) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"card": map[string]string{
+			"longNum": c.LongNum,
+			"expires": c.Expires,
+			"ccv":     c.CCV,
+			"token":   c.Token,
+			"vault":   c.Vault,
+		},
+		"customer": map[string]string{"id": userID},
+		"amount":   0,
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := p.Client.Post(p.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("payment: returned %v", resp.Status)
+	}
+	var r struct {
+		Authorisation struct {
+			Authorised bool   `json:"authorised"`
+			Message    string `json:"message"`
+		} `json:"authorisation"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return err
+	}
+	if !r.Authorisation.Authorised {
+		return fmt.Errorf("%w: %v", ErrDeclined, r.Authorisation.Message)
+	}
+	return nil
+}
@@ -0,0 +1,216 @@
+package changes
+
+// changes.go contains the stream of changes to users, addresses and cards
+// that admin dashboards follow live. The broker keeps the latest events so
+// subscribers reconnecting with the id of the last event they saw resume
+// where they left off.
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Type identifies what changed.
+type Type string
+
+const (
+	UserCreated Type = "user.created"
+	UserUpdated Type = "user.updated"
+	UserDeleted Type = "user.deleted"
+	// UserLoggedIn carries where the user logged in from in its details.
+	UserLoggedIn   Type = "user.login"
+	AddressCreated Type = "address.created"
+	AddressUpdated Type = "address.updated"
+	AddressDeleted Type = "address.deleted"
+	CardCreated    Type = "card.created"
+	CardUpdated    Type = "card.updated"
+	CardDeleted    Type = "card.deleted"
+)
+
+// Types lists every type of event.
+var Types = []Type{
+	UserCreated, UserUpdated, UserDeleted, UserLoggedIn,
+	AddressCreated, AddressUpdated, AddressDeleted,
+	CardCreated, CardUpdated, CardDeleted,
+}
+
+// Event is a single change. It names what changed, never the data itself.
+type Event struct {
+	ID         string            `json:"id"`
+	Type       Type              `json:"type"`
+	ResourceID string            `json:"resourceId"`
+	UserID     string            `json:"userId,omitempty"`
+	Time       time.Time         `json:"time"`
+	Details    map[string]string `json:"details,omitempty"`
+	// Key identifies the change for events that may be published more
+	// than once, only the first is sent out.
+	Key string `json:"key,omitempty"`
+}
+
+// dedupeKeys is how many of the latest keys the broker remembers to drop
+// the events published again.
+const dedupeKeys = 4096
+
+// subscriberBuffer is how many events a subscriber may fall behind before
+// it is dropped. Dropped subscribers reconnect and resume.
+const subscriberBuffer = 64
+
+// Broker fans events out to its subscribers.
+type Broker struct {
+	mtx    sync.Mutex
+	epoch  string
+	seq    uint64
+	retain int
+	recent []Event
+	subs   map[*Subscription]struct{}
+	// watched is set once the changes come from the database, see Watch.
+	watched bool
+	// keys are the latest event keys, oldest first, and seen holds them.
+	keys []string
+	seen map[string]struct{}
+}
+
+// NewBroker returns a broker keeping the latest retain events for resuming
+// subscribers.
+func NewBroker(retain int) *Broker {
+	return &Broker{
+		epoch:  strconv.FormatInt(time.Now().UnixNano(), 36),
+		retain: retain,
+		subs:   map[*Subscription]struct{}{},
+		seen:   map[string]struct{}{},
+	}
+}
+
+// Publish sends an event of type t about the resource id of user to every
+// subscriber. Subscribers too far behind are dropped rather than waited
+// for.
+func (b *Broker) Publish(t Type, id, userID string) {
+	b.PublishEvent(Event{Type: t, ResourceID: id, UserID: userID})
+}
+
+// PublishEvent publishes e, setting its ID and Time.
+func (b *Broker) PublishEvent(e Event) {
+	b.publish(e, false)
+}
+
+// Watch has watch publish the changes to users, addresses and cards as the
+// database reports them, writes bypassing the service included. From then
+// on the broker ignores those published to it, not to have them twice,
+// even once watch returns: it is expected to be called again. Logins are
+// still published to the broker.
+func (b *Broker) Watch(ctx context.Context, watch func(context.Context, func(Event)) error) error {
+	b.mtx.Lock()
+	b.watched = true
+	b.mtx.Unlock()
+	return watch(ctx, func(e Event) { b.publish(e, true) })
+}
+
+func (b *Broker) publish(e Event, watched bool) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if b.watched && !watched && e.Type != UserLoggedIn {
+		return
+	}
+	if e.Key != "" {
+		if _, ok := b.seen[e.Key]; ok {
+			return
+		}
+		if len(b.keys) == dedupeKeys {
+			delete(b.seen, b.keys[0])
+			b.keys = append(b.keys[:0], b.keys[1:]...)
+		}
+		b.keys = append(b.keys, e.Key)
+		b.seen[e.Key] = struct{}{}
+	}
+	b.seq++
+	e.ID = fmt.Sprintf("%v-%v", b.epoch, b.seq)
+	e.Time = time.Now().UTC()
+	if b.retain > 0 {
+		if len(b.recent) == b.retain {
+			b.recent = append(b.recent[:0], b.recent[1:]...)
+		}
+		b.recent = append(b.recent, e)
+	}
+	for s := range b.subs {
+		if s.userID != "" && s.userID != e.UserID {
+			continue
+		}
+		select {
+		case s.events <- e:
+		default:
+			delete(b.subs, s)
+			close(s.events)
+		}
+	}
+}
+
+// Subscription receives the events published after it was made.
+type Subscription struct {
+	// Events is closed when the subscriber falls too far behind.
+	Events <-chan Event
+	events chan Event
+	userID string
+	b      *Broker
+}
+
+// Subscribe returns a subscription to the events after lastEventID, the
+// retained ones first. Without lastEventID only new events are received,
+// an unknown or expired one gets every retained event.
+func (b *Broker) Subscribe(lastEventID string) *Subscription {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	replay := b.after(lastEventID)
+	ch := make(chan Event, len(replay)+subscriberBuffer)
+	for _, e := range replay {
+		ch <- e
+	}
+	s := &Subscription{Events: ch, events: ch, b: b}
+	b.subs[s] = struct{}{}
+	return s
+}
+
+// SubscribeUser returns a subscription to the new events of the user with
+// userID.
+func (b *Broker) SubscribeUser(userID string) *Subscription {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	ch := make(chan Event, subscriberBuffer)
+	s := &Subscription{Events: ch, events: ch, userID: userID, b: b}
+	b.subs[s] = struct{}{}
+	return s
+}
+
+// after returns the retained events after the event id.
+func (b *Broker) after(id string) []Event {
+	if id == "" {
+		return nil
+	}
+	epoch, seq, _ := strings.Cut(id, "-")
+	n, err := strconv.ParseUint(seq, 10, 64)
+	if epoch != b.epoch || err != nil {
+		return append([]Event(nil), b.recent...)
+	}
+	// recent holds the events up to b.seq.
+	first := b.seq - uint64(len(b.recent)) + 1
+	switch {
+	case n >= b.seq:
+		return nil
+	case n+1 < first:
+		return append([]Event(nil), b.recent...)
+	}
+	return append([]Event(nil), b.recent[n+1-first:]...)
+}
+
+// Close ends the subscription.
+func (s *Subscription) Close() {
+	s.b.mtx.Lock()
+	defer s.b.mtx.Unlock()
+	if _, ok := s.b.subs[s]; ok {
+		delete(s.b.subs, s)
+		close(s.events)
+	}
+}
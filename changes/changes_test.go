@@ -0,0 +1,125 @@
+package changes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func receive(s *Subscription) []Event {
+	var es []Event
+	for {
+		select {
+		case e, ok := <-s.Events:
+			if !ok {
+				return es
+			}
+			es = append(es, e)
+		default:
+			return es
+		}
+	}
+}
+
+func TestBrokerResume(t *testing.T) {
+	b := NewBroker(3)
+	live := b.Subscribe("")
+	b.Publish(UserCreated, "u1", "u1")
+	b.Publish(AddressCreated, "a1", "u1")
+	b.Publish(CardCreated, "c1", "u1")
+	es := receive(live)
+	if len(es) != 3 || es[0].Type != UserCreated || es[2].ResourceID != "c1" {
+		t.Fatalf("expected the published events, got %v", es)
+	}
+
+	if got := receive(b.Subscribe(es[0].ID)); len(got) != 2 || got[0].ID != es[1].ID {
+		t.Errorf("expected the events after the first, got %v", got)
+	}
+	if got := receive(b.Subscribe(es[2].ID)); len(got) != 0 {
+		t.Errorf("expected nothing after the last, got %v", got)
+	}
+
+	b.Publish(CardDeleted, "c1", "u1")
+	b.Publish(UserUpdated, "u1", "u1")
+	if got := receive(b.Subscribe(es[0].ID)); len(got) != 3 || got[0].ID != es[2].ID {
+		t.Errorf("expected every retained event for an expired id, got %v", got)
+	}
+	if got := receive(b.Subscribe("other-1")); len(got) != 3 {
+		t.Errorf("expected every retained event for another broker's id, got %v", got)
+	}
+}
+
+func TestBrokerDropsSlowSubscribers(t *testing.T) {
+	b := NewBroker(0)
+	slow := b.Subscribe("")
+	for i := 0; i <= subscriberBuffer; i++ {
+		b.Publish(UserUpdated, "u1", "u1")
+	}
+	if es := receive(slow); len(es) != subscriberBuffer {
+		t.Errorf("expected the buffered events before the drop, got %v", len(es))
+	}
+	if _, ok := <-slow.Events; ok {
+		t.Error("expected the slow subscription closed")
+	}
+	slow.Close()
+
+	s := b.Subscribe("")
+	s.Close()
+	b.Publish(UserUpdated, "u1", "u1")
+	if _, ok := <-s.Events; ok {
+		t.Error("expected no events after Close")
+	}
+}
+
+func TestBrokerSubscribeUser(t *testing.T) {
+	b := NewBroker(10)
+	b.Publish(UserUpdated, "u1", "u1")
+	s := b.SubscribeUser("u1")
+	b.Publish(UserUpdated, "u2", "u2")
+	b.PublishEvent(Event{Type: UserLoggedIn, ResourceID: "u1", UserID: "u1", Details: map[string]string{"ip": "10.0.0.1"}})
+	es := receive(s)
+	if len(es) != 1 || es[0].Type != UserLoggedIn || es[0].ID == "" || es[0].Details["ip"] != "10.0.0.1" {
+		t.Errorf("expected only the new login of u1, got %v", es)
+	}
+}
+
+func TestBrokerWatch(t *testing.T) {
+	b := NewBroker(0)
+	s := b.Subscribe("")
+	watch := func(ctx context.Context, publish func(Event)) error {
+		publish(Event{Type: UserUpdated, ResourceID: "u1", UserID: "u1"})
+		return errors.New("stream closed")
+	}
+	if err := b.Watch(context.Background(), watch); err == nil {
+		t.Error("expected the error of the watch")
+	}
+	b.Publish(UserUpdated, "u1", "u1")
+	b.Publish(UserLoggedIn, "u1", "u1")
+	es := receive(s)
+	if len(es) != 2 || es[0].Type != UserUpdated || es[1].Type != UserLoggedIn {
+		t.Errorf("expected the watched change and the login, got %v", es)
+	}
+}
+
+func TestBrokerDedupe(t *testing.T) {
+	b := NewBroker(0)
+	s := b.Subscribe("")
+	b.PublishEvent(Event{Type: UserCreated, ResourceID: "u1", Key: "1"})
+	b.PublishEvent(Event{Type: UserCreated, ResourceID: "u1", Key: "1"})
+	b.PublishEvent(Event{Type: UserUpdated, ResourceID: "u1", Key: "2"})
+	b.Publish(UserUpdated, "u1", "u1")
+	b.Publish(UserUpdated, "u1", "u1")
+	es := receive(s)
+	if len(es) != 4 || es[0].Type != UserCreated || es[1].Key != "2" {
+		t.Errorf("expected the event published again dropped, got %v", es)
+	}
+	for i := 0; i < dedupeKeys; i++ {
+		b.PublishEvent(Event{Type: UserUpdated, ResourceID: "u1", Key: fmt.Sprint(i + 3)})
+	}
+	s = b.Subscribe("")
+	b.PublishEvent(Event{Type: UserCreated, ResourceID: "u1", Key: "1"})
+	if es := receive(s); len(es) != 1 {
+		t.Errorf("expected the keys forgotten past %v, got %v", dedupeKeys, es)
+	}
+}
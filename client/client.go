@@ -0,0 +1,291 @@
+// Package client calls the user service over its HTTP API, so other
+// services don't have to hand-roll the requests:
+//
+//	c := client.New(sd.FixedInstancer{"http://user:8084"})
+//	defer c.Close()
+//	u, err := c.GetUser(client.WithToken(ctx, tok), id)
+//
+// Calls are balanced round robin over the instances of the instancer, which
+// may come from any go-kit service discovery. Failed calls are retried on
+// the next instance, apart from the errors the service responded with a 4xx
+// status for. Every call is traced and the trace context passed on.
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/sd"
+	"github.com/go-kit/kit/sd/lb"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+
+	"user/users"
+)
+
+const (
+	// DefaultRetries is how often a call is tried at most.
+	DefaultRetries = 3
+	// DefaultTimeout is how long a call may take, retries included.
+	DefaultTimeout = 10 * time.Second
+)
+
+// Error is an error the service responded with.
+type Error struct {
+	StatusCode int    `json:"status_code"`
+	Message    string `json:"error"`
+	// Field is the request field the error is about, if any.
+	Field string `json:"field,omitempty"`
+}
+
+func (e *Error) Error() string {
+	if e.Field != "" {
+		return fmt.Sprintf("user service: %d %s (%s)", e.StatusCode, e.Message, e.Field)
+	}
+	return fmt.Sprintf("user service: %d %s", e.StatusCode, e.Message)
+}
+
+// Temporary reports whether the call may succeed when tried again.
+func (e *Error) Temporary() bool {
+	return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithRetries sets how often a call is tried at most and how long it may
+// take, retries included.
+func WithRetries(max int, timeout time.Duration) Option {
+	return func(c *Client) {
+		c.retries = max
+		c.timeout = timeout
+	}
+}
+
+// WithHTTPClient sets the client the requests are sent with,
+// http.DefaultClient by default.
+func WithHTTPClient(h *http.Client) Option {
+	return func(c *Client) {
+		c.http = h
+	}
+}
+
+// WithLogger sets the logger of the service discovery.
+func WithLogger(logger log.Logger) Option {
+	return func(c *Client) {
+		c.logger = logger
+	}
+}
+
+// Client calls the user service. It is safe for concurrent use.
+type Client struct {
+	retries int
+	timeout time.Duration
+	http    *http.Client
+	logger  log.Logger
+
+	endpointers []*sd.DefaultEndpointer
+	get         endpoint.Endpoint
+	addresses   endpoint.Endpoint
+	cards       endpoint.Endpoint
+	login       endpoint.Endpoint
+	register    endpoint.Endpoint
+	list        endpoint.Endpoint
+	reset       endpoint.Endpoint
+	delete      endpoint.Endpoint
+	export      endpoint.Endpoint
+}
+
+// New returns a client of the instances of instancer, the base URLs of the
+// service. Close ends the watching of the instancer.
+func New(instancer sd.Instancer, opts ...Option) *Client {
+	c := &Client{
+		retries: DefaultRetries,
+		timeout: DefaultTimeout,
+		http:    http.DefaultClient,
+		logger:  log.NewNopLogger(),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	c.get = c.balance(instancer, "GetUser", getUserFactory)
+	c.addresses = c.balance(instancer, "GetAddresses", getAddressesFactory)
+	c.cards = c.balance(instancer, "GetCards", getCardsFactory)
+	c.login = c.balance(instancer, "Login", loginFactory)
+	c.register = c.balance(instancer, "Register", registerFactory)
+	c.list = c.balance(instancer, "ListUsers", listUsersFactory)
+	c.reset = c.balance(instancer, "ResetPassword", resetPasswordFactory)
+	c.delete = c.balance(instancer, "DeleteUser", deleteUserFactory)
+	// Exports are streamed to the caller, so they are tried once: the
+	// retries end their calls when they return.
+	balancer := lb.NewRoundRobin(c.endpointer(instancer, exportUsersFactory))
+	c.export = traced("ExportUsers", func(ctx context.Context, request interface{}) (interface{}, error) {
+		e, err := balancer.Endpoint()
+		if err != nil {
+			return nil, err
+		}
+		return e(ctx, request)
+	})
+	return c
+}
+
+// Close stops watching the instances.
+func (c *Client) Close() {
+	for _, e := range c.endpointers {
+		e.Close()
+	}
+}
+
+// endpointer returns the endpoints made by f for the instances.
+func (c *Client) endpointer(instancer sd.Instancer, f func(string, *http.Client) (endpoint.Endpoint, error)) sd.Endpointer {
+	endpointer := sd.NewEndpointer(instancer, func(instance string) (endpoint.Endpoint, io.Closer, error) {
+		e, err := f(instance, c.http)
+		return e, nil, err
+	}, c.logger)
+	c.endpointers = append(c.endpointers, endpointer)
+	return endpointer
+}
+
+// balance returns the endpoint made by f, balanced over the instances,
+// retried and traced.
+func (c *Client) balance(instancer sd.Instancer, name string, f func(string, *http.Client) (endpoint.Endpoint, error)) endpoint.Endpoint {
+	balancer := lb.NewRoundRobin(c.endpointer(instancer, f))
+	retry := lb.RetryWithCallback(c.timeout, balancer, func(n int, err error) (bool, error) {
+		var e *Error
+		if errors.As(err, &e) && !e.Temporary() {
+			return false, e
+		}
+		return n < c.retries, nil
+	})
+	return traced(name, retry)
+}
+
+// traced wraps next in a span named after the call.
+func traced(name string, next endpoint.Endpoint) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		ctx, span := otel.Tracer("user/client").Start(ctx, name)
+		span.SetAttributes(attribute.Key("service").String("user"))
+		defer span.End()
+		response, err := next(ctx, request)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		return response, err
+	}
+}
+
+// GetUser returns the customer with the given id.
+func (c *Client) GetUser(ctx context.Context, id string) (users.User, error) {
+	response, err := c.get(ctx, id)
+	if err != nil {
+		return users.User{}, unwrap(err)
+	}
+	return response.(users.User), nil
+}
+
+// GetAddresses returns the addresses of the customer with the given id.
+func (c *Client) GetAddresses(ctx context.Context, id string) ([]users.Address, error) {
+	response, err := c.addresses(ctx, id)
+	if err != nil {
+		return nil, unwrap(err)
+	}
+	return response.([]users.Address), nil
+}
+
+// GetCards returns the masked cards of the customer with the given id.
+func (c *Client) GetCards(ctx context.Context, id string) ([]users.Card, error) {
+	response, err := c.cards(ctx, id)
+	if err != nil {
+		return nil, unwrap(err)
+	}
+	return response.([]users.Card), nil
+}
+
+// Login checks the credentials and returns the customer with a token of
+// the given scopes, the default ones when none are given.
+func (c *Client) Login(ctx context.Context, username, password string, scopes ...string) (users.User, string, error) {
+	response, err := c.login(ctx, loginRequest{Username: username, Password: password, Scopes: scopes})
+	if err != nil {
+		return users.User{}, "", unwrap(err)
+	}
+	r := response.(loginResponse)
+	return r.User, r.Token, nil
+}
+
+// Registration is a new customer.
+type Registration struct {
+	Username  string `json:"username"`
+	Password  string `json:"password"`
+	Email     string `json:"email,omitempty"`
+	FirstName string `json:"firstName,omitempty"`
+	LastName  string `json:"lastName,omitempty"`
+	Phone     string `json:"phone,omitempty"`
+}
+
+// Register creates the customer and returns its id. Retries send the same
+// idempotency key, so the customer is created once.
+func (c *Client) Register(ctx context.Context, r Registration) (string, error) {
+	response, err := c.register(withIdempotencyKey(ctx), r)
+	if err != nil {
+		return "", unwrap(err)
+	}
+	return response.(string), nil
+}
+
+// ListUsers returns a page of customers and the cursor of the next page,
+// empty on the last one. It needs an admin token.
+func (c *Client) ListUsers(ctx context.Context, cursor string, limit int) ([]users.User, string, error) {
+	response, err := c.list(ctx, listRequest{Cursor: cursor, Limit: limit})
+	if err != nil {
+		return nil, "", unwrap(err)
+	}
+	r := response.(listResponse)
+	return r.Users, r.Next, nil
+}
+
+// ResetPassword sets a new password of the customer, a generated one when
+// password is empty, and returns the generated one. It needs an admin token.
+func (c *Client) ResetPassword(ctx context.Context, id, password string) (string, error) {
+	response, err := c.reset(ctx, resetPasswordRequest{ID: id, Password: password})
+	if err != nil {
+		return "", unwrap(err)
+	}
+	return response.(string), nil
+}
+
+// DeleteUser deletes the customer with the given id.
+func (c *Client) DeleteUser(ctx context.Context, id string) error {
+	_, err := c.delete(ctx, id)
+	return unwrap(err)
+}
+
+// ExportUsers writes the CSV export of all customers to w, with the given
+// columns masked. It needs an admin token.
+func (c *Client) ExportUsers(ctx context.Context, w io.Writer, mask []string) error {
+	response, err := c.export(ctx, mask)
+	if err != nil {
+		return err
+	}
+	body := response.(io.ReadCloser)
+	defer body.Close()
+	_, err = io.Copy(w, body)
+	return err
+}
+
+// unwrap returns the error the service responded with last rather than
+// the retry error.
+func unwrap(err error) error {
+	var re lb.RetryError
+	if errors.As(err, &re) && re.Final != nil {
+		return re.Final
+	}
+	return err
+}
@@ -0,0 +1,167 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/sd"
+)
+
+func TestGetUser(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/customers/57a98d98e4b00679b4a830af" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		if r.Header.Get("Authorization") != "Bearer tok" || r.Header.Get("X-Tenant-ID") != "shop-1" || r.Header.Get("X-Request-ID") != "req-1" {
+			t.Errorf("unexpected headers %v", r.Header)
+		}
+		w.Write([]byte(`{"firstName":"Eve","username":"eve","id":"57a98d98e4b00679b4a830af","_links":{}}`))
+	}))
+	defer srv.Close()
+	c := New(sd.FixedInstancer{srv.URL})
+	defer c.Close()
+
+	ctx := WithRequestID(WithTenant(WithToken(context.Background(), "tok"), "shop-1"), "req-1")
+	u, err := c.GetUser(ctx, "57a98d98e4b00679b4a830af")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Username != "eve" || u.UserID != "57a98d98e4b00679b4a830af" {
+		t.Errorf("unexpected user %+v", u)
+	}
+}
+
+func TestGetAddresses(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/customers/1/addresses" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		w.Write([]byte(`{"_embedded":{"addresses":[{"id":"2","street":"Main Street","city":"Springfield"}]}}`))
+	}))
+	defer srv.Close()
+	c := New(sd.FixedInstancer{srv.URL})
+	defer c.Close()
+
+	as, err := c.GetAddresses(context.Background(), "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(as) != 1 || as[0].Street != "Main Street" {
+		t.Errorf("unexpected addresses %+v", as)
+	}
+}
+
+func TestLogin(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, p, ok := r.BasicAuth()
+		if r.URL.Path != "/v2/login" || !ok || u != "eve" || p != "secret" || r.URL.Query().Get("scope") != "profile cards" {
+			t.Errorf("unexpected request %s %v", r.URL, r.Header)
+		}
+		w.Write([]byte(`{"user":{"username":"eve"},"token":"tok"}`))
+	}))
+	defer srv.Close()
+	c := New(sd.FixedInstancer{srv.URL})
+	defer c.Close()
+
+	u, tok, err := c.Login(context.Background(), "eve", "secret", "profile", "cards")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Username != "eve" || tok != "tok" {
+		t.Errorf("unexpected login %+v %q", u, tok)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	var calls int32
+	var key atomic.Value
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		k := r.Header.Get("Idempotency-Key")
+		if k == "" || !key.CompareAndSwap(nil, k) && key.Load() != k {
+			t.Errorf("expected the same idempotency key on every try, got %q", k)
+		}
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"id":"1"}`))
+	}))
+	defer srv.Close()
+	c := New(sd.FixedInstancer{srv.URL}, WithRetries(3, time.Second))
+	defer c.Close()
+
+	id, err := c.Register(context.Background(), Registration{Username: "eve", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "1" || atomic.LoadInt32(&calls) != 3 {
+		t.Errorf("expected id 1 after 3 calls, got %q after %d", id, calls)
+	}
+}
+
+func TestClientErrorNotRetried(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error":"Not found","status_code":404,"status_text":"Not Found"}`))
+	}))
+	defer srv.Close()
+	c := New(sd.FixedInstancer{srv.URL})
+	defer c.Close()
+
+	_, err := c.GetCards(context.Background(), "1")
+	var e *Error
+	if !errors.As(err, &e) || e.StatusCode != http.StatusNotFound || e.Message != "Not found" {
+		t.Fatalf("expected the 404, got %v", err)
+	}
+	if atomic.LoadInt32(&calls) != 1 {
+		t.Errorf("expected no retry, got %d calls", calls)
+	}
+}
+
+func TestListUsers(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/admin/customers" || r.URL.Query().Get("cursor") != "abc" || r.URL.Query().Get("limit") != "2" {
+			t.Errorf("unexpected request %s", r.URL)
+		}
+		w.Write([]byte(`{"_embedded":{"customer":[{"id":"1","username":"eve","email":"eve@example.com","status":"active"}]},"next":"def"}`))
+	}))
+	defer srv.Close()
+	c := New(sd.FixedInstancer{srv.URL})
+	defer c.Close()
+
+	us, next, err := c.ListUsers(context.Background(), "abc", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(us) != 1 || us[0].UserID != "1" || us[0].Email != "eve@example.com" || next != "def" {
+		t.Errorf("unexpected page %+v %q", us, next)
+	}
+}
+
+func TestExportUsers(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/admin/customers/export" || r.URL.Query().Get("mask") != "email,phone" {
+			t.Errorf("unexpected request %s", r.URL)
+		}
+		w.Write([]byte("id,username\n1,eve\n"))
+	}))
+	defer srv.Close()
+	c := New(sd.FixedInstancer{srv.URL})
+	defer c.Close()
+
+	var b strings.Builder
+	if err := c.ExportUsers(context.Background(), &b, []string{"email", "phone"}); err != nil {
+		t.Fatal(err)
+	}
+	if b.String() != "id,username\n1,eve\n" {
+		t.Errorf("unexpected export %q", b.String())
+	}
+}
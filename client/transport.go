@@ -0,0 +1,346 @@
+package client
+
+// transport.go contains the HTTP requests of the calls and the decoding of
+// their responses, in the shape of API version 2.
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	httptransport "github.com/go-kit/kit/transport/http"
+	"go.opentelemetry.io/otel/propagation"
+
+	"user/users"
+)
+
+type contextKey int
+
+const (
+	tokenContextKey contextKey = iota
+	tenantContextKey
+	requestIDContextKey
+	idempotencyKeyContextKey
+)
+
+// WithToken returns a context whose calls are authorized by the bearer
+// token tok.
+func WithToken(ctx context.Context, tok string) context.Context {
+	return context.WithValue(ctx, tokenContextKey, tok)
+}
+
+// WithTenant returns a context whose calls are made for the tenant, when
+// their token doesn't name one.
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantContextKey, tenant)
+}
+
+// WithRequestID returns a context whose calls pass on the request id, so
+// the service logs them with it.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDContextKey, id)
+}
+
+// withIdempotencyKey returns a context whose calls send a new idempotency
+// key, so retries don't create a resource twice.
+func withIdempotencyKey(ctx context.Context) context.Context {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return context.WithValue(ctx, idempotencyKeyContextKey, hex.EncodeToString(b))
+}
+
+// contextToHeaders sets the headers of the token, tenant, request id,
+// idempotency key and trace context of ctx.
+func contextToHeaders(ctx context.Context, r *http.Request) context.Context {
+	if tok, ok := ctx.Value(tokenContextKey).(string); ok && tok != "" {
+		r.Header.Set("Authorization", "Bearer "+tok)
+	}
+	if tenant, ok := ctx.Value(tenantContextKey).(string); ok && tenant != "" {
+		r.Header.Set("X-Tenant-ID", tenant)
+	}
+	if id, ok := ctx.Value(requestIDContextKey).(string); ok && id != "" {
+		r.Header.Set("X-Request-ID", id)
+	}
+	if key, ok := ctx.Value(idempotencyKeyContextKey).(string); ok {
+		r.Header.Set("Idempotency-Key", key)
+	}
+	propagation.TraceContext{}.Inject(ctx, propagation.HeaderCarrier(r.Header))
+	return ctx
+}
+
+type loginRequest struct {
+	Username string
+	Password string
+	Scopes   []string
+}
+
+type loginResponse struct {
+	User  users.User `json:"user"`
+	Token string     `json:"token"`
+}
+
+type listRequest struct {
+	Cursor string
+	Limit  int
+}
+
+type listResponse struct {
+	Users []users.User
+	Next  string
+}
+
+// listedUser is a customer of the admin listing, which includes the email.
+type listedUser struct {
+	ID          string     `json:"id"`
+	Username    string     `json:"username"`
+	Email       string     `json:"email"`
+	FirstName   string     `json:"firstName"`
+	LastName    string     `json:"lastName"`
+	Status      string     `json:"status"`
+	Roles       []string   `json:"roles"`
+	Tags        []string   `json:"tags"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	LastLoginAt *time.Time `json:"lastLoginAt"`
+	LoginCount  int        `json:"loginCount"`
+}
+
+type resetPasswordRequest struct {
+	ID       string `json:"-"`
+	Password string `json:"password"`
+}
+
+// newEndpoint returns the endpoint of the route at instance, a base URL.
+func newEndpoint(instance, method, path string, h *http.Client, enc httptransport.EncodeRequestFunc, dec httptransport.DecodeResponseFunc, opts ...httptransport.ClientOption) (endpoint.Endpoint, error) {
+	if !strings.Contains(instance, "://") {
+		instance = "http://" + instance
+	}
+	u, err := url.Parse(strings.TrimSuffix(instance, "/") + path)
+	if err != nil {
+		return nil, err
+	}
+	opts = append([]httptransport.ClientOption{
+		httptransport.SetClient(h),
+		httptransport.ClientBefore(contextToHeaders),
+	}, opts...)
+	return httptransport.NewClient(method, u, enc, dec, opts...).Endpoint(), nil
+}
+
+func getUserFactory(instance string, h *http.Client) (endpoint.Endpoint, error) {
+	return newEndpoint(instance, "GET", "/v2/customers", h, encodeIDRequest(""), decodeUserResponse)
+}
+
+func getAddressesFactory(instance string, h *http.Client) (endpoint.Endpoint, error) {
+	return newEndpoint(instance, "GET", "/v2/customers", h, encodeIDRequest("addresses"), decodeEmbeddedResponse("addresses"))
+}
+
+func getCardsFactory(instance string, h *http.Client) (endpoint.Endpoint, error) {
+	return newEndpoint(instance, "GET", "/v2/customers", h, encodeIDRequest("cards"), decodeEmbeddedResponse("cards"))
+}
+
+func loginFactory(instance string, h *http.Client) (endpoint.Endpoint, error) {
+	return newEndpoint(instance, "GET", "/v2/login", h, encodeLoginRequest, decodeLoginResponse)
+}
+
+func registerFactory(instance string, h *http.Client) (endpoint.Endpoint, error) {
+	return newEndpoint(instance, "POST", "/v2/register", h, httptransport.EncodeJSONRequest, decodeRegisterResponse)
+}
+
+func listUsersFactory(instance string, h *http.Client) (endpoint.Endpoint, error) {
+	return newEndpoint(instance, "GET", "/v2/admin/customers", h, encodeListRequest, decodeListResponse)
+}
+
+func resetPasswordFactory(instance string, h *http.Client) (endpoint.Endpoint, error) {
+	return newEndpoint(instance, "PUT", "/v2/admin/customers", h, encodeResetPasswordRequest, decodeResetPasswordResponse)
+}
+
+func deleteUserFactory(instance string, h *http.Client) (endpoint.Endpoint, error) {
+	return newEndpoint(instance, "DELETE", "/v2/customers", h, encodeIDRequest(""), decodeDeleteResponse)
+}
+
+func exportUsersFactory(instance string, h *http.Client) (endpoint.Endpoint, error) {
+	return newEndpoint(instance, "GET", "/v2/admin/customers/export", h, encodeExportRequest, decodeExportResponse, httptransport.BufferedStream(true))
+}
+
+// encodeIDRequest appends the id of the request, and attr if any, to the
+// path.
+func encodeIDRequest(attr string) httptransport.EncodeRequestFunc {
+	return func(_ context.Context, r *http.Request, request interface{}) error {
+		r.URL = r.URL.JoinPath(request.(string))
+		if attr != "" {
+			r.URL = r.URL.JoinPath(attr)
+		}
+		return nil
+	}
+}
+
+func encodeLoginRequest(_ context.Context, r *http.Request, request interface{}) error {
+	req := request.(loginRequest)
+	r.SetBasicAuth(req.Username, req.Password)
+	if len(req.Scopes) > 0 {
+		r.URL.RawQuery = url.Values{"scope": {strings.Join(req.Scopes, " ")}}.Encode()
+	}
+	return nil
+}
+
+func encodeListRequest(_ context.Context, r *http.Request, request interface{}) error {
+	req := request.(listRequest)
+	q := url.Values{}
+	if req.Cursor != "" {
+		q.Set("cursor", req.Cursor)
+	}
+	if req.Limit > 0 {
+		q.Set("limit", strconv.Itoa(req.Limit))
+	}
+	r.URL.RawQuery = q.Encode()
+	return nil
+}
+
+func encodeResetPasswordRequest(ctx context.Context, r *http.Request, request interface{}) error {
+	req := request.(resetPasswordRequest)
+	r.URL = r.URL.JoinPath(req.ID, "password")
+	return httptransport.EncodeJSONRequest(ctx, r, req)
+}
+
+func encodeExportRequest(_ context.Context, r *http.Request, request interface{}) error {
+	r.URL.RawQuery = url.Values{"mask": {strings.Join(request.([]string), ",")}}.Encode()
+	return nil
+}
+
+// decodeError returns the error the service responded with, if any.
+func decodeError(r *http.Response) error {
+	if r.StatusCode < 400 {
+		return nil
+	}
+	e := &Error{}
+	if err := json.NewDecoder(r.Body).Decode(e); err != nil || e.Message == "" {
+		e.Message = http.StatusText(r.StatusCode)
+	}
+	e.StatusCode = r.StatusCode
+	return e
+}
+
+func decodeUserResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	if err := decodeError(r); err != nil {
+		return nil, err
+	}
+	var u users.User
+	err := json.NewDecoder(r.Body).Decode(&u)
+	return u, err
+}
+
+// decodeEmbeddedResponse decodes the collection embedded under name.
+func decodeEmbeddedResponse(name string) httptransport.DecodeResponseFunc {
+	return func(_ context.Context, r *http.Response) (interface{}, error) {
+		if err := decodeError(r); err != nil {
+			return nil, err
+		}
+		var doc struct {
+			Embedded map[string]json.RawMessage `json:"_embedded"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&doc); err != nil {
+			return nil, err
+		}
+		switch name {
+		case "addresses":
+			as := []users.Address{}
+			err := unmarshalEmbedded(doc.Embedded[name], &as)
+			return as, err
+		default:
+			cs := []users.Card{}
+			err := unmarshalEmbedded(doc.Embedded[name], &cs)
+			return cs, err
+		}
+	}
+}
+
+func unmarshalEmbedded(raw json.RawMessage, v interface{}) error {
+	if len(raw) == 0 {
+		return nil
+	}
+	return json.Unmarshal(raw, v)
+}
+
+func decodeLoginResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	if err := decodeError(r); err != nil {
+		return nil, err
+	}
+	var l loginResponse
+	err := json.NewDecoder(r.Body).Decode(&l)
+	return l, err
+}
+
+func decodeRegisterResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	if err := decodeError(r); err != nil {
+		return nil, err
+	}
+	var p struct {
+		ID string `json:"id"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&p)
+	return p.ID, err
+}
+
+// decodeListResponse decodes the admin listing, which keeps its _embedded
+// customer in every API version.
+func decodeListResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	if err := decodeError(r); err != nil {
+		return nil, err
+	}
+	var doc struct {
+		Embedded struct {
+			Customers []listedUser `json:"customer"`
+		} `json:"_embedded"`
+		Next string `json:"next"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&doc); err != nil {
+		return nil, err
+	}
+	l := listResponse{Users: make([]users.User, 0, len(doc.Embedded.Customers)), Next: doc.Next}
+	for _, u := range doc.Embedded.Customers {
+		l.Users = append(l.Users, users.User{
+			UserID:      u.ID,
+			Username:    u.Username,
+			Email:       u.Email,
+			FirstName:   u.FirstName,
+			LastName:    u.LastName,
+			Status:      u.Status,
+			Roles:       u.Roles,
+			Tags:        u.Tags,
+			CreatedAt:   u.CreatedAt,
+			LastLoginAt: u.LastLoginAt,
+			LoginCount:  u.LoginCount,
+		})
+	}
+	return l, nil
+}
+
+func decodeResetPasswordResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	if err := decodeError(r); err != nil {
+		return nil, err
+	}
+	var p struct {
+		Password string `json:"password"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&p)
+	return p.Password, err
+}
+
+func decodeDeleteResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	return nil, decodeError(r)
+}
+
+// decodeExportResponse returns the body, which the caller closes.
+func decodeExportResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	if err := decodeError(r); err != nil {
+		r.Body.Close()
+		return nil, err
+	}
+	return r.Body, nil
+}
@@ -0,0 +1,399 @@
+// Command userctl administers customers for on-call and migration tasks.
+// It calls the API of a running service with an admin token, or with
+// -offline works on the database directly, configured by the same flags
+// and environment as the service:
+//
+//	userctl -url http://user:8084 -token $ADMIN_TOKEN list
+//	userctl -offline -mongo-host mongo:27017 reset-password 57a98d98e4b00679b4a830af
+//	userctl -offline -database postgres migrate -status
+//	userctl -offline -database sqlite seed -users 1000
+//	userctl -offline -archive-store s3 -archive-bucket user-archive archived 57a98d98e4b00679b4a830af
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/sd"
+	"user/api"
+	"user/archive"
+	"user/client"
+	"user/db"
+	"user/db/cache"
+	"user/db/dynamodb"
+	"user/db/inmem"
+	"user/db/mongodb"
+	"user/db/mysql"
+	"user/db/postgres"
+	"user/db/sqlite"
+	"user/pii"
+	"user/secrets"
+	"user/users"
+)
+
+// backend is what the subcommands are run against: the API of a running
+// service, or the database directly.
+type backend interface {
+	Register(ctx context.Context, r client.Registration) (string, error)
+	ResetPassword(ctx context.Context, id, password string) (string, error)
+	ListUsers(ctx context.Context, cursor string, limit int) ([]users.User, string, error)
+	DeleteUser(ctx context.Context, id string) error
+	ExportUsers(ctx context.Context, w io.Writer, mask []string) error
+}
+
+// archiveReader is implemented by the backends working on the database
+// directly, which reading the archive of purged users needs.
+type archiveReader interface {
+	Archived(ctx context.Context, id string) (archive.Record, error)
+}
+
+// migrator is implemented by the backends working on the database
+// directly, which migrations need.
+type migrator interface {
+	Migrate(ctx context.Context) ([]db.MigrationStatus, error)
+	MigrationStatus(ctx context.Context) ([]db.MigrationStatus, error)
+}
+
+const usage = `usage: userctl [flags] <command> [arguments]
+
+Commands:
+  create-user -username <name> -password <password> [-email, -first, -last, -phone]
+  reset-password [-password <password>] <id>   generates a password when none is given
+  list [-limit <n>]                            lists all customers
+  delete <id>...                               deletes customers
+  export [-mask <columns>]                     writes all customers as CSV
+  migrate [-status]                            applies the pending database migrations, needs -offline
+  archived <id>                                writes the archived record of a purged customer as JSON, needs -offline
+  seed [-users <n>, -addresses <n>, -cards <n>, -locales <tags>, -password <password>, -seed <n>]
+                                               creates made up customers, needs -offline
+
+Flags:
+`
+
+func main() {
+	var (
+		url     = flag.String("url", envOr("USER_URL", "http://localhost:8084"), "Base URL of the user service")
+		token   = flag.String("token", os.Getenv("USER_TOKEN"), "Admin token the API is called with")
+		tenant  = flag.String("tenant", os.Getenv("USER_TENANT"), "Tenant whose customers are administered, the default one when empty")
+		offline = flag.Bool("offline", false, "Work on the database directly instead of calling the API")
+		timeout = flag.Duration("timeout", time.Minute, "How long a command may take")
+	)
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	var b backend
+	if *offline {
+		if flag.Arg(0) == "migrate" {
+			// Listing the status doesn't apply them.
+			db.AutoMigrate = false
+		}
+		o, err := newOffline(*tenant)
+		if err != nil {
+			fatal(err)
+		}
+		defer o.all.Close()
+		b = o
+	} else {
+		c := client.New(sd.FixedInstancer{*url})
+		defer c.Close()
+		ctx = client.WithTenant(client.WithToken(ctx, *token), *tenant)
+		b = c
+	}
+	if err := run(ctx, b, flag.Args(), os.Stdout); err != nil {
+		fatal(err)
+	}
+}
+
+// run runs the command of args against b, writing its output to w.
+func run(ctx context.Context, b backend, args []string, w io.Writer) error {
+	cmd, args := args[0], args[1:]
+	fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+	switch cmd {
+	case "create-user":
+		var r client.Registration
+		fs.StringVar(&r.Username, "username", "", "Username")
+		fs.StringVar(&r.Password, "password", "", "Password")
+		fs.StringVar(&r.Email, "email", "", "Email")
+		fs.StringVar(&r.FirstName, "first", "", "First name")
+		fs.StringVar(&r.LastName, "last", "", "Last name")
+		fs.StringVar(&r.Phone, "phone", "", "Phone number")
+		fs.Parse(args)
+		if r.Username == "" || r.Password == "" {
+			return fmt.Errorf("create-user: -username and -password are required")
+		}
+		id, err := b.Register(ctx, r)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(w, id)
+	case "reset-password":
+		password := fs.String("password", "", "New password, generated when empty")
+		fs.Parse(args)
+		if fs.NArg() != 1 {
+			return fmt.Errorf("reset-password: expected one customer id")
+		}
+		generated, err := b.ResetPassword(ctx, fs.Arg(0), *password)
+		if err != nil {
+			return err
+		}
+		if generated != "" {
+			fmt.Fprintln(w, generated)
+		}
+	case "list":
+		limit := fs.Int("limit", api.MaxPageSize, "Customers fetched per page")
+		fs.Parse(args)
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tUSERNAME\tEMAIL\tSTATUS\tCREATED")
+		cursor := ""
+		for {
+			us, next, err := b.ListUsers(ctx, cursor, *limit)
+			if err != nil {
+				return err
+			}
+			for _, u := range us {
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", u.UserID, u.Username, u.Email, u.GetStatus(), u.CreatedAt.Format(time.RFC3339))
+			}
+			if next == "" {
+				break
+			}
+			cursor = next
+		}
+		return tw.Flush()
+	case "delete":
+		fs.Parse(args)
+		if fs.NArg() == 0 {
+			return fmt.Errorf("delete: expected customer ids")
+		}
+		for _, id := range fs.Args() {
+			if err := b.DeleteUser(ctx, id); err != nil {
+				return fmt.Errorf("delete %s: %w", id, err)
+			}
+		}
+	case "export":
+		mask := fs.String("mask", strings.Join(api.DefaultExportMask, ","), "Comma separated columns to mask, none when empty")
+		fs.Parse(args)
+		var columns []string
+		if *mask != "" {
+			columns = strings.Split(*mask, ",")
+		}
+		return b.ExportUsers(ctx, w, columns)
+	case "migrate":
+		statusOnly := fs.Bool("status", false, "Only list the migrations and when they were applied")
+		fs.Parse(args)
+		m, ok := b.(migrator)
+		if !ok {
+			return fmt.Errorf("migrate: needs -offline")
+		}
+		var status []db.MigrationStatus
+		var err error
+		if *statusOnly {
+			status, err = m.MigrationStatus(ctx)
+		} else {
+			status, err = m.Migrate(ctx)
+		}
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "VERSION\tNAME\tAPPLIED")
+		for _, st := range status {
+			applied := "pending"
+			if st.AppliedAt != nil {
+				applied = st.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(tw, "%d\t%s\t%s\n", st.Version, st.Name, applied)
+		}
+		return tw.Flush()
+	case "archived":
+		fs.Parse(args)
+		a, ok := b.(archiveReader)
+		if !ok {
+			return fmt.Errorf("archived: needs -offline")
+		}
+		if fs.NArg() != 1 {
+			return fmt.Errorf("archived: expected one id")
+		}
+		r, err := a.Archived(ctx, fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(r)
+	case "seed":
+		var o seedOptions
+		fs.IntVar(&o.Users, "users", 100, "Customers created")
+		fs.IntVar(&o.Addresses, "addresses", 2, "Most addresses per customer")
+		fs.IntVar(&o.Cards, "cards", 2, "Most cards per customer")
+		locales := fs.String("locales", strings.Join(seedTags(), ","), "Comma separated locales the customers are spread over")
+		fs.StringVar(&o.Password, "password", "password", "Password of every customer")
+		n := fs.Int64("seed", 0, "Seed of the made up data, the same seed makes up the same customers, a random one when 0")
+		fs.Parse(args)
+		s, ok := b.(seeder)
+		if !ok {
+			return fmt.Errorf("seed: needs -offline")
+		}
+		if *n == 0 {
+			*n = time.Now().UnixNano()
+		}
+		o.Locales = strings.Split(*locales, ",")
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tUSERNAME\tLOCALE")
+		err := seed(ctx, s, rand.New(rand.NewSource(*n)), o, func(u users.User) {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", u.UserID, u.Username, u.Locale)
+		})
+		if err != nil {
+			return err
+		}
+		return tw.Flush()
+	default:
+		return fmt.Errorf("unknown command %q", cmd)
+	}
+	return nil
+}
+
+// offline runs the commands on the database through the service, the way
+// the API would.
+type offline struct {
+	s     api.Service
+	store *db.Store
+	// all is the store of every tenant, closed once done.
+	all *db.Store
+	// archive holds the purged users of tenant, nil without one.
+	archive *archive.Archive
+	tenant  string
+}
+
+// newOffline connects to the database of the tenant with the keys of the
+// secrets provider.
+func newOffline(tenant string) (offline, error) {
+	if err := secrets.Init(); err != nil {
+		return offline{}, err
+	}
+	var opts []db.StoreOption
+	var cipher, cardCipher *pii.Cipher
+	var err error
+	if key := secrets.Value(secrets.CardEncryptionKey); key != "" {
+		if cardCipher, err = pii.New([]byte(key)); err != nil {
+			return offline{}, err
+		}
+		opts = append(opts, db.WithCardCipher(cardCipher))
+	}
+	if key := secrets.Value(secrets.PIIEncryptionKey); key != "" {
+		if cipher, err = pii.New([]byte(key)); err != nil {
+			return offline{}, err
+		}
+		opts = append(opts, db.WithCipher(cipher))
+	}
+	db.Register("mongodb", &mongodb.Mongo{Cipher: cipher})
+	db.Register("postgres", &postgres.Postgres{})
+	db.Register("mysql", &mysql.MySQL{})
+	db.Register("inmem", &inmem.Memory{Cipher: cipher, CardCipher: cardCipher})
+	db.Register("sqlite", &sqlite.SQLite{})
+	db.Register("dynamodb", &dynamodb.DynamoDB{})
+	d, err := db.Open()
+	if err != nil {
+		return offline{}, err
+	}
+	// Writes invalidate what the service has cached.
+	all := db.NewStore(cache.New(d, log.NewLogfmtLogger(os.Stderr)), opts...)
+	store, err := all.Tenant(tenant)
+	if err != nil {
+		all.Close()
+		return offline{}, err
+	}
+	arch, err := archive.New()
+	if err != nil {
+		all.Close()
+		return offline{}, err
+	}
+	audit := log.With(log.NewLogfmtLogger(os.Stderr), "audit", "userctl")
+	svcOpts := []api.ServiceOption{api.WithTenant(tenant, store), api.WithAuditLogger(audit)}
+	if arch != nil {
+		svcOpts = append(svcOpts, api.WithArchive(arch))
+	}
+	return offline{api.NewFixedService(svcOpts...), store, all, arch, tenant}, nil
+}
+
+func (o offline) Archived(ctx context.Context, id string) (archive.Record, error) {
+	if o.archive == nil {
+		return archive.Record{}, errors.New("archived: no -archive-store")
+	}
+	return o.archive.Get(o.tenant, id)
+}
+
+func (o offline) Register(ctx context.Context, r client.Registration) (string, error) {
+	return o.s.Register(ctx, r.Username, r.Password, r.Email, r.FirstName, r.LastName, r.Phone)
+}
+
+func (o offline) ResetPassword(ctx context.Context, id, password string) (string, error) {
+	return o.s.ResetPassword(ctx, id, password)
+}
+
+func (o offline) ListUsers(ctx context.Context, cursor string, limit int) ([]users.User, string, error) {
+	return o.s.ListUsers(ctx, cursor, limit)
+}
+
+func (o offline) DeleteUser(ctx context.Context, id string) error {
+	return o.s.Delete(ctx, "customers", id)
+}
+
+func (o offline) PostUser(ctx context.Context, u users.User) (string, error) {
+	return o.s.PostUser(ctx, u)
+}
+
+func (o offline) PostAddress(ctx context.Context, a users.Address, userID string) (string, error) {
+	return o.s.PostAddress(ctx, a, userID)
+}
+
+func (o offline) PostCard(ctx context.Context, c users.Card, userID string) (string, error) {
+	return o.s.PostCard(ctx, c, userID)
+}
+
+func (o offline) ExportUsers(ctx context.Context, w io.Writer, mask []string) error {
+	return o.s.ExportUsers(ctx, w, mask)
+}
+
+// Migrate applies the pending migrations and returns their status.
+func (o offline) Migrate(ctx context.Context) ([]db.MigrationStatus, error) {
+	if err := o.store.Migrate(ctx); err != nil {
+		return nil, err
+	}
+	return o.store.MigrationStatus(ctx)
+}
+
+func (o offline) MigrationStatus(ctx context.Context) ([]db.MigrationStatus, error) {
+	return o.store.MigrationStatus(ctx)
+}
+
+// envOr returns the environment variable name, or def if it is empty.
+func envOr(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "userctl:", err)
+	os.Exit(1)
+}
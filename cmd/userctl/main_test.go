@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"user/address"
+	"user/client"
+	"user/db"
+	"user/users"
+)
+
+type fakeBackend struct {
+	deleted []string
+	mask    []string
+}
+
+func (b *fakeBackend) Register(_ context.Context, r client.Registration) (string, error) {
+	return "id-" + r.Username, nil
+}
+
+func (b *fakeBackend) ResetPassword(_ context.Context, id, password string) (string, error) {
+	if password == "" {
+		return "generated", nil
+	}
+	return "", nil
+}
+
+func (b *fakeBackend) ListUsers(_ context.Context, cursor string, limit int) ([]users.User, string, error) {
+	if cursor == "" {
+		return []users.User{{UserID: "1", Username: "eve"}}, "next", nil
+	}
+	return []users.User{{UserID: "2", Username: "bob"}}, "", nil
+}
+
+func (b *fakeBackend) DeleteUser(_ context.Context, id string) error {
+	b.deleted = append(b.deleted, id)
+	return nil
+}
+
+func (b *fakeBackend) ExportUsers(_ context.Context, w io.Writer, mask []string) error {
+	b.mask = mask
+	_, err := io.WriteString(w, "id\n")
+	return err
+}
+
+type fakeMigrator struct {
+	fakeBackend
+	applied *time.Time
+}
+
+func (m *fakeMigrator) Migrate(ctx context.Context) ([]db.MigrationStatus, error) {
+	at := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	m.applied = &at
+	return m.MigrationStatus(ctx)
+}
+
+func (m *fakeMigrator) MigrationStatus(_ context.Context) ([]db.MigrationStatus, error) {
+	return []db.MigrationStatus{{Version: 1, Name: "create tables", AppliedAt: m.applied}}, nil
+}
+
+func TestMigrate(t *testing.T) {
+	m := &fakeMigrator{}
+	var out strings.Builder
+	if err := run(context.Background(), m, []string{"migrate", "-status"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "pending") || m.applied != nil {
+		t.Errorf("expected the migration listed pending, got %q", out.String())
+	}
+	out.Reset()
+	if err := run(context.Background(), m, []string{"migrate"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "2020-01-01T00:00:00Z") {
+		t.Errorf("expected the migration applied, got %q", out.String())
+	}
+	if err := run(context.Background(), &fakeBackend{}, []string{"migrate"}, io.Discard); err == nil {
+		t.Error("expected migrating through the API to fail")
+	}
+}
+
+func TestRun(t *testing.T) {
+	b := &fakeBackend{}
+	for _, c := range []struct {
+		args []string
+		out  string
+	}{
+		{[]string{"create-user", "-username", "eve", "-password", "secret"}, "id-eve\n"},
+		{[]string{"reset-password", "1"}, "generated\n"},
+		{[]string{"reset-password", "-password", "secret", "1"}, ""},
+		{[]string{"delete", "1", "2"}, ""},
+		{[]string{"export", "-mask", ""}, "id\n"},
+	} {
+		var out strings.Builder
+		if err := run(context.Background(), b, c.args, &out); err != nil {
+			t.Fatalf("%v: %v", c.args, err)
+		}
+		if out.String() != c.out {
+			t.Errorf("%v: expected %q, got %q", c.args, c.out, out.String())
+		}
+	}
+	if len(b.deleted) != 2 || b.mask != nil {
+		t.Errorf("unexpected deletes %v and mask %v", b.deleted, b.mask)
+	}
+
+	var out strings.Builder
+	if err := run(context.Background(), b, []string{"list"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "eve") || !strings.Contains(out.String(), "bob") {
+		t.Errorf("expected every page listed, got %q", out.String())
+	}
+	for _, args := range [][]string{{"create-user"}, {"reset-password"}, {"delete"}, {"frobnicate"}} {
+		if err := run(context.Background(), b, args, io.Discard); err == nil {
+			t.Errorf("%v: expected an error", args)
+		}
+	}
+}
+
+type fakeSeeder struct {
+	fakeBackend
+	taken     string
+	users     []users.User
+	addresses []users.Address
+	cards     []users.Card
+}
+
+func (s *fakeSeeder) PostUser(_ context.Context, u users.User) (string, error) {
+	// The first username is taken.
+	if s.taken == "" {
+		s.taken = u.Username
+		return "", &db.ConflictError{Field: "username"}
+	}
+	s.users = append(s.users, u)
+	return fmt.Sprint(len(s.users)), nil
+}
+
+func (s *fakeSeeder) PostAddress(_ context.Context, a users.Address, userID string) (string, error) {
+	s.addresses = append(s.addresses, a)
+	return "a", nil
+}
+
+func (s *fakeSeeder) PostCard(_ context.Context, c users.Card, userID string) (string, error) {
+	s.cards = append(s.cards, c)
+	return "c", nil
+}
+
+func TestSeed(t *testing.T) {
+	s := &fakeSeeder{}
+	var out strings.Builder
+	args := []string{"seed", "-users", "12", "-addresses", "3", "-cards", "3", "-seed", "7"}
+	if err := run(context.Background(), s, args, &out); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.users) != 12 || strings.Count(out.String(), "\n") != 13 {
+		t.Fatalf("expected 12 customers listed, got %v %q", len(s.users), out.String())
+	}
+	if s.users[0].Username == s.taken {
+		t.Errorf("expected another username drawn after %v", s.taken)
+	}
+	locales := map[string]bool{}
+	for _, u := range s.users {
+		locales[u.Locale] = true
+		if err := users.ValidatePhone(u.Phone); err != nil || !strings.HasSuffix(u.Email, "@example.com") {
+			t.Errorf("expected a valid phone and an example.com email, got %v %v", u.Phone, u.Email)
+		}
+	}
+	if len(locales) != len(seedLocales) {
+		t.Errorf("expected every locale, got %v", locales)
+	}
+	if len(s.addresses) == 0 || len(s.cards) == 0 {
+		t.Fatalf("expected addresses and cards, got %v %v", s.addresses, s.cards)
+	}
+	for _, a := range s.addresses {
+		if _, err := address.Basic(a); err != nil {
+			t.Errorf("%+v: %v", a, err)
+		}
+	}
+	for _, c := range s.cards {
+		if err := c.Validate(); err != nil {
+			t.Errorf("%+v: %v", c, err)
+		}
+	}
+
+	// The same seed makes up the same customers.
+	again := &fakeSeeder{}
+	if err := run(context.Background(), again, args, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if again.users[5].Username != s.users[5].Username {
+		t.Errorf("expected %v again, got %v", s.users[5].Username, again.users[5].Username)
+	}
+
+	if err := run(context.Background(), &fakeSeeder{}, []string{"seed", "-locales", "xx-XX"}, io.Discard); err == nil {
+		t.Error("expected unknown locales to fail")
+	}
+	if err := run(context.Background(), &fakeBackend{}, []string{"seed"}, io.Discard); err == nil {
+		t.Error("expected seeding through the API to fail")
+	}
+}
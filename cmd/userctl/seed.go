@@ -0,0 +1,263 @@
+package main
+
+// seed.go makes up customers with addresses and cards for local and load
+// test environments. The data looks like that of customers of each locale,
+// but the emails are on example.com and the card numbers only pass the
+// Luhn check.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+
+	"user/db"
+	"user/users"
+)
+
+// seeder is implemented by the backends working on the database directly,
+// which seeding needs.
+type seeder interface {
+	PostUser(ctx context.Context, u users.User) (string, error)
+	PostAddress(ctx context.Context, a users.Address, userID string) (string, error)
+	PostCard(ctx context.Context, c users.Card, userID string) (string, error)
+}
+
+// seedCity is a city with its state or prefecture and the format of its
+// post codes, # standing for a digit.
+type seedCity struct {
+	Name, Region, PostCode string
+}
+
+// seedLocale is what the customers of a locale are made up from.
+type seedLocale struct {
+	Timezone string
+	Country  string
+	// Phone is the prefix of the phone numbers, # standing for a digit.
+	Phone   string
+	First   []string
+	Last    []string
+	Streets []string
+	Cities  []seedCity
+}
+
+// seedLocales are the locales customers are seeded in, by BCP 47 tag.
+var seedLocales = map[string]seedLocale{
+	"en-US": {
+		Timezone: "America/Chicago", Country: "US", Phone: "+131255501##",
+		First:   []string{"James", "Mary", "Robert", "Patricia", "Michael", "Jennifer", "David", "Linda", "Emily", "Daniel"},
+		Last:    []string{"Smith", "Johnson", "Williams", "Brown", "Jones", "Garcia", "Miller", "Davis", "Wilson", "Anderson"},
+		Streets: []string{"Main St", "Oak Ave", "Maple Dr", "Cedar Ln", "Elm St", "Washington Blvd", "Lakeview Rd"},
+		Cities: []seedCity{
+			{"Springfield", "IL", "627##"}, {"Austin", "TX", "787##"}, {"Portland", "OR", "972##"},
+			{"Denver", "CO", "802##"}, {"Brooklyn", "NY", "112##"}, {"Columbus", "OH", "432##"},
+		},
+	},
+	"en-GB": {
+		Timezone: "Europe/London", Country: "GB", Phone: "+447700900###",
+		First:   []string{"Oliver", "Amelia", "George", "Isla", "Harry", "Ava", "Jack", "Olivia", "Charlie", "Sophie"},
+		Last:    []string{"Taylor", "Davies", "Evans", "Thomas", "Roberts", "Walker", "Wright", "Hughes", "Edwards", "Green"},
+		Streets: []string{"High Street", "Station Road", "Church Lane", "Victoria Road", "Park Avenue", "Mill Lane"},
+		Cities: []seedCity{
+			{"London", "", "SW1A #AA"}, {"Manchester", "", "M# #AE"}, {"Bristol", "", "BS# #TH"},
+			{"Leeds", "", "LS# #JN"}, {"Edinburgh", "", "EH# #YT"},
+		},
+	},
+	"de-DE": {
+		Timezone: "Europe/Berlin", Country: "DE", Phone: "+4915550######",
+		First:   []string{"Lukas", "Anna", "Jonas", "Lea", "Felix", "Mia", "Paul", "Hannah", "Jürgen", "Sophie"},
+		Last:    []string{"Müller", "Schmidt", "Schneider", "Fischer", "Weber", "Meyer", "Wagner", "Becker", "Schäfer", "Koch"},
+		Streets: []string{"Hauptstraße", "Schulstraße", "Gartenstraße", "Bahnhofstraße", "Lindenweg", "Kirchplatz"},
+		Cities: []seedCity{
+			{"Berlin", "", "10###"}, {"Hamburg", "", "20###"}, {"München", "", "80###"},
+			{"Köln", "", "50###"}, {"Leipzig", "", "04###"},
+		},
+	},
+	"fr-FR": {
+		Timezone: "Europe/Paris", Country: "FR", Phone: "+3363998####",
+		First:   []string{"Gabriel", "Louise", "Léo", "Jade", "Raphaël", "Emma", "Hugo", "Chloé", "Arthur", "Inès"},
+		Last:    []string{"Martin", "Bernard", "Dubois", "Thomas", "Robert", "Richard", "Petit", "Durand", "Lefèvre", "Moreau"},
+		Streets: []string{"Rue de la République", "Avenue Victor Hugo", "Rue Pasteur", "Boulevard Voltaire", "Rue des Lilas"},
+		Cities: []seedCity{
+			{"Paris", "", "750##"}, {"Lyon", "", "6900#"}, {"Marseille", "", "130##"},
+			{"Bordeaux", "", "33000"}, {"Lille", "", "59000"},
+		},
+	},
+	"ja-JP": {
+		Timezone: "Asia/Tokyo", Country: "JP", Phone: "+8190########",
+		First:   []string{"Haruto", "Yui", "Sota", "Hina", "Yuto", "Mei", "Riku", "Sakura", "Ren", "Aoi"},
+		Last:    []string{"Sato", "Suzuki", "Takahashi", "Tanaka", "Watanabe", "Ito", "Yamamoto", "Nakamura", "Kobayashi", "Kato"},
+		Streets: []string{"Marunouchi", "Jingumae", "Umeda", "Sakae", "Tenjin", "Nishiki"},
+		Cities: []seedCity{
+			{"Chiyoda-ku", "Tokyo", "100-####"}, {"Shibuya-ku", "Tokyo", "150-####"}, {"Kita-ku", "Osaka", "530-####"},
+			{"Naka-ku", "Aichi", "460-####"}, {"Chuo-ku", "Fukuoka", "810-####"},
+		},
+	},
+	"nl-NL": {
+		Timezone: "Europe/Amsterdam", Country: "NL", Phone: "+316########",
+		First:   []string{"Daan", "Emma", "Sem", "Julia", "Lucas", "Tess", "Finn", "Sara", "Levi", "Anna"},
+		Last:    []string{"de Jong", "Jansen", "de Vries", "van den Berg", "van Dijk", "Bakker", "Visser", "Smit", "Meijer", "de Boer"},
+		Streets: []string{"Kerkstraat", "Dorpsstraat", "Molenweg", "Stationsplein", "Prinsengracht", "Julianalaan"},
+		Cities: []seedCity{
+			{"Amsterdam", "", "10## AB"}, {"Rotterdam", "", "30## CD"}, {"Utrecht", "", "35## EF"},
+			{"Den Haag", "", "25## GH"}, {"Eindhoven", "", "56## JK"},
+		},
+	},
+}
+
+// seedTags returns the tags of the seed locales in order.
+func seedTags() []string {
+	tags := make([]string, 0, len(seedLocales))
+	for tag := range seedLocales {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// seedOptions are what seed makes up.
+type seedOptions struct {
+	Users     int
+	Addresses int
+	Cards     int
+	Locales   []string
+	Password  string
+}
+
+// seedAttempts is how often seed draws another username after a collision.
+const seedAttempts = 5
+
+// seed creates o.Users customers through s, spread evenly over the
+// locales, with up to o.Addresses addresses, the last one their default
+// shipping address, and up to o.Cards cards each. It calls created with
+// each customer.
+func seed(ctx context.Context, s seeder, rnd *rand.Rand, o seedOptions, created func(users.User)) error {
+	for _, tag := range o.Locales {
+		if _, ok := seedLocales[tag]; !ok {
+			return fmt.Errorf("seed: no locale %q", tag)
+		}
+	}
+	for i := 0; i < o.Users; i++ {
+		tag := o.Locales[i%len(o.Locales)]
+		l := seedLocales[tag]
+		u := users.User{
+			FirstName: pick(rnd, l.First),
+			LastName:  pick(rnd, l.Last),
+			Password:  o.Password,
+			Locale:    tag,
+			Timezone:  l.Timezone,
+			Phone:     digits(rnd, l.Phone),
+		}
+		var err error
+		for attempt := 0; attempt < seedAttempts; attempt++ {
+			name := fmt.Sprintf("%s.%s%d", asciiName(u.FirstName), asciiName(u.LastName), rnd.Intn(1000000))
+			u.Username, u.Email = name, name+"@example.com"
+			if u.UserID, err = s.PostUser(ctx, u); !errors.Is(err, db.ErrConflict) {
+				break
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("seed %s: %w", u.Username, err)
+		}
+		for k := rnd.Intn(o.Addresses + 1); k > 0; k-- {
+			a := seedAddress(rnd, l)
+			if k == 1 {
+				a.Type, a.Default = users.AddressShipping, true
+			}
+			if _, err := s.PostAddress(ctx, a, u.UserID); err != nil {
+				return fmt.Errorf("seed %s: %w", u.Username, err)
+			}
+		}
+		for k := rnd.Intn(o.Cards + 1); k > 0; k-- {
+			c := seedCard(rnd, u.FirstName+" "+u.LastName)
+			if _, err := s.PostCard(ctx, c, u.UserID); err != nil {
+				return fmt.Errorf("seed %s: %w", u.Username, err)
+			}
+		}
+		created(u)
+	}
+	return nil
+}
+
+// seedAddress makes up an address in the country of l.
+func seedAddress(rnd *rand.Rand, l seedLocale) users.Address {
+	c := l.Cities[rnd.Intn(len(l.Cities))]
+	a := users.Address{
+		Street:   pick(rnd, l.Streets),
+		Number:   fmt.Sprint(rnd.Intn(200) + 1),
+		Country:  l.Country,
+		City:     c.Name,
+		PostCode: digits(rnd, c.PostCode),
+	}
+	if l.Country == "JP" {
+		a.Number = fmt.Sprintf("%d-%d-%d", rnd.Intn(5)+1, rnd.Intn(20)+1, rnd.Intn(30)+1)
+		a.Prefecture = c.Region
+	} else {
+		a.State = c.Region
+	}
+	return a
+}
+
+// seedCard makes up a Visa or Mastercard card of holder expiring in the
+// next five years.
+func seedCard(rnd *rand.Rand, holder string) users.Card {
+	prefix := "4"
+	if rnd.Intn(2) == 1 {
+		prefix = fmt.Sprint(51 + rnd.Intn(5))
+	}
+	num := digits(rnd, prefix+strings.Repeat("#", 15-len(prefix)))
+	expires := time.Now().AddDate(0, 1+rnd.Intn(60), 0)
+	return users.Card{
+		LongNum: num + luhnDigit(num),
+		Expires: expires.Format("01/06"),
+		Holder:  holder,
+	}
+}
+
+// luhnDigit returns the check digit making num pass the Luhn check.
+func luhnDigit(num string) string {
+	sum := 0
+	for k := len(num) - 1; k >= 0; k-- {
+		d := int(num[k] - '0')
+		// Every other digit from the check digit on the right is doubled.
+		if (len(num)-k)%2 == 1 {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	return fmt.Sprint((10 - sum%10) % 10)
+}
+
+// digits replaces the # of format with random digits.
+func digits(rnd *rand.Rand, format string) string {
+	var b strings.Builder
+	for _, r := range format {
+		if r == '#' {
+			r = rune('0' + rnd.Intn(10))
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func pick(rnd *rand.Rand, s []string) string {
+	return s[rnd.Intn(len(s))]
+}
+
+// nameFolding spells the letters of seeded names in ASCII.
+var nameFolding = strings.NewReplacer("ä", "ae", "ö", "oe", "ü", "ue", "ß", "ss", "é", "e", "è", "e", "ë", "e", "ï", "i")
+
+// asciiName returns name in lower case ASCII letters, for usernames.
+func asciiName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r < 'a' || r > 'z' {
+			return -1
+		}
+		return r
+	}, nameFolding.Replace(strings.ToLower(name)))
+}
@@ -0,0 +1,379 @@
+// Package cache keeps users, addresses and cards read from a Database in
+// Redis, so hot reads, like during sales, don't reach the database. Writes
+// through the cache delete the entries they change. Entries expire after a
+// TTL anyway, which bounds how long writes made around the cache, or racing
+// a read that fills it, go unseen.
+package cache
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"flag"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"user/changes"
+	"user/db"
+	"user/secrets"
+	"user/users"
+)
+
+var (
+	addr string
+	ttl  time.Duration
+
+	// Lookups counts reads of the cache by result: hit, miss or error.
+	Lookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cache_lookups_total",
+		Help: "Reads of cached users, addresses and cards, by result.",
+	}, []string{"result"})
+)
+
+func init() {
+	flag.StringVar(&addr, "redis-addr", os.Getenv("REDIS_ADDR"), "Redis host:port users, addresses and cards are cached in, no cache when empty")
+	flag.DurationVar(&ttl, "cache-ttl", time.Minute, "How long users, addresses and cards stay cached")
+}
+
+// New wraps d in a Cache on the Redis of the -redis-addr flag, with the
+// REDIS_PASSWORD secret. Without an address it returns d itself.
+func New(d db.Database, logger log.Logger) db.Database {
+	if addr == "" {
+		return d
+	}
+	return &Cache{
+		Database: d,
+		Redis:    NewRedis(addr, secrets.Value(secrets.RedisPassword)),
+		TTL:      ttl,
+		Prefix:   "user:",
+		Logger:   logger,
+	}
+}
+
+// Cache is a Database serving GetUser, GetAddresses and GetCards from Redis
+// when it can. The other reads go to the Database. Failing Redis commands
+// are logged and the Database is used instead.
+type Cache struct {
+	db.Database
+	Redis *Redis
+	TTL   time.Duration
+	// Prefix starts the keys of all entries.
+	Prefix string
+	Logger log.Logger
+}
+
+func (c *Cache) userKey(id string) string {
+	return c.Prefix + "customers:" + id
+}
+
+func (c *Cache) addressesKey() string {
+	return c.Prefix + "addresses"
+}
+
+func (c *Cache) cardsKey() string {
+	return c.Prefix + "cards"
+}
+
+// cached decodes the entry of key into v, or calls load to fill v and
+// stores it under key.
+func (c *Cache) cached(key string, v interface{}, load func() error) error {
+	b, err := c.Redis.Get(key)
+	switch {
+	case err != nil:
+		Lookups.WithLabelValues("error").Inc()
+		c.Logger.Log("cache", "get", "key", key, "err", err)
+	case b == nil:
+		Lookups.WithLabelValues("miss").Inc()
+	default:
+		if err := gob.NewDecoder(bytes.NewReader(b)).Decode(v); err == nil {
+			Lookups.WithLabelValues("hit").Inc()
+			return nil
+		}
+		Lookups.WithLabelValues("error").Inc()
+	}
+	if err := load(); err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil
+	}
+	if err := c.Redis.Set(key, buf.Bytes(), c.TTL); err != nil {
+		c.Logger.Log("cache", "set", "key", key, "err", err)
+	}
+	return nil
+}
+
+// invalidate deletes the entries of keys. Writes call it whether they
+// failed or not, as a failed write may still have changed some.
+func (c *Cache) invalidate(keys ...string) {
+	if err := c.Redis.Del(keys...); err != nil {
+		c.Logger.Log("cache", "del", "keys", len(keys), "err", err)
+	}
+}
+
+// ownerKey returns the key of the user owning the address or card id, to
+// invalidate it as well. It is read before the write, which may unlink it.
+func (c *Cache) ownerKey(ctx context.Context, entity, id string) []string {
+	owner, err := c.Database.OwnerOf(ctx, entity, id)
+	if err != nil {
+		return nil
+	}
+	return []string{c.userKey(owner)}
+}
+
+// GetUser gets the user from the cache or the Database
+func (c *Cache) GetUser(ctx context.Context, id string) (users.User, error) {
+	var u users.User
+	err := c.cached(c.userKey(id), &u, func() (err error) {
+		u, err = c.Database.GetUser(ctx, id)
+		return err
+	})
+	return u, err
+}
+
+// GetAddresses gets the addresses from the cache or the Database
+func (c *Cache) GetAddresses(ctx context.Context) ([]users.Address, error) {
+	var as []users.Address
+	err := c.cached(c.addressesKey(), &as, func() (err error) {
+		as, err = c.Database.GetAddresses(ctx)
+		return err
+	})
+	return as, err
+}
+
+// GetCards gets the cards from the cache or the Database
+func (c *Cache) GetCards(ctx context.Context) ([]users.Card, error) {
+	var cs []users.Card
+	err := c.cached(c.cardsKey(), &cs, func() (err error) {
+		cs, err = c.Database.GetCards(ctx)
+		return err
+	})
+	return cs, err
+}
+
+// CreateUser invokes the Database method, new addresses and cards change
+// the cached lists
+func (c *Cache) CreateUser(ctx context.Context, u *users.User) error {
+	if len(u.Addresses) > 0 || len(u.Cards) > 0 {
+		defer c.invalidate(c.addressesKey(), c.cardsKey())
+	}
+	return c.Database.CreateUser(ctx, u)
+}
+
+// UpdateUser invokes the Database method
+func (c *Cache) UpdateUser(ctx context.Context, id string, p users.ProfileUpdate) error {
+	defer c.invalidate(c.userKey(id))
+	return c.Database.UpdateUser(ctx, id, p)
+}
+
+// AddUserTag invokes the Database method
+func (c *Cache) AddUserTag(ctx context.Context, id, tag string) error {
+	defer c.invalidate(c.userKey(id))
+	return c.Database.AddUserTag(ctx, id, tag)
+}
+
+// RemoveUserTag invokes the Database method
+func (c *Cache) RemoveUserTag(ctx context.Context, id, tag string) error {
+	defer c.invalidate(c.userKey(id))
+	return c.Database.RemoveUserTag(ctx, id, tag)
+}
+
+// RecordLogin invokes the Database method
+func (c *Cache) RecordLogin(ctx context.Context, id string, at time.Time) error {
+	defer c.invalidate(c.userKey(id))
+	return c.Database.RecordLogin(ctx, id, at)
+}
+
+// RenameUser invokes the Database method
+func (c *Cache) RenameUser(ctx context.Context, id, username string) error {
+	defer c.invalidate(c.userKey(id))
+	return c.Database.RenameUser(ctx, id, username)
+}
+
+// UpgradeUser invokes the Database method
+func (c *Cache) UpgradeUser(ctx context.Context, id string, u users.User) error {
+	defer c.invalidate(c.userKey(id))
+	return c.Database.UpgradeUser(ctx, id, u)
+}
+
+// MergeUsers invokes the Database method, the addresses and cards of source
+// move to target
+func (c *Cache) MergeUsers(ctx context.Context, target, source string, p users.ProfileUpdate) error {
+	defer c.invalidate(c.userKey(target), c.userKey(source), c.addressesKey(), c.cardsKey())
+	return c.Database.MergeUsers(ctx, target, source, p)
+}
+
+// DeleteUsers invokes the Database method
+func (c *Cache) DeleteUsers(ctx context.Context, ids []string) (map[string]error, error) {
+	keys := []string{c.addressesKey(), c.cardsKey()}
+	for _, id := range ids {
+		keys = append(keys, c.userKey(id))
+	}
+	defer c.invalidate(keys...)
+	return c.Database.DeleteUsers(ctx, ids)
+}
+
+// Delete invokes the Database method
+func (c *Cache) Delete(ctx context.Context, entity, id string) error {
+	var keys []string
+	switch entity {
+	case "customers":
+		keys = []string{c.userKey(id), c.addressesKey(), c.cardsKey()}
+	case "addresses":
+		keys = append(c.ownerKey(ctx, entity, id), c.addressesKey())
+	case "cards":
+		keys = append(c.ownerKey(ctx, entity, id), c.cardsKey())
+	}
+	if len(keys) > 0 {
+		defer c.invalidate(keys...)
+	}
+	return c.Database.Delete(ctx, entity, id)
+}
+
+// CreateAddress invokes the Database method
+func (c *Cache) CreateAddress(ctx context.Context, a *users.Address, userid string) error {
+	defer c.invalidate(c.userKey(userid), c.addressesKey())
+	return c.Database.CreateAddress(ctx, a, userid)
+}
+
+// CreateAddresses invokes the Database method
+func (c *Cache) CreateAddresses(ctx context.Context, as []users.Address, userid string) error {
+	defer c.invalidate(c.userKey(userid), c.addressesKey())
+	return c.Database.CreateAddresses(ctx, as, userid)
+}
+
+// SetAddressLocation invokes the Database method
+func (c *Cache) SetAddressLocation(ctx context.Context, id string, l *users.Location, status string) error {
+	defer c.invalidate(c.addressesKey())
+	return c.Database.SetAddressLocation(ctx, id, l, status)
+}
+
+// UpdateAddress invokes the Database method
+func (c *Cache) UpdateAddress(ctx context.Context, id string, a *users.Address) error {
+	defer c.invalidate(c.addressesKey())
+	return c.Database.UpdateAddress(ctx, id, a)
+}
+
+// CreateCard invokes the Database method
+func (c *Cache) CreateCard(ctx context.Context, ca *users.Card, userid string) error {
+	defer c.invalidate(c.userKey(userid), c.cardsKey())
+	return c.Database.CreateCard(ctx, ca, userid)
+}
+
+// UpdateCard invokes the Database method
+func (c *Cache) UpdateCard(ctx context.Context, id string, u users.CardUpdate) error {
+	defer c.invalidate(c.cardsKey())
+	return c.Database.UpdateCard(ctx, id, u)
+}
+
+// SetDefaultCard invokes the Database method
+func (c *Cache) SetDefaultCard(ctx context.Context, userID, cardID string) error {
+	defer c.invalidate(c.userKey(userID), c.cardsKey())
+	return c.Database.SetDefaultCard(ctx, userID, cardID)
+}
+
+// SetCardReminded invokes the Database method
+func (c *Cache) SetCardReminded(ctx context.Context, id, expires string) error {
+	defer c.invalidate(c.cardsKey())
+	return c.Database.SetCardReminded(ctx, id, expires)
+}
+
+// SetCardVerification invokes the Database method
+func (c *Cache) SetCardVerification(ctx context.Context, id, status string) error {
+	defer c.invalidate(c.cardsKey())
+	return c.Database.SetCardVerification(ctx, id, status)
+}
+
+// TombstoneCard invokes the Database method
+func (c *Cache) TombstoneCard(ctx context.Context, id, masked, replacedBy string) error {
+	defer c.invalidate(append(c.ownerKey(ctx, "cards", id), c.cardsKey())...)
+	return c.Database.TombstoneCard(ctx, id, masked, replacedBy)
+}
+
+// Tenant returns the cache of the Database of a tenant, its keys prefixed
+// with the tenant id.
+func (c *Cache) Tenant(id string) (db.Database, error) {
+	t, ok := c.Database.(db.Tenanted)
+	if !ok {
+		return nil, db.ErrNoTenancy
+	}
+	d, err := t.Tenant(id)
+	if err != nil {
+		return nil, err
+	}
+	return &Cache{Database: d, Redis: c.Redis, TTL: c.TTL, Prefix: c.Prefix + "tenants:" + id + ":", Logger: c.Logger}, nil
+}
+
+// Migrated reports whether the migrations of the Database have been
+// applied.
+func (c *Cache) Migrated() bool {
+	return db.NewStore(c.Database).Migrated()
+}
+
+// Migrate applies the pending migrations of the Database.
+func (c *Cache) Migrate(ctx context.Context) error {
+	return db.NewStore(c.Database).Migrate(ctx)
+}
+
+// Watch streams the changes of the Database. Changes made around the cache
+// drop the entries they make stale.
+func (c *Cache) Watch(ctx context.Context, publish func(changes.Event)) error {
+	return db.NewStore(c.Database).Watch(ctx, func(e changes.Event) {
+		c.invalidate(c.changedKeys(e)...)
+		publish(e)
+	})
+}
+
+// RelayOutbox relays the changes recorded by the Database, dropping the
+// entries they make stale like Watch.
+func (c *Cache) RelayOutbox(ctx context.Context, publish func(changes.Event)) error {
+	return db.NewStore(c.Database).RelayOutbox(ctx, func(e changes.Event) {
+		c.invalidate(c.changedKeys(e)...)
+		publish(e)
+	})
+}
+
+// changedKeys returns the keys of the entries the change e makes stale.
+func (c *Cache) changedKeys(e changes.Event) []string {
+	var keys []string
+	if e.UserID != "" {
+		keys = append(keys, c.userKey(e.UserID))
+	}
+	switch {
+	case strings.HasPrefix(string(e.Type), "address."):
+		keys = append(keys, c.addressesKey())
+	case strings.HasPrefix(string(e.Type), "card."):
+		keys = append(keys, c.cardsKey())
+	}
+	return keys
+}
+
+// MigrationFailure returns the error the last migration of the Database
+// failed with.
+func (c *Cache) MigrationFailure() error {
+	return db.NewStore(c.Database).MigrationFailure()
+}
+
+// MigrationStatus lists the migrations of the Database.
+func (c *Cache) MigrationStatus(ctx context.Context) ([]db.MigrationStatus, error) {
+	return db.NewStore(c.Database).MigrationStatus(ctx)
+}
+
+// Reconnect reconnects the Database.
+func (c *Cache) Reconnect(ctx context.Context) error {
+	return db.NewStore(c.Database).Reconnect(ctx)
+}
+
+// Close closes the connections to Redis and the Database.
+func (c *Cache) Close() error {
+	c.Redis.Close()
+	if cl, ok := c.Database.(io.Closer); ok {
+		return cl.Close()
+	}
+	return nil
+}
@@ -0,0 +1,309 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"user/changes"
+	"user/db"
+	"user/db/inmem"
+	"user/users"
+)
+
+var (
+	_ db.Database    = &Cache{}
+	_ db.Tenanted    = &Cache{}
+	_ db.Migrator    = &Cache{}
+	_ db.Watcher     = &Cache{}
+	_ db.Reconnector = &Cache{}
+)
+
+// fakeRedis serves GET, SET, DEL and AUTH from memory.
+type fakeRedis struct {
+	mu       sync.Mutex
+	values   map[string]string
+	password string
+}
+
+func newFakeRedis(t *testing.T, password string) (*fakeRedis, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	f := &fakeRedis{values: map[string]string{}, password: password}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(c)
+		}
+	}()
+	return f, l.Addr().String()
+}
+
+func (f *fakeRedis) serve(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	authed := f.password == ""
+	for {
+		v, err := readReply(r)
+		if err != nil {
+			return
+		}
+		var args []string
+		for _, a := range v.([]interface{}) {
+			args = append(args, string(a.([]byte)))
+		}
+		f.mu.Lock()
+		var reply string
+		switch cmd := strings.ToUpper(args[0]); {
+		case cmd == "AUTH":
+			authed = args[1] == f.password
+			reply = map[bool]string{true: "+OK", false: "-WRONGPASS invalid password"}[authed]
+		case !authed:
+			reply = "-NOAUTH Authentication required."
+		case cmd == "GET":
+			if s, ok := f.values[args[1]]; ok {
+				reply = "$" + strconv.Itoa(len(s)) + "\r\n" + s
+			} else {
+				reply = "$-1"
+			}
+		case cmd == "SET":
+			f.values[args[1]] = args[2]
+			reply = "+OK"
+		case cmd == "DEL":
+			n := 0
+			for _, k := range args[1:] {
+				if _, ok := f.values[k]; ok {
+					delete(f.values, k)
+					n++
+				}
+			}
+			reply = ":" + strconv.Itoa(n)
+		default:
+			reply = "-ERR unknown command"
+		}
+		f.mu.Unlock()
+		io.WriteString(c, reply+"\r\n")
+	}
+}
+
+func (f *fakeRedis) has(key string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, ok := f.values[key]
+	return ok
+}
+
+func TestReadReply(t *testing.T) {
+	in := "*4\r\n+OK\r\n:3\r\n$5\r\nhe\r\no\r\n*2\r\n$-1\r\n-ERR nope\r\n"
+	v, err := readReply(bufio.NewReader(strings.NewReader(in)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	vs := v.([]interface{})
+	if vs[0] != "OK" || vs[1] != int64(3) || !bytes.Equal(vs[2].([]byte), []byte("he\r\no")) {
+		t.Errorf("unexpected reply %q", vs)
+	}
+	if inner := vs[3].([]interface{}); inner[0] != nil || inner[1] != RedisError("ERR nope") {
+		t.Errorf("unexpected nested reply %q", inner)
+	}
+	if _, err := readReply(bufio.NewReader(strings.NewReader("?\r\n"))); err == nil {
+		t.Error("expected an unknown reply type to fail")
+	}
+}
+
+func TestRedis(t *testing.T) {
+	_, addr := newFakeRedis(t, "secret")
+	r := NewRedis(addr, "secret")
+	defer r.Close()
+	if v, err := r.Get("k"); err != nil || v != nil {
+		t.Errorf("expected no value, got %q %v", v, err)
+	}
+	if err := r.Set("k", []byte("v\x00\r\n"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := r.Get("k"); err != nil || string(v) != "v\x00\r\n" {
+		t.Errorf("expected the value, got %q %v", v, err)
+	}
+	if err := r.Del("k", "other"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Do("FLUSHALL"); !errors.As(err, new(RedisError)) {
+		t.Errorf("expected an error reply, got %v", err)
+	}
+	if len(r.idle) != 1 {
+		t.Errorf("expected the connection reused after an error reply, got %v idle", len(r.idle))
+	}
+	if _, err := NewRedis(addr, "wrong").Get("k"); err == nil {
+		t.Error("expected a wrong password to fail")
+	}
+}
+
+func open(t *testing.T, addr string) (*Cache, *inmem.Memory) {
+	m := &inmem.Memory{}
+	if err := m.Init(); err != nil {
+		t.Fatal(err)
+	}
+	c := &Cache{Database: m, Redis: NewRedis(addr, ""), TTL: time.Minute, Prefix: "user:", Logger: log.NewNopLogger()}
+	t.Cleanup(func() { c.Close() })
+	return c, m
+}
+
+func TestCache(t *testing.T) {
+	ctx := context.Background()
+	f, addr := newFakeRedis(t, "")
+	c, m := open(t, addr)
+	u := users.User{Username: "eve", FirstName: "Eve", Password: "hash",
+		Addresses: []users.Address{{Street: "street"}}}
+	if err := c.CreateUser(ctx, &u); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := c.GetUser(ctx, u.UserID); err != nil || got.Password != "hash" || len(got.Addresses) != 1 {
+		t.Fatalf("expected the user, got %+v %v", got, err)
+	}
+	if !f.has("user:customers:" + u.UserID) {
+		t.Fatal("expected the user cached")
+	}
+	if as, err := c.GetAddresses(ctx); err != nil || len(as) != 1 {
+		t.Fatalf("expected the address, got %v %v", as, err)
+	}
+
+	// Writes around the cache are not seen until the entry goes.
+	name := "Eva"
+	if err := m.UpdateUser(ctx, u.UserID, users.ProfileUpdate{FirstName: &name}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := c.GetUser(ctx, u.UserID); got.FirstName != "Eve" {
+		t.Errorf("expected the cached user, got %v", got.FirstName)
+	}
+	name = "Evi"
+	if err := c.UpdateUser(ctx, u.UserID, users.ProfileUpdate{FirstName: &name}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := c.GetUser(ctx, u.UserID); got.FirstName != "Evi" {
+		t.Errorf("expected the updated user, got %v", got.FirstName)
+	}
+
+	ca := users.Card{LongNum: "4111111111111111"}
+	if err := c.CreateCard(ctx, &ca, u.UserID); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := c.GetUser(ctx, u.UserID); len(got.Cards) != 1 {
+		t.Errorf("expected the new card on the user, got %v", got.Cards)
+	}
+	if cs, err := c.GetCards(ctx); err != nil || len(cs) != 1 {
+		t.Fatalf("expected the card, got %v %v", cs, err)
+	}
+	if err := c.Delete(ctx, "cards", ca.ID); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := c.GetUser(ctx, u.UserID); len(got.Cards) != 0 {
+		t.Errorf("expected the deleted card gone from the user, got %v", got.Cards)
+	}
+	if cs, _ := c.GetCards(ctx); len(cs) != 0 {
+		t.Errorf("expected the deleted card gone, got %v", cs)
+	}
+
+	if _, err := c.DeleteUsers(ctx, []string{u.UserID}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GetUser(ctx, u.UserID); err == nil {
+		t.Error("expected the deleted user gone")
+	}
+}
+
+// TestRedisDown checks the Database is used when Redis fails.
+func TestRedisDown(t *testing.T) {
+	ctx := context.Background()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	c, _ := open(t, addr)
+	u := users.User{Username: "eve"}
+	if err := c.CreateUser(ctx, &u); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := c.GetUser(ctx, u.UserID); err != nil || got.Username != "eve" {
+		t.Errorf("expected the user from the database, got %+v %v", got, err)
+	}
+	if err := c.AddUserTag(ctx, u.UserID, "vip"); err != nil {
+		t.Errorf("expected writes to succeed, got %v", err)
+	}
+}
+
+func TestTenant(t *testing.T) {
+	ctx := context.Background()
+	f, addr := newFakeRedis(t, "")
+	c, _ := open(t, addr)
+	d, err := c.Tenant("acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := users.User{Username: "eve"}
+	if err := d.CreateUser(ctx, &u); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.GetUser(ctx, u.UserID); err != nil {
+		t.Fatal(err)
+	}
+	if !f.has("user:tenants:acme:customers:" + u.UserID) {
+		t.Error("expected the tenant's user cached under its prefix")
+	}
+	if _, err := c.GetUser(ctx, u.UserID); err == nil {
+		t.Error("expected the tenant's user unknown to the default database")
+	}
+}
+
+// watchedMemory streams the changes it is given.
+type watchedMemory struct {
+	*inmem.Memory
+	changes []changes.Event
+}
+
+func (m watchedMemory) Watch(ctx context.Context, publish func(changes.Event)) error {
+	for _, e := range m.changes {
+		publish(e)
+	}
+	return nil
+}
+
+// TestWatch checks changes made around the cache drop its entries.
+func TestWatch(t *testing.T) {
+	ctx := context.Background()
+	f, addr := newFakeRedis(t, "")
+	c, m := open(t, addr)
+	u := users.User{Username: "eve"}
+	if err := c.CreateUser(ctx, &u); err != nil {
+		t.Fatal(err)
+	}
+	c.GetUser(ctx, u.UserID)
+	c.GetCards(ctx)
+	if err := c.Watch(ctx, func(changes.Event) {}); !errors.Is(err, db.ErrNotWatchable) {
+		t.Errorf("expected the memory not watchable, got %v", err)
+	}
+	c.Database = watchedMemory{Memory: m, changes: []changes.Event{{Type: changes.CardCreated, ResourceID: "c1", UserID: u.UserID}}}
+	var published []changes.Event
+	if err := c.Watch(ctx, func(e changes.Event) { published = append(published, e) }); err != nil {
+		t.Fatal(err)
+	}
+	if len(published) != 1 || f.has("user:customers:"+u.UserID) || f.has("user:cards") {
+		t.Errorf("expected the change published and the user and cards dropped, got %v", published)
+	}
+}
@@ -0,0 +1,208 @@
+package cache
+
+// redis.go contains a minimal client of the Redis protocol, enough for the
+// GET, SET and DEL of the cache.
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RedisError is an error reply of the server.
+type RedisError string
+
+func (e RedisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// errProtocol is returned for replies the client can't parse.
+var errProtocol = errors.New("redis: protocol error")
+
+// Redis sends commands to a Redis server over a pool of connections.
+type Redis struct {
+	Addr     string
+	Password string
+	// Timeout bounds dialing and each command.
+	Timeout time.Duration
+
+	mu     sync.Mutex
+	idle   []*redisConn
+	closed bool
+}
+
+// maxIdle is the most connections kept open between commands.
+const maxIdle = 16
+
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// NewRedis returns a client of the server at addr, authenticating with
+// password unless it is empty.
+func NewRedis(addr, password string) *Redis {
+	return &Redis{Addr: addr, Password: password, Timeout: time.Second}
+}
+
+// Get returns the value of key, nil when it is not set.
+func (r *Redis) Get(key string) ([]byte, error) {
+	v, err := r.Do("GET", key)
+	if err != nil || v == nil {
+		return nil, err
+	}
+	b, ok := v.([]byte)
+	if !ok {
+		return nil, errProtocol
+	}
+	return b, nil
+}
+
+// Set sets key to value, expiring after ttl.
+func (r *Redis) Set(key string, value []byte, ttl time.Duration) error {
+	_, err := r.Do("SET", key, string(value), "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	return err
+}
+
+// Del deletes the keys.
+func (r *Redis) Del(keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	_, err := r.Do(append([]string{"DEL"}, keys...)...)
+	return err
+}
+
+// Do sends the command args and returns its reply: a string, an int64, a
+// []byte, a []interface{} of replies or nil. Error replies are a
+// RedisError.
+func (r *Redis) Do(args ...string) (interface{}, error) {
+	c, err := r.conn()
+	if err != nil {
+		return nil, err
+	}
+	v, err := c.do(r.Timeout, args...)
+	if _, ok := err.(RedisError); err != nil && !ok {
+		c.Close()
+		return nil, err
+	}
+	r.put(c)
+	return v, err
+}
+
+// conn takes an idle connection or dials a new one.
+func (r *Redis) conn() (*redisConn, error) {
+	r.mu.Lock()
+	if n := len(r.idle); n > 0 {
+		c := r.idle[n-1]
+		r.idle = r.idle[:n-1]
+		r.mu.Unlock()
+		return c, nil
+	}
+	r.mu.Unlock()
+	nc, err := net.DialTimeout("tcp", r.Addr, r.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{Conn: nc, r: bufio.NewReader(nc)}
+	if r.Password != "" {
+		if _, err := c.do(r.Timeout, "AUTH", r.Password); err != nil {
+			nc.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// put returns c to the idle connections, closes it when there are enough.
+func (r *Redis) put(c *redisConn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed || len(r.idle) >= maxIdle {
+		c.Close()
+		return
+	}
+	r.idle = append(r.idle, c)
+}
+
+// Close closes the idle connections, and the busy ones once they are done.
+func (r *Redis) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	for _, c := range r.idle {
+		c.Close()
+	}
+	r.idle = nil
+	return nil
+}
+
+func (c *redisConn) do(timeout time.Duration, args ...string) (interface{}, error) {
+	if timeout > 0 {
+		c.SetDeadline(time.Now().Add(timeout))
+	}
+	buf := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, a := range args {
+		buf = append(buf, "$"+strconv.Itoa(len(a))+"\r\n"...)
+		buf = append(buf, a...)
+		buf = append(buf, "\r\n"...)
+	}
+	if _, err := c.Write(buf); err != nil {
+		return nil, err
+	}
+	return readReply(c.r)
+}
+
+// readReply reads a reply in the Redis serialization protocol.
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errProtocol
+	}
+	kind, line := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return line, nil
+	case '-':
+		return nil, RedisError(line)
+	case ':':
+		return strconv.ParseInt(line, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		vs := make([]interface{}, n)
+		for k := range vs {
+			// Errors of elements are values, not failures of the command.
+			v, err := readReply(r)
+			if e, ok := err.(RedisError); ok {
+				v, err = e, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			vs[k] = v
+		}
+		return vs, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply type %q", kind)
+}
@@ -0,0 +1,10 @@
+package db
+
+import "user/users"
+
+// OwnedCard is a card with the id of the customer it belongs to, empty for
+// anonymous cards.
+type OwnedCard struct {
+	users.Card
+	UserID string
+}
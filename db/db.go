@@ -1,11 +1,17 @@
 package db
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
-	"github.com/go-kit/kit/log"
+	"io"
 	"os"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"user/changes"
+	"user/pii"
 	"user/users"
 )
 
@@ -13,57 +19,122 @@ import (
 // this is just basic and specific to this microservice
 type Database interface {
 	Init() error
-	GetUserByName(string) (users.User, error)
-	GetUser(string) (users.User, error)
-	GetUsers() ([]users.User, error)
-	CreateUser(*users.User) error
-	GetUserAttributes(*users.User) error
-	GetAddress(string) (users.Address, error)
-	GetAddresses() ([]users.Address, error)
-	CreateAddress(*users.Address, string) error
-	GetCard(string) (users.Card, error)
-	GetCards() ([]users.Card, error)
-	Delete(string, string) error
-	CreateCard(*users.Card, string) error
-	Ping() error
+	GetUserByName(context.Context, string) (users.User, error)
+	GetUser(context.Context, string) (users.User, error)
+	GetUsers(context.Context, UserQuery) ([]users.User, error)
+	GetUsersByID(context.Context, []string) ([]users.User, error)
+	ListUsers(context.Context, string, int) ([]users.User, error)
+	GetStats(context.Context, time.Time, time.Time) (Stats, error)
+	CreateUser(context.Context, *users.User) error
+	UpdateUser(context.Context, string, users.ProfileUpdate) error
+	GetUserAttributes(context.Context, *users.User) error
+	ExpandUsers(context.Context, []users.User, []string) error
+	UserExists(context.Context, string, string) (bool, error)
+	AddUserTag(context.Context, string, string) error
+	RecordLogin(context.Context, string, time.Time) error
+	RenameUser(context.Context, string, string) error
+	UpgradeUser(context.Context, string, users.User) error
+	MergeUsers(context.Context, string, string, users.ProfileUpdate) error
+	ResolveAlias(context.Context, string) (string, error)
+	GetUserByPreviousName(context.Context, string, time.Time) (users.User, error)
+	RemoveUserTag(context.Context, string, string) error
+	GetAddress(context.Context, string) (users.Address, error)
+	GetAddresses(context.Context) ([]users.Address, error)
+	GetAddressesByID(context.Context, []string) ([]users.Address, error)
+	CreateAddress(context.Context, *users.Address, string) error
+	CreateAddresses(context.Context, []users.Address, string) error
+	SetAddressLocation(context.Context, string, *users.Location, string) error
+	UpdateAddress(context.Context, string, *users.Address) error
+	GetCard(context.Context, string) (users.Card, error)
+	GetCards(context.Context) ([]users.Card, error)
+	GetCardsByID(context.Context, []string) ([]users.Card, error)
+	ListCards(context.Context, string, int) ([]OwnedCard, error)
+	Delete(context.Context, string, string) error
+	DeleteUsers(context.Context, []string) (map[string]error, error)
+	CreateCard(context.Context, *users.Card, string) error
+	UpdateCard(context.Context, string, users.CardUpdate) error
+	SetDefaultCard(context.Context, string, string) error
+	SetCardReminded(context.Context, string, string) error
+	SetCardVerification(context.Context, string, string) error
+	TombstoneCard(context.Context, string, string, string) error
+	CreateGroup(context.Context, *users.Group) error
+	GetGroup(context.Context, string) (users.Group, error)
+	GetUserGroups(context.Context, string) ([]users.Group, error)
+	AddActivity(context.Context, *users.Activity) error
+	GetActivity(context.Context, string, string, int) ([]users.Activity, error)
+	OwnerOf(context.Context, string, string) (string, error)
+	AddGroupMember(context.Context, string, string) error
+	RemoveGroupMember(context.Context, string, string) error
+	CreateIdempotencyKey(context.Context, *IdempotencyKey) error
+	GetIdempotencyKey(context.Context, string) (IdempotencyKey, error)
+	SetIdempotencyResult(context.Context, string, string) error
+	DeleteIdempotencyKey(context.Context, string) error
+	CreateWebhook(context.Context, *users.Webhook) error
+	GetWebhooks(context.Context) ([]users.Webhook, error)
+	DeleteWebhook(context.Context, string) error
+	AddWebhookDelivery(context.Context, *users.WebhookDelivery) error
+	GetWebhookDeliveries(context.Context, string, string, int) ([]users.WebhookDelivery, error)
+	Ping(context.Context) error
 }
 
 var (
 	database string
-	//DefaultDb is the database set for the microservice
-	DefaultDb Database
 	//DBTypes is a map of DB interfaces that can be used for this service
 	DBTypes = map[string]Database{}
 	//ErrNoDatabaseFound error returnes when database interface does not exists in DBTypes
 	ErrNoDatabaseFound = "No database with name %v registered"
 	//ErrNoDatabaseSelected is returned when no database was designated in the flag or env
 	ErrNoDatabaseSelected = errors.New("No DB selected")
+	//Expandable lists the attributes ExpandUsers loads
+	Expandable = []string{"addresses", "cards"}
+	//ErrConflict is matched by errors from writes that would duplicate a unique field
+	ErrConflict = errors.New("Conflict")
+	//AutoMigrate has databases apply their pending migrations on Init
+	AutoMigrate bool
+	//ErrNotWatchable is returned by Watch for databases that don't stream their changes
+	ErrNotWatchable = errors.New("database doesn't stream its changes")
+	//ErrNoOutbox is returned by RelayOutbox for databases without an outbox
+	ErrNoOutbox = errors.New("database has no outbox")
 )
-var logger log.Logger
+
+// ConflictError names the unique field a write collided on. It matches
+// ErrConflict with errors.Is.
+type ConflictError struct {
+	Field string
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("%v already in use", e.Field)
+}
+
+// Is reports target is ErrConflict.
+func (e *ConflictError) Is(target error) bool {
+	return target == ErrConflict
+}
 
 func init() {
-	flag.StringVar(&database, "database", os.Getenv("USER_DATABASE"), "Database to use, Mongodb or ...")
+	flag.StringVar(&database, "database", os.Getenv("USER_DATABASE"), "Database to use, mongodb, postgres, mysql, sqlite, dynamodb or inmem")
+	flag.BoolVar(&AutoMigrate, "auto-migrate", os.Getenv("AUTO_MIGRATE") != "false", "Apply pending database migrations on startup, otherwise userctl migrate does")
 }
 
-// Init inits the selected DB in DefaultDb
-func Init() error {
+// Open initializes the database selected by the -database flag among the
+// registered ones and returns it. Configuration it can't work with fails
+// with a *ConfigError, other errors may go away when tried again.
+func Open() (Database, error) {
 	if database == "" {
-		return ErrNoDatabaseSelected
+		return nil, &ConfigError{ErrNoDatabaseSelected}
 	}
-	err := Set()
-	if err != nil {
-		return err
+	d, ok := DBTypes[database]
+	if !ok {
+		return nil, &ConfigError{fmt.Errorf(ErrNoDatabaseFound, database)}
 	}
-	return DefaultDb.Init()
-}
-
-// Set the DefaultDb
-func Set() error {
-	if v, ok := DBTypes[database]; ok {
-		DefaultDb = v
-		return nil
+	if err := ValidateIDFormat(); err != nil {
+		return nil, &ConfigError{err}
+	}
+	if err := d.Init(); err != nil {
+		return nil, err
 	}
-	return fmt.Errorf(ErrNoDatabaseFound, database)
+	return d, nil
 }
 
 // Register registers the database interface in the DBTypes
@@ -71,41 +142,466 @@ func Register(name string, db Database) {
 	DBTypes[name] = db
 }
 
-// CreateUser invokes DefaultDb method
-func CreateUser(u *users.User) error {
-	return DefaultDb.CreateUser(u)
+// Store wraps a Database with what every implementation shares: email
+// normalization, pii encryption, alias resolution and links.
+type Store struct {
+	db Database
+	// cipher encrypts the pii tagged user fields and webhook secrets at
+	// rest, cardCipher card numbers, nil ones store them as plaintext.
+	cipher     *pii.Cipher
+	cardCipher *pii.Cipher
+	// timeout bounds each query, slow is how long one takes before it is
+	// logged to logger.
+	timeout time.Duration
+	slow    time.Duration
+	logger  log.Logger
+}
+
+// StoreOption configures a Store.
+type StoreOption func(*Store)
+
+// WithCipher encrypts the pii tagged user fields and the webhook secrets
+// with c.
+func WithCipher(c *pii.Cipher) StoreOption {
+	return func(s *Store) {
+		s.cipher = c
+	}
+}
+
+// WithCardCipher encrypts card numbers with c.
+func WithCardCipher(c *pii.Cipher) StoreOption {
+	return func(s *Store) {
+		s.cardCipher = c
+	}
+}
+
+// NewStore returns a Store over d.
+func NewStore(d Database, opts ...StoreOption) *Store {
+	s := &Store{db: d}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Tenant returns the Store of the given tenant, the empty tenant is s
+// itself. The Database has to implement Tenanted.
+func (s *Store) Tenant(id string) (*Store, error) {
+	if id == "" {
+		return s, nil
+	}
+	if !ValidTenant(id) {
+		return nil, ErrInvalidTenant
+	}
+	t, ok := s.db.(Tenanted)
+	if !ok {
+		return nil, ErrNoTenancy
+	}
+	d, err := t.Tenant(id)
+	if err != nil {
+		return nil, err
+	}
+	ts := *s
+	ts.db = d
+	if s.logger != nil {
+		ts.logger = log.With(s.logger, "tenant", id)
+	}
+	return &ts, nil
+}
+
+// CreateUser invokes the Database method
+func (s *Store) CreateUser(ctx context.Context, u *users.User) error {
+	ctx, done := s.query(ctx, "CreateUser")
+	defer done()
+	u.Email = users.NormalizeEmail(u.Email)
+	u.Phone = users.NormalizePhone(u.Phone)
+	if s.cipher == nil {
+		return s.db.CreateUser(ctx, u)
+	}
+	e := *u
+	s.cipher.Encrypt(&e)
+	err := s.db.CreateUser(ctx, &e)
+	if err != nil {
+		return err
+	}
+	*u = e
+	return s.decryptUser(u)
+}
+
+// UpdateUser invokes the Database method
+func (s *Store) UpdateUser(ctx context.Context, id string, p users.ProfileUpdate) error {
+	ctx, done := s.query(ctx, "UpdateUser", "id", id)
+	defer done()
+	p = copyProfile(p)
+	if p.Email != nil {
+		*p.Email = users.NormalizeEmail(*p.Email)
+	}
+	if p.Phone != nil {
+		*p.Phone = users.NormalizePhone(*p.Phone)
+	}
+	if s.cipher != nil {
+		s.cipher.Encrypt(&p)
+	}
+	return s.db.UpdateUser(ctx, id, p)
+}
+
+// copyProfile gives p fresh pointers so normalizing and encrypting it
+// leaves the caller's values alone.
+func copyProfile(p users.ProfileUpdate) users.ProfileUpdate {
+	for _, f := range []**string{&p.FirstName, &p.LastName, &p.Email, &p.Phone} {
+		if *f != nil {
+			v := **f
+			*f = &v
+		}
+	}
+	return p
 }
 
-// GetUserByName invokes DefaultDb method
-func GetUserByName(n string) (users.User, error) {
-	u, err := DefaultDb.GetUserByName(n)
+// GetUserByName invokes the Database method
+func (s *Store) GetUserByName(ctx context.Context, n string) (users.User, error) {
+	ctx, done := s.query(ctx, "GetUserByName")
+	defer done()
+	u, err := s.db.GetUserByName(ctx, n)
 	if err == nil {
 		u.AddLinks()
+		err = s.decryptUser(&u)
 	}
 	return u, err
 }
 
-// GetUser invokes DefaultDb method
-func GetUser(n string) (users.User, error) {
-	u, err := DefaultDb.GetUser(n)
+// GetUser invokes the Database method
+func (s *Store) GetUser(ctx context.Context, n string) (users.User, error) {
+	ctx, done := s.query(ctx, "GetUser", "id", n)
+	defer done()
+	u, err := s.db.GetUser(ctx, n)
+	if err != nil {
+		// Ids of users merged away resolve to the user they were merged into.
+		if target, aerr := s.db.ResolveAlias(ctx, n); aerr == nil {
+			u, err = s.db.GetUser(ctx, target)
+		}
+	}
 	if err == nil {
 		u.AddLinks()
+		err = s.decryptUser(&u)
 	}
 	return u, err
 }
 
-// GetUsers invokes DefaultDb method
-func GetUsers() ([]users.User, error) {
-	us, err := DefaultDb.GetUsers()
+// GetUsers invokes the Database method. Email is matched on its deterministic
+// ciphertext when encryption is on, last names can't be queried then.
+func (s *Store) GetUsers(ctx context.Context, q UserQuery) ([]users.User, error) {
+	ctx, done := s.query(ctx, "GetUsers", q.filter()...)
+	defer done()
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+	q.Email = users.NormalizeEmail(q.Email)
+	if s.cipher != nil {
+		if f, _ := q.SortField(); q.LastName != "" || f == "lastName" || f == "email" {
+			return nil, ErrEncryptedField
+		}
+		q.Email = string(s.cipher.EncryptString(q.Email, pii.Deterministic))
+	}
+	us, err := s.db.GetUsers(ctx, q)
 	for k, _ := range us {
 		us[k].AddLinks()
+		if derr := s.decryptUser(&us[k]); derr != nil && err == nil {
+			err = derr
+		}
 	}
 	return us, err
 }
 
-// GetUserAttributes invokes DefaultDb method
-func GetUserAttributes(u *users.User) error {
-	err := DefaultDb.GetUserAttributes(u)
+// GetUsersByID invokes the Database method, it returns the users with the
+// given ids in one query. Unknown ids, including those of merged users, are
+// left out.
+func (s *Store) GetUsersByID(ctx context.Context, ids []string) ([]users.User, error) {
+	ctx, done := s.query(ctx, "GetUsersByID", "ids", len(ids))
+	defer done()
+	us, err := s.db.GetUsersByID(ctx, ids)
+	for k := range us {
+		us[k].AddLinks()
+		if derr := s.decryptUser(&us[k]); derr != nil && err == nil {
+			err = derr
+		}
+	}
+	return us, err
+}
+
+// StoredEmail returns email the way a Store with cipher stores it:
+// normalized and, with a cipher, encrypted.
+func StoredEmail(email string, cipher *pii.Cipher) string {
+	email = users.NormalizeEmail(email)
+	if cipher != nil {
+		email = string(cipher.EncryptString(email, pii.Deterministic))
+	}
+	return email
+}
+
+// GetStats invokes the Database method
+func (s *Store) GetStats(ctx context.Context, signupsSince, activeSince time.Time) (Stats, error) {
+	ctx, done := s.query(ctx, "GetStats", "signupsSince", signupsSince, "activeSince", activeSince)
+	defer done()
+	return s.db.GetStats(ctx, signupsSince, activeSince)
+}
+
+// ListUsers invokes the Database method, it returns up to limit users with an
+// id after the given one in id order. Only admin relevant fields are loaded.
+func (s *Store) ListUsers(ctx context.Context, after string, limit int) ([]users.User, error) {
+	ctx, done := s.query(ctx, "ListUsers", "after", after, "limit", limit)
+	defer done()
+	us, err := s.db.ListUsers(ctx, after, limit)
+	for k, _ := range us {
+		if derr := s.decryptUser(&us[k]); derr != nil && err == nil {
+			err = derr
+		}
+	}
+	return us, err
+}
+
+func (s *Store) decryptUser(u *users.User) error {
+	if s.cipher == nil {
+		return nil
+	}
+	return s.cipher.Decrypt(u)
+}
+
+// UserExists invokes the Database method, field is "username" or "email"
+func (s *Store) UserExists(ctx context.Context, field, value string) (bool, error) {
+	ctx, done := s.query(ctx, "UserExists", "field", field)
+	defer done()
+	if field == "email" {
+		value = StoredEmail(value, s.cipher)
+	}
+	return s.db.UserExists(ctx, field, value)
+}
+
+// MergeUsers invokes the Database method. The source user is merged into the
+// target: its addresses, cards and tags are added, the profile fields set in
+// p are written, and its id becomes an alias of the target.
+func (s *Store) MergeUsers(ctx context.Context, target, source string, p users.ProfileUpdate) error {
+	ctx, done := s.query(ctx, "MergeUsers", "target", target, "source", source)
+	defer done()
+	p = copyProfile(p)
+	if p.Email != nil {
+		*p.Email = users.NormalizeEmail(*p.Email)
+	}
+	if s.cipher != nil {
+		s.cipher.Encrypt(&p)
+	}
+	return s.db.MergeUsers(ctx, target, source, p)
+}
+
+// UpgradeUser invokes the Database method. The guest id gets the
+// username, password, salt, email and names of u and loses its guest role.
+func (s *Store) UpgradeUser(ctx context.Context, id string, u users.User) error {
+	ctx, done := s.query(ctx, "UpgradeUser", "id", id)
+	defer done()
+	u.Email = users.NormalizeEmail(u.Email)
+	if s.cipher != nil {
+		s.cipher.Encrypt(&u)
+	}
+	return s.db.UpgradeUser(ctx, id, u)
+}
+
+// RenameUser invokes the Database method
+func (s *Store) RenameUser(ctx context.Context, id, username string) error {
+	ctx, done := s.query(ctx, "RenameUser", "id", id)
+	defer done()
+	return s.db.RenameUser(ctx, id, username)
+}
+
+// GetUserByPreviousName invokes the Database method, it finds the user who
+// gave up name after since
+func (s *Store) GetUserByPreviousName(ctx context.Context, name string, since time.Time) (users.User, error) {
+	ctx, done := s.query(ctx, "GetUserByPreviousName", "since", since)
+	defer done()
+	u, err := s.db.GetUserByPreviousName(ctx, name, since)
+	if err == nil {
+		u.AddLinks()
+		err = s.decryptUser(&u)
+	}
+	return u, err
+}
+
+// RecordLogin invokes the Database method
+func (s *Store) RecordLogin(ctx context.Context, id string, at time.Time) error {
+	ctx, done := s.query(ctx, "RecordLogin", "id", id)
+	defer done()
+	return s.db.RecordLogin(ctx, id, at)
+}
+
+// AddUserTag invokes the Database method
+func (s *Store) AddUserTag(ctx context.Context, id, tag string) error {
+	ctx, done := s.query(ctx, "AddUserTag", "id", id, "tag", tag)
+	defer done()
+	return s.db.AddUserTag(ctx, id, tag)
+}
+
+// RemoveUserTag invokes the Database method
+func (s *Store) RemoveUserTag(ctx context.Context, id, tag string) error {
+	ctx, done := s.query(ctx, "RemoveUserTag", "id", id, "tag", tag)
+	defer done()
+	return s.db.RemoveUserTag(ctx, id, tag)
+}
+
+// CreateGroup invokes the Database method
+func (s *Store) CreateGroup(ctx context.Context, g *users.Group) error {
+	ctx, done := s.query(ctx, "CreateGroup")
+	defer done()
+	return s.db.CreateGroup(ctx, g)
+}
+
+// GetGroup invokes the Database method
+func (s *Store) GetGroup(ctx context.Context, id string) (users.Group, error) {
+	ctx, done := s.query(ctx, "GetGroup", "id", id)
+	defer done()
+	g, err := s.db.GetGroup(ctx, id)
+	if err == nil {
+		g.AddLinks()
+	}
+	return g, err
+}
+
+// GetUserGroups invokes the Database method, it returns the groups the user
+// owns or is a member of
+func (s *Store) GetUserGroups(ctx context.Context, userID string) ([]users.Group, error) {
+	ctx, done := s.query(ctx, "GetUserGroups", "user", userID)
+	defer done()
+	gs, err := s.db.GetUserGroups(ctx, userID)
+	for k := range gs {
+		gs[k].AddLinks()
+	}
+	return gs, err
+}
+
+// AddGroupMember invokes the Database method
+func (s *Store) AddGroupMember(ctx context.Context, groupID, userID string) error {
+	ctx, done := s.query(ctx, "AddGroupMember", "group", groupID, "user", userID)
+	defer done()
+	return s.db.AddGroupMember(ctx, groupID, userID)
+}
+
+// RemoveGroupMember invokes the Database method
+func (s *Store) RemoveGroupMember(ctx context.Context, groupID, userID string) error {
+	ctx, done := s.query(ctx, "RemoveGroupMember", "group", groupID, "user", userID)
+	defer done()
+	return s.db.RemoveGroupMember(ctx, groupID, userID)
+}
+
+// AddActivity invokes the Database method
+func (s *Store) AddActivity(ctx context.Context, a *users.Activity) error {
+	ctx, done := s.query(ctx, "AddActivity")
+	defer done()
+	return s.db.AddActivity(ctx, a)
+}
+
+// GetActivity invokes the Database method, it returns up to limit entries
+// of the activity feed of the user older than the entry before, newest
+// first
+func (s *Store) GetActivity(ctx context.Context, userID, before string, limit int) ([]users.Activity, error) {
+	ctx, done := s.query(ctx, "GetActivity", "user", userID, "before", before, "limit", limit)
+	defer done()
+	return s.db.GetActivity(ctx, userID, before, limit)
+}
+
+// OwnerOf invokes the Database method, it returns the id of the user owning
+// the address or card id
+func (s *Store) OwnerOf(ctx context.Context, entity, id string) (string, error) {
+	ctx, done := s.query(ctx, "OwnerOf", "entity", entity, "id", id)
+	defer done()
+	return s.db.OwnerOf(ctx, entity, id)
+}
+
+// CreateIdempotencyKey invokes the Database method, it fails with
+// ErrConflict for keys already in use
+func (s *Store) CreateIdempotencyKey(ctx context.Context, k *IdempotencyKey) error {
+	ctx, done := s.query(ctx, "CreateIdempotencyKey")
+	defer done()
+	return s.db.CreateIdempotencyKey(ctx, k)
+}
+
+// GetIdempotencyKey invokes the Database method
+func (s *Store) GetIdempotencyKey(ctx context.Context, key string) (IdempotencyKey, error) {
+	ctx, done := s.query(ctx, "GetIdempotencyKey", "key", key)
+	defer done()
+	return s.db.GetIdempotencyKey(ctx, key)
+}
+
+// SetIdempotencyResult invokes the Database method
+func (s *Store) SetIdempotencyResult(ctx context.Context, key, resultID string) error {
+	ctx, done := s.query(ctx, "SetIdempotencyResult", "key", key)
+	defer done()
+	return s.db.SetIdempotencyResult(ctx, key, resultID)
+}
+
+// DeleteIdempotencyKey invokes the Database method
+func (s *Store) DeleteIdempotencyKey(ctx context.Context, key string) error {
+	ctx, done := s.query(ctx, "DeleteIdempotencyKey", "key", key)
+	defer done()
+	return s.db.DeleteIdempotencyKey(ctx, key)
+}
+
+// CreateWebhook invokes the Database method, the secret is stored encrypted
+// with the PII key, if any
+func (s *Store) CreateWebhook(ctx context.Context, w *users.Webhook) error {
+	ctx, done := s.query(ctx, "CreateWebhook")
+	defer done()
+	if s.cipher == nil {
+		return s.db.CreateWebhook(ctx, w)
+	}
+	e := *w
+	s.cipher.Encrypt(&e)
+	if err := s.db.CreateWebhook(ctx, &e); err != nil {
+		return err
+	}
+	*w = e
+	return s.cipher.Decrypt(w)
+}
+
+// GetWebhooks invokes the Database method, decrypting the secrets
+func (s *Store) GetWebhooks(ctx context.Context) ([]users.Webhook, error) {
+	ctx, done := s.query(ctx, "GetWebhooks")
+	defer done()
+	ws, err := s.db.GetWebhooks(ctx)
+	if err != nil || s.cipher == nil {
+		return ws, err
+	}
+	for k := range ws {
+		if err := s.cipher.Decrypt(&ws[k]); err != nil {
+			return nil, err
+		}
+	}
+	return ws, nil
+}
+
+// DeleteWebhook invokes the Database method
+func (s *Store) DeleteWebhook(ctx context.Context, id string) error {
+	ctx, done := s.query(ctx, "DeleteWebhook", "id", id)
+	defer done()
+	return s.db.DeleteWebhook(ctx, id)
+}
+
+// AddWebhookDelivery invokes the Database method
+func (s *Store) AddWebhookDelivery(ctx context.Context, d *users.WebhookDelivery) error {
+	ctx, done := s.query(ctx, "AddWebhookDelivery")
+	defer done()
+	return s.db.AddWebhookDelivery(ctx, d)
+}
+
+// GetWebhookDeliveries invokes the Database method, it returns up to limit
+// deliveries to the webhook older than the delivery before, newest first
+func (s *Store) GetWebhookDeliveries(ctx context.Context, webhookID, before string, limit int) ([]users.WebhookDelivery, error) {
+	ctx, done := s.query(ctx, "GetWebhookDeliveries", "webhook", webhookID, "before", before, "limit", limit)
+	defer done()
+	return s.db.GetWebhookDeliveries(ctx, webhookID, before, limit)
+}
+
+// GetUserAttributes invokes the Database method
+func (s *Store) GetUserAttributes(ctx context.Context, u *users.User) error {
+	ctx, done := s.query(ctx, "GetUserAttributes", "user", u.UserID)
+	defer done()
+	err := s.db.GetUserAttributes(ctx, u)
 	if err != nil {
 		return err
 	}
@@ -114,60 +610,398 @@ func GetUserAttributes(u *users.User) error {
 	}
 	for k, _ := range u.Cards {
 		u.Cards[k].AddLinks()
+		if err := s.decryptCard(&u.Cards[k]); err != nil {
+			return err
+		}
 	}
+	u.MarkDefaultCard()
 	return nil
 }
 
-// CreateAddress invokes DefaultDb method
-func CreateAddress(a *users.Address, userid string) error {
-	return DefaultDb.CreateAddress(a, userid)
+// ExpandUsers invokes the Database method, it loads the named Expandable
+// attributes of all the users with one query per attribute. Only the asked
+// for attributes are replaced.
+func (s *Store) ExpandUsers(ctx context.Context, us []users.User, attrs []string) error {
+	ctx, done := s.query(ctx, "ExpandUsers", "users", len(us), "attrs", attrs)
+	defer done()
+	if len(us) == 0 || len(attrs) == 0 {
+		return nil
+	}
+	if err := s.db.ExpandUsers(ctx, us, attrs); err != nil {
+		return err
+	}
+	for k := range us {
+		for i := range us[k].Addresses {
+			us[k].Addresses[i].AddLinks()
+		}
+		for i := range us[k].Cards {
+			us[k].Cards[i].AddLinks()
+			if err := s.decryptCard(&us[k].Cards[i]); err != nil {
+				return err
+			}
+		}
+		us[k].MarkDefaultCard()
+	}
+	return nil
 }
 
-// GetAddress invokes DefaultDb method
-func GetAddress(n string) (users.Address, error) {
-	a, err := DefaultDb.GetAddress(n)
+// CreateAddress invokes the Database method
+func (s *Store) CreateAddress(ctx context.Context, a *users.Address, userid string) error {
+	ctx, done := s.query(ctx, "CreateAddress", "user", userid)
+	defer done()
+	return s.db.CreateAddress(ctx, a, userid)
+}
+
+// CreateAddresses invokes the Database method
+func (s *Store) CreateAddresses(ctx context.Context, as []users.Address, userid string) error {
+	ctx, done := s.query(ctx, "CreateAddresses", "user", userid, "addresses", len(as))
+	defer done()
+	return s.db.CreateAddresses(ctx, as, userid)
+}
+
+// SetAddressLocation invokes the Database method
+func (s *Store) SetAddressLocation(ctx context.Context, id string, l *users.Location, status string) error {
+	ctx, done := s.query(ctx, "SetAddressLocation", "id", id)
+	defer done()
+	return s.db.SetAddressLocation(ctx, id, l, status)
+}
+
+// UpdateAddress invokes the Database method
+func (s *Store) UpdateAddress(ctx context.Context, id string, a *users.Address) error {
+	ctx, done := s.query(ctx, "UpdateAddress", "id", id)
+	defer done()
+	return s.db.UpdateAddress(ctx, id, a)
+}
+
+// GetAddress invokes the Database method
+func (s *Store) GetAddress(ctx context.Context, n string) (users.Address, error) {
+	ctx, done := s.query(ctx, "GetAddress", "id", n)
+	defer done()
+	a, err := s.db.GetAddress(ctx, n)
 	if err == nil {
 		a.AddLinks()
 	}
 	return a, err
 }
 
-// GetAddresses invokes DefaultDb method
-func GetAddresses() ([]users.Address, error) {
-	as, err := DefaultDb.GetAddresses()
+// GetAddresses invokes the Database method
+func (s *Store) GetAddresses(ctx context.Context) ([]users.Address, error) {
+	ctx, done := s.query(ctx, "GetAddresses")
+	defer done()
+	as, err := s.db.GetAddresses(ctx)
 	for k, _ := range as {
 		as[k].AddLinks()
 	}
 	return as, err
 }
 
-// CreateCard invokes DefaultDb method
-func CreateCard(c *users.Card, userid string) error {
-	return DefaultDb.CreateCard(c, userid)
+// GetAddressesByID invokes the Database method, it returns the addresses
+// with the given ids in one query. Unknown ids are left out.
+func (s *Store) GetAddressesByID(ctx context.Context, ids []string) ([]users.Address, error) {
+	ctx, done := s.query(ctx, "GetAddressesByID", "ids", len(ids))
+	defer done()
+	as, err := s.db.GetAddressesByID(ctx, ids)
+	for k := range as {
+		as[k].AddLinks()
+	}
+	return as, err
+}
+
+// CreateCard invokes the Database method, the number is encrypted by
+// card cipher.
+func (s *Store) CreateCard(ctx context.Context, c *users.Card, userid string) error {
+	ctx, done := s.query(ctx, "CreateCard", "user", userid)
+	defer done()
+	c.StripCVV()
+	if s.cardCipher == nil {
+		return s.db.CreateCard(ctx, c, userid)
+	}
+	e := *c
+	s.cardCipher.Encrypt(&e)
+	if err := s.db.CreateCard(ctx, &e, userid); err != nil {
+		return err
+	}
+	*c = e
+	return s.decryptCard(c)
+}
+
+func (s *Store) decryptCard(c *users.Card) error {
+	if s.cardCipher == nil {
+		return nil
+	}
+	return s.cardCipher.Decrypt(c)
+}
+
+// UpdateCard invokes the Database method
+func (s *Store) UpdateCard(ctx context.Context, id string, u users.CardUpdate) error {
+	ctx, done := s.query(ctx, "UpdateCard", "id", id)
+	defer done()
+	return s.db.UpdateCard(ctx, id, u)
 }
 
-// GetCard invokes DefaultDb method
-func GetCard(n string) (users.Card, error) {
-	return DefaultDb.GetCard(n)
+// SetDefaultCard invokes the Database method
+func (s *Store) SetDefaultCard(ctx context.Context, userID, cardID string) error {
+	ctx, done := s.query(ctx, "SetDefaultCard", "user", userID, "card", cardID)
+	defer done()
+	return s.db.SetDefaultCard(ctx, userID, cardID)
 }
 
-// GetCards invokes DefaultDb method
-func GetCards() ([]users.Card, error) {
-	cs, err := DefaultDb.GetCards()
+// SetCardVerification invokes the Database method
+func (s *Store) SetCardVerification(ctx context.Context, id, status string) error {
+	ctx, done := s.query(ctx, "SetCardVerification", "id", id, "status", status)
+	defer done()
+	return s.db.SetCardVerification(ctx, id, status)
+}
+
+// SetCardReminded invokes the Database method
+func (s *Store) SetCardReminded(ctx context.Context, id, expires string) error {
+	ctx, done := s.query(ctx, "SetCardReminded", "id", id)
+	defer done()
+	return s.db.SetCardReminded(ctx, id, expires)
+}
+
+// DeleteCard replaces the card with a tombstone keeping only its masked
+// number, linked to the card replacing it if there is one.
+func (s *Store) DeleteCard(ctx context.Context, id, replacedBy string) error {
+	ctx, done := s.query(ctx, "DeleteCard", "id", id)
+	defer done()
+	c, err := s.GetCard(ctx, id)
+	if err != nil {
+		return err
+	}
+	c.MaskCC()
+	return s.db.TombstoneCard(ctx, id, c.LongNum, replacedBy)
+}
+
+// GetCard invokes the Database method
+func (s *Store) GetCard(ctx context.Context, n string) (users.Card, error) {
+	ctx, done := s.query(ctx, "GetCard", "id", n)
+	defer done()
+	c, err := s.db.GetCard(ctx, n)
+	if err == nil {
+		err = s.decryptCard(&c)
+	}
+	return c, err
+}
+
+// GetCards invokes the Database method
+func (s *Store) GetCards(ctx context.Context) ([]users.Card, error) {
+	ctx, done := s.query(ctx, "GetCards")
+	defer done()
+	cs, err := s.db.GetCards(ctx)
 	for k, _ := range cs {
 		cs[k].AddLinks()
+		if derr := s.decryptCard(&cs[k]); derr != nil && err == nil {
+			err = derr
+		}
+	}
+	return cs, err
+}
+
+// GetCardsByID invokes the Database method, it returns the cards with the
+// given ids in one query. Unknown ids and deleted cards are left out.
+func (s *Store) GetCardsByID(ctx context.Context, ids []string) ([]users.Card, error) {
+	ctx, done := s.query(ctx, "GetCardsByID", "ids", len(ids))
+	defer done()
+	cs, err := s.db.GetCardsByID(ctx, ids)
+	for k := range cs {
+		cs[k].AddLinks()
+		if derr := s.decryptCard(&cs[k]); derr != nil && err == nil {
+			err = derr
+		}
+	}
+	return cs, err
+}
+
+// ListCards invokes the Database method, it returns up to limit cards with
+// an id after the given one in id order. Their numbers are always masked.
+func (s *Store) ListCards(ctx context.Context, after string, limit int) ([]OwnedCard, error) {
+	ctx, done := s.query(ctx, "ListCards", "after", after, "limit", limit)
+	defer done()
+	cs, err := s.db.ListCards(ctx, after, limit)
+	for k := range cs {
+		if derr := s.decryptCard(&cs[k].Card); derr != nil && err == nil {
+			err = derr
+		}
+		cs[k].MaskCC()
+		cs[k].StripCVV()
 	}
 	return cs, err
 }
 
-// Delete invokes DefaultDb method
-func Delete(entity, id string) error {
-	return DefaultDb.Delete(entity, id)
+// Delete invokes the Database method
+func (s *Store) Delete(ctx context.Context, entity, id string) error {
+	ctx, done := s.query(ctx, "Delete", "entity", entity, "id", id)
+	defer done()
+	return s.db.Delete(ctx, entity, id)
+}
+
+// DeleteUsers invokes the Database method, returning the outcome per id. The
+// error is set when the batch as a whole failed.
+func (s *Store) DeleteUsers(ctx context.Context, ids []string) (map[string]error, error) {
+	ctx, done := s.query(ctx, "DeleteUsers", "ids", len(ids))
+	defer done()
+	return s.db.DeleteUsers(ctx, ids)
+}
+
+// Ping invokes the Database method
+func (s *Store) Ping(ctx context.Context) error {
+	ctx, done := s.query(ctx, "Ping")
+	defer done()
+	return s.db.Ping(ctx)
+}
+
+// Reconnector is implemented by databases whose connections don't recover
+// from every failure by themselves, like a MongoDB session after its
+// primary failed over. Reconnect drops the connections and checks the
+// database can be reached anew.
+type Reconnector interface {
+	Reconnect(context.Context) error
+}
+
+// Reconnect invokes the Database method, databases without it reconnect by
+// themselves and are pinged instead.
+func (s *Store) Reconnect(ctx context.Context) error {
+	if r, ok := s.db.(Reconnector); ok {
+		return r.Reconnect(ctx)
+	}
+	return s.db.Ping(ctx)
+}
+
+// Migrator is implemented by databases with versioned migrations. They
+// apply the pending ones on Init when AutoMigrate is set. A migration
+// failing to apply doesn't fail Init, it is reported by MigrationFailure
+// until the migrations have been applied.
+type Migrator interface {
+	// Migrated reports whether the migrations have been applied.
+	Migrated() bool
+	// Migrate applies the pending migrations in version order.
+	Migrate(context.Context) error
+	// MigrationStatus lists the migrations in version order.
+	MigrationStatus(context.Context) ([]MigrationStatus, error)
+	// MigrationFailure returns the *MigrationError the last migration
+	// failed with, nil when none failed.
+	MigrationFailure() error
+}
+
+// ConfigError is returned by Open and Init for configuration the database
+// can't be used with, which trying again won't fix.
+type ConfigError struct {
+	Err error
+}
+
+func (e *ConfigError) Error() string {
+	return e.Err.Error()
 }
 
-// Ping invokes DefaultDB method
-func Ping() error {
-	return DefaultDb.Ping()
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+// MigrationError is returned by Migrate when a migration fails to apply,
+// like a unique index that can't be built over duplicates.
+type MigrationError struct {
+	Version int
+	Name    string
+	Err     error
+}
+
+func (e *MigrationError) Error() string {
+	return fmt.Sprintf("migration %v %v: %v", e.Version, e.Name, e.Err)
+}
+
+func (e *MigrationError) Unwrap() error {
+	return e.Err
+}
+
+// Watcher is implemented by databases streaming the changes made to them,
+// by this service or anything else writing to them.
+type Watcher interface {
+	// Watch calls publish with the changes to users, addresses and cards
+	// as they are made, until ctx is done or the stream fails. Called
+	// again, it resumes where it stopped if the database can.
+	Watch(ctx context.Context, publish func(changes.Event)) error
+}
+
+// Watch streams the changes of the Database as for Watcher. Databases that
+// don't fail with ErrNotWatchable.
+func (s *Store) Watch(ctx context.Context, publish func(changes.Event)) error {
+	if w, ok := s.db.(Watcher); ok {
+		return w.Watch(ctx, publish)
+	}
+	return ErrNotWatchable
+}
+
+// Outbox is implemented by databases recording the changes to users,
+// addresses and cards in the transaction making them, so none is lost
+// between the write and its event.
+type Outbox interface {
+	// RelayOutbox calls publish with the recorded changes in order, keyed
+	// so the broker drops those published again, and removes them once
+	// published, until ctx is done or the database fails. Changes are
+	// published at least once: those not removed are published again by
+	// the next call.
+	RelayOutbox(ctx context.Context, publish func(changes.Event)) error
+}
+
+// RelayOutbox relays the changes of the Database as for Outbox. Databases
+// without an outbox fail with ErrNoOutbox.
+func (s *Store) RelayOutbox(ctx context.Context, publish func(changes.Event)) error {
+	if o, ok := s.db.(Outbox); ok {
+		return o.RelayOutbox(ctx, publish)
+	}
+	return ErrNoOutbox
+}
+
+// MigrationStatus is a migration and when it was applied, nil while it is
+// pending.
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	AppliedAt *time.Time
+}
+
+// Migrated reports whether the migrations of the Database have been
+// applied. Databases without migrations always have.
+func (s *Store) Migrated() bool {
+	if m, ok := s.db.(Migrator); ok {
+		return m.Migrated()
+	}
+	return true
+}
+
+// Migrate applies the pending migrations of the Database, if it has any.
+func (s *Store) Migrate(ctx context.Context) error {
+	if m, ok := s.db.(Migrator); ok {
+		return m.Migrate(ctx)
+	}
+	return nil
+}
+
+// MigrationFailure returns the error the last migration of the Database
+// failed with, if any.
+func (s *Store) MigrationFailure() error {
+	if m, ok := s.db.(Migrator); ok {
+		return m.MigrationFailure()
+	}
+	return nil
+}
+
+// MigrationStatus lists the migrations of the Database, none if it has
+// none.
+func (s *Store) MigrationStatus(ctx context.Context) ([]MigrationStatus, error) {
+	if m, ok := s.db.(Migrator); ok {
+		return m.MigrationStatus(ctx)
+	}
+	return nil, nil
+}
+
+// Close closes the connections of the Database, if it holds any.
+func (s *Store) Close() error {
+	if c, ok := s.db.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
 }
 
 //u.Addresses[k] = users.Address{
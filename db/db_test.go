@@ -1,10 +1,14 @@
 package db
 
 import (
+	"context"
 	"errors"
 	"reflect"
 	"testing"
+	"time"
 
+	"github.com/go-kit/kit/log"
+	"user/pii"
 	"user/users"
 )
 
@@ -20,32 +24,26 @@ var (
 	}
 )
 
-func TestInit(t *testing.T) {
-	err := Init()
-	if err == nil {
-		t.Error("Expected no registered db error")
+func TestOpen(t *testing.T) {
+	database = ""
+	if _, err := Open(); !errors.Is(err, ErrNoDatabaseSelected) || !errors.As(err, new(*ConfigError)) {
+		t.Errorf("expected no selected db error, got %v", err)
+	}
+	database = "nodb"
+	if _, err := Open(); !errors.As(err, new(*ConfigError)) {
+		t.Errorf("Expecting config error for no databade found, got %v", err)
 	}
 	Register("test", TestDB)
 	database = "test"
-	err = Init()
-	if err != ErrFakeError {
+	if _, err := Open(); err != ErrFakeError {
 		t.Error("expected fake db error from init")
 	}
-	TestAddress.AddLinks()
-}
-
-func TestSet(t *testing.T) {
-	database = "nodb"
-	err := Set()
-	if err == nil {
-		t.Error("Expecting error for no databade found")
-	}
-	Register("nodb2", TestDB)
-	database = "nodb2"
-	err = Set()
-	if err != nil {
-		t.Error(err)
+	defer func(f string) { IDFormat = f }(IDFormat)
+	IDFormat = "uuid"
+	if _, err := Open(); !errors.As(err, new(*ConfigError)) {
+		t.Errorf("expected config error for an unknown id format, got %v", err)
 	}
+	TestAddress.AddLinks()
 }
 
 func TestRegister(t *testing.T) {
@@ -62,29 +60,75 @@ func TestRegister(t *testing.T) {
 }
 
 func TestCreateUser(t *testing.T) {
-	err := CreateUser(&users.User{})
+	ctx := context.Background()
+	err := NewStore(TestDB).CreateUser(ctx, &users.User{})
 	if err != ErrFakeError {
 		t.Error("expected fake db error from create")
 	}
 }
 
+func TestUpdateUser(t *testing.T) {
+	ctx := context.Background()
+	err := NewStore(TestDB).UpdateUser(ctx, "test", users.ProfileUpdate{})
+	if err != ErrFakeError {
+		t.Error("expected fake db error from update")
+	}
+}
+
 func TestGetUser(t *testing.T) {
-	_, err := GetUser("test")
+	ctx := context.Background()
+	_, err := NewStore(TestDB).GetUser(ctx, "test")
+	if err != ErrFakeError {
+		t.Error("expected fake db error from get")
+	}
+}
+
+func TestGetUsers(t *testing.T) {
+	ctx := context.Background()
+	_, err := NewStore(TestDB).GetUsers(ctx, UserQuery{})
 	if err != ErrFakeError {
 		t.Error("expected fake db error from get")
 	}
+	_, err = NewStore(TestDB).GetUsers(ctx, UserQuery{Sort: "salt"})
+	if err != ErrInvalidSort {
+		t.Error("expected invalid sort error before querying")
+	}
+}
+
+func TestStoredEmail(t *testing.T) {
+	if StoredEmail("Eve@Example.com ", nil) != "eve@example.com" {
+		t.Error("expected normalized email")
+	}
+	c, _ := pii.New([]byte("secret"))
+	if StoredEmail("Eve@Example.com", c) != StoredEmail("eve@example.com", c) {
+		t.Error("expected equal ciphertexts for emails differing by case")
+	}
+}
+
+func TestDecryptCard(t *testing.T) {
+	cipher, _ := pii.New([]byte("cardkey"))
+	c := users.Card{LongNum: "4111111111111111"}
+	cipher.Encrypt(&c)
+	if c.LongNum == "4111111111111111" {
+		t.Fatal("expected encrypted card number")
+	}
+	if err := NewStore(TestDB, WithCardCipher(cipher)).decryptCard(&c); err != nil || c.LongNum != "4111111111111111" {
+		t.Errorf("expected decrypted card number, got %v %v", c.LongNum, err)
+	}
 }
 
 func TestGetUserByName(t *testing.T) {
-	_, err := GetUserByName("test")
+	ctx := context.Background()
+	_, err := NewStore(TestDB).GetUserByName(ctx, "test")
 	if err != ErrFakeError {
 		t.Error("expected fake db error from get")
 	}
 }
 
 func TestGetUserAttributes(t *testing.T) {
+	ctx := context.Background()
 	u := users.New()
-	GetUserAttributes(&u)
+	NewStore(TestDB).GetUserAttributes(ctx, &u)
 	if len(u.Addresses) != 1 {
 		t.Error("expected one address added for GetUserAttributes")
 	}
@@ -93,67 +137,498 @@ func TestGetUserAttributes(t *testing.T) {
 	}
 }
 
+func TestExpandUsers(t *testing.T) {
+	ctx := context.Background()
+	if err := NewStore(TestDB).ExpandUsers(ctx, nil, []string{"cards"}); err != nil {
+		t.Errorf("expected no lookup without users, got %v", err)
+	}
+	if err := NewStore(TestDB).ExpandUsers(ctx, []users.User{users.New()}, []string{"cards"}); err != ErrFakeError {
+		t.Error("expected fake db error from expand")
+	}
+}
+
+type webhookDB struct {
+	fake
+	stored *users.Webhook
+}
+
+func (d webhookDB) CreateWebhook(ctx context.Context, w *users.Webhook) error {
+	*d.stored = *w
+	return nil
+}
+
+func (d webhookDB) GetWebhooks(ctx context.Context) ([]users.Webhook, error) {
+	return []users.Webhook{*d.stored}, nil
+}
+
+func TestWebhookSecretEncrypted(t *testing.T) {
+	ctx := context.Background()
+	c, _ := pii.New([]byte("secret"))
+	d := webhookDB{stored: &users.Webhook{}}
+	s := NewStore(d, WithCipher(c))
+	w := users.Webhook{URL: "https://crm.example.com/hooks", Secret: "0123456789abcdef"}
+	if err := s.CreateWebhook(ctx, &w); err != nil {
+		t.Fatal(err)
+	}
+	if d.stored.Secret == w.Secret || w.Secret != "0123456789abcdef" {
+		t.Errorf("expected the secret stored encrypted, got %q", d.stored.Secret)
+	}
+	ws, err := s.GetWebhooks(ctx)
+	if err != nil || len(ws) != 1 || ws[0].Secret != "0123456789abcdef" {
+		t.Errorf("expected the secret decrypted, got %+v %v", ws, err)
+	}
+}
+
 func TestPing(t *testing.T) {
-	err := Ping()
+	ctx := context.Background()
+	err := NewStore(TestDB).Ping(ctx)
 	if err != ErrFakeError {
 		t.Error("expected fake db error from ping")
 	}
 
 }
 
+type closer struct {
+	fake
+	closed bool
+}
+
+func (c *closer) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestClose(t *testing.T) {
+	if err := NewStore(TestDB).Close(); err != nil {
+		t.Errorf("expected databases without connections closed, got %v", err)
+	}
+	c := &closer{}
+	if err := NewStore(c).Close(); err != nil || !c.closed {
+		t.Errorf("expected the database closed, got %v", err)
+	}
+}
+
+type slowDB struct {
+	fake
+}
+
+func (d slowDB) GetUser(ctx context.Context, id string) (users.User, error) {
+	<-ctx.Done()
+	return users.User{}, ctx.Err()
+}
+
+func TestSlowQueries(t *testing.T) {
+	ctx := context.Background()
+	var logged []interface{}
+	logger := log.LoggerFunc(func(kv ...interface{}) error {
+		logged = kv
+		return nil
+	})
+	s := NewStore(slowDB{}, WithQueryTimeout(10*time.Millisecond), WithSlowQueries(5*time.Millisecond, logger))
+	if _, err := s.GetUser(ctx, "57a98d98e4b00679b4a830af"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the query timed out, got %v", err)
+	}
+	if len(logged) != 6 || logged[1] != "GetUser" || logged[4] != "id" || logged[5] != "57a98d98e4b00679b4a830af" {
+		t.Errorf("expected the slow query logged with its id, got %v", logged)
+	}
+	logged = nil
+	if _, err := s.GetUsers(ctx, UserQuery{Email: "eve@example.com", Status: users.StatusActive}); err != ErrFakeError {
+		t.Errorf("expected fake db error from get, got %v", err)
+	}
+	if logged != nil {
+		t.Errorf("expected fast queries not logged, got %v", logged)
+	}
+	kv := UserQuery{Email: "eve@example.com", LastName: "Doe", Status: users.StatusActive}.filter()
+	if !reflect.DeepEqual(kv, []interface{}{"email", "?", "lastName", "?", "status", users.StatusActive}) {
+		t.Errorf("expected personal data left out of the filter, got %v", kv)
+	}
+}
+
+type flakyDB struct {
+	fake
+	down        *bool
+	reconnected *int
+}
+
+func (d flakyDB) Ping(ctx context.Context) error {
+	if *d.down {
+		return ErrFakeError
+	}
+	return nil
+}
+
+func (d flakyDB) Reconnect(ctx context.Context) error {
+	*d.reconnected++
+	return d.Ping(ctx)
+}
+
+func TestSupervisor(t *testing.T) {
+	down, reconnected := false, 0
+	s := &Supervisor{Store: NewStore(flakyDB{down: &down, reconnected: &reconnected}), Logger: log.NewNopLogger()}
+	if !s.check(time.Second) || s.Err() != nil {
+		t.Fatalf("expected the database reachable, got %v", s.Err())
+	}
+	down = true
+	if s.check(time.Second) || !errors.Is(s.Err(), ErrDegraded) || !errors.Is(s.Err(), ErrFakeError) {
+		t.Errorf("expected the database degraded, got %v", s.Err())
+	}
+	if reconnected != 0 {
+		t.Errorf("expected a failing ping before reconnecting, got %v reconnects", reconnected)
+	}
+	s.check(time.Second)
+	down = false
+	if !s.check(time.Second) || s.Err() != nil || reconnected != 2 {
+		t.Errorf("expected the database reconnected, got %v after %v reconnects", s.Err(), reconnected)
+	}
+}
+
+type migrator struct {
+	fake
+	migrated bool
+}
+
+func (m migrator) Migrated() bool {
+	return m.migrated
+}
+
+func (m migrator) Migrate(ctx context.Context) error {
+	return errors.New("migrated")
+}
+
+func (m migrator) MigrationStatus(ctx context.Context) ([]MigrationStatus, error) {
+	return []MigrationStatus{{Version: 1, Name: "create"}}, nil
+}
+
+func (m migrator) MigrationFailure() error {
+	if m.migrated {
+		return nil
+	}
+	return &MigrationError{Version: 1, Name: "create", Err: errors.New("duplicate")}
+}
+
+func TestMigrated(t *testing.T) {
+	ctx := context.Background()
+	if !NewStore(fake{}).Migrated() {
+		t.Error("expected databases without migrations migrated")
+	}
+	if NewStore(migrator{}).Migrated() || !NewStore(migrator{migrated: true}).Migrated() {
+		t.Error("expected the migration state of the database")
+	}
+	if err := NewStore(fake{}).Migrate(ctx); err != nil {
+		t.Errorf("expected nothing to migrate, got %v", err)
+	}
+	if status, err := NewStore(fake{}).MigrationStatus(ctx); status != nil || err != nil {
+		t.Errorf("expected no migrations, got %v %v", status, err)
+	}
+	if err := NewStore(migrator{}).Migrate(ctx); err == nil || err.Error() != "migrated" {
+		t.Errorf("expected the database migrated, got %v", err)
+	}
+	if status, _ := NewStore(migrator{}).MigrationStatus(ctx); len(status) != 1 {
+		t.Errorf("expected the migrations of the database, got %v", status)
+	}
+	if err := NewStore(fake{}).MigrationFailure(); err != nil {
+		t.Errorf("expected no failure without migrations, got %v", err)
+	}
+	if err := NewStore(migrator{}).MigrationFailure(); err == nil || err.Error() != "migration 1 create: duplicate" {
+		t.Errorf("expected the failed migration, got %v", err)
+	}
+}
+
+func TestReadPreference(t *testing.T) {
+	for _, p := range []ReadPreference{Primary, SecondaryPreferred, Secondary, Nearest} {
+		if got, err := ParseReadPreference(p.String()); err != nil || got != p {
+			t.Errorf("expected %v parsed, got %v %v", p, got, err)
+		}
+	}
+	if _, err := ParseReadPreference("replica"); err == nil {
+		t.Error("expected an unknown preference rejected")
+	}
+	ctx := context.Background()
+	if ReadPreferenceFrom(ctx) != Primary || ReadPreferenceFrom(WithReadPreference(ctx, Nearest)) != Nearest {
+		t.Error("expected the read preference of the context, primary by default")
+	}
+}
+
+type cardRecorder struct {
+	fake
+	cards []users.Card
+}
+
+func (r *cardRecorder) CreateCard(ctx context.Context, c *users.Card, id string) error {
+	r.cards = append(r.cards, *c)
+	return nil
+}
+
+func (r *cardRecorder) ListCards(ctx context.Context, after string, limit int) ([]OwnedCard, error) {
+	return []OwnedCard{{Card: users.Card{LongNum: "4111111111111111"}, UserID: "1"}}, nil
+}
+
+func TestListCardsMasked(t *testing.T) {
+	ctx := context.Background()
+	cs, err := NewStore(&cardRecorder{}).ListCards(ctx, "", 1)
+	if err != nil || len(cs) != 1 || cs[0].LongNum != "************1111" {
+		t.Errorf("expected masked card numbers, got %+v %v", cs, err)
+	}
+}
+
+func TestCreateCardStripsCVV(t *testing.T) {
+	ctx := context.Background()
+	r := &cardRecorder{}
+	c := users.Card{LongNum: "4111111111111111", CCV: "123"}
+	if err := NewStore(r).CreateCard(ctx, &c, ""); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.cards) != 1 || r.cards[0].CCV != "" {
+		t.Errorf("expected the CCV stripped before reaching the database, got %+v", r.cards)
+	}
+}
+
 type fake struct{}
 
 func (f fake) Init() error {
 	return ErrFakeError
 }
-func (f fake) GetUserByName(name string) (users.User, error) {
+func (f fake) GetUserByName(ctx context.Context, name string) (users.User, error) {
 	return users.User{}, ErrFakeError
 }
-func (f fake) GetUser(id string) (users.User, error) {
+func (f fake) GetUser(ctx context.Context, id string) (users.User, error) {
 	return users.User{}, ErrFakeError
 }
 
-func (f fake) GetUsers() ([]users.User, error) {
+func (f fake) GetUsers(ctx context.Context, q UserQuery) ([]users.User, error) {
 	return make([]users.User, 0), ErrFakeError
 }
 
-func (f fake) CreateUser(*users.User) error {
+func (f fake) CreateUser(context.Context, *users.User) error {
+	return ErrFakeError
+}
+
+func (f fake) UpdateUser(ctx context.Context, id string, p users.ProfileUpdate) error {
+	return ErrFakeError
+}
+
+func (f fake) UserExists(ctx context.Context, field, value string) (bool, error) {
+	return false, ErrFakeError
+}
+
+func (f fake) GetStats(ctx context.Context, signupsSince, activeSince time.Time) (Stats, error) {
+	return Stats{}, ErrFakeError
+}
+
+func (f fake) ListUsers(ctx context.Context, after string, limit int) ([]users.User, error) {
+	return nil, ErrFakeError
+}
+
+func (f fake) MergeUsers(ctx context.Context, target, source string, p users.ProfileUpdate) error {
+	return ErrFakeError
+}
+
+func (f fake) ResolveAlias(ctx context.Context, id string) (string, error) {
+	return "", ErrFakeError
+}
+
+func (f fake) RenameUser(ctx context.Context, id, username string) error {
+	return ErrFakeError
+}
+
+func (f fake) GetUserByPreviousName(ctx context.Context, name string, since time.Time) (users.User, error) {
+	return users.User{}, ErrFakeError
+}
+
+func (f fake) UpgradeUser(ctx context.Context, id string, u users.User) error {
+	return ErrFakeError
+}
+
+func (f fake) SetAddressLocation(ctx context.Context, id string, l *users.Location, status string) error {
+	return ErrFakeError
+}
+
+func (f fake) UpdateAddress(ctx context.Context, id string, a *users.Address) error {
+	return ErrFakeError
+}
+
+func (f fake) AddActivity(ctx context.Context, a *users.Activity) error {
 	return ErrFakeError
 }
 
-func (f fake) GetUserAttributes(u *users.User) error {
+func (f fake) GetActivity(ctx context.Context, userID, before string, limit int) ([]users.Activity, error) {
+	return nil, ErrFakeError
+}
+
+func (f fake) OwnerOf(ctx context.Context, entity, id string) (string, error) {
+	return "", ErrFakeError
+}
+
+func (f fake) CreateIdempotencyKey(ctx context.Context, k *IdempotencyKey) error {
+	return ErrFakeError
+}
+
+func (f fake) GetIdempotencyKey(ctx context.Context, key string) (IdempotencyKey, error) {
+	return IdempotencyKey{}, ErrFakeError
+}
+
+func (f fake) SetIdempotencyResult(ctx context.Context, key, resultID string) error {
+	return ErrFakeError
+}
+
+func (f fake) DeleteIdempotencyKey(ctx context.Context, key string) error {
+	return ErrFakeError
+}
+
+func (f fake) CreateWebhook(ctx context.Context, w *users.Webhook) error {
+	return ErrFakeError
+}
+
+func (f fake) GetWebhooks(ctx context.Context) ([]users.Webhook, error) {
+	return nil, ErrFakeError
+}
+
+func (f fake) DeleteWebhook(ctx context.Context, id string) error {
+	return ErrFakeError
+}
+
+func (f fake) AddWebhookDelivery(ctx context.Context, d *users.WebhookDelivery) error {
+	return ErrFakeError
+}
+
+func (f fake) GetWebhookDeliveries(ctx context.Context, webhookID, before string, limit int) ([]users.WebhookDelivery, error) {
+	return nil, ErrFakeError
+}
+
+func (f fake) GetUsersByID(ctx context.Context, ids []string) ([]users.User, error) {
+	return nil, ErrFakeError
+}
+
+func (f fake) RecordLogin(ctx context.Context, id string, at time.Time) error {
+	return ErrFakeError
+}
+
+func (f fake) AddUserTag(ctx context.Context, id, tag string) error {
+	return ErrFakeError
+}
+
+func (f fake) RemoveUserTag(ctx context.Context, id, tag string) error {
+	return ErrFakeError
+}
+
+func (f fake) CreateGroup(ctx context.Context, g *users.Group) error {
+	return ErrFakeError
+}
+
+func (f fake) GetGroup(ctx context.Context, id string) (users.Group, error) {
+	return users.Group{}, ErrFakeError
+}
+
+func (f fake) GetUserGroups(ctx context.Context, userID string) ([]users.Group, error) {
+	return nil, ErrFakeError
+}
+
+func (f fake) AddGroupMember(ctx context.Context, groupID, userID string) error {
+	return ErrFakeError
+}
+
+func (f fake) RemoveGroupMember(ctx context.Context, groupID, userID string) error {
+	return ErrFakeError
+}
+
+func (f fake) GetUserAttributes(ctx context.Context, u *users.User) error {
 	u.Addresses = append(u.Addresses, TestAddress)
 	return nil
 }
 
-func (f fake) GetCard(id string) (users.Card, error) {
+func (f fake) ExpandUsers(ctx context.Context, us []users.User, attrs []string) error {
+	return ErrFakeError
+}
+
+func (f fake) GetCard(ctx context.Context, id string) (users.Card, error) {
 	return users.Card{}, ErrFakeError
 }
 
-func (f fake) GetCards() ([]users.Card, error) {
+func (f fake) GetCardsByID(ctx context.Context, ids []string) ([]users.Card, error) {
+	return nil, ErrFakeError
+}
+
+func (f fake) GetCards(ctx context.Context) ([]users.Card, error) {
 	return make([]users.Card, 0), ErrFakeError
 }
 
-func (f fake) CreateCard(c *users.Card, id string) error {
+func (f fake) UpdateCard(ctx context.Context, id string, u users.CardUpdate) error {
+	return ErrFakeError
+}
+
+func (f fake) SetDefaultCard(ctx context.Context, userID, cardID string) error {
 	return ErrFakeError
 }
 
-func (f fake) GetAddress(id string) (users.Address, error) {
+func (f fake) SetCardReminded(ctx context.Context, id, expires string) error {
+	return ErrFakeError
+}
+
+func (f fake) CreateAddresses(ctx context.Context, as []users.Address, userid string) error {
+	return ErrFakeError
+}
+
+func (f fake) ListCards(ctx context.Context, after string, limit int) ([]OwnedCard, error) {
+	return nil, ErrFakeError
+}
+
+func (f fake) SetCardVerification(ctx context.Context, id, status string) error {
+	return ErrFakeError
+}
+
+func (f fake) TombstoneCard(ctx context.Context, id, masked, replacedBy string) error {
+	return ErrFakeError
+}
+
+func (f fake) CreateCard(ctx context.Context, c *users.Card, id string) error {
+	return ErrFakeError
+}
+
+func (f fake) GetAddress(ctx context.Context, id string) (users.Address, error) {
 	return users.Address{}, ErrFakeError
 }
 
-func (f fake) GetAddresses() ([]users.Address, error) {
+func (f fake) GetAddressesByID(ctx context.Context, ids []string) ([]users.Address, error) {
+	return nil, ErrFakeError
+}
+
+func (f fake) GetAddresses(ctx context.Context) ([]users.Address, error) {
 	return make([]users.Address, 0), ErrFakeError
 }
 
-func (f fake) CreateAddress(u *users.Address, id string) error {
+func (f fake) CreateAddress(ctx context.Context, u *users.Address, id string) error {
 	return ErrFakeError
 }
 
-func (f fake) Delete(entity, id string) error {
+func (f fake) Delete(ctx context.Context, entity, id string) error {
 	return ErrFakeError
 }
 
-func (f fake) Ping() error {
+func (f fake) DeleteUsers(ctx context.Context, ids []string) (map[string]error, error) {
+	return nil, ErrFakeError
+}
+
+func (f fake) Ping(ctx context.Context) error {
 	return ErrFakeError
 }
+
+func TestValidTenant(t *testing.T) {
+	for id, valid := range map[string]bool{"shop-1": true, "a": true, "": false, "-shop": false, "Shop": false, "shop_1": false, "a23456789012345678901234567890123": false} {
+		if ValidTenant(id) != valid {
+			t.Errorf("expected %q valid %v", id, valid)
+		}
+	}
+}
+
+func TestStoreTenant(t *testing.T) {
+	s := NewStore(TestDB)
+	if d, err := s.Tenant(""); err != nil || d != s {
+		t.Error("expected the default tenant to be the store itself")
+	}
+	if _, err := s.Tenant("shop"); err != ErrNoTenancy {
+		t.Error("expected no tenancy error")
+	}
+	if _, err := s.Tenant("Shop!"); err != ErrInvalidTenant {
+		t.Error("expected invalid tenant error")
+	}
+}
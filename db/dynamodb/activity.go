@@ -0,0 +1,64 @@
+package dynamodb
+
+import (
+	"context"
+	"user/users"
+)
+
+// activityKey is the key of the activity entry id. The feed of each user
+// is a partition in id order.
+func activityKey(userID, id string) item {
+	return item{"pk": str("activity#" + userID), "sk": str(id)}
+}
+
+func activityItem(a users.Activity) item {
+	return keyed(marshal(&a), activityKey(a.UserID, a.ID))
+}
+
+// AddActivity appends a to the activity feed of its user
+func (d *DynamoDB) AddActivity(ctx context.Context, a *users.Activity) error {
+	stored := *a
+	stored.ID = newID()
+	stored.Time = now()
+	if err := d.write(ctx, put(activityItem(stored), "", nil, nil)); err != nil {
+		return err
+	}
+	*a = stored
+	return nil
+}
+
+// GetActivity returns up to limit entries of the activity feed of the user
+// older than the entry before, newest first
+func (d *DynamoDB) GetActivity(ctx context.Context, userID, before string, n int) ([]users.Activity, error) {
+	as := make([]users.Activity, 0)
+	err := d.query(ctx, partition("activity#"+userID, before), func(it item) (bool, error) {
+		var a users.Activity
+		if err := unmarshal(it, &a); err != nil {
+			return false, err
+		}
+		a.ID = it.str("sk")
+		as = append(as, a)
+		return n <= 0 || len(as) < n, nil
+	})
+	return as, err
+}
+
+// moveActivity moves the activity feed of the user source to target,
+// deletes it for an empty target.
+func (d *DynamoDB) moveActivity(ctx context.Context, source, target string) error {
+	as, err := d.GetActivity(ctx, source, "", 0)
+	if err != nil {
+		return err
+	}
+	for _, a := range as {
+		actions := []action{remove(activityKey(source, a.ID), "", nil, nil)}
+		if target != "" {
+			a.UserID = target
+			actions = append(actions, put(activityItem(a), "", nil, nil))
+		}
+		if err := d.write(ctx, actions...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,500 @@
+package dynamodb
+
+import (
+	"context"
+	"fmt"
+
+	"user/db"
+	"user/users"
+)
+
+// addressItem is the item of a owned by the user owner, empty for
+// anonymous users.
+func addressItem(a users.Address, owner string) item {
+	it := withKey(marshal(&a), "address", a.ID)
+	if owner != "" {
+		it["owner"] = str(owner)
+	}
+	return it
+}
+
+func decodeAddress(it item) (users.Address, error) {
+	var a users.Address
+	err := unmarshal(it, &a)
+	a.ID = it.str("sk")
+	return a, err
+}
+
+// cardItem is the item of ca owned by the user owner, empty for anonymous
+// users and deleted cards.
+func cardItem(ca users.Card, owner string) item {
+	it := withKey(marshal(&ca), "card", ca.ID)
+	if owner != "" {
+		it["owner"] = str(owner)
+	}
+	return it
+}
+
+func decodeCard(it item) (users.Card, error) {
+	var ca users.Card
+	err := unmarshal(it, &ca)
+	ca.ID = it.str("sk")
+	return ca, err
+}
+
+// GetUserAttributes given a user, load all cards and addresses connected to that user
+func (d *DynamoDB) GetUserAttributes(ctx context.Context, u *users.User) error {
+	us := []users.User{*u}
+	if err := d.ExpandUsers(ctx, us, db.Expandable); err != nil {
+		return err
+	}
+	*u = us[0]
+	return nil
+}
+
+// ExpandUsers replaces the ids of the named attributes of the users,
+// addresses or cards, with the stored ones
+func (d *DynamoDB) ExpandUsers(ctx context.Context, us []users.User, attrs []string) error {
+	for _, attr := range attrs {
+		if attr != "addresses" && attr != "cards" {
+			return fmt.Errorf("no attribute %v", attr)
+		}
+	}
+	for _, attr := range attrs {
+		var ids []string
+		for _, u := range us {
+			if attr == "addresses" {
+				for _, a := range u.Addresses {
+					ids = append(ids, a.ID)
+				}
+				continue
+			}
+			for _, ca := range u.Cards {
+				ids = append(ids, ca.ID)
+			}
+		}
+		if attr == "addresses" {
+			found, err := d.addressesByID(ctx, ids)
+			if err != nil {
+				return err
+			}
+			for k := range us {
+				as := make([]users.Address, 0, len(us[k].Addresses))
+				for _, a := range us[k].Addresses {
+					if stored, ok := found[a.ID]; ok {
+						as = append(as, stored)
+					}
+				}
+				us[k].Addresses = as
+			}
+			continue
+		}
+		found, err := d.cardsByID(ctx, ids, true)
+		if err != nil {
+			return err
+		}
+		for k := range us {
+			cs := make([]users.Card, 0, len(us[k].Cards))
+			for _, ca := range us[k].Cards {
+				if stored, ok := found[ca.ID]; ok {
+					cs = append(cs, stored)
+				}
+			}
+			us[k].Cards = cs
+		}
+	}
+	return nil
+}
+
+// addressesByID reads the addresses with ids, by id.
+func (d *DynamoDB) addressesByID(ctx context.Context, ids []string) (map[string]users.Address, error) {
+	its, err := d.batchGet(ctx, "address", ids)
+	if err != nil {
+		return nil, err
+	}
+	as := make(map[string]users.Address, len(its))
+	for id, it := range its {
+		if as[id], err = decodeAddress(it); err != nil {
+			return nil, err
+		}
+	}
+	return as, nil
+}
+
+// cardsByID reads the cards with ids by id, without the deleted ones unless
+// deleted is set.
+func (d *DynamoDB) cardsByID(ctx context.Context, ids []string, deleted bool) (map[string]users.Card, error) {
+	its, err := d.batchGet(ctx, "card", ids)
+	if err != nil {
+		return nil, err
+	}
+	cs := make(map[string]users.Card, len(its))
+	for id, it := range its {
+		ca, err := decodeCard(it)
+		if err != nil {
+			return nil, err
+		}
+		if deleted || ca.DeletedAt == nil {
+			cs[id] = ca
+		}
+	}
+	return cs, nil
+}
+
+// GetCard Gets card by id
+func (d *DynamoDB) GetCard(ctx context.Context, id string) (users.Card, error) {
+	it, err := d.get(ctx, key("card", id))
+	if err != nil {
+		return users.Card{}, err
+	}
+	return decodeCard(it)
+}
+
+// listCards returns up to n cards after the given id in id order, all for
+// zero, with the customers owning them. Deleted cards are left out.
+func (d *DynamoDB) listCards(ctx context.Context, after string, n int) ([]db.OwnedCard, error) {
+	cs := make([]db.OwnedCard, 0)
+	err := d.query(ctx, byKind("card", after), func(it item) (bool, error) {
+		ca, err := decodeCard(it)
+		if err != nil {
+			return false, err
+		}
+		if ca.DeletedAt == nil {
+			cs = append(cs, db.OwnedCard{Card: ca, UserID: it.str("owner")})
+		}
+		return n <= 0 || len(cs) < n, nil
+	})
+	return cs, err
+}
+
+// GetCards Gets all cards
+func (d *DynamoDB) GetCards(ctx context.Context) ([]users.Card, error) {
+	owned, err := d.listCards(ctx, "", 0)
+	if err != nil {
+		return nil, err
+	}
+	cs := make([]users.Card, len(owned))
+	for k, ca := range owned {
+		cs[k] = ca.Card
+	}
+	return cs, nil
+}
+
+// GetCardsByID gets the cards with the given ids, unknown ids and deleted
+// cards are left out
+func (d *DynamoDB) GetCardsByID(ctx context.Context, ids []string) ([]users.Card, error) {
+	found, err := d.cardsByID(ctx, ids, false)
+	if err != nil {
+		return nil, err
+	}
+	cs := make([]users.Card, 0, len(found))
+	for _, id := range unique(ids) {
+		if ca, ok := found[id]; ok {
+			cs = append(cs, ca)
+		}
+	}
+	return cs, nil
+}
+
+// ListCards returns up to limit cards after the given id in id order, with
+// the customers owning them. Deleted cards are left out.
+func (d *DynamoDB) ListCards(ctx context.Context, after string, n int) ([]db.OwnedCard, error) {
+	return d.listCards(ctx, after, n)
+}
+
+// own adds the address or card ids to the user owner in the same
+// transaction, failing with ErrNotFound for unknown users.
+func own(owner, attr string, ids ...string) action {
+	return update(key("user", owner), "ADD #"+attr+" :ids, #version :one", exists,
+		item{":ids": strs(ids...), ":one": num(1)}, ErrNotFound)
+}
+
+// CreateCard stores the card, owned by userid unless it is empty
+func (d *DynamoDB) CreateCard(ctx context.Context, ca *users.Card, userid string) error {
+	stored := *ca
+	stored.ID = newID()
+	stored.CreatedAt = now()
+	stored.UpdatedAt = stored.CreatedAt
+	actions := []action{put(cardItem(stored, userid), "attribute_not_exists(#pk)", nil, nil)}
+	if userid != "" {
+		actions = append(actions, own(userid, "cardIds", stored.ID))
+	}
+	if err := d.write(ctx, actions...); err != nil {
+		return err
+	}
+	*ca = stored
+	return nil
+}
+
+// UpdateCard sets the expiry and holder of the card, the number is never
+// changed
+func (d *DynamoDB) UpdateCard(ctx context.Context, id string, u users.CardUpdate) error {
+	expr := "SET #updatedAt = :at"
+	values := item{":at": timestamp(now())}
+	if u.Expires != nil {
+		expr += ", #expires = :expires"
+		values[":expires"] = str(*u.Expires)
+	}
+	if u.Holder != nil {
+		expr += ", #holder = :holder"
+		values[":holder"] = str(*u.Holder)
+	}
+	return d.write(ctx, update(key("card", id), expr, exists, values, ErrNotFound))
+}
+
+// SetDefaultCard makes the card the default of the user, failing with
+// ErrNotFound unless the card is one of theirs
+func (d *DynamoDB) SetDefaultCard(ctx context.Context, userID, cardID string) error {
+	return d.write(ctx, update(key("user", userID), "SET #defaultCard = :card, #updatedAt = :at ADD #version :one",
+		exists+" AND contains(#cardIds, :card)",
+		item{":card": str(cardID), ":at": timestamp(now()), ":one": num(1)}, ErrNotFound))
+}
+
+// SetCardVerification stores the outcome of verifying a pending card.
+// Cards no longer pending are left alone.
+func (d *DynamoDB) SetCardVerification(ctx context.Context, id, status string) error {
+	err := d.write(ctx, update(key("card", id), "SET #verification = :status, #updatedAt = :at", "#verification = :pending",
+		item{":status": str(status), ":at": timestamp(now()), ":pending": str(users.VerificationPending)}, errChanged))
+	if err == errChanged {
+		return nil
+	}
+	return err
+}
+
+// SetCardReminded records that the owner of the card was reminded of the
+// expiry
+func (d *DynamoDB) SetCardReminded(ctx context.Context, id, expires string) error {
+	return d.write(ctx, update(key("card", id), "SET #remindedFor = :expires", exists,
+		item{":expires": str(expires)}, ErrNotFound))
+}
+
+// TombstoneCard keeps only the masked number of the card, drops its token
+// and takes it off its owner. Cards already deleted fail with ErrNotFound
+func (d *DynamoDB) TombstoneCard(ctx context.Context, id, masked, replacedBy string) error {
+	it, err := d.get(ctx, key("card", id))
+	if err != nil {
+		return err
+	}
+	at := now()
+	expr := "SET #longNum = :masked, #deletedAt = :at, #updatedAt = :at"
+	values := item{":masked": str(masked), ":at": timestamp(at)}
+	if replacedBy != "" {
+		expr += ", #replacedBy = :replacedBy"
+		values[":replacedBy"] = str(replacedBy)
+	}
+	tombstone := update(key("card", id), expr+" REMOVE #token, #owner", exists+" AND attribute_not_exists(#deletedAt)", values, ErrNotFound)
+	owner := it.str("owner")
+	if owner == "" {
+		return d.write(ctx, tombstone)
+	}
+	err = d.modify(ctx, owner, func(u *users.User) ([]action, error) {
+		cs := make([]users.Card, 0, len(u.Cards))
+		for _, ca := range u.Cards {
+			if ca.ID != id {
+				cs = append(cs, ca)
+			}
+		}
+		u.Cards = cs
+		if u.DefaultCard == id {
+			u.DefaultCard = ""
+		}
+		return []action{tombstone}, nil
+	})
+	if err == ErrNotFound {
+		// Cards left behind by their owner are still tombstoned.
+		return d.write(ctx, tombstone)
+	}
+	return err
+}
+
+// GetAddress Gets an address by id
+func (d *DynamoDB) GetAddress(ctx context.Context, id string) (users.Address, error) {
+	it, err := d.get(ctx, key("address", id))
+	if err != nil {
+		return users.Address{}, err
+	}
+	return decodeAddress(it)
+}
+
+// GetAddresses gets all addresses
+func (d *DynamoDB) GetAddresses(ctx context.Context) ([]users.Address, error) {
+	its, err := d.all(ctx, byKind("address", ""))
+	if err != nil {
+		return nil, err
+	}
+	as := make([]users.Address, len(its))
+	for k, it := range its {
+		if as[k], err = decodeAddress(it); err != nil {
+			return nil, err
+		}
+	}
+	return as, nil
+}
+
+// GetAddressesByID gets the addresses with the given ids, unknown ids are
+// left out
+func (d *DynamoDB) GetAddressesByID(ctx context.Context, ids []string) ([]users.Address, error) {
+	found, err := d.addressesByID(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	as := make([]users.Address, 0, len(found))
+	for _, id := range unique(ids) {
+		if a, ok := found[id]; ok {
+			as = append(as, a)
+		}
+	}
+	return as, nil
+}
+
+// clearDefaults takes the default flag off the addresses of the user owner
+// with the types of the default ones in as, but for those in as.
+func (d *DynamoDB) clearDefaults(ctx context.Context, owner string, as []users.Address) ([]action, error) {
+	types := map[string]bool{}
+	keep := map[string]bool{}
+	for _, a := range as {
+		keep[a.ID] = true
+		if a.Default {
+			types[a.Type] = true
+		}
+	}
+	if len(types) == 0 {
+		return nil, nil
+	}
+	u, _, err := d.getUser(ctx, owner)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(u.Addresses))
+	for _, a := range u.Addresses {
+		if !keep[a.ID] {
+			ids = append(ids, a.ID)
+		}
+	}
+	found, err := d.addressesByID(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	var actions []action
+	for id, a := range found {
+		if a.Default && types[a.Type] {
+			actions = append(actions, update(key("address", id), "SET #updatedAt = :at REMOVE #default", exists,
+				item{":at": timestamp(now())}, nil))
+		}
+	}
+	return actions, nil
+}
+
+// CreateAddress stores the address, owned by userid unless it is empty
+func (d *DynamoDB) CreateAddress(ctx context.Context, a *users.Address, userid string) error {
+	as := []users.Address{*a}
+	if err := d.CreateAddresses(ctx, as, userid); err != nil {
+		return err
+	}
+	*a = as[0]
+	return nil
+}
+
+// CreateAddresses stores the addresses and adds them to the user, setting
+// their ids.
+func (d *DynamoDB) CreateAddresses(ctx context.Context, as []users.Address, userid string) error {
+	at := now()
+	stored := make([]users.Address, len(as))
+	ids := make([]string, len(as))
+	actions := make([]action, 0, len(as)+1)
+	for k, a := range as {
+		a.ID, a.CreatedAt, a.UpdatedAt = newID(), at, at
+		stored[k], ids[k] = a, a.ID
+	}
+	// The last default of a type stays the default.
+	for k := range stored {
+		for _, later := range stored[k+1:] {
+			if userid != "" && later.Default && later.Type == stored[k].Type {
+				stored[k].Default = false
+			}
+		}
+		actions = append(actions, put(addressItem(stored[k], userid), "attribute_not_exists(#pk)", nil, nil))
+	}
+	if userid != "" {
+		cleared, err := d.clearDefaults(ctx, userid, stored)
+		if err != nil {
+			return err
+		}
+		actions = append(append(actions, own(userid, "addressIds", ids...)), cleared...)
+	}
+	if err := d.write(ctx, actions...); err != nil {
+		return err
+	}
+	copy(as, stored)
+	return nil
+}
+
+// SetAddressLocation stores the outcome of geocoding a pending address.
+// Addresses no longer pending are left alone.
+func (d *DynamoDB) SetAddressLocation(ctx context.Context, id string, l *users.Location, status string) error {
+	expr := "SET #geocode = :status, #updatedAt = :at"
+	values := item{":status": str(status), ":at": timestamp(now()), ":pending": str(users.GeocodePending)}
+	if l != nil {
+		expr += ", #location = :location"
+		values[":location"] = attr{M: marshal(l)}
+	}
+	err := d.write(ctx, update(key("address", id), expr, "#geocode = :pending", values, errChanged))
+	if err == errChanged {
+		return nil
+	}
+	return err
+}
+
+// UpdateAddress replaces the address with id, keeping when it was created.
+// A default address stops being the default of its type for its owner's
+// other addresses.
+func (d *DynamoDB) UpdateAddress(ctx context.Context, id string, a *users.Address) error {
+	it, err := d.get(ctx, key("address", id))
+	if err != nil {
+		return err
+	}
+	old, err := decodeAddress(it)
+	if err != nil {
+		return err
+	}
+	stored := *a
+	stored.ID = id
+	stored.CreatedAt = old.CreatedAt
+	stored.UpdatedAt = now()
+	owner := it.str("owner")
+	actions := []action{put(addressItem(stored, owner), exists, nil, ErrNotFound)}
+	// Addresses of anonymous users have no owner.
+	if owner != "" {
+		cleared, err := d.clearDefaults(ctx, owner, []users.Address{stored})
+		if err != nil && err != ErrNotFound {
+			return err
+		}
+		actions = append(actions, cleared...)
+	}
+	if err := d.write(ctx, actions...); err != nil {
+		return err
+	}
+	*a = stored
+	return nil
+}
+
+// OwnerOf returns the id of the user owning the address or card id
+func (d *DynamoDB) OwnerOf(ctx context.Context, entity, id string) (string, error) {
+	var kind string
+	switch entity {
+	case "addresses":
+		kind = "address"
+	case "cards":
+		kind = "card"
+	default:
+		return "", fmt.Errorf("no owner of %v", entity)
+	}
+	it, err := d.get(ctx, key(kind, id))
+	if err != nil {
+		return "", err
+	}
+	if it.str("owner") == "" {
+		return "", ErrNotFound
+	}
+	return it.str("owner"), nil
+}
@@ -0,0 +1,617 @@
+// Package dynamodb stores the data of the service in a single DynamoDB
+// table, for serverless AWS deployments. Users, addresses and cards are
+// items keyed user#, address# and card# with their id; the username and
+// email indexes look users up, and claim items under username# and email#
+// written in the same transactions keep both unique.
+package dynamodb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"user/db"
+	"user/sigv4"
+)
+
+var (
+	table    string
+	endpoint string
+	region   string
+	timeout  time.Duration
+	//ErrNotFound is returned when no stored item matches, like mgo.ErrNotFound and sql.ErrNoRows
+	ErrNotFound = errors.New("not found")
+	// errChanged fails writes conditioned on the version of an item read
+	// before, when another write came in between.
+	errChanged = errors.New("dynamodb: item changed while writing")
+)
+
+func init() {
+	flag.StringVar(&table, "dynamodb-table", os.Getenv("DYNAMODB_TABLE"), "DynamoDB table, created if missing (default users)")
+	flag.StringVar(&endpoint, "dynamodb-endpoint", os.Getenv("DYNAMODB_ENDPOINT"), "DynamoDB endpoint, e.g. http://localhost:8000 for DynamoDB Local")
+	flag.StringVar(&region, "dynamodb-region", os.Getenv("AWS_REGION"), "Region of the DynamoDB table")
+	flag.DurationVar(&timeout, "dynamodb-timeout", 10*time.Second, "How long a DynamoDB request may take")
+}
+
+// Indexes of the table. Kind holds the users, addresses, cards, groups,
+// webhooks and aliases in id order per kind; username and email hold users
+// by their normalized username and by their email.
+const (
+	kindIndex     = "kind"
+	usernameIndex = "username"
+	emailIndex    = "email"
+)
+
+// maxTransaction is the most items a DynamoDB transaction writes.
+const maxTransaction = 100
+
+// DynamoDB meets the Database interface requirements. Credentials come from
+// the standard AWS environment variables.
+type DynamoDB struct {
+	// Table is the name of the table, the -dynamodb-table flag when empty
+	// and users without one.
+	Table string
+	// Endpoint is the URL of the DynamoDB API, the -dynamodb-endpoint flag
+	// or the regional endpoint when empty.
+	Endpoint string
+	Region   string
+	Creds    sigv4.Credentials
+	Client   *http.Client
+
+	mu      sync.Mutex
+	tenants map[string]*DynamoDB
+}
+
+// Init creates the table and its indexes unless they exist, and waits for
+// them to become active.
+func (d *DynamoDB) Init() error {
+	if d.Table == "" {
+		d.Table = table
+	}
+	if d.Table == "" {
+		d.Table = "users"
+	}
+	if d.Region == "" {
+		d.Region = region
+	}
+	if d.Endpoint == "" {
+		d.Endpoint = endpoint
+	}
+	if d.Endpoint == "" {
+		if d.Region == "" {
+			return errors.New("no DynamoDB region")
+		}
+		d.Endpoint = fmt.Sprintf("https://dynamodb.%v.amazonaws.com", d.Region)
+	}
+	if d.Creds.AccessKey == "" {
+		d.Creds = sigv4.Credentials{
+			AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		}
+	}
+	if d.Client == nil {
+		d.Client = &http.Client{Timeout: timeout}
+	}
+	return d.createTable(context.Background())
+}
+
+type tableDescription struct {
+	Table struct {
+		TableStatus            string
+		GlobalSecondaryIndexes []struct {
+			IndexStatus string
+		}
+	}
+}
+
+func (d *DynamoDB) describe(ctx context.Context) (tableDescription, error) {
+	var out tableDescription
+	err := d.do(ctx, "DescribeTable", map[string]string{"TableName": d.Table}, &out)
+	return out, err
+}
+
+func (d *DynamoDB) createTable(ctx context.Context) error {
+	_, err := d.describe(ctx)
+	var e *Error
+	if errors.As(err, &e) && e.Code() == "ResourceNotFoundException" {
+		err = d.do(ctx, "CreateTable", tableDefinition(d.Table), nil)
+		if errors.As(err, &e) && e.Code() == "ResourceInUseException" {
+			err = nil
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if err := d.waitActive(ctx); err != nil {
+		return err
+	}
+	// Idempotency keys and webhook deliveries expire.
+	err = d.do(ctx, "UpdateTimeToLive", map[string]interface{}{
+		"TableName":               d.Table,
+		"TimeToLiveSpecification": map[string]interface{}{"Enabled": true, "AttributeName": "expires"},
+	}, nil)
+	if errors.As(err, &e) && e.Code() == "ValidationException" && strings.Contains(e.Message, "already enabled") {
+		return nil
+	}
+	return err
+}
+
+// waitActive waits for the table and its indexes to be created.
+func (d *DynamoDB) waitActive(ctx context.Context) error {
+	for deadline := time.Now().Add(5 * time.Minute); ; time.Sleep(2 * time.Second) {
+		out, err := d.describe(ctx)
+		if err != nil {
+			return err
+		}
+		active := out.Table.TableStatus == "ACTIVE"
+		for _, i := range out.Table.GlobalSecondaryIndexes {
+			active = active && i.IndexStatus == "ACTIVE"
+		}
+		if active {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("dynamodb: table %v not active", d.Table)
+		}
+	}
+}
+
+// tableDefinition is the CreateTable request of the table name.
+func tableDefinition(name string) map[string]interface{} {
+	attribute := func(name string) map[string]string {
+		return map[string]string{"AttributeName": name, "AttributeType": "S"}
+	}
+	keys := func(hash, rng string) []map[string]string {
+		ks := []map[string]string{{"AttributeName": hash, "KeyType": "HASH"}}
+		if rng != "" {
+			ks = append(ks, map[string]string{"AttributeName": rng, "KeyType": "RANGE"})
+		}
+		return ks
+	}
+	index := func(name, hash, rng, projection string) map[string]interface{} {
+		return map[string]interface{}{
+			"IndexName":  name,
+			"KeySchema":  keys(hash, rng),
+			"Projection": map[string]string{"ProjectionType": projection},
+		}
+	}
+	return map[string]interface{}{
+		"TableName":   name,
+		"BillingMode": "PAY_PER_REQUEST",
+		"AttributeDefinitions": []map[string]string{
+			attribute("pk"), attribute("sk"), attribute("kind"), attribute("usernameKey"), attribute("email"),
+		},
+		"KeySchema": keys("pk", "sk"),
+		"GlobalSecondaryIndexes": []map[string]interface{}{
+			index(kindIndex, "kind", "sk", "ALL"),
+			index(usernameIndex, "usernameKey", "", "KEYS_ONLY"),
+			index(emailIndex, "email", "", "KEYS_ONLY"),
+		},
+	}
+}
+
+// Tenant returns the database of a tenant. Each tenant has a table of its
+// own named after the configured one, created on first use.
+func (d *DynamoDB) Tenant(id string) (db.Database, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if t, ok := d.tenants[id]; ok {
+		return t, nil
+	}
+	t := &DynamoDB{Table: d.Table + "-" + id, Endpoint: d.Endpoint, Region: d.Region, Creds: d.Creds, Client: d.Client}
+	if err := t.Init(); err != nil {
+		return nil, err
+	}
+	if d.tenants == nil {
+		d.tenants = make(map[string]*DynamoDB)
+	}
+	d.tenants[id] = t
+	return t, nil
+}
+
+// Ping checks the table can be described.
+func (d *DynamoDB) Ping(ctx context.Context) error {
+	_, err := d.describe(ctx)
+	return err
+}
+
+// Error is an error response of DynamoDB.
+type Error struct {
+	Type    string `json:"__type"`
+	Message string `json:"message"`
+	// CancellationReasons explain canceled transactions, one per item.
+	CancellationReasons []struct {
+		Code string
+	}
+	Status int `json:"-"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("dynamodb: %v: %v", e.Code(), e.Message)
+}
+
+// Code is the error type without its namespace, like
+// ConditionalCheckFailedException.
+func (e *Error) Code() string {
+	return e.Type[strings.LastIndex(e.Type, "#")+1:]
+}
+
+// do calls the operation op of the DynamoDB API with in, decoding the
+// response into out unless it is nil. The request is canceled when ctx is
+// done.
+func (d *DynamoDB) do(ctx context.Context, op string, in, out interface{}) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", d.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.0")
+	req.Header.Set("X-Amz-Target", "DynamoDB_20120810."+op)
+	sigv4.Sign(req, body, d.Creds, d.Region, "dynamodb", time.Now())
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		e := &Error{Status: resp.StatusCode}
+		if err := json.NewDecoder(resp.Body).Decode(e); err != nil || e.Type == "" {
+			return fmt.Errorf("dynamodb: %v returned %v", op, resp.Status)
+		}
+		return e
+	}
+	if out == nil {
+		_, err := io.Copy(io.Discard, resp.Body)
+		return err
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// key is the key of the item of kind with id.
+func key(kind, id string) item {
+	return item{"pk": str(kind + "#" + id), "sk": str(id)}
+}
+
+// keyed adds the key k to it.
+func keyed(it, k item) item {
+	for name, v := range k {
+		it[name] = v
+	}
+	return it
+}
+
+// withKey adds the key of the item of kind with id to it, and the kind for
+// the kind index.
+func withKey(it item, kind, id string) item {
+	it["kind"] = str(kind)
+	return keyed(it, key(kind, id))
+}
+
+// get reads the item with k, failing with ErrNotFound when there is none.
+func (d *DynamoDB) get(ctx context.Context, k item) (item, error) {
+	var out struct {
+		Item item
+	}
+	if err := d.do(ctx, "GetItem", map[string]interface{}{"TableName": d.Table, "Key": k, "ConsistentRead": consistent(ctx)}, &out); err != nil {
+		return nil, err
+	}
+	if out.Item == nil {
+		return nil, ErrNotFound
+	}
+	return out.Item, nil
+}
+
+// consistent reports whether reads with ctx have to see every write
+// before them. Reads preferring replicas are eventually consistent, which
+// costs half.
+func consistent(ctx context.Context) bool {
+	return db.ReadPreferenceFrom(ctx) == db.Primary
+}
+
+// batchGet reads the items of kind with ids, by id. Missing items are left
+// out.
+func (d *DynamoDB) batchGet(ctx context.Context, kind string, ids []string) (map[string]item, error) {
+	found := make(map[string]item, len(ids))
+	keys := make([]item, 0, len(ids))
+	for _, id := range unique(ids) {
+		keys = append(keys, key(kind, id))
+	}
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > 100 {
+			n = 100
+		}
+		var out struct {
+			Responses       map[string][]item
+			UnprocessedKeys map[string]struct {
+				Keys []item
+			}
+		}
+		in := map[string]interface{}{
+			"RequestItems": map[string]interface{}{d.Table: map[string]interface{}{"Keys": keys[:n], "ConsistentRead": consistent(ctx)}},
+		}
+		if err := d.do(ctx, "BatchGetItem", in, &out); err != nil {
+			return nil, err
+		}
+		for _, it := range out.Responses[d.Table] {
+			found[it.str("sk")] = it
+		}
+		// Keys left unprocessed under load are read again.
+		keys = append(out.UnprocessedKeys[d.Table].Keys, keys[n:]...)
+	}
+	return found, nil
+}
+
+// query pages through the items matching q, calling f with each until it
+// returns false.
+func (d *DynamoDB) query(ctx context.Context, q query, f func(item) (bool, error)) error {
+	q.TableName = d.Table
+	q.ConsistentRead = q.ConsistentRead && consistent(ctx)
+	q.ExpressionAttributeNames = names(q.KeyConditionExpression)
+	for {
+		var out struct {
+			Items            []item
+			LastEvaluatedKey item
+		}
+		if err := d.do(ctx, "Query", q, &out); err != nil {
+			return err
+		}
+		for _, it := range out.Items {
+			more, err := f(it)
+			if err != nil || !more {
+				return err
+			}
+		}
+		if out.LastEvaluatedKey == nil {
+			return nil
+		}
+		q.ExclusiveStartKey = out.LastEvaluatedKey
+	}
+}
+
+// query is a Query request.
+type query struct {
+	TableName                 string
+	IndexName                 string `json:",omitempty"`
+	KeyConditionExpression    string
+	ExpressionAttributeNames  map[string]string `json:",omitempty"`
+	ExpressionAttributeValues item              `json:",omitempty"`
+	ScanIndexForward          bool
+	ConsistentRead            bool `json:",omitempty"`
+	ExclusiveStartKey         item `json:",omitempty"`
+}
+
+// byKind queries the kind index for the items of kind with ids after the
+// given one, in id order.
+func byKind(kind, after string) query {
+	return query{
+		IndexName:                 kindIndex,
+		KeyConditionExpression:    "#kind = :kind AND #sk > :after",
+		ExpressionAttributeValues: item{":kind": str(kind), ":after": str(after)},
+		ScanIndexForward:          true,
+	}
+}
+
+// partition queries the items of the partition pk with ids before the
+// given one, newest first, all for an empty before.
+func partition(pk, before string) query {
+	q := query{
+		KeyConditionExpression:    "#pk = :pk",
+		ExpressionAttributeValues: item{":pk": str(pk)},
+		ConsistentRead:            true,
+	}
+	if before != "" {
+		q.KeyConditionExpression += " AND #sk < :before"
+		q.ExpressionAttributeValues[":before"] = str(before)
+	}
+	return q
+}
+
+// all collects the items of q.
+func (d *DynamoDB) all(ctx context.Context, q query) ([]item, error) {
+	its := make([]item, 0)
+	err := d.query(ctx, q, func(it item) (bool, error) {
+		its = append(its, it)
+		return true, nil
+	})
+	return its, err
+}
+
+// count counts the items of kind.
+func (d *DynamoDB) count(ctx context.Context, kind string) (int, error) {
+	q := byKind(kind, "")
+	in := struct {
+		query
+		Select string
+	}{q, "COUNT"}
+	in.TableName = d.Table
+	in.ExpressionAttributeNames = names(q.KeyConditionExpression)
+	n := 0
+	for {
+		var out struct {
+			Count            int
+			LastEvaluatedKey item
+		}
+		if err := d.do(ctx, "Query", in, &out); err != nil {
+			return 0, err
+		}
+		n += out.Count
+		if out.LastEvaluatedKey == nil {
+			return n, nil
+		}
+		in.ExclusiveStartKey = out.LastEvaluatedKey
+	}
+}
+
+var nameRE = regexp.MustCompile(`#\w+`)
+
+// names maps the #names of the expressions to the attributes, so no
+// attribute name collides with the reserved words of DynamoDB.
+func names(exprs ...string) map[string]string {
+	ns := map[string]string{}
+	for _, e := range exprs {
+		for _, n := range nameRE.FindAllString(e, -1) {
+			ns[n] = n[1:]
+		}
+	}
+	if len(ns) == 0 {
+		return nil
+	}
+	return ns
+}
+
+// action is a write of one item, alone or in a transaction.
+type action struct {
+	// kind is Put, Update, Delete or ConditionCheck.
+	kind string
+	op   op
+	// fail is returned when the condition of the action fails.
+	fail error
+}
+
+// op are the parameters of a write.
+type op struct {
+	TableName                 string
+	Key                       item              `json:",omitempty"`
+	Item                      item              `json:",omitempty"`
+	UpdateExpression          string            `json:",omitempty"`
+	ConditionExpression       string            `json:",omitempty"`
+	ExpressionAttributeNames  map[string]string `json:",omitempty"`
+	ExpressionAttributeValues item              `json:",omitempty"`
+}
+
+// put writes it when cond holds.
+func put(it item, cond string, values item, fail error) action {
+	return action{kind: "Put", op: op{Item: it, ConditionExpression: cond, ExpressionAttributeValues: values}, fail: fail}
+}
+
+// update runs the update expression on the item with k when cond holds.
+func update(k item, expr, cond string, values item, fail error) action {
+	return action{kind: "Update", op: op{Key: k, UpdateExpression: expr, ConditionExpression: cond, ExpressionAttributeValues: values}, fail: fail}
+}
+
+// remove deletes the item with k when cond holds.
+func remove(k item, cond string, values item, fail error) action {
+	return action{kind: "Delete", op: op{Key: k, ConditionExpression: cond, ExpressionAttributeValues: values}, fail: fail}
+}
+
+// exists is the condition of writes to stored items.
+const exists = "attribute_exists(#pk)"
+
+// write runs the actions, in a transaction when there are several. The
+// first action whose condition failed returns its fail error.
+func (d *DynamoDB) write(ctx context.Context, actions ...action) error {
+	if len(actions) > maxTransaction {
+		return fmt.Errorf("dynamodb: %v writes exceed a transaction", len(actions))
+	}
+	for k := range actions {
+		o := &actions[k].op
+		o.TableName = d.Table
+		o.ExpressionAttributeNames = names(o.UpdateExpression, o.ConditionExpression)
+		if len(o.ExpressionAttributeValues) == 0 {
+			o.ExpressionAttributeValues = nil
+		}
+	}
+	if len(actions) == 1 {
+		err := d.do(ctx, actions[0].kind+"Item", actions[0].op, nil)
+		var e *Error
+		if errors.As(err, &e) && e.Code() == "ConditionalCheckFailedException" && actions[0].fail != nil {
+			return actions[0].fail
+		}
+		return err
+	}
+	items := make([]map[string]op, len(actions))
+	for k, a := range actions {
+		items[k] = map[string]op{a.kind: a.op}
+	}
+	for attempt := 0; ; attempt++ {
+		err := d.do(ctx, "TransactWriteItems", map[string]interface{}{"TransactItems": items}, nil)
+		var e *Error
+		if !errors.As(err, &e) || e.Code() != "TransactionCanceledException" {
+			return err
+		}
+		conflict := false
+		for k, r := range e.CancellationReasons {
+			switch r.Code {
+			case "ConditionalCheckFailed":
+				if k < len(actions) && actions[k].fail != nil {
+					return actions[k].fail
+				}
+				return err
+			case "TransactionConflict":
+				conflict = true
+			}
+		}
+		// Transactions on the same items at once are canceled, one runs
+		// again once the other is through.
+		if !conflict || attempt == 5 {
+			return err
+		}
+		time.Sleep(time.Duration(attempt+1) * 20 * time.Millisecond)
+	}
+}
+
+// retry runs f again while the items it read changed before it wrote them.
+func retry(f func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := f()
+		if err != errChanged || attempt == 10 {
+			return err
+		}
+	}
+}
+
+// now is the current time at the precision the service stores.
+func now() time.Time {
+	return time.Now().UTC().Truncate(time.Millisecond)
+}
+
+// newID returns ids like those of the other databases, sorting in the order
+// they were created.
+func newID() string {
+	return db.NewID()
+}
+
+func contains(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func without(ss []string, s string) []string {
+	kept := make([]string, 0, len(ss))
+	for _, v := range ss {
+		if v != s {
+			kept = append(kept, v)
+		}
+	}
+	return kept
+}
+
+// unique returns the ids without repeats, in their first order.
+func unique(ids []string) []string {
+	u := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if !contains(u, id) {
+			u = append(u, id)
+		}
+	}
+	return u
+}
@@ -0,0 +1,254 @@
+package dynamodb
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"user/db"
+	"user/users"
+)
+
+var (
+	_ db.Database = &DynamoDB{}
+	_ db.Tenanted = &DynamoDB{}
+)
+
+func TestMarshal(t *testing.T) {
+	deleted := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	c := users.Card{LongNum: "4111111111111111", DeletedAt: &deleted}
+	var got users.Card
+	if err := unmarshal(marshal(&c), &got); err != nil || !reflect.DeepEqual(got, c) {
+		t.Errorf("expected %+v, got %+v %v", c, got, err)
+	}
+	a := users.Address{Street: "street", Location: &users.Location{Lat: 1.5, Lng: -2}, Default: true}
+	var gotA users.Address
+	if err := unmarshal(marshal(&a), &gotA); err != nil || !reflect.DeepEqual(gotA, a) {
+		t.Errorf("expected %+v, got %+v %v", a, gotA, err)
+	}
+	if _, ok := marshal(&users.Address{})["default"]; ok {
+		t.Error("expected zero values left out")
+	}
+}
+
+func TestNames(t *testing.T) {
+	got := names("#a = :a AND attribute_exists(#pk)", "SET #a = :b")
+	if !reflect.DeepEqual(got, map[string]string{"#a": "a", "#pk": "pk"}) {
+		t.Errorf("unexpected names %v", got)
+	}
+}
+
+func TestDo(t *testing.T) {
+	ctx := context.Background()
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if target := r.Header.Get("X-Amz-Target"); target != "DynamoDB_20120810.GetItem" {
+			t.Errorf("unexpected target %v", target)
+		}
+		if auth := r.Header.Get("Authorization"); !strings.Contains(auth, "/eu-west-1/dynamodb/aws4_request") {
+			t.Errorf("expected a request signed for dynamodb, got %v", auth)
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"__type":"com.amazonaws.dynamodb.v20120810#ResourceNotFoundException","message":"no table"}`))
+	}))
+	defer s.Close()
+	d := &DynamoDB{Table: "users", Endpoint: s.URL, Region: "eu-west-1", Client: s.Client()}
+	d.Creds.AccessKey = "AKID"
+	_, err := d.get(ctx, key("user", "1"))
+	var e *Error
+	if !errors.As(err, &e) || e.Code() != "ResourceNotFoundException" || e.Status != http.StatusBadRequest {
+		t.Errorf("expected the DynamoDB error, got %v", err)
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := d.get(canceled, key("user", "1")); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the request canceled, got %v", err)
+	}
+}
+
+func TestDynamoDB(t *testing.T) {
+	ctx := context.Background()
+	d := newFake(t)
+	u := users.User{Username: "Eve", Email: "eve@example.com", Tags: []string{"vip"},
+		Addresses: []users.Address{{Street: "street", Type: users.AddressBilling, Default: true}},
+		Cards:     []users.Card{{LongNum: "4111111111111111", Expires: "01/30"}}}
+	if err := d.CreateUser(ctx, &u); err != nil {
+		t.Fatal(err)
+	}
+	got, err := d.GetUserByName(ctx, "eve")
+	if err != nil || got.UserID != u.UserID || len(got.Addresses) != 1 || len(got.Cards) != 1 || got.Tags[0] != "vip" {
+		t.Fatalf("expected the created user, got %+v %v", got, err)
+	}
+	if err := d.GetUserAttributes(ctx, &got); err != nil || got.Addresses[0].Street != "street" {
+		t.Errorf("expected the addresses, got %+v %v", got.Addresses, err)
+	}
+	dup := users.User{Username: "EVE"}
+	var conflict *db.ConflictError
+	if err := d.CreateUser(ctx, &dup); !errors.As(err, &conflict) || conflict.Field != "username" {
+		t.Errorf("expected a username conflict, got %v", err)
+	}
+	dup = users.User{Username: "other", Email: "eve@example.com"}
+	if err := d.CreateUser(ctx, &dup); !errors.As(err, &conflict) || conflict.Field != "email" {
+		t.Errorf("expected an email conflict, got %v", err)
+	}
+	if n, err := d.count(ctx, "user"); err != nil || n != 1 {
+		t.Errorf("expected only the first user, got %v %v", n, err)
+	}
+
+	if err := d.RenameUser(ctx, u.UserID, "eve2"); err != nil {
+		t.Fatal(err)
+	}
+	if prev, err := d.GetUserByPreviousName(ctx, "Eve", time.Now().Add(-time.Minute)); err != nil || prev.UserID != u.UserID {
+		t.Errorf("expected the renamed user, got %+v %v", prev, err)
+	}
+	taken := users.User{Username: "eve"}
+	if err := d.CreateUser(ctx, &taken); err != nil {
+		t.Errorf("expected the old username released, got %v", err)
+	}
+	v := "1"
+	if err := d.UpdateUser(ctx, u.UserID, users.ProfileUpdate{Metadata: map[string]*string{"crm": &v}}); err != nil {
+		t.Fatal(err)
+	}
+	if us, err := d.GetUsers(ctx, db.UserQuery{Metadata: map[string]string{"crm": "1"}, Tag: "vip"}); err != nil || len(us) != 1 {
+		t.Errorf("expected the user by metadata and tag, got %v %v", us, err)
+	}
+	if us, err := d.GetUsers(ctx, db.UserQuery{Email: "eve@example.com"}); err != nil || len(us) != 1 {
+		t.Errorf("expected the user by email, got %v %v", us, err)
+	}
+
+	g := users.Group{Name: "team", Owners: []string{taken.UserID}}
+	if err := d.CreateGroup(ctx, &g); err != nil {
+		t.Fatal(err)
+	}
+	other := users.User{Username: "mallory", Tags: []string{"new"}}
+	if err := d.CreateUser(ctx, &other); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.AddGroupMember(ctx, g.ID, other.UserID); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.MergeUsers(ctx, u.UserID, other.UserID, users.ProfileUpdate{}); err != nil {
+		t.Fatal(err)
+	}
+	if target, err := d.ResolveAlias(ctx, other.UserID); err != nil || target != u.UserID {
+		t.Errorf("expected an alias of the merged user, got %v %v", target, err)
+	}
+	if g, err := d.GetGroup(ctx, g.ID); err != nil || !reflect.DeepEqual(g.Members, []string{u.UserID}) {
+		t.Errorf("expected the merged user in the group, got %v %v", g.Members, err)
+	}
+	if merged, err := d.GetUser(ctx, u.UserID); err != nil || len(merged.Tags) != 2 {
+		t.Errorf("expected the tags of both users, got %v %v", merged.Tags, err)
+	}
+
+	if err := d.TombstoneCard(ctx, u.Cards[0].ID, "************1111", ""); err != nil {
+		t.Fatal(err)
+	}
+	if cs, err := d.GetCardsByID(ctx, []string{u.Cards[0].ID}); err != nil || len(cs) != 0 {
+		t.Errorf("expected the deleted card left out, got %v %v", cs, err)
+	}
+	res, err := d.DeleteUsers(ctx, []string{u.UserID, "missing"})
+	if err != nil || res[u.UserID] != nil || res["missing"] == nil {
+		t.Errorf("unexpected deletions %v %v", res, err)
+	}
+	if _, err := d.GetUser(ctx, u.UserID); err == nil {
+		t.Error("expected the deleted user gone")
+	}
+	if _, err := d.GetAddress(ctx, u.Addresses[0].ID); err != ErrNotFound {
+		t.Errorf("expected the addresses deleted, got %v", err)
+	}
+}
+
+// TestList checks listings page through the kind index.
+func TestList(t *testing.T) {
+	ctx := context.Background()
+	d := newFake(t)
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		u := users.User{Username: name}
+		if err := d.CreateUser(ctx, &u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	us, err := d.GetUsers(ctx, db.UserQuery{})
+	if err != nil || len(us) != 5 {
+		t.Fatalf("expected all users, got %v %v", len(us), err)
+	}
+	if n, err := d.count(ctx, "user"); err != nil || n != 5 {
+		t.Errorf("expected 5 users, got %v %v", n, err)
+	}
+	for k := 0; k < 5; k++ {
+		if err := d.AddActivity(ctx, &users.Activity{UserID: us[0].UserID, Type: "login"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if as, err := d.GetActivity(ctx, us[0].UserID, "", 3); err != nil || len(as) != 3 {
+		t.Errorf("expected 3 activities, got %v %v", len(as), err)
+	}
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	ctx := context.Background()
+	d := newFake(t)
+	k := db.IdempotencyKey{Key: "k", Fingerprint: "f"}
+	if err := d.CreateIdempotencyKey(ctx, &k); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.CreateIdempotencyKey(ctx, &k); err != db.ErrConflict {
+		t.Errorf("expected a conflict, got %v", err)
+	}
+	old := keyed(marshal(&k), idempotencyKey("old"))
+	old["expires"] = num(time.Now().Add(-time.Hour).Unix())
+	if err := d.write(ctx, put(old, "", nil, nil)); err != nil {
+		t.Fatal(err)
+	}
+	k.Key = "old"
+	if err := d.CreateIdempotencyKey(ctx, &k); err != nil {
+		t.Errorf("expected the expired key taken over, got %v", err)
+	}
+}
+
+func TestTenant(t *testing.T) {
+	ctx := context.Background()
+	d := newFake(t)
+	u := users.User{Username: "eve"}
+	if err := d.CreateUser(ctx, &u); err != nil {
+		t.Fatal(err)
+	}
+	tenant, err := d.Tenant("acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tenant.(*DynamoDB).Table != "users-acme" {
+		t.Errorf("unexpected table %v", tenant.(*DynamoDB).Table)
+	}
+	if _, err := tenant.GetUserByName(ctx, "eve"); err == nil {
+		t.Error("expected the tenant not to see the user of another")
+	}
+}
+
+// TestEndpoint runs against a real endpoint, like DynamoDB Local, when
+// DYNAMODB_TEST_ENDPOINT is set.
+func TestEndpoint(t *testing.T) {
+	ctx := context.Background()
+	endpoint := os.Getenv("DYNAMODB_TEST_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("DYNAMODB_TEST_ENDPOINT not set")
+	}
+	d := &DynamoDB{Table: "users-test-" + newID(), Endpoint: endpoint, Region: "us-east-1"}
+	d.Creds.AccessKey, d.Creds.SecretKey = "local", "local"
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	u := users.User{Username: "eve", Email: "eve@example.com"}
+	if err := d.CreateUser(ctx, &u); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := d.GetUserByName(ctx, "EVE"); err != nil || got.UserID != u.UserID {
+		t.Errorf("expected the created user, got %+v %v", got, err)
+	}
+}
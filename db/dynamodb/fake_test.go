@@ -0,0 +1,388 @@
+package dynamodb
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fake serves the part of the DynamoDB API the package uses, from memory.
+// Queries return pages of two items so paging is exercised.
+type fake struct {
+	mu      sync.Mutex
+	tables  map[string]map[string]item
+	indexes map[string]map[string][2]string
+}
+
+// newFake returns a DynamoDB on a fake server.
+func newFake(t *testing.T) *DynamoDB {
+	f := &fake{tables: map[string]map[string]item{}, indexes: map[string]map[string][2]string{}}
+	s := httptest.NewServer(f)
+	t.Cleanup(s.Close)
+	d := &DynamoDB{Table: "users", Endpoint: s.URL, Region: "eu-west-1"}
+	d.Creds.AccessKey = "AKID"
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+type fakeError struct {
+	code    string
+	reasons []string
+}
+
+func (e *fakeError) Error() string {
+	return e.code
+}
+
+func (f *fake) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var in map[string]json.RawMessage
+	json.NewDecoder(r.Body).Decode(&in)
+	target := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "DynamoDB_20120810.")
+	out, err := f.call(target, in)
+	if err != nil {
+		e := err.(*fakeError)
+		resp := map[string]interface{}{"__type": "com.amazonaws.dynamodb.v20120810#" + e.code, "message": e.code}
+		if e.reasons != nil {
+			rs := make([]map[string]string, len(e.reasons))
+			for k, code := range e.reasons {
+				rs[k] = map[string]string{"Code": code}
+			}
+			resp["CancellationReasons"] = rs
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+	json.NewEncoder(w).Encode(out)
+}
+
+func field(in map[string]json.RawMessage, name string, v interface{}) {
+	if raw, ok := in[name]; ok {
+		json.Unmarshal(raw, v)
+	}
+}
+
+func (f *fake) call(target string, in map[string]json.RawMessage) (interface{}, error) {
+	var table string
+	field(in, "TableName", &table)
+	switch target {
+	case "DescribeTable":
+		if _, ok := f.tables[table]; !ok {
+			return nil, &fakeError{code: "ResourceNotFoundException"}
+		}
+		return map[string]interface{}{"Table": map[string]string{"TableStatus": "ACTIVE"}}, nil
+	case "CreateTable":
+		var indexes []struct {
+			IndexName string
+			KeySchema []struct{ AttributeName string }
+		}
+		field(in, "GlobalSecondaryIndexes", &indexes)
+		f.tables[table] = map[string]item{}
+		f.indexes[table] = map[string][2]string{}
+		for _, i := range indexes {
+			var ks [2]string
+			for k, s := range i.KeySchema {
+				ks[k] = s.AttributeName
+			}
+			f.indexes[table][i.IndexName] = ks
+		}
+		return struct{}{}, nil
+	case "UpdateTimeToLive":
+		return struct{}{}, nil
+	case "GetItem":
+		var k item
+		field(in, "Key", &k)
+		if it, ok := f.tables[table][id(k)]; ok {
+			return map[string]item{"Item": it}, nil
+		}
+		return struct{}{}, nil
+	case "BatchGetItem":
+		var req map[string]struct{ Keys []item }
+		field(in, "RequestItems", &req)
+		res := map[string][]item{}
+		for t, r := range req {
+			res[t] = []item{}
+			for _, k := range r.Keys {
+				if it, ok := f.tables[t][id(k)]; ok {
+					res[t] = append(res[t], it)
+				}
+			}
+		}
+		return map[string]interface{}{"Responses": res}, nil
+	case "PutItem", "UpdateItem", "DeleteItem":
+		var o op
+		for name, raw := range in {
+			field(map[string]json.RawMessage{name: raw}, name, map[string]interface{}{
+				"Key": &o.Key, "Item": &o.Item, "UpdateExpression": &o.UpdateExpression,
+				"ConditionExpression": &o.ConditionExpression, "ExpressionAttributeNames": &o.ExpressionAttributeNames,
+				"ExpressionAttributeValues": &o.ExpressionAttributeValues,
+			}[name])
+		}
+		o.TableName = table
+		a := action{kind: strings.TrimSuffix(target, "Item"), op: o}
+		if !f.check(a) {
+			return nil, &fakeError{code: "ConditionalCheckFailedException"}
+		}
+		f.apply(a)
+		return struct{}{}, nil
+	case "TransactWriteItems":
+		var items []map[string]op
+		field(in, "TransactItems", &items)
+		actions := make([]action, len(items))
+		reasons := make([]string, len(items))
+		failed := false
+		for k, ti := range items {
+			for kind, o := range ti {
+				actions[k] = action{kind: kind, op: o}
+			}
+			reasons[k] = "None"
+			if !f.check(actions[k]) {
+				reasons[k], failed = "ConditionalCheckFailed", true
+			}
+		}
+		if failed {
+			return nil, &fakeError{code: "TransactionCanceledException", reasons: reasons}
+		}
+		for _, a := range actions {
+			f.apply(a)
+		}
+		return struct{}{}, nil
+	case "Query":
+		return f.query(table, in)
+	}
+	return nil, &fakeError{code: "UnknownOperationException"}
+}
+
+// id is the primary key of the item with k in the table.
+func id(k item) string {
+	return k.str("pk") + "\x00" + k.str("sk")
+}
+
+func keyOf(a action) item {
+	if a.op.Item != nil {
+		return a.op.Item
+	}
+	return a.op.Key
+}
+
+func (f *fake) check(a action) bool {
+	it := f.tables[a.op.TableName][id(keyOf(a))]
+	return a.op.ConditionExpression == "" || eval(a.op.ConditionExpression, it, a.op)
+}
+
+func (f *fake) apply(a action) {
+	t := f.tables[a.op.TableName]
+	k := id(keyOf(a))
+	switch a.kind {
+	case "Put":
+		t[k] = a.op.Item
+	case "Delete":
+		delete(t, k)
+	case "Update":
+		it, ok := t[k]
+		if !ok {
+			it = item{"pk": a.op.Key["pk"], "sk": a.op.Key["sk"]}
+		}
+		applyUpdate(a.op.UpdateExpression, it, a.op)
+		t[k] = it
+	}
+}
+
+// eval evaluates the conditions the package writes: comparisons,
+// attribute_exists, attribute_not_exists and contains joined by AND and OR.
+func eval(cond string, it item, o op) bool {
+	for _, or := range strings.Split(cond, " OR ") {
+		all := true
+		for _, term := range strings.Split(or, " AND ") {
+			all = all && evalTerm(strings.TrimSpace(term), it, o)
+		}
+		if all {
+			return true
+		}
+	}
+	return false
+}
+
+func evalTerm(term string, it item, o op) bool {
+	name := func(s string) string { return o.ExpressionAttributeNames[strings.TrimSpace(s)] }
+	args := func(fn string) []string {
+		return strings.Split(strings.TrimSuffix(strings.TrimPrefix(term, fn+"("), ")"), ",")
+	}
+	switch {
+	case strings.HasPrefix(term, "attribute_exists("):
+		_, ok := it[name(args("attribute_exists")[0])]
+		return ok
+	case strings.HasPrefix(term, "attribute_not_exists("):
+		_, ok := it[name(args("attribute_not_exists")[0])]
+		return !ok
+	case strings.HasPrefix(term, "contains("):
+		as := args("contains")
+		v := o.ExpressionAttributeValues[strings.TrimSpace(as[1])]
+		for _, s := range it[name(as[0])].SS {
+			if s == *v.S {
+				return true
+			}
+		}
+		return false
+	}
+	parts := strings.Fields(term)
+	a, ok := it[name(parts[0])]
+	if !ok {
+		return false
+	}
+	return compare(a, parts[1], o.ExpressionAttributeValues[parts[2]])
+}
+
+func compare(a attr, operator string, b attr) bool {
+	var c int
+	switch {
+	case a.S != nil && b.S != nil:
+		c = strings.Compare(*a.S, *b.S)
+	case a.N != nil && b.N != nil:
+		x, _ := strconv.ParseFloat(*a.N, 64)
+		y, _ := strconv.ParseFloat(*b.N, 64)
+		c = map[bool]int{true: -1, false: 1}[x < y]
+		if x == y {
+			c = 0
+		}
+	default:
+		return false
+	}
+	switch operator {
+	case "=":
+		return c == 0
+	case "<":
+		return c < 0
+	case ">":
+		return c > 0
+	}
+	panic("fake: no operator " + operator)
+}
+
+// applyUpdate runs the SET, REMOVE, ADD and DELETE clauses of expr on it.
+func applyUpdate(expr string, it item, o op) {
+	clause := ""
+	for _, tok := range strings.Fields(strings.ReplaceAll(expr, ",", " ")) {
+		switch tok {
+		case "SET", "REMOVE", "ADD", "DELETE":
+			clause = tok
+			continue
+		}
+		if tok == "=" {
+			continue
+		}
+		if strings.HasPrefix(tok, "#") {
+			if clause == "REMOVE" {
+				delete(it, o.ExpressionAttributeNames[tok])
+			}
+			it["\x00name"] = str(o.ExpressionAttributeNames[tok])
+			continue
+		}
+		n := it.str("\x00name")
+		v := o.ExpressionAttributeValues[tok]
+		switch clause {
+		case "SET":
+			it[n] = v
+		case "ADD":
+			if v.N != nil {
+				x, _ := strconv.ParseInt(*v.N, 10, 64)
+				it[n] = num(it.num(n) + x)
+			} else {
+				it[n] = strs(unique(append(it[n].SS, v.SS...))...)
+			}
+		case "DELETE":
+			kept := it[n].SS
+			for _, s := range v.SS {
+				kept = without(kept, s)
+			}
+			it[n] = strs(kept...)
+			if len(kept) == 0 {
+				delete(it, n)
+			}
+		}
+	}
+	delete(it, "\x00name")
+}
+
+func (f *fake) query(table string, in map[string]json.RawMessage) (interface{}, error) {
+	var q query
+	var sel string
+	field(in, "IndexName", &q.IndexName)
+	field(in, "KeyConditionExpression", &q.KeyConditionExpression)
+	field(in, "ExpressionAttributeNames", &q.ExpressionAttributeNames)
+	field(in, "ExpressionAttributeValues", &q.ExpressionAttributeValues)
+	field(in, "ScanIndexForward", &q.ScanIndexForward)
+	field(in, "ExclusiveStartKey", &q.ExclusiveStartKey)
+	field(in, "Select", &sel)
+	o := op{ExpressionAttributeNames: q.ExpressionAttributeNames, ExpressionAttributeValues: q.ExpressionAttributeValues}
+	keys := [2]string{"pk", "sk"}
+	if q.IndexName != "" {
+		keys = f.indexes[table][q.IndexName]
+	}
+	var its []item
+	for _, it := range f.tables[table] {
+		if _, ok := it[keys[0]]; ok && eval(q.KeyConditionExpression, it, o) {
+			its = append(its, it)
+		}
+	}
+	sort.Slice(its, func(i, j int) bool {
+		if c := strings.Compare(its[i].str(keys[1]), its[j].str(keys[1])); c != 0 {
+			return (c < 0) == q.ScanIndexForward
+		}
+		return id(its[i]) < id(its[j])
+	})
+	if q.ExclusiveStartKey != nil {
+		for k, it := range its {
+			if id(it) == id(q.ExclusiveStartKey) {
+				its = its[k+1:]
+				break
+			}
+		}
+	}
+	out := map[string]interface{}{}
+	if len(its) > 2 {
+		its = its[:2]
+		out["LastEvaluatedKey"] = item{"pk": its[1]["pk"], "sk": its[1]["sk"]}
+	}
+	if sel == "COUNT" {
+		out["Count"] = len(its)
+		return out, nil
+	}
+	if q.IndexName == usernameIndex || q.IndexName == emailIndex {
+		for k, it := range its {
+			its[k] = item{"pk": it["pk"], "sk": it["sk"], keys[0]: it[keys[0]]}
+		}
+	}
+	out["Items"] = its
+	return out, nil
+}
+
+func TestFake(t *testing.T) {
+	it := item{"n": num(1), "s": str("b"), "set": strs("x")}
+	o := op{ExpressionAttributeNames: names("#n #s #set #m"), ExpressionAttributeValues: item{":one": num(1), ":a": str("a"), ":x": strs("x")}}
+	for cond, expected := range map[string]bool{
+		"#n = :one":                          true,
+		"#s > :a":                            true,
+		"#s < :a":                            false,
+		"attribute_exists(#m) OR #n = :one":  true,
+		"attribute_exists(#m) AND #n = :one": false,
+	} {
+		if got := eval(cond, it, o); got != expected {
+			t.Errorf("%v: expected %v, got %v", cond, expected, got)
+		}
+	}
+	applyUpdate("SET #s = :a REMOVE #m ADD #n :one DELETE #set :x", it, o)
+	if it.num("n") != 2 || it.str("s") != "a" || it["set"].SS != nil {
+		t.Errorf("unexpected update %v", fmt.Sprint(it))
+	}
+}
@@ -0,0 +1,117 @@
+package dynamodb
+
+import (
+	"context"
+	"user/users"
+)
+
+func groupItem(g users.Group, version int64) item {
+	it := withKey(marshal(&g), "group", g.ID)
+	it["version"] = num(version)
+	return it
+}
+
+func decodeGroup(it item) (users.Group, error) {
+	g := users.Group{Owners: make([]string, 0), Members: make([]string, 0)}
+	err := unmarshal(it, &g)
+	g.ID = it.str("sk")
+	return g, err
+}
+
+// CreateGroup stores the group with its owners and members
+func (d *DynamoDB) CreateGroup(ctx context.Context, g *users.Group) error {
+	stored := *g
+	stored.ID = newID()
+	stored.CreatedAt = now()
+	stored.Owners, stored.Members = unique(g.Owners), unique(g.Members)
+	if err := d.write(ctx, put(groupItem(stored, 1), "attribute_not_exists(#pk)", nil, nil)); err != nil {
+		return err
+	}
+	*g = stored
+	return nil
+}
+
+// GetGroup gets a group by id
+func (d *DynamoDB) GetGroup(ctx context.Context, id string) (users.Group, error) {
+	it, err := d.get(ctx, key("group", id))
+	if err != nil {
+		return users.Group{}, err
+	}
+	return decodeGroup(it)
+}
+
+// GetUserGroups gets the groups the user owns or is a member of
+func (d *DynamoDB) GetUserGroups(ctx context.Context, userID string) ([]users.Group, error) {
+	gs := make([]users.Group, 0)
+	err := d.query(ctx, byKind("group", ""), func(it item) (bool, error) {
+		g, err := decodeGroup(it)
+		if err != nil {
+			return false, err
+		}
+		if contains(g.Owners, userID) || contains(g.Members, userID) {
+			gs = append(gs, g)
+		}
+		return true, nil
+	})
+	return gs, err
+}
+
+// modifyGroup applies f to the group with id and writes it back, again
+// when the group changed in between.
+func (d *DynamoDB) modifyGroup(ctx context.Context, id string, f func(g *users.Group)) error {
+	return retry(func() error {
+		it, err := d.get(ctx, key("group", id))
+		if err != nil {
+			return err
+		}
+		g, err := decodeGroup(it)
+		if err != nil {
+			return err
+		}
+		f(&g)
+		version := it.num("version")
+		return d.write(ctx, put(groupItem(g, version+1), "#version = :version", item{":version": num(version)}, errChanged))
+	})
+}
+
+// AddGroupMember adds the user to the group members
+func (d *DynamoDB) AddGroupMember(ctx context.Context, groupID, userID string) error {
+	return d.modifyGroup(ctx, groupID, func(g *users.Group) {
+		g.Members = unique(append(g.Members, userID))
+	})
+}
+
+// RemoveGroupMember removes the user from the group members
+func (d *DynamoDB) RemoveGroupMember(ctx context.Context, groupID, userID string) error {
+	return d.modifyGroup(ctx, groupID, func(g *users.Group) {
+		g.Members = without(g.Members, userID)
+	})
+}
+
+// replaceGroupUser puts target in place of the user source in the groups
+// it owns or is a member of, removes it for an empty target.
+func (d *DynamoDB) replaceGroupUser(ctx context.Context, source, target string) error {
+	gs, err := d.GetUserGroups(ctx, source)
+	if err != nil {
+		return err
+	}
+	replace := func(ids []string) []string {
+		if !contains(ids, source) {
+			return ids
+		}
+		ids = without(ids, source)
+		if target != "" {
+			ids = unique(append(ids, target))
+		}
+		return ids
+	}
+	for _, g := range gs {
+		err := d.modifyGroup(ctx, g.ID, func(g *users.Group) {
+			g.Owners, g.Members = replace(g.Owners), replace(g.Members)
+		})
+		if err != nil && err != ErrNotFound {
+			return err
+		}
+	}
+	return nil
+}
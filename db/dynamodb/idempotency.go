@@ -0,0 +1,46 @@
+package dynamodb
+
+import (
+	"context"
+	"user/db"
+)
+
+// CreateIdempotencyKey stores the key, failing with db.ErrConflict if it is
+// already in use. Expired keys are taken over, the time to live of the
+// table removes them eventually.
+func (d *DynamoDB) CreateIdempotencyKey(ctx context.Context, k *db.IdempotencyKey) error {
+	k.CreatedAt = now()
+	it := keyed(marshal(k), idempotencyKey(k.Key))
+	it["expires"] = num(k.CreatedAt.Add(db.IdempotencyKeyTTL).Unix())
+	return d.write(ctx, put(it, "attribute_not_exists(#pk) OR #expires < :now", item{":now": num(k.CreatedAt.Unix())}, db.ErrConflict))
+}
+
+// GetIdempotencyKey gets the key unless it expired
+func (d *DynamoDB) GetIdempotencyKey(ctx context.Context, key string) (db.IdempotencyKey, error) {
+	it, err := d.get(ctx, idempotencyKey(key))
+	if err != nil {
+		return db.IdempotencyKey{}, err
+	}
+	var k db.IdempotencyKey
+	if err := unmarshal(it, &k); err != nil {
+		return db.IdempotencyKey{}, err
+	}
+	if k.CreatedAt.Before(now().Add(-db.IdempotencyKeyTTL)) {
+		return db.IdempotencyKey{}, ErrNotFound
+	}
+	return k, nil
+}
+
+func idempotencyKey(k string) item {
+	return key("idempotency", k)
+}
+
+// SetIdempotencyResult records the id of the resource created under key
+func (d *DynamoDB) SetIdempotencyResult(ctx context.Context, key, resultID string) error {
+	return d.write(ctx, update(idempotencyKey(key), "SET #resultId = :id", exists, item{":id": str(resultID)}, ErrNotFound))
+}
+
+// DeleteIdempotencyKey removes the key, so it can be used again
+func (d *DynamoDB) DeleteIdempotencyKey(ctx context.Context, key string) error {
+	return d.write(ctx, remove(idempotencyKey(key), "", nil, nil))
+}
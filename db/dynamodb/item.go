@@ -0,0 +1,273 @@
+package dynamodb
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// attr is a DynamoDB attribute value. Exactly one field is set, none is
+// NULL.
+type attr struct {
+	S    *string
+	N    *string
+	BOOL *bool
+	NULL bool
+	L    []attr
+	M    map[string]attr
+	SS   []string
+}
+
+// MarshalJSON writes the value with its type, like {"S": "eve"}.
+func (a attr) MarshalJSON() ([]byte, error) {
+	switch {
+	case a.S != nil:
+		return json.Marshal(map[string]string{"S": *a.S})
+	case a.N != nil:
+		return json.Marshal(map[string]string{"N": *a.N})
+	case a.BOOL != nil:
+		return json.Marshal(map[string]bool{"BOOL": *a.BOOL})
+	case a.L != nil:
+		return json.Marshal(map[string][]attr{"L": a.L})
+	case a.M != nil:
+		return json.Marshal(map[string]map[string]attr{"M": a.M})
+	case a.SS != nil:
+		return json.Marshal(map[string][]string{"SS": a.SS})
+	}
+	return []byte(`{"NULL":true}`), nil
+}
+
+func str(s string) attr {
+	return attr{S: &s}
+}
+
+func num(n int64) attr {
+	s := strconv.FormatInt(n, 10)
+	return attr{N: &s}
+}
+
+func boolean(b bool) attr {
+	return attr{BOOL: &b}
+}
+
+// strs is a string set, NULL when ss is empty since sets can't be.
+func strs(ss ...string) attr {
+	if len(ss) == 0 {
+		return attr{}
+	}
+	return attr{SS: ss}
+}
+
+// timestamp stores t as UTC RFC 3339 text.
+func timestamp(t time.Time) attr {
+	return str(t.UTC().Format(time.RFC3339Nano))
+}
+
+// item is a stored item, by attribute name.
+type item map[string]attr
+
+// str returns the text of the attribute name, empty when it is missing.
+func (it item) str(name string) string {
+	if a, ok := it[name]; ok && a.S != nil {
+		return *a.S
+	}
+	return ""
+}
+
+// num returns the number of the attribute name, zero when it is missing.
+func (it item) num(name string) int64 {
+	if a, ok := it[name]; ok && a.N != nil {
+		n, _ := strconv.ParseInt(*a.N, 10, 64)
+		return n
+	}
+	return 0
+}
+
+// set returns the sorted members of the string set name.
+func (it item) set(name string) []string {
+	ss := append([]string(nil), it[name].SS...)
+	sort.Strings(ss)
+	return ss
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// marshal encodes the fields of the struct v under their bson names, the
+// names the MongoDB documents use. Zero values and fields without a bson
+// name are left out, so empty strings never reach an index.
+func marshal(v interface{}) item {
+	it := item{}
+	encodeFields(reflect.Indirect(reflect.ValueOf(v)), it)
+	return it
+}
+
+func encodeFields(v reflect.Value, it item) {
+	t := v.Type()
+	for k := 0; k < t.NumField(); k++ {
+		name := fieldName(t.Field(k))
+		if name == "" {
+			continue
+		}
+		if a, ok := encode(v.Field(k)); ok {
+			it[name] = a
+		}
+	}
+}
+
+// fieldName returns the bson name of f, empty for fields that aren't
+// stored.
+func fieldName(f reflect.StructField) string {
+	name := strings.Split(f.Tag.Get("bson"), ",")[0]
+	if name == "-" || f.PkgPath != "" {
+		return ""
+	}
+	return name
+}
+
+// encode returns the attribute value of v, false for zero values.
+func encode(v reflect.Value) (attr, bool) {
+	if v.Type() == timeType {
+		t := v.Interface().(time.Time)
+		return timestamp(t), !t.IsZero()
+	}
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return attr{}, false
+		}
+		if v.Elem().Kind() == reflect.Struct && v.Elem().Type() != timeType {
+			// A set pointer is stored even when it points at zero values.
+			it := item{}
+			encodeFields(v.Elem(), it)
+			return attr{M: it}, true
+		}
+		return encode(v.Elem())
+	case reflect.String:
+		return str(v.String()), v.Len() > 0
+	case reflect.Bool:
+		return boolean(true), v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return num(v.Int()), v.Int() != 0
+	case reflect.Float32, reflect.Float64:
+		s := strconv.FormatFloat(v.Float(), 'g', -1, 64)
+		return attr{N: &s}, v.Float() != 0
+	case reflect.Struct:
+		it := item{}
+		encodeFields(v, it)
+		return attr{M: it}, len(it) > 0
+	case reflect.Slice:
+		l := make([]attr, v.Len())
+		for k := range l {
+			l[k], _ = encode(v.Index(k))
+		}
+		return attr{L: l}, v.Len() > 0
+	case reflect.Map:
+		m := make(map[string]attr, v.Len())
+		for _, key := range v.MapKeys() {
+			m[key.String()], _ = encode(v.MapIndex(key))
+		}
+		return attr{M: m}, v.Len() > 0
+	}
+	panic(fmt.Sprintf("dynamodb: can't store %v", v.Type()))
+}
+
+// unmarshal decodes it into the struct v points at, the reverse of
+// marshal.
+func unmarshal(it item, v interface{}) error {
+	return decodeFields(it, reflect.ValueOf(v).Elem())
+}
+
+func decodeFields(it item, v reflect.Value) error {
+	t := v.Type()
+	for k := 0; k < t.NumField(); k++ {
+		name := fieldName(t.Field(k))
+		a, ok := it[name]
+		if name == "" || !ok || a.NULL {
+			continue
+		}
+		if err := decode(a, v.Field(k)); err != nil {
+			return fmt.Errorf("dynamodb: %v: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func decode(a attr, v reflect.Value) error {
+	if v.Type() == timeType {
+		if a.S == nil {
+			return fmt.Errorf("expected a timestamp")
+		}
+		t, err := time.Parse(time.RFC3339Nano, *a.S)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(t))
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Ptr:
+		p := reflect.New(v.Type().Elem())
+		if err := decode(a, p.Elem()); err != nil {
+			return err
+		}
+		v.Set(p)
+		return nil
+	case reflect.String:
+		if a.S == nil {
+			return fmt.Errorf("expected text")
+		}
+		v.SetString(*a.S)
+		return nil
+	case reflect.Bool:
+		if a.BOOL == nil {
+			return fmt.Errorf("expected a boolean")
+		}
+		v.SetBool(*a.BOOL)
+		return nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if a.N == nil {
+			return fmt.Errorf("expected a number")
+		}
+		n, err := strconv.ParseInt(*a.N, 10, 64)
+		v.SetInt(n)
+		return err
+	case reflect.Float32, reflect.Float64:
+		if a.N == nil {
+			return fmt.Errorf("expected a number")
+		}
+		f, err := strconv.ParseFloat(*a.N, 64)
+		v.SetFloat(f)
+		return err
+	case reflect.Struct:
+		return decodeFields(a.M, v)
+	case reflect.Slice:
+		if a.SS != nil && v.Type().Elem().Kind() == reflect.String {
+			v.Set(reflect.ValueOf(append([]string(nil), a.SS...)).Convert(v.Type()))
+			return nil
+		}
+		s := reflect.MakeSlice(v.Type(), len(a.L), len(a.L))
+		for k, e := range a.L {
+			if err := decode(e, s.Index(k)); err != nil {
+				return err
+			}
+		}
+		v.Set(s)
+		return nil
+	case reflect.Map:
+		m := reflect.MakeMapWithSize(v.Type(), len(a.M))
+		for key, e := range a.M {
+			ev := reflect.New(v.Type().Elem()).Elem()
+			if err := decode(e, ev); err != nil {
+				return err
+			}
+			m.SetMapIndex(reflect.ValueOf(key).Convert(v.Type().Key()), ev)
+		}
+		v.Set(m)
+		return nil
+	}
+	return fmt.Errorf("can't decode %v", v.Type())
+}
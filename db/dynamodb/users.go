@@ -0,0 +1,692 @@
+package dynamodb
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"user/db"
+	"user/users"
+)
+
+// userItem is the item of u at the given version, with the normalized
+// username for the username index and the ids of its addresses and cards.
+func userItem(u users.User, version int64) item {
+	it := withKey(marshal(&u), "user", u.UserID)
+	it["usernameKey"] = str(users.NormalizeUsername(u.Username))
+	it["version"] = num(version)
+	ids := make([]string, len(u.Addresses))
+	for k, a := range u.Addresses {
+		ids[k] = a.ID
+	}
+	if len(ids) > 0 {
+		it["addressIds"] = strs(ids...)
+	}
+	ids = make([]string, len(u.Cards))
+	for k, ca := range u.Cards {
+		ids[k] = ca.ID
+	}
+	if len(ids) > 0 {
+		it["cardIds"] = strs(ids...)
+	}
+	return it
+}
+
+// decodeUser returns the user of it with the ids of its addresses and cards
+// in id order.
+func decodeUser(it item) (users.User, error) {
+	var u users.User
+	if err := unmarshal(it, &u); err != nil {
+		return users.New(), err
+	}
+	u.UserID = it.str("sk")
+	u.Addresses = make([]users.Address, 0)
+	for _, id := range it.set("addressIds") {
+		u.Addresses = append(u.Addresses, users.Address{ID: id})
+	}
+	u.Cards = make([]users.Card, 0)
+	for _, id := range it.set("cardIds") {
+		u.Cards = append(u.Cards, users.Card{ID: id})
+	}
+	return u, nil
+}
+
+// getUser reads the user with id and the version of its item.
+func (d *DynamoDB) getUser(ctx context.Context, id string) (users.User, int64, error) {
+	it, err := d.get(ctx, key("user", id))
+	if err != nil {
+		return users.New(), 0, err
+	}
+	u, err := decodeUser(it)
+	return u, it.num("version"), err
+}
+
+// putUser writes u as the next version of the user read at version, zero
+// for new users.
+func putUser(u users.User, version int64) action {
+	if version == 0 {
+		return put(userItem(u, 1), "attribute_not_exists(#pk)", nil, errChanged)
+	}
+	return put(userItem(u, version+1), "#version = :version", item{":version": num(version)}, errChanged)
+}
+
+// removeUser deletes the user read at version.
+func removeUser(id string, version int64) action {
+	return remove(key("user", id), "#version = :version", item{":version": num(version)}, errChanged)
+}
+
+// modify applies f to the user with id and writes it back in a transaction
+// with the writes f returns. It runs again when the user changed in between.
+func (d *DynamoDB) modify(ctx context.Context, id string, f func(u *users.User) ([]action, error)) error {
+	return retry(func() error {
+		u, version, err := d.getUser(ctx, id)
+		if err != nil {
+			return err
+		}
+		actions, err := f(&u)
+		if err != nil {
+			return err
+		}
+		return d.write(ctx, append([]action{putUser(u, version)}, actions...)...)
+	})
+}
+
+// claim takes the unique value of field, username or email, for the user
+// id. Values the user or one of also hold already are taken over.
+func claim(field, value, id string, also ...string) action {
+	cond := "attribute_not_exists(#pk) OR #target = :id"
+	values := item{":id": str(id)}
+	for k, other := range also {
+		p := ":also" + strconv.Itoa(k)
+		cond += " OR #target = " + p
+		values[p] = str(other)
+	}
+	it := key(field, value)
+	it["target"] = str(id)
+	return put(it, cond, values, &db.ConflictError{Field: field})
+}
+
+// release gives up the unique value of field.
+func release(field, value string) action {
+	return remove(key(field, value), "", nil, nil)
+}
+
+// swap moves the unique value of field of a user from old to value,
+// nothing when they are the same.
+func swap(field, old, value, id string, also ...string) []action {
+	if old == value {
+		return nil
+	}
+	var actions []action
+	if value != "" {
+		actions = append(actions, claim(field, value, id, also...))
+	}
+	if old != "" {
+		actions = append(actions, release(field, old))
+	}
+	return actions
+}
+
+// CreateUser stores the user with its addresses and cards, setting their
+// ids.
+func (d *DynamoDB) CreateUser(ctx context.Context, u *users.User) error {
+	at := now()
+	stored := *u
+	stored.UserID = newID()
+	stored.CreatedAt, stored.UpdatedAt = at, at
+	stored.Tags = unique(u.Tags)
+	actions := []action{claim("username", users.NormalizeUsername(u.Username), stored.UserID)}
+	if u.Email != "" {
+		actions = append(actions, claim("email", u.Email, stored.UserID))
+	}
+	stored.Addresses = append([]users.Address(nil), u.Addresses...)
+	for k := range stored.Addresses {
+		a := &stored.Addresses[k]
+		a.ID, a.CreatedAt, a.UpdatedAt = newID(), at, at
+		actions = append(actions, put(addressItem(*a, stored.UserID), "attribute_not_exists(#pk)", nil, nil))
+	}
+	stored.Cards = append([]users.Card(nil), u.Cards...)
+	for k := range stored.Cards {
+		ca := &stored.Cards[k]
+		ca.ID, ca.CreatedAt, ca.UpdatedAt = newID(), at, at
+		actions = append(actions, put(cardItem(*ca, stored.UserID), "attribute_not_exists(#pk)", nil, nil))
+	}
+	if err := d.write(ctx, append(actions, putUser(stored, 0))...); err != nil {
+		return err
+	}
+	*u = stored
+	return nil
+}
+
+// UpdateUser sets the given profile fields of the user, leaving the rest as is
+func (d *DynamoDB) UpdateUser(ctx context.Context, id string, p users.ProfileUpdate) error {
+	if profileEmpty(p) {
+		return nil
+	}
+	return d.modify(ctx, id, func(u *users.User) ([]action, error) {
+		old := u.Email
+		applyProfile(u, p, now())
+		return swap("email", old, u.Email, id), nil
+	})
+}
+
+func profileEmpty(p users.ProfileUpdate) bool {
+	return p.FirstName == nil && p.LastName == nil && p.Email == nil && p.Locale == nil && p.Timezone == nil &&
+		p.Phone == nil && p.PhoneVerified == nil && p.PhoneCode == nil && p.Avatar == nil && p.Preferences == nil &&
+		p.Status == nil && p.Password == nil && p.Salt == nil && len(p.Metadata) == 0
+}
+
+// applyProfile sets the fields of p on u.
+func applyProfile(u *users.User, p users.ProfileUpdate, at time.Time) {
+	for _, f := range []struct {
+		field *string
+		v     *string
+	}{
+		{&u.FirstName, p.FirstName}, {&u.LastName, p.LastName}, {&u.Email, p.Email}, {&u.Locale, p.Locale},
+		{&u.Timezone, p.Timezone}, {&u.Status, p.Status}, {&u.Password, p.Password}, {&u.Salt, p.Salt},
+	} {
+		if f.v != nil {
+			*f.field = *f.v
+		}
+	}
+	// A new phone has to be verified again.
+	if p.Phone != nil {
+		u.Phone = *p.Phone
+		u.PhoneVerified = false
+	}
+	if p.PhoneVerified != nil {
+		u.PhoneVerified = *p.PhoneVerified
+	}
+	switch {
+	case p.PhoneCode != nil:
+		c := *p.PhoneCode
+		u.PhoneCode = &c
+	case p.Phone != nil || p.PhoneVerified != nil:
+		u.PhoneCode = nil
+	}
+	if p.Avatar != nil {
+		u.Avatar = p.Avatar
+	}
+	if p.Preferences != nil {
+		prefs := *p.Preferences
+		u.Preferences = &prefs
+	}
+	if len(p.Metadata) > 0 {
+		if u.Metadata == nil {
+			u.Metadata = map[string]string{}
+		}
+		for k, v := range p.Metadata {
+			if v == nil {
+				delete(u.Metadata, k)
+				continue
+			}
+			u.Metadata[k] = *v
+		}
+	}
+	u.UpdatedAt = at
+}
+
+// RenameUser changes the username, recording the old one in the history
+func (d *DynamoDB) RenameUser(ctx context.Context, id, username string) error {
+	return d.modify(ctx, id, func(u *users.User) ([]action, error) {
+		at := now()
+		actions := swap("username", users.NormalizeUsername(u.Username), users.NormalizeUsername(username), id)
+		u.UsernameHistory = append(u.UsernameHistory, users.UsernameChange{Username: u.Username, ChangedAt: at})
+		u.Username = username
+		u.UpdatedAt = at
+		return actions, nil
+	})
+}
+
+// UpgradeUser gives the guest id the credentials and profile of u and drops
+// its guest role. It fails with ErrNotFound unless id is a guest.
+func (d *DynamoDB) UpgradeUser(ctx context.Context, id string, u users.User) error {
+	return d.modify(ctx, id, func(stored *users.User) ([]action, error) {
+		if !stored.HasRole(users.RoleGuest) {
+			return nil, ErrNotFound
+		}
+		actions := swap("username", users.NormalizeUsername(stored.Username), users.NormalizeUsername(u.Username), id)
+		actions = append(actions, swap("email", stored.Email, u.Email, id)...)
+		stored.Username, stored.Password, stored.Salt, stored.Email = u.Username, u.Password, u.Salt, u.Email
+		stored.FirstName, stored.LastName = u.FirstName, u.LastName
+		stored.Roles = without(stored.Roles, users.RoleGuest)
+		stored.UpdatedAt = now()
+		return actions, nil
+	})
+}
+
+// MergeUsers moves the addresses, cards and tags of source to target, sets
+// the profile fields in p on target and removes source. The source username
+// becomes a previous username of target, the source id an alias of it.
+// Activity, groups and earlier aliases of source follow once the merge is
+// written.
+func (d *DynamoDB) MergeUsers(ctx context.Context, target, source string, p users.ProfileUpdate) error {
+	if _, _, err := d.getUser(ctx, source); err != nil {
+		return err
+	}
+	err := d.modify(ctx, target, func(t *users.User) ([]action, error) {
+		src, version, err := d.getUser(ctx, source)
+		if err != nil {
+			return nil, err
+		}
+		at := now()
+		old := t.Email
+		applyProfile(t, p, at)
+		// The email of source can go to target, claims of either are
+		// taken over.
+		actions := swap("email", old, t.Email, target, source)
+		if src.Email != "" && src.Email != t.Email {
+			actions = append(actions, release("email", src.Email))
+		}
+		actions = append(actions, removeUser(source, version),
+			release("username", users.NormalizeUsername(src.Username)),
+			put(aliasItem(source, target, at), "", nil, nil))
+		t.UsernameHistory = append(t.UsernameHistory, users.UsernameChange{Username: src.Username, ChangedAt: at})
+		t.Tags = unique(append(t.Tags, src.Tags...))
+		owner := item{":owner": str(target)}
+		for _, a := range src.Addresses {
+			actions = append(actions, update(key("address", a.ID), "SET #owner = :owner", exists, owner, nil))
+		}
+		for _, ca := range src.Cards {
+			actions = append(actions, update(key("card", ca.ID), "SET #owner = :owner", exists, owner, nil))
+		}
+		t.Addresses = append(t.Addresses, src.Addresses...)
+		t.Cards = append(t.Cards, src.Cards...)
+		return actions, nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := d.retargetAliases(ctx, source, target); err != nil {
+		return err
+	}
+	if err := d.moveActivity(ctx, source, target); err != nil {
+		return err
+	}
+	return d.replaceGroupUser(ctx, source, target)
+}
+
+// ResolveAlias returns the id of the user the given id was merged into
+func (d *DynamoDB) ResolveAlias(ctx context.Context, id string) (string, error) {
+	it, err := d.get(ctx, key("alias", id))
+	if err != nil {
+		return "", err
+	}
+	return it.str("target"), nil
+}
+
+func aliasItem(id, target string, at time.Time) item {
+	return withKey(item{"target": str(target), "mergedAt": timestamp(at)}, "alias", id)
+}
+
+// retargetAliases points the aliases of source at target.
+func (d *DynamoDB) retargetAliases(ctx context.Context, source, target string) error {
+	var actions []action
+	err := d.query(ctx, byKind("alias", ""), func(it item) (bool, error) {
+		if it.str("target") == source {
+			actions = append(actions, update(key("alias", it.str("sk")), "SET #target = :target", exists, item{":target": str(target)}, nil))
+		}
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, a := range actions {
+		if err := d.write(ctx, a); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetUserByPreviousName gets the user who renamed away from name after
+// since, the latest one if several did
+func (d *DynamoDB) GetUserByPreviousName(ctx context.Context, name string, since time.Time) (users.User, error) {
+	key := users.NormalizeUsername(name)
+	found := users.New()
+	var latest time.Time
+	err := d.eachUser(ctx, func(u users.User) {
+		for _, h := range u.UsernameHistory {
+			if users.NormalizeUsername(h.Username) == key && h.ChangedAt.After(since) && h.ChangedAt.After(latest) {
+				found, latest = u, h.ChangedAt
+			}
+		}
+	})
+	if err != nil {
+		return users.New(), err
+	}
+	if latest.IsZero() {
+		return users.New(), ErrNotFound
+	}
+	return found, nil
+}
+
+// eachUser calls f with every user in id order.
+func (d *DynamoDB) eachUser(ctx context.Context, f func(users.User)) error {
+	return d.query(ctx, byKind("user", ""), func(it item) (bool, error) {
+		u, err := decodeUser(it)
+		if err != nil {
+			return false, err
+		}
+		f(u)
+		return true, nil
+	})
+}
+
+// RecordLogin stores the time of a successful login and counts it
+func (d *DynamoDB) RecordLogin(ctx context.Context, id string, at time.Time) error {
+	return d.write(ctx, update(key("user", id), "SET #lastLoginAt = :at ADD #loginCount :one, #version :one", exists,
+		item{":at": timestamp(at), ":one": num(1)}, ErrNotFound))
+}
+
+// AddUserTag adds tag to the user, tags are kept unique
+func (d *DynamoDB) AddUserTag(ctx context.Context, id, tag string) error {
+	return d.modify(ctx, id, func(u *users.User) ([]action, error) {
+		u.Tags = unique(append(u.Tags, tag))
+		u.UpdatedAt = now()
+		return nil, nil
+	})
+}
+
+// RemoveUserTag removes tag from the user
+func (d *DynamoDB) RemoveUserTag(ctx context.Context, id, tag string) error {
+	return d.modify(ctx, id, func(u *users.User) ([]action, error) {
+		u.Tags = without(u.Tags, tag)
+		u.UpdatedAt = now()
+		return nil, nil
+	})
+}
+
+// lookup returns the id of the user in the index with the value, empty
+// when there is none.
+func (d *DynamoDB) lookup(ctx context.Context, index, attribute, value string) (string, error) {
+	var id string
+	err := d.query(ctx, query{
+		IndexName:                 index,
+		KeyConditionExpression:    "#" + attribute + " = :value",
+		ExpressionAttributeValues: item{":value": str(value)},
+	}, func(it item) (bool, error) {
+		id = it.str("sk")
+		return false, nil
+	})
+	return id, err
+}
+
+// GetUserByName Get user by their name
+func (d *DynamoDB) GetUserByName(ctx context.Context, name string) (users.User, error) {
+	id, err := d.lookup(ctx, usernameIndex, "usernameKey", users.NormalizeUsername(name))
+	if err != nil {
+		return users.New(), err
+	}
+	if id == "" {
+		return users.New(), ErrNotFound
+	}
+	return d.GetUser(ctx, id)
+}
+
+// GetUser Get user by their id
+func (d *DynamoDB) GetUser(ctx context.Context, id string) (users.User, error) {
+	u, _, err := d.getUser(ctx, id)
+	return u, err
+}
+
+// GetUsersByID gets the users with the given ids, unknown ids are left out
+func (d *DynamoDB) GetUsersByID(ctx context.Context, ids []string) ([]users.User, error) {
+	found, err := d.batchGet(ctx, "user", ids)
+	if err != nil {
+		return nil, err
+	}
+	us := make([]users.User, 0, len(found))
+	for _, id := range unique(ids) {
+		if it, ok := found[id]; ok {
+			u, err := decodeUser(it)
+			if err != nil {
+				return nil, err
+			}
+			us = append(us, u)
+		}
+	}
+	return us, nil
+}
+
+// sortCompare compares users by the fields of db.SortFields. Users without
+// a login sort after the others, like NULLs in PostgreSQL.
+var sortCompare = map[string]func(a, b *users.User) int{
+	"username": func(a, b *users.User) int {
+		return strings.Compare(users.NormalizeUsername(a.Username), users.NormalizeUsername(b.Username))
+	},
+	"email":     func(a, b *users.User) int { return strings.Compare(a.Email, b.Email) },
+	"lastName":  func(a, b *users.User) int { return strings.Compare(a.LastName, b.LastName) },
+	"createdAt": func(a, b *users.User) int { return a.CreatedAt.Compare(b.CreatedAt) },
+	"updatedAt": func(a, b *users.User) int { return a.UpdatedAt.Compare(b.UpdatedAt) },
+	"lastLoginAt": func(a, b *users.User) int {
+		switch {
+		case a.LastLoginAt == nil && b.LastLoginAt == nil:
+			return 0
+		case a.LastLoginAt == nil:
+			return 1
+		case b.LastLoginAt == nil:
+			return -1
+		}
+		return a.LastLoginAt.Compare(*b.LastLoginAt)
+	},
+}
+
+// GetUsers Get all users matching the query. All fields are loaded, the
+// fields of the query only narrow the responses. Users are filtered and
+// sorted as they are read, only an email is looked up in its index.
+func (d *DynamoDB) GetUsers(ctx context.Context, q db.UserQuery) ([]users.User, error) {
+	compare := func(a, b *users.User) int { return 0 }
+	f, desc := q.SortField()
+	if q.Sort != "" {
+		var ok bool
+		if compare, ok = sortCompare[f]; !ok {
+			return nil, db.ErrInvalidSort
+		}
+	}
+	var us []users.User
+	if q.Email != "" {
+		id, err := d.lookup(ctx, emailIndex, "email", q.Email)
+		if err != nil {
+			return nil, err
+		}
+		if id != "" {
+			if us, err = d.GetUsersByID(ctx, []string{id}); err != nil {
+				return nil, err
+			}
+		}
+	} else if err := d.eachUser(ctx, func(u users.User) { us = append(us, u) }); err != nil {
+		return nil, err
+	}
+	matched := make([]users.User, 0, len(us))
+	for _, u := range us {
+		if matches(&u, q) {
+			matched = append(matched, u)
+		}
+	}
+	sort.SliceStable(matched, func(i, j int) bool {
+		if c := compare(&matched[i], &matched[j]); c != 0 {
+			return (c < 0) != desc
+		}
+		return matched[i].UserID < matched[j].UserID
+	})
+	if q.Limit > 0 && len(matched) > q.Limit {
+		matched = matched[:q.Limit]
+	}
+	return matched, nil
+}
+
+// matches reports whether u passes the filters of q.
+func matches(u *users.User, q db.UserQuery) bool {
+	if q.Email != "" && u.Email != q.Email {
+		return false
+	}
+	if q.LastName != "" && u.LastName != q.LastName {
+		return false
+	}
+	if !q.CreatedAfter.IsZero() && !u.CreatedAt.After(q.CreatedAfter) {
+		return false
+	}
+	if !q.CreatedBefore.IsZero() && !u.CreatedAt.Before(q.CreatedBefore) {
+		return false
+	}
+	if !q.UpdatedAfter.IsZero() && !u.UpdatedAt.After(q.UpdatedAfter) {
+		return false
+	}
+	if q.Tag != "" && !contains(u.Tags, q.Tag) {
+		return false
+	}
+	if q.Role != "" && !contains(u.Roles, q.Role) {
+		return false
+	}
+	for k, v := range q.Metadata {
+		if got, ok := u.Metadata[k]; !ok || got != v {
+			return false
+		}
+	}
+	switch q.Status {
+	case "":
+		return u.Status != users.StatusDeleted
+	case users.StatusActive:
+		// Users without a status predate lifecycle states and are active.
+		return u.Status == "" || u.Status == users.StatusActive
+	default:
+		return u.Status == q.Status
+	}
+}
+
+// GetStats counts the users, addresses and cards, signups per day since
+// signupsSince and users who logged in since activeSince
+func (d *DynamoDB) GetStats(ctx context.Context, signupsSince, activeSince time.Time) (db.Stats, error) {
+	var st db.Stats
+	var err error
+	if st.Addresses, err = d.count(ctx, "address"); err != nil {
+		return st, err
+	}
+	if st.Cards, err = d.count(ctx, "card"); err != nil {
+		return st, err
+	}
+	counts := map[string]int{}
+	err = d.eachUser(ctx, func(u users.User) {
+		st.Users++
+		if u.LastLoginAt != nil && !u.LastLoginAt.Before(activeSince) {
+			st.Active++
+		}
+		if !u.CreatedAt.Before(signupsSince) {
+			counts[u.CreatedAt.UTC().Format(db.DayFormat)]++
+		}
+	})
+	if err != nil {
+		return st, err
+	}
+	st.Signups = db.Days(signupsSince, time.Now(), counts)
+	return st, nil
+}
+
+// ListUsers gets a page of users in id order, starting after the given id
+func (d *DynamoDB) ListUsers(ctx context.Context, after string, n int) ([]users.User, error) {
+	us := make([]users.User, 0)
+	err := d.query(ctx, byKind("user", after), func(it item) (bool, error) {
+		u, err := decodeUser(it)
+		if err != nil {
+			return false, err
+		}
+		us = append(us, u)
+		return n <= 0 || len(us) < n, nil
+	})
+	return us, err
+}
+
+// UserExists reports whether a user has the value in the given field,
+// username or email
+func (d *DynamoDB) UserExists(ctx context.Context, field, value string) (bool, error) {
+	var id string
+	var err error
+	switch field {
+	case "username":
+		id, err = d.lookup(ctx, usernameIndex, "usernameKey", users.NormalizeUsername(value))
+	case "email":
+		id, err = d.lookup(ctx, emailIndex, "email", value)
+	default:
+		return false, fmt.Errorf("no user field %v", field)
+	}
+	return id != "", err
+}
+
+// DeleteUsers removes the users and their addresses and cards, reporting
+// unknown ids individually
+func (d *DynamoDB) DeleteUsers(ctx context.Context, ids []string) (map[string]error, error) {
+	res := make(map[string]error, len(ids))
+	for _, id := range unique(ids) {
+		err := d.deleteUser(ctx, id)
+		if err != nil && err != ErrNotFound {
+			return res, err
+		}
+		res[id] = err
+		if err != nil {
+			continue
+		}
+		if err := d.replaceGroupUser(ctx, id, ""); err != nil {
+			return res, err
+		}
+		if err := d.moveActivity(ctx, id, ""); err != nil {
+			return res, err
+		}
+	}
+	return res, nil
+}
+
+// deleteUser removes the user with its claims, addresses and cards.
+func (d *DynamoDB) deleteUser(ctx context.Context, id string) error {
+	return retry(func() error {
+		u, version, err := d.getUser(ctx, id)
+		if err != nil {
+			return err
+		}
+		actions := []action{removeUser(id, version), release("username", users.NormalizeUsername(u.Username))}
+		if u.Email != "" {
+			actions = append(actions, release("email", u.Email))
+		}
+		for _, a := range u.Addresses {
+			actions = append(actions, remove(key("address", a.ID), "", nil, nil))
+		}
+		for _, ca := range u.Cards {
+			actions = append(actions, remove(key("card", ca.ID), "", nil, nil))
+		}
+		return d.write(ctx, actions...)
+	})
+}
+
+// Delete removes the entity with id. Deleting customers removes their
+// addresses and cards too.
+func (d *DynamoDB) Delete(ctx context.Context, entity, id string) error {
+	switch entity {
+	case "customers":
+		return d.deleteUser(ctx, id)
+	case "addresses":
+		return d.deleteOwned(ctx, "address", "addressIds", id)
+	case "cards":
+		return d.deleteOwned(ctx, "card", "cardIds", id)
+	case "groups":
+		return d.write(ctx, remove(key("group", id), exists, nil, ErrNotFound))
+	}
+	return fmt.Errorf("no entity %v", entity)
+}
+
+// deleteOwned removes the address or card with id, and takes it off its
+// owner.
+func (d *DynamoDB) deleteOwned(ctx context.Context, kind, ids, id string) error {
+	it, err := d.get(ctx, key(kind, id))
+	if err != nil {
+		return err
+	}
+	actions := []action{remove(key(kind, id), exists, nil, ErrNotFound)}
+	if owner := it.str("owner"); owner != "" {
+		actions = append(actions, update(key("user", owner), "DELETE #"+ids+" :ids ADD #version :one", exists,
+			item{":ids": strs(id), ":one": num(1)}, nil))
+	}
+	return d.write(ctx, actions...)
+}
@@ -0,0 +1,82 @@
+package dynamodb
+
+import (
+	"context"
+	"user/db"
+	"user/users"
+)
+
+// CreateWebhook stores the webhook
+func (d *DynamoDB) CreateWebhook(ctx context.Context, w *users.Webhook) error {
+	stored := *w
+	stored.ID = newID()
+	stored.CreatedAt = now()
+	if err := d.write(ctx, put(withKey(marshal(&stored), "webhook", stored.ID), "attribute_not_exists(#pk)", nil, nil)); err != nil {
+		return err
+	}
+	*w = stored
+	return nil
+}
+
+// GetWebhooks gets every webhook, oldest first
+func (d *DynamoDB) GetWebhooks(ctx context.Context) ([]users.Webhook, error) {
+	its, err := d.all(ctx, byKind("webhook", ""))
+	if err != nil {
+		return nil, err
+	}
+	ws := make([]users.Webhook, len(its))
+	for k, it := range its {
+		if err := unmarshal(it, &ws[k]); err != nil {
+			return nil, err
+		}
+		ws[k].ID = it.str("sk")
+	}
+	return ws, nil
+}
+
+// DeleteWebhook removes the webhook, its delivery log expires
+func (d *DynamoDB) DeleteWebhook(ctx context.Context, id string) error {
+	return d.write(ctx, remove(key("webhook", id), exists, nil, ErrNotFound))
+}
+
+// deliveryKey is the key of the delivery id. The log of each webhook is a
+// partition in id order.
+func deliveryKey(webhookID, id string) item {
+	return item{"pk": str("delivery#" + webhookID), "sk": str(id)}
+}
+
+// AddWebhookDelivery logs the delivery attempt, the time to live of the
+// table removes it once it expired
+func (d *DynamoDB) AddWebhookDelivery(ctx context.Context, wd *users.WebhookDelivery) error {
+	stored := *wd
+	stored.ID = newID()
+	stored.Time = now()
+	it := keyed(marshal(&stored), deliveryKey(stored.WebhookID, stored.ID))
+	it["expires"] = num(stored.Time.Add(db.WebhookDeliveryTTL).Unix())
+	if err := d.write(ctx, put(it, "", nil, nil)); err != nil {
+		return err
+	}
+	*wd = stored
+	return nil
+}
+
+// GetWebhookDeliveries returns up to limit deliveries to the webhook older
+// than the delivery before, newest first
+func (d *DynamoDB) GetWebhookDeliveries(ctx context.Context, webhookID, before string, n int) ([]users.WebhookDelivery, error) {
+	expired := now().Add(-db.WebhookDeliveryTTL)
+	ds := make([]users.WebhookDelivery, 0)
+	err := d.query(ctx, partition("delivery#"+webhookID, before), func(it item) (bool, error) {
+		var wd users.WebhookDelivery
+		if err := unmarshal(it, &wd); err != nil {
+			return false, err
+		}
+		wd.ID = it.str("sk")
+		// Deliveries outlive their time to live until DynamoDB gets to them.
+		if wd.Time.Before(expired) {
+			return false, nil
+		}
+		ds = append(ds, wd)
+		return n <= 0 || len(ds) < n, nil
+	})
+	return ds, err
+}
@@ -0,0 +1,275 @@
+package db
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The formats of the ids NewID generates.
+const (
+	// IDObjectID lays ids out like MongoDB ObjectIds, as 24 hex digits.
+	IDObjectID = "objectid"
+	// IDUUIDv7 generates time ordered UUIDs, as specified by RFC 9562.
+	IDUUIDv7 = "uuidv7"
+	// IDULID generates ULIDs, 26 digits of Crockford's base32.
+	IDULID = "ulid"
+)
+
+// IDFormat is the format of the ids of new users, addresses, cards and the
+// other entities the service creates.
+var IDFormat string
+
+func init() {
+	format := os.Getenv("ID_FORMAT")
+	if format == "" {
+		format = IDObjectID
+	}
+	flag.StringVar(&IDFormat, "id-format", format, "Format of new ids: objectid, uuidv7 or ulid")
+
+	var b [4]byte
+	rand.Read(idProcess[:])
+	rand.Read(b[:])
+	idCounter = binary.BigEndian.Uint32(b[:])
+}
+
+// ValidateIDFormat returns an error when IDFormat isn't one NewID knows.
+func ValidateIDFormat() error {
+	switch IDFormat {
+	case IDObjectID, IDUUIDv7, IDULID:
+		return nil
+	}
+	return fmt.Errorf("unknown id format %q, expected objectid, uuidv7 or ulid", IDFormat)
+}
+
+// NewID returns a new id in IDFormat. Ids of every format sort in the order
+// they were created, within a format.
+func NewID() string {
+	switch IDFormat {
+	case IDUUIDv7:
+		return newUUIDv7()
+	case IDULID:
+		return newULID()
+	}
+	return newObjectID()
+}
+
+var (
+	idProcess [5]byte
+	idCounter uint32
+)
+
+// newObjectID returns an id laid out like a MongoDB ObjectId: the creation
+// time in seconds, a random process value and a counter, as 24 hex digits.
+func newObjectID() string {
+	var b [12]byte
+	binary.BigEndian.PutUint32(b[:4], uint32(time.Now().Unix()))
+	copy(b[4:9], idProcess[:])
+	c := atomic.AddUint32(&idCounter, 1)
+	b[9], b[10], b[11] = byte(c>>16), byte(c>>8), byte(c)
+	return hex.EncodeToString(b[:])
+}
+
+// monotonic hands out the millisecond and sequence of the time ordered ids,
+// so ids generated within the same millisecond still sort in order.
+type monotonic struct {
+	mu   sync.Mutex
+	ms   uint64
+	last [16]byte
+}
+
+var (
+	uuids monotonic
+	ulids monotonic
+)
+
+// uuidCounterMax is the largest value of the 12 bit counter of UUIDv7s.
+const uuidCounterMax = 1<<12 - 1
+
+// newUUIDv7 returns a UUIDv7: the creation time in milliseconds, a 12 bit
+// counter starting at a random value below half its range each
+// millisecond, and 62 random bits. A counter running out moves on to the
+// next millisecond.
+func newUUIDv7() string {
+	g := &uuids
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var b [16]byte
+	rand.Read(b[:])
+	ms := uint64(time.Now().UnixMilli())
+	counter := uint16(b[6]&0x07)<<8 | uint16(b[7])
+	if ms <= g.ms {
+		ms = g.ms
+		last := uint16(g.last[6]&0x0f)<<8 | uint16(g.last[7])
+		if counter = last + 1; counter > uuidCounterMax {
+			ms, counter = ms+1, 0
+		}
+	}
+	putMillis(b[:], ms)
+	b[6], b[7] = 0x70|byte(counter>>8), byte(counter)
+	b[8] = 0x80 | b[8]&0x3f
+	g.ms, g.last = ms, b
+
+	return formatUUID(b)
+}
+
+// formatUUID spells b as a UUID, in lower case.
+func formatUUID(b [16]byte) string {
+	s := hex.EncodeToString(b[:])
+	return s[:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:]
+}
+
+// newULID returns a ULID: the creation time in milliseconds followed by 80
+// random bits, which count up from the previous ULID within a millisecond.
+func newULID() string {
+	g := &ulids
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var b [16]byte
+	ms := uint64(time.Now().UnixMilli())
+	if ms <= g.ms {
+		ms, b = g.ms, g.last
+		if !increment(b[6:]) {
+			ms++
+			rand.Read(b[6:])
+		}
+	} else {
+		rand.Read(b[6:])
+	}
+	putMillis(b[:], ms)
+	g.ms, g.last = ms, b
+	return encodeCrockford(b)
+}
+
+// putMillis writes ms as the 48 bit big endian timestamp starting b.
+func putMillis(b []byte, ms uint64) {
+	for k := 5; k >= 0; k-- {
+		b[k] = byte(ms)
+		ms >>= 8
+	}
+}
+
+// increment adds one to the big endian number b, reporting false when it
+// overflowed.
+func increment(b []byte) bool {
+	for k := len(b) - 1; k >= 0; k-- {
+		if b[k]++; b[k] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// crockford is the base32 alphabet of ULIDs, without I, L, O and U.
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// encodeCrockford encodes the 128 bits of b as 26 base32 digits, the first
+// one holding the top 3 bits.
+func encodeCrockford(b [16]byte) string {
+	hi, lo := binary.BigEndian.Uint64(b[:8]), binary.BigEndian.Uint64(b[8:])
+	var s [26]byte
+	for k := 25; k >= 0; k-- {
+		s[k] = crockford[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(s[:])
+}
+
+// FirstIDAt returns the smallest id in IDFormat generated at t. Ids of a
+// format compare in the order they were generated, so it separates the ids
+// generated before t from the others.
+func FirstIDAt(t time.Time) string {
+	var b [16]byte
+	switch IDFormat {
+	case IDUUIDv7:
+		putMillis(b[:], uint64(t.UnixMilli()))
+		b[6], b[8] = 0x70, 0x80
+		return formatUUID(b)
+	case IDULID:
+		putMillis(b[:], uint64(t.UnixMilli()))
+		return encodeCrockford(b)
+	}
+	binary.BigEndian.PutUint32(b[:4], uint32(t.Unix()))
+	return hex.EncodeToString(b[:12])
+}
+
+// ValidID reports whether id is an ObjectId, a UUID or a ULID, in any
+// spelling CanonicalID accepts.
+func ValidID(id string) bool {
+	switch len(id) {
+	case 24:
+		return isHex(id)
+	case 36:
+		return isUUID(id)
+	case 26:
+		return isULID(id)
+	}
+	return false
+}
+
+// CanonicalID returns id spelled the way NewID spells ids of its format:
+// ObjectIds and UUIDs in lower case, ULIDs in upper case with the letters
+// Crockford's base32 reads as digits replaced. Anything else is returned as
+// is, so ids of every format are accepted whichever one is generated.
+func CanonicalID(id string) string {
+	switch {
+	case len(id) == 24 && isHex(id):
+		return strings.ToLower(id)
+	case len(id) == 36 && isUUID(id):
+		return strings.ToLower(id)
+	case len(id) == 26 && isULID(id):
+		return ulidDigits.Replace(strings.ToUpper(id))
+	}
+	return id
+}
+
+// ulidDigits replaces the letters ULIDs may be typed with by their digits.
+var ulidDigits = strings.NewReplacer("I", "1", "L", "1", "O", "0")
+
+func isHex(s string) bool {
+	for k := 0; k < len(s); k++ {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", rune(s[k])) {
+			return false
+		}
+	}
+	return true
+}
+
+func isUUID(s string) bool {
+	for k := 0; k < len(s); k++ {
+		switch k {
+		case 8, 13, 18, 23:
+			if s[k] != '-' {
+				return false
+			}
+		default:
+			if !isHex(s[k : k+1]) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// isULID reports s is a ULID in any case, whose first digit only holds 3
+// bits.
+func isULID(s string) bool {
+	u := strings.ToUpper(s)
+	if u[0] > '7' {
+		return false
+	}
+	for k := 0; k < len(u); k++ {
+		if !strings.ContainsRune(crockford+"ILO", rune(u[k])) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,109 @@
+package db
+
+import (
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestNewID(t *testing.T) {
+	defer func(f string) { IDFormat = f }(IDFormat)
+	for format, shape := range map[string]*regexp.Regexp{
+		IDObjectID: regexp.MustCompile(`^[0-9a-f]{24}$`),
+		IDUUIDv7:   regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`),
+		IDULID:     regexp.MustCompile(`^[0-7][0-9A-HJKMNP-TV-Z]{25}$`),
+	} {
+		IDFormat = format
+		seen := map[string]bool{}
+		last := ""
+		// More than the 4096 UUIDv7s a millisecond counts to.
+		for k := 0; k < 5000; k++ {
+			id := NewID()
+			if !shape.MatchString(id) || seen[id] {
+				t.Fatalf("expected unique %v ids, got %v", format, id)
+			}
+			if format != IDObjectID && id <= last {
+				t.Fatalf("expected %v after %v", id, last)
+			}
+			if CanonicalID(id) != id {
+				t.Fatalf("expected %v canonical", id)
+			}
+			seen[id] = true
+			last = id
+		}
+	}
+	// ObjectIds of later seconds sort after.
+	IDFormat = IDObjectID
+	last := NewID()
+	time.Sleep(1100 * time.Millisecond)
+	if id := NewID(); id <= last {
+		t.Errorf("expected %v after %v", id, last)
+	}
+}
+
+func TestULIDOverflow(t *testing.T) {
+	defer func(f string) { IDFormat = f }(IDFormat)
+	IDFormat = IDULID
+	last := NewID()
+	ulids.mu.Lock()
+	ulids.ms += 1000
+	for k := 6; k < 16; k++ {
+		ulids.last[k] = 0xff
+	}
+	ulids.mu.Unlock()
+	if id := NewID(); id <= last {
+		t.Errorf("expected %v after %v", id, last)
+	}
+}
+
+func TestValidateIDFormat(t *testing.T) {
+	defer func(f string) { IDFormat = f }(IDFormat)
+	for format, valid := range map[string]bool{IDObjectID: true, IDUUIDv7: true, IDULID: true, "uuid": false, "": false} {
+		IDFormat = format
+		if err := ValidateIDFormat(); (err == nil) != valid {
+			t.Errorf("format %q: unexpected %v", format, err)
+		}
+	}
+}
+
+func TestCanonicalID(t *testing.T) {
+	for id, want := range map[string]string{
+		"57A98D98E4B00679B4A830AF":             "57a98d98e4b00679b4a830af",
+		"0190E8C5-3B1A-7C2D-8E3F-0123456789AB": "0190e8c5-3b1a-7c2d-8e3f-0123456789ab",
+		"01j1x8ybqk3e4f5g6h7j8k9mno":           "01J1X8YBQK3E4F5G6H7J8K9MN0",
+		"01ARZ3NDEKTSV4RRFFQ69G5FAI":           "01ARZ3NDEKTSV4RRFFQ69G5FA1",
+		"81ARZ3NDEKTSV4RRFFQ69G5FAV":           "81ARZ3NDEKTSV4RRFFQ69G5FAV",
+		"0190E8C5_3B1A-7C2D-8E3F-0123456789AB": "0190E8C5_3B1A-7C2D-8E3F-0123456789AB",
+		"Alice":                                "Alice",
+	} {
+		if got := CanonicalID(id); got != want {
+			t.Errorf("%v: expected %v, got %v", id, want, got)
+		}
+	}
+}
+
+func TestFirstIDAt(t *testing.T) {
+	defer func(f string) { IDFormat = f }(IDFormat)
+	for _, format := range []string{IDObjectID, IDUUIDv7, IDULID} {
+		IDFormat = format
+		at := time.Now().Add(-time.Second)
+		first := FirstIDAt(at)
+		if !ValidID(first) || CanonicalID(first) != first {
+			t.Errorf("%v: expected a canonical id, got %v", format, first)
+		}
+		if id := NewID(); id <= first || id >= FirstIDAt(time.Now().Add(2*time.Second)) {
+			t.Errorf("%v: expected %v between %v and the next seconds", format, id, first)
+		}
+	}
+	for id, valid := range map[string]bool{
+		"57a98d98e4b00679b4a830af":             true,
+		"0190e8c5-3b1a-7c2d-8e3f-0123456789ab": true,
+		"01J1X8YBQK3E4F5G6H7J8K9MN0":           true,
+		"81ARZ3NDEKTSV4RRFFQ69G5FAV":           false,
+		"Alice":                                false,
+	} {
+		if ValidID(id) != valid {
+			t.Errorf("%v: expected valid %v", id, valid)
+		}
+	}
+}
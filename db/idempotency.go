@@ -0,0 +1,19 @@
+package db
+
+import "time"
+
+// IdempotencyKeyTTL is how long idempotency keys are kept, retries after
+// that create another resource.
+const IdempotencyKeyTTL = 24 * time.Hour
+
+// IdempotencyKey records a request made with an Idempotency-Key header, so
+// retries of it return the resource it created instead of another one.
+type IdempotencyKey struct {
+	Key string `bson:"_id"`
+	// Fingerprint identifies the request the key was first used with.
+	Fingerprint string `bson:"fingerprint"`
+	// ResultID is the id of the created resource, empty while the request
+	// is in progress.
+	ResultID  string    `bson:"resultId,omitempty"`
+	CreatedAt time.Time `bson:"createdAt"`
+}
@@ -0,0 +1,40 @@
+package inmem
+
+import (
+	"context"
+	"sort"
+
+	"user/users"
+)
+
+func cloneActivity(a users.Activity) users.Activity {
+	a.Details = cloneStrings(a.Details)
+	return a
+}
+
+// AddActivity appends a to the activity feed of its user
+func (m *Memory) AddActivity(ctx context.Context, a *users.Activity) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored := cloneActivity(*a)
+	stored.ID = newID()
+	stored.Time = now()
+	m.activity[stored.ID] = cloneActivity(stored)
+	*a = stored
+	return nil
+}
+
+// GetActivity returns up to limit entries of the activity feed of the user
+// older than the entry before, newest first
+func (m *Memory) GetActivity(ctx context.Context, userID, before string, n int) ([]users.Activity, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	as := make([]users.Activity, 0)
+	for id, a := range m.activity {
+		if a.UserID == userID && (before == "" || id < before) {
+			as = append(as, cloneActivity(a))
+		}
+	}
+	sort.Slice(as, func(i, j int) bool { return as[i].ID > as[j].ID })
+	return as[:limit(n, len(as))], nil
+}
@@ -0,0 +1,409 @@
+package inmem
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"user/db"
+	"user/users"
+)
+
+func cloneAddress(a users.Address) users.Address {
+	if a.Location != nil {
+		l := *a.Location
+		a.Location = &l
+	}
+	a.Links = nil
+	return a
+}
+
+func cloneCard(ca users.Card) users.Card {
+	if ca.DeletedAt != nil {
+		t := *ca.DeletedAt
+		ca.DeletedAt = &t
+	}
+	ca.Links = nil
+	return ca
+}
+
+// insertAddress stores a with a new id, its timestamps are set by the
+// caller.
+func (m *Memory) insertAddress(a users.Address, owner string) string {
+	a.ID = newID()
+	m.addresses[a.ID] = &address{Address: cloneAddress(a), owner: owner}
+	return a.ID
+}
+
+// insertCard stores ca with a new id, its timestamps are set by the caller.
+func (m *Memory) insertCard(ca users.Card, owner string) string {
+	ca.ID = newID()
+	m.cards[ca.ID] = &card{Card: cloneCard(ca), owner: owner}
+	return ca.ID
+}
+
+// clearDefaultAddress takes the default flag off the other addresses of the
+// user with the given type.
+func (m *Memory) clearDefaultAddress(owner, keep, typ string) {
+	at := now()
+	for id, a := range m.addresses {
+		if a.owner == owner && id != keep && a.Type == typ && a.Default {
+			a.Default = false
+			a.UpdatedAt = at
+		}
+	}
+}
+
+// exists fails with ErrNotFound unless there is a user with id, empty ids
+// of anonymous owners exist.
+func (m *Memory) exists(id string) error {
+	if _, ok := m.users[id]; id != "" && !ok {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// GetUserAttributes given a user, load all cards and addresses connected to that user
+func (m *Memory) GetUserAttributes(ctx context.Context, u *users.User) error {
+	us := []users.User{*u}
+	if err := m.ExpandUsers(ctx, us, db.Expandable); err != nil {
+		return err
+	}
+	*u = us[0]
+	return nil
+}
+
+// ExpandUsers replaces the ids of the named attributes of the users,
+// addresses or cards, with the stored ones
+func (m *Memory) ExpandUsers(ctx context.Context, us []users.User, attrs []string) error {
+	for _, attr := range attrs {
+		if attr != "addresses" && attr != "cards" {
+			return fmt.Errorf("no attribute %v", attr)
+		}
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, attr := range attrs {
+		for k := range us {
+			if attr == "addresses" {
+				as := make([]users.Address, 0, len(us[k].Addresses))
+				for _, a := range us[k].Addresses {
+					if stored, ok := m.addresses[a.ID]; ok {
+						as = append(as, cloneAddress(stored.Address))
+					}
+				}
+				us[k].Addresses = as
+				continue
+			}
+			cs := make([]users.Card, 0, len(us[k].Cards))
+			for _, ca := range us[k].Cards {
+				if stored, ok := m.cards[ca.ID]; ok {
+					cs = append(cs, cloneCard(stored.Card))
+				}
+			}
+			us[k].Cards = cs
+		}
+	}
+	return nil
+}
+
+// GetCard Gets card by id
+func (m *Memory) GetCard(ctx context.Context, id string) (users.Card, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	ca, ok := m.cards[id]
+	if !ok {
+		return users.Card{}, ErrNotFound
+	}
+	return cloneCard(ca.Card), nil
+}
+
+// sortedCards returns the cards passing keep in id order.
+func (m *Memory) sortedCards(keep func(*card) bool) []*card {
+	cs := make([]*card, 0)
+	for _, ca := range m.cards {
+		if keep(ca) {
+			cs = append(cs, ca)
+		}
+	}
+	sort.Slice(cs, func(i, j int) bool { return cs[i].ID < cs[j].ID })
+	return cs
+}
+
+// GetCards Gets all cards
+func (m *Memory) GetCards(ctx context.Context) ([]users.Card, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	stored := m.sortedCards(func(ca *card) bool { return ca.DeletedAt == nil })
+	cs := make([]users.Card, len(stored))
+	for k, ca := range stored {
+		cs[k] = cloneCard(ca.Card)
+	}
+	return cs, nil
+}
+
+// GetCardsByID gets the cards with the given ids, unknown ids and deleted
+// cards are left out
+func (m *Memory) GetCardsByID(ctx context.Context, ids []string) ([]users.Card, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	cs := make([]users.Card, 0, len(ids))
+	for _, id := range ids {
+		if ca, ok := m.cards[id]; ok && ca.DeletedAt == nil {
+			cs = append(cs, cloneCard(ca.Card))
+		}
+	}
+	return cs, nil
+}
+
+// ListCards returns up to limit cards after the given id in id order, with
+// the customers owning them. Deleted cards are left out.
+func (m *Memory) ListCards(ctx context.Context, after string, n int) ([]db.OwnedCard, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	stored := m.sortedCards(func(ca *card) bool { return ca.DeletedAt == nil && ca.ID > after })
+	cs := make([]db.OwnedCard, limit(n, len(stored)))
+	for k := range cs {
+		cs[k] = db.OwnedCard{Card: cloneCard(stored[k].Card), UserID: stored[k].owner}
+	}
+	return cs, nil
+}
+
+// CreateCard stores the card, owned by userid unless it is empty
+func (m *Memory) CreateCard(ctx context.Context, ca *users.Card, userid string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.exists(userid); err != nil {
+		return err
+	}
+	stored := cloneCard(*ca)
+	stored.CreatedAt = now()
+	stored.UpdatedAt = stored.CreatedAt
+	stored.ID = m.insertCard(stored, userid)
+	*ca = stored
+	return nil
+}
+
+// UpdateCard sets the expiry and holder of the card, the number is never
+// changed
+func (m *Memory) UpdateCard(ctx context.Context, id string, u users.CardUpdate) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ca, ok := m.cards[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if u.Expires != nil {
+		ca.Expires = *u.Expires
+	}
+	if u.Holder != nil {
+		ca.Holder = *u.Holder
+	}
+	ca.UpdatedAt = now()
+	return nil
+}
+
+// SetDefaultCard makes the card the default of the user, failing with
+// ErrNotFound unless the card is one of theirs
+func (m *Memory) SetDefaultCard(ctx context.Context, userID, cardID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[userID]
+	if ca, found := m.cards[cardID]; !ok || !found || ca.owner != userID {
+		return ErrNotFound
+	}
+	u.DefaultCard = cardID
+	u.UpdatedAt = now()
+	return nil
+}
+
+// SetCardVerification stores the outcome of verifying a pending card.
+// Cards no longer pending are left alone.
+func (m *Memory) SetCardVerification(ctx context.Context, id, status string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if ca, ok := m.cards[id]; ok && ca.Verification == users.VerificationPending {
+		ca.Verification = status
+		ca.UpdatedAt = now()
+	}
+	return nil
+}
+
+// SetCardReminded records that the owner of the card was reminded of the
+// expiry
+func (m *Memory) SetCardReminded(ctx context.Context, id, expires string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ca, ok := m.cards[id]
+	if !ok {
+		return ErrNotFound
+	}
+	ca.RemindedFor = expires
+	return nil
+}
+
+// TombstoneCard keeps only the masked number of the card, drops its token
+// and takes it off its owner. Cards already deleted fail with ErrNotFound
+func (m *Memory) TombstoneCard(ctx context.Context, id, masked, replacedBy string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ca, ok := m.cards[id]
+	if !ok || ca.DeletedAt != nil {
+		return ErrNotFound
+	}
+	at := now()
+	ca.LongNum, ca.Token, ca.owner = masked, "", ""
+	ca.DeletedAt, ca.UpdatedAt = &at, at
+	if replacedBy != "" {
+		ca.ReplacedBy = replacedBy
+	}
+	for _, u := range m.users {
+		if u.DefaultCard == id {
+			u.DefaultCard = ""
+		}
+	}
+	return nil
+}
+
+// GetAddress Gets an address by id
+func (m *Memory) GetAddress(ctx context.Context, id string) (users.Address, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	a, ok := m.addresses[id]
+	if !ok {
+		return users.Address{}, ErrNotFound
+	}
+	return cloneAddress(a.Address), nil
+}
+
+// GetAddresses gets all addresses
+func (m *Memory) GetAddresses(ctx context.Context) ([]users.Address, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	as := make([]users.Address, 0, len(m.addresses))
+	for _, a := range m.addresses {
+		as = append(as, cloneAddress(a.Address))
+	}
+	sort.Slice(as, func(i, j int) bool { return as[i].ID < as[j].ID })
+	return as, nil
+}
+
+// GetAddressesByID gets the addresses with the given ids, unknown ids are
+// left out
+func (m *Memory) GetAddressesByID(ctx context.Context, ids []string) ([]users.Address, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	as := make([]users.Address, 0, len(ids))
+	for _, id := range ids {
+		if a, ok := m.addresses[id]; ok {
+			as = append(as, cloneAddress(a.Address))
+		}
+	}
+	return as, nil
+}
+
+// CreateAddress stores the address, owned by userid unless it is empty
+func (m *Memory) CreateAddress(ctx context.Context, a *users.Address, userid string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.exists(userid); err != nil {
+		return err
+	}
+	stored := cloneAddress(*a)
+	stored.CreatedAt = now()
+	stored.UpdatedAt = stored.CreatedAt
+	stored.ID = m.insertAddress(stored, userid)
+	if userid != "" && stored.Default {
+		m.clearDefaultAddress(userid, stored.ID, stored.Type)
+	}
+	*a = stored
+	return nil
+}
+
+// CreateAddresses stores the addresses and adds them to the user, setting
+// their ids.
+func (m *Memory) CreateAddresses(ctx context.Context, as []users.Address, userid string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.exists(userid); err != nil {
+		return err
+	}
+	at := now()
+	stored := make([]users.Address, len(as))
+	for k, a := range as {
+		stored[k] = cloneAddress(a)
+		stored[k].CreatedAt, stored[k].UpdatedAt = at, at
+		stored[k].ID = m.insertAddress(stored[k], userid)
+	}
+	for _, a := range stored {
+		if userid != "" && a.Default {
+			m.clearDefaultAddress(userid, a.ID, a.Type)
+		}
+	}
+	copy(as, stored)
+	return nil
+}
+
+// SetAddressLocation stores the outcome of geocoding a pending address.
+// Addresses no longer pending are left alone.
+func (m *Memory) SetAddressLocation(ctx context.Context, id string, l *users.Location, status string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	a, ok := m.addresses[id]
+	if !ok || a.Geocode != users.GeocodePending {
+		return nil
+	}
+	a.Geocode = status
+	a.UpdatedAt = now()
+	if l != nil {
+		loc := *l
+		a.Location = &loc
+	}
+	return nil
+}
+
+// UpdateAddress replaces the address with id, keeping when it was created.
+// A default address stops being the default of its type for its owner's
+// other addresses.
+func (m *Memory) UpdateAddress(ctx context.Context, id string, a *users.Address) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	old, ok := m.addresses[id]
+	if !ok {
+		return ErrNotFound
+	}
+	stored := cloneAddress(*a)
+	stored.ID = id
+	stored.CreatedAt = old.CreatedAt
+	stored.UpdatedAt = now()
+	m.addresses[id] = &address{Address: cloneAddress(stored), owner: old.owner}
+	// Addresses of anonymous users have no owner.
+	if stored.Default && old.owner != "" {
+		m.clearDefaultAddress(old.owner, id, stored.Type)
+	}
+	*a = stored
+	return nil
+}
+
+// OwnerOf returns the id of the user owning the address or card id
+func (m *Memory) OwnerOf(ctx context.Context, entity, id string) (string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var owner string
+	switch entity {
+	case "addresses":
+		if a, ok := m.addresses[id]; ok {
+			owner = a.owner
+		}
+	case "cards":
+		if ca, ok := m.cards[id]; ok {
+			owner = ca.owner
+		}
+	default:
+		return "", fmt.Errorf("no owner of %v", entity)
+	}
+	if owner == "" {
+		return "", ErrNotFound
+	}
+	return owner, nil
+}
@@ -0,0 +1,120 @@
+package inmem
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"user/users"
+)
+
+// Fixture is the JSON seeding a Memory. Ids are kept where given, so
+// other services of a demo can refer to them.
+type Fixture struct {
+	Users []FixtureUser `json:"users"`
+}
+
+// FixtureUser is a user of a Fixture with its addresses and cards, and the
+// fields the API never returns. Password is the hash of the salt and the
+// password as the service stores it.
+type FixtureUser struct {
+	User      users.User
+	Email     string
+	Password  string
+	Salt      string
+	Addresses []users.Address
+	Cards     []users.Card
+}
+
+// UnmarshalJSON reads the fields of the user and the others from the same
+// object.
+func (f *FixtureUser) UnmarshalJSON(b []byte) error {
+	var hidden struct {
+		Email     string          `json:"email"`
+		Password  string          `json:"password"`
+		Salt      string          `json:"salt"`
+		Addresses []users.Address `json:"addresses"`
+		Cards     []users.Card    `json:"cards"`
+	}
+	if err := json.Unmarshal(b, &hidden); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, &f.User); err != nil {
+		return err
+	}
+	f.Email, f.Password, f.Salt = hidden.Email, hidden.Password, hidden.Salt
+	f.Addresses, f.Cards = hidden.Addresses, hidden.Cards
+	return nil
+}
+
+// seed stores the users of fx like registrations, normalized and
+// encrypted as configured.
+func (m *Memory) seed(fx Fixture) error {
+	at := now()
+	for _, f := range fx.Users {
+		u := cloneUser(f.User)
+		u.Email, u.Password, u.Salt = users.NormalizeEmail(f.Email), f.Password, f.Salt
+		u.Phone = users.NormalizePhone(u.Phone)
+		if u.UserID == "" {
+			u.UserID = newID()
+		}
+		if _, ok := m.users[u.UserID]; ok {
+			return fmt.Errorf("fixture user %v: id used twice", u.UserID)
+		}
+		if err := m.usernameFree(u.Username, ""); err != nil {
+			return err
+		}
+		if err := m.emailFree(u.Email, ""); err != nil {
+			return err
+		}
+		if u.CreatedAt.IsZero() {
+			u.CreatedAt = at
+		}
+		if u.UpdatedAt.IsZero() {
+			u.UpdatedAt = u.CreatedAt
+		}
+		if m.Cipher != nil {
+			m.Cipher.Encrypt(&u)
+		}
+		u.Addresses, u.Cards, u.Links = nil, nil, nil
+		m.users[u.UserID] = &u
+		for _, a := range f.Addresses {
+			a.CreatedAt, a.UpdatedAt = u.CreatedAt, u.CreatedAt
+			if err := m.seedAddress(a, u.UserID); err != nil {
+				return err
+			}
+		}
+		for _, ca := range f.Cards {
+			ca.CreatedAt, ca.UpdatedAt = u.CreatedAt, u.CreatedAt
+			ca.CCV = ""
+			if m.CardCipher != nil {
+				m.CardCipher.Encrypt(&ca)
+			}
+			if err := m.seedCard(ca, u.UserID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (m *Memory) seedAddress(a users.Address, owner string) error {
+	if a.ID == "" {
+		a.ID = newID()
+	}
+	if _, ok := m.addresses[a.ID]; ok {
+		return fmt.Errorf("fixture address %v: id used twice", a.ID)
+	}
+	m.addresses[a.ID] = &address{Address: cloneAddress(a), owner: owner}
+	return nil
+}
+
+func (m *Memory) seedCard(ca users.Card, owner string) error {
+	if ca.ID == "" {
+		ca.ID = newID()
+	}
+	if _, ok := m.cards[ca.ID]; ok {
+		return fmt.Errorf("fixture card %v: id used twice", ca.ID)
+	}
+	m.cards[ca.ID] = &card{Card: cloneCard(ca), owner: owner}
+	return nil
+}
@@ -0,0 +1,91 @@
+package inmem
+
+import (
+	"context"
+	"sort"
+
+	"user/users"
+)
+
+func cloneGroup(g users.Group) users.Group {
+	g.Owners = append(make([]string, 0, len(g.Owners)), g.Owners...)
+	g.Members = append(make([]string, 0, len(g.Members)), g.Members...)
+	g.Links = nil
+	return g
+}
+
+// unique returns the ids without repeats, in their first order.
+func unique(ids []string) []string {
+	u := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if !contains(u, id) {
+			u = append(u, id)
+		}
+	}
+	return u
+}
+
+// CreateGroup stores the group with its owners and members
+func (m *Memory) CreateGroup(ctx context.Context, g *users.Group) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored := cloneGroup(*g)
+	stored.ID = newID()
+	stored.CreatedAt = now()
+	stored.Owners, stored.Members = unique(stored.Owners), unique(stored.Members)
+	kept := cloneGroup(stored)
+	m.groups[stored.ID] = &kept
+	*g = stored
+	return nil
+}
+
+// GetGroup gets a group by id
+func (m *Memory) GetGroup(ctx context.Context, id string) (users.Group, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	g, ok := m.groups[id]
+	if !ok {
+		return users.Group{}, ErrNotFound
+	}
+	return cloneGroup(*g), nil
+}
+
+// GetUserGroups gets the groups the user owns or is a member of
+func (m *Memory) GetUserGroups(ctx context.Context, userID string) ([]users.Group, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	gs := make([]users.Group, 0)
+	for _, g := range m.groups {
+		if contains(g.Owners, userID) || contains(g.Members, userID) {
+			gs = append(gs, cloneGroup(*g))
+		}
+	}
+	sort.Slice(gs, func(i, j int) bool { return gs[i].ID < gs[j].ID })
+	return gs, nil
+}
+
+// AddGroupMember adds the user to the group members
+func (m *Memory) AddGroupMember(ctx context.Context, groupID, userID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	g, ok := m.groups[groupID]
+	if !ok {
+		return ErrNotFound
+	}
+	if !contains(g.Members, userID) {
+		g.Members = append(g.Members, userID)
+	}
+	return nil
+}
+
+// RemoveGroupMember removes the user from the group members
+func (m *Memory) RemoveGroupMember(ctx context.Context, groupID, userID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	g, ok := m.groups[groupID]
+	if !ok {
+		return ErrNotFound
+	}
+	g.Members = remove(g.Members, userID)
+	return nil
+}
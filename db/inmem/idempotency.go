@@ -0,0 +1,55 @@
+package inmem
+
+import "context"
+import "user/db"
+
+// CreateIdempotencyKey stores the key, failing with db.ErrConflict if it is
+// already in use. Expired keys are removed first.
+func (m *Memory) CreateIdempotencyKey(ctx context.Context, k *db.IdempotencyKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k.CreatedAt = now()
+	expired := k.CreatedAt.Add(-db.IdempotencyKeyTTL)
+	for key, stored := range m.keys {
+		if stored.CreatedAt.Before(expired) {
+			delete(m.keys, key)
+		}
+	}
+	if _, ok := m.keys[k.Key]; ok {
+		return db.ErrConflict
+	}
+	m.keys[k.Key] = *k
+	return nil
+}
+
+// GetIdempotencyKey gets the key unless it expired
+func (m *Memory) GetIdempotencyKey(ctx context.Context, key string) (db.IdempotencyKey, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	k, ok := m.keys[key]
+	if !ok || k.CreatedAt.Before(now().Add(-db.IdempotencyKeyTTL)) {
+		return db.IdempotencyKey{}, ErrNotFound
+	}
+	return k, nil
+}
+
+// SetIdempotencyResult records the id of the resource created under key
+func (m *Memory) SetIdempotencyResult(ctx context.Context, key, resultID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k, ok := m.keys[key]
+	if !ok {
+		return ErrNotFound
+	}
+	k.ResultID = resultID
+	m.keys[key] = k
+	return nil
+}
+
+// DeleteIdempotencyKey removes the key, so it can be used again
+func (m *Memory) DeleteIdempotencyKey(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.keys, key)
+	return nil
+}
@@ -0,0 +1,167 @@
+// Package inmem keeps the data of the service in memory, for running it
+// locally and in CI without a database server. Nothing survives a restart,
+// the data can be seeded from a JSON Fixture on Init.
+package inmem
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"os"
+	"sync"
+	"time"
+
+	"user/db"
+	"user/pii"
+	"user/users"
+)
+
+var (
+	fixture string
+	//ErrNotFound is returned when no stored entity matches, like mgo.ErrNotFound and sql.ErrNoRows
+	ErrNotFound = errors.New("not found")
+)
+
+func init() {
+	flag.StringVar(&fixture, "inmem-fixture", os.Getenv("INMEM_FIXTURE"), "JSON file seeding the in-memory database")
+}
+
+// Memory meets the Database interface requirements. It is safe for
+// concurrent use, every method holds the lock for its whole run so writes
+// are atomic like the transactions of the SQL databases.
+type Memory struct {
+	// Fixture is the JSON file seeding the database, the -inmem-fixture
+	// flag when empty. No file leaves the database empty.
+	Fixture string
+	// Cipher and CardCipher are those of the Store the database is used
+	// by, the fixture is encrypted with them.
+	Cipher, CardCipher *pii.Cipher
+
+	mu         sync.RWMutex
+	users      map[string]*users.User
+	addresses  map[string]*address
+	cards      map[string]*card
+	aliases    map[string]alias
+	groups     map[string]*users.Group
+	activity   map[string]users.Activity
+	keys       map[string]db.IdempotencyKey
+	webhooks   map[string]users.Webhook
+	deliveries map[string]users.WebhookDelivery
+	tenants    map[string]*Memory
+}
+
+// address is a stored address with the id of the user owning it, empty for
+// anonymous users.
+type address struct {
+	users.Address
+	owner string
+}
+
+// card is a stored card with the id of the user owning it, empty for
+// anonymous users and deleted cards.
+type card struct {
+	users.Card
+	owner string
+}
+
+// alias records the user a merged user went into.
+type alias struct {
+	target   string
+	mergedAt time.Time
+}
+
+// Init empties the database and loads the fixture.
+func (m *Memory) Init() error {
+	if m.Fixture == "" {
+		m.Fixture = fixture
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reset()
+	if m.Fixture == "" {
+		return nil
+	}
+	f, err := os.Open(m.Fixture)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var fx Fixture
+	if err := json.NewDecoder(f).Decode(&fx); err != nil {
+		return err
+	}
+	return m.seed(fx)
+}
+
+func (m *Memory) reset() {
+	m.users = make(map[string]*users.User)
+	m.addresses = make(map[string]*address)
+	m.cards = make(map[string]*card)
+	m.aliases = make(map[string]alias)
+	m.groups = make(map[string]*users.Group)
+	m.activity = make(map[string]users.Activity)
+	m.keys = make(map[string]db.IdempotencyKey)
+	m.webhooks = make(map[string]users.Webhook)
+	m.deliveries = make(map[string]users.WebhookDelivery)
+}
+
+// Tenant returns the database of a tenant, an empty Memory created on
+// first use. Fixtures only seed the database of no tenant.
+func (m *Memory) Tenant(id string) (db.Database, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if t, ok := m.tenants[id]; ok {
+		return t, nil
+	}
+	t := &Memory{}
+	t.reset()
+	if m.tenants == nil {
+		m.tenants = make(map[string]*Memory)
+	}
+	m.tenants[id] = t
+	return t, nil
+}
+
+// Ping always succeeds.
+func (m *Memory) Ping(ctx context.Context) error {
+	return nil
+}
+
+// now is the current time at the precision the service stores.
+func now() time.Time {
+	return time.Now().UTC().Truncate(time.Millisecond)
+}
+
+// newID returns ids like those of the other databases, sorting in the order
+// they were created.
+func newID() string {
+	return db.NewID()
+}
+
+// limit returns the first n of l entries, all for zero like MongoDB.
+func limit(n, l int) int {
+	if n <= 0 || n > l {
+		return l
+	}
+	return n
+}
+
+func contains(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func remove(ss []string, s string) []string {
+	kept := ss[:0]
+	for _, v := range ss {
+		if v != s {
+			kept = append(kept, v)
+		}
+	}
+	return kept
+}
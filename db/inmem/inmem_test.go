@@ -0,0 +1,161 @@
+package inmem
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"user/db"
+	"user/users"
+)
+
+var (
+	_ db.Database = &Memory{}
+	_ db.Tenanted = &Memory{}
+)
+
+func TestFixture(t *testing.T) {
+	ctx := context.Background()
+	m := &Memory{Fixture: "../../docker/user-db/fixture.json"}
+	if err := m.Init(); err != nil {
+		t.Fatal(err)
+	}
+	u, err := m.GetUserByName(ctx, "eve_berger")
+	if err != nil || u.UserID != "57a98d98e4b00679b4a830af" || u.Salt != "c748112bc027878aa62812ba1ae00e40ad46d497" {
+		t.Fatalf("expected Eve with her id and salt, got %+v %v", u, err)
+	}
+	if err := m.GetUserAttributes(ctx, &u); err != nil || len(u.Addresses) != 1 || u.Addresses[0].City != "Glasgow" ||
+		len(u.Cards) != 1 || u.Cards[0].LongNum != "5953580604169678" {
+		t.Errorf("expected the address and card of Eve, got %+v %+v %v", u.Addresses, u.Cards, err)
+	}
+	if owner, err := m.OwnerOf(ctx, "cards", "57a98d98e4b00679b4a830b4"); err != nil || owner != "57a98d98e4b00679b4a830b5" {
+		t.Errorf("expected the card of user1, got %v %v", owner, err)
+	}
+
+	if err := (&Memory{Fixture: "missing.json"}).Init(); err == nil {
+		t.Error("expected a missing fixture to fail")
+	}
+}
+
+func TestMemory(t *testing.T) {
+	ctx := context.Background()
+	m := &Memory{}
+	if err := m.Init(); err != nil {
+		t.Fatal(err)
+	}
+	u := users.User{Username: "Eve", Email: "eve@example.com", Tags: []string{"vip", "vip"},
+		Addresses: []users.Address{{Street: "street", Type: users.AddressBilling, Default: true}},
+		Cards:     []users.Card{{LongNum: "4111111111111111", Expires: "01/30"}}}
+	if err := m.CreateUser(ctx, &u); err != nil {
+		t.Fatal(err)
+	}
+	got, err := m.GetUserByName(ctx, "eve")
+	if err != nil || got.UserID != u.UserID || len(got.Addresses) != 1 || len(got.Cards) != 1 || len(got.Tags) != 1 {
+		t.Fatalf("expected the created user, got %+v %v", got, err)
+	}
+	got.Tags[0] = "changed"
+	if again, _ := m.GetUser(ctx, u.UserID); again.Tags[0] != "vip" {
+		t.Error("expected stored users not to share their tags with callers")
+	}
+	for _, dup := range []users.User{{Username: "EVE"}, {Username: "eve2", Email: "eve@example.com"}} {
+		if err := m.CreateUser(ctx, &dup); !errors.Is(err, db.ErrConflict) {
+			t.Errorf("expected a conflict creating %v, got %v", dup.Username, err)
+		}
+	}
+
+	if err := m.RenameUser(ctx, u.UserID, "eve2"); err != nil {
+		t.Fatal(err)
+	}
+	if prev, err := m.GetUserByPreviousName(ctx, "Eve", time.Now().Add(-time.Minute)); err != nil || prev.UserID != u.UserID {
+		t.Errorf("expected the renamed user, got %+v %v", prev, err)
+	}
+	v := "1"
+	if err := m.UpdateUser(ctx, u.UserID, users.ProfileUpdate{Metadata: map[string]*string{"crm": &v}}); err != nil {
+		t.Fatal(err)
+	}
+	if us, err := m.GetUsers(ctx, db.UserQuery{Metadata: map[string]string{"crm": "1"}, Tag: "vip"}); err != nil || len(us) != 1 {
+		t.Errorf("expected the user by metadata and tag, got %v %v", us, err)
+	}
+
+	other := users.User{Username: "mallory", Tags: []string{"new"}}
+	if err := m.CreateUser(ctx, &other); err != nil {
+		t.Fatal(err)
+	}
+	if us, err := m.GetUsers(ctx, db.UserQuery{Sort: "-username"}); err != nil || len(us) != 2 || us[0].UserID != other.UserID {
+		t.Errorf("expected mallory first, got %v %v", us, err)
+	}
+	if us, err := m.GetUsers(ctx, db.UserQuery{Sort: "-username", Limit: 1}); err != nil || len(us) != 1 || us[0].UserID != other.UserID {
+		t.Errorf("expected only mallory, got %v %v", us, err)
+	}
+	if err := m.MergeUsers(ctx, u.UserID, other.UserID, users.ProfileUpdate{}); err != nil {
+		t.Fatal(err)
+	}
+	if target, err := m.ResolveAlias(ctx, other.UserID); err != nil || target != u.UserID {
+		t.Errorf("expected an alias of the merged user, got %v %v", target, err)
+	}
+	if err := m.SetDefaultCard(ctx, u.UserID, u.Cards[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.TombstoneCard(ctx, u.Cards[0].ID, "************1111", ""); err != nil {
+		t.Fatal(err)
+	}
+	if cs, err := m.GetCardsByID(ctx, []string{u.Cards[0].ID}); err != nil || len(cs) != 0 {
+		t.Errorf("expected the deleted card left out, got %v %v", cs, err)
+	}
+	if got, _ := m.GetUser(ctx, u.UserID); got.DefaultCard != "" || len(got.Cards) != 0 {
+		t.Errorf("expected the deleted card taken off the user, got %+v", got)
+	}
+	res, err := m.DeleteUsers(ctx, []string{u.UserID, "missing"})
+	if err != nil || res[u.UserID] != nil || res["missing"] != ErrNotFound {
+		t.Errorf("unexpected deletions %v %v", res, err)
+	}
+	if as, _ := m.GetAddresses(ctx); len(as) != 0 {
+		t.Errorf("expected the addresses deleted with their user, got %v", as)
+	}
+}
+
+func TestConcurrentCreate(t *testing.T) {
+	ctx := context.Background()
+	m := &Memory{}
+	m.Init()
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for k := 0; k < 20; k++ {
+		wg.Add(1)
+		go func(k int) {
+			defer wg.Done()
+			errs <- m.CreateUser(ctx, &users.User{Username: fmt.Sprintf("user%v", k%10)})
+		}(k)
+	}
+	wg.Wait()
+	close(errs)
+	conflicts := 0
+	for err := range errs {
+		if errors.Is(err, db.ErrConflict) {
+			conflicts++
+		}
+	}
+	if us, _ := m.ListUsers(ctx, "", 0); len(us) != 10 || conflicts != 10 {
+		t.Errorf("expected 10 users and 10 conflicts, got %v and %v", len(us), conflicts)
+	}
+}
+
+func TestTenant(t *testing.T) {
+	ctx := context.Background()
+	m := &Memory{}
+	m.Init()
+	m.CreateUser(ctx, &users.User{Username: "eve"})
+	tm, err := m.Tenant("acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tm.GetUserByName(ctx, "eve"); err != ErrNotFound {
+		t.Errorf("expected the tenant not to see other users, got %v", err)
+	}
+	if again, _ := m.Tenant("acme"); again != tm {
+		t.Error("expected the same database for a tenant")
+	}
+}
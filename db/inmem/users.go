@@ -0,0 +1,669 @@
+package inmem
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"user/db"
+	"user/users"
+)
+
+// cloneUser copies u, so stored users share nothing with callers.
+func cloneUser(u users.User) users.User {
+	u.Roles = append([]string(nil), u.Roles...)
+	u.Tags = append([]string(nil), u.Tags...)
+	u.UsernameHistory = append([]users.UsernameChange(nil), u.UsernameHistory...)
+	u.Avatar = cloneStrings(u.Avatar)
+	u.Metadata = cloneStrings(u.Metadata)
+	if u.LastLoginAt != nil {
+		t := *u.LastLoginAt
+		u.LastLoginAt = &t
+	}
+	if u.Preferences != nil {
+		p := *u.Preferences
+		u.Preferences = &p
+	}
+	if u.PhoneCode != nil {
+		c := *u.PhoneCode
+		u.PhoneCode = &c
+	}
+	as := make([]users.Address, len(u.Addresses))
+	for k, a := range u.Addresses {
+		as[k] = cloneAddress(a)
+	}
+	u.Addresses = as
+	cs := make([]users.Card, len(u.Cards))
+	for k, ca := range u.Cards {
+		cs[k] = cloneCard(ca)
+	}
+	u.Cards = cs
+	return u
+}
+
+func cloneStrings(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	c := make(map[string]string, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+// user returns a copy of the stored user with the ids of its addresses and
+// cards, failing with ErrNotFound for unknown ids.
+func (m *Memory) user(id string) (users.User, error) {
+	u, ok := m.users[id]
+	if !ok {
+		return users.New(), ErrNotFound
+	}
+	us := []users.User{cloneUser(*u)}
+	m.loadLinks(us)
+	return us[0], nil
+}
+
+// loadLinks fills in the ids of the addresses and cards of us, in id order.
+func (m *Memory) loadLinks(us []users.User) {
+	byID := make(map[string]*users.User, len(us))
+	for k := range us {
+		us[k].Addresses = make([]users.Address, 0)
+		us[k].Cards = make([]users.Card, 0)
+		byID[us[k].UserID] = &us[k]
+	}
+	for id, a := range m.addresses {
+		if u, ok := byID[a.owner]; ok {
+			u.Addresses = append(u.Addresses, users.Address{ID: id})
+		}
+	}
+	for id, ca := range m.cards {
+		if u, ok := byID[ca.owner]; ok {
+			u.Cards = append(u.Cards, users.Card{ID: id})
+		}
+	}
+	for _, u := range byID {
+		sort.Slice(u.Addresses, func(i, j int) bool { return u.Addresses[i].ID < u.Addresses[j].ID })
+		sort.Slice(u.Cards, func(i, j int) bool { return u.Cards[i].ID < u.Cards[j].ID })
+	}
+}
+
+// usernameFree checks no user but except has the username, compared
+// normalized.
+func (m *Memory) usernameFree(username, except string) error {
+	key := users.NormalizeUsername(username)
+	for id, u := range m.users {
+		if id != except && users.NormalizeUsername(u.Username) == key {
+			return &db.ConflictError{Field: "username"}
+		}
+	}
+	return nil
+}
+
+// emailFree checks no user but except has the email.
+func (m *Memory) emailFree(email, except string) error {
+	if email == "" {
+		return nil
+	}
+	for id, u := range m.users {
+		if id != except && u.Email == email {
+			return &db.ConflictError{Field: "email"}
+		}
+	}
+	return nil
+}
+
+// CreateUser stores the user with its addresses and cards, setting their
+// ids.
+func (m *Memory) CreateUser(ctx context.Context, u *users.User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.usernameFree(u.Username, ""); err != nil {
+		return err
+	}
+	if err := m.emailFree(u.Email, ""); err != nil {
+		return err
+	}
+	at := now()
+	stored := cloneUser(*u)
+	stored.UserID = newID()
+	stored.CreatedAt, stored.UpdatedAt = at, at
+	stored.Tags = nil
+	for _, tag := range u.Tags {
+		if !contains(stored.Tags, tag) {
+			stored.Tags = append(stored.Tags, tag)
+		}
+	}
+	for k := range stored.Addresses {
+		stored.Addresses[k].CreatedAt, stored.Addresses[k].UpdatedAt = at, at
+		stored.Addresses[k].ID = m.insertAddress(stored.Addresses[k], stored.UserID)
+	}
+	for k := range stored.Cards {
+		stored.Cards[k].CreatedAt, stored.Cards[k].UpdatedAt = at, at
+		stored.Cards[k].ID = m.insertCard(stored.Cards[k], stored.UserID)
+	}
+	kept := cloneUser(stored)
+	kept.Addresses, kept.Cards, kept.Links = nil, nil, nil
+	m.users[kept.UserID] = &kept
+	*u = stored
+	return nil
+}
+
+// UpdateUser sets the given profile fields of the user, leaving the rest as is
+func (m *Memory) UpdateUser(ctx context.Context, id string, p users.ProfileUpdate) error {
+	if profileEmpty(p) {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if p.Email != nil {
+		if err := m.emailFree(*p.Email, id); err != nil {
+			return err
+		}
+	}
+	return m.updateProfile(id, p, now())
+}
+
+func profileEmpty(p users.ProfileUpdate) bool {
+	return p.FirstName == nil && p.LastName == nil && p.Email == nil && p.Locale == nil && p.Timezone == nil &&
+		p.Phone == nil && p.PhoneVerified == nil && p.PhoneCode == nil && p.Avatar == nil && p.Preferences == nil &&
+		p.Status == nil && p.Password == nil && p.Salt == nil && len(p.Metadata) == 0
+}
+
+// updateProfile sets the fields of p on the user, failing with ErrNotFound
+// for unknown users.
+func (m *Memory) updateProfile(id string, p users.ProfileUpdate, at time.Time) error {
+	u, ok := m.users[id]
+	if !ok {
+		return ErrNotFound
+	}
+	for _, f := range []struct {
+		field *string
+		v     *string
+	}{
+		{&u.FirstName, p.FirstName}, {&u.LastName, p.LastName}, {&u.Email, p.Email}, {&u.Locale, p.Locale},
+		{&u.Timezone, p.Timezone}, {&u.Status, p.Status}, {&u.Password, p.Password}, {&u.Salt, p.Salt},
+	} {
+		if f.v != nil {
+			*f.field = *f.v
+		}
+	}
+	// A new phone has to be verified again.
+	if p.Phone != nil {
+		u.Phone = *p.Phone
+		u.PhoneVerified = false
+	}
+	if p.PhoneVerified != nil {
+		u.PhoneVerified = *p.PhoneVerified
+	}
+	switch {
+	case p.PhoneCode != nil:
+		c := *p.PhoneCode
+		u.PhoneCode = &c
+	case p.Phone != nil || p.PhoneVerified != nil:
+		u.PhoneCode = nil
+	}
+	if p.Avatar != nil {
+		u.Avatar = cloneStrings(p.Avatar)
+	}
+	if p.Preferences != nil {
+		prefs := *p.Preferences
+		u.Preferences = &prefs
+	}
+	if len(p.Metadata) > 0 {
+		if u.Metadata == nil {
+			u.Metadata = map[string]string{}
+		}
+		for k, v := range p.Metadata {
+			if v == nil {
+				delete(u.Metadata, k)
+				continue
+			}
+			u.Metadata[k] = *v
+		}
+		if len(u.Metadata) == 0 {
+			u.Metadata = nil
+		}
+	}
+	u.UpdatedAt = at
+	return nil
+}
+
+// RenameUser changes the username, recording the old one in the history
+func (m *Memory) RenameUser(ctx context.Context, id, username string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if err := m.usernameFree(username, id); err != nil {
+		return err
+	}
+	at := now()
+	u.UsernameHistory = append(u.UsernameHistory, users.UsernameChange{Username: u.Username, ChangedAt: at})
+	u.Username = username
+	u.UpdatedAt = at
+	return nil
+}
+
+// UpgradeUser gives the guest id the credentials and profile of u and drops
+// its guest role. It fails with ErrNotFound unless id is a guest.
+func (m *Memory) UpgradeUser(ctx context.Context, id string, u users.User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.emailFree(u.Email, id); err != nil {
+		return err
+	}
+	stored, ok := m.users[id]
+	if !ok || !stored.HasRole(users.RoleGuest) {
+		return ErrNotFound
+	}
+	if err := m.usernameFree(u.Username, id); err != nil {
+		return err
+	}
+	stored.Username, stored.Password, stored.Salt, stored.Email = u.Username, u.Password, u.Salt, u.Email
+	stored.FirstName, stored.LastName = u.FirstName, u.LastName
+	stored.Roles = remove(stored.Roles, users.RoleGuest)
+	stored.UpdatedAt = now()
+	return nil
+}
+
+// MergeUsers moves the addresses, cards and tags of source to target, sets
+// the profile fields in p on target and removes source. The source username
+// becomes a previous username of target, the source id an alias of it.
+func (m *Memory) MergeUsers(ctx context.Context, target, source string, p users.ProfileUpdate) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	src, ok := m.users[source]
+	if !ok {
+		return ErrNotFound
+	}
+	at := now()
+	if err := m.updateProfile(target, p, at); err != nil {
+		return err
+	}
+	t := m.users[target]
+	t.UsernameHistory = append(t.UsernameHistory, users.UsernameChange{Username: src.Username, ChangedAt: at})
+	for _, tag := range src.Tags {
+		if !contains(t.Tags, tag) {
+			t.Tags = append(t.Tags, tag)
+		}
+	}
+	for _, a := range m.addresses {
+		if a.owner == source {
+			a.owner = target
+		}
+	}
+	for _, ca := range m.cards {
+		if ca.owner == source {
+			ca.owner = target
+		}
+	}
+	// Aliases of the source, and the source itself, now point at target.
+	for id, a := range m.aliases {
+		if a.target == source {
+			a.target = target
+			m.aliases[id] = a
+		}
+	}
+	m.aliases[source] = alias{target: target, mergedAt: at}
+	for id, a := range m.activity {
+		if a.UserID == source {
+			a.UserID = target
+			m.activity[id] = a
+		}
+	}
+	for _, g := range m.groups {
+		if contains(g.Owners, source) {
+			g.Owners = remove(g.Owners, source)
+			if !contains(g.Owners, target) {
+				g.Owners = append(g.Owners, target)
+			}
+		}
+		if contains(g.Members, source) {
+			g.Members = remove(g.Members, source)
+			if !contains(g.Members, target) {
+				g.Members = append(g.Members, target)
+			}
+		}
+	}
+	delete(m.users, source)
+	return nil
+}
+
+// ResolveAlias returns the id of the user the given id was merged into
+func (m *Memory) ResolveAlias(ctx context.Context, id string) (string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	a, ok := m.aliases[id]
+	if !ok {
+		return "", ErrNotFound
+	}
+	return a.target, nil
+}
+
+// GetUserByPreviousName gets the user who renamed away from name after
+// since, the latest one if several did
+func (m *Memory) GetUserByPreviousName(ctx context.Context, name string, since time.Time) (users.User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	key := users.NormalizeUsername(name)
+	var found string
+	var latest time.Time
+	for id, u := range m.users {
+		for _, h := range u.UsernameHistory {
+			if users.NormalizeUsername(h.Username) == key && h.ChangedAt.After(since) && h.ChangedAt.After(latest) {
+				found, latest = id, h.ChangedAt
+			}
+		}
+	}
+	return m.user(found)
+}
+
+// RecordLogin stores the time of a successful login and counts it
+func (m *Memory) RecordLogin(ctx context.Context, id string, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[id]
+	if !ok {
+		return ErrNotFound
+	}
+	u.LastLoginAt = &at
+	u.LoginCount++
+	return nil
+}
+
+// AddUserTag adds tag to the user, tags are kept unique
+func (m *Memory) AddUserTag(ctx context.Context, id, tag string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if !contains(u.Tags, tag) {
+		u.Tags = append(u.Tags, tag)
+	}
+	u.UpdatedAt = now()
+	return nil
+}
+
+// RemoveUserTag removes tag from the user
+func (m *Memory) RemoveUserTag(ctx context.Context, id, tag string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[id]
+	if !ok {
+		return ErrNotFound
+	}
+	u.Tags = remove(u.Tags, tag)
+	u.UpdatedAt = now()
+	return nil
+}
+
+// GetUserByName Get user by their name
+func (m *Memory) GetUserByName(ctx context.Context, name string) (users.User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	key := users.NormalizeUsername(name)
+	for id, u := range m.users {
+		if users.NormalizeUsername(u.Username) == key {
+			return m.user(id)
+		}
+	}
+	return users.New(), ErrNotFound
+}
+
+// GetUser Get user by their id
+func (m *Memory) GetUser(ctx context.Context, id string) (users.User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.user(id)
+}
+
+// GetUsersByID gets the users with the given ids, unknown ids are left out
+func (m *Memory) GetUsersByID(ctx context.Context, ids []string) ([]users.User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	us := make([]users.User, 0, len(ids))
+	seen := map[string]bool{}
+	for _, id := range ids {
+		if u, ok := m.users[id]; ok && !seen[id] {
+			seen[id] = true
+			us = append(us, cloneUser(*u))
+		}
+	}
+	m.loadLinks(us)
+	return us, nil
+}
+
+// sortCompare compares users by the fields of db.SortFields. Users without
+// a login sort after the others, like NULLs in PostgreSQL.
+var sortCompare = map[string]func(a, b *users.User) int{
+	"username": func(a, b *users.User) int {
+		return strings.Compare(users.NormalizeUsername(a.Username), users.NormalizeUsername(b.Username))
+	},
+	"email":     func(a, b *users.User) int { return strings.Compare(a.Email, b.Email) },
+	"lastName":  func(a, b *users.User) int { return strings.Compare(a.LastName, b.LastName) },
+	"createdAt": func(a, b *users.User) int { return a.CreatedAt.Compare(b.CreatedAt) },
+	"updatedAt": func(a, b *users.User) int { return a.UpdatedAt.Compare(b.UpdatedAt) },
+	"lastLoginAt": func(a, b *users.User) int {
+		switch {
+		case a.LastLoginAt == nil && b.LastLoginAt == nil:
+			return 0
+		case a.LastLoginAt == nil:
+			return 1
+		case b.LastLoginAt == nil:
+			return -1
+		}
+		return a.LastLoginAt.Compare(*b.LastLoginAt)
+	},
+}
+
+// GetUsers Get all users matching the query. All fields are loaded, the
+// fields of the query only narrow the responses.
+func (m *Memory) GetUsers(ctx context.Context, q db.UserQuery) ([]users.User, error) {
+	compare := func(a, b *users.User) int { return 0 }
+	f, desc := q.SortField()
+	if q.Sort != "" {
+		var ok bool
+		if compare, ok = sortCompare[f]; !ok {
+			return nil, db.ErrInvalidSort
+		}
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	matched := make([]*users.User, 0)
+	for _, u := range m.users {
+		if m.matches(u, q) {
+			matched = append(matched, u)
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		if c := compare(matched[i], matched[j]); c != 0 {
+			return (c < 0) != desc
+		}
+		return matched[i].UserID < matched[j].UserID
+	})
+	if q.Limit > 0 && len(matched) > q.Limit {
+		matched = matched[:q.Limit]
+	}
+	us := make([]users.User, len(matched))
+	for k, u := range matched {
+		us[k] = cloneUser(*u)
+	}
+	m.loadLinks(us)
+	return us, nil
+}
+
+// matches reports whether u passes the filters of q.
+func (m *Memory) matches(u *users.User, q db.UserQuery) bool {
+	if q.Email != "" && u.Email != q.Email {
+		return false
+	}
+	if q.LastName != "" && u.LastName != q.LastName {
+		return false
+	}
+	if !q.CreatedAfter.IsZero() && !u.CreatedAt.After(q.CreatedAfter) {
+		return false
+	}
+	if !q.CreatedBefore.IsZero() && !u.CreatedAt.Before(q.CreatedBefore) {
+		return false
+	}
+	if !q.UpdatedAfter.IsZero() && !u.UpdatedAt.After(q.UpdatedAfter) {
+		return false
+	}
+	if q.Tag != "" && !contains(u.Tags, q.Tag) {
+		return false
+	}
+	if q.Role != "" && !contains(u.Roles, q.Role) {
+		return false
+	}
+	for k, v := range q.Metadata {
+		if got, ok := u.Metadata[k]; !ok || got != v {
+			return false
+		}
+	}
+	switch q.Status {
+	case "":
+		return u.Status != users.StatusDeleted
+	case users.StatusActive:
+		// Users without a status predate lifecycle states and are active.
+		return u.Status == "" || u.Status == users.StatusActive
+	default:
+		return u.Status == q.Status
+	}
+}
+
+// GetStats counts the users, addresses and cards, signups per day since
+// signupsSince and users who logged in since activeSince
+func (m *Memory) GetStats(ctx context.Context, signupsSince, activeSince time.Time) (db.Stats, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	st := db.Stats{Users: len(m.users), Addresses: len(m.addresses), Cards: len(m.cards)}
+	counts := map[string]int{}
+	for _, u := range m.users {
+		if u.LastLoginAt != nil && !u.LastLoginAt.Before(activeSince) {
+			st.Active++
+		}
+		if !u.CreatedAt.Before(signupsSince) {
+			counts[u.CreatedAt.UTC().Format(db.DayFormat)]++
+		}
+	}
+	st.Signups = db.Days(signupsSince, time.Now(), counts)
+	return st, nil
+}
+
+// ListUsers gets a page of users in id order, starting after the given id
+func (m *Memory) ListUsers(ctx context.Context, after string, n int) ([]users.User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	ids := make([]string, 0)
+	for id := range m.users {
+		if id > after {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	us := make([]users.User, limit(n, len(ids)))
+	for k := range us {
+		us[k] = cloneUser(*m.users[ids[k]])
+	}
+	m.loadLinks(us)
+	return us, nil
+}
+
+// UserExists reports whether a user has the value in the given field,
+// username or email
+func (m *Memory) UserExists(ctx context.Context, field, value string) (bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var err error
+	switch field {
+	case "username":
+		err = m.usernameFree(value, "")
+	case "email":
+		err = m.emailFree(value, "")
+	default:
+		return false, fmt.Errorf("no user field %v", field)
+	}
+	return err != nil, nil
+}
+
+// DeleteUsers removes the users and their addresses and cards, reporting
+// unknown ids individually
+func (m *Memory) DeleteUsers(ctx context.Context, ids []string) (map[string]error, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res := make(map[string]error, len(ids))
+	for _, id := range ids {
+		if _, ok := m.users[id]; !ok {
+			if _, done := res[id]; !done {
+				res[id] = ErrNotFound
+			}
+			continue
+		}
+		m.deleteUser(id)
+		for _, g := range m.groups {
+			g.Owners = remove(g.Owners, id)
+			g.Members = remove(g.Members, id)
+		}
+		for aid, a := range m.activity {
+			if a.UserID == id {
+				delete(m.activity, aid)
+			}
+		}
+		res[id] = nil
+	}
+	return res, nil
+}
+
+// deleteUser removes the user with its addresses and cards.
+func (m *Memory) deleteUser(id string) {
+	delete(m.users, id)
+	for aid, a := range m.addresses {
+		if a.owner == id {
+			delete(m.addresses, aid)
+		}
+	}
+	for cid, ca := range m.cards {
+		if ca.owner == id {
+			delete(m.cards, cid)
+		}
+	}
+}
+
+// Delete removes the entity with id. Deleting customers removes their
+// addresses and cards too.
+func (m *Memory) Delete(ctx context.Context, entity, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var found bool
+	switch entity {
+	case "customers":
+		if _, found = m.users[id]; found {
+			m.deleteUser(id)
+		}
+	case "addresses":
+		if _, found = m.addresses[id]; found {
+			delete(m.addresses, id)
+		}
+	case "cards":
+		if _, found = m.cards[id]; found {
+			delete(m.cards, id)
+		}
+	case "groups":
+		if _, found = m.groups[id]; found {
+			delete(m.groups, id)
+		}
+	default:
+		return fmt.Errorf("no entity %v", entity)
+	}
+	if !found {
+		return ErrNotFound
+	}
+	return nil
+}
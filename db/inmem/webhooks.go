@@ -0,0 +1,83 @@
+package inmem
+
+import (
+	"context"
+	"sort"
+
+	"user/db"
+	"user/users"
+)
+
+func cloneWebhook(w users.Webhook) users.Webhook {
+	w.Events = append([]string(nil), w.Events...)
+	return w
+}
+
+// CreateWebhook stores the webhook
+func (m *Memory) CreateWebhook(ctx context.Context, w *users.Webhook) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored := cloneWebhook(*w)
+	stored.ID = newID()
+	stored.CreatedAt = now()
+	m.webhooks[stored.ID] = cloneWebhook(stored)
+	*w = stored
+	return nil
+}
+
+// GetWebhooks gets every webhook, oldest first
+func (m *Memory) GetWebhooks(ctx context.Context) ([]users.Webhook, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	ws := make([]users.Webhook, 0, len(m.webhooks))
+	for _, w := range m.webhooks {
+		ws = append(ws, cloneWebhook(w))
+	}
+	sort.Slice(ws, func(i, j int) bool { return ws[i].ID < ws[j].ID })
+	return ws, nil
+}
+
+// DeleteWebhook removes the webhook, its delivery log expires
+func (m *Memory) DeleteWebhook(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.webhooks[id]; !ok {
+		return ErrNotFound
+	}
+	delete(m.webhooks, id)
+	return nil
+}
+
+// AddWebhookDelivery logs the delivery attempt, removing the expired ones
+func (m *Memory) AddWebhookDelivery(ctx context.Context, wd *users.WebhookDelivery) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored := *wd
+	stored.ID = newID()
+	stored.Time = now()
+	expired := stored.Time.Add(-db.WebhookDeliveryTTL)
+	for id, d := range m.deliveries {
+		if d.Time.Before(expired) {
+			delete(m.deliveries, id)
+		}
+	}
+	m.deliveries[stored.ID] = stored
+	*wd = stored
+	return nil
+}
+
+// GetWebhookDeliveries returns up to limit deliveries to the webhook older
+// than the delivery before, newest first
+func (m *Memory) GetWebhookDeliveries(ctx context.Context, webhookID, before string, n int) ([]users.WebhookDelivery, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	expired := now().Add(-db.WebhookDeliveryTTL)
+	ds := make([]users.WebhookDelivery, 0)
+	for id, d := range m.deliveries {
+		if d.WebhookID == webhookID && !d.Time.Before(expired) && (before == "" || id < before) {
+			ds = append(ds, d)
+		}
+	}
+	sort.Slice(ds, func(i, j int) bool { return ds[i].ID > ds[j].ID })
+	return ds[:limit(n, len(ds))], nil
+}
@@ -0,0 +1,101 @@
+package mongodb
+
+// ids.go contains the _ids of the documents. Ids in the ObjectId format are
+// stored as ObjectIds, like MongoDB generates them, UUIDv7s and ULIDs as
+// strings, so documents get ids of any db.IDFormat. MongoDB orders strings
+// before ObjectIds, a database switched to another format pages through
+// both.
+
+import (
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+	"user/db"
+)
+
+// docID is the _id of a document, or a reference to one.
+type docID string
+
+// newID returns a new id in db.IDFormat.
+func newID() docID {
+	return docID(db.NewID())
+}
+
+// GetBSON stores ObjectIds as ObjectIds and other ids as strings.
+func (id docID) GetBSON() (interface{}, error) {
+	if bson.IsObjectIdHex(string(id)) {
+		return bson.ObjectIdHex(string(id)), nil
+	}
+	return string(id), nil
+}
+
+// SetBSON reads ObjectIds as their hex digits and other ids as stored.
+func (id *docID) SetBSON(raw bson.Raw) error {
+	if raw.Kind == 0x07 {
+		var oid bson.ObjectId
+		if err := raw.Unmarshal(&oid); err != nil {
+			return err
+		}
+		*id = docID(oid.Hex())
+		return nil
+	}
+	var s string
+	if err := raw.Unmarshal(&s); err != nil {
+		return err
+	}
+	*id = docID(s)
+	return nil
+}
+
+// time returns the creation time ObjectIds hold, zero for other ids.
+func (id docID) time() time.Time {
+	if !bson.IsObjectIdHex(string(id)) {
+		return time.Time{}
+	}
+	return bson.ObjectIdHex(string(id)).Time()
+}
+
+// createdBetween selects the documents whose _id was generated after after
+// and before before, either zero for no bound. ObjectIds and the strings of
+// db.IDFormat are compared apart.
+func createdBetween(after, before time.Time) bson.M {
+	oids, strs := bson.M{}, bson.M{}
+	if !after.IsZero() {
+		oids["$gt"] = bson.NewObjectIdWithTime(after)
+		strs["$gt"] = db.FirstIDAt(after)
+	}
+	if !before.IsZero() {
+		oids["$lt"] = bson.NewObjectIdWithTime(before)
+		strs["$lt"] = db.FirstIDAt(before)
+	}
+	if db.IDFormat == db.IDObjectID {
+		return bson.M{"_id": oids}
+	}
+	return bson.M{"$or": []bson.M{{"_id": oids}, {"_id": strs}}}
+}
+
+// afterID selects the _ids following id in ascending order, the ObjectIds
+// following strings.
+func afterID(id string) bson.M {
+	if bson.IsObjectIdHex(id) {
+		return bson.M{"_id": bson.M{"$gt": docID(id)}}
+	}
+	return bson.M{"$or": []bson.M{{"_id": bson.M{"$gt": id}}, {"_id": bson.M{"$type": "objectId"}}}}
+}
+
+// beforeID selects the _ids preceding id in descending order, the strings
+// following ObjectIds.
+func beforeID(id string) bson.M {
+	if !bson.IsObjectIdHex(id) {
+		return bson.M{"_id": bson.M{"$lt": id}}
+	}
+	return bson.M{"$or": []bson.M{{"_id": bson.M{"$lt": docID(id)}}, {"_id": bson.M{"$type": "string"}}}}
+}
+
+// and adds the conditions of cond to sel, returning sel.
+func and(sel, cond bson.M) bson.M {
+	for k, v := range cond {
+		sel[k] = v
+	}
+	return sel
+}
@@ -0,0 +1,189 @@
+package mongodb
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"user/db"
+	"user/pii"
+	"user/users"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Migration is a numbered step of the data and indexes of a database. MongoDB
+// can't record it in the same transaction, so Up runs again when an instance
+// fails before recording it and has to be safe to.
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(*Mongo) error
+}
+
+// Migrations upgrade the data and indexes, recorded in the schemaMigrations
+// collection. Released migrations are never edited, changes are appended
+// with the next version.
+var Migrations = []Migration{
+	{Version: 1, Name: "normalize usernames and emails", Up: (*Mongo).normalizeUsers},
+	{Version: 2, Name: "remove card verification values", Up: (*Mongo).scrubCVVs},
+	{Version: 3, Name: "create indexes", Up: (*Mongo).EnsureIndexes},
+	{Version: 4, Name: "unique emails", Up: (*Mongo).uniqueEmails},
+}
+
+// Migrate applies the migrations not recorded in schemaMigrations, in
+// Version order.
+func (m *Mongo) Migrate(ctx context.Context) error {
+	status, err := m.MigrationStatus(ctx)
+	if err != nil {
+		return err
+	}
+	s := m.session(ctx)
+	defer s.Close()
+	c := s.DB(m.Name).C("schemaMigrations")
+	ordered := sortedMigrations()
+	for k, st := range status {
+		if st.AppliedAt != nil {
+			continue
+		}
+		mg := ordered[k]
+		if err := mg.Up(m); err != nil {
+			failed := &db.MigrationError{Version: mg.Version, Name: mg.Name, Err: err}
+			m.failed.Store(failed)
+			return failed
+		}
+		// Of instances applying it together, the first records when.
+		if _, err := c.UpsertId(mg.Version, bson.M{"$setOnInsert": bson.M{"name": mg.Name, "appliedAt": now()}}); err != nil {
+			return err
+		}
+	}
+	m.failed.Store(nil)
+	m.migrated.Store(true)
+	return nil
+}
+
+// MigrationFailure returns the error the last migration failed with.
+func (m *Mongo) MigrationFailure() error {
+	if failed := m.failed.Load(); failed != nil {
+		return failed
+	}
+	return nil
+}
+
+// MigrationStatus lists the migrations with when they were applied.
+func (m *Mongo) MigrationStatus(ctx context.Context) ([]db.MigrationStatus, error) {
+	s := m.session(ctx)
+	defer s.Close()
+	var recorded []struct {
+		Version   int       `bson:"_id"`
+		AppliedAt time.Time `bson:"appliedAt"`
+	}
+	if err := s.DB(m.Name).C("schemaMigrations").Find(nil).All(&recorded); err != nil {
+		return nil, err
+	}
+	applied := map[int]time.Time{}
+	for _, r := range recorded {
+		applied[r.Version] = r.AppliedAt
+	}
+	var status []db.MigrationStatus
+	for _, mg := range sortedMigrations() {
+		st := db.MigrationStatus{Version: mg.Version, Name: mg.Name}
+		if at, ok := applied[mg.Version]; ok {
+			st.AppliedAt = &at
+		}
+		status = append(status, st)
+	}
+	return status, nil
+}
+
+// Migrated reports whether the migrations have been applied, by Init or
+// since by another instance.
+func (m *Mongo) Migrated() bool {
+	if m.migrated.Load() {
+		return true
+	}
+	status, err := m.MigrationStatus(context.Background())
+	if err != nil {
+		return false
+	}
+	for _, st := range status {
+		if st.AppliedAt == nil {
+			return false
+		}
+	}
+	m.failed.Store(nil)
+	m.migrated.Store(true)
+	return true
+}
+
+func sortedMigrations() []Migration {
+	sorted := append([]Migration(nil), Migrations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Version < sorted[j].Version })
+	return sorted
+}
+
+// uniqueEmails replaces the email index by a unique one, leaving out users
+// without email. Duplicates have to be merged or changed first.
+func (m *Mongo) uniqueEmails() error {
+	s := m.Session.Copy()
+	defer s.Close()
+	d := s.DB(m.Name)
+	// Indexes of the same keys can't differ in options.
+	if err := d.C("customers").DropIndexName("email_1"); err != nil && !strings.Contains(err.Error(), "not found") {
+		return err
+	}
+	// mgo can't create partial indexes.
+	return d.Run(bson.D{
+		{Name: "createIndexes", Value: "customers"},
+		{Name: "indexes", Value: []bson.M{{
+			"key":                     bson.M{"email": 1},
+			"name":                    "email_unique",
+			"unique":                  true,
+			"partialFilterExpression": bson.M{"email": bson.M{"$gt": ""}},
+		}}},
+	}, nil)
+}
+
+// normalizeUsers migrates users stored before usernames and emails were
+// matched case insensitively: it fills in the username key and lower cases
+// the email. Users whose usernames only differ by case fail the unique
+// index afterwards and have to be renamed by hand.
+func (m *Mongo) normalizeUsers() error {
+	s := m.Session.Copy()
+	defer s.Close()
+	c := s.DB(m.Name).C("customers")
+	var d struct {
+		ID       docID  `bson:"_id"`
+		Username string `bson:"username"`
+		Email    string `bson:"email"`
+	}
+	iter := c.Find(bson.M{"usernameKey": bson.M{"$exists": false}}).Select(bson.M{"username": 1, "email": 1}).Iter()
+	for iter.Next(&d) {
+		set := bson.M{"usernameKey": users.NormalizeUsername(d.Username)}
+		if d.Email != "" {
+			email := d.Email
+			if m.Cipher != nil {
+				var err error
+				if email, err = m.Cipher.DecryptString(pii.Ciphertext(email)); err != nil {
+					return err
+				}
+			}
+			set["email"] = db.StoredEmail(email, m.Cipher)
+		}
+		if err := c.UpdateId(d.ID, bson.M{"$set": set}); err != nil {
+			iter.Close()
+			return err
+		}
+	}
+	return iter.Close()
+}
+
+// scrubCVVs removes the card verification values stored by earlier
+// versions.
+func (m *Mongo) scrubCVVs() error {
+	s := m.Session.Copy()
+	defer s.Close()
+	_, err := s.DB(m.Name).C("cards").UpdateAll(bson.M{"ccv": bson.M{"$exists": true}}, bson.M{"$unset": bson.M{"ccv": ""}})
+	return err
+}
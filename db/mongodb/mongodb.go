@@ -1,13 +1,20 @@
 package mongodb
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
 	"net/url"
 	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"user/db"
+	"user/pii"
+	"user/secrets"
 	"user/users"
 
 	"gopkg.in/mgo.v2"
@@ -15,10 +22,14 @@ import (
 )
 
 var (
-	name     string
-	password string
-	host     string
-	db       = "users"
+	name             string
+	password         string
+	host             string
+	poolLimit        int
+	dialTimeout      time.Duration
+	socketTimeout    time.Duration
+	selectionTimeout time.Duration
+	dbName           = "users"
 	//ErrInvalidHexID represents a entity id that is not a valid bson ObjectID
 	ErrInvalidHexID = errors.New("Invalid Id Hex")
 )
@@ -27,31 +38,138 @@ func init() {
 	flag.StringVar(&name, "mongo-user", os.Getenv("MONGO_USER"), "Mongo user")
 	flag.StringVar(&password, "mongo-password", os.Getenv("MONGO_PASS"), "Mongo password")
 	flag.StringVar(&host, "mongo-host", os.Getenv("MONGO_HOST"), "Mongo host")
+	flag.IntVar(&poolLimit, "mongo-pool-limit", 100, "Connections to each MongoDB server, operations wait for one beyond it")
+	flag.DurationVar(&dialTimeout, "mongo-timeout", 5*time.Second, "How long connecting to MongoDB may take")
+	flag.DurationVar(&socketTimeout, "mongo-socket-timeout", 30*time.Second, "How long a MongoDB server may take to answer, 0 for no limit")
+	flag.DurationVar(&selectionTimeout, "mongo-server-selection-timeout", 10*time.Second, "How long operations wait for a usable MongoDB server, 0 to wait forever")
 }
 
 // Mongo meets the Database interface requirements
 type Mongo struct {
 	//Session is a MongoDB Session
 	Session *mgo.Session
+	//Name is the database of the collections, empty for the one in the URL
+	Name string
+	//Cipher is the cipher of the Store the database is used by, the
+	//migrations normalizing emails decrypt them with it
+	Cipher *pii.Cipher
+
+	mu      sync.Mutex
+	tenants map[string]*Mongo
+	// resume is the token of the last change Watch saw.
+	resume *bson.Raw
+	// migrated is set once the migrations are known to be applied.
+	migrated atomic.Bool
+	// failed is the error the last migration failed with.
+	failed atomic.Pointer[db.MigrationError]
+}
+
+// Tenant returns the database of a tenant. Each tenant has its own MongoDB
+// database on the same session, migrated on first use.
+func (m *Mongo) Tenant(id string) (db.Database, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if t, ok := m.tenants[id]; ok {
+		return t, nil
+	}
+	t := &Mongo{Session: m.Session, Name: dbName + "-" + id, Cipher: m.Cipher}
+	if err := t.removeOrphans(); err != nil {
+		return nil, err
+	}
+	if db.AutoMigrate {
+		if err := t.Migrate(context.Background()); err != nil && !errors.As(err, new(*db.MigrationError)) {
+			return nil, err
+		}
+	}
+	if m.tenants == nil {
+		m.tenants = make(map[string]*Mongo)
+	}
+	m.tenants[id] = t
+	return t, nil
 }
 
 // Init MongoDB
 func (m *Mongo) Init() error {
+	if name == "" {
+		name = secrets.Value(secrets.MongoUser)
+	}
+	if password == "" {
+		password = secrets.Value(secrets.MongoPassword)
+	}
 	u := getURL()
-	var err error
-	m.Session, err = mgo.DialWithTimeout(u.String(), time.Duration(5)*time.Second)
+	info, err := mgo.ParseURL(u.String())
+	if err != nil {
+		return &db.ConfigError{Err: err}
+	}
+	info.Timeout = dialTimeout
+	info.PoolLimit = poolLimit
+	m.Session, err = mgo.DialWithInfo(info)
 	if err != nil {
 		return err
 	}
-	return m.EnsureIndexes()
+	// Copies of the session take these over.
+	m.Session.SetSocketTimeout(socketTimeout)
+	m.Session.SetSyncTimeout(selectionTimeout)
+	if err := m.removeOrphans(); err != nil {
+		return err
+	}
+	if !db.AutoMigrate {
+		return nil
+	}
+	// A migration failing to apply is left to MigrationFailure to report.
+	if err := m.Migrate(context.Background()); err != nil && !errors.As(err, new(*db.MigrationError)) {
+		return err
+	}
+	return nil
+}
+
+// registrationGrace is how long a registration may take. Marked addresses
+// and cards older than it are left by registrations that crashed.
+const registrationGrace = 10 * time.Minute
+
+// removeOrphans finishes registrations that crashed halfway: the marks of
+// addresses and cards whose user was written come off, the others are
+// removed.
+func (m *Mongo) removeOrphans() error {
+	s := m.Session.Copy()
+	defer s.Close()
+	customers := s.DB(m.Name).C("customers")
+	before := createdBetween(time.Time{}, time.Now().Add(-registrationGrace))
+	for _, name := range []string{"addresses", "cards"} {
+		c := s.DB(m.Name).C(name)
+		var d struct {
+			ID          docID `bson:"_id"`
+			Registering docID `bson:"registering"`
+		}
+		iter := c.Find(and(bson.M{"registering": bson.M{"$exists": true}}, before)).Select(bson.M{"registering": 1}).Iter()
+		for iter.Next(&d) {
+			n, err := customers.FindId(d.Registering).Count()
+			if err == nil && n > 0 {
+				err = c.UpdateId(d.ID, bson.M{"$unset": bson.M{"registering": ""}})
+			} else if err == nil {
+				err = c.RemoveId(d.ID)
+			}
+			if err != nil && err != mgo.ErrNotFound {
+				iter.Close()
+				return err
+			}
+		}
+		if err := iter.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // MongoUser is a wrapper for the users
 type MongoUser struct {
 	users.User `bson:",inline"`
-	ID         bson.ObjectId   `bson:"_id"`
-	AddressIDs []bson.ObjectId `bson:"addresses"`
-	CardIDs    []bson.ObjectId `bson:"cards"`
+	ID         docID `bson:"_id"`
+	// UsernameKey is the normalized username, usernames are unique and
+	// looked up by it.
+	UsernameKey string  `bson:"usernameKey"`
+	AddressIDs  []docID `bson:"addresses"`
+	CardIDs     []docID `bson:"cards"`
 }
 
 // New Returns a new MongoUser
@@ -59,8 +177,8 @@ func New() MongoUser {
 	u := users.New()
 	return MongoUser{
 		User:       u,
-		AddressIDs: make([]bson.ObjectId, 0),
-		CardIDs:    make([]bson.ObjectId, 0),
+		AddressIDs: make([]docID, 0),
+		CardIDs:    make([]docID, 0),
 	}
 }
 
@@ -71,166 +189,576 @@ func (mu *MongoUser) AddUserIDs() {
 	}
 	for _, id := range mu.AddressIDs {
 		mu.User.Addresses = append(mu.User.Addresses, users.Address{
-			ID: id.Hex(),
+			ID: string(id),
 		})
 	}
 	if mu.User.Cards == nil {
 		mu.User.Cards = make([]users.Card, 0)
 	}
 	for _, id := range mu.CardIDs {
-		mu.User.Cards = append(mu.User.Cards, users.Card{ID: id.Hex()})
+		mu.User.Cards = append(mu.User.Cards, users.Card{ID: string(id)})
+	}
+	mu.User.UserID = string(mu.ID)
+	stamp(&mu.User.CreatedAt, &mu.User.UpdatedAt, mu.ID)
+}
+
+// stamp fills in the timestamps of documents written before they were
+// recorded, their ObjectId holds the creation time.
+func stamp(created, updated *time.Time, id docID) {
+	if created.IsZero() {
+		*created = id.time()
+	}
+	if updated.IsZero() {
+		*updated = *created
+	}
+}
+
+// readModes are the mgo modes of the read preferences routing reads to
+// secondaries. mgo sends writes to the primary in any mode.
+var readModes = map[db.ReadPreference]mgo.Mode{
+	db.SecondaryPreferred: mgo.SecondaryPreferred,
+	db.Secondary:          mgo.Secondary,
+	db.Nearest:            mgo.Nearest,
+}
+
+// session copies the session for an operation within ctx, reading from
+// the members of its read preference. mgo can't cancel operations, so the
+// socket and server selection timeouts of the copy are cut to the deadline
+// of ctx instead.
+func (m *Mongo) session(ctx context.Context) *mgo.Session {
+	s := m.Session.Copy()
+	if mode, ok := readModes[db.ReadPreferenceFrom(ctx)]; ok {
+		s.SetMode(mode, true)
 	}
-	mu.User.UserID = mu.ID.Hex()
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return s
+	}
+	// A zero timeout means none, so an expired deadline still gets one.
+	left := time.Until(deadline)
+	if left < time.Millisecond {
+		left = time.Millisecond
+	}
+	if socketTimeout == 0 || left < socketTimeout {
+		s.SetSocketTimeout(left)
+	}
+	if selectionTimeout == 0 || left < selectionTimeout {
+		s.SetSyncTimeout(left)
+	}
+	return s
+}
+
+// now is the current time at the precision MongoDB stores.
+func now() time.Time {
+	return time.Now().UTC().Truncate(time.Millisecond)
 }
 
 // MongoAddress is a wrapper for Address
 type MongoAddress struct {
 	users.Address `bson:",inline"`
-	ID            bson.ObjectId `bson:"_id"`
+	ID            docID `bson:"_id"`
+	// Registering is the user being created with the address, until it is.
+	Registering docID `bson:"registering,omitempty"`
 }
 
 // AddID ObjectID as string
 func (m *MongoAddress) AddID() {
-	m.Address.ID = m.ID.Hex()
+	m.Address.ID = string(m.ID)
+	stamp(&m.Address.CreatedAt, &m.Address.UpdatedAt, m.ID)
 }
 
 // MongoCard is a wrapper for Card
 type MongoCard struct {
 	users.Card `bson:",inline"`
-	ID         bson.ObjectId `bson:"_id"`
+	ID         docID `bson:"_id"`
+	// Registering is the user being created with the card, until it is.
+	Registering docID `bson:"registering,omitempty"`
 }
 
 // AddID ObjectID as string
 func (m *MongoCard) AddID() {
-	m.Card.ID = m.ID.Hex()
+	m.Card.ID = string(m.ID)
+	stamp(&m.Card.CreatedAt, &m.Card.UpdatedAt, m.ID)
 }
 
-// CreateUser Insert user to MongoDB, including connected addresses and cards, update passed in user with Ids
-func (m *Mongo) CreateUser(u *users.User) error {
-	s := m.Session.Copy()
+// CreateUser Insert user to MongoDB, including connected addresses and cards, update passed in user with Ids.
+// MongoDB can't write them in one transaction, so the addresses and cards
+// are written first, marked as registering for the user, and removed again
+// when a later write fails. The marks come off once the user is written,
+// marked documents left by a crash in between are removed on Init.
+func (m *Mongo) CreateUser(ctx context.Context, u *users.User) error {
+	s := m.session(ctx)
 	defer s.Close()
-	id := bson.NewObjectId()
+	if err := emailFree(s.DB(m.Name).C("customers"), u.Email, ""); err != nil {
+		return err
+	}
 	mu := New()
 	mu.User = *u
-	mu.ID = id
-	var carderr error
-	var addrerr error
-	mu.CardIDs, carderr = m.createCards(u.Cards)
-	mu.AddressIDs, addrerr = m.createAddresses(u.Addresses)
-	c := s.DB("").C("customers")
-	_, err := c.UpsertId(mu.ID, mu)
+	mu.UsernameKey = users.NormalizeUsername(u.Username)
+	mu.ID = newID()
+	mu.User.CreatedAt = now()
+	mu.User.UpdatedAt = mu.User.CreatedAt
+	var err error
+	mu.CardIDs, err = m.createCards(ctx, mu.ID, u.Cards)
+	if err == nil {
+		mu.AddressIDs, err = m.createAddresses(ctx, mu.ID, u.Addresses)
+	}
+	if err == nil {
+		_, err = s.DB(m.Name).C("customers").UpsertId(mu.ID, mu)
+		err = conflict(err)
+	}
 	if err != nil {
-		// Gonna clean up if we can, ignore error
-		// because the user save error takes precedence.
-		m.cleanAttributes(mu)
+		// Undone even when ctx is done, which may be why the write failed.
+		m.unregister(context.WithoutCancel(ctx), mu)
 		return err
 	}
-	mu.User.UserID = mu.ID.Hex()
-	// Cheap err for attributes
-	if carderr != nil || addrerr != nil {
-		return fmt.Errorf("%v %v", carderr, addrerr)
-	}
+	// Marks left on failure come off on Init.
+	m.registered(ctx, mu)
+	mu.User.UserID = string(mu.ID)
 	*u = mu.User
 	return nil
 }
 
-func (m *Mongo) createCards(cs []users.Card) ([]bson.ObjectId, error) {
-	s := m.Session.Copy()
+// UpdateUser sets the given profile fields of the user, leaving the rest as is
+func (m *Mongo) UpdateUser(ctx context.Context, id string, p users.ProfileUpdate) error {
+	if !db.ValidID(id) {
+		return ErrInvalidHexID
+	}
+	set, unset := profileSet(p), profileUnset(p)
+	if len(set) == 0 && len(unset) == 0 {
+		return nil
+	}
+	set["updatedAt"] = now()
+	s := m.session(ctx)
+	defer s.Close()
+	if p.Email != nil {
+		if err := emailFree(s.DB(m.Name).C("customers"), *p.Email, docID(id)); err != nil {
+			return err
+		}
+	}
+	update := bson.M{"$set": set}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	c := s.DB(m.Name).C("customers")
+	return conflict(c.UpdateId(docID(id), update))
+}
+
+// profileSet maps the fields set in p to their document fields.
+func profileSet(p users.ProfileUpdate) bson.M {
+	set := bson.M{}
+	if p.FirstName != nil {
+		set["firstName"] = *p.FirstName
+	}
+	if p.LastName != nil {
+		set["lastName"] = *p.LastName
+	}
+	if p.Email != nil {
+		set["email"] = *p.Email
+	}
+	if p.Locale != nil {
+		set["locale"] = *p.Locale
+	}
+	if p.Timezone != nil {
+		set["timezone"] = *p.Timezone
+	}
+	// A new phone has to be verified again.
+	if p.Phone != nil {
+		set["phone"] = *p.Phone
+		set["phoneVerified"] = false
+	}
+	if p.PhoneVerified != nil {
+		set["phoneVerified"] = *p.PhoneVerified
+	}
+	if p.PhoneCode != nil {
+		set["phoneCode"] = p.PhoneCode
+	}
+	if p.Avatar != nil {
+		set["avatar"] = p.Avatar
+	}
+	if p.Preferences != nil {
+		set["preferences"] = p.Preferences
+	}
+	if p.Status != nil {
+		set["status"] = *p.Status
+	}
+	if p.Password != nil {
+		set["password"] = *p.Password
+	}
+	if p.Salt != nil {
+		set["salt"] = *p.Salt
+	}
+	for k, v := range p.Metadata {
+		if v != nil {
+			set["metadata."+k] = *v
+		}
+	}
+	return set
+}
+
+// profileUnset lists the document fields p removes.
+func profileUnset(p users.ProfileUpdate) bson.M {
+	unset := bson.M{}
+	if p.Phone != nil || p.PhoneVerified != nil {
+		unset["phoneCode"] = ""
+	}
+	for k, v := range p.Metadata {
+		if v == nil {
+			unset["metadata."+k] = ""
+		}
+	}
+	return unset
+}
+
+// emailFree checks no user but except holds email. Email has no unique
+// index, so two concurrent writes can still both pass.
+func emailFree(c *mgo.Collection, email string, except docID) error {
+	if email == "" {
+		return nil
+	}
+	sel := bson.M{"email": email}
+	if except != "" {
+		sel["_id"] = bson.M{"$ne": except}
+	}
+	n, err := c.Find(sel).Limit(1).Count()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return &db.ConflictError{Field: "email"}
+	}
+	return nil
+}
+
+// conflict turns duplicate key errors into a db.ConflictError naming the
+// field of the violated index.
+func conflict(err error) error {
+	if !mgo.IsDup(err) {
+		return err
+	}
+	for index, f := range map[string]string{"usernameKey_": "username", "username_": "username", "email_": "email"} {
+		if strings.Contains(err.Error(), index) {
+			return &db.ConflictError{Field: f}
+		}
+	}
+	return &db.ConflictError{}
+}
+
+// RenameUser changes the username, recording the old one in the history
+func (m *Mongo) RenameUser(ctx context.Context, id, username string) error {
+	if !db.ValidID(id) {
+		return ErrInvalidHexID
+	}
+	s := m.session(ctx)
+	defer s.Close()
+	c := s.DB(m.Name).C("customers")
+	var old struct {
+		Username string `bson:"username"`
+	}
+	if err := c.FindId(docID(id)).Select(bson.M{"username": 1}).One(&old); err != nil {
+		return err
+	}
+	at := now()
+	// Matching the old username fails the update if it changed meanwhile.
+	err := c.Update(bson.M{"_id": docID(id), "username": old.Username}, bson.M{
+		"$set": bson.M{
+			"username":    username,
+			"usernameKey": users.NormalizeUsername(username),
+			"updatedAt":   at,
+		},
+		"$push": bson.M{"usernameHistory": bson.M{
+			"username":  old.Username,
+			"key":       users.NormalizeUsername(old.Username),
+			"changedAt": at,
+		}},
+	})
+	return conflict(err)
+}
+
+// UpgradeUser gives the guest id the credentials and profile of u and drops
+// its guest role. It fails with mgo.ErrNotFound unless id is a guest.
+func (m *Mongo) UpgradeUser(ctx context.Context, id string, u users.User) error {
+	if !db.ValidID(id) {
+		return ErrInvalidHexID
+	}
+	s := m.session(ctx)
+	defer s.Close()
+	c := s.DB(m.Name).C("customers")
+	if err := emailFree(c, u.Email, docID(id)); err != nil {
+		return err
+	}
+	err := c.Update(bson.M{"_id": docID(id), "roles": users.RoleGuest}, bson.M{
+		"$set": bson.M{
+			"username":    u.Username,
+			"usernameKey": users.NormalizeUsername(u.Username),
+			"password":    u.Password,
+			"salt":        u.Salt,
+			"email":       u.Email,
+			"firstName":   u.FirstName,
+			"lastName":    u.LastName,
+			"updatedAt":   now(),
+		},
+		"$pull": bson.M{"roles": users.RoleGuest},
+	})
+	return conflict(err)
+}
+
+// MergeUsers moves the addresses, cards and tags of source to target, sets
+// the profile fields in p on target and removes source. The source username
+// becomes a previous username of target, the source id an alias of it.
+func (m *Mongo) MergeUsers(ctx context.Context, target, source string, p users.ProfileUpdate) error {
+	if !db.ValidID(target) || !db.ValidID(source) {
+		return ErrInvalidHexID
+	}
+	s := m.session(ctx)
+	defer s.Close()
+	c := s.DB(m.Name).C("customers")
+	src := New()
+	if err := c.FindId(docID(source)).One(&src); err != nil {
+		return err
+	}
+	at := now()
+	set := profileSet(p)
+	set["updatedAt"] = at
+	add := bson.M{}
+	if len(src.AddressIDs) > 0 {
+		add["addresses"] = bson.M{"$each": src.AddressIDs}
+	}
+	if len(src.CardIDs) > 0 {
+		add["cards"] = bson.M{"$each": src.CardIDs}
+	}
+	if len(src.Tags) > 0 {
+		add["tags"] = bson.M{"$each": src.Tags}
+	}
+	update := bson.M{
+		"$set": set,
+		"$push": bson.M{"usernameHistory": bson.M{
+			"username":  src.Username,
+			"key":       users.NormalizeUsername(src.Username),
+			"changedAt": at,
+		}},
+	}
+	if len(add) > 0 {
+		update["$addToSet"] = add
+	}
+	if err := c.UpdateId(docID(target), update); err != nil {
+		return err
+	}
+	// Aliases of the source, and the source itself, now point at target.
+	a := s.DB(m.Name).C("aliases")
+	if _, err := a.UpdateAll(bson.M{"target": source}, bson.M{"$set": bson.M{"target": target}}); err != nil {
+		return err
+	}
+	if _, err := a.UpsertId(source, bson.M{"target": target, "mergedAt": at}); err != nil {
+		return err
+	}
+	if _, err := s.DB(m.Name).C("activity").UpdateAll(bson.M{"userId": source}, bson.M{"$set": bson.M{"userId": target}}); err != nil {
+		return err
+	}
+	g := s.DB(m.Name).C("groups")
+	for _, f := range []string{"owners", "members"} {
+		if _, err := g.UpdateAll(bson.M{f: source}, bson.M{"$addToSet": bson.M{f: target}}); err != nil {
+			return err
+		}
+		if _, err := g.UpdateAll(bson.M{f: source}, bson.M{"$pull": bson.M{f: source}}); err != nil {
+			return err
+		}
+	}
+	return c.RemoveId(docID(source))
+}
+
+// ResolveAlias returns the id of the user the given id was merged into
+func (m *Mongo) ResolveAlias(ctx context.Context, id string) (string, error) {
+	s := m.session(ctx)
+	defer s.Close()
+	var alias struct {
+		Target string `bson:"target"`
+	}
+	err := s.DB(m.Name).C("aliases").FindId(id).One(&alias)
+	return alias.Target, err
+}
+
+// GetUserByPreviousName gets the user who renamed away from name after since
+func (m *Mongo) GetUserByPreviousName(ctx context.Context, name string, since time.Time) (users.User, error) {
+	s := m.session(ctx)
+	defer s.Close()
+	c := s.DB(m.Name).C("customers")
+	mu := New()
+	err := c.Find(bson.M{"usernameHistory": bson.M{"$elemMatch": bson.M{
+		"key":       users.NormalizeUsername(name),
+		"changedAt": bson.M{"$gt": since},
+	}}}).One(&mu)
+	mu.AddUserIDs()
+	return mu.User, err
+}
+
+// RecordLogin stores the time of a successful login and counts it
+func (m *Mongo) RecordLogin(ctx context.Context, id string, at time.Time) error {
+	if !db.ValidID(id) {
+		return ErrInvalidHexID
+	}
+	s := m.session(ctx)
+	defer s.Close()
+	c := s.DB(m.Name).C("customers")
+	return c.UpdateId(docID(id), bson.M{
+		"$set": bson.M{"lastLoginAt": at},
+		"$inc": bson.M{"loginCount": 1},
+	})
+}
+
+// AddUserTag adds tag to the user, tags are kept unique
+func (m *Mongo) AddUserTag(ctx context.Context, id, tag string) error {
+	return m.updateTags(ctx, id, bson.M{"$addToSet": bson.M{"tags": tag}, "$set": bson.M{"updatedAt": now()}})
+}
+
+// RemoveUserTag removes tag from the user
+func (m *Mongo) RemoveUserTag(ctx context.Context, id, tag string) error {
+	return m.updateTags(ctx, id, bson.M{"$pull": bson.M{"tags": tag}, "$set": bson.M{"updatedAt": now()}})
+}
+
+func (m *Mongo) updateTags(ctx context.Context, id string, update bson.M) error {
+	if !db.ValidID(id) {
+		return ErrInvalidHexID
+	}
+	s := m.session(ctx)
 	defer s.Close()
-	ids := make([]bson.ObjectId, 0)
+	c := s.DB(m.Name).C("customers")
+	return c.UpdateId(docID(id), update)
+}
+
+func (m *Mongo) createCards(ctx context.Context, owner docID, cs []users.Card) ([]docID, error) {
+	s := m.session(ctx)
 	defer s.Close()
+	ids := make([]docID, 0)
 	for k, ca := range cs {
-		id := bson.NewObjectId()
-		mc := MongoCard{Card: ca, ID: id}
-		c := s.DB("").C("cards")
-		_, err := c.UpsertId(mc.ID, mc)
-		if err != nil {
+		id := newID()
+		ca.CreatedAt, ca.UpdatedAt = now(), now()
+		mc := MongoCard{Card: ca, ID: id, Registering: owner}
+		c := s.DB(m.Name).C("cards")
+		if err := c.Insert(mc); err != nil {
 			return ids, err
 		}
 		ids = append(ids, id)
-		cs[k].ID = id.Hex()
+		mc.AddID()
+		cs[k] = mc.Card
 	}
 	return ids, nil
 }
 
-func (m *Mongo) createAddresses(as []users.Address) ([]bson.ObjectId, error) {
-	ids := make([]bson.ObjectId, 0)
-	s := m.Session.Copy()
+func (m *Mongo) createAddresses(ctx context.Context, owner docID, as []users.Address) ([]docID, error) {
+	ids := make([]docID, 0)
+	s := m.session(ctx)
 	defer s.Close()
 	for k, a := range as {
-		id := bson.NewObjectId()
-		ma := MongoAddress{Address: a, ID: id}
-		c := s.DB("").C("addresses")
-		_, err := c.UpsertId(ma.ID, ma)
-		if err != nil {
+		id := newID()
+		a.CreatedAt, a.UpdatedAt = now(), now()
+		ma := MongoAddress{Address: a, ID: id, Registering: owner}
+		c := s.DB(m.Name).C("addresses")
+		if err := c.Insert(ma); err != nil {
 			return ids, err
 		}
 		ids = append(ids, id)
-		as[k].ID = id.Hex()
+		ma.AddID()
+		as[k] = ma.Address
 	}
 	return ids, nil
 }
 
-func (m *Mongo) cleanAttributes(mu MongoUser) error {
-	s := m.Session.Copy()
+// unregister removes the user and the addresses and cards of a failed
+// CreateUser. The user may be there, as a failed write may still have been
+// applied.
+func (m *Mongo) unregister(ctx context.Context, mu MongoUser) error {
+	s := m.session(ctx)
+	defer s.Close()
+	if err := s.DB(m.Name).C("customers").RemoveId(mu.ID); err != nil && err != mgo.ErrNotFound {
+		return err
+	}
+	if _, err := s.DB(m.Name).C("addresses").RemoveAll(bson.M{"_id": bson.M{"$in": mu.AddressIDs}}); err != nil {
+		return err
+	}
+	_, err := s.DB(m.Name).C("cards").RemoveAll(bson.M{"_id": bson.M{"$in": mu.CardIDs}})
+	return err
+}
+
+// registered takes the registering marks off the addresses and cards of the
+// user.
+func (m *Mongo) registered(ctx context.Context, mu MongoUser) error {
+	s := m.session(ctx)
 	defer s.Close()
-	c := s.DB("").C("addresses")
-	_, err := c.RemoveAll(bson.M{"_id": bson.M{"$in": mu.AddressIDs}})
-	c = s.DB("").C("cards")
-	_, err = c.RemoveAll(bson.M{"_id": bson.M{"$in": mu.CardIDs}})
+	unset := bson.M{"$unset": bson.M{"registering": ""}}
+	if _, err := s.DB(m.Name).C("addresses").UpdateAll(bson.M{"_id": bson.M{"$in": mu.AddressIDs}}, unset); err != nil {
+		return err
+	}
+	_, err := s.DB(m.Name).C("cards").UpdateAll(bson.M{"_id": bson.M{"$in": mu.CardIDs}}, unset)
 	return err
 }
 
-func (m *Mongo) appendAttributeId(attr string, id bson.ObjectId, userid string) error {
-	s := m.Session.Copy()
+func (m *Mongo) appendAttributeId(ctx context.Context, attr string, id docID, userid string) error {
+	s := m.session(ctx)
 	defer s.Close()
-	c := s.DB("").C("customers")
-	return c.Update(bson.M{"_id": bson.ObjectIdHex(userid)},
+	c := s.DB(m.Name).C("customers")
+	return c.Update(bson.M{"_id": docID(userid)},
 		bson.M{"$addToSet": bson.M{attr: id}})
 }
 
-func (m *Mongo) removeAttributeId(attr string, id bson.ObjectId, userid string) error {
-	s := m.Session.Copy()
+// clearDefaultAddress takes the default flag off the other addresses of the
+// user with the given type.
+func (m *Mongo) clearDefaultAddress(ctx context.Context, userid string, keep docID, typ string) error {
+	s := m.session(ctx)
 	defer s.Close()
-	c := s.DB("").C("customers")
-	return c.Update(bson.M{"_id": bson.ObjectIdHex(userid)},
+	var mu MongoUser
+	if err := s.DB(m.Name).C("customers").FindId(docID(userid)).Select(bson.M{"addresses": 1}).One(&mu); err != nil {
+		return err
+	}
+	_, err := s.DB(m.Name).C("addresses").UpdateAll(bson.M{
+		"_id":     bson.M{"$in": mu.AddressIDs, "$ne": keep},
+		"type":    typ,
+		"default": true,
+	}, bson.M{"$set": bson.M{"default": false, "updatedAt": now()}})
+	return err
+}
+
+func (m *Mongo) removeAttributeId(ctx context.Context, attr string, id docID, userid string) error {
+	s := m.session(ctx)
+	defer s.Close()
+	c := s.DB(m.Name).C("customers")
+	return c.Update(bson.M{"_id": docID(userid)},
 		bson.M{"$pull": bson.M{attr: id}})
 }
 
 // GetUserByName Get user by their name
-func (m *Mongo) GetUserByName(name string) (users.User, error) {
-	s := m.Session.Copy()
+func (m *Mongo) GetUserByName(ctx context.Context, name string) (users.User, error) {
+	s := m.session(ctx)
 	defer s.Close()
-	c := s.DB("").C("customers")
+	c := s.DB(m.Name).C("customers")
 	mu := New()
-	err := c.Find(bson.M{"username": name}).One(&mu)
+	err := c.Find(bson.M{"usernameKey": users.NormalizeUsername(name)}).One(&mu)
 	mu.AddUserIDs()
 	return mu.User, err
 }
 
 // GetUser Get user by their object id
-func (m *Mongo) GetUser(id string) (users.User, error) {
-	s := m.Session.Copy()
+func (m *Mongo) GetUser(ctx context.Context, id string) (users.User, error) {
+	s := m.session(ctx)
 	defer s.Close()
-	if !bson.IsObjectIdHex(id) {
+	if !db.ValidID(id) {
 		return users.New(), errors.New("Invalid Id Hex")
 	}
-	c := s.DB("").C("customers")
+	c := s.DB(m.Name).C("customers")
 	mu := New()
-	err := c.FindId(bson.ObjectIdHex(id)).One(&mu)
+	err := c.FindId(docID(id)).One(&mu)
 	mu.AddUserIDs()
 	return mu.User, err
 }
 
-// GetUsers Get all users
-func (m *Mongo) GetUsers() ([]users.User, error) {
-	// TODO: add paginations
-	s := m.Session.Copy()
+// GetUsersByID gets the users with the given ids in a single query, ids
+// that aren't valid or unknown are left out
+func (m *Mongo) GetUsersByID(ctx context.Context, ids []string) ([]users.User, error) {
+	s := m.session(ctx)
 	defer s.Close()
-	c := s.DB("").C("customers")
 	var mus []MongoUser
-	err := c.Find(nil).All(&mus)
-	us := make([]users.User, 0)
+	err := s.DB(m.Name).C("customers").Find(bson.M{"_id": bson.M{"$in": docIDs(ids)}}).All(&mus)
+	us := make([]users.User, 0, len(mus))
 	for _, mu := range mus {
 		mu.AddUserIDs()
 		us = append(us, mu.User)
@@ -238,101 +766,383 @@ func (m *Mongo) GetUsers() ([]users.User, error) {
 	return us, err
 }
 
-// GetUserAttributes given a user, load all cards and addresses connected to that user
-func (m *Mongo) GetUserAttributes(u *users.User) error {
-	s := m.Session.Copy()
-	defer s.Close()
-	ids := make([]bson.ObjectId, 0)
-	for _, a := range u.Addresses {
-		if !bson.IsObjectIdHex(a.ID) {
-			return ErrInvalidHexID
+// docIDs converts the valid ids of ids, dropping the others
+func docIDs(ids []string) []docID {
+	oids := make([]docID, 0, len(ids))
+	for _, id := range ids {
+		if db.ValidID(id) {
+			oids = append(oids, docID(id))
 		}
-		ids = append(ids, bson.ObjectIdHex(a.ID))
 	}
-	var ma []MongoAddress
-	c := s.DB("").C("addresses")
-	err := c.Find(bson.M{"_id": bson.M{"$in": ids}}).All(&ma)
-	if err != nil {
-		return err
+	return oids
+}
+
+// GetUsers Get all users matching the query
+func (m *Mongo) GetUsers(ctx context.Context, q db.UserQuery) ([]users.User, error) {
+	// TODO: add paginations
+	s := m.session(ctx)
+	defer s.Close()
+	c := s.DB(m.Name).C("customers")
+	var mus []MongoUser
+	query := c.Find(userSelector(q))
+	if q.Sort != "" {
+		query = query.Sort(userSort(q))
+	}
+	if len(q.Fields) > 0 {
+		query = query.Select(userProjection(q.Fields))
 	}
-	na := make([]users.Address, 0)
-	for _, a := range ma {
-		a.Address.ID = a.ID.Hex()
-		na = append(na, a.Address)
+	if q.Limit > 0 {
+		query = query.Limit(q.Limit)
 	}
-	u.Addresses = na
+	err := query.All(&mus)
+	us := make([]users.User, 0)
+	for _, mu := range mus {
+		mu.AddUserIDs()
+		us = append(us, mu.User)
+	}
+	return us, err
+}
 
-	ids = make([]bson.ObjectId, 0)
-	for _, c := range u.Cards {
-		if !bson.IsObjectIdHex(c.ID) {
-			return ErrInvalidHexID
+// userProjection selects the document fields of the given users.Fields,
+// and the ids of the addresses and cards to expand them by.
+func userProjection(fields []string) bson.M {
+	p := bson.M{"_id": 1, "addresses": 1, "cards": 1}
+	for _, f := range fields {
+		if doc := users.Fields[f]; doc != "" {
+			p[doc] = 1
 		}
-		ids = append(ids, bson.ObjectIdHex(c.ID))
-	}
-	var mc []MongoCard
-	c = s.DB("").C("cards")
-	err = c.Find(bson.M{"_id": bson.M{"$in": ids}}).All(&mc)
-	if err != nil {
-		return err
 	}
+	return p
+}
 
-	nc := make([]users.Card, 0)
-	for _, ca := range mc {
-		ca.Card.ID = ca.ID.Hex()
-		nc = append(nc, ca.Card)
+// GetStats counts the collections, signups per day since signupsSince and
+// users who logged in since activeSince
+func (m *Mongo) GetStats(ctx context.Context, signupsSince, activeSince time.Time) (db.Stats, error) {
+	s := m.session(ctx)
+	defer s.Close()
+	var st db.Stats
+	var err error
+	if st.Users, err = s.DB(m.Name).C("customers").Count(); err != nil {
+		return st, err
 	}
-	u.Cards = nc
-	return nil
+	if st.Addresses, err = s.DB(m.Name).C("addresses").Count(); err != nil {
+		return st, err
+	}
+	if st.Cards, err = s.DB(m.Name).C("cards").Count(); err != nil {
+		return st, err
+	}
+	c := s.DB(m.Name).C("customers")
+	if st.Active, err = c.Find(bson.M{"lastLoginAt": bson.M{"$gte": activeSince}}).Count(); err != nil {
+		return st, err
+	}
+	var days []struct {
+		Day   string `bson:"_id"`
+		Count int    `bson:"count"`
+	}
+	err = c.Pipe([]bson.M{
+		{"$match": bson.M{"createdAt": bson.M{"$gte": signupsSince}}},
+		{"$group": bson.M{
+			"_id":   bson.M{"$dateToString": bson.M{"format": "%Y-%m-%d", "date": "$createdAt"}},
+			"count": bson.M{"$sum": 1},
+		}},
+	}).All(&days)
+	counts := make(map[string]int, len(days))
+	for _, d := range days {
+		counts[d.Day] = d.Count
+	}
+	st.Signups = db.Days(signupsSince, time.Now(), counts)
+	return st, err
 }
 
-// GetCard Gets card by objects Id
-func (m *Mongo) GetCard(id string) (users.Card, error) {
-	s := m.Session.Copy()
+// adminFields are the user fields loaded for admin listings.
+var adminFields = bson.M{
+	"username":    1,
+	"email":       1,
+	"firstName":   1,
+	"lastName":    1,
+	"status":      1,
+	"roles":       1,
+	"tags":        1,
+	"createdAt":   1,
+	"lastLoginAt": 1,
+	"loginCount":  1,
+}
+
+// ListUsers gets a page of users in _id order, starting after the given id
+func (m *Mongo) ListUsers(ctx context.Context, after string, limit int) ([]users.User, error) {
+	sel := bson.M{}
+	if after != "" {
+		if !db.ValidID(after) {
+			return nil, ErrInvalidHexID
+		}
+		and(sel, afterID(after))
+	}
+	s := m.session(ctx)
 	defer s.Close()
-	if !bson.IsObjectIdHex(id) {
-		return users.Card{}, errors.New("Invalid Id Hex")
+	c := s.DB(m.Name).C("customers")
+	var mus []MongoUser
+	err := c.Find(sel).Select(adminFields).Sort("_id").Limit(limit).All(&mus)
+	us := make([]users.User, 0, len(mus))
+	for _, mu := range mus {
+		mu.AddUserIDs()
+		us = append(us, mu.User)
 	}
-	c := s.DB("").C("cards")
-	mc := MongoCard{}
-	err := c.FindId(bson.ObjectIdHex(id)).One(&mc)
-	mc.AddID()
-	return mc.Card, err
+	return us, err
 }
 
-// GetCards Gets all cards
-func (m *Mongo) GetCards() ([]users.Card, error) {
-	// TODO: add pagination
-	s := m.Session.Copy()
+// UserExists reports whether a user has the value in the given field, both
+// username and email are indexed
+func (m *Mongo) UserExists(ctx context.Context, field, value string) (bool, error) {
+	s := m.session(ctx)
 	defer s.Close()
-	c := s.DB("").C("cards")
-	var mcs []MongoCard
-	err := c.Find(nil).All(&mcs)
-	cs := make([]users.Card, 0)
-	for _, mc := range mcs {
-		mc.AddID()
-		cs = append(cs, mc.Card)
+	c := s.DB(m.Name).C("customers")
+	if field == "username" {
+		field, value = "usernameKey", users.NormalizeUsername(value)
 	}
-	return cs, err
+	n, err := c.Find(bson.M{field: value}).Limit(1).Count()
+	return n > 0, err
 }
 
-// CreateCard adds card to MongoDB
-func (m *Mongo) CreateCard(ca *users.Card, userid string) error {
-	if userid != "" && !bson.IsObjectIdHex(userid) {
-		return errors.New("Invalid Id Hex")
+// userSelector translates the query filters, all of them on indexed fields.
+// Creation time is taken from the _id.
+func userSelector(q db.UserQuery) bson.M {
+	sel := bson.M{}
+	if q.Email != "" {
+		sel["email"] = q.Email
 	}
-	s := m.Session.Copy()
-	defer s.Close()
-	c := s.DB("").C("cards")
-	id := bson.NewObjectId()
-	mc := MongoCard{Card: *ca, ID: id}
-	_, err := c.UpsertId(mc.ID, mc)
-	if err != nil {
-		return err
+	if q.LastName != "" {
+		sel["lastName"] = q.LastName
 	}
-	// Address for anonymous user
-	if userid != "" {
-		err = m.appendAttributeId("cards", mc.ID, userid)
-		if err != nil {
+	if !q.CreatedAfter.IsZero() || !q.CreatedBefore.IsZero() {
+		and(sel, createdBetween(q.CreatedAfter, q.CreatedBefore))
+	}
+	if !q.UpdatedAfter.IsZero() {
+		sel["updatedAt"] = bson.M{"$gt": q.UpdatedAfter}
+	}
+	if q.Tag != "" {
+		sel["tags"] = q.Tag
+	}
+	if q.Role != "" {
+		sel["roles"] = q.Role
+	}
+	for k, v := range q.Metadata {
+		sel["metadata."+k] = v
+	}
+	switch q.Status {
+	case "":
+		sel["status"] = bson.M{"$ne": users.StatusDeleted}
+	case users.StatusActive:
+		// Users without a status predate lifecycle states and are active.
+		sel["status"] = bson.M{"$in": []interface{}{nil, users.StatusActive}}
+	default:
+		sel["status"] = q.Status
+	}
+	return sel
+}
+
+func userSort(q db.UserQuery) string {
+	f, desc := q.SortField()
+	if f == "createdAt" {
+		f = "_id"
+	}
+	if desc {
+		return "-" + f
+	}
+	return f
+}
+
+// GetUserAttributes given a user, load all cards and addresses connected to that user
+func (m *Mongo) GetUserAttributes(ctx context.Context, u *users.User) error {
+	for _, a := range u.Addresses {
+		if !db.ValidID(a.ID) {
+			return ErrInvalidHexID
+		}
+	}
+	for _, c := range u.Cards {
+		if !db.ValidID(c.ID) {
+			return ErrInvalidHexID
+		}
+	}
+	us := []users.User{*u}
+	if err := m.ExpandUsers(ctx, us, db.Expandable); err != nil {
+		return err
+	}
+	*u = us[0]
+	return nil
+}
+
+// ExpandUsers loads the named attributes, addresses or cards, of all the
+// users with one query per collection instead of one per user
+func (m *Mongo) ExpandUsers(ctx context.Context, us []users.User, attrs []string) error {
+	s := m.session(ctx)
+	defer s.Close()
+	for _, attr := range attrs {
+		var ids []string
+		for _, u := range us {
+			switch attr {
+			case "addresses":
+				for _, a := range u.Addresses {
+					ids = append(ids, a.ID)
+				}
+			case "cards":
+				for _, c := range u.Cards {
+					ids = append(ids, c.ID)
+				}
+			default:
+				return fmt.Errorf("no attribute %v", attr)
+			}
+		}
+		q := s.DB(m.Name).C(attr).Find(bson.M{"_id": bson.M{"$in": docIDs(ids)}})
+		if attr == "addresses" {
+			var mas []MongoAddress
+			if err := q.All(&mas); err != nil {
+				return err
+			}
+			byID := make(map[string]users.Address, len(mas))
+			for _, ma := range mas {
+				ma.AddID()
+				byID[ma.Address.ID] = ma.Address
+			}
+			for k := range us {
+				as := make([]users.Address, 0, len(us[k].Addresses))
+				for _, a := range us[k].Addresses {
+					if a, ok := byID[a.ID]; ok {
+						as = append(as, a)
+					}
+				}
+				us[k].Addresses = as
+			}
+			continue
+		}
+		var mcs []MongoCard
+		if err := q.All(&mcs); err != nil {
+			return err
+		}
+		byID := make(map[string]users.Card, len(mcs))
+		for _, mc := range mcs {
+			mc.AddID()
+			byID[mc.Card.ID] = mc.Card
+		}
+		for k := range us {
+			cs := make([]users.Card, 0, len(us[k].Cards))
+			for _, c := range us[k].Cards {
+				if c, ok := byID[c.ID]; ok {
+					cs = append(cs, c)
+				}
+			}
+			us[k].Cards = cs
+		}
+	}
+	return nil
+}
+
+// GetCard Gets card by objects Id
+func (m *Mongo) GetCard(ctx context.Context, id string) (users.Card, error) {
+	s := m.session(ctx)
+	defer s.Close()
+	if !db.ValidID(id) {
+		return users.Card{}, errors.New("Invalid Id Hex")
+	}
+	c := s.DB(m.Name).C("cards")
+	mc := MongoCard{}
+	err := c.FindId(docID(id)).One(&mc)
+	mc.AddID()
+	return mc.Card, err
+}
+
+// GetCards Gets all cards
+func (m *Mongo) GetCards(ctx context.Context) ([]users.Card, error) {
+	// TODO: add pagination
+	s := m.session(ctx)
+	defer s.Close()
+	c := s.DB(m.Name).C("cards")
+	var mcs []MongoCard
+	err := c.Find(bson.M{"deletedAt": bson.M{"$exists": false}}).All(&mcs)
+	cs := make([]users.Card, 0)
+	for _, mc := range mcs {
+		mc.AddID()
+		cs = append(cs, mc.Card)
+	}
+	return cs, err
+}
+
+// GetCardsByID gets the cards with the given ids in a single query, ids that
+// aren't valid or unknown and deleted cards are left out
+func (m *Mongo) GetCardsByID(ctx context.Context, ids []string) ([]users.Card, error) {
+	s := m.session(ctx)
+	defer s.Close()
+	var mcs []MongoCard
+	err := s.DB(m.Name).C("cards").Find(bson.M{
+		"_id":       bson.M{"$in": docIDs(ids)},
+		"deletedAt": bson.M{"$exists": false},
+	}).All(&mcs)
+	cs := make([]users.Card, 0, len(mcs))
+	for _, mc := range mcs {
+		mc.AddID()
+		cs = append(cs, mc.Card)
+	}
+	return cs, err
+}
+
+// ListCards returns up to limit cards after the given id in id order, with
+// the customers owning them. Deleted cards are left out.
+func (m *Mongo) ListCards(ctx context.Context, after string, limit int) ([]db.OwnedCard, error) {
+	sel := bson.M{"deletedAt": bson.M{"$exists": false}}
+	if after != "" {
+		if !db.ValidID(after) {
+			return nil, ErrInvalidHexID
+		}
+		and(sel, afterID(after))
+	}
+	s := m.session(ctx)
+	defer s.Close()
+	var mcs []MongoCard
+	if err := s.DB(m.Name).C("cards").Find(sel).Sort("_id").Limit(limit).All(&mcs); err != nil {
+		return nil, err
+	}
+	ids := make([]docID, 0, len(mcs))
+	for _, mc := range mcs {
+		ids = append(ids, mc.ID)
+	}
+	var mus []MongoUser
+	err := s.DB(m.Name).C("customers").Find(bson.M{"cards": bson.M{"$in": ids}}).Select(bson.M{"cards": 1}).All(&mus)
+	if err != nil {
+		return nil, err
+	}
+	owners := map[docID]string{}
+	for _, mu := range mus {
+		for _, id := range mu.CardIDs {
+			owners[id] = string(mu.ID)
+		}
+	}
+	cs := make([]db.OwnedCard, 0, len(mcs))
+	for _, mc := range mcs {
+		mc.AddID()
+		cs = append(cs, db.OwnedCard{Card: mc.Card, UserID: owners[mc.ID]})
+	}
+	return cs, nil
+}
+
+// CreateCard adds card to MongoDB
+func (m *Mongo) CreateCard(ctx context.Context, ca *users.Card, userid string) error {
+	if userid != "" && !db.ValidID(userid) {
+		return errors.New("Invalid Id Hex")
+	}
+	s := m.session(ctx)
+	defer s.Close()
+	c := s.DB(m.Name).C("cards")
+	id := newID()
+	mc := MongoCard{Card: *ca, ID: id}
+	mc.Card.CreatedAt = now()
+	mc.Card.UpdatedAt = mc.Card.CreatedAt
+	_, err := c.UpsertId(mc.ID, mc)
+	if err != nil {
+		return err
+	}
+	// Address for anonymous user
+	if userid != "" {
+		err = m.appendAttributeId(ctx, "cards", mc.ID, userid)
+		if err != nil {
 			return err
 		}
 	}
@@ -341,26 +1151,116 @@ func (m *Mongo) CreateCard(ca *users.Card, userid string) error {
 	return err
 }
 
+// UpdateCard sets the expiry and holder of the card, the number is never
+// changed
+func (m *Mongo) UpdateCard(ctx context.Context, id string, u users.CardUpdate) error {
+	if !db.ValidID(id) {
+		return errors.New("Invalid Id Hex")
+	}
+	s := m.session(ctx)
+	defer s.Close()
+	set := bson.M{"updatedAt": now()}
+	if u.Expires != nil {
+		set["expires"] = *u.Expires
+	}
+	if u.Holder != nil {
+		set["holder"] = *u.Holder
+	}
+	return s.DB(m.Name).C("cards").UpdateId(docID(id), bson.M{"$set": set})
+}
+
+// SetDefaultCard makes the card the default of the user, failing with
+// mgo.ErrNotFound unless the card is one of theirs
+func (m *Mongo) SetDefaultCard(ctx context.Context, userID, cardID string) error {
+	if !db.ValidID(userID) || !db.ValidID(cardID) {
+		return ErrInvalidHexID
+	}
+	s := m.session(ctx)
+	defer s.Close()
+	return s.DB(m.Name).C("customers").Update(
+		bson.M{"_id": docID(userID), "cards": docID(cardID)},
+		bson.M{"$set": bson.M{"defaultCard": cardID, "updatedAt": now()}},
+	)
+}
+
+// SetCardVerification stores the outcome of verifying a pending card.
+// Cards no longer pending are left alone.
+func (m *Mongo) SetCardVerification(ctx context.Context, id, status string) error {
+	if !db.ValidID(id) {
+		return ErrInvalidHexID
+	}
+	s := m.session(ctx)
+	defer s.Close()
+	err := s.DB(m.Name).C("cards").Update(
+		bson.M{"_id": docID(id), "verification": users.VerificationPending},
+		bson.M{"$set": bson.M{"verification": status, "updatedAt": now()}},
+	)
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// SetCardReminded records that the owner of the card was reminded of the
+// expiry
+func (m *Mongo) SetCardReminded(ctx context.Context, id, expires string) error {
+	if !db.ValidID(id) {
+		return ErrInvalidHexID
+	}
+	s := m.session(ctx)
+	defer s.Close()
+	return s.DB(m.Name).C("cards").UpdateId(docID(id), bson.M{"$set": bson.M{"remindedFor": expires}})
+}
+
+// TombstoneCard keeps only the masked number of the card, drops its token
+// and takes it off its owner. Cards already deleted fail with
+// mgo.ErrNotFound
+func (m *Mongo) TombstoneCard(ctx context.Context, id, masked, replacedBy string) error {
+	if !db.ValidID(id) {
+		return ErrInvalidHexID
+	}
+	s := m.session(ctx)
+	defer s.Close()
+	at := now()
+	set := bson.M{"longNum": masked, "deletedAt": at, "updatedAt": at}
+	if replacedBy != "" {
+		set["replacedBy"] = replacedBy
+	}
+	err := s.DB(m.Name).C("cards").Update(
+		bson.M{"_id": docID(id), "deletedAt": bson.M{"$exists": false}},
+		bson.M{"$set": set, "$unset": bson.M{"ccv": "", "token": ""}},
+	)
+	if err != nil {
+		return err
+	}
+	c := s.DB(m.Name).C("customers")
+	if _, err := c.UpdateAll(bson.M{"defaultCard": id}, bson.M{"$unset": bson.M{"defaultCard": ""}}); err != nil {
+		return err
+	}
+	_, err = c.UpdateAll(bson.M{"cards": docID(id)}, bson.M{"$pull": bson.M{"cards": docID(id)}})
+	return err
+}
+
 // GetAddress Gets an address by object Id
-func (m *Mongo) GetAddress(id string) (users.Address, error) {
-	s := m.Session.Copy()
+func (m *Mongo) GetAddress(ctx context.Context, id string) (users.Address, error) {
+	s := m.session(ctx)
 	defer s.Close()
-	if !bson.IsObjectIdHex(id) {
+	if !db.ValidID(id) {
 		return users.Address{}, errors.New("Invalid Id Hex")
 	}
-	c := s.DB("").C("addresses")
+	c := s.DB(m.Name).C("addresses")
 	ma := MongoAddress{}
-	err := c.FindId(bson.ObjectIdHex(id)).One(&ma)
+	err := c.FindId(docID(id)).One(&ma)
 	ma.AddID()
 	return ma.Address, err
 }
 
 // GetAddresses gets all addresses
-func (m *Mongo) GetAddresses() ([]users.Address, error) {
+func (m *Mongo) GetAddresses(ctx context.Context) ([]users.Address, error) {
 	// TODO: add pagination
-	s := m.Session.Copy()
+	s := m.session(ctx)
 	defer s.Close()
-	c := s.DB("").C("addresses")
+	c := s.DB(m.Name).C("addresses")
 	var mas []MongoAddress
 	err := c.Find(nil).All(&mas)
 	as := make([]users.Address, 0)
@@ -371,70 +1271,386 @@ func (m *Mongo) GetAddresses() ([]users.Address, error) {
 	return as, err
 }
 
+// GetAddressesByID gets the addresses with the given ids in a single query,
+// ids that aren't valid or unknown are left out
+func (m *Mongo) GetAddressesByID(ctx context.Context, ids []string) ([]users.Address, error) {
+	s := m.session(ctx)
+	defer s.Close()
+	var mas []MongoAddress
+	err := s.DB(m.Name).C("addresses").Find(bson.M{"_id": bson.M{"$in": docIDs(ids)}}).All(&mas)
+	as := make([]users.Address, 0, len(mas))
+	for _, ma := range mas {
+		ma.AddID()
+		as = append(as, ma.Address)
+	}
+	return as, err
+}
+
+// MongoActivity is a wrapper for Activity
+type MongoActivity struct {
+	users.Activity `bson:",inline"`
+	ID             docID `bson:"_id"`
+}
+
+// AddActivity appends a to the activity feed of its user
+func (m *Mongo) AddActivity(ctx context.Context, a *users.Activity) error {
+	s := m.session(ctx)
+	defer s.Close()
+	ma := MongoActivity{Activity: *a, ID: newID()}
+	ma.Activity.Time = now()
+	if err := s.DB(m.Name).C("activity").Insert(ma); err != nil {
+		return err
+	}
+	ma.Activity.ID = string(ma.ID)
+	*a = ma.Activity
+	return nil
+}
+
+// GetActivity returns up to limit entries of the activity feed of the user
+// older than the entry before, newest first
+func (m *Mongo) GetActivity(ctx context.Context, userID, before string, limit int) ([]users.Activity, error) {
+	sel := bson.M{"userId": userID}
+	if before != "" {
+		if !db.ValidID(before) {
+			return nil, ErrInvalidHexID
+		}
+		and(sel, beforeID(before))
+	}
+	s := m.session(ctx)
+	defer s.Close()
+	var mas []MongoActivity
+	err := s.DB(m.Name).C("activity").Find(sel).Sort("-_id").Limit(limit).All(&mas)
+	as := make([]users.Activity, 0, len(mas))
+	for _, ma := range mas {
+		ma.Activity.ID = string(ma.ID)
+		as = append(as, ma.Activity)
+	}
+	return as, err
+}
+
+// OwnerOf returns the id of the user owning the address or card id
+func (m *Mongo) OwnerOf(ctx context.Context, entity, id string) (string, error) {
+	if entity != "addresses" && entity != "cards" {
+		return "", fmt.Errorf("no owner of %v", entity)
+	}
+	if !db.ValidID(id) {
+		return "", ErrInvalidHexID
+	}
+	s := m.session(ctx)
+	defer s.Close()
+	var mu struct {
+		ID docID `bson:"_id"`
+	}
+	err := s.DB(m.Name).C("customers").Find(bson.M{entity: docID(id)}).Select(bson.M{"_id": 1}).One(&mu)
+	return string(mu.ID), err
+}
+
+// MongoGroup is a wrapper for Group
+type MongoGroup struct {
+	users.Group `bson:",inline"`
+	ID          docID `bson:"_id"`
+}
+
+// AddID ObjectID as string
+func (m *MongoGroup) AddID() {
+	m.Group.ID = string(m.ID)
+}
+
+// CreateGroup inserts the group into MongoDB
+func (m *Mongo) CreateGroup(ctx context.Context, g *users.Group) error {
+	s := m.session(ctx)
+	defer s.Close()
+	mg := MongoGroup{Group: *g, ID: newID()}
+	mg.Group.CreatedAt = now()
+	if mg.Group.Owners == nil {
+		mg.Group.Owners = make([]string, 0)
+	}
+	if mg.Group.Members == nil {
+		mg.Group.Members = make([]string, 0)
+	}
+	if err := s.DB(m.Name).C("groups").Insert(mg); err != nil {
+		return err
+	}
+	mg.AddID()
+	*g = mg.Group
+	return nil
+}
+
+// GetGroup gets a group by object id
+func (m *Mongo) GetGroup(ctx context.Context, id string) (users.Group, error) {
+	if !db.ValidID(id) {
+		return users.Group{}, ErrInvalidHexID
+	}
+	s := m.session(ctx)
+	defer s.Close()
+	mg := MongoGroup{}
+	err := s.DB(m.Name).C("groups").FindId(docID(id)).One(&mg)
+	mg.AddID()
+	return mg.Group, err
+}
+
+// GetUserGroups gets the groups the user owns or is a member of
+func (m *Mongo) GetUserGroups(ctx context.Context, userID string) ([]users.Group, error) {
+	s := m.session(ctx)
+	defer s.Close()
+	var mgs []MongoGroup
+	err := s.DB(m.Name).C("groups").Find(bson.M{"$or": []bson.M{
+		{"owners": userID},
+		{"members": userID},
+	}}).All(&mgs)
+	gs := make([]users.Group, 0, len(mgs))
+	for _, mg := range mgs {
+		mg.AddID()
+		gs = append(gs, mg.Group)
+	}
+	return gs, err
+}
+
+// AddGroupMember adds the user to the group members
+func (m *Mongo) AddGroupMember(ctx context.Context, groupID, userID string) error {
+	return m.updateGroup(ctx, groupID, bson.M{"$addToSet": bson.M{"members": userID}})
+}
+
+// RemoveGroupMember removes the user from the group members
+func (m *Mongo) RemoveGroupMember(ctx context.Context, groupID, userID string) error {
+	return m.updateGroup(ctx, groupID, bson.M{"$pull": bson.M{"members": userID}})
+}
+
+func (m *Mongo) updateGroup(ctx context.Context, id string, update bson.M) error {
+	if !db.ValidID(id) {
+		return ErrInvalidHexID
+	}
+	s := m.session(ctx)
+	defer s.Close()
+	return s.DB(m.Name).C("groups").UpdateId(docID(id), update)
+}
+
 // CreateAddress Inserts Address into MongoDB
-func (m *Mongo) CreateAddress(a *users.Address, userid string) error {
-	if userid != "" && !bson.IsObjectIdHex(userid) {
+func (m *Mongo) CreateAddress(ctx context.Context, a *users.Address, userid string) error {
+	if userid != "" && !db.ValidID(userid) {
 		return errors.New("Invalid Id Hex")
 	}
-	s := m.Session.Copy()
+	s := m.session(ctx)
 	defer s.Close()
-	c := s.DB("").C("addresses")
-	id := bson.NewObjectId()
+	c := s.DB(m.Name).C("addresses")
+	id := newID()
 	ma := MongoAddress{Address: *a, ID: id}
+	ma.Address.CreatedAt = now()
+	ma.Address.UpdatedAt = ma.Address.CreatedAt
 	_, err := c.UpsertId(ma.ID, ma)
 	if err != nil {
 		return err
 	}
 	// Address for anonymous user
 	if userid != "" {
-		err = m.appendAttributeId("addresses", ma.ID, userid)
+		err = m.appendAttributeId(ctx, "addresses", ma.ID, userid)
 		if err != nil {
 			return err
 		}
+		if a.Default {
+			if err := m.clearDefaultAddress(ctx, userid, ma.ID, a.Type); err != nil {
+				return err
+			}
+		}
 	}
 	ma.AddID()
 	*a = ma.Address
 	return err
 }
 
+// CreateAddresses inserts the addresses in a single batch and adds them to
+// the user, setting their ids.
+func (m *Mongo) CreateAddresses(ctx context.Context, as []users.Address, userid string) error {
+	if !db.ValidID(userid) {
+		return ErrInvalidHexID
+	}
+	s := m.session(ctx)
+	defer s.Close()
+	at := now()
+	mas := make([]MongoAddress, len(as))
+	docs := make([]interface{}, len(as))
+	ids := make([]docID, len(as))
+	for i, a := range as {
+		mas[i] = MongoAddress{Address: a, ID: newID()}
+		mas[i].Address.CreatedAt = at
+		mas[i].Address.UpdatedAt = at
+		docs[i], ids[i] = mas[i], mas[i].ID
+	}
+	if err := s.DB(m.Name).C("addresses").Insert(docs...); err != nil {
+		return err
+	}
+	err := s.DB(m.Name).C("customers").UpdateId(docID(userid),
+		bson.M{"$addToSet": bson.M{"addresses": bson.M{"$each": ids}}})
+	if err != nil {
+		return err
+	}
+	for i, ma := range mas {
+		if ma.Address.Default {
+			if err := m.clearDefaultAddress(ctx, userid, ma.ID, ma.Address.Type); err != nil {
+				return err
+			}
+		}
+		ma.AddID()
+		as[i] = ma.Address
+	}
+	return nil
+}
+
+// SetAddressLocation stores the outcome of geocoding a pending address.
+// Addresses no longer pending are left alone.
+func (m *Mongo) SetAddressLocation(ctx context.Context, id string, l *users.Location, status string) error {
+	if !db.ValidID(id) {
+		return errors.New("Invalid Id Hex")
+	}
+	s := m.session(ctx)
+	defer s.Close()
+	set := bson.M{"geocode": status, "updatedAt": now()}
+	if l != nil {
+		set["location"] = l
+	}
+	err := s.DB(m.Name).C("addresses").Update(bson.M{"_id": docID(id), "geocode": users.GeocodePending}, bson.M{"$set": set})
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// UpdateAddress replaces the address with id, keeping when it was created.
+// A default address stops being the default of its type for its owner's
+// other addresses.
+func (m *Mongo) UpdateAddress(ctx context.Context, id string, a *users.Address) error {
+	if !db.ValidID(id) {
+		return ErrInvalidHexID
+	}
+	s := m.session(ctx)
+	defer s.Close()
+	c := s.DB(m.Name).C("addresses")
+	var stored MongoAddress
+	if err := c.FindId(docID(id)).One(&stored); err != nil {
+		return err
+	}
+	stored.AddID()
+	ma := MongoAddress{Address: *a, ID: stored.ID}
+	ma.Address.Links = nil
+	ma.Address.CreatedAt = stored.CreatedAt
+	ma.Address.UpdatedAt = now()
+	if err := c.UpdateId(ma.ID, ma); err != nil {
+		return err
+	}
+	if a.Default {
+		// Addresses of anonymous users have no owner.
+		owner, err := m.OwnerOf(ctx, "addresses", id)
+		switch {
+		case err == nil:
+			if err := m.clearDefaultAddress(ctx, owner, ma.ID, a.Type); err != nil {
+				return err
+			}
+		case err != mgo.ErrNotFound:
+			return err
+		}
+	}
+	ma.AddID()
+	*a = ma.Address
+	return nil
+}
+
 // CreateAddress Inserts Address into MongoDB
-func (m *Mongo) Delete(entity, id string) error {
-	if !bson.IsObjectIdHex(id) {
+func (m *Mongo) Delete(ctx context.Context, entity, id string) error {
+	if !db.ValidID(id) {
 		return errors.New("Invalid Id Hex")
 	}
-	s := m.Session.Copy()
+	s := m.session(ctx)
 	defer s.Close()
-	c := s.DB("").C(entity)
+	c := s.DB(m.Name).C(entity)
 	if entity == "customers" {
-		u, err := m.GetUser(id)
+		u, err := m.GetUser(ctx, id)
 		if err != nil {
 			return err
 		}
-		aids := make([]bson.ObjectId, 0)
+		aids := make([]docID, 0)
 		for _, a := range u.Addresses {
-			aids = append(aids, bson.ObjectIdHex(a.ID))
+			aids = append(aids, docID(a.ID))
 		}
-		cids := make([]bson.ObjectId, 0)
+		cids := make([]docID, 0)
 		for _, c := range u.Cards {
-			cids = append(cids, bson.ObjectIdHex(c.ID))
+			cids = append(cids, docID(c.ID))
 		}
-		ac := s.DB("").C("addresses")
+		ac := s.DB(m.Name).C("addresses")
 		ac.RemoveAll(bson.M{"_id": bson.M{"$in": aids}})
-		cc := s.DB("").C("cards")
+		cc := s.DB(m.Name).C("cards")
 		cc.RemoveAll(bson.M{"_id": bson.M{"$in": cids}})
 	} else {
-		c := s.DB("").C("customers")
+		c := s.DB(m.Name).C("customers")
 		c.UpdateAll(bson.M{},
-			bson.M{"$pull": bson.M{entity: bson.ObjectIdHex(id)}})
+			bson.M{"$pull": bson.M{entity: docID(id)}})
 	}
-	return c.Remove(bson.M{"_id": bson.ObjectIdHex(id)})
+	return c.Remove(bson.M{"_id": docID(id)})
+}
+
+// DeleteUsers removes the users and their addresses and cards in one batch
+// per collection, reporting invalid and unknown ids individually
+func (m *Mongo) DeleteUsers(ctx context.Context, ids []string) (map[string]error, error) {
+	res := make(map[string]error, len(ids))
+	oids := make([]docID, 0, len(ids))
+	for _, id := range ids {
+		if !db.ValidID(id) {
+			res[id] = ErrInvalidHexID
+			continue
+		}
+		oids = append(oids, docID(id))
+	}
+	s := m.session(ctx)
+	defer s.Close()
+	c := s.DB(m.Name).C("customers")
+	var mus []MongoUser
+	err := c.Find(bson.M{"_id": bson.M{"$in": oids}}).All(&mus)
+	if err != nil {
+		return nil, err
+	}
+	found := make([]docID, 0, len(mus))
+	aids := make([]docID, 0)
+	cids := make([]docID, 0)
+	for _, mu := range mus {
+		found = append(found, mu.ID)
+		aids = append(aids, mu.AddressIDs...)
+		cids = append(cids, mu.CardIDs...)
+	}
+	if _, err := s.DB(m.Name).C("addresses").RemoveAll(bson.M{"_id": bson.M{"$in": aids}}); err != nil {
+		return nil, err
+	}
+	if _, err := s.DB(m.Name).C("cards").RemoveAll(bson.M{"_id": bson.M{"$in": cids}}); err != nil {
+		return nil, err
+	}
+	if _, err := c.RemoveAll(bson.M{"_id": bson.M{"$in": found}}); err != nil {
+		return nil, err
+	}
+	hexes := make([]string, 0, len(found))
+	for _, id := range found {
+		hexes = append(hexes, string(id))
+	}
+	if _, err := s.DB(m.Name).C("groups").UpdateAll(bson.M{}, bson.M{"$pull": bson.M{
+		"owners":  bson.M{"$in": hexes},
+		"members": bson.M{"$in": hexes},
+	}}); err != nil {
+		return nil, err
+	}
+	if _, err := s.DB(m.Name).C("activity").RemoveAll(bson.M{"userId": bson.M{"$in": hexes}}); err != nil {
+		return nil, err
+	}
+	for _, id := range oids {
+		res[string(id)] = mgo.ErrNotFound
+	}
+	for _, id := range found {
+		res[string(id)] = nil
+	}
+	return res, nil
 }
 
 func getURL() url.URL {
 	ur := url.URL{
 		Scheme: "mongodb",
 		Host:   host,
-		Path:   db,
+		Path:   dbName,
 	}
 	if name != "" {
 		u := url.UserPassword(name, password)
@@ -443,7 +1659,8 @@ func getURL() url.URL {
 	return ur
 }
 
-// EnsureIndexes ensures username is unique
+// EnsureIndexes ensures username is unique and listing queries are indexed.
+// It is migration 3, indexes added later go in migrations of their own.
 func (m *Mongo) EnsureIndexes() error {
 	s := m.Session.Copy()
 	defer s.Close()
@@ -454,12 +1671,195 @@ func (m *Mongo) EnsureIndexes() error {
 		Background: true,
 		Sparse:     false,
 	}
-	c := s.DB("").C("customers")
-	return c.EnsureIndex(i)
+	c := s.DB(m.Name).C("customers")
+	if err := c.EnsureIndex(i); err != nil {
+		return err
+	}
+	// Never drop duplicates here, they are distinct accounts.
+	if err := c.EnsureIndex(mgo.Index{Key: []string{"usernameKey"}, Unique: true, Background: true}); err != nil {
+		return fmt.Errorf("usernames differing only by case, rename them first: %v", err)
+	}
+	g := s.DB(m.Name).C("groups")
+	for _, k := range []string{"owners", "members"} {
+		if err := g.EnsureIndex(mgo.Index{Key: []string{k}, Background: true}); err != nil {
+			return err
+		}
+	}
+	// Activity feeds are read per user, newest first
+	if err := s.DB(m.Name).C("activity").EnsureIndex(mgo.Index{Key: []string{"userId", "-_id"}, Background: true}); err != nil {
+		return err
+	}
+	// Idempotency keys expire
+	if err := s.DB(m.Name).C("idempotency").EnsureIndex(mgo.Index{Key: []string{"createdAt"}, ExpireAfter: db.IdempotencyKeyTTL, Background: true}); err != nil {
+		return err
+	}
+	// Webhook delivery logs are read per webhook, newest first, and expire
+	wd := s.DB(m.Name).C("webhookDeliveries")
+	if err := wd.EnsureIndex(mgo.Index{Key: []string{"webhookId", "-_id"}, Background: true}); err != nil {
+		return err
+	}
+	if err := wd.EnsureIndex(mgo.Index{Key: []string{"time"}, ExpireAfter: db.WebhookDeliveryTTL, Background: true}); err != nil {
+		return err
+	}
+	// Registrations that crashed are looked up on Init
+	for _, name := range []string{"addresses", "cards"} {
+		if err := s.DB(m.Name).C(name).EnsureIndex(mgo.Index{Key: []string{"registering"}, Sparse: true, Background: true}); err != nil {
+			return err
+		}
+	}
+	// Listing filters and sorts
+	for _, k := range []string{"email", "lastName", "tags", "updatedAt", "lastLoginAt", "usernameHistory.key"} {
+		if err := c.EnsureIndex(mgo.Index{Key: []string{k}, Background: true}); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func (m *Mongo) Ping() error {
-	s := m.Session.Copy()
+// CreateIdempotencyKey inserts the key, failing with db.ErrConflict if it
+// is already in use
+func (m *Mongo) CreateIdempotencyKey(ctx context.Context, k *db.IdempotencyKey) error {
+	s := m.session(ctx)
+	defer s.Close()
+	k.CreatedAt = now()
+	err := s.DB(m.Name).C("idempotency").Insert(k)
+	if mgo.IsDup(err) {
+		return db.ErrConflict
+	}
+	return err
+}
+
+// GetIdempotencyKey gets the key
+func (m *Mongo) GetIdempotencyKey(ctx context.Context, key string) (db.IdempotencyKey, error) {
+	s := m.session(ctx)
+	defer s.Close()
+	var k db.IdempotencyKey
+	err := s.DB(m.Name).C("idempotency").FindId(key).One(&k)
+	return k, err
+}
+
+// SetIdempotencyResult records the id of the resource created under key
+func (m *Mongo) SetIdempotencyResult(ctx context.Context, key, resultID string) error {
+	s := m.session(ctx)
+	defer s.Close()
+	return s.DB(m.Name).C("idempotency").UpdateId(key, bson.M{"$set": bson.M{"resultId": resultID}})
+}
+
+// DeleteIdempotencyKey removes the key, so it can be used again
+func (m *Mongo) DeleteIdempotencyKey(ctx context.Context, key string) error {
+	s := m.session(ctx)
+	defer s.Close()
+	err := s.DB(m.Name).C("idempotency").RemoveId(key)
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// MongoWebhook is a wrapper for the webhook
+type MongoWebhook struct {
+	users.Webhook `bson:",inline"`
+	ID            docID `bson:"_id"`
+}
+
+// MongoWebhookDelivery is a wrapper for the webhook delivery
+type MongoWebhookDelivery struct {
+	users.WebhookDelivery `bson:",inline"`
+	ID                    docID `bson:"_id"`
+}
+
+// CreateWebhook inserts the webhook into MongoDB
+func (m *Mongo) CreateWebhook(ctx context.Context, w *users.Webhook) error {
+	s := m.session(ctx)
+	defer s.Close()
+	mw := MongoWebhook{Webhook: *w, ID: newID()}
+	mw.Webhook.CreatedAt = now()
+	if err := s.DB(m.Name).C("webhooks").Insert(mw); err != nil {
+		return err
+	}
+	mw.Webhook.ID = string(mw.ID)
+	*w = mw.Webhook
+	return nil
+}
+
+// GetWebhooks gets every webhook, oldest first
+func (m *Mongo) GetWebhooks(ctx context.Context) ([]users.Webhook, error) {
+	s := m.session(ctx)
+	defer s.Close()
+	var mws []MongoWebhook
+	err := s.DB(m.Name).C("webhooks").Find(nil).Sort("_id").All(&mws)
+	ws := make([]users.Webhook, 0, len(mws))
+	for _, mw := range mws {
+		mw.Webhook.ID = string(mw.ID)
+		ws = append(ws, mw.Webhook)
+	}
+	return ws, err
+}
+
+// DeleteWebhook removes the webhook, its delivery log expires
+func (m *Mongo) DeleteWebhook(ctx context.Context, id string) error {
+	if !db.ValidID(id) {
+		return ErrInvalidHexID
+	}
+	s := m.session(ctx)
+	defer s.Close()
+	return s.DB(m.Name).C("webhooks").RemoveId(docID(id))
+}
+
+// AddWebhookDelivery logs the delivery attempt
+func (m *Mongo) AddWebhookDelivery(ctx context.Context, d *users.WebhookDelivery) error {
+	s := m.session(ctx)
+	defer s.Close()
+	md := MongoWebhookDelivery{WebhookDelivery: *d, ID: newID()}
+	md.WebhookDelivery.Time = now()
+	if err := s.DB(m.Name).C("webhookDeliveries").Insert(md); err != nil {
+		return err
+	}
+	md.WebhookDelivery.ID = string(md.ID)
+	*d = md.WebhookDelivery
+	return nil
+}
+
+// GetWebhookDeliveries returns up to limit deliveries to the webhook older
+// than the delivery before, newest first
+func (m *Mongo) GetWebhookDeliveries(ctx context.Context, webhookID, before string, limit int) ([]users.WebhookDelivery, error) {
+	sel := bson.M{"webhookId": webhookID}
+	if before != "" {
+		if !db.ValidID(before) {
+			return nil, ErrInvalidHexID
+		}
+		and(sel, beforeID(before))
+	}
+	s := m.session(ctx)
+	defer s.Close()
+	var mds []MongoWebhookDelivery
+	err := s.DB(m.Name).C("webhookDeliveries").Find(sel).Sort("-_id").Limit(limit).All(&mds)
+	ds := make([]users.WebhookDelivery, 0, len(mds))
+	for _, md := range mds {
+		md.WebhookDelivery.ID = string(md.ID)
+		ds = append(ds, md.WebhookDelivery)
+	}
+	return ds, err
+}
+
+// Close closes the session shared by every tenant.
+func (m *Mongo) Close() error {
+	if m.Session != nil {
+		m.Session.Close()
+	}
+	return nil
+}
+
+func (m *Mongo) Ping(ctx context.Context) error {
+	s := m.session(ctx)
 	defer s.Close()
 	return s.Ping()
 }
+
+// Reconnect drops the sockets of the session, which it would otherwise keep
+// using after the member they lead to went away, and pings the replica set
+// anew, finding its primary after a failover.
+func (m *Mongo) Reconnect(ctx context.Context) error {
+	m.Session.Refresh()
+	return m.Ping(ctx)
+}
@@ -1,15 +1,24 @@
 package mongodb
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
+	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 	"gopkg.in/mgo.v2/dbtest"
+	"user/changes"
+	"user/db"
 	"user/users"
 )
 
+var _ db.Reconnector = &Mongo{}
+
 var (
 	TestMongo  = Mongo{}
 	TestServer = dbtest.DBServer{}
@@ -32,7 +41,7 @@ func init() {
 
 func TestMain(m *testing.M) {
 	TestMongo.Session = TestServer.Session()
-	TestMongo.EnsureIndexes()
+	TestMongo.Migrate(context.Background())
 	TestMongo.Session.Close()
 	exitTest(m.Run())
 }
@@ -59,9 +68,9 @@ func TestNew(t *testing.T) {
 
 func TestAddUserIDs(t *testing.T) {
 	m := New()
-	uid := bson.NewObjectId()
-	cid := bson.NewObjectId()
-	aid := bson.NewObjectId()
+	uid := newID()
+	cid := newID()
+	aid := newID()
 	m.ID = uid
 	m.AddressIDs = append(m.AddressIDs, aid)
 	m.CardIDs = append(m.CardIDs, cid)
@@ -71,75 +80,863 @@ func TestAddUserIDs(t *testing.T) {
 			fmt.Sprintf(
 				"Expected one card and one address added."))
 	}
-	if m.Addresses[0].ID != aid.Hex() {
+	if m.Addresses[0].ID != string(aid) {
 		t.Error("Expected matching Address Hex")
 	}
-	if m.Cards[0].ID != cid.Hex() {
+	if m.Cards[0].ID != string(cid) {
 		t.Error("Expected matching Card Hex")
 	}
-	if m.UserID != uid.Hex() {
+	if m.UserID != string(uid) {
 		t.Error("Expected matching User Hex")
 	}
 }
 
+func TestDocID(t *testing.T) {
+	for id, kind := range map[docID]byte{
+		"57a98d98e4b00679b4a830af":             0x07,
+		"0190e8c5-3b1a-7c2d-8e3f-0123456789ab": 0x02,
+		"01J1X8YBQK3E4F5G6H7J8K9MN0":           0x02,
+	} {
+		b, err := bson.Marshal(bson.M{"_id": id})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var raw struct {
+			ID bson.Raw `bson:"_id"`
+		}
+		var doc struct {
+			ID docID `bson:"_id"`
+		}
+		if err := bson.Unmarshal(b, &raw); err != nil || raw.ID.Kind != kind {
+			t.Errorf("%v: expected stored as kind %x, got %x %v", id, kind, raw.ID.Kind, err)
+		}
+		if err := bson.Unmarshal(b, &doc); err != nil || doc.ID != id {
+			t.Errorf("%v: expected read back, got %v %v", id, doc.ID, err)
+		}
+	}
+}
+
 func TestAddressAddId(t *testing.T) {
 	m := MongoAddress{Address: users.Address{}}
-	id := bson.NewObjectId()
+	id := newID()
 	m.ID = id
 	m.AddID()
-	if m.Address.ID != id.Hex() {
+	if m.Address.ID != string(id) {
 		t.Error("Expected matching Address Hex")
 	}
 }
 
 func TestCardAddId(t *testing.T) {
 	m := MongoCard{Card: users.Card{}}
-	id := bson.NewObjectId()
+	id := newID()
 	m.ID = id
 	m.AddID()
-	if m.Card.ID != id.Hex() {
+	if m.Card.ID != string(id) {
 		t.Error("Expected matching Card Hex")
 	}
 }
 
 func TestCreate(t *testing.T) {
+	ctx := context.Background()
 	TestMongo.Session = TestServer.Session()
 	defer TestMongo.Session.Close()
-	err := TestMongo.CreateUser(&TestUser)
+	err := TestMongo.CreateUser(ctx, &TestUser)
 	if err != nil {
 		t.Error(err)
 	}
-	err = TestMongo.CreateUser(&TestUser)
+	if TestUser.CreatedAt.IsZero() || !TestUser.UpdatedAt.Equal(TestUser.CreatedAt) {
+		t.Error("expected creation timestamps")
+	}
+	err = TestMongo.CreateUser(ctx, &TestUser)
 	if err == nil {
 		t.Error("Expected duplicate key error")
 	}
 }
 
+func TestCreateUndone(t *testing.T) {
+	ctx := context.Background()
+	TestMongo.Session = TestServer.Session()
+	defer TestMongo.Session.Close()
+	count := func() int {
+		a, _ := TestMongo.Session.DB("").C("addresses").Count()
+		c, _ := TestMongo.Session.DB("").C("cards").Count()
+		return a + c
+	}
+	u := users.User{Username: "undone", Addresses: []users.Address{{Street: "street"}}}
+	if err := TestMongo.CreateUser(ctx, &u); err != nil {
+		t.Fatal(err)
+	}
+	before := count()
+	taken := users.User{Username: "UNDONE", Addresses: []users.Address{{Street: "street"}},
+		Cards: []users.Card{{LongNum: "4111111111111111"}}}
+	if err := TestMongo.CreateUser(ctx, &taken); err == nil {
+		t.Fatal("expected the taken username to fail")
+	}
+	if after := count(); after != before {
+		t.Errorf("expected the addresses and cards removed again, got %v more", after-before)
+	}
+	var a MongoAddress
+	if err := TestMongo.Session.DB("").C("addresses").FindId(docID(u.Addresses[0].ID)).One(&a); err != nil || a.Registering != "" {
+		t.Errorf("expected the address of the user unmarked, got %v %v", a.Registering, err)
+	}
+}
+
+func TestRemoveOrphans(t *testing.T) {
+	ctx := context.Background()
+	TestMongo.Session = TestServer.Session()
+	defer TestMongo.Session.Close()
+	u := users.User{Username: "crashed"}
+	if err := TestMongo.CreateUser(ctx, &u); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * registrationGrace)
+	orphan := MongoAddress{ID: docID(bson.NewObjectIdWithTime(old).Hex()), Registering: newID()}
+	kept := MongoCard{ID: docID(bson.NewObjectIdWithTime(old).Hex()), Registering: docID(u.UserID)}
+	pending := MongoAddress{ID: newID(), Registering: newID()}
+	addresses, cards := TestMongo.Session.DB("").C("addresses"), TestMongo.Session.DB("").C("cards")
+	if err := addresses.Insert(orphan, pending); err != nil {
+		t.Fatal(err)
+	}
+	if err := cards.Insert(kept); err != nil {
+		t.Fatal(err)
+	}
+	if err := TestMongo.removeOrphans(); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := addresses.FindId(orphan.ID).Count(); n != 0 {
+		t.Error("expected the address of the missing user removed")
+	}
+	var c MongoCard
+	if err := cards.FindId(kept.ID).One(&c); err != nil || c.Registering != "" {
+		t.Errorf("expected the card of the user kept unmarked, got %v %v", c.Registering, err)
+	}
+	if n, _ := addresses.FindId(pending.ID).Count(); n != 1 {
+		t.Error("expected the address of a registration under way kept")
+	}
+}
+
+func TestMigrations(t *testing.T) {
+	for k, m := range Migrations {
+		if m.Version != k+1 || m.Name == "" || m.Up == nil {
+			t.Errorf("expected migration %v numbered in order with a name and Up, got %v %q", k, m.Version, m.Name)
+		}
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+	TestMongo.Session = TestServer.Session()
+	defer TestMongo.Session.Close()
+	if err := TestMongo.Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	status, err := TestMongo.MigrationStatus(ctx)
+	if err != nil || len(status) != len(Migrations) {
+		t.Fatalf("expected the status of every migration, got %v %v", status, err)
+	}
+	for _, st := range status {
+		if st.AppliedAt == nil {
+			t.Errorf("expected migration %v applied", st.Version)
+		}
+	}
+	applied := *status[0].AppliedAt
+	if err := TestMongo.Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := TestMongo.MigrationStatus(ctx); !status[0].AppliedAt.Equal(applied) {
+		t.Errorf("expected applied migrations left alone, got %v", status[0].AppliedAt)
+	}
+	if !TestMongo.Migrated() {
+		t.Error("expected the database migrated")
+	}
+}
+
+func TestUniqueEmails(t *testing.T) {
+	TestMongo.Session = TestServer.Session()
+	defer TestMongo.Session.Close()
+	c := TestMongo.Session.DB("").C("customers")
+	for _, id := range []docID{newID(), newID()} {
+		if err := c.Insert(bson.M{"_id": id, "email": ""}); err != nil {
+			t.Fatalf("expected users without email left out, got %v", err)
+		}
+	}
+	if err := c.Insert(bson.M{"email": "eve@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	err := c.Insert(bson.M{"email": "eve@example.com"})
+	var field *db.ConflictError
+	if !errors.As(conflict(err), &field) || field.Field != "email" {
+		t.Errorf("expected the email conflicting, got %v", err)
+	}
+}
+
 func TestGetUserByName(t *testing.T) {
+	ctx := context.Background()
 	TestMongo.Session = TestServer.Session()
 	defer TestMongo.Session.Close()
-	u, err := TestMongo.GetUserByName(TestUser.Username)
+	u, err := TestMongo.GetUserByName(ctx, TestUser.Username)
 	if err != nil {
 		t.Error(err)
 	}
 	if u.Username != TestUser.Username {
 		t.Error("expected equal usernames")
 	}
-	_, err = TestMongo.GetUserByName("bogususers")
+	if _, err := TestMongo.GetUserByName(ctx, strings.ToUpper(TestUser.Username)); err != nil {
+		t.Error("expected username lookup to ignore case")
+	}
+	_, err = TestMongo.GetUserByName(ctx, "bogususers")
 	if err == nil {
 		t.Error("expected not found error")
 	}
 }
 
+func TestUserExists(t *testing.T) {
+	ctx := context.Background()
+	TestMongo.Session = TestServer.Session()
+	defer TestMongo.Session.Close()
+	ok, err := TestMongo.UserExists(ctx, "username", TestUser.Username)
+	if err != nil || !ok {
+		t.Error("expected username to exist")
+	}
+	ok, _ = TestMongo.UserExists(ctx, "username", "bogususers")
+	if ok {
+		t.Error("expected unknown username not to exist")
+	}
+}
+
 func TestGetUser(t *testing.T) {
+	ctx := context.Background()
 	TestMongo.Session = TestServer.Session()
 	defer TestMongo.Session.Close()
-	_, err := TestMongo.GetUser(TestUser.UserID)
+	_, err := TestMongo.GetUser(ctx, TestUser.UserID)
 	if err != nil {
 		t.Error(err)
 	}
 }
 
+func TestGetUsers(t *testing.T) {
+	ctx := context.Background()
+	TestMongo.Session = TestServer.Session()
+	defer TestMongo.Session.Close()
+	us, err := TestMongo.GetUsers(ctx, db.UserQuery{LastName: TestUser.LastName, Sort: "-createdAt"})
+	if err != nil {
+		t.Error(err)
+	}
+	if len(us) != 1 {
+		t.Errorf("expected one user received %v", len(us))
+	}
+	us, _ = TestMongo.GetUsers(ctx, db.UserQuery{CreatedAfter: time.Now().Add(time.Hour)})
+	if len(us) != 0 {
+		t.Error("expected no users created in the future")
+	}
+	us, _ = TestMongo.GetUsers(ctx, db.UserQuery{LastName: TestUser.LastName, Status: users.StatusActive})
+	if len(us) != 1 {
+		t.Error("expected user without status to list as active")
+	}
+	if err := TestMongo.AddUserTag(ctx, TestUser.UserID, "vip"); err != nil {
+		t.Error(err)
+	}
+	us, _ = TestMongo.GetUsers(ctx, db.UserQuery{Tag: "vip"})
+	if len(us) != 1 {
+		t.Error("expected tagged user")
+	}
+	TestMongo.RemoveUserTag(ctx, TestUser.UserID, "vip")
+	us, _ = TestMongo.GetUsers(ctx, db.UserQuery{Tag: "vip"})
+	if len(us) != 0 {
+		t.Error("expected tag removed")
+	}
+}
+
+func TestUpdateUser(t *testing.T) {
+	ctx := context.Background()
+	TestMongo.Session = TestServer.Session()
+	defer TestMongo.Session.Close()
+	last := "newlastname"
+	err := TestMongo.UpdateUser(ctx, TestUser.UserID, users.ProfileUpdate{LastName: &last})
+	if err != nil {
+		t.Error(err)
+	}
+	u, err := TestMongo.GetUser(ctx, TestUser.UserID)
+	if err != nil {
+		t.Error(err)
+	}
+	if u.LastName != last || u.FirstName != TestUser.FirstName {
+		t.Error("expected only last name updated")
+	}
+	if TestMongo.UpdateUser(ctx, "bogus", users.ProfileUpdate{}) != ErrInvalidHexID {
+		t.Error("expected invalid id error")
+	}
+}
+
+func TestStats(t *testing.T) {
+	ctx := context.Background()
+	TestMongo.Session = TestServer.Session()
+	defer TestMongo.Session.Close()
+	st, err := TestMongo.GetStats(ctx, time.Now().Add(-48*time.Hour), time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Users == 0 || len(st.Signups) != 3 || st.Signups[2].Count == 0 {
+		t.Errorf("expected todays signup counted, got %+v", st)
+	}
+}
+
+func TestListUsers(t *testing.T) {
+	ctx := context.Background()
+	TestMongo.Session = TestServer.Session()
+	defer TestMongo.Session.Close()
+	us, err := TestMongo.ListUsers(ctx, "", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(us) != 1 || us[0].Username == "" || us[0].Salt != "" {
+		t.Errorf("expected one user with admin fields only, got %v", us)
+	}
+	next, _ := TestMongo.ListUsers(ctx, us[0].UserID, 1)
+	if len(next) == 1 && next[0].UserID <= us[0].UserID {
+		t.Error("expected next page to start after the cursor")
+	}
+}
+
+func TestUpdateCard(t *testing.T) {
+	ctx := context.Background()
+	TestMongo.Session = TestServer.Session()
+	defer TestMongo.Session.Close()
+	c := users.Card{LongNum: "4111111111111111", Expires: "01/25"}
+	if err := TestMongo.CreateCard(ctx, &c, ""); err != nil {
+		t.Fatal(err)
+	}
+	expires, holder := "01/29", "Eve Smith"
+	if err := TestMongo.UpdateCard(ctx, c.ID, users.CardUpdate{Expires: &expires, Holder: &holder}); err != nil {
+		t.Fatal(err)
+	}
+	c, err := TestMongo.GetCard(ctx, c.ID)
+	if err != nil || c.Expires != expires || c.Holder != holder || c.LongNum != "4111111111111111" {
+		t.Errorf("unexpected card %+v %v", c, err)
+	}
+}
+
+func TestUpdateAddress(t *testing.T) {
+	ctx := context.Background()
+	TestMongo.Session = TestServer.Session()
+	defer TestMongo.Session.Close()
+	u := users.New()
+	u.Username = "updateaddress"
+	if err := TestMongo.CreateUser(ctx, &u); err != nil {
+		t.Fatal(err)
+	}
+	first := users.Address{Street: "Main", City: "Springfield", Country: "US", Type: users.AddressShipping, Default: true}
+	if err := TestMongo.CreateAddress(ctx, &first, u.UserID); err != nil {
+		t.Fatal(err)
+	}
+	second := users.Address{Street: "Elm", City: "Springfield", Country: "US", Type: users.AddressShipping}
+	if err := TestMongo.CreateAddress(ctx, &second, u.UserID); err != nil {
+		t.Fatal(err)
+	}
+	second.Number, second.Default = "12", true
+	if err := TestMongo.UpdateAddress(ctx, second.ID, &second); err != nil {
+		t.Fatal(err)
+	}
+	if a, err := TestMongo.GetAddress(ctx, second.ID); err != nil || a.Number != "12" || !a.Default || a.CreatedAt.IsZero() {
+		t.Errorf("unexpected address %+v %v", a, err)
+	}
+	if a, _ := TestMongo.GetAddress(ctx, first.ID); a.Default {
+		t.Error("expected the former default address cleared")
+	}
+}
+
+func TestSetDefaultCard(t *testing.T) {
+	ctx := context.Background()
+	TestMongo.Session = TestServer.Session()
+	defer TestMongo.Session.Close()
+	u := users.New()
+	u.Username = "defaultcard"
+	if err := TestMongo.CreateUser(ctx, &u); err != nil {
+		t.Fatal(err)
+	}
+	c := users.Card{LongNum: "4111111111111111", Expires: "01/99"}
+	if err := TestMongo.CreateCard(ctx, &c, u.UserID); err != nil {
+		t.Fatal(err)
+	}
+	if err := TestMongo.SetDefaultCard(ctx, u.UserID, bson.NewObjectId().Hex()); err != mgo.ErrNotFound {
+		t.Errorf("expected someone else's card to be rejected, got %v", err)
+	}
+	if err := TestMongo.SetDefaultCard(ctx, u.UserID, c.ID); err != nil {
+		t.Fatal(err)
+	}
+	u, _ = TestMongo.GetUser(ctx, u.UserID)
+	if u.DefaultCard != c.ID {
+		t.Errorf("expected default card %v, got %v", c.ID, u.DefaultCard)
+	}
+}
+
+func TestGroups(t *testing.T) {
+	ctx := context.Background()
+	TestMongo.Session = TestServer.Session()
+	defer TestMongo.Session.Close()
+	g := users.Group{Name: "acme", Owners: []string{TestUser.UserID}}
+	if err := TestMongo.CreateGroup(ctx, &g); err != nil {
+		t.Fatal(err)
+	}
+	if err := TestMongo.AddGroupMember(ctx, g.ID, "member"); err != nil {
+		t.Error(err)
+	}
+	gs, err := TestMongo.GetUserGroups(ctx, "member")
+	if err != nil || len(gs) != 1 || gs[0].ID != g.ID {
+		t.Errorf("expected member of the group, got %v", gs)
+	}
+	TestMongo.RemoveGroupMember(ctx, g.ID, "member")
+	if g, _ := TestMongo.GetGroup(ctx, g.ID); g.IsMember("member") || !g.IsOwner(TestUser.UserID) {
+		t.Error("expected member removed and owner kept")
+	}
+}
+
+func TestMergeUsers(t *testing.T) {
+	ctx := context.Background()
+	TestMongo.Session = TestServer.Session()
+	defer TestMongo.Session.Close()
+	dup := users.User{Username: "duplicate", Tags: []string{"merged"}, Addresses: []users.Address{{Street: "dup"}}}
+	if err := TestMongo.CreateUser(ctx, &dup); err != nil {
+		t.Fatal(err)
+	}
+	if err := TestMongo.MergeUsers(ctx, TestUser.UserID, dup.UserID, users.ProfileUpdate{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := TestMongo.GetUser(ctx, dup.UserID); err == nil {
+		t.Error("expected source removed")
+	}
+	if id, err := TestMongo.ResolveAlias(ctx, dup.UserID); err != nil || id != TestUser.UserID {
+		t.Error("expected source id to alias the target")
+	}
+	u, _ := TestMongo.GetUser(ctx, TestUser.UserID)
+	if len(u.Tags) == 0 || u.Tags[len(u.Tags)-1] != "merged" || len(u.Addresses) != len(TestUser.Addresses)+1 {
+		t.Errorf("expected tags and addresses moved, got %+v", u)
+	}
+}
+
+func TestRenameUser(t *testing.T) {
+	ctx := context.Background()
+	TestMongo.Session = TestServer.Session()
+	defer TestMongo.Session.Close()
+	old := TestUser.Username
+	if err := TestMongo.RenameUser(ctx, TestUser.UserID, "renamed"); err != nil {
+		t.Fatal(err)
+	}
+	u, err := TestMongo.GetUserByPreviousName(ctx, strings.ToUpper(old), time.Now().Add(-time.Hour))
+	if err != nil || u.Username != "renamed" {
+		t.Error("expected user found by previous name")
+	}
+	if len(u.UsernameHistory) != 1 || u.UsernameHistory[0].Username != old {
+		t.Errorf("expected rename recorded, got %v", u.UsernameHistory)
+	}
+	if _, err := TestMongo.GetUserByPreviousName(ctx, old, time.Now().Add(time.Hour)); err == nil {
+		t.Error("expected previous name to expire")
+	}
+	TestMongo.RenameUser(ctx, TestUser.UserID, old)
+}
+
+func TestDeleteUsers(t *testing.T) {
+	ctx := context.Background()
+	TestMongo.Session = TestServer.Session()
+	defer TestMongo.Session.Close()
+	u := New().User
+	u.Username = "bulkdelete"
+	if err := TestMongo.CreateUser(ctx, &u); err != nil {
+		t.Fatal(err)
+	}
+	missing := bson.NewObjectId().Hex()
+	res, err := TestMongo.DeleteUsers(ctx, []string{u.UserID, missing, "bogus"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res[u.UserID] != nil || res[missing] != mgo.ErrNotFound || res["bogus"] != ErrInvalidHexID {
+		t.Errorf("unexpected results %v", res)
+	}
+}
+
+func TestUpgradeUser(t *testing.T) {
+	ctx := context.Background()
+	TestMongo.Session = TestServer.Session()
+	defer TestMongo.Session.Close()
+	g := users.NewGuest()
+	g.Addresses = []users.Address{{Street: "guest street"}}
+	if err := TestMongo.CreateUser(ctx, &g); err != nil {
+		t.Fatal(err)
+	}
+	u := users.New()
+	u.Username = "upgraded"
+	u.Password = "hash"
+	if err := TestMongo.UpgradeUser(ctx, g.UserID, u); err != nil {
+		t.Fatal(err)
+	}
+	got, err := TestMongo.GetUser(ctx, g.UserID)
+	if err != nil || got.Username != "upgraded" || got.HasRole(users.RoleGuest) || len(got.Addresses) != 1 {
+		t.Errorf("expected guest upgraded keeping its address, got %+v", got)
+	}
+	if err := TestMongo.UpgradeUser(ctx, g.UserID, u); err != mgo.ErrNotFound {
+		t.Error("expected registered user not to be upgraded again")
+	}
+}
+
+func TestGetUsersByID(t *testing.T) {
+	ctx := context.Background()
+	TestMongo.Session = TestServer.Session()
+	defer TestMongo.Session.Close()
+	u := New().User
+	u.Username = "batchget"
+	if err := TestMongo.CreateUser(ctx, &u); err != nil {
+		t.Fatal(err)
+	}
+	us, err := TestMongo.GetUsersByID(ctx, []string{u.UserID, bson.NewObjectId().Hex(), "bogus"})
+	if err != nil || len(us) != 1 || us[0].Username != "batchget" {
+		t.Errorf("expected only the known user, got %v %v", us, err)
+	}
+}
+
+func TestExpandUsers(t *testing.T) {
+	ctx := context.Background()
+	TestMongo.Session = TestServer.Session()
+	defer TestMongo.Session.Close()
+	var us []users.User
+	for _, name := range []string{"expand1", "expand2"} {
+		u := New().User
+		u.Username = name
+		if err := TestMongo.CreateUser(ctx, &u); err != nil {
+			t.Fatal(err)
+		}
+		a := users.Address{Street: "Main Street", City: name}
+		if err := TestMongo.CreateAddress(ctx, &a, u.UserID); err != nil {
+			t.Fatal(err)
+		}
+		c := users.Card{LongNum: "4111111111111111", Expires: "01/99"}
+		if err := TestMongo.CreateCard(ctx, &c, u.UserID); err != nil {
+			t.Fatal(err)
+		}
+		if u, err := TestMongo.GetUser(ctx, u.UserID); err == nil {
+			us = append(us, u)
+		}
+	}
+	if err := TestMongo.ExpandUsers(ctx, us, []string{"addresses"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(us) != 2 || us[1].Addresses[0].City != "expand2" || us[1].Cards[0].LongNum != "" {
+		t.Errorf("expected only the addresses of each user loaded, got %+v", us)
+	}
+	if err := TestMongo.ExpandUsers(ctx, us, []string{"groups"}); err == nil {
+		t.Error("expected unknown attributes rejected")
+	}
+}
+
+func TestGetAttributesByID(t *testing.T) {
+	ctx := context.Background()
+	TestMongo.Session = TestServer.Session()
+	defer TestMongo.Session.Close()
+	u := New().User
+	u.Username = "batchattributes"
+	if err := TestMongo.CreateUser(ctx, &u); err != nil {
+		t.Fatal(err)
+	}
+	a := users.Address{Street: "Main Street", City: "Springfield"}
+	if err := TestMongo.CreateAddress(ctx, &a, u.UserID); err != nil {
+		t.Fatal(err)
+	}
+	as, err := TestMongo.GetAddressesByID(ctx, []string{a.ID, bson.NewObjectId().Hex(), "bogus"})
+	if err != nil || len(as) != 1 || as[0].ID != a.ID {
+		t.Errorf("expected only the known address, got %v %v", as, err)
+	}
+	live := users.Card{LongNum: "4111111111111111", Expires: "01/99"}
+	deleted := users.Card{LongNum: "5555555555554444", Expires: "01/99"}
+	for _, c := range []*users.Card{&live, &deleted} {
+		if err := TestMongo.CreateCard(ctx, c, u.UserID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := TestMongo.TombstoneCard(ctx, deleted.ID, "************4444", ""); err != nil {
+		t.Fatal(err)
+	}
+	cs, err := TestMongo.GetCardsByID(ctx, []string{live.ID, deleted.ID, "bogus"})
+	if err != nil || len(cs) != 1 || cs[0].ID != live.ID {
+		t.Errorf("expected only the live card, got %v %v", cs, err)
+	}
+}
+
+func TestActivity(t *testing.T) {
+	ctx := context.Background()
+	TestMongo.Session = TestServer.Session()
+	defer TestMongo.Session.Close()
+	id := bson.NewObjectId().Hex()
+	for _, typ := range []string{users.ActivityAddressAdded, users.ActivityCardAdded, users.ActivityCardRemoved} {
+		if err := TestMongo.AddActivity(ctx, &users.Activity{UserID: id, Type: typ}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	as, err := TestMongo.GetActivity(ctx, id, "", 2)
+	if err != nil || len(as) != 2 || as[0].Type != users.ActivityCardRemoved {
+		t.Fatalf("expected newest activity first, got %v %v", as, err)
+	}
+	as, _ = TestMongo.GetActivity(ctx, id, as[1].ID, 2)
+	if len(as) != 1 || as[0].Type != users.ActivityAddressAdded {
+		t.Errorf("expected the oldest activity on the next page, got %v", as)
+	}
+}
+
+func TestCreateAddresses(t *testing.T) {
+	ctx := context.Background()
+	TestMongo.Session = TestServer.Session()
+	defer TestMongo.Session.Close()
+	u := New().User
+	u.Username = "importer"
+	if err := TestMongo.CreateUser(ctx, &u); err != nil {
+		t.Fatal(err)
+	}
+	old := users.Address{Street: "Old Street", Type: users.AddressBilling, Default: true}
+	if err := TestMongo.CreateAddress(ctx, &old, u.UserID); err != nil {
+		t.Fatal(err)
+	}
+	as := []users.Address{
+		{Street: "High Street", Type: users.AddressBilling, Default: true},
+		{Street: "Low Street", Type: users.AddressShipping},
+	}
+	if err := TestMongo.CreateAddresses(ctx, as, u.UserID); err != nil {
+		t.Fatal(err)
+	}
+	if as[0].ID == "" || as[1].ID == "" {
+		t.Errorf("expected ids set, got %+v", as)
+	}
+	u, _ = TestMongo.GetUser(ctx, u.UserID)
+	if len(u.Addresses) != 3 {
+		t.Errorf("expected 3 addresses, got %v", len(u.Addresses))
+	}
+	if old, _ = TestMongo.GetAddress(ctx, old.ID); old.Default {
+		t.Error("expected the imported default to replace the old one")
+	}
+}
+
+func TestSetAddressLocation(t *testing.T) {
+	ctx := context.Background()
+	TestMongo.Session = TestServer.Session()
+	defer TestMongo.Session.Close()
+	a := users.Address{Street: "High Street", Geocode: users.GeocodePending}
+	if err := TestMongo.CreateAddress(ctx, &a, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := TestMongo.SetAddressLocation(ctx, a.ID, &users.Location{Lat: 53.8, Lng: -1.55}, users.GeocodeDone); err != nil {
+		t.Fatal(err)
+	}
+	if err := TestMongo.SetAddressLocation(ctx, a.ID, nil, users.GeocodeFailed); err != nil {
+		t.Fatal(err)
+	}
+	a, err := TestMongo.GetAddress(ctx, a.ID)
+	if err != nil || a.Geocode != users.GeocodeDone || a.Location == nil || a.Location.Lat != 53.8 {
+		t.Errorf("expected only the first geocode to be stored, got %+v %v", a, err)
+	}
+}
+
+func TestSetCardVerification(t *testing.T) {
+	ctx := context.Background()
+	TestMongo.Session = TestServer.Session()
+	defer TestMongo.Session.Close()
+	c := users.Card{LongNum: "4111111111111111", Expires: "01/99", Verification: users.VerificationPending}
+	if err := TestMongo.CreateCard(ctx, &c, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := TestMongo.SetCardVerification(ctx, c.ID, users.VerificationDone); err != nil {
+		t.Fatal(err)
+	}
+	if err := TestMongo.SetCardVerification(ctx, c.ID, users.VerificationFailed); err != nil {
+		t.Fatal(err)
+	}
+	c, err := TestMongo.GetCard(ctx, c.ID)
+	if err != nil || c.Verification != users.VerificationDone {
+		t.Errorf("expected only the first outcome stored, got %+v %v", c, err)
+	}
+}
+
+func TestListCards(t *testing.T) {
+	ctx := context.Background()
+	TestMongo.Session = TestServer.Session()
+	defer TestMongo.Session.Close()
+	u := New().User
+	u.Username = "cardlister"
+	if err := TestMongo.CreateUser(ctx, &u); err != nil {
+		t.Fatal(err)
+	}
+	c := users.Card{LongNum: "4111111111111111", Expires: "01/99"}
+	if err := TestMongo.CreateCard(ctx, &c, u.UserID); err != nil {
+		t.Fatal(err)
+	}
+	cs, err := TestMongo.ListCards(ctx, "", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, oc := range cs {
+		if oc.ID == c.ID {
+			found = oc.UserID == u.UserID
+		}
+	}
+	if !found {
+		t.Errorf("expected the card listed with its owner, got %+v", cs)
+	}
+	if cs, _ := TestMongo.ListCards(ctx, c.ID, 1000); len(cs) != 0 && cs[0].ID <= c.ID {
+		t.Errorf("expected only cards after the cursor, got %+v", cs)
+	}
+}
+
+func TestTombstoneCard(t *testing.T) {
+	ctx := context.Background()
+	TestMongo.Session = TestServer.Session()
+	defer TestMongo.Session.Close()
+	u := New().User
+	u.Username = "tombstone"
+	if err := TestMongo.CreateUser(ctx, &u); err != nil {
+		t.Fatal(err)
+	}
+	c := users.Card{LongNum: "4111111111111111", Expires: "01/99", CCV: "123"}
+	if err := TestMongo.CreateCard(ctx, &c, u.UserID); err != nil {
+		t.Fatal(err)
+	}
+	replacement := bson.NewObjectId().Hex()
+	if err := TestMongo.TombstoneCard(ctx, c.ID, "************1111", replacement); err != nil {
+		t.Fatal(err)
+	}
+	if err := TestMongo.TombstoneCard(ctx, c.ID, "************1111", ""); err != mgo.ErrNotFound {
+		t.Errorf("expected a deleted card not to be deleted again, got %v", err)
+	}
+	c, err := TestMongo.GetCard(ctx, c.ID)
+	if err != nil || c.DeletedAt == nil || c.LongNum != "************1111" || c.CCV != "" || c.ReplacedBy != replacement {
+		t.Errorf("unexpected tombstone %+v %v", c, err)
+	}
+	cs, _ := TestMongo.GetCards(ctx)
+	for _, card := range cs {
+		if card.ID == c.ID {
+			t.Error("expected tombstones left out of the card list")
+		}
+	}
+	u, _ = TestMongo.GetUser(ctx, u.UserID)
+	if len(u.Cards) != 0 {
+		t.Errorf("expected the card taken off its owner, got %v", u.Cards)
+	}
+}
+
+func TestTenant(t *testing.T) {
+	ctx := context.Background()
+	m := &Mongo{Session: TestServer.Session()}
+	defer m.Session.Close()
+	d, err := m.Tenant("shop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := m.Tenant("shop"); again != d {
+		t.Error("expected tenant database reused")
+	}
+	u := New().User
+	u.Username = "tenantuser"
+	if err := d.CreateUser(ctx, &u); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.GetUser(ctx, u.UserID); err == nil {
+		t.Error("expected tenant user hidden from the default database")
+	}
+	if _, err := d.GetUser(ctx, u.UserID); err != nil {
+		t.Error("expected tenant user found in the tenant database")
+	}
+}
+
+func TestChangeEvent(t *testing.T) {
+	ctx := context.Background()
+	m := &Mongo{Session: TestServer.Session()}
+	defer m.Session.Close()
+	u := New().User
+	u.Username = "watched"
+	u.Addresses = []users.Address{{Street: "street"}}
+	if err := m.CreateUser(ctx, &u); err != nil {
+		t.Fatal(err)
+	}
+	d := m.Session.DB(m.Name)
+	var c change
+	c.NS.Coll = "addresses"
+	c.OperationType = "insert"
+	c.DocumentKey.ID = docID(u.Addresses[0].ID)
+	c.FullDocument.Registering = docID(u.UserID)
+	if e, ok := m.changeEvent(d, c); ok {
+		t.Errorf("expected the address of a registering user left out, got %v", e)
+	}
+	c.OperationType = "update"
+	c.UpdateDescription.RemovedFields = []string{"registering"}
+	if e, ok := m.changeEvent(d, c); !ok || e.Type != changes.AddressCreated || e.UserID != u.UserID {
+		t.Errorf("expected the address created once registered, got %v %v", e, ok)
+	}
+
+	c = change{OperationType: "update"}
+	c.NS.Coll = "customers"
+	c.DocumentKey.ID = docID(u.UserID)
+	c.UpdateDescription.UpdatedFields = bson.M{"lastLoginAt": time.Now(), "loginCount": 2}
+	if e, ok := m.changeEvent(d, c); ok {
+		t.Errorf("expected logins left out, got %v", e)
+	}
+	c.UpdateDescription.UpdatedFields["firstName"] = "Eve"
+	if e, ok := m.changeEvent(d, c); !ok || e.Type != changes.UserUpdated || e.UserID != u.UserID {
+		t.Errorf("expected the user updated, got %v %v", e, ok)
+	}
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	ctx := context.Background()
+	TestMongo.Session = TestServer.Session()
+	defer TestMongo.Session.Close()
+	k := db.IdempotencyKey{Key: "register::retry-1", Fingerprint: "abc"}
+	if err := TestMongo.CreateIdempotencyKey(ctx, &k); err != nil {
+		t.Fatal(err)
+	}
+	if err := TestMongo.CreateIdempotencyKey(ctx, &db.IdempotencyKey{Key: k.Key}); err != db.ErrConflict {
+		t.Errorf("expected conflict on reuse, got %v", err)
+	}
+	if err := TestMongo.SetIdempotencyResult(ctx, k.Key, "57a98d98e4b00679b4a830af"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := TestMongo.GetIdempotencyKey(ctx, k.Key)
+	if err != nil || got.Fingerprint != "abc" || got.ResultID != "57a98d98e4b00679b4a830af" {
+		t.Errorf("expected stored result, got %+v %v", got, err)
+	}
+	if err := TestMongo.DeleteIdempotencyKey(ctx, k.Key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := TestMongo.GetIdempotencyKey(ctx, k.Key); err != mgo.ErrNotFound {
+		t.Errorf("expected deleted key gone, got %v", err)
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+	ctx := context.Background()
+	TestMongo.Session = TestServer.Session()
+	defer TestMongo.Session.Close()
+	w := users.Webhook{URL: "https://crm.example.com/hooks", Secret: "0123456789abcdef", Events: []string{"*"}}
+	if err := TestMongo.CreateWebhook(ctx, &w); err != nil {
+		t.Fatal(err)
+	}
+	for attempt := 1; attempt <= 3; attempt++ {
+		if err := TestMongo.AddWebhookDelivery(ctx, &users.WebhookDelivery{WebhookID: w.ID, EventID: "e1", Attempt: attempt}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ds, err := TestMongo.GetWebhookDeliveries(ctx, w.ID, "", 2)
+	if err != nil || len(ds) != 2 || ds[0].Attempt != 3 {
+		t.Fatalf("expected newest delivery first, got %v %v", ds, err)
+	}
+	ds, _ = TestMongo.GetWebhookDeliveries(ctx, w.ID, ds[1].ID, 2)
+	if len(ds) != 1 || ds[0].Attempt != 1 {
+		t.Errorf("expected the first attempt on the next page, got %v", ds)
+	}
+	if err := TestMongo.DeleteWebhook(ctx, w.ID); err != nil {
+		t.Fatal(err)
+	}
+	ws, err := TestMongo.GetWebhooks(ctx)
+	if err != nil || len(ws) != 0 {
+		t.Errorf("expected no webhooks left, got %v %v", ws, err)
+	}
+}
+
 func TestGetUserAttributes(t *testing.T) {
 	TestMongo.Session = TestServer.Session()
 	defer TestMongo.Session.Close()
@@ -156,9 +953,10 @@ func TestGetURL(t *testing.T) {
 }
 
 func TestPing(t *testing.T) {
+	ctx := context.Background()
 	TestMongo.Session = TestServer.Session()
 	defer TestMongo.Session.Close()
-	err := TestMongo.Ping()
+	err := TestMongo.Ping(ctx)
 	if err != nil {
 		t.Error(err)
 	}
@@ -0,0 +1,197 @@
+package mongodb
+
+// watch.go follows the change stream of the database, so the changes to
+// users, addresses and cards are published whoever makes them: this
+// service, another one or someone in the shell.
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"user/changes"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// watchWait is how long the change stream waits for changes before Watch
+// checks whether to stop.
+var watchWait = time.Second
+
+// changeTypes are the created, updated and deleted events of the watched
+// collections.
+var changeTypes = map[string][3]changes.Type{
+	"customers": {changes.UserCreated, changes.UserUpdated, changes.UserDeleted},
+	"addresses": {changes.AddressCreated, changes.AddressUpdated, changes.AddressDeleted},
+	"cards":     {changes.CardCreated, changes.CardUpdated, changes.CardDeleted},
+}
+
+// loginFields are the fields of users only logins set, published as logins
+// by the service rather than as updates.
+var loginFields = map[string]bool{"lastLoginAt": true, "loginCount": true}
+
+// change is a change stream event.
+type change struct {
+	// Token resumes the stream after the change.
+	Token         bson.Raw `bson:"_id"`
+	OperationType string   `bson:"operationType"`
+	NS            struct {
+		Coll string `bson:"coll"`
+	} `bson:"ns"`
+	DocumentKey struct {
+		ID docID `bson:"_id"`
+	} `bson:"documentKey"`
+	FullDocument struct {
+		Registering docID `bson:"registering,omitempty"`
+	} `bson:"fullDocument"`
+	UpdateDescription struct {
+		UpdatedFields bson.M   `bson:"updatedFields"`
+		RemovedFields []string `bson:"removedFields"`
+	} `bson:"updateDescription"`
+}
+
+// changeCursor is the reply of the aggregate and getMore commands of the
+// change stream.
+type changeCursor struct {
+	Cursor struct {
+		ID         int64    `bson:"id"`
+		FirstBatch []change `bson:"firstBatch"`
+		NextBatch  []change `bson:"nextBatch"`
+	} `bson:"cursor"`
+}
+
+// Watch follows the change stream of the database, which needs a replica
+// set of MongoDB 4.0 or later. Called again, it resumes after the last
+// change it saw. Addresses and cards deleted are published without their
+// user, who no longer links to them by then.
+func (m *Mongo) Watch(ctx context.Context, publish func(changes.Event)) error {
+	s := m.Session.Copy()
+	defer s.Close()
+	d := s.DB(m.Name)
+	stream := bson.M{}
+	if token := m.resumeToken(); token != nil {
+		stream["resumeAfter"] = token
+	}
+	colls := make([]string, 0, len(changeTypes))
+	for coll := range changeTypes {
+		colls = append(colls, coll)
+	}
+	// mgo predates change streams, so the commands are run by hand.
+	var res changeCursor
+	err := d.Run(bson.D{
+		{Name: "aggregate", Value: 1},
+		{Name: "pipeline", Value: []bson.M{
+			{"$changeStream": stream},
+			{"$match": bson.M{
+				"ns.coll":       bson.M{"$in": colls},
+				"operationType": bson.M{"$in": []string{"insert", "update", "replace", "delete"}},
+			}},
+		}},
+		{Name: "cursor", Value: bson.M{}},
+	}, &res)
+	if err != nil {
+		return err
+	}
+	batch, id := res.Cursor.FirstBatch, res.Cursor.ID
+	defer func() {
+		if id != 0 {
+			d.Run(bson.D{{Name: "killCursors", Value: "$cmd.aggregate"}, {Name: "cursors", Value: []int64{id}}}, nil)
+		}
+	}()
+	for {
+		for _, c := range batch {
+			if e, ok := m.changeEvent(d, c); ok {
+				publish(e)
+			}
+			m.setResumeToken(c.Token)
+		}
+		if id == 0 {
+			return errors.New("change stream closed")
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		res = changeCursor{}
+		err := d.Run(bson.D{
+			{Name: "getMore", Value: id},
+			{Name: "collection", Value: "$cmd.aggregate"},
+			{Name: "maxTimeMS", Value: int64(watchWait / time.Millisecond)},
+		}, &res)
+		if err != nil {
+			return err
+		}
+		batch, id = res.Cursor.NextBatch, res.Cursor.ID
+	}
+}
+
+// changeEvent returns the event of the change c, false for changes not
+// published: addresses and cards of users still registering, published
+// once registered, and logins.
+func (m *Mongo) changeEvent(d *mgo.Database, c change) (changes.Event, bool) {
+	types, ok := changeTypes[c.NS.Coll]
+	if !ok {
+		return changes.Event{}, false
+	}
+	var t changes.Type
+	switch c.OperationType {
+	case "insert":
+		if c.FullDocument.Registering != "" {
+			return changes.Event{}, false
+		}
+		t = types[0]
+	case "update":
+		t = types[1]
+		for _, f := range c.UpdateDescription.RemovedFields {
+			if f == "registering" {
+				t = types[0]
+			}
+		}
+		if _, ok := c.UpdateDescription.UpdatedFields["deletedAt"]; ok {
+			t = types[2]
+		}
+		if c.NS.Coll == "customers" && loginOnly(c.UpdateDescription.UpdatedFields) {
+			return changes.Event{}, false
+		}
+	case "replace":
+		t = types[1]
+	case "delete":
+		t = types[2]
+	default:
+		return changes.Event{}, false
+	}
+	e := changes.Event{Type: t, ResourceID: string(c.DocumentKey.ID)}
+	if c.NS.Coll == "customers" {
+		e.UserID = e.ResourceID
+	} else if c.OperationType != "delete" {
+		var u struct {
+			ID docID `bson:"_id"`
+		}
+		if d.C("customers").Find(bson.M{c.NS.Coll: c.DocumentKey.ID}).Select(bson.M{"_id": 1}).One(&u) == nil {
+			e.UserID = string(u.ID)
+		}
+	}
+	return e, true
+}
+
+// loginOnly reports whether the updated fields are only those of logins.
+func loginOnly(updated bson.M) bool {
+	for f := range updated {
+		if !loginFields[f] {
+			return false
+		}
+	}
+	return len(updated) > 0
+}
+
+func (m *Mongo) resumeToken() *bson.Raw {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.resume
+}
+
+func (m *Mongo) setResumeToken(token bson.Raw) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.resume = &token
+}
@@ -0,0 +1,227 @@
+package mysql
+
+import "user/db/sqldb"
+
+// tableOptions makes text compare byte for byte like in the other backends,
+// usernames are matched through the normalized username_key instead.
+const tableOptions = ` ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin`
+
+// Migrations create and upgrade the schema. Released migrations are never
+// edited, changes are appended with the next version. MySQL commits DDL
+// right away, so statements have to be safe to run again after a failure.
+var Migrations = []sqldb.Migration{
+	{Version: 1, Name: "create tables", Statements: []string{
+		`CREATE TABLE IF NOT EXISTS customers (
+			id VARCHAR(64) NOT NULL PRIMARY KEY,
+			username VARCHAR(255) NOT NULL,
+			username_key VARCHAR(255) NOT NULL,
+			email VARCHAR(512) NOT NULL DEFAULT '',
+			first_name VARCHAR(512) NOT NULL DEFAULT '',
+			last_name VARCHAR(512) NOT NULL DEFAULT '',
+			password VARCHAR(255) NOT NULL DEFAULT '',
+			salt VARCHAR(255) NOT NULL DEFAULT '',
+			roles JSON,
+			status VARCHAR(32) NOT NULL DEFAULT '',
+			last_login_at DATETIME(3),
+			login_count INT NOT NULL DEFAULT 0,
+			created_at DATETIME(3) NOT NULL,
+			updated_at DATETIME(3) NOT NULL,
+			avatar JSON,
+			preferences JSON,
+			locale VARCHAR(64) NOT NULL DEFAULT '',
+			timezone VARCHAR(64) NOT NULL DEFAULT '',
+			metadata JSON,
+			default_card VARCHAR(64) NOT NULL DEFAULT '',
+			phone VARCHAR(512) NOT NULL DEFAULT '',
+			phone_verified BOOL NOT NULL DEFAULT FALSE,
+			phone_code JSON,
+			-- Users without an email don't collide, NULLs are distinct.
+			email_unique VARCHAR(512) GENERATED ALWAYS AS (NULLIF(email, '')) STORED,
+			CONSTRAINT customers_username_unique UNIQUE (username),
+			CONSTRAINT customers_username_key_unique UNIQUE (username_key),
+			CONSTRAINT customers_email_unique UNIQUE (email_unique),
+			INDEX customers_email (email),
+			INDEX customers_last_name (last_name),
+			INDEX customers_created_at (created_at),
+			INDEX customers_updated_at (updated_at),
+			INDEX customers_last_login_at (last_login_at)
+		)` + tableOptions,
+		`CREATE TABLE IF NOT EXISTS customer_tags (
+			customer_id VARCHAR(64) NOT NULL,
+			tag VARCHAR(255) NOT NULL,
+			PRIMARY KEY (customer_id, tag),
+			INDEX customer_tags_tag (tag),
+			FOREIGN KEY (customer_id) REFERENCES customers (id) ON DELETE CASCADE
+		)` + tableOptions,
+		`CREATE TABLE IF NOT EXISTS username_history (
+			customer_id VARCHAR(64) NOT NULL,
+			username VARCHAR(255) NOT NULL,
+			username_key VARCHAR(255) NOT NULL,
+			changed_at DATETIME(3) NOT NULL,
+			INDEX username_history_username_key (username_key),
+			FOREIGN KEY (customer_id) REFERENCES customers (id) ON DELETE CASCADE
+		)` + tableOptions,
+		`CREATE TABLE IF NOT EXISTS addresses (
+			id VARCHAR(64) NOT NULL PRIMARY KEY,
+			customer_id VARCHAR(64),
+			street VARCHAR(255) NOT NULL DEFAULT '',
+			street_number VARCHAR(64) NOT NULL DEFAULT '',
+			building VARCHAR(255) NOT NULL DEFAULT '',
+			country VARCHAR(255) NOT NULL DEFAULT '',
+			state VARCHAR(255) NOT NULL DEFAULT '',
+			prefecture VARCHAR(255) NOT NULL DEFAULT '',
+			city VARCHAR(255) NOT NULL DEFAULT '',
+			post_code VARCHAR(64) NOT NULL DEFAULT '',
+			type VARCHAR(32) NOT NULL DEFAULT '',
+			is_default BOOL NOT NULL DEFAULT FALSE,
+			validated BOOL NOT NULL DEFAULT FALSE,
+			lat DOUBLE,
+			lng DOUBLE,
+			geocode VARCHAR(32) NOT NULL DEFAULT '',
+			created_at DATETIME(3) NOT NULL,
+			updated_at DATETIME(3) NOT NULL,
+			FOREIGN KEY (customer_id) REFERENCES customers (id) ON DELETE CASCADE
+		)` + tableOptions,
+		`CREATE TABLE IF NOT EXISTS cards (
+			id VARCHAR(64) NOT NULL PRIMARY KEY,
+			customer_id VARCHAR(64),
+			long_num VARCHAR(512) NOT NULL,
+			expires VARCHAR(16) NOT NULL DEFAULT '',
+			holder VARCHAR(255) NOT NULL DEFAULT '',
+			brand VARCHAR(64) NOT NULL DEFAULT '',
+			token VARCHAR(255) NOT NULL DEFAULT '',
+			vault VARCHAR(64) NOT NULL DEFAULT '',
+			reminded_for VARCHAR(16) NOT NULL DEFAULT '',
+			verification VARCHAR(32) NOT NULL DEFAULT '',
+			replaces VARCHAR(64) NOT NULL DEFAULT '',
+			replaced_by VARCHAR(64) NOT NULL DEFAULT '',
+			deleted_at DATETIME(3),
+			created_at DATETIME(3) NOT NULL,
+			updated_at DATETIME(3) NOT NULL,
+			FOREIGN KEY (customer_id) REFERENCES customers (id) ON DELETE CASCADE
+		)` + tableOptions,
+		`CREATE TABLE IF NOT EXISTS aliases (
+			id VARCHAR(64) NOT NULL PRIMARY KEY,
+			target VARCHAR(64) NOT NULL,
+			merged_at DATETIME(3) NOT NULL,
+			INDEX aliases_target (target)
+		)` + tableOptions,
+		`CREATE TABLE IF NOT EXISTS user_groups (
+			id VARCHAR(64) NOT NULL PRIMARY KEY,
+			name VARCHAR(255) NOT NULL,
+			created_at DATETIME(3) NOT NULL
+		)` + tableOptions,
+		`CREATE TABLE IF NOT EXISTS group_users (
+			group_id VARCHAR(64) NOT NULL,
+			user_id VARCHAR(64) NOT NULL,
+			role VARCHAR(16) NOT NULL,
+			PRIMARY KEY (group_id, user_id, role),
+			INDEX group_users_user_id (user_id),
+			FOREIGN KEY (group_id) REFERENCES user_groups (id) ON DELETE CASCADE
+		)` + tableOptions,
+		// Activity feeds are read per user, newest first
+		`CREATE TABLE IF NOT EXISTS activity (
+			id VARCHAR(64) NOT NULL PRIMARY KEY,
+			user_id VARCHAR(64) NOT NULL,
+			type VARCHAR(64) NOT NULL,
+			at DATETIME(3) NOT NULL,
+			details JSON,
+			INDEX activity_user_id (user_id, id)
+		)` + tableOptions,
+		`CREATE TABLE IF NOT EXISTS idempotency_keys (
+			idempotency_key VARCHAR(255) NOT NULL PRIMARY KEY,
+			fingerprint VARCHAR(255) NOT NULL,
+			result_id VARCHAR(64) NOT NULL DEFAULT '',
+			created_at DATETIME(3) NOT NULL,
+			INDEX idempotency_keys_created_at (created_at)
+		)` + tableOptions,
+		`CREATE TABLE IF NOT EXISTS webhooks (
+			id VARCHAR(64) NOT NULL PRIMARY KEY,
+			url TEXT NOT NULL,
+			secret VARCHAR(512) NOT NULL,
+			events JSON,
+			created_at DATETIME(3) NOT NULL
+		)` + tableOptions,
+		// Webhook delivery logs are read per webhook, newest first, and expire
+		`CREATE TABLE IF NOT EXISTS webhook_deliveries (
+			id VARCHAR(64) NOT NULL PRIMARY KEY,
+			webhook_id VARCHAR(64) NOT NULL,
+			event_id VARCHAR(64) NOT NULL,
+			event_type VARCHAR(64) NOT NULL,
+			attempt INT NOT NULL,
+			status_code INT NOT NULL DEFAULT 0,
+			error TEXT NOT NULL,
+			delivered BOOL NOT NULL,
+			attempted_at DATETIME(3) NOT NULL,
+			duration_ms BIGINT NOT NULL DEFAULT 0,
+			INDEX webhook_deliveries_webhook_id (webhook_id, id),
+			INDEX webhook_deliveries_attempted_at (attempted_at)
+		)` + tableOptions,
+	}},
+	// The changes to customers, addresses and cards are recorded in the
+	// outbox, in the transaction making them. Changes nobody relayed are
+	// dropped after a week. Cascades don't fire triggers in MySQL, the
+	// addresses and cards of deleted customers go unrecorded.
+	{Version: 2, Name: "outbox", Statements: []string{
+		`CREATE TABLE IF NOT EXISTS outbox (
+			seq BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+			type VARCHAR(64) NOT NULL,
+			resource_id VARCHAR(64) NOT NULL,
+			user_id VARCHAR(64) NOT NULL DEFAULT '',
+			created_at DATETIME(3) NOT NULL DEFAULT CURRENT_TIMESTAMP(3),
+			INDEX outbox_created_at (created_at)
+		)` + tableOptions,
+		`DROP TRIGGER IF EXISTS customers_insert_outbox`,
+		`CREATE TRIGGER customers_insert_outbox AFTER INSERT ON customers FOR EACH ROW BEGIN
+			DELETE FROM outbox WHERE created_at < NOW(3) - INTERVAL 7 DAY;
+			INSERT INTO outbox (type, resource_id, user_id) VALUES ('user.created', NEW.id, NEW.id);
+		END`,
+		// Logins, the only updates counting, are published by the service.
+		`DROP TRIGGER IF EXISTS customers_update_outbox`,
+		`CREATE TRIGGER customers_update_outbox AFTER UPDATE ON customers FOR EACH ROW BEGIN
+			IF OLD.login_count = NEW.login_count THEN
+				DELETE FROM outbox WHERE created_at < NOW(3) - INTERVAL 7 DAY;
+				INSERT INTO outbox (type, resource_id, user_id) VALUES ('user.updated', NEW.id, NEW.id);
+			END IF;
+		END`,
+		`DROP TRIGGER IF EXISTS customers_delete_outbox`,
+		`CREATE TRIGGER customers_delete_outbox AFTER DELETE ON customers FOR EACH ROW BEGIN
+			DELETE FROM outbox WHERE created_at < NOW(3) - INTERVAL 7 DAY;
+			INSERT INTO outbox (type, resource_id, user_id) VALUES ('user.deleted', OLD.id, OLD.id);
+		END`,
+		`DROP TRIGGER IF EXISTS addresses_insert_outbox`,
+		`CREATE TRIGGER addresses_insert_outbox AFTER INSERT ON addresses FOR EACH ROW BEGIN
+			DELETE FROM outbox WHERE created_at < NOW(3) - INTERVAL 7 DAY;
+			INSERT INTO outbox (type, resource_id, user_id) VALUES ('address.created', NEW.id, COALESCE(NEW.customer_id, ''));
+		END`,
+		`DROP TRIGGER IF EXISTS addresses_update_outbox`,
+		`CREATE TRIGGER addresses_update_outbox AFTER UPDATE ON addresses FOR EACH ROW BEGIN
+			DELETE FROM outbox WHERE created_at < NOW(3) - INTERVAL 7 DAY;
+			INSERT INTO outbox (type, resource_id, user_id)
+				VALUES ('address.updated', NEW.id, COALESCE(NEW.customer_id, OLD.customer_id, ''));
+		END`,
+		`DROP TRIGGER IF EXISTS addresses_delete_outbox`,
+		`CREATE TRIGGER addresses_delete_outbox AFTER DELETE ON addresses FOR EACH ROW BEGIN
+			DELETE FROM outbox WHERE created_at < NOW(3) - INTERVAL 7 DAY;
+			INSERT INTO outbox (type, resource_id, user_id) VALUES ('address.deleted', OLD.id, COALESCE(OLD.customer_id, ''));
+		END`,
+		`DROP TRIGGER IF EXISTS cards_insert_outbox`,
+		`CREATE TRIGGER cards_insert_outbox AFTER INSERT ON cards FOR EACH ROW BEGIN
+			DELETE FROM outbox WHERE created_at < NOW(3) - INTERVAL 7 DAY;
+			INSERT INTO outbox (type, resource_id, user_id) VALUES ('card.created', NEW.id, COALESCE(NEW.customer_id, ''));
+		END`,
+		// Deleted cards are kept, taken off their customer.
+		`DROP TRIGGER IF EXISTS cards_update_outbox`,
+		`CREATE TRIGGER cards_update_outbox AFTER UPDATE ON cards FOR EACH ROW BEGIN
+			DELETE FROM outbox WHERE created_at < NOW(3) - INTERVAL 7 DAY;
+			INSERT INTO outbox (type, resource_id, user_id) VALUES (
+				CASE WHEN OLD.deleted_at IS NULL AND NEW.deleted_at IS NOT NULL THEN 'card.deleted' ELSE 'card.updated' END,
+				NEW.id, COALESCE(NEW.customer_id, OLD.customer_id, ''));
+		END`,
+		`DROP TRIGGER IF EXISTS cards_delete_outbox`,
+		`CREATE TRIGGER cards_delete_outbox AFTER DELETE ON cards FOR EACH ROW BEGIN
+			DELETE FROM outbox WHERE created_at < NOW(3) - INTERVAL 7 DAY;
+			INSERT INTO outbox (type, resource_id, user_id) VALUES ('card.deleted', OLD.id, COALESCE(OLD.customer_id, ''));
+		END`,
+	}},
+}
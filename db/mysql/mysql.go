@@ -0,0 +1,229 @@
+// Package mysql stores the data of the service in MySQL or MariaDB. The
+// queries are those of sqldb, the schema is created and upgraded by
+// Migrations on Init.
+package mysql
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"user/db"
+	"user/db/sqldb"
+	"user/secrets"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+var (
+	dsn         string
+	replicaDSN  string
+	pool        sqldb.Pool
+	dialTimeout time.Duration
+	ioTimeout   time.Duration
+)
+
+func init() {
+	flag.StringVar(&dsn, "mysql-dsn", os.Getenv("MYSQL_DSN"), "MySQL data source name, like user:pass@tcp(host:3306)/users")
+	flag.StringVar(&replicaDSN, "mysql-replica-dsn", os.Getenv("MYSQL_REPLICA_DSN"), "Data source name of a MySQL read replica serving the reads preferring secondaries, none when empty")
+	flag.IntVar(&pool.MaxOpen, "mysql-max-open-conns", 20, "Open MySQL connections, 0 for no limit")
+	flag.IntVar(&pool.MaxIdle, "mysql-max-idle-conns", 10, "Idle MySQL connections kept for reuse")
+	flag.DurationVar(&pool.MaxLifetime, "mysql-conn-max-lifetime", 5*time.Minute, "How long a MySQL connection is used, below the wait_timeout of the server, 0 for no limit")
+	flag.DurationVar(&pool.MaxIdleTime, "mysql-conn-max-idle-time", time.Minute, "How long a MySQL connection may be idle, 0 for no limit")
+	flag.DurationVar(&dialTimeout, "mysql-timeout", 5*time.Second, "How long connecting to MySQL may take")
+	flag.DurationVar(&ioTimeout, "mysql-io-timeout", 30*time.Second, "How long reading or writing a MySQL connection may take, 0 for no limit")
+}
+
+// MySQL meets the Database interface requirements
+type MySQL struct {
+	sqldb.Database
+	// DSN is the data source name, the -mysql-dsn flag when empty.
+	DSN string
+	// ReplicaDSN is the data source name of a read replica, the
+	// -mysql-replica-dsn flag when empty.
+	ReplicaDSN string
+	// Pool configures the connection pool, the -mysql-* flags when zero.
+	Pool sqldb.Pool
+
+	mu      sync.Mutex
+	tenants map[string]*MySQL
+}
+
+// Init connects to MySQL and applies the pending migrations.
+func (m *MySQL) Init() error {
+	if m.DSN == "" {
+		m.DSN = dsn
+	}
+	if m.DSN == "" {
+		m.DSN = secrets.Value(secrets.MySQLDSN)
+	}
+	if m.DSN == "" {
+		return &db.ConfigError{Err: errors.New("no MySQL data source name")}
+	}
+	if m.ReplicaDSN == "" {
+		m.ReplicaDSN = replicaDSN
+	}
+	if m.Pool == (sqldb.Pool{}) {
+		m.Pool = pool
+	}
+	cfg, err := Config(m.DSN)
+	if err != nil {
+		return &db.ConfigError{Err: err}
+	}
+	return m.open(cfg)
+}
+
+// Config parses dsn with the settings the queries rely on: times are
+// parsed in UTC, and updates count the rows they match rather than those
+// they change.
+func Config(dsn string) (*mysql.Config, error) {
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	cfg.ParseTime = true
+	cfg.Loc = time.UTC
+	cfg.ClientFoundRows = true
+	if cfg.Params == nil {
+		cfg.Params = map[string]string{}
+	}
+	cfg.Params["time_zone"] = "'+00:00'"
+	if cfg.Timeout == 0 {
+		cfg.Timeout = dialTimeout
+	}
+	if cfg.ReadTimeout == 0 {
+		cfg.ReadTimeout = ioTimeout
+	}
+	if cfg.WriteTimeout == 0 {
+		cfg.WriteTimeout = ioTimeout
+	}
+	return cfg, nil
+}
+
+func (m *MySQL) open(cfg *mysql.Config) error {
+	var err error
+	if m.Database.DB, err = m.connect(cfg); err != nil {
+		return err
+	}
+	if m.ReplicaDSN != "" {
+		replica, err := Config(m.ReplicaDSN)
+		if err != nil {
+			return err
+		}
+		// Tenants read their database on the replica too.
+		replica.DBName = cfg.DBName
+		if m.Replica, err = m.connect(replica); err != nil {
+			return err
+		}
+	}
+	m.Dialect = Dialect{}
+	m.Migrations = Migrations
+	return m.Database.Init()
+}
+
+// connect returns a pool of connections to the database of cfg.
+func (m *MySQL) connect(cfg *mysql.Config) (*sql.DB, error) {
+	c, err := mysql.NewConnector(cfg)
+	if err != nil {
+		return nil, err
+	}
+	d := sql.OpenDB(c)
+	m.Pool.Apply(d)
+	return d, nil
+}
+
+// Tenant returns the database of a tenant. Each tenant has its own MySQL
+// database next to the configured one, migrated on first use, with a pool
+// configured like the one of m.
+func (m *MySQL) Tenant(id string) (db.Database, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if t, ok := m.tenants[id]; ok {
+		return t, nil
+	}
+	cfg, err := Config(m.DSN)
+	if err != nil {
+		return nil, err
+	}
+	cfg.DBName = tenantDatabase(cfg.DBName, id)
+	if _, err := m.Database.DB.Exec("CREATE DATABASE IF NOT EXISTS `" + cfg.DBName + "`"); err != nil {
+		return nil, err
+	}
+	t := &MySQL{DSN: cfg.FormatDSN(), ReplicaDSN: m.ReplicaDSN, Pool: m.Pool}
+	if err := t.open(cfg); err != nil {
+		t.Close()
+		return nil, err
+	}
+	if m.tenants == nil {
+		m.tenants = make(map[string]*MySQL)
+	}
+	m.tenants[id] = t
+	return t, nil
+}
+
+// tenantDatabase names the database of the tenant. Tenant ids have no
+// underscores, so ids with dashes can't collide.
+func tenantDatabase(name, id string) string {
+	return name + "_" + strings.ReplaceAll(id, "-", "_")
+}
+
+// Close closes the connection pools of the database and its tenants.
+func (m *MySQL) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, t := range m.tenants {
+		t.Close()
+	}
+	return m.Database.Close()
+}
+
+// Dialect is the MySQL sqldb.Dialect.
+type Dialect struct{}
+
+// Placeholder returns ?.
+func (Dialect) Placeholder(int) string {
+	return "?"
+}
+
+// UniqueViolation returns the key of duplicate entry errors, like
+// customers_username_unique of
+//
+//	Duplicate entry 'eve' for key 'customers.customers_username_unique'
+func (Dialect) UniqueViolation(err error) (string, bool) {
+	var e *mysql.MySQLError
+	if !errors.As(err, &e) || e.Number != 1062 {
+		return "", false
+	}
+	k := strings.LastIndex(e.Message, " for key ")
+	if k < 0 {
+		return "", true
+	}
+	key := strings.Trim(e.Message[k+len(" for key "):], "'")
+	// MySQL 8 prefixes the table.
+	return key[strings.LastIndex(key, ".")+1:], true
+}
+
+// JSONField extracts the text of key from the JSON column. Metadata keys
+// are letters, digits, - and _, they need no escaping.
+func (Dialect) JSONField(column, key string) (string, interface{}) {
+	return "JSON_UNQUOTE(JSON_EXTRACT(" + column + ", ?))", `$."` + key + `"`
+}
+
+// JSONContains matches JSON arrays holding the quoted text.
+func (Dialect) JSONContains(column string) string {
+	return "JSON_CONTAINS(" + column + ", JSON_QUOTE(?))"
+}
+
+// Day formats the timestamp column, stored in UTC.
+func (Dialect) Day(column string) string {
+	return "DATE_FORMAT(" + column + ", '%Y-%m-%d')"
+}
+
+// ForUpdate locks the selected rows.
+func (Dialect) ForUpdate() string {
+	return " FOR UPDATE"
+}
@@ -0,0 +1,135 @@
+package mysql
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"user/db"
+	"user/db/sqldb"
+	"user/users"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+var (
+	_ db.Database = &MySQL{}
+	_ db.Tenanted = &MySQL{}
+	_ db.Outbox   = &MySQL{}
+)
+
+func TestMigrations(t *testing.T) {
+	if err := sqldb.Validate(Migrations); err != nil {
+		t.Fatal(err)
+	}
+	for k, m := range Migrations {
+		if m.Version != k+1 {
+			t.Errorf("expected version %v of %v, got %v", k+1, m.Name, m.Version)
+		}
+	}
+}
+
+func TestConfig(t *testing.T) {
+	cfg, err := Config("user:pass@tcp(db:3306)/users?readTimeout=1s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.ParseTime || cfg.Loc != time.UTC || !cfg.ClientFoundRows {
+		t.Errorf("expected UTC times and found rows, got %+v", cfg)
+	}
+	if cfg.ReadTimeout != time.Second || cfg.WriteTimeout != ioTimeout || cfg.Timeout != dialTimeout {
+		t.Errorf("expected the timeouts of the flags unless set, got %v %v %v", cfg.Timeout, cfg.ReadTimeout, cfg.WriteTimeout)
+	}
+	if _, err := Config("not a dsn"); err == nil {
+		t.Error("expected an invalid data source name to fail")
+	}
+}
+
+func TestTenantDatabase(t *testing.T) {
+	if got := tenantDatabase("users", "acme-eu"); got != "users_acme_eu" {
+		t.Errorf("expected users_acme_eu, got %v", got)
+	}
+}
+
+func TestUniqueViolation(t *testing.T) {
+	d := Dialect{}
+	for msg, expected := range map[string]string{
+		"Duplicate entry 'eve' for key 'customers.customers_username_unique'": "customers_username_unique",
+		"Duplicate entry 'eve' for key 'customers_email_unique'":              "customers_email_unique",
+	} {
+		got, ok := d.UniqueViolation(&mysql.MySQLError{Number: 1062, Message: msg})
+		if !ok || got != expected {
+			t.Errorf("%v: expected %v, got %v %v", msg, expected, got, ok)
+		}
+	}
+	if _, ok := d.UniqueViolation(&mysql.MySQLError{Number: 1452}); ok {
+		t.Error("expected foreign key errors not to be unique violations")
+	}
+	if _, ok := d.UniqueViolation(errors.New("1062")); ok {
+		t.Error("expected only MySQL errors to be unique violations")
+	}
+}
+
+// TestMySQL runs against the server of MYSQL_TEST_DSN, which it fills with
+// databases and tables.
+func TestMySQL(t *testing.T) {
+	ctx := context.Background()
+	dsn := os.Getenv("MYSQL_TEST_DSN")
+	if dsn == "" {
+		t.Skip("MYSQL_TEST_DSN not set")
+	}
+	m := &MySQL{DSN: dsn}
+	if err := m.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	tm, err := m.Tenant("test-" + db.NewID()[16:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := tm.(*MySQL)
+
+	u := users.User{Username: "Eve", Email: "eve@example.com", Tags: []string{"vip"},
+		Addresses: []users.Address{{Street: "street", Type: users.AddressBilling, Default: true}},
+		Cards:     []users.Card{{LongNum: "4111111111111111", Expires: "01/30"}}}
+	if err := s.CreateUser(ctx, &u); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.GetUserByName(ctx, "eve")
+	if err != nil || got.UserID != u.UserID || len(got.Addresses) != 1 || len(got.Cards) != 1 || got.Tags[0] != "vip" {
+		t.Fatalf("expected the created user, got %+v %v", got, err)
+	}
+	dup := users.User{Username: "EVE"}
+	if err := s.CreateUser(ctx, &dup); !errors.Is(err, db.ErrConflict) {
+		t.Errorf("expected a username conflict, got %v", err)
+	}
+	dup = users.User{Username: "eve-again", Email: "eve@example.com"}
+	if err := s.CreateUser(ctx, &dup); !errors.Is(err, db.ErrConflict) {
+		t.Errorf("expected an email conflict, got %v", err)
+	}
+	for _, name := range []string{"mallory", "trent"} {
+		if err := s.CreateUser(ctx, &users.User{Username: name}); err != nil {
+			t.Errorf("expected users without email not to conflict, got %v", err)
+		}
+	}
+
+	v := "1"
+	if err := s.UpdateUser(ctx, u.UserID, users.ProfileUpdate{Metadata: map[string]*string{"crm": &v}}); err != nil {
+		t.Fatal(err)
+	}
+	if us, err := s.GetUsers(ctx, db.UserQuery{Metadata: map[string]string{"crm": "1"}, Tag: "vip"}); err != nil || len(us) != 1 {
+		t.Errorf("expected the user by metadata and tag, got %v %v", us, err)
+	}
+	if err := s.RecordLogin(ctx, u.UserID, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RecordLogin(ctx, "missing", time.Now()); err == nil {
+		t.Error("expected a login of a missing user to fail")
+	}
+	res, err := s.DeleteUsers(ctx, []string{u.UserID, "missing"})
+	if err != nil || res[u.UserID] != nil || res["missing"] == nil {
+		t.Errorf("unexpected deletions %v %v", res, err)
+	}
+}
@@ -0,0 +1,253 @@
+package postgres
+
+import "user/db/sqldb"
+
+// Migrations create and upgrade the schema. Released migrations are never
+// edited, changes are appended with the next version.
+var Migrations = []sqldb.Migration{
+	{Version: 1, Name: "create tables", Statements: []string{
+		`CREATE TABLE customers (
+			id TEXT PRIMARY KEY,
+			username TEXT NOT NULL,
+			username_key TEXT NOT NULL,
+			email TEXT NOT NULL DEFAULT '',
+			first_name TEXT NOT NULL DEFAULT '',
+			last_name TEXT NOT NULL DEFAULT '',
+			password TEXT NOT NULL DEFAULT '',
+			salt TEXT NOT NULL DEFAULT '',
+			roles JSONB,
+			status TEXT NOT NULL DEFAULT '',
+			last_login_at TIMESTAMPTZ,
+			login_count INTEGER NOT NULL DEFAULT 0,
+			created_at TIMESTAMPTZ NOT NULL,
+			updated_at TIMESTAMPTZ NOT NULL,
+			avatar JSONB,
+			preferences JSONB,
+			locale TEXT NOT NULL DEFAULT '',
+			timezone TEXT NOT NULL DEFAULT '',
+			metadata JSONB,
+			default_card TEXT NOT NULL DEFAULT '',
+			phone TEXT NOT NULL DEFAULT '',
+			phone_verified BOOLEAN NOT NULL DEFAULT FALSE,
+			phone_code JSONB,
+			CONSTRAINT customers_username_unique UNIQUE (username),
+			CONSTRAINT customers_username_key_unique UNIQUE (username_key)
+		)`,
+		// Listing filters and sorts
+		`CREATE INDEX customers_email ON customers (email)`,
+		`CREATE INDEX customers_last_name ON customers (last_name)`,
+		`CREATE INDEX customers_created_at ON customers (created_at)`,
+		`CREATE INDEX customers_updated_at ON customers (updated_at)`,
+		`CREATE INDEX customers_last_login_at ON customers (last_login_at)`,
+		`CREATE TABLE customer_tags (
+			customer_id TEXT NOT NULL REFERENCES customers (id) ON DELETE CASCADE,
+			tag TEXT NOT NULL,
+			PRIMARY KEY (customer_id, tag)
+		)`,
+		`CREATE INDEX customer_tags_tag ON customer_tags (tag)`,
+		`CREATE TABLE username_history (
+			customer_id TEXT NOT NULL REFERENCES customers (id) ON DELETE CASCADE,
+			username TEXT NOT NULL,
+			username_key TEXT NOT NULL,
+			changed_at TIMESTAMPTZ NOT NULL
+		)`,
+		`CREATE INDEX username_history_customer_id ON username_history (customer_id)`,
+		`CREATE INDEX username_history_username_key ON username_history (username_key)`,
+		// Addresses and cards link to their customer, anonymous ones to none.
+		`CREATE TABLE addresses (
+			id TEXT PRIMARY KEY,
+			customer_id TEXT REFERENCES customers (id) ON DELETE CASCADE,
+			street TEXT NOT NULL DEFAULT '',
+			street_number TEXT NOT NULL DEFAULT '',
+			building TEXT NOT NULL DEFAULT '',
+			country TEXT NOT NULL DEFAULT '',
+			state TEXT NOT NULL DEFAULT '',
+			prefecture TEXT NOT NULL DEFAULT '',
+			city TEXT NOT NULL DEFAULT '',
+			post_code TEXT NOT NULL DEFAULT '',
+			type TEXT NOT NULL DEFAULT '',
+			is_default BOOLEAN NOT NULL DEFAULT FALSE,
+			validated BOOLEAN NOT NULL DEFAULT FALSE,
+			lat DOUBLE PRECISION,
+			lng DOUBLE PRECISION,
+			geocode TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMPTZ NOT NULL,
+			updated_at TIMESTAMPTZ NOT NULL
+		)`,
+		`CREATE INDEX addresses_customer_id ON addresses (customer_id)`,
+		`CREATE TABLE cards (
+			id TEXT PRIMARY KEY,
+			customer_id TEXT REFERENCES customers (id) ON DELETE CASCADE,
+			long_num TEXT NOT NULL,
+			expires TEXT NOT NULL DEFAULT '',
+			holder TEXT NOT NULL DEFAULT '',
+			brand TEXT NOT NULL DEFAULT '',
+			token TEXT NOT NULL DEFAULT '',
+			vault TEXT NOT NULL DEFAULT '',
+			reminded_for TEXT NOT NULL DEFAULT '',
+			verification TEXT NOT NULL DEFAULT '',
+			replaces TEXT NOT NULL DEFAULT '',
+			replaced_by TEXT NOT NULL DEFAULT '',
+			deleted_at TIMESTAMPTZ,
+			created_at TIMESTAMPTZ NOT NULL,
+			updated_at TIMESTAMPTZ NOT NULL
+		)`,
+		`CREATE INDEX cards_customer_id ON cards (customer_id)`,
+		`CREATE TABLE aliases (
+			id TEXT PRIMARY KEY,
+			target TEXT NOT NULL,
+			merged_at TIMESTAMPTZ NOT NULL
+		)`,
+		`CREATE INDEX aliases_target ON aliases (target)`,
+		`CREATE TABLE user_groups (
+			id TEXT PRIMARY KEY,
+			name TEXT NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL
+		)`,
+		`CREATE TABLE group_users (
+			group_id TEXT NOT NULL REFERENCES user_groups (id) ON DELETE CASCADE,
+			user_id TEXT NOT NULL,
+			role TEXT NOT NULL,
+			PRIMARY KEY (group_id, user_id, role)
+		)`,
+		`CREATE INDEX group_users_user_id ON group_users (user_id)`,
+		// Activity feeds are read per user, newest first
+		`CREATE TABLE activity (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			type TEXT NOT NULL,
+			at TIMESTAMPTZ NOT NULL,
+			details JSONB
+		)`,
+		`CREATE INDEX activity_user_id ON activity (user_id, id DESC)`,
+		`CREATE TABLE idempotency_keys (
+			idempotency_key TEXT PRIMARY KEY,
+			fingerprint TEXT NOT NULL,
+			result_id TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMPTZ NOT NULL
+		)`,
+		`CREATE INDEX idempotency_keys_created_at ON idempotency_keys (created_at)`,
+		`CREATE TABLE webhooks (
+			id TEXT PRIMARY KEY,
+			url TEXT NOT NULL,
+			secret TEXT NOT NULL,
+			events JSONB,
+			created_at TIMESTAMPTZ NOT NULL
+		)`,
+		// Webhook delivery logs are read per webhook, newest first, and expire
+		`CREATE TABLE webhook_deliveries (
+			id TEXT PRIMARY KEY,
+			webhook_id TEXT NOT NULL,
+			event_id TEXT NOT NULL,
+			event_type TEXT NOT NULL,
+			attempt INTEGER NOT NULL,
+			status_code INTEGER NOT NULL DEFAULT 0,
+			error TEXT NOT NULL DEFAULT '',
+			delivered BOOLEAN NOT NULL,
+			attempted_at TIMESTAMPTZ NOT NULL,
+			duration_ms BIGINT NOT NULL DEFAULT 0
+		)`,
+		`CREATE INDEX webhook_deliveries_webhook_id ON webhook_deliveries (webhook_id, id DESC)`,
+		`CREATE INDEX webhook_deliveries_attempted_at ON webhook_deliveries (attempted_at)`,
+	}},
+	// Emails are unique like in MySQL, empty ones aside. Duplicates have
+	// to be merged or changed first.
+	{Version: 2, Name: "unique emails", Statements: []string{
+		`CREATE UNIQUE INDEX customers_email_unique ON customers (email) WHERE email <> ''`,
+		`DROP INDEX customers_email`,
+	}},
+	// Changes to customers, addresses and cards are notified on
+	// notifyChannel for Watch, whoever makes them. Logins are left out, the
+	// service publishes them itself.
+	{Version: 3, Name: "change notifications", Statements: []string{
+		`CREATE FUNCTION notify_change() RETURNS trigger AS $$
+		DECLARE
+			r RECORD;
+			op TEXT := TG_OP;
+			owner TEXT;
+		BEGIN
+			IF TG_OP = 'DELETE' THEN
+				r := OLD;
+			ELSE
+				r := NEW;
+			END IF;
+			IF TG_TABLE_NAME = 'customers' THEN
+				IF TG_OP = 'UPDATE' AND to_jsonb(NEW) - 'last_login_at' - 'login_count' = to_jsonb(OLD) - 'last_login_at' - 'login_count' THEN
+					RETURN NULL;
+				END IF;
+				owner := r.id;
+			ELSIF TG_OP = 'UPDATE' THEN
+				-- Deleted cards are kept, taken off their customer.
+				owner := COALESCE(NEW.customer_id, OLD.customer_id);
+				IF TG_TABLE_NAME = 'cards' THEN
+					IF OLD.deleted_at IS NULL AND NEW.deleted_at IS NOT NULL THEN
+						op := 'DELETE';
+					END IF;
+				END IF;
+			ELSE
+				owner := r.customer_id;
+			END IF;
+			PERFORM pg_notify('user_changes', json_build_object(
+				'schema', TG_TABLE_SCHEMA, 'table', TG_TABLE_NAME, 'op', op, 'id', r.id, 'userId', owner)::text);
+			RETURN NULL;
+		END
+		$$ LANGUAGE plpgsql`,
+		`CREATE TRIGGER customers_notify_change AFTER INSERT OR UPDATE OR DELETE ON customers
+			FOR EACH ROW EXECUTE PROCEDURE notify_change()`,
+		`CREATE TRIGGER addresses_notify_change AFTER INSERT OR UPDATE OR DELETE ON addresses
+			FOR EACH ROW EXECUTE PROCEDURE notify_change()`,
+		`CREATE TRIGGER cards_notify_change AFTER INSERT OR UPDATE OR DELETE ON cards
+			FOR EACH ROW EXECUTE PROCEDURE notify_change()`,
+	}},
+	// The changes notified are also recorded in the outbox, in the
+	// transaction making them. Changes nobody relayed are dropped after a
+	// week.
+	{Version: 4, Name: "outbox", Statements: []string{
+		`CREATE TABLE outbox (
+			seq BIGSERIAL PRIMARY KEY,
+			type TEXT NOT NULL,
+			resource_id TEXT NOT NULL,
+			user_id TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		)`,
+		`CREATE INDEX outbox_created_at ON outbox (created_at)`,
+		`CREATE OR REPLACE FUNCTION notify_change() RETURNS trigger AS $$
+		DECLARE
+			r RECORD;
+			op TEXT := TG_OP;
+			owner TEXT;
+		BEGIN
+			IF TG_OP = 'DELETE' THEN
+				r := OLD;
+			ELSE
+				r := NEW;
+			END IF;
+			IF TG_TABLE_NAME = 'customers' THEN
+				IF TG_OP = 'UPDATE' AND to_jsonb(NEW) - 'last_login_at' - 'login_count' = to_jsonb(OLD) - 'last_login_at' - 'login_count' THEN
+					RETURN NULL;
+				END IF;
+				owner := r.id;
+			ELSIF TG_OP = 'UPDATE' THEN
+				-- Deleted cards are kept, taken off their customer.
+				owner := COALESCE(NEW.customer_id, OLD.customer_id);
+				IF TG_TABLE_NAME = 'cards' THEN
+					IF OLD.deleted_at IS NULL AND NEW.deleted_at IS NOT NULL THEN
+						op := 'DELETE';
+					END IF;
+				END IF;
+			ELSE
+				owner := r.customer_id;
+			END IF;
+			PERFORM pg_notify('user_changes', json_build_object(
+				'schema', TG_TABLE_SCHEMA, 'table', TG_TABLE_NAME, 'op', op, 'id', r.id, 'userId', owner)::text);
+			-- The outbox of the schema of the table, whatever the search path.
+			EXECUTE format('DELETE FROM %I.outbox WHERE created_at < now() - interval ''7 days''', TG_TABLE_SCHEMA);
+			EXECUTE format('INSERT INTO %I.outbox (type, resource_id, user_id) VALUES ($1, $2, $3)', TG_TABLE_SCHEMA)
+				USING CASE TG_TABLE_NAME WHEN 'customers' THEN 'user' WHEN 'addresses' THEN 'address' ELSE 'card' END
+					|| CASE op WHEN 'INSERT' THEN '.created' WHEN 'UPDATE' THEN '.updated' ELSE '.deleted' END,
+					r.id, COALESCE(owner, '');
+			RETURN NULL;
+		END
+		$$ LANGUAGE plpgsql`,
+	}},
+}
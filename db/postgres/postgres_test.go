@@ -0,0 +1,177 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"user/changes"
+	"user/db"
+	"user/db/sqldb"
+	"user/users"
+)
+
+var (
+	_ db.Database = &Postgres{}
+	_ db.Tenanted = &Postgres{}
+	_ db.Watcher  = &Postgres{}
+	_ db.Outbox   = &Postgres{}
+)
+
+func TestMigrations(t *testing.T) {
+	if err := sqldb.Validate(Migrations); err != nil {
+		t.Fatal(err)
+	}
+	for k, m := range Migrations {
+		if m.Version != k+1 {
+			t.Errorf("expected version %v of %v, got %v", k+1, m.Name, m.Version)
+		}
+	}
+}
+
+func TestWithSearchPath(t *testing.T) {
+	for dsn, expected := range map[string]string{
+		"postgres://user:pass@db/users?sslmode=disable": "postgres://user:pass@db/users?search_path=tenant_acme_eu&sslmode=disable",
+		"host=db dbname=users":                          "host=db dbname=users search_path=tenant_acme_eu",
+	} {
+		got, err := withSearchPath(dsn, tenantSchema("acme-eu"))
+		if err != nil || got != expected {
+			t.Errorf("%v: expected %v, got %v %v", dsn, expected, got, err)
+		}
+	}
+}
+
+// TestTimeouts checks a server that stops answering fails the connection
+// rather than hanging it.
+func TestTimeouts(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+	p := &Postgres{URL: "postgres://user@" + l.Addr().String() + "/users?sslmode=disable"}
+	p.Dialect = Dialect{}
+	io := ioTimeout
+	ioTimeout = 50 * time.Millisecond
+	defer func() { ioTimeout = io }()
+	start := time.Now()
+	if err := p.open(); err == nil {
+		t.Fatal("expected a silent server to fail")
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("expected the read to time out, took %v", d)
+	}
+	var ne net.Error
+	if err := p.DB.Ping(); !errors.As(err, &ne) || !ne.Timeout() {
+		t.Errorf("expected a timeout, got %v", err)
+	}
+	p.Close()
+}
+
+func TestDialect(t *testing.T) {
+	d := Dialect{}
+	if d.Placeholder(3) != "$3" {
+		t.Errorf("expected $3, got %v", d.Placeholder(3))
+	}
+	if _, ok := d.UniqueViolation(errors.New("23505")); ok {
+		t.Error("expected only pq errors to be unique violations")
+	}
+}
+
+func TestChangeEvent(t *testing.T) {
+	e, ok := changeEvent(`{"schema":"tenant_acme","table":"cards","op":"DELETE","id":"c1","userId":"u1"}`, "tenant_acme")
+	if !ok || e.Type != changes.CardDeleted || e.ResourceID != "c1" || e.UserID != "u1" {
+		t.Errorf("expected the card deleted, got %v %v", e, ok)
+	}
+	if e, ok := changeEvent(`{"schema":"public","table":"cards","op":"DELETE","id":"c1"}`, "tenant_acme"); ok {
+		t.Errorf("expected changes of other schemas left out, got %v", e)
+	}
+	if e, ok := changeEvent(`{"schema":"public","table":"webhooks","op":"INSERT","id":"w1"}`, "public"); ok {
+		t.Errorf("expected changes of other tables left out, got %v", e)
+	}
+}
+
+// TestPostgres runs against the server of POSTGRES_TEST_URL, which it
+// fills with tables.
+func TestPostgres(t *testing.T) {
+	ctx := context.Background()
+	url := os.Getenv("POSTGRES_TEST_URL")
+	if url == "" {
+		t.Skip("POSTGRES_TEST_URL not set")
+	}
+	p := &Postgres{URL: url}
+	if err := p.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	tp, err := p.Tenant("test-" + db.NewID()[16:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := tp.(*Postgres)
+
+	u := users.User{Username: "Eve", Email: "eve@example.com", Tags: []string{"vip"},
+		Addresses: []users.Address{{Street: "street", Type: users.AddressBilling, Default: true}},
+		Cards:     []users.Card{{LongNum: "4111111111111111", Expires: "01/30"}}}
+	if err := s.CreateUser(ctx, &u); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.GetUserByName(ctx, "eve")
+	if err != nil || got.UserID != u.UserID || len(got.Addresses) != 1 || len(got.Cards) != 1 || got.Tags[0] != "vip" {
+		t.Fatalf("expected the created user, got %+v %v", got, err)
+	}
+	if err := s.GetUserAttributes(ctx, &got); err != nil || got.Addresses[0].Street != "street" {
+		t.Errorf("expected the addresses, got %+v %v", got.Addresses, err)
+	}
+	dup := users.User{Username: "EVE"}
+	if err := s.CreateUser(ctx, &dup); !errors.Is(err, db.ErrConflict) {
+		t.Errorf("expected a username conflict, got %v", err)
+	}
+
+	if err := s.RenameUser(ctx, u.UserID, "eve2"); err != nil {
+		t.Fatal(err)
+	}
+	if prev, err := s.GetUserByPreviousName(ctx, "Eve", time.Now().Add(-time.Minute)); err != nil || prev.UserID != u.UserID {
+		t.Errorf("expected the renamed user, got %+v %v", prev, err)
+	}
+	v := "1"
+	if err := s.UpdateUser(ctx, u.UserID, users.ProfileUpdate{Metadata: map[string]*string{"crm": &v}}); err != nil {
+		t.Fatal(err)
+	}
+	if us, err := s.GetUsers(ctx, db.UserQuery{Metadata: map[string]string{"crm": "1"}, Tag: "vip"}); err != nil || len(us) != 1 {
+		t.Errorf("expected the user by metadata and tag, got %v %v", us, err)
+	}
+
+	other := users.User{Username: "mallory", Tags: []string{"new"}}
+	if err := s.CreateUser(ctx, &other); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.MergeUsers(ctx, u.UserID, other.UserID, users.ProfileUpdate{}); err != nil {
+		t.Fatal(err)
+	}
+	if target, err := s.ResolveAlias(ctx, other.UserID); err != nil || target != u.UserID {
+		t.Errorf("expected an alias of the merged user, got %v %v", target, err)
+	}
+	if err := s.TombstoneCard(ctx, u.Cards[0].ID, "************1111", ""); err != nil {
+		t.Fatal(err)
+	}
+	if cs, err := s.GetCardsByID(ctx, []string{u.Cards[0].ID}); err != nil || len(cs) != 0 {
+		t.Errorf("expected the deleted card left out, got %v %v", cs, err)
+	}
+	res, err := s.DeleteUsers(ctx, []string{u.UserID, "missing"})
+	if err != nil || res[u.UserID] != nil || res["missing"] == nil {
+		t.Errorf("unexpected deletions %v %v", res, err)
+	}
+}
@@ -0,0 +1,77 @@
+package postgres
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"time"
+
+	"user/changes"
+
+	"github.com/lib/pq"
+)
+
+// notifyChannel is the channel the triggers of the change notifications
+// migration notify on.
+const notifyChannel = "user_changes"
+
+// changeTypes are the events of the operations on the watched tables.
+var changeTypes = map[string]map[string]changes.Type{
+	"customers": {"INSERT": changes.UserCreated, "UPDATE": changes.UserUpdated, "DELETE": changes.UserDeleted},
+	"addresses": {"INSERT": changes.AddressCreated, "UPDATE": changes.AddressUpdated, "DELETE": changes.AddressDeleted},
+	"cards":     {"INSERT": changes.CardCreated, "UPDATE": changes.CardUpdated, "DELETE": changes.CardDeleted},
+}
+
+// Watch listens to the notifications of the changes to the customers,
+// addresses and cards of the schema. Notifications sent while the
+// connection is down are lost, the listener reconnects on its own.
+func (p *Postgres) Watch(ctx context.Context, publish func(changes.Event)) error {
+	var schema string
+	if err := p.Database.DB.QueryRowContext(ctx, `SELECT current_schema()`).Scan(&schema); err != nil {
+		return err
+	}
+	// Without the io timeout, idle listeners would time out.
+	l := pq.NewDialListener(dialer{Dialer: net.Dialer{Timeout: dialTimeout}}, p.URL, time.Second, time.Minute, nil)
+	defer l.Close()
+	if err := l.Listen(notifyChannel); err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case n, ok := <-l.Notify:
+			if !ok {
+				return errors.New("listener closed")
+			}
+			// nil tells of a reconnection.
+			if n == nil {
+				continue
+			}
+			if e, ok := changeEvent(n.Extra, schema); ok {
+				publish(e)
+			}
+		}
+	}
+}
+
+// changeEvent returns the event of the notification payload of a change to
+// a table of schema, false for other schemas.
+func changeEvent(payload, schema string) (changes.Event, bool) {
+	var n struct {
+		Schema string `json:"schema"`
+		Table  string `json:"table"`
+		Op     string `json:"op"`
+		ID     string `json:"id"`
+		UserID string `json:"userId"`
+	}
+	if err := json.Unmarshal([]byte(payload), &n); err != nil || n.Schema != schema {
+		return changes.Event{}, false
+	}
+	t, ok := changeTypes[n.Table][n.Op]
+	if !ok {
+		return changes.Event{}, false
+	}
+	return changes.Event{Type: t, ResourceID: n.ID, UserID: n.UserID}, true
+}
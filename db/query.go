@@ -0,0 +1,76 @@
+package db
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"user/users"
+)
+
+var (
+	//ErrInvalidSort is returned when a listing is sorted by an unsupported field
+	ErrInvalidSort = errors.New("Invalid sort field")
+	//ErrEncryptedField is returned when filtering or sorting on a field stored with randomized encryption
+	ErrEncryptedField = errors.New("Can't query an encrypted field")
+)
+
+// SortFields are the user fields listings can be sorted by, all of them are
+// indexed.
+var SortFields = []string{"username", "email", "lastName", "createdAt", "updatedAt", "lastLoginAt"}
+
+// UserQuery filters and orders a user listing. Zero fields don't filter.
+type UserQuery struct {
+	Email        string
+	LastName     string
+	CreatedAfter time.Time
+	// CreatedBefore finds accounts old enough to expire.
+	CreatedBefore time.Time
+	// UpdatedAfter supports incremental syncs.
+	UpdatedAfter time.Time
+	// Status filters by lifecycle state. Deleted users are left out unless
+	// asked for.
+	Status string
+	// Tag only matches users carrying the tag.
+	Tag string
+	// Role only matches users holding the role.
+	Role string
+	// Metadata only matches users carrying all of these entries.
+	Metadata map[string]string
+	// Sort names one of SortFields, prefixed with - for descending order.
+	Sort string
+	// Fields limits the loaded fields to these users.Fields, all when empty.
+	Fields []string
+	// Limit caps the number of users returned, all when zero.
+	Limit int
+}
+
+// SortField returns the field to sort by and whether the order is descending.
+func (q UserQuery) SortField() (string, bool) {
+	return strings.TrimPrefix(q.Sort, "-"), strings.HasPrefix(q.Sort, "-")
+}
+
+// Validate checks the query can be run.
+func (q UserQuery) Validate() error {
+	if q.Status != "" && !users.ValidStatus(q.Status) {
+		return users.ErrInvalidStatus
+	}
+	if err := users.ValidateFields(q.Fields); err != nil {
+		return err
+	}
+	for k := range q.Metadata {
+		if err := users.ValidateMetadataKey(k); err != nil {
+			return err
+		}
+	}
+	if q.Sort == "" {
+		return nil
+	}
+	f, _ := q.SortField()
+	for _, s := range SortFields {
+		if f == s {
+			return nil
+		}
+	}
+	return ErrInvalidSort
+}
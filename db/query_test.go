@@ -0,0 +1,16 @@
+package db
+
+import "testing"
+
+func TestUserQueryValidate(t *testing.T) {
+	if err := (UserQuery{Sort: "-lastName"}).Validate(); err != nil {
+		t.Error(err)
+	}
+	if err := (UserQuery{Sort: "password"}).Validate(); err != ErrInvalidSort {
+		t.Error("expected invalid sort error")
+	}
+	f, desc := UserQuery{Sort: "-createdAt"}.SortField()
+	if f != "createdAt" || !desc {
+		t.Error("expected descending createdAt")
+	}
+}
@@ -0,0 +1,59 @@
+package db
+
+import (
+	"context"
+	"fmt"
+)
+
+// ReadPreference is which members of a replicated database a read may be
+// served by. Writes always go to the primary.
+type ReadPreference int
+
+const (
+	// Primary reads what was last written.
+	Primary ReadPreference = iota
+	// SecondaryPreferred reads from a replica, or the primary when none is
+	// available.
+	SecondaryPreferred
+	// Secondary only reads from a replica.
+	Secondary
+	// Nearest reads from the member with the lowest latency.
+	Nearest
+)
+
+var readPreferences = map[ReadPreference]string{
+	Primary:            "primary",
+	SecondaryPreferred: "secondaryPreferred",
+	Secondary:          "secondary",
+	Nearest:            "nearest",
+}
+
+func (p ReadPreference) String() string {
+	return readPreferences[p]
+}
+
+// ParseReadPreference parses primary, secondaryPreferred, secondary or
+// nearest.
+func ParseReadPreference(s string) (ReadPreference, error) {
+	for p, name := range readPreferences {
+		if s == name {
+			return p, nil
+		}
+	}
+	return Primary, fmt.Errorf("unknown read preference %q", s)
+}
+
+type readPreferenceKey struct{}
+
+// WithReadPreference returns ctx having the reads made with it served
+// according to p. Backends without replicas ignore it.
+func WithReadPreference(ctx context.Context, p ReadPreference) context.Context {
+	return context.WithValue(ctx, readPreferenceKey{}, p)
+}
+
+// ReadPreferenceFrom returns the read preference of ctx, Primary when it
+// has none.
+func ReadPreferenceFrom(ctx context.Context) ReadPreference {
+	p, _ := ctx.Value(readPreferenceKey{}).(ReadPreference)
+	return p
+}
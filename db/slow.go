@@ -0,0 +1,98 @@
+package db
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// DefaultQueryTimeout is how long a query may take.
+	DefaultQueryTimeout = 5 * time.Second
+	// DefaultSlowQuery is how long a query takes before it is logged.
+	DefaultSlowQuery = 250 * time.Millisecond
+)
+
+// SlowQueries counts the queries taking longer than the slow query
+// threshold, by Store method.
+var SlowQueries = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "db_slow_queries_total",
+	Help: "Queries taking longer than the slow query threshold, by store method.",
+}, []string{"query"})
+
+// WithQueryTimeout ends the queries still running after d with
+// context.DeadlineExceeded, 0 lets them run as long as their context.
+func WithQueryTimeout(d time.Duration) StoreOption {
+	return func(s *Store) {
+		s.timeout = d
+	}
+}
+
+// WithSlowQueries logs the queries taking longer than threshold to logger,
+// with what they filter on. Personal data, like emails and names, is left
+// out, so they only say which fields were matched.
+func WithSlowQueries(threshold time.Duration, logger log.Logger) StoreOption {
+	return func(s *Store) {
+		s.slow, s.logger = threshold, logger
+	}
+}
+
+// query starts a query of the Store method name, bounding ctx by the query
+// timeout. The returned func ends it, logging it when slow. filter holds
+// key value pairs of what the query matches, without personal data.
+func (s *Store) query(ctx context.Context, name string, filter ...interface{}) (context.Context, func()) {
+	cancel := func() {}
+	if s.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+	}
+	start := time.Now()
+	return ctx, func() {
+		cancel()
+		took := time.Since(start)
+		if s.logger == nil || took < s.slow {
+			return
+		}
+		SlowQueries.WithLabelValues(name).Inc()
+		s.logger.Log(append([]interface{}{"query", name, "took", took}, filter...)...)
+	}
+}
+
+// filter returns what q matches as key value pairs, the values of the
+// fields holding personal data replaced by a ?.
+func (q UserQuery) filter() []interface{} {
+	var kv []interface{}
+	if q.Email != "" {
+		kv = append(kv, "email", "?")
+	}
+	if q.LastName != "" {
+		kv = append(kv, "lastName", "?")
+	}
+	for _, t := range []struct {
+		key string
+		at  time.Time
+	}{{"createdAfter", q.CreatedAfter}, {"createdBefore", q.CreatedBefore}, {"updatedAfter", q.UpdatedAfter}} {
+		if !t.at.IsZero() {
+			kv = append(kv, t.key, t.at)
+		}
+	}
+	for _, f := range []struct{ key, value string }{{"status", q.Status}, {"tag", q.Tag}, {"role", q.Role}, {"sort", q.Sort}} {
+		if f.value != "" {
+			kv = append(kv, f.key, f.value)
+		}
+	}
+	if len(q.Metadata) > 0 {
+		keys := make([]string, 0, len(q.Metadata))
+		for k := range q.Metadata {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		kv = append(kv, "metadata", keys)
+	}
+	if q.Limit > 0 {
+		kv = append(kv, "limit", q.Limit)
+	}
+	return kv
+}
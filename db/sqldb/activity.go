@@ -0,0 +1,55 @@
+package sqldb
+
+import (
+	"context"
+
+	"user/db"
+	"user/users"
+)
+
+// AddActivity appends a to the activity feed of its user
+func (d *Database) AddActivity(ctx context.Context, a *users.Activity) error {
+	stored := *a
+	stored.ID = db.NewID()
+	stored.Time = now()
+	details, err := toJSON(stored.Details)
+	if err != nil {
+		return err
+	}
+	_, err = d.conn(ctx).exec(`INSERT INTO activity (id, user_id, type, at, details) VALUES (?, ?, ?, ?, ?)`,
+		stored.ID, stored.UserID, stored.Type, stored.Time, details)
+	if err != nil {
+		return err
+	}
+	*a = stored
+	return nil
+}
+
+// GetActivity returns up to limit entries of the activity feed of the user
+// older than the entry before, newest first
+func (d *Database) GetActivity(ctx context.Context, userID, before string, n int) ([]users.Activity, error) {
+	query := `SELECT id, user_id, type, at, details FROM activity WHERE user_id = ?`
+	args := []interface{}{userID}
+	if before != "" {
+		query += ` AND id < ?`
+		args = append(args, before)
+	}
+	rows, err := d.read(ctx).query(query+` ORDER BY id DESC`+limit(n), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	as := make([]users.Activity, 0)
+	for rows.Next() {
+		var a users.Activity
+		var details []byte
+		if err := rows.Scan(&a.ID, &a.UserID, &a.Type, &a.Time, &details); err != nil {
+			return nil, err
+		}
+		if err := fromJSON(details, &a.Details); err != nil {
+			return nil, err
+		}
+		as = append(as, a)
+	}
+	return as, rows.Err()
+}
@@ -0,0 +1,478 @@
+package sqldb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"user/db"
+	"user/users"
+)
+
+// addressColumns are the columns of addresses scanned by scanAddress.
+const addressColumns = `id, street, street_number, building, country, state, prefecture, city, post_code,
+	type, is_default, validated, lat, lng, geocode, created_at, updated_at`
+
+func scanAddress(s scanner) (users.Address, error) {
+	var a users.Address
+	var lat, lng sql.NullFloat64
+	err := s.Scan(&a.ID, &a.Street, &a.Number, &a.Building, &a.Country, &a.State, &a.Prefecture, &a.City, &a.PostCode,
+		&a.Type, &a.Default, &a.Validated, &lat, &lng, &a.Geocode, &a.CreatedAt, &a.UpdatedAt)
+	if lat.Valid && lng.Valid {
+		a.Location = &users.Location{Lat: lat.Float64, Lng: lng.Float64}
+	}
+	return a, err
+}
+
+func (c conn) queryAddresses(query string, args ...interface{}) ([]users.Address, error) {
+	rows, err := c.query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	as := make([]users.Address, 0)
+	for rows.Next() {
+		a, err := scanAddress(rows)
+		if err != nil {
+			return nil, err
+		}
+		as = append(as, a)
+	}
+	return as, rows.Err()
+}
+
+// cardColumns are the columns of cards scanned by scanCard.
+const cardColumns = `id, long_num, expires, holder, brand, token, vault, reminded_for, verification,
+	replaces, replaced_by, deleted_at, created_at, updated_at`
+
+func scanCard(s scanner) (users.Card, error) {
+	var ca users.Card
+	err := s.Scan(&ca.ID, &ca.LongNum, &ca.Expires, &ca.Holder, &ca.Brand, &ca.Token, &ca.Vault, &ca.RemindedFor, &ca.Verification,
+		&ca.Replaces, &ca.ReplacedBy, &ca.DeletedAt, &ca.CreatedAt, &ca.UpdatedAt)
+	return ca, err
+}
+
+func (c conn) queryCards(query string, args ...interface{}) ([]users.Card, error) {
+	rows, err := c.query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	cs := make([]users.Card, 0)
+	for rows.Next() {
+		ca, err := scanCard(rows)
+		if err != nil {
+			return nil, err
+		}
+		cs = append(cs, ca)
+	}
+	return cs, rows.Err()
+}
+
+// owner returns the customer_id of a new address or card, NULL for
+// anonymous users.
+func owner(userid string) interface{} {
+	if userid == "" {
+		return nil
+	}
+	return userid
+}
+
+// insertAddress inserts a with a new id, its timestamps are set by the
+// caller.
+func (c conn) insertAddress(a *users.Address, userid string) error {
+	a.ID = db.NewID()
+	var lat, lng interface{}
+	if a.Location != nil {
+		lat, lng = a.Location.Lat, a.Location.Lng
+	}
+	_, err := c.exec(`INSERT INTO addresses (id, customer_id, street, street_number, building, country, state, prefecture, city, post_code,
+		type, is_default, validated, lat, lng, geocode, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		a.ID, owner(userid), a.Street, a.Number, a.Building, a.Country, a.State, a.Prefecture, a.City, a.PostCode,
+		a.Type, a.Default, a.Validated, lat, lng, a.Geocode, a.CreatedAt, a.UpdatedAt)
+	return err
+}
+
+// insertCard inserts ca with a new id, its timestamps are set by the
+// caller.
+func (c conn) insertCard(ca *users.Card, userid string) error {
+	ca.ID = db.NewID()
+	_, err := c.exec(`INSERT INTO cards (id, customer_id, long_num, expires, holder, brand, token, vault, reminded_for, verification,
+		replaces, replaced_by, deleted_at, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		ca.ID, owner(userid), ca.LongNum, ca.Expires, ca.Holder, ca.Brand, ca.Token, ca.Vault, ca.RemindedFor, ca.Verification,
+		ca.Replaces, ca.ReplacedBy, ca.DeletedAt, ca.CreatedAt, ca.UpdatedAt)
+	return err
+}
+
+// clearDefaultAddress takes the default flag off the other addresses of the
+// user with the given type.
+func (c conn) clearDefaultAddress(userid, keep, typ string) error {
+	_, err := c.exec(`UPDATE addresses SET is_default = ?, updated_at = ?
+		WHERE customer_id = ? AND id <> ? AND type = ? AND is_default = ?`, false, now(), userid, keep, typ, true)
+	return err
+}
+
+// GetUserAttributes given a user, load all cards and addresses connected to that user
+func (d *Database) GetUserAttributes(ctx context.Context, u *users.User) error {
+	us := []users.User{*u}
+	if err := d.ExpandUsers(ctx, us, db.Expandable); err != nil {
+		return err
+	}
+	*u = us[0]
+	return nil
+}
+
+// ExpandUsers loads the named attributes, addresses or cards, of all the
+// users with one query per table instead of one per user
+func (d *Database) ExpandUsers(ctx context.Context, us []users.User, attrs []string) error {
+	c := d.read(ctx)
+	for _, attr := range attrs {
+		var ids []string
+		for _, u := range us {
+			switch attr {
+			case "addresses":
+				for _, a := range u.Addresses {
+					ids = append(ids, a.ID)
+				}
+			case "cards":
+				for _, ca := range u.Cards {
+					ids = append(ids, ca.ID)
+				}
+			default:
+				return fmt.Errorf("no attribute %v", attr)
+			}
+		}
+		if attr == "addresses" {
+			as, err := c.addressesByID(ids)
+			if err != nil {
+				return err
+			}
+			byID := make(map[string]users.Address, len(as))
+			for _, a := range as {
+				byID[a.ID] = a
+			}
+			for k := range us {
+				as := make([]users.Address, 0, len(us[k].Addresses))
+				for _, a := range us[k].Addresses {
+					if a, ok := byID[a.ID]; ok {
+						as = append(as, a)
+					}
+				}
+				us[k].Addresses = as
+			}
+			continue
+		}
+		cs, err := c.cardsByID(ids, true)
+		if err != nil {
+			return err
+		}
+		byID := make(map[string]users.Card, len(cs))
+		for _, ca := range cs {
+			byID[ca.ID] = ca
+		}
+		for k := range us {
+			cs := make([]users.Card, 0, len(us[k].Cards))
+			for _, ca := range us[k].Cards {
+				if ca, ok := byID[ca.ID]; ok {
+					cs = append(cs, ca)
+				}
+			}
+			us[k].Cards = cs
+		}
+	}
+	return nil
+}
+
+func (c conn) addressesByID(ids []string) ([]users.Address, error) {
+	if len(ids) == 0 {
+		return make([]users.Address, 0), nil
+	}
+	list, args := in(ids)
+	return c.queryAddresses(`SELECT `+addressColumns+` FROM addresses WHERE id IN (`+list+`)`, args...)
+}
+
+// cardsByID loads the cards with ids, without the deleted ones unless
+// deleted is set.
+func (c conn) cardsByID(ids []string, deleted bool) ([]users.Card, error) {
+	if len(ids) == 0 {
+		return make([]users.Card, 0), nil
+	}
+	list, args := in(ids)
+	query := `SELECT ` + cardColumns + ` FROM cards WHERE id IN (` + list + `)`
+	if !deleted {
+		query += ` AND deleted_at IS NULL`
+	}
+	return c.queryCards(query, args...)
+}
+
+// GetCard Gets card by id
+func (d *Database) GetCard(ctx context.Context, id string) (users.Card, error) {
+	return scanCard(d.read(ctx).queryRow(`SELECT `+cardColumns+` FROM cards WHERE id = ?`, id))
+}
+
+// GetCards Gets all cards
+func (d *Database) GetCards(ctx context.Context) ([]users.Card, error) {
+	return d.read(ctx).queryCards(`SELECT ` + cardColumns + ` FROM cards WHERE deleted_at IS NULL ORDER BY id`)
+}
+
+// GetCardsByID gets the cards with the given ids in a single query, unknown
+// ids and deleted cards are left out
+func (d *Database) GetCardsByID(ctx context.Context, ids []string) ([]users.Card, error) {
+	return d.read(ctx).cardsByID(ids, false)
+}
+
+// ListCards returns up to limit cards after the given id in id order, with
+// the customers owning them. Deleted cards are left out.
+func (d *Database) ListCards(ctx context.Context, after string, n int) ([]db.OwnedCard, error) {
+	rows, err := d.read(ctx).query(`SELECT `+cardColumns+`, customer_id FROM cards
+		WHERE deleted_at IS NULL AND id > ? ORDER BY id`+limit(n), after)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	cs := make([]db.OwnedCard, 0)
+	for rows.Next() {
+		var ca users.Card
+		var userID sql.NullString
+		err := rows.Scan(&ca.ID, &ca.LongNum, &ca.Expires, &ca.Holder, &ca.Brand, &ca.Token, &ca.Vault, &ca.RemindedFor, &ca.Verification,
+			&ca.Replaces, &ca.ReplacedBy, &ca.DeletedAt, &ca.CreatedAt, &ca.UpdatedAt, &userID)
+		if err != nil {
+			return nil, err
+		}
+		cs = append(cs, db.OwnedCard{Card: ca, UserID: userID.String})
+	}
+	return cs, rows.Err()
+}
+
+// CreateCard inserts the card, owned by userid unless it is empty
+func (d *Database) CreateCard(ctx context.Context, ca *users.Card, userid string) error {
+	stored := *ca
+	stored.CreatedAt = now()
+	stored.UpdatedAt = stored.CreatedAt
+	err := d.tx(ctx, func(c conn) error {
+		if err := c.exists("customers", userid); err != nil {
+			return err
+		}
+		return c.insertCard(&stored, userid)
+	})
+	if err != nil {
+		return err
+	}
+	*ca = stored
+	return nil
+}
+
+// exists fails with sql.ErrNoRows unless the table has a row with id, empty
+// ids of anonymous owners exist.
+func (c conn) exists(table, id string) error {
+	if id == "" {
+		return nil
+	}
+	var n int
+	if err := c.queryRow(`SELECT COUNT(*) FROM `+table+` WHERE id = ?`, id).Scan(&n); err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// UpdateCard sets the expiry and holder of the card, the number is never
+// changed
+func (d *Database) UpdateCard(ctx context.Context, id string, u users.CardUpdate) error {
+	set := "updated_at = ?"
+	args := []interface{}{now()}
+	if u.Expires != nil {
+		set += ", expires = ?"
+		args = append(args, *u.Expires)
+	}
+	if u.Holder != nil {
+		set += ", holder = ?"
+		args = append(args, *u.Holder)
+	}
+	return d.conn(ctx).update(`UPDATE cards SET `+set+` WHERE id = ?`, append(args, id)...)
+}
+
+// SetDefaultCard makes the card the default of the user, failing with
+// sql.ErrNoRows unless the card is one of theirs
+func (d *Database) SetDefaultCard(ctx context.Context, userID, cardID string) error {
+	return d.conn(ctx).update(`UPDATE customers SET default_card = ?, updated_at = ?
+		WHERE id = ? AND EXISTS (SELECT 1 FROM cards WHERE id = ? AND customer_id = ?)`,
+		cardID, now(), userID, cardID, userID)
+}
+
+// SetCardVerification stores the outcome of verifying a pending card.
+// Cards no longer pending are left alone.
+func (d *Database) SetCardVerification(ctx context.Context, id, status string) error {
+	_, err := d.conn(ctx).exec(`UPDATE cards SET verification = ?, updated_at = ? WHERE id = ? AND verification = ?`,
+		status, now(), id, users.VerificationPending)
+	return err
+}
+
+// SetCardReminded records that the owner of the card was reminded of the
+// expiry
+func (d *Database) SetCardReminded(ctx context.Context, id, expires string) error {
+	return d.conn(ctx).update(`UPDATE cards SET reminded_for = ? WHERE id = ?`, expires, id)
+}
+
+// TombstoneCard keeps only the masked number of the card, drops its token
+// and takes it off its owner. Cards already deleted fail with
+// sql.ErrNoRows
+func (d *Database) TombstoneCard(ctx context.Context, id, masked, replacedBy string) error {
+	return d.tx(ctx, func(c conn) error {
+		at := now()
+		set := "long_num = ?, deleted_at = ?, updated_at = ?, token = '', customer_id = NULL"
+		args := []interface{}{masked, at, at}
+		if replacedBy != "" {
+			set += ", replaced_by = ?"
+			args = append(args, replacedBy)
+		}
+		if err := c.update(`UPDATE cards SET `+set+` WHERE id = ? AND deleted_at IS NULL`, append(args, id)...); err != nil {
+			return err
+		}
+		_, err := c.exec(`UPDATE customers SET default_card = '' WHERE default_card = ?`, id)
+		return err
+	})
+}
+
+// GetAddress Gets an address by id
+func (d *Database) GetAddress(ctx context.Context, id string) (users.Address, error) {
+	return scanAddress(d.read(ctx).queryRow(`SELECT `+addressColumns+` FROM addresses WHERE id = ?`, id))
+}
+
+// GetAddresses gets all addresses
+func (d *Database) GetAddresses(ctx context.Context) ([]users.Address, error) {
+	return d.read(ctx).queryAddresses(`SELECT ` + addressColumns + ` FROM addresses ORDER BY id`)
+}
+
+// GetAddressesByID gets the addresses with the given ids in a single query,
+// unknown ids are left out
+func (d *Database) GetAddressesByID(ctx context.Context, ids []string) ([]users.Address, error) {
+	return d.read(ctx).addressesByID(ids)
+}
+
+// CreateAddress inserts the address, owned by userid unless it is empty
+func (d *Database) CreateAddress(ctx context.Context, a *users.Address, userid string) error {
+	stored := *a
+	stored.CreatedAt = now()
+	stored.UpdatedAt = stored.CreatedAt
+	err := d.tx(ctx, func(c conn) error {
+		if err := c.exists("customers", userid); err != nil {
+			return err
+		}
+		if err := c.insertAddress(&stored, userid); err != nil {
+			return err
+		}
+		if userid != "" && stored.Default {
+			return c.clearDefaultAddress(userid, stored.ID, stored.Type)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	*a = stored
+	return nil
+}
+
+// CreateAddresses inserts the addresses in a single transaction and adds
+// them to the user, setting their ids.
+func (d *Database) CreateAddresses(ctx context.Context, as []users.Address, userid string) error {
+	stored := append([]users.Address(nil), as...)
+	err := d.tx(ctx, func(c conn) error {
+		if err := c.exists("customers", userid); err != nil {
+			return err
+		}
+		at := now()
+		for k := range stored {
+			stored[k].CreatedAt, stored[k].UpdatedAt = at, at
+			if err := c.insertAddress(&stored[k], userid); err != nil {
+				return err
+			}
+		}
+		for _, a := range stored {
+			if a.Default {
+				if err := c.clearDefaultAddress(userid, a.ID, a.Type); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	copy(as, stored)
+	return nil
+}
+
+// SetAddressLocation stores the outcome of geocoding a pending address.
+// Addresses no longer pending are left alone.
+func (d *Database) SetAddressLocation(ctx context.Context, id string, l *users.Location, status string) error {
+	set := "geocode = ?, updated_at = ?"
+	args := []interface{}{status, now()}
+	if l != nil {
+		set += ", lat = ?, lng = ?"
+		args = append(args, l.Lat, l.Lng)
+	}
+	_, err := d.conn(ctx).exec(`UPDATE addresses SET `+set+` WHERE id = ? AND geocode = ?`, append(args, id, users.GeocodePending)...)
+	return err
+}
+
+// UpdateAddress replaces the address with id, keeping when it was created.
+// A default address stops being the default of its type for its owner's
+// other addresses.
+func (d *Database) UpdateAddress(ctx context.Context, id string, a *users.Address) error {
+	stored := *a
+	stored.ID = id
+	stored.Links = nil
+	err := d.tx(ctx, func(c conn) error {
+		var userID sql.NullString
+		err := c.queryRow(`SELECT created_at, customer_id FROM addresses WHERE id = ?`+c.d.ForUpdate(), id).Scan(&stored.CreatedAt, &userID)
+		if err != nil {
+			return err
+		}
+		stored.UpdatedAt = now()
+		var lat, lng interface{}
+		if stored.Location != nil {
+			lat, lng = stored.Location.Lat, stored.Location.Lng
+		}
+		_, err = c.exec(`UPDATE addresses SET street = ?, street_number = ?, building = ?, country = ?, state = ?, prefecture = ?,
+			city = ?, post_code = ?, type = ?, is_default = ?, validated = ?, lat = ?, lng = ?, geocode = ?, updated_at = ?
+			WHERE id = ?`,
+			stored.Street, stored.Number, stored.Building, stored.Country, stored.State, stored.Prefecture,
+			stored.City, stored.PostCode, stored.Type, stored.Default, stored.Validated, lat, lng, stored.Geocode, stored.UpdatedAt,
+			id)
+		if err != nil {
+			return err
+		}
+		// Addresses of anonymous users have no owner.
+		if stored.Default && userID.Valid {
+			return c.clearDefaultAddress(userID.String, id, stored.Type)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	*a = stored
+	return nil
+}
+
+// OwnerOf returns the id of the user owning the address or card id
+func (d *Database) OwnerOf(ctx context.Context, entity, id string) (string, error) {
+	if entity != "addresses" && entity != "cards" {
+		return "", fmt.Errorf("no owner of %v", entity)
+	}
+	var userID sql.NullString
+	if err := d.read(ctx).queryRow(`SELECT customer_id FROM `+entity+` WHERE id = ?`, id).Scan(&userID); err != nil {
+		return "", err
+	}
+	if !userID.Valid {
+		return "", sql.ErrNoRows
+	}
+	return userID.String, nil
+}
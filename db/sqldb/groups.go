@@ -0,0 +1,178 @@
+package sqldb
+
+import (
+	"context"
+	"database/sql"
+
+	"user/db"
+	"user/users"
+)
+
+// Roles of the rows of group_users.
+const (
+	groupOwner  = "owner"
+	groupMember = "member"
+)
+
+// CreateGroup inserts the group with its owners and members
+func (d *Database) CreateGroup(ctx context.Context, g *users.Group) error {
+	stored := *g
+	stored.ID = db.NewID()
+	stored.CreatedAt = now()
+	if stored.Owners == nil {
+		stored.Owners = make([]string, 0)
+	}
+	if stored.Members == nil {
+		stored.Members = make([]string, 0)
+	}
+	err := d.tx(ctx, func(c conn) error {
+		if _, err := c.exec(`INSERT INTO user_groups (id, name, created_at) VALUES (?, ?, ?)`, stored.ID, stored.Name, stored.CreatedAt); err != nil {
+			return err
+		}
+		for role, ids := range map[string][]string{groupOwner: stored.Owners, groupMember: stored.Members} {
+			for _, id := range ids {
+				if err := c.addGroupUser(stored.ID, id, role); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	*g = stored
+	return nil
+}
+
+// addGroupUser adds the user to the group in role, unless it has it.
+func (c conn) addGroupUser(groupID, userID, role string) error {
+	var n int
+	err := c.queryRow(`SELECT COUNT(*) FROM group_users WHERE group_id = ? AND user_id = ? AND role = ?`, groupID, userID, role).Scan(&n)
+	if err != nil || n > 0 {
+		return err
+	}
+	_, err = c.exec(`INSERT INTO group_users (group_id, user_id, role) VALUES (?, ?, ?)`, groupID, userID, role)
+	return err
+}
+
+// moveGroupUser gives target the roles of source in every group, and takes
+// them from source.
+func (c conn) moveGroupUser(source, target string) error {
+	rows, err := c.query(`SELECT group_id, role FROM group_users WHERE user_id = ?`, source)
+	if err != nil {
+		return err
+	}
+	var roles [][2]string
+	for rows.Next() {
+		var r [2]string
+		if err := rows.Scan(&r[0], &r[1]); err != nil {
+			rows.Close()
+			return err
+		}
+		roles = append(roles, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, r := range roles {
+		if err := c.addGroupUser(r[0], target, r[1]); err != nil {
+			return err
+		}
+	}
+	_, err = c.exec(`DELETE FROM group_users WHERE user_id = ?`, source)
+	return err
+}
+
+// GetGroup gets a group by id
+func (d *Database) GetGroup(ctx context.Context, id string) (users.Group, error) {
+	gs, err := d.read(ctx).queryGroups(`SELECT id, name, created_at FROM user_groups WHERE id = ?`, id)
+	if err != nil {
+		return users.Group{}, err
+	}
+	if len(gs) == 0 {
+		return users.Group{}, sql.ErrNoRows
+	}
+	return gs[0], nil
+}
+
+// GetUserGroups gets the groups the user owns or is a member of
+func (d *Database) GetUserGroups(ctx context.Context, userID string) ([]users.Group, error) {
+	return d.read(ctx).queryGroups(`SELECT id, name, created_at FROM user_groups
+		WHERE id IN (SELECT group_id FROM group_users WHERE user_id = ?) ORDER BY id`, userID)
+}
+
+// queryGroups runs a select of groups and loads their owners and members.
+func (c conn) queryGroups(query string, args ...interface{}) ([]users.Group, error) {
+	rows, err := c.query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	gs := make([]users.Group, 0)
+	for rows.Next() {
+		g := users.Group{Owners: make([]string, 0), Members: make([]string, 0)}
+		if err := rows.Scan(&g.ID, &g.Name, &g.CreatedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		gs = append(gs, g)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || len(gs) == 0 {
+		return gs, err
+	}
+	byID := make(map[string]*users.Group, len(gs))
+	ids := make([]string, len(gs))
+	for k := range gs {
+		byID[gs[k].ID] = &gs[k]
+		ids[k] = gs[k].ID
+	}
+	list, args := in(ids)
+	rows, err = c.query(`SELECT group_id, user_id, role FROM group_users WHERE group_id IN (`+list+`) ORDER BY user_id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var groupID, userID, role string
+		if err := rows.Scan(&groupID, &userID, &role); err != nil {
+			return nil, err
+		}
+		g := byID[groupID]
+		if role == groupOwner {
+			g.Owners = append(g.Owners, userID)
+		} else {
+			g.Members = append(g.Members, userID)
+		}
+	}
+	return gs, rows.Err()
+}
+
+// AddGroupMember adds the user to the group members
+func (d *Database) AddGroupMember(ctx context.Context, groupID, userID string) error {
+	return d.tx(ctx, func(c conn) error {
+		if err := c.lockGroup(groupID); err != nil {
+			return err
+		}
+		return c.addGroupUser(groupID, userID, groupMember)
+	})
+}
+
+// RemoveGroupMember removes the user from the group members
+func (d *Database) RemoveGroupMember(ctx context.Context, groupID, userID string) error {
+	return d.tx(ctx, func(c conn) error {
+		if err := c.lockGroup(groupID); err != nil {
+			return err
+		}
+		_, err := c.exec(`DELETE FROM group_users WHERE group_id = ? AND user_id = ? AND role = ?`, groupID, userID, groupMember)
+		return err
+	})
+}
+
+// lockGroup locks the group for the rest of the transaction, failing with
+// sql.ErrNoRows for unknown groups.
+func (c conn) lockGroup(id string) error {
+	var found string
+	return c.queryRow(`SELECT id FROM user_groups WHERE id = ?`+c.d.ForUpdate(), id).Scan(&found)
+}
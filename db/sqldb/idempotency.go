@@ -0,0 +1,40 @@
+package sqldb
+
+import "context"
+import "user/db"
+
+// CreateIdempotencyKey inserts the key, failing with db.ErrConflict if it
+// is already in use. Expired keys are removed first.
+func (d *Database) CreateIdempotencyKey(ctx context.Context, k *db.IdempotencyKey) error {
+	k.CreatedAt = now()
+	c := d.conn(ctx)
+	if _, err := c.exec(`DELETE FROM idempotency_keys WHERE created_at < ?`, k.CreatedAt.Add(-db.IdempotencyKeyTTL)); err != nil {
+		return err
+	}
+	_, err := c.exec(`INSERT INTO idempotency_keys (idempotency_key, fingerprint, result_id, created_at) VALUES (?, ?, ?, ?)`,
+		k.Key, k.Fingerprint, k.ResultID, k.CreatedAt)
+	if _, dup := d.Dialect.UniqueViolation(err); dup {
+		return db.ErrConflict
+	}
+	return err
+}
+
+// GetIdempotencyKey gets the key unless it expired
+func (d *Database) GetIdempotencyKey(ctx context.Context, key string) (db.IdempotencyKey, error) {
+	var k db.IdempotencyKey
+	err := d.conn(ctx).queryRow(`SELECT idempotency_key, fingerprint, result_id, created_at FROM idempotency_keys
+		WHERE idempotency_key = ? AND created_at >= ?`, key, now().Add(-db.IdempotencyKeyTTL)).
+		Scan(&k.Key, &k.Fingerprint, &k.ResultID, &k.CreatedAt)
+	return k, err
+}
+
+// SetIdempotencyResult records the id of the resource created under key
+func (d *Database) SetIdempotencyResult(ctx context.Context, key, resultID string) error {
+	return d.conn(ctx).update(`UPDATE idempotency_keys SET result_id = ? WHERE idempotency_key = ?`, resultID, key)
+}
+
+// DeleteIdempotencyKey removes the key, so it can be used again
+func (d *Database) DeleteIdempotencyKey(ctx context.Context, key string) error {
+	_, err := d.conn(ctx).exec(`DELETE FROM idempotency_keys WHERE idempotency_key = ?`, key)
+	return err
+}
@@ -0,0 +1,140 @@
+package sqldb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+
+	"user/db"
+)
+
+// Migration is a numbered step of a schema. Backends never edit released
+// migrations, changes are new ones with a higher Version.
+type Migration struct {
+	Version int
+	Name    string
+	// Statements are run in order, in a transaction where the backend
+	// supports transactional DDL.
+	Statements []string
+	// Func, when set, runs after the Statements in the same transaction,
+	// for changes of the data SQL can't express, like rewriting encrypted
+	// or hashed fields.
+	Func func(ctx context.Context, tx *sql.Tx) error
+}
+
+// migrationsTable records the applied migrations.
+const migrationsTable = `CREATE TABLE IF NOT EXISTS schema_migrations (
+	version INTEGER PRIMARY KEY,
+	name VARCHAR(255) NOT NULL,
+	applied_at TIMESTAMP NOT NULL
+)`
+
+// Migrate applies the migrations not recorded in schema_migrations, in
+// Version order. Of replicas starting together, those losing the race to
+// apply a migration fail and are restarted.
+func Migrate(ctx context.Context, sqlDB *sql.DB, d Dialect, ms []Migration) error {
+	status, err := Status(ctx, sqlDB, d, ms)
+	if err != nil {
+		return err
+	}
+	ordered := sorted(ms)
+	for k, st := range status {
+		if st.AppliedAt != nil {
+			continue
+		}
+		m := ordered[k]
+		if err := apply(ctx, sqlDB, d, m); err != nil {
+			return &db.MigrationError{Version: m.Version, Name: m.Name, Err: err}
+		}
+	}
+	return nil
+}
+
+// Status returns the migrations in Version order with when they were
+// applied.
+func Status(ctx context.Context, sqlDB *sql.DB, d Dialect, ms []Migration) ([]db.MigrationStatus, error) {
+	if err := Validate(ms); err != nil {
+		return nil, err
+	}
+	if _, err := sqlDB.ExecContext(ctx, migrationsTable); err != nil {
+		return nil, err
+	}
+	c := conn{ctx: ctx, q: sqlDB, d: d}
+	rows, err := c.query(`SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	applied := map[int]time.Time{}
+	for rows.Next() {
+		var v int
+		var at time.Time
+		if err := rows.Scan(&v, &at); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		applied[v] = at
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	var status []db.MigrationStatus
+	for _, m := range sorted(ms) {
+		st := db.MigrationStatus{Version: m.Version, Name: m.Name}
+		if at, ok := applied[m.Version]; ok {
+			st.AppliedAt = &at
+		}
+		status = append(status, st)
+	}
+	return status, nil
+}
+
+func sorted(ms []Migration) []Migration {
+	sorted := append([]Migration(nil), ms...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Version < sorted[j].Version })
+	return sorted
+}
+
+func apply(ctx context.Context, sqlDB *sql.DB, d Dialect, m Migration) error {
+	tx, err := sqlDB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	for _, s := range m.Statements {
+		if _, err := tx.ExecContext(ctx, s); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if m.Func != nil {
+		if err := m.Func(ctx, tx); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	// Recorded last, so a migration failing halfway is run again. Backends
+	// without transactional DDL write statements that can run twice.
+	c := conn{ctx: ctx, q: tx, d: d}
+	if _, err := c.exec(`INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)`, m.Version, m.Name, now()); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Validate checks the versions of ms are positive and unique.
+func Validate(ms []Migration) error {
+	seen := map[int]bool{}
+	for _, m := range ms {
+		if m.Version <= 0 {
+			return fmt.Errorf("migration %v: version must be positive", m.Name)
+		}
+		if seen[m.Version] {
+			return fmt.Errorf("migration %v: version %v used twice", m.Name, m.Version)
+		}
+		seen[m.Version] = true
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package sqldb
+
+// outbox.go relays the changes the triggers of the outbox migrations
+// record in the transaction of each write.
+
+import (
+	"context"
+	"time"
+
+	"user/changes"
+)
+
+// outboxBatch is how many changes are relayed per transaction.
+const outboxBatch = 100
+
+// outboxPoll is how long RelayOutbox waits once it emptied the outbox.
+var outboxPoll = time.Second
+
+// RelayOutbox publishes the changes of the outbox in order, keyed by their
+// sequence number, and removes them in the transaction that read them.
+// Changes published before a removal failed are published again.
+func (d *Database) RelayOutbox(ctx context.Context, publish func(changes.Event)) error {
+	for {
+		n, err := d.relayOutbox(ctx, publish)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if n == outboxBatch {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(outboxPoll):
+		}
+	}
+}
+
+// relayOutbox relays a batch of changes and returns how many it relayed.
+// The rows stay locked until removed, so other instances relaying wait
+// for them rather than publish them too.
+func (d *Database) relayOutbox(ctx context.Context, publish func(changes.Event)) (int, error) {
+	var n int
+	err := d.tx(ctx, func(c conn) error {
+		rows, err := c.query(`SELECT seq, type, resource_id, user_id FROM outbox ORDER BY seq` + limit(outboxBatch) + c.d.ForUpdate())
+		if err != nil {
+			return err
+		}
+		var events []changes.Event
+		for rows.Next() {
+			var e changes.Event
+			if err := rows.Scan(&e.Key, &e.Type, &e.ResourceID, &e.UserID); err != nil {
+				rows.Close()
+				return err
+			}
+			events = append(events, e)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil || len(events) == 0 {
+			return err
+		}
+		// Changes committed out of order may have been skipped, so only
+		// those read are removed.
+		keys := make([]string, len(events))
+		for k, e := range events {
+			publish(e)
+			keys[k] = e.Key
+		}
+		list, args := in(keys)
+		if _, err := c.exec(`DELETE FROM outbox WHERE seq IN (`+list+`)`, args...); err != nil {
+			return err
+		}
+		n = len(events)
+		return nil
+	})
+	return n, err
+}
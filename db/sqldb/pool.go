@@ -0,0 +1,27 @@
+package sqldb
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Pool configures the connection pool of a backend.
+type Pool struct {
+	// MaxOpen limits the open connections, 0 for no limit.
+	MaxOpen int
+	// MaxIdle is how many idle connections are kept for reuse.
+	MaxIdle int
+	// MaxLifetime closes connections older than it, before the server or a
+	// proxy in between drops them. 0 keeps them.
+	MaxLifetime time.Duration
+	// MaxIdleTime closes connections idle for longer, 0 keeps them.
+	MaxIdleTime time.Duration
+}
+
+// Apply configures the pool of d.
+func (p Pool) Apply(d *sql.DB) {
+	d.SetMaxOpenConns(p.MaxOpen)
+	d.SetMaxIdleConns(p.MaxIdle)
+	d.SetConnMaxLifetime(p.MaxLifetime)
+	d.SetConnMaxIdleTime(p.MaxIdleTime)
+}
@@ -0,0 +1,319 @@
+// Package sqldb implements the Database of the service on database/sql. The
+// SQL is shared by the relational backends, a Dialect covers where they
+// differ and each backend brings its own schema as Migrations.
+//
+// Users are rows of customers, their addresses and cards link back to them
+// with a customer_id column. Tags and earlier usernames are rows of their
+// own, nested documents such as preferences and metadata are JSON columns.
+package sqldb
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"user/db"
+)
+
+// Dialect covers the SQL a backend doesn't share with the others.
+type Dialect interface {
+	// Placeholder returns the placeholder of the nth argument, from 1.
+	Placeholder(n int) string
+	// UniqueViolation returns the name of the unique constraint or index
+	// err violated, false for other errors.
+	UniqueViolation(err error) (string, bool)
+	// JSONField returns an expression of the text of key in the JSON
+	// object column, and the argument of its placeholder.
+	JSONField(column, key string) (string, interface{})
+	// JSONContains returns a condition of the JSON array column holding
+	// the text of its placeholder.
+	JSONContains(column string) string
+	// Day returns an expression of the YYYY-MM-DD date of the timestamp
+	// column in UTC.
+	Day(column string) string
+	// ForUpdate is appended to selects of rows a transaction updates next,
+	// empty for backends locking the whole database.
+	ForUpdate() string
+}
+
+// Database meets the db.Database interface on a database/sql connection
+// pool. Backends open DB and set the Dialect and Migrations before Init.
+type Database struct {
+	DB         *sql.DB
+	Dialect    Dialect
+	Migrations []Migration
+	// Replica, when set, is the pool of a read replica. Reads with a
+	// db.ReadPreference other than db.Primary are served by it.
+	Replica *sql.DB
+
+	// migrated is set once the migrations are known to be applied.
+	migrated atomic.Bool
+	// failed is the error the last migration failed with.
+	failed atomic.Pointer[db.MigrationError]
+}
+
+// Init applies the pending migrations when db.AutoMigrate is set. A
+// migration failing to apply is left to MigrationFailure to report.
+func (d *Database) Init() error {
+	if err := Validate(d.Migrations); err != nil {
+		return err
+	}
+	if !db.AutoMigrate {
+		return nil
+	}
+	if err := d.Migrate(context.Background()); err != nil && !errors.As(err, new(*db.MigrationError)) {
+		return err
+	}
+	return nil
+}
+
+// Migrate applies the pending migrations.
+func (d *Database) Migrate(ctx context.Context) error {
+	err := Migrate(ctx, d.DB, d.Dialect, d.Migrations)
+	var failed *db.MigrationError
+	if errors.As(err, &failed) {
+		d.failed.Store(failed)
+	}
+	if err != nil {
+		return err
+	}
+	d.failed.Store(nil)
+	d.migrated.Store(true)
+	return nil
+}
+
+// MigrationFailure returns the error the last migration failed with.
+func (d *Database) MigrationFailure() error {
+	if failed := d.failed.Load(); failed != nil {
+		return failed
+	}
+	return nil
+}
+
+// MigrationStatus lists the migrations with when they were applied.
+func (d *Database) MigrationStatus(ctx context.Context) ([]db.MigrationStatus, error) {
+	return Status(ctx, d.DB, d.Dialect, d.Migrations)
+}
+
+// Migrated reports whether the migrations have been applied, by Init or
+// since by another instance.
+func (d *Database) Migrated() bool {
+	if d.migrated.Load() {
+		return true
+	}
+	status, err := d.MigrationStatus(context.Background())
+	if err != nil {
+		return false
+	}
+	for _, st := range status {
+		if st.AppliedAt == nil {
+			return false
+		}
+	}
+	d.failed.Store(nil)
+	d.migrated.Store(true)
+	return true
+}
+
+// Close closes the connection pools.
+func (d *Database) Close() error {
+	if d.Replica != nil {
+		d.Replica.Close()
+	}
+	if d.DB == nil {
+		return nil
+	}
+	return d.DB.Close()
+}
+
+// Ping checks a connection to the database can be made.
+func (d *Database) Ping(ctx context.Context) error {
+	return d.DB.PingContext(ctx)
+}
+
+// queryer is met by both *sql.DB and *sql.Tx.
+type queryer interface {
+	ExecContext(context.Context, string, ...interface{}) (sql.Result, error)
+	QueryContext(context.Context, string, ...interface{}) (*sql.Rows, error)
+	QueryRowContext(context.Context, string, ...interface{}) *sql.Row
+}
+
+// conn runs the queries of d, written with ? placeholders, on q within
+// ctx.
+type conn struct {
+	ctx context.Context
+	q   queryer
+	d   Dialect
+}
+
+func (d *Database) conn(ctx context.Context) conn {
+	return conn{ctx: ctx, q: d.DB, d: d.Dialect}
+}
+
+// read returns the conn of reads within ctx, on the Replica when ctx
+// prefers one and there is one.
+func (d *Database) read(ctx context.Context) conn {
+	if d.Replica != nil && db.ReadPreferenceFrom(ctx) != db.Primary {
+		return conn{ctx: ctx, q: d.Replica, d: d.Dialect}
+	}
+	return d.conn(ctx)
+}
+
+// tx runs f in a transaction, committed when f returns nil. The
+// transaction is rolled back when ctx is done before.
+func (d *Database) tx(ctx context.Context, f func(conn) error) error {
+	tx, err := d.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := f(conn{ctx: ctx, q: tx, d: d.Dialect}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (c conn) exec(query string, args ...interface{}) (sql.Result, error) {
+	return c.q.ExecContext(c.ctx, rebind(c.d, query), utc(args)...)
+}
+
+func (c conn) query(query string, args ...interface{}) (*sql.Rows, error) {
+	return c.q.QueryContext(c.ctx, rebind(c.d, query), utc(args)...)
+}
+
+func (c conn) queryRow(query string, args ...interface{}) *sql.Row {
+	return c.q.QueryRowContext(c.ctx, rebind(c.d, query), utc(args)...)
+}
+
+// utc converts the times of args to UTC. Drivers storing times as text,
+// like SQLite's, keep the zone of the time, and text in different zones
+// doesn't compare in time order.
+func utc(args []interface{}) []interface{} {
+	converted := make([]interface{}, len(args))
+	for k, a := range args {
+		switch t := a.(type) {
+		case time.Time:
+			converted[k] = t.UTC()
+		case *time.Time:
+			if t != nil {
+				converted[k] = t.UTC()
+			}
+		default:
+			converted[k] = a
+		}
+	}
+	return converted
+}
+
+// update runs an UPDATE or DELETE, failing with sql.ErrNoRows when it
+// matched no row.
+func (c conn) update(query string, args ...interface{}) error {
+	res, err := c.exec(query, args...)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// strings returns the single text column of the rows of query.
+func (c conn) strings(query string, args ...interface{}) ([]string, error) {
+	rows, err := c.query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ss []string
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			return nil, err
+		}
+		ss = append(ss, s)
+	}
+	return ss, rows.Err()
+}
+
+// rebind replaces the ? placeholders of query with those of the dialect.
+func rebind(d Dialect, query string) string {
+	if d.Placeholder(1) == "?" {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString(d.Placeholder(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// in returns the placeholders of an IN list of the ids, and the ids as
+// arguments.
+func in(ids []string) (string, []interface{}) {
+	args := make([]interface{}, len(ids))
+	for k, id := range ids {
+		args[k] = id
+	}
+	return strings.TrimSuffix(strings.Repeat("?, ", len(ids)), ", "), args
+}
+
+// limit returns the LIMIT clause of limit, none for zero like MongoDB.
+func limit(n int) string {
+	if n <= 0 {
+		return ""
+	}
+	return " LIMIT " + strconv.Itoa(n)
+}
+
+// conflict turns unique violations into a db.ConflictError naming the field
+// of the violated constraint.
+func conflict(d Dialect, err error) error {
+	c, ok := d.UniqueViolation(err)
+	if !ok {
+		return err
+	}
+	for _, f := range []string{"username", "email"} {
+		if strings.Contains(c, f) {
+			return &db.ConflictError{Field: f}
+		}
+	}
+	return &db.ConflictError{}
+}
+
+// toJSON returns the JSON of v for a JSON column, NULL for nil values.
+func toJSON(v interface{}) (interface{}, error) {
+	b, err := json.Marshal(v)
+	if err != nil || string(b) == "null" {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// fromJSON decodes a JSON column into v, leaving it alone for NULL.
+func fromJSON(b []byte, v interface{}) error {
+	if len(b) == 0 {
+		return nil
+	}
+	return json.Unmarshal(b, v)
+}
+
+// now is the current time at the precision the service stores.
+func now() time.Time {
+	return time.Now().UTC().Truncate(time.Millisecond)
+}
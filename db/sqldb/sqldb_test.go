@@ -0,0 +1,41 @@
+package sqldb
+
+import (
+	"fmt"
+	"testing"
+)
+
+type numbered struct{ Dialect }
+
+func (numbered) Placeholder(n int) string {
+	return fmt.Sprintf("$%d", n)
+}
+
+func TestRebind(t *testing.T) {
+	q := `SELECT id FROM customers WHERE email = ? AND id IN (?, ?)`
+	if got := rebind(numbered{}, q); got != `SELECT id FROM customers WHERE email = $1 AND id IN ($2, $3)` {
+		t.Errorf("unexpected query %v", got)
+	}
+}
+
+func TestIn(t *testing.T) {
+	list, args := in([]string{"a", "b", "c"})
+	if list != "?, ?, ?" || len(args) != 3 || args[2] != "c" {
+		t.Errorf("unexpected list %q %v", list, args)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, c := range []struct {
+		ms    []Migration
+		valid bool
+	}{
+		{[]Migration{{Version: 1}, {Version: 2}}, true},
+		{[]Migration{{Version: 1}, {Version: 1}}, false},
+		{[]Migration{{Version: 0}}, false},
+	} {
+		if err := Validate(c.ms); (err == nil) != c.valid {
+			t.Errorf("%v: expected valid %v, got %v", c.ms, c.valid, err)
+		}
+	}
+}
@@ -0,0 +1,712 @@
+package sqldb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"user/db"
+	"user/users"
+)
+
+// userColumns are the columns of customers scanned by scanUser.
+const userColumns = `id, username, email, first_name, last_name, password, salt, roles, status,
+	last_login_at, login_count, created_at, updated_at, avatar, preferences, locale, timezone,
+	metadata, default_card, phone, phone_verified, phone_code`
+
+type scanner interface {
+	Scan(...interface{}) error
+}
+
+func scanUser(s scanner) (users.User, error) {
+	u := users.New()
+	var roles, avatar, prefs, metadata, code []byte
+	err := s.Scan(&u.UserID, &u.Username, &u.Email, &u.FirstName, &u.LastName, &u.Password, &u.Salt, &roles, &u.Status,
+		&u.LastLoginAt, &u.LoginCount, &u.CreatedAt, &u.UpdatedAt, &avatar, &prefs, &u.Locale, &u.Timezone,
+		&metadata, &u.DefaultCard, &u.Phone, &u.PhoneVerified, &code)
+	if err != nil {
+		return u, err
+	}
+	for _, f := range []struct {
+		b []byte
+		v interface{}
+	}{{roles, &u.Roles}, {avatar, &u.Avatar}, {prefs, &u.Preferences}, {metadata, &u.Metadata}, {code, &u.PhoneCode}} {
+		if err := fromJSON(f.b, f.v); err != nil {
+			return u, err
+		}
+	}
+	return u, nil
+}
+
+// queryUsers runs a select of userColumns and loads the links of the users.
+func (c conn) queryUsers(query string, args ...interface{}) ([]users.User, error) {
+	rows, err := c.query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	us := make([]users.User, 0)
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		us = append(us, u)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return us, c.loadLinks(us)
+}
+
+// queryUser is queryUsers for a single user, failing with sql.ErrNoRows
+// without one.
+func (c conn) queryUser(query string, args ...interface{}) (users.User, error) {
+	us, err := c.queryUsers(query, args...)
+	if err != nil {
+		return users.New(), err
+	}
+	if len(us) == 0 {
+		return users.New(), sql.ErrNoRows
+	}
+	return us[0], nil
+}
+
+// loadLinks fills in the ids of the addresses and cards, the tags and the
+// username history of us.
+func (c conn) loadLinks(us []users.User) error {
+	if len(us) == 0 {
+		return nil
+	}
+	byID := make(map[string]*users.User, len(us))
+	ids := make([]string, len(us))
+	for k := range us {
+		us[k].Addresses = make([]users.Address, 0)
+		us[k].Cards = make([]users.Card, 0)
+		byID[us[k].UserID] = &us[k]
+		ids[k] = us[k].UserID
+	}
+	list, args := in(ids)
+	for _, l := range []struct {
+		query string
+		add   func(u *users.User, v string)
+	}{
+		{`SELECT customer_id, id FROM addresses WHERE customer_id IN (` + list + `) ORDER BY id`, func(u *users.User, id string) {
+			u.Addresses = append(u.Addresses, users.Address{ID: id})
+		}},
+		{`SELECT customer_id, id FROM cards WHERE customer_id IN (` + list + `) ORDER BY id`, func(u *users.User, id string) {
+			u.Cards = append(u.Cards, users.Card{ID: id})
+		}},
+		{`SELECT customer_id, tag FROM customer_tags WHERE customer_id IN (` + list + `) ORDER BY tag`, func(u *users.User, tag string) {
+			u.Tags = append(u.Tags, tag)
+		}},
+	} {
+		rows, err := c.query(l.query, args...)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var owner, v string
+			if err := rows.Scan(&owner, &v); err != nil {
+				rows.Close()
+				return err
+			}
+			l.add(byID[owner], v)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+	rows, err := c.query(`SELECT customer_id, username, changed_at FROM username_history WHERE customer_id IN (`+list+`) ORDER BY changed_at`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var owner string
+		var h users.UsernameChange
+		if err := rows.Scan(&owner, &h.Username, &h.ChangedAt); err != nil {
+			return err
+		}
+		byID[owner].UsernameHistory = append(byID[owner].UsernameHistory, h)
+	}
+	return rows.Err()
+}
+
+// CreateUser inserts the user with its addresses and cards, setting their
+// ids.
+func (d *Database) CreateUser(ctx context.Context, u *users.User) error {
+	at := now()
+	stored := *u
+	stored.UserID = db.NewID()
+	stored.CreatedAt, stored.UpdatedAt = at, at
+	err := d.tx(ctx, func(c conn) error {
+		if err := c.emailFree(u.Email, ""); err != nil {
+			return err
+		}
+		if err := c.insertUser(&stored); err != nil {
+			return conflict(d.Dialect, err)
+		}
+		for k := range stored.Addresses {
+			stored.Addresses[k].CreatedAt, stored.Addresses[k].UpdatedAt = at, at
+			if err := c.insertAddress(&stored.Addresses[k], stored.UserID); err != nil {
+				return err
+			}
+		}
+		for k := range stored.Cards {
+			stored.Cards[k].CreatedAt, stored.Cards[k].UpdatedAt = at, at
+			if err := c.insertCard(&stored.Cards[k], stored.UserID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	*u = stored
+	return nil
+}
+
+func (c conn) insertUser(u *users.User) error {
+	roles, err := toJSON(u.Roles)
+	if err != nil {
+		return err
+	}
+	avatar, err := toJSON(u.Avatar)
+	if err != nil {
+		return err
+	}
+	prefs, err := toJSON(u.Preferences)
+	if err != nil {
+		return err
+	}
+	metadata, err := toJSON(u.Metadata)
+	if err != nil {
+		return err
+	}
+	code, err := toJSON(u.PhoneCode)
+	if err != nil {
+		return err
+	}
+	_, err = c.exec(`INSERT INTO customers (id, username, username_key, email, first_name, last_name, password, salt, roles, status,
+		last_login_at, login_count, created_at, updated_at, avatar, preferences, locale, timezone,
+		metadata, default_card, phone, phone_verified, phone_code)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		u.UserID, u.Username, users.NormalizeUsername(u.Username), u.Email, u.FirstName, u.LastName, u.Password, u.Salt, roles, u.Status,
+		u.LastLoginAt, u.LoginCount, u.CreatedAt, u.UpdatedAt, avatar, prefs, u.Locale, u.Timezone,
+		metadata, u.DefaultCard, u.Phone, u.PhoneVerified, code)
+	if err != nil {
+		return err
+	}
+	for _, tag := range u.Tags {
+		if err := c.addTag(u.UserID, tag); err != nil {
+			return err
+		}
+	}
+	for _, h := range u.UsernameHistory {
+		if err := c.addHistory(u.UserID, h.Username, h.ChangedAt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addTag adds tag to the user unless it has it. Callers hold the lock of
+// the customer row.
+func (c conn) addTag(id, tag string) error {
+	var n int
+	if err := c.queryRow(`SELECT COUNT(*) FROM customer_tags WHERE customer_id = ? AND tag = ?`, id, tag).Scan(&n); err != nil || n > 0 {
+		return err
+	}
+	_, err := c.exec(`INSERT INTO customer_tags (customer_id, tag) VALUES (?, ?)`, id, tag)
+	return err
+}
+
+func (c conn) addHistory(id, username string, at time.Time) error {
+	_, err := c.exec(`INSERT INTO username_history (customer_id, username, username_key, changed_at) VALUES (?, ?, ?, ?)`,
+		id, username, users.NormalizeUsername(username), at)
+	return err
+}
+
+// emailFree checks no user but except holds email, before the unique
+// constraint on it fails the write.
+func (c conn) emailFree(email, except string) error {
+	if email == "" {
+		return nil
+	}
+	var n int
+	if err := c.queryRow(`SELECT COUNT(*) FROM customers WHERE email = ? AND id <> ?`, email, except).Scan(&n); err != nil {
+		return err
+	}
+	if n > 0 {
+		return &db.ConflictError{Field: "email"}
+	}
+	return nil
+}
+
+// UpdateUser sets the given profile fields of the user, leaving the rest as is
+func (d *Database) UpdateUser(ctx context.Context, id string, p users.ProfileUpdate) error {
+	if profileEmpty(p) {
+		return nil
+	}
+	return d.tx(ctx, func(c conn) error {
+		if p.Email != nil {
+			if err := c.emailFree(*p.Email, id); err != nil {
+				return err
+			}
+		}
+		return conflict(d.Dialect, c.updateProfile(id, p, now()))
+	})
+}
+
+func profileEmpty(p users.ProfileUpdate) bool {
+	return p.FirstName == nil && p.LastName == nil && p.Email == nil && p.Locale == nil && p.Timezone == nil &&
+		p.Phone == nil && p.PhoneVerified == nil && p.PhoneCode == nil && p.Avatar == nil && p.Preferences == nil &&
+		p.Status == nil && p.Password == nil && p.Salt == nil && len(p.Metadata) == 0
+}
+
+// updateProfile sets the fields of p on the user, failing with
+// sql.ErrNoRows for unknown users.
+func (c conn) updateProfile(id string, p users.ProfileUpdate, at time.Time) error {
+	set := "updated_at = ?"
+	args := []interface{}{at}
+	add := func(column string, v interface{}) {
+		set += ", " + column + " = ?"
+		args = append(args, v)
+	}
+	for _, f := range []struct {
+		column string
+		v      *string
+	}{
+		{"first_name", p.FirstName}, {"last_name", p.LastName}, {"email", p.Email}, {"locale", p.Locale},
+		{"timezone", p.Timezone}, {"status", p.Status}, {"password", p.Password}, {"salt", p.Salt},
+	} {
+		if f.v != nil {
+			add(f.column, *f.v)
+		}
+	}
+	// A new phone has to be verified again.
+	if p.Phone != nil {
+		add("phone", *p.Phone)
+		if p.PhoneVerified == nil {
+			add("phone_verified", false)
+		}
+	}
+	if p.PhoneVerified != nil {
+		add("phone_verified", *p.PhoneVerified)
+	}
+	switch {
+	case p.PhoneCode != nil:
+		code, err := toJSON(p.PhoneCode)
+		if err != nil {
+			return err
+		}
+		add("phone_code", code)
+	case p.Phone != nil || p.PhoneVerified != nil:
+		add("phone_code", nil)
+	}
+	if p.Avatar != nil {
+		j, err := toJSON(p.Avatar)
+		if err != nil {
+			return err
+		}
+		add("avatar", j)
+	}
+	if p.Preferences != nil {
+		j, err := toJSON(p.Preferences)
+		if err != nil {
+			return err
+		}
+		add("preferences", j)
+	}
+	if len(p.Metadata) > 0 {
+		var b []byte
+		err := c.queryRow(`SELECT metadata FROM customers WHERE id = ?`+c.d.ForUpdate(), id).Scan(&b)
+		if err != nil {
+			return err
+		}
+		var metadata map[string]string
+		if err := fromJSON(b, &metadata); err != nil {
+			return err
+		}
+		if metadata == nil {
+			metadata = map[string]string{}
+		}
+		for k, v := range p.Metadata {
+			if v == nil {
+				delete(metadata, k)
+				continue
+			}
+			metadata[k] = *v
+		}
+		if len(metadata) == 0 {
+			metadata = nil
+		}
+		j, err := toJSON(metadata)
+		if err != nil {
+			return err
+		}
+		add("metadata", j)
+	}
+	return c.update(`UPDATE customers SET `+set+` WHERE id = ?`, append(args, id)...)
+}
+
+// RenameUser changes the username, recording the old one in the history
+func (d *Database) RenameUser(ctx context.Context, id, username string) error {
+	return d.tx(ctx, func(c conn) error {
+		var old string
+		if err := c.queryRow(`SELECT username FROM customers WHERE id = ?`+c.d.ForUpdate(), id).Scan(&old); err != nil {
+			return err
+		}
+		at := now()
+		err := c.update(`UPDATE customers SET username = ?, username_key = ?, updated_at = ? WHERE id = ?`,
+			username, users.NormalizeUsername(username), at, id)
+		if err != nil {
+			return conflict(d.Dialect, err)
+		}
+		return c.addHistory(id, old, at)
+	})
+}
+
+// UpgradeUser gives the guest id the credentials and profile of u and drops
+// its guest role. It fails with sql.ErrNoRows unless id is a guest.
+func (d *Database) UpgradeUser(ctx context.Context, id string, u users.User) error {
+	return d.tx(ctx, func(c conn) error {
+		if err := c.emailFree(u.Email, id); err != nil {
+			return err
+		}
+		var b []byte
+		if err := c.queryRow(`SELECT roles FROM customers WHERE id = ?`+c.d.ForUpdate(), id).Scan(&b); err != nil {
+			return err
+		}
+		var roles []string
+		if err := fromJSON(b, &roles); err != nil {
+			return err
+		}
+		kept := make([]string, 0, len(roles))
+		for _, r := range roles {
+			if r != users.RoleGuest {
+				kept = append(kept, r)
+			}
+		}
+		if len(kept) == len(roles) {
+			return sql.ErrNoRows
+		}
+		j, err := toJSON(kept)
+		if err != nil {
+			return err
+		}
+		err = c.update(`UPDATE customers SET username = ?, username_key = ?, password = ?, salt = ?, email = ?,
+			first_name = ?, last_name = ?, roles = ?, updated_at = ? WHERE id = ?`,
+			u.Username, users.NormalizeUsername(u.Username), u.Password, u.Salt, u.Email,
+			u.FirstName, u.LastName, j, now(), id)
+		return conflict(d.Dialect, err)
+	})
+}
+
+// MergeUsers moves the addresses, cards and tags of source to target, sets
+// the profile fields in p on target and removes source. The source username
+// becomes a previous username of target, the source id an alias of it.
+func (d *Database) MergeUsers(ctx context.Context, target, source string, p users.ProfileUpdate) error {
+	return d.tx(ctx, func(c conn) error {
+		src, err := c.queryUser(`SELECT `+userColumns+` FROM customers WHERE id = ?`, source)
+		if err != nil {
+			return err
+		}
+		at := now()
+		if err := c.updateProfile(target, p, at); err != nil {
+			return err
+		}
+		if err := c.addHistory(target, src.Username, at); err != nil {
+			return err
+		}
+		for _, tag := range src.Tags {
+			if err := c.addTag(target, tag); err != nil {
+				return err
+			}
+		}
+		for _, q := range []string{
+			`UPDATE addresses SET customer_id = ? WHERE customer_id = ?`,
+			`UPDATE cards SET customer_id = ? WHERE customer_id = ?`,
+			// Aliases of the source, and the source itself, now point at target.
+			`UPDATE aliases SET target = ? WHERE target = ?`,
+			`UPDATE activity SET user_id = ? WHERE user_id = ?`,
+		} {
+			if _, err := c.exec(q, target, source); err != nil {
+				return err
+			}
+		}
+		if _, err := c.exec(`DELETE FROM aliases WHERE id = ?`, source); err != nil {
+			return err
+		}
+		if _, err := c.exec(`INSERT INTO aliases (id, target, merged_at) VALUES (?, ?, ?)`, source, target, at); err != nil {
+			return err
+		}
+		if err := c.moveGroupUser(source, target); err != nil {
+			return err
+		}
+		if _, err := c.exec(`DELETE FROM group_users WHERE user_id = ?`, source); err != nil {
+			return err
+		}
+		return c.update(`DELETE FROM customers WHERE id = ?`, source)
+	})
+}
+
+// ResolveAlias returns the id of the user the given id was merged into
+func (d *Database) ResolveAlias(ctx context.Context, id string) (string, error) {
+	var target string
+	err := d.conn(ctx).queryRow(`SELECT target FROM aliases WHERE id = ?`, id).Scan(&target)
+	return target, err
+}
+
+// GetUserByPreviousName gets the user who renamed away from name after since
+func (d *Database) GetUserByPreviousName(ctx context.Context, name string, since time.Time) (users.User, error) {
+	return d.conn(ctx).queryUser(`SELECT `+userColumns+` FROM customers WHERE id IN
+		(SELECT customer_id FROM username_history WHERE username_key = ? AND changed_at > ?)`,
+		users.NormalizeUsername(name), since)
+}
+
+// RecordLogin stores the time of a successful login and counts it
+func (d *Database) RecordLogin(ctx context.Context, id string, at time.Time) error {
+	return d.conn(ctx).update(`UPDATE customers SET last_login_at = ?, login_count = login_count + 1 WHERE id = ?`, at, id)
+}
+
+// AddUserTag adds tag to the user, tags are kept unique
+func (d *Database) AddUserTag(ctx context.Context, id, tag string) error {
+	return d.tx(ctx, func(c conn) error {
+		if err := c.update(`UPDATE customers SET updated_at = ? WHERE id = ?`, now(), id); err != nil {
+			return err
+		}
+		return c.addTag(id, tag)
+	})
+}
+
+// RemoveUserTag removes tag from the user
+func (d *Database) RemoveUserTag(ctx context.Context, id, tag string) error {
+	return d.tx(ctx, func(c conn) error {
+		if err := c.update(`UPDATE customers SET updated_at = ? WHERE id = ?`, now(), id); err != nil {
+			return err
+		}
+		_, err := c.exec(`DELETE FROM customer_tags WHERE customer_id = ? AND tag = ?`, id, tag)
+		return err
+	})
+}
+
+// GetUserByName Get user by their name
+func (d *Database) GetUserByName(ctx context.Context, name string) (users.User, error) {
+	return d.conn(ctx).queryUser(`SELECT `+userColumns+` FROM customers WHERE username_key = ?`, users.NormalizeUsername(name))
+}
+
+// GetUser Get user by their id
+func (d *Database) GetUser(ctx context.Context, id string) (users.User, error) {
+	return d.read(ctx).queryUser(`SELECT `+userColumns+` FROM customers WHERE id = ?`, id)
+}
+
+// GetUsersByID gets the users with the given ids in a single query, unknown
+// ids are left out
+func (d *Database) GetUsersByID(ctx context.Context, ids []string) ([]users.User, error) {
+	if len(ids) == 0 {
+		return make([]users.User, 0), nil
+	}
+	list, args := in(ids)
+	return d.read(ctx).queryUsers(`SELECT `+userColumns+` FROM customers WHERE id IN (`+list+`)`, args...)
+}
+
+// sortColumns are the columns of db.SortFields.
+var sortColumns = map[string]string{
+	"username":    "username_key",
+	"email":       "email",
+	"lastName":    "last_name",
+	"createdAt":   "created_at",
+	"updatedAt":   "updated_at",
+	"lastLoginAt": "last_login_at",
+}
+
+// GetUsers Get all users matching the query. All columns are loaded, the
+// fields of the query only narrow the responses.
+func (d *Database) GetUsers(ctx context.Context, q db.UserQuery) ([]users.User, error) {
+	where, args := d.userWhere(q)
+	order := "id"
+	if q.Sort != "" {
+		f, desc := q.SortField()
+		column, ok := sortColumns[f]
+		if !ok {
+			return nil, db.ErrInvalidSort
+		}
+		order = column
+		if desc {
+			order += " DESC"
+		}
+		order += ", id"
+	}
+	return d.read(ctx).queryUsers(`SELECT `+userColumns+` FROM customers WHERE `+where+` ORDER BY `+order+limit(q.Limit), args...)
+}
+
+// userWhere translates the query filters.
+func (d *Database) userWhere(q db.UserQuery) (string, []interface{}) {
+	where := "1 = 1"
+	var args []interface{}
+	add := func(cond string, vs ...interface{}) {
+		where += " AND " + cond
+		args = append(args, vs...)
+	}
+	if q.Email != "" {
+		add("email = ?", q.Email)
+	}
+	if q.LastName != "" {
+		add("last_name = ?", q.LastName)
+	}
+	if !q.CreatedAfter.IsZero() {
+		add("created_at > ?", q.CreatedAfter)
+	}
+	if !q.CreatedBefore.IsZero() {
+		add("created_at < ?", q.CreatedBefore)
+	}
+	if !q.UpdatedAfter.IsZero() {
+		add("updated_at > ?", q.UpdatedAfter)
+	}
+	if q.Tag != "" {
+		add("id IN (SELECT customer_id FROM customer_tags WHERE tag = ?)", q.Tag)
+	}
+	if q.Role != "" {
+		add(d.Dialect.JSONContains("roles"), q.Role)
+	}
+	for k, v := range q.Metadata {
+		field, key := d.Dialect.JSONField("metadata", k)
+		add(field+" = ?", key, v)
+	}
+	switch q.Status {
+	case "":
+		add("status <> ?", users.StatusDeleted)
+	case users.StatusActive:
+		// Users without a status predate lifecycle states and are active.
+		add("status IN ('', ?)", users.StatusActive)
+	default:
+		add("status = ?", q.Status)
+	}
+	return where, args
+}
+
+// GetStats counts the tables, signups per day since signupsSince and users
+// who logged in since activeSince
+func (d *Database) GetStats(ctx context.Context, signupsSince, activeSince time.Time) (db.Stats, error) {
+	c := d.read(ctx)
+	var st db.Stats
+	for _, n := range []struct {
+		query string
+		v     *int
+	}{
+		{`SELECT COUNT(*) FROM customers`, &st.Users},
+		{`SELECT COUNT(*) FROM addresses`, &st.Addresses},
+		{`SELECT COUNT(*) FROM cards`, &st.Cards},
+	} {
+		if err := c.queryRow(n.query).Scan(n.v); err != nil {
+			return st, err
+		}
+	}
+	if err := c.queryRow(`SELECT COUNT(*) FROM customers WHERE last_login_at >= ?`, activeSince).Scan(&st.Active); err != nil {
+		return st, err
+	}
+	day := d.Dialect.Day("created_at")
+	rows, err := c.query(`SELECT `+day+`, COUNT(*) FROM customers WHERE created_at >= ? GROUP BY `+day, signupsSince)
+	if err != nil {
+		return st, err
+	}
+	defer rows.Close()
+	counts := map[string]int{}
+	for rows.Next() {
+		var day string
+		var n int
+		if err := rows.Scan(&day, &n); err != nil {
+			return st, err
+		}
+		counts[day] = n
+	}
+	st.Signups = db.Days(signupsSince, time.Now(), counts)
+	return st, rows.Err()
+}
+
+// ListUsers gets a page of users in id order, starting after the given id
+func (d *Database) ListUsers(ctx context.Context, after string, n int) ([]users.User, error) {
+	return d.read(ctx).queryUsers(`SELECT `+userColumns+` FROM customers WHERE id > ? ORDER BY id`+limit(n), after)
+}
+
+// UserExists reports whether a user has the value in the given field,
+// username or email
+func (d *Database) UserExists(ctx context.Context, field, value string) (bool, error) {
+	switch field {
+	case "username":
+		field, value = "username_key", users.NormalizeUsername(value)
+	case "email":
+	default:
+		return false, fmt.Errorf("no user field %v", field)
+	}
+	var n int
+	err := d.conn(ctx).queryRow(`SELECT COUNT(*) FROM customers WHERE `+field+` = ?`, value).Scan(&n)
+	return n > 0, err
+}
+
+// DeleteUsers removes the users and their addresses and cards, reporting
+// unknown ids individually
+func (d *Database) DeleteUsers(ctx context.Context, ids []string) (map[string]error, error) {
+	res := make(map[string]error, len(ids))
+	if len(ids) == 0 {
+		return res, nil
+	}
+	err := d.tx(ctx, func(c conn) error {
+		list, args := in(ids)
+		found, err := c.strings(`SELECT id FROM customers WHERE id IN (`+list+`)`, args...)
+		if err != nil || len(found) == 0 {
+			return err
+		}
+		list, args = in(found)
+		for _, q := range []string{
+			// Addresses and cards go with their customers.
+			`DELETE FROM customers WHERE id IN (` + list + `)`,
+			`DELETE FROM group_users WHERE user_id IN (` + list + `)`,
+			`DELETE FROM activity WHERE user_id IN (` + list + `)`,
+		} {
+			if _, err := c.exec(q, args...); err != nil {
+				return err
+			}
+		}
+		for _, id := range ids {
+			res[id] = sql.ErrNoRows
+		}
+		for _, id := range found {
+			res[id] = nil
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		if _, ok := res[id]; !ok {
+			res[id] = sql.ErrNoRows
+		}
+	}
+	return res, nil
+}
+
+// tables maps the entities of Delete to their tables.
+var tables = map[string]string{
+	"customers": "customers",
+	"addresses": "addresses",
+	"cards":     "cards",
+	"groups":    "user_groups",
+}
+
+// Delete removes the entity with id. Deleting customers removes their
+// addresses and cards too.
+func (d *Database) Delete(ctx context.Context, entity, id string) error {
+	table, ok := tables[entity]
+	if !ok {
+		return fmt.Errorf("no entity %v", entity)
+	}
+	return d.conn(ctx).update(`DELETE FROM `+table+` WHERE id = ?`, id)
+}
@@ -0,0 +1,100 @@
+package sqldb
+
+import (
+	"context"
+	"user/db"
+	"user/users"
+)
+
+// CreateWebhook inserts the webhook
+func (d *Database) CreateWebhook(ctx context.Context, w *users.Webhook) error {
+	stored := *w
+	stored.ID = db.NewID()
+	stored.CreatedAt = now()
+	events, err := toJSON(stored.Events)
+	if err != nil {
+		return err
+	}
+	_, err = d.conn(ctx).exec(`INSERT INTO webhooks (id, url, secret, events, created_at) VALUES (?, ?, ?, ?, ?)`,
+		stored.ID, stored.URL, stored.Secret, events, stored.CreatedAt)
+	if err != nil {
+		return err
+	}
+	*w = stored
+	return nil
+}
+
+// GetWebhooks gets every webhook, oldest first
+func (d *Database) GetWebhooks(ctx context.Context) ([]users.Webhook, error) {
+	rows, err := d.read(ctx).query(`SELECT id, url, secret, events, created_at FROM webhooks ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ws := make([]users.Webhook, 0)
+	for rows.Next() {
+		var w users.Webhook
+		var events []byte
+		if err := rows.Scan(&w.ID, &w.URL, &w.Secret, &events, &w.CreatedAt); err != nil {
+			return nil, err
+		}
+		if err := fromJSON(events, &w.Events); err != nil {
+			return nil, err
+		}
+		ws = append(ws, w)
+	}
+	return ws, rows.Err()
+}
+
+// DeleteWebhook removes the webhook, its delivery log expires
+func (d *Database) DeleteWebhook(ctx context.Context, id string) error {
+	return d.conn(ctx).update(`DELETE FROM webhooks WHERE id = ?`, id)
+}
+
+// AddWebhookDelivery logs the delivery attempt, removing the expired ones
+func (d *Database) AddWebhookDelivery(ctx context.Context, wd *users.WebhookDelivery) error {
+	stored := *wd
+	stored.ID = db.NewID()
+	stored.Time = now()
+	c := d.conn(ctx)
+	if _, err := c.exec(`DELETE FROM webhook_deliveries WHERE attempted_at < ?`, stored.Time.Add(-db.WebhookDeliveryTTL)); err != nil {
+		return err
+	}
+	_, err := c.exec(`INSERT INTO webhook_deliveries (id, webhook_id, event_id, event_type, attempt, status_code, error, delivered,
+		attempted_at, duration_ms) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		stored.ID, stored.WebhookID, stored.EventID, stored.EventType, stored.Attempt, stored.StatusCode, stored.Error, stored.Delivered,
+		stored.Time, stored.DurationMS)
+	if err != nil {
+		return err
+	}
+	*wd = stored
+	return nil
+}
+
+// GetWebhookDeliveries returns up to limit deliveries to the webhook older
+// than the delivery before, newest first
+func (d *Database) GetWebhookDeliveries(ctx context.Context, webhookID, before string, n int) ([]users.WebhookDelivery, error) {
+	query := `SELECT id, webhook_id, event_id, event_type, attempt, status_code, error, delivered, attempted_at, duration_ms
+		FROM webhook_deliveries WHERE webhook_id = ? AND attempted_at >= ?`
+	args := []interface{}{webhookID, now().Add(-db.WebhookDeliveryTTL)}
+	if before != "" {
+		query += ` AND id < ?`
+		args = append(args, before)
+	}
+	rows, err := d.read(ctx).query(query+` ORDER BY id DESC`+limit(n), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ds := make([]users.WebhookDelivery, 0)
+	for rows.Next() {
+		var wd users.WebhookDelivery
+		err := rows.Scan(&wd.ID, &wd.WebhookID, &wd.EventID, &wd.EventType, &wd.Attempt, &wd.StatusCode, &wd.Error, &wd.Delivered,
+			&wd.Time, &wd.DurationMS)
+		if err != nil {
+			return nil, err
+		}
+		ds = append(ds, wd)
+	}
+	return ds, rows.Err()
+}
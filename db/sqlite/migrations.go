@@ -0,0 +1,214 @@
+package sqlite
+
+import "user/db/sqldb"
+
+// Migrations create and upgrade the schema. Released migrations are never
+// edited, changes are appended with the next version. Timestamps are text
+// in UTC and JSON is text, read with the json functions of SQLite.
+var Migrations = []sqldb.Migration{
+	{Version: 1, Name: "create tables", Statements: []string{
+		`CREATE TABLE customers (
+			id TEXT PRIMARY KEY,
+			username TEXT NOT NULL,
+			username_key TEXT NOT NULL,
+			email TEXT NOT NULL DEFAULT '',
+			first_name TEXT NOT NULL DEFAULT '',
+			last_name TEXT NOT NULL DEFAULT '',
+			password TEXT NOT NULL DEFAULT '',
+			salt TEXT NOT NULL DEFAULT '',
+			roles TEXT,
+			status TEXT NOT NULL DEFAULT '',
+			last_login_at TIMESTAMP,
+			login_count INTEGER NOT NULL DEFAULT 0,
+			created_at TIMESTAMP NOT NULL,
+			updated_at TIMESTAMP NOT NULL,
+			avatar TEXT,
+			preferences TEXT,
+			locale TEXT NOT NULL DEFAULT '',
+			timezone TEXT NOT NULL DEFAULT '',
+			metadata TEXT,
+			default_card TEXT NOT NULL DEFAULT '',
+			phone TEXT NOT NULL DEFAULT '',
+			phone_verified BOOLEAN NOT NULL DEFAULT FALSE,
+			phone_code TEXT,
+			CONSTRAINT customers_username_unique UNIQUE (username),
+			CONSTRAINT customers_username_key_unique UNIQUE (username_key)
+		)`,
+		// Listing filters and sorts
+		`CREATE INDEX customers_email ON customers (email)`,
+		`CREATE INDEX customers_last_name ON customers (last_name)`,
+		`CREATE INDEX customers_created_at ON customers (created_at)`,
+		`CREATE INDEX customers_updated_at ON customers (updated_at)`,
+		`CREATE INDEX customers_last_login_at ON customers (last_login_at)`,
+		`CREATE TABLE customer_tags (
+			customer_id TEXT NOT NULL REFERENCES customers (id) ON DELETE CASCADE,
+			tag TEXT NOT NULL,
+			PRIMARY KEY (customer_id, tag)
+		)`,
+		`CREATE INDEX customer_tags_tag ON customer_tags (tag)`,
+		`CREATE TABLE username_history (
+			customer_id TEXT NOT NULL REFERENCES customers (id) ON DELETE CASCADE,
+			username TEXT NOT NULL,
+			username_key TEXT NOT NULL,
+			changed_at TIMESTAMP NOT NULL
+		)`,
+		`CREATE INDEX username_history_customer_id ON username_history (customer_id)`,
+		`CREATE INDEX username_history_username_key ON username_history (username_key)`,
+		// Addresses and cards link to their customer, anonymous ones to none.
+		`CREATE TABLE addresses (
+			id TEXT PRIMARY KEY,
+			customer_id TEXT REFERENCES customers (id) ON DELETE CASCADE,
+			street TEXT NOT NULL DEFAULT '',
+			street_number TEXT NOT NULL DEFAULT '',
+			building TEXT NOT NULL DEFAULT '',
+			country TEXT NOT NULL DEFAULT '',
+			state TEXT NOT NULL DEFAULT '',
+			prefecture TEXT NOT NULL DEFAULT '',
+			city TEXT NOT NULL DEFAULT '',
+			post_code TEXT NOT NULL DEFAULT '',
+			type TEXT NOT NULL DEFAULT '',
+			is_default BOOLEAN NOT NULL DEFAULT FALSE,
+			validated BOOLEAN NOT NULL DEFAULT FALSE,
+			lat REAL,
+			lng REAL,
+			geocode TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMP NOT NULL,
+			updated_at TIMESTAMP NOT NULL
+		)`,
+		`CREATE INDEX addresses_customer_id ON addresses (customer_id)`,
+		`CREATE TABLE cards (
+			id TEXT PRIMARY KEY,
+			customer_id TEXT REFERENCES customers (id) ON DELETE CASCADE,
+			long_num TEXT NOT NULL,
+			expires TEXT NOT NULL DEFAULT '',
+			holder TEXT NOT NULL DEFAULT '',
+			brand TEXT NOT NULL DEFAULT '',
+			token TEXT NOT NULL DEFAULT '',
+			vault TEXT NOT NULL DEFAULT '',
+			reminded_for TEXT NOT NULL DEFAULT '',
+			verification TEXT NOT NULL DEFAULT '',
+			replaces TEXT NOT NULL DEFAULT '',
+			replaced_by TEXT NOT NULL DEFAULT '',
+			deleted_at TIMESTAMP,
+			created_at TIMESTAMP NOT NULL,
+			updated_at TIMESTAMP NOT NULL
+		)`,
+		`CREATE INDEX cards_customer_id ON cards (customer_id)`,
+		`CREATE TABLE aliases (
+			id TEXT PRIMARY KEY,
+			target TEXT NOT NULL,
+			merged_at TIMESTAMP NOT NULL
+		)`,
+		`CREATE INDEX aliases_target ON aliases (target)`,
+		`CREATE TABLE user_groups (
+			id TEXT PRIMARY KEY,
+			name TEXT NOT NULL,
+			created_at TIMESTAMP NOT NULL
+		)`,
+		`CREATE TABLE group_users (
+			group_id TEXT NOT NULL REFERENCES user_groups (id) ON DELETE CASCADE,
+			user_id TEXT NOT NULL,
+			role TEXT NOT NULL,
+			PRIMARY KEY (group_id, user_id, role)
+		)`,
+		`CREATE INDEX group_users_user_id ON group_users (user_id)`,
+		// Activity feeds are read per user, newest first
+		`CREATE TABLE activity (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			type TEXT NOT NULL,
+			at TIMESTAMP NOT NULL,
+			details TEXT
+		)`,
+		`CREATE INDEX activity_user_id ON activity (user_id, id DESC)`,
+		`CREATE TABLE idempotency_keys (
+			idempotency_key TEXT PRIMARY KEY,
+			fingerprint TEXT NOT NULL,
+			result_id TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMP NOT NULL
+		)`,
+		`CREATE INDEX idempotency_keys_created_at ON idempotency_keys (created_at)`,
+		`CREATE TABLE webhooks (
+			id TEXT PRIMARY KEY,
+			url TEXT NOT NULL,
+			secret TEXT NOT NULL,
+			events TEXT,
+			created_at TIMESTAMP NOT NULL
+		)`,
+		// Webhook delivery logs are read per webhook, newest first, and expire
+		`CREATE TABLE webhook_deliveries (
+			id TEXT PRIMARY KEY,
+			webhook_id TEXT NOT NULL,
+			event_id TEXT NOT NULL,
+			event_type TEXT NOT NULL,
+			attempt INTEGER NOT NULL,
+			status_code INTEGER NOT NULL DEFAULT 0,
+			error TEXT NOT NULL DEFAULT '',
+			delivered BOOLEAN NOT NULL,
+			attempted_at TIMESTAMP NOT NULL,
+			duration_ms BIGINT NOT NULL DEFAULT 0
+		)`,
+		`CREATE INDEX webhook_deliveries_webhook_id ON webhook_deliveries (webhook_id, id DESC)`,
+		`CREATE INDEX webhook_deliveries_attempted_at ON webhook_deliveries (attempted_at)`,
+	}},
+	// Emails are unique like in MySQL, empty ones aside. Duplicates have
+	// to be merged or changed first.
+	{Version: 2, Name: "unique emails", Statements: []string{
+		`CREATE UNIQUE INDEX customers_email_unique ON customers (email) WHERE email <> ''`,
+		`DROP INDEX customers_email`,
+	}},
+	// The changes to customers, addresses and cards are recorded in the
+	// outbox, in the transaction making them. Changes nobody relayed are
+	// dropped after a week.
+	{Version: 3, Name: "outbox", Statements: []string{
+		`CREATE TABLE outbox (
+			seq INTEGER PRIMARY KEY AUTOINCREMENT,
+			type TEXT NOT NULL,
+			resource_id TEXT NOT NULL,
+			user_id TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE INDEX outbox_created_at ON outbox (created_at)`,
+		`CREATE TRIGGER customers_insert_outbox AFTER INSERT ON customers BEGIN
+			DELETE FROM outbox WHERE created_at < datetime('now', '-7 days');
+			INSERT INTO outbox (type, resource_id, user_id) VALUES ('user.created', NEW.id, NEW.id);
+		END`,
+		// Logins, the only updates counting, are published by the service.
+		`CREATE TRIGGER customers_update_outbox AFTER UPDATE ON customers WHEN OLD.login_count = NEW.login_count BEGIN
+			DELETE FROM outbox WHERE created_at < datetime('now', '-7 days');
+			INSERT INTO outbox (type, resource_id, user_id) VALUES ('user.updated', NEW.id, NEW.id);
+		END`,
+		`CREATE TRIGGER customers_delete_outbox AFTER DELETE ON customers BEGIN
+			DELETE FROM outbox WHERE created_at < datetime('now', '-7 days');
+			INSERT INTO outbox (type, resource_id, user_id) VALUES ('user.deleted', OLD.id, OLD.id);
+		END`,
+		`CREATE TRIGGER addresses_insert_outbox AFTER INSERT ON addresses BEGIN
+			DELETE FROM outbox WHERE created_at < datetime('now', '-7 days');
+			INSERT INTO outbox (type, resource_id, user_id) VALUES ('address.created', NEW.id, COALESCE(NEW.customer_id, ''));
+		END`,
+		`CREATE TRIGGER addresses_update_outbox AFTER UPDATE ON addresses BEGIN
+			DELETE FROM outbox WHERE created_at < datetime('now', '-7 days');
+			INSERT INTO outbox (type, resource_id, user_id)
+				VALUES ('address.updated', NEW.id, COALESCE(NEW.customer_id, OLD.customer_id, ''));
+		END`,
+		`CREATE TRIGGER addresses_delete_outbox AFTER DELETE ON addresses BEGIN
+			DELETE FROM outbox WHERE created_at < datetime('now', '-7 days');
+			INSERT INTO outbox (type, resource_id, user_id) VALUES ('address.deleted', OLD.id, COALESCE(OLD.customer_id, ''));
+		END`,
+		`CREATE TRIGGER cards_insert_outbox AFTER INSERT ON cards BEGIN
+			DELETE FROM outbox WHERE created_at < datetime('now', '-7 days');
+			INSERT INTO outbox (type, resource_id, user_id) VALUES ('card.created', NEW.id, COALESCE(NEW.customer_id, ''));
+		END`,
+		// Deleted cards are kept, taken off their customer.
+		`CREATE TRIGGER cards_update_outbox AFTER UPDATE ON cards BEGIN
+			DELETE FROM outbox WHERE created_at < datetime('now', '-7 days');
+			INSERT INTO outbox (type, resource_id, user_id) VALUES (
+				CASE WHEN OLD.deleted_at IS NULL AND NEW.deleted_at IS NOT NULL THEN 'card.deleted' ELSE 'card.updated' END,
+				NEW.id, COALESCE(NEW.customer_id, OLD.customer_id, ''));
+		END`,
+		`CREATE TRIGGER cards_delete_outbox AFTER DELETE ON cards BEGIN
+			DELETE FROM outbox WHERE created_at < datetime('now', '-7 days');
+			INSERT INTO outbox (type, resource_id, user_id) VALUES ('card.deleted', OLD.id, COALESCE(OLD.customer_id, ''));
+		END`,
+	}},
+}
@@ -0,0 +1,169 @@
+// Package sqlite stores the data of the service in a SQLite file, for
+// single node and demo deployments without a database server. The queries
+// are those of sqldb, the schema is created and upgraded by Migrations on
+// Init.
+package sqlite
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"user/db"
+	"user/db/sqldb"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+var (
+	path        string
+	busyTimeout time.Duration
+)
+
+func init() {
+	flag.StringVar(&path, "sqlite-path", os.Getenv("SQLITE_PATH"), "SQLite database file, created if missing (default users.db)")
+	flag.DurationVar(&busyTimeout, "sqlite-busy-timeout", 5*time.Second, "How long a SQLite write waits for another to finish")
+}
+
+// SQLite meets the Database interface requirements
+type SQLite struct {
+	sqldb.Database
+	// Path is the database file, the -sqlite-path flag when empty and
+	// users.db without one.
+	Path string
+
+	mu      sync.Mutex
+	tenants map[string]*SQLite
+}
+
+// Init opens the database file in WAL mode and applies the pending
+// migrations.
+func (s *SQLite) Init() error {
+	if s.Path == "" {
+		s.Path = path
+	}
+	if s.Path == "" {
+		s.Path = "users.db"
+	}
+	return s.open()
+}
+
+// DSN returns the data source name of the database file at path. Readers
+// don't block the writer in WAL mode; transactions take the write lock
+// when they begin, so two of them never deadlock upgrading their locks.
+// Foreign keys are enforced for addresses and cards to go with their user.
+func DSN(path string) string {
+	params := url.Values{}
+	params.Set("_journal_mode", "WAL")
+	params.Set("_txlock", "immediate")
+	params.Set("_busy_timeout", strconv.FormatInt(busyTimeout.Milliseconds(), 10))
+	params.Set("_foreign_keys", "on")
+	params.Set("_synchronous", "NORMAL")
+	return path + "?" + params.Encode()
+}
+
+func (s *SQLite) open() error {
+	if dir := filepath.Dir(s.Path); dir != "." {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return err
+		}
+	}
+	var err error
+	if s.Database.DB, err = sql.Open("sqlite3", DSN(s.Path)); err != nil {
+		return err
+	}
+	s.Dialect = Dialect{}
+	s.Migrations = Migrations
+	return s.Database.Init()
+}
+
+// Tenant returns the database of a tenant. Each tenant has its own file
+// next to the configured one, migrated on first use.
+func (s *SQLite) Tenant(id string) (db.Database, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t, ok := s.tenants[id]; ok {
+		return t, nil
+	}
+	t := &SQLite{Path: tenantPath(s.Path, id)}
+	if err := t.open(); err != nil {
+		t.Close()
+		return nil, err
+	}
+	if s.tenants == nil {
+		s.tenants = make(map[string]*SQLite)
+	}
+	s.tenants[id] = t
+	return t, nil
+}
+
+// tenantPath names the file of the tenant, like users_acme.db for
+// users.db.
+func tenantPath(path, id string) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "_" + id + ext
+}
+
+// Close closes the databases and those of the tenants.
+func (s *SQLite) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.tenants {
+		t.Close()
+	}
+	return s.Database.Close()
+}
+
+// Dialect is the SQLite sqldb.Dialect.
+type Dialect struct{}
+
+// Placeholder returns ?.
+func (Dialect) Placeholder(int) string {
+	return "?"
+}
+
+// UniqueViolation returns the columns of unique and primary key
+// violations, like customers.username_key of
+//
+//	UNIQUE constraint failed: customers.username_key
+//
+// SQLite doesn't name the constraint.
+func (Dialect) UniqueViolation(err error) (string, bool) {
+	var e sqlite3.Error
+	if !errors.As(err, &e) || (e.ExtendedCode != sqlite3.ErrConstraintUnique && e.ExtendedCode != sqlite3.ErrConstraintPrimaryKey) {
+		return "", false
+	}
+	msg := e.Error()
+	if i := strings.LastIndex(msg, ": "); i >= 0 {
+		msg = msg[i+2:]
+	}
+	return msg, true
+}
+
+// JSONField extracts the text of key from the JSON column. Metadata keys
+// are letters, digits, - and _, they need no escaping.
+func (Dialect) JSONField(column, key string) (string, interface{}) {
+	return "json_extract(" + column + ", ?)", `$."` + key + `"`
+}
+
+// JSONContains looks for the text among the elements of the JSON array.
+func (Dialect) JSONContains(column string) string {
+	return "EXISTS (SELECT 1 FROM json_each(" + column + ") WHERE value = ?)"
+}
+
+// Day formats the timestamp column, stored as text in UTC.
+func (Dialect) Day(column string) string {
+	return "strftime('%Y-%m-%d', " + column + ")"
+}
+
+// ForUpdate is empty, transactions lock the whole database.
+func (Dialect) ForUpdate() string {
+	return ""
+}
@@ -0,0 +1,364 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"user/changes"
+	"user/db"
+	"user/db/sqldb"
+	"user/users"
+)
+
+var (
+	_ db.Database = &SQLite{}
+	_ db.Tenanted = &SQLite{}
+	_ db.Outbox   = &SQLite{}
+)
+
+func TestMigrations(t *testing.T) {
+	if err := sqldb.Validate(Migrations); err != nil {
+		t.Fatal(err)
+	}
+	for k, m := range Migrations {
+		if m.Version != k+1 {
+			t.Errorf("expected version %v of %v, got %v", k+1, m.Name, m.Version)
+		}
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+	db.AutoMigrate = false
+	defer func() { db.AutoMigrate = true }()
+	s := open(t)
+	if s.Migrated() {
+		t.Error("expected the migrations left to userctl migrate")
+	}
+	status, err := s.MigrationStatus(ctx)
+	if err != nil || len(status) != len(Migrations) || status[0].AppliedAt != nil {
+		t.Fatalf("expected every migration pending, got %v %v", status, err)
+	}
+
+	// Another instance migrating makes this one ready.
+	other := &SQLite{Path: s.Path}
+	if err := other.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if err := other.Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !s.Migrated() {
+		t.Error("expected the migrations applied by the other instance seen")
+	}
+	if status, _ := s.MigrationStatus(ctx); status[len(status)-1].AppliedAt == nil {
+		t.Errorf("expected the migrations applied, got %v", status)
+	}
+
+	// Data migrations run with the statements of their version.
+	ms := append(append([]sqldb.Migration(nil), Migrations...), sqldb.Migration{Version: len(Migrations) + 1, Name: "rename",
+		Statements: []string{`UPDATE customers SET first_name = 'Eve'`},
+		Func: func(ctx context.Context, tx *sql.Tx) error {
+			_, err := tx.ExecContext(ctx, `UPDATE customers SET last_name = first_name`)
+			return err
+		}})
+	if err := s.CreateUser(ctx, &users.User{Username: "eve"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sqldb.Migrate(ctx, s.DB, s.Dialect, ms); err != nil {
+		t.Fatal(err)
+	}
+	var last string
+	if err := s.DB.QueryRow(`SELECT last_name FROM customers`).Scan(&last); err != nil || last != "Eve" {
+		t.Errorf("expected the data migrated, got %q %v", last, err)
+	}
+}
+
+func TestUniqueEmails(t *testing.T) {
+	ctx := context.Background()
+	db.AutoMigrate = false
+	s := open(t)
+	db.AutoMigrate = true
+	if err := sqldb.Migrate(ctx, s.DB, s.Dialect, Migrations[:1]); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"eve", "eva"} {
+		if err := s.CreateUser(ctx, &users.User{Username: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.DB.Exec(`UPDATE customers SET email = 'eve@example.com'`); err != nil {
+		t.Fatal(err)
+	}
+
+	// Init goes on, the failure is reported until the duplicates are gone.
+	other := &SQLite{Path: s.Path}
+	if err := other.Init(); err != nil {
+		t.Fatalf("expected Init to leave the failed migration to readiness, got %v", err)
+	}
+	defer other.Close()
+	var failed *db.MigrationError
+	if !errors.As(other.MigrationFailure(), &failed) || failed.Version != 2 || other.Migrated() {
+		t.Fatalf("expected the unique emails failing, got %v", other.MigrationFailure())
+	}
+	if _, err := s.DB.Exec(`UPDATE customers SET email = '' WHERE username = 'eva'`); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Migrate(ctx); err != nil || other.MigrationFailure() != nil {
+		t.Fatalf("expected the migration applied, got %v", err)
+	}
+	_, err := s.DB.Exec(`UPDATE customers SET email = 'eve@example.com'`)
+	if c, ok := s.Dialect.UniqueViolation(err); !ok || c != "customers.email" {
+		t.Errorf("expected duplicate emails rejected, got %v", err)
+	}
+}
+
+func TestReplica(t *testing.T) {
+	ctx := context.Background()
+	s, replica := open(t), open(t)
+	s.Replica = replica.DB
+	defer func() { s.Replica = nil }()
+	u := users.User{Username: "eve"}
+	if err := s.CreateUser(ctx, &u); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetUser(ctx, u.UserID); err != nil {
+		t.Errorf("expected the user read from the primary, got %v", err)
+	}
+	if _, err := s.GetUser(db.WithReadPreference(ctx, db.SecondaryPreferred), u.UserID); err == nil {
+		t.Error("expected the user read from the replica, not replicated to in the test")
+	}
+	if _, err := s.GetUserByName(db.WithReadPreference(ctx, db.Secondary), "eve"); err != nil {
+		t.Errorf("expected logins read from the primary, got %v", err)
+	}
+}
+
+func TestTenantPath(t *testing.T) {
+	for path, expected := range map[string]string{
+		"users.db":       "users_acme.db",
+		"/data/users.db": "/data/users_acme.db",
+		"users":          "users_acme",
+	} {
+		if got := tenantPath(path, "acme"); got != expected {
+			t.Errorf("%v: expected %v, got %v", path, expected, got)
+		}
+	}
+}
+
+func TestUniqueViolation(t *testing.T) {
+	s := open(t)
+	insert := `INSERT INTO user_groups (id, name, created_at) VALUES ('g', 'group', '2020-01-01')`
+	if _, err := s.DB.Exec(insert); err != nil {
+		t.Fatal(err)
+	}
+	_, err := s.DB.Exec(insert)
+	if got, ok := s.Dialect.UniqueViolation(err); !ok || got != "user_groups.id" {
+		t.Errorf("expected a violation of user_groups.id, got %v %v", got, ok)
+	}
+	if _, ok := s.Dialect.UniqueViolation(errors.New("UNIQUE constraint failed")); ok {
+		t.Error("expected only SQLite errors to be unique violations")
+	}
+}
+
+func TestCanceled(t *testing.T) {
+	s := open(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := s.CreateUser(ctx, &users.User{Username: "eve"}); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the write canceled, got %v", err)
+	}
+	if _, err := s.GetUsers(ctx, db.UserQuery{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the read canceled, got %v", err)
+	}
+}
+
+func open(t *testing.T) *SQLite {
+	s := &SQLite{Path: filepath.Join(t.TempDir(), "data", "users.db")}
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestSQLite(t *testing.T) {
+	ctx := context.Background()
+	s := open(t)
+	var mode string
+	if err := s.DB.QueryRow(`PRAGMA journal_mode`).Scan(&mode); err != nil || mode != "wal" {
+		t.Errorf("expected WAL mode, got %v %v", mode, err)
+	}
+
+	u := users.User{Username: "Eve", Email: "eve@example.com", Tags: []string{"vip"},
+		Addresses: []users.Address{{Street: "street", Type: users.AddressBilling, Default: true}},
+		Cards:     []users.Card{{LongNum: "4111111111111111", Expires: "01/30"}}}
+	if err := s.CreateUser(ctx, &u); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.GetUserByName(ctx, "eve")
+	if err != nil || got.UserID != u.UserID || len(got.Addresses) != 1 || len(got.Cards) != 1 || got.Tags[0] != "vip" {
+		t.Fatalf("expected the created user, got %+v %v", got, err)
+	}
+	if err := s.GetUserAttributes(ctx, &got); err != nil || got.Addresses[0].Street != "street" {
+		t.Errorf("expected the addresses, got %+v %v", got.Addresses, err)
+	}
+	dup := users.User{Username: "EVE"}
+	if err := s.CreateUser(ctx, &dup); !errors.Is(err, db.ErrConflict) {
+		t.Errorf("expected a username conflict, got %v", err)
+	}
+
+	if err := s.RenameUser(ctx, u.UserID, "eve2"); err != nil {
+		t.Fatal(err)
+	}
+	if prev, err := s.GetUserByPreviousName(ctx, "Eve", time.Now().Add(-time.Minute)); err != nil || prev.UserID != u.UserID {
+		t.Errorf("expected the renamed user, got %+v %v", prev, err)
+	}
+	v := "1"
+	if err := s.UpdateUser(ctx, u.UserID, users.ProfileUpdate{Metadata: map[string]*string{"crm": &v}}); err != nil {
+		t.Fatal(err)
+	}
+	if us, err := s.GetUsers(ctx, db.UserQuery{Metadata: map[string]string{"crm": "1"}, Tag: "vip"}); err != nil || len(us) != 1 {
+		t.Errorf("expected the user by metadata and tag, got %v %v", us, err)
+	}
+	if us, err := s.GetUsers(ctx, db.UserQuery{Metadata: map[string]string{"crm": "2"}}); err != nil || len(us) != 0 {
+		t.Errorf("expected no user by other metadata, got %v %v", us, err)
+	}
+	guest := users.NewGuest()
+	if err := s.CreateUser(ctx, &guest); err != nil {
+		t.Fatal(err)
+	}
+	if us, err := s.GetUsers(ctx, db.UserQuery{Role: users.RoleGuest, CreatedBefore: time.Now().Add(time.Minute)}); err != nil || len(us) != 1 || us[0].UserID != guest.UserID {
+		t.Errorf("expected the guest by role, got %v %v", us, err)
+	}
+	if us, err := s.GetUsers(ctx, db.UserQuery{Role: users.RoleGuest, CreatedBefore: time.Now().Add(-time.Minute)}); err != nil || len(us) != 0 {
+		t.Errorf("expected no guest created before, got %v %v", us, err)
+	}
+
+	other := users.User{Username: "mallory", Tags: []string{"new"}}
+	if err := s.CreateUser(ctx, &other); err != nil {
+		t.Fatal(err)
+	}
+	if us, err := s.GetUsers(ctx, db.UserQuery{Sort: "-username", Limit: 1}); err != nil || len(us) != 1 || us[0].UserID != other.UserID {
+		t.Errorf("expected only mallory, got %v %v", us, err)
+	}
+	if err := s.MergeUsers(ctx, u.UserID, other.UserID, users.ProfileUpdate{}); err != nil {
+		t.Fatal(err)
+	}
+	if target, err := s.ResolveAlias(ctx, other.UserID); err != nil || target != u.UserID {
+		t.Errorf("expected an alias of the merged user, got %v %v", target, err)
+	}
+	if err := s.TombstoneCard(ctx, u.Cards[0].ID, "************1111", ""); err != nil {
+		t.Fatal(err)
+	}
+	if cs, err := s.GetCardsByID(ctx, []string{u.Cards[0].ID}); err != nil || len(cs) != 0 {
+		t.Errorf("expected the deleted card left out, got %v %v", cs, err)
+	}
+	res, err := s.DeleteUsers(ctx, []string{u.UserID, "missing"})
+	if err != nil || res[u.UserID] != nil || res["missing"] == nil {
+		t.Errorf("unexpected deletions %v %v", res, err)
+	}
+	if _, err := s.GetUser(ctx, u.UserID); err == nil {
+		t.Error("expected the deleted user gone")
+	}
+}
+
+// TestConcurrentCreate checks writers wait for each other instead of
+// failing with a busy database.
+func TestConcurrentCreate(t *testing.T) {
+	ctx := context.Background()
+	s := open(t)
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			u := users.User{Username: "user" + string(rune('a'+i))}
+			errs <- s.CreateUser(ctx, &u)
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestTenant(t *testing.T) {
+	ctx := context.Background()
+	s := open(t)
+	u := users.User{Username: "eve"}
+	if err := s.CreateUser(ctx, &u); err != nil {
+		t.Fatal(err)
+	}
+	tenant, err := s.Tenant("acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tenant.GetUserByName(ctx, "eve"); err == nil {
+		t.Error("expected the tenant not to see the user of another")
+	}
+	if again, _ := s.Tenant("acme"); again != tenant {
+		t.Error("expected the same database for the tenant")
+	}
+}
+
+func TestOutbox(t *testing.T) {
+	ctx := context.Background()
+	s := open(t)
+	u := users.User{Username: "outbox"}
+	if err := s.CreateUser(ctx, &u); err != nil {
+		t.Fatal(err)
+	}
+	a := users.Address{Street: "Main"}
+	if err := s.CreateAddress(ctx, &a, u.UserID); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RecordLogin(ctx, u.UserID, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(ctx, "customers", u.UserID); err != nil {
+		t.Fatal(err)
+	}
+
+	// Canceled while publishing, the changes stay in the outbox.
+	cctx, cancel := context.WithCancel(ctx)
+	var first []changes.Event
+	err := s.RelayOutbox(cctx, func(e changes.Event) {
+		first = append(first, e)
+		cancel()
+	})
+	if err != nil || len(first) != 4 {
+		t.Fatalf("expected the changes published, got %v %v", first, err)
+	}
+	tctx, cancel := context.WithTimeout(ctx, 500*time.Millisecond)
+	defer cancel()
+	var es []changes.Event
+	if err := s.RelayOutbox(tctx, func(e changes.Event) { es = append(es, e) }); err != nil {
+		t.Fatal(err)
+	}
+	want := []changes.Type{changes.UserCreated, changes.AddressCreated, changes.AddressDeleted, changes.UserDeleted}
+	if len(es) != len(want) {
+		t.Fatalf("expected the changes published again, got %v", es)
+	}
+	for k, e := range es {
+		if e.Type != want[k] || e.UserID != u.UserID || e.Key != first[k].Key {
+			t.Errorf("expected %v of %v keyed %v, got %v", want[k], u.UserID, first[k].Key, e)
+		}
+	}
+	if es[1].ResourceID != a.ID {
+		t.Errorf("expected the address %v, got %v", a.ID, es[1].ResourceID)
+	}
+	var n int
+	if err := s.DB.QueryRow(`SELECT COUNT(*) FROM outbox`).Scan(&n); err != nil || n != 0 {
+		t.Errorf("expected the relayed changes removed, got %v %v", n, err)
+	}
+}
@@ -0,0 +1,34 @@
+package db
+
+import "time"
+
+// Stats are the totals served to admins.
+type Stats struct {
+	Users     int `json:"users"`
+	Addresses int `json:"addresses"`
+	Cards     int `json:"cards"`
+	// Signups counts new users per UTC day, oldest first.
+	Signups []DailyCount `json:"signups"`
+	// Active counts users who logged in since the requested time.
+	Active int `json:"active"`
+}
+
+// DailyCount is a count for one UTC day.
+type DailyCount struct {
+	Day   string `json:"day"`
+	Count int    `json:"count"`
+}
+
+// DayFormat is the layout of DailyCount.Day.
+const DayFormat = "2006-01-02"
+
+// Days returns a zero count for every day from since up to and including
+// until, filled in from counts keyed by day.
+func Days(since, until time.Time, counts map[string]int) []DailyCount {
+	ds := make([]DailyCount, 0)
+	for d := since.UTC().Truncate(24 * time.Hour); !d.After(until); d = d.Add(24 * time.Hour) {
+		day := d.Format(DayFormat)
+		ds = append(ds, DailyCount{Day: day, Count: counts[day]})
+	}
+	return ds
+}
@@ -0,0 +1,15 @@
+package db
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDays(t *testing.T) {
+	since := time.Date(2016, 8, 30, 15, 0, 0, 0, time.UTC)
+	until := time.Date(2016, 9, 1, 9, 0, 0, 0, time.UTC)
+	ds := Days(since, until, map[string]int{"2016-08-31": 4})
+	if len(ds) != 3 || ds[0].Day != "2016-08-30" || ds[1].Count != 4 || ds[2].Day != "2016-09-01" {
+		t.Errorf("unexpected days %v", ds)
+	}
+}
@@ -0,0 +1,104 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+const (
+	// DefaultPingInterval is how often a Supervisor pings the database.
+	DefaultPingInterval = 5 * time.Second
+	// DefaultMaxBackoff is the longest a Supervisor waits between
+	// reconnects.
+	DefaultMaxBackoff = time.Minute
+)
+
+// ErrDegraded is matched by the errors of a Supervisor whose database
+// can't be reached.
+var ErrDegraded = errors.New("database unreachable")
+
+// Supervisor keeps the database of Store connected. It pings the database
+// every Interval and, once a ping fails, reconnects it until it can be
+// reached again, waiting Interval between the first attempts and twice as
+// long after every further one, up to MaxBackoff. Meanwhile Err reports
+// the database degraded, for the readiness of the service, so the instance
+// is taken out of rotation rather than restarted. Interval and MaxBackoff
+// default to DefaultPingInterval and DefaultMaxBackoff.
+type Supervisor struct {
+	Store      *Store
+	Interval   time.Duration
+	MaxBackoff time.Duration
+	Logger     log.Logger
+
+	mu  sync.RWMutex
+	err error
+}
+
+// Err returns why the database is degraded, nil while it can be reached.
+func (s *Supervisor) Err() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.err
+}
+
+// Run supervises the database until stop is closed.
+func (s *Supervisor) Run(stop <-chan struct{}) {
+	interval, max := s.Interval, s.MaxBackoff
+	if interval <= 0 {
+		interval = DefaultPingInterval
+	}
+	if max <= 0 {
+		max = DefaultMaxBackoff
+	}
+	backoff := interval
+	for {
+		wait := interval
+		if s.check(interval) {
+			backoff = interval
+		} else {
+			wait = backoff
+			if backoff *= 2; backoff > max {
+				backoff = max
+			}
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// check pings the database, or reconnects it while degraded, and reports
+// whether it can be reached. Each attempt may take up to timeout.
+func (s *Supervisor) check(timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	degraded := s.Err() != nil
+	var err error
+	if degraded {
+		err = s.Store.Reconnect(ctx)
+	} else {
+		err = s.Store.Ping(ctx)
+	}
+	switch {
+	case err != nil && !degraded:
+		s.Logger.Log("db", "degraded", "err", err)
+	case err != nil:
+		s.Logger.Log("db", "reconnect", "err", err)
+	case degraded:
+		s.Logger.Log("db", "reconnected")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = nil
+	if err != nil {
+		s.err = fmt.Errorf("%w: %w", ErrDegraded, err)
+	}
+	return err == nil
+}
@@ -0,0 +1,28 @@
+package db
+
+import (
+	"errors"
+	"regexp"
+)
+
+var (
+	//ErrInvalidTenant is returned for tenant ids that are not lowercase alphanumerics and dashes
+	ErrInvalidTenant = errors.New("Invalid tenant")
+	//ErrNoTenancy is returned when the database does not support tenants
+	ErrNoTenancy = errors.New("Database does not support tenants")
+
+	tenantPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,31}$`)
+)
+
+// Tenanted is implemented by databases keeping the data of each tenant
+// apart. Every query and index of the returned Database only sees the data
+// of that tenant.
+type Tenanted interface {
+	Tenant(string) (Database, error)
+}
+
+// ValidTenant reports whether id can name a tenant: up to 32 lowercase
+// letters, digits and dashes, not starting with a dash.
+func ValidTenant(id string) bool {
+	return tenantPattern.MatchString(id)
+}
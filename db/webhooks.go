@@ -0,0 +1,6 @@
+package db
+
+import "time"
+
+// WebhookDeliveryTTL is how long the delivery log of webhooks is kept.
+const WebhookDeliveryTTL = 7 * 24 * time.Hour
@@ -0,0 +1,407 @@
+package graphql
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+// Request is a GraphQL request as posted by clients.
+type Request struct {
+	Query         string                 `json:"query"`
+	Variables     map[string]interface{} `json:"variables,omitempty"`
+	OperationName string                 `json:"operationName,omitempty"`
+}
+
+// Response is the result of executing a Request. Data is absent when the
+// request could not be executed at all.
+type Response struct {
+	Data   interface{} `json:"data,omitempty"`
+	Errors []*Error    `json:"errors,omitempty"`
+}
+
+// Error is an error of a request, located at Path for errors raised by
+// resolvers.
+type Error struct {
+	Message string        `json:"message"`
+	Path    []interface{} `json:"path,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Execute runs the request against the schema.
+func (s *Schema) Execute(ctx context.Context, r Request) Response {
+	doc, err := parse(r.Query)
+	if err != nil {
+		return Response{Errors: []*Error{{Message: err.Error()}}}
+	}
+	op, err := doc.operation(r.OperationName)
+	if err != nil {
+		return Response{Errors: []*Error{{Message: err.Error()}}}
+	}
+	if errs := s.validate(doc, op); len(errs) > 0 {
+		return Response{Errors: errs}
+	}
+	vars, err := coerceVariables(op, r.Variables)
+	if err != nil {
+		return Response{Errors: []*Error{{Message: err.Error()}}}
+	}
+	e := &executor{ctx: ctx, doc: doc, vars: vars}
+	data := e.selectionSet(s.Query, []interface{}{nil}, [][]interface{}{nil}, op.selection)
+	return Response{Data: data[0], Errors: e.errors}
+}
+
+func (d *document) operation(name string) (*operation, error) {
+	if name == "" {
+		if len(d.operations) > 1 {
+			return nil, fmt.Errorf("Must provide operation name if query contains multiple operations.")
+		}
+		return d.operations[0], nil
+	}
+	for _, op := range d.operations {
+		if op.name == name {
+			return op, nil
+		}
+	}
+	return nil, fmt.Errorf("Unknown operation named %q.", name)
+}
+
+func coerceVariables(op *operation, given map[string]interface{}) (map[string]interface{}, error) {
+	vars := map[string]interface{}{}
+	for _, def := range op.variables {
+		v, ok := given[def.name]
+		if !ok && def.defValue.kind != "" {
+			var err error
+			if v, err = def.defValue.resolve(nil); err != nil {
+				return nil, err
+			}
+		}
+		if v == nil && def.nonNull {
+			return nil, fmt.Errorf("Variable \"$%v\" of required type %q was not provided.", def.name, def.typ)
+		}
+		vars[def.name] = v
+	}
+	return vars, nil
+}
+
+type executor struct {
+	ctx    context.Context
+	doc    *document
+	vars   map[string]interface{}
+	errors []*Error
+}
+
+func (e *executor) errorf(path []interface{}, format string, args ...interface{}) {
+	e.errors = append(e.errors, &Error{Message: fmt.Sprintf(format, args...), Path: path})
+}
+
+// selectionSet resolves sel on every source of type obj, returning one
+// result object per source.
+func (e *executor) selectionSet(obj *Object, sources []interface{}, paths [][]interface{}, sel []selection) []interface{} {
+	results := make([]*result, len(sources))
+	for i := range results {
+		results[i] = &result{values: map[string]interface{}{}}
+	}
+	keys, fields := e.collect(obj, sel, map[string]bool{}, nil, map[string][]*field{})
+	for _, key := range keys {
+		nodes := fields[key]
+		f := nodes[0]
+		childPaths := make([][]interface{}, len(paths))
+		for i, p := range paths {
+			childPaths[i] = appendPath(p, key)
+		}
+		var values []interface{}
+		if f.name == "__typename" {
+			values = make([]interface{}, len(sources))
+			for i := range values {
+				values[i] = obj.Name
+			}
+		} else {
+			def := obj.Fields[f.name]
+			values = e.complete(def.Type, e.resolve(def, f, sources, childPaths), childPaths, nodes)
+		}
+		for i, r := range results {
+			r.set(key, values[i])
+		}
+	}
+	out := make([]interface{}, len(results))
+	for i, r := range results {
+		out[i] = r
+	}
+	return out
+}
+
+// collect gathers the fields of sel applying to obj by response key,
+// flattening fragments.
+func (e *executor) collect(obj *Object, sel []selection, visited map[string]bool, keys []string, fields map[string][]*field) ([]string, map[string][]*field) {
+	for _, s := range sel {
+		switch s := s.(type) {
+		case *field:
+			if !e.included(s.directives) {
+				continue
+			}
+			k := s.key()
+			if _, ok := fields[k]; !ok {
+				keys = append(keys, k)
+			}
+			fields[k] = append(fields[k], s)
+		case *fragmentSpread:
+			if !e.included(s.directives) || visited[s.name] {
+				continue
+			}
+			visited[s.name] = true
+			f := e.doc.fragments[s.name]
+			if f.on == obj.Name {
+				keys, fields = e.collect(obj, f.selection, visited, keys, fields)
+			}
+		case *inlineFragment:
+			if !e.included(s.directives) || s.on != "" && s.on != obj.Name {
+				continue
+			}
+			keys, fields = e.collect(obj, s.selection, visited, keys, fields)
+		}
+	}
+	return keys, fields
+}
+
+// included evaluates the @skip and @include directives.
+func (e *executor) included(dirs []*directive) bool {
+	for _, d := range dirs {
+		if d.name != "skip" && d.name != "include" {
+			continue
+		}
+		for _, a := range d.args {
+			if a.name != "if" {
+				continue
+			}
+			v, _ := a.value.resolve(e.vars)
+			if b, _ := v.(bool); b == (d.name == "skip") {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// resolve resolves the field f of def on every source.
+func (e *executor) resolve(def *Field, f *field, sources []interface{}, paths [][]interface{}) []interface{} {
+	values := make([]interface{}, len(sources))
+	args, err := e.arguments(def, f)
+	if err != nil {
+		for _, p := range paths {
+			e.errorf(p, "%v", err)
+		}
+		return values
+	}
+	switch {
+	case def.Batch != nil:
+		vs, err := def.Batch(e.ctx, BatchParams{Sources: sources, Args: args})
+		if err == nil && len(vs) != len(sources) {
+			err = fmt.Errorf("batch resolver of %q returned %v values for %v sources", f.name, len(vs), len(sources))
+		}
+		if err != nil {
+			for _, p := range paths {
+				e.errorf(p, "%v", err)
+			}
+			return values
+		}
+		return vs
+	case def.Resolve != nil:
+		for i, src := range sources {
+			v, err := def.Resolve(e.ctx, ResolveParams{Source: src, Args: args})
+			if err != nil {
+				e.errorf(paths[i], "%v", err)
+				continue
+			}
+			values[i] = v
+		}
+	default:
+		for i, src := range sources {
+			values[i] = defaultResolve(src, f.name)
+		}
+	}
+	return values
+}
+
+// arguments coerces the arguments of f to the types declared by def.
+func (e *executor) arguments(def *Field, f *field) (map[string]interface{}, error) {
+	args := map[string]interface{}{}
+	for name, t := range def.Args {
+		var v interface{}
+		for _, a := range f.args {
+			if a.name != name {
+				continue
+			}
+			var err error
+			if v, err = a.value.resolve(e.vars); err != nil {
+				return nil, err
+			}
+		}
+		c, err := coerce(t, v)
+		if err != nil {
+			return nil, fmt.Errorf("Argument %q: %v", name, err)
+		}
+		if c != nil {
+			args[name] = c
+		}
+	}
+	return args, nil
+}
+
+func coerce(t Type, v interface{}) (interface{}, error) {
+	switch t := t.(type) {
+	case *NonNull:
+		if v == nil {
+			return nil, fmt.Errorf("expected non null value of type %q", t.String())
+		}
+		return coerce(t.OfType, v)
+	case *List:
+		if v == nil {
+			return nil, nil
+		}
+		items, ok := v.([]interface{})
+		if !ok {
+			items = []interface{}{v}
+		}
+		l := make([]interface{}, len(items))
+		for i, item := range items {
+			c, err := coerce(t.OfType, item)
+			if err != nil {
+				return nil, err
+			}
+			l[i] = c
+		}
+		return l, nil
+	case *Scalar:
+		if v == nil {
+			return nil, nil
+		}
+		return t.Parse(v)
+	}
+	return nil, fmt.Errorf("%v is not an input type", t)
+}
+
+// complete serializes resolved values of type t, resolving the selection
+// of nodes on object values.
+func (e *executor) complete(t Type, values []interface{}, paths [][]interface{}, nodes []*field) []interface{} {
+	out := make([]interface{}, len(values))
+	switch t := t.(type) {
+	case *NonNull:
+		out = e.complete(t.OfType, values, paths, nodes)
+		for i, v := range out {
+			if v == nil {
+				e.errorf(paths[i], "Cannot return null for non-nullable field %q.", nodes[0].name)
+			}
+		}
+	case *Scalar:
+		for i, v := range values {
+			if isNil(v) {
+				continue
+			}
+			s, err := t.Serialize(v)
+			if err != nil {
+				e.errorf(paths[i], "%v", err)
+				continue
+			}
+			out[i] = s
+		}
+	case *List:
+		var items []interface{}
+		var itemPaths [][]interface{}
+		lens := make([]int, len(values))
+		for i, v := range values {
+			lens[i] = -1
+			if isNil(v) {
+				continue
+			}
+			rv := reflect.ValueOf(v)
+			if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+				e.errorf(paths[i], "Expected a list for field %q.", nodes[0].name)
+				continue
+			}
+			lens[i] = rv.Len()
+			for j := 0; j < rv.Len(); j++ {
+				items = append(items, rv.Index(j).Interface())
+				itemPaths = append(itemPaths, appendPath(paths[i], j))
+			}
+		}
+		done := e.complete(t.OfType, items, itemPaths, nodes)
+		for i, n := range lens {
+			if n < 0 {
+				continue
+			}
+			l := make([]interface{}, n)
+			copy(l, done)
+			out[i] = l
+			done = done[n:]
+		}
+	case *Object:
+		var sources []interface{}
+		var sourcePaths [][]interface{}
+		var index []int
+		for i, v := range values {
+			if isNil(v) {
+				continue
+			}
+			sources = append(sources, v)
+			sourcePaths = append(sourcePaths, paths[i])
+			index = append(index, i)
+		}
+		if len(sources) == 0 {
+			return out
+		}
+		var sel []selection
+		for _, n := range nodes {
+			sel = append(sel, n.selection...)
+		}
+		for j, r := range e.selectionSet(t, sources, sourcePaths, sel) {
+			out[index[j]] = r
+		}
+	}
+	return out
+}
+
+func appendPath(p []interface{}, key interface{}) []interface{} {
+	q := make([]interface{}, len(p)+1)
+	copy(q, p)
+	q[len(p)] = key
+	return q
+}
+
+// result is a response object keeping its keys in the order of the query.
+type result struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+func (r *result) set(key string, v interface{}) {
+	if _, ok := r.values[key]; !ok {
+		r.keys = append(r.keys, key)
+	}
+	r.values[key] = v
+}
+
+// MarshalJSON encodes the object with its keys in query order.
+func (r *result) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, k := range r.keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		kb, _ := json.Marshal(k)
+		b.Write(kb)
+		b.WriteByte(':')
+		vb, err := json.Marshal(r.values[k])
+		if err != nil {
+			return nil, err
+		}
+		b.Write(vb)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
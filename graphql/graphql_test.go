@@ -0,0 +1,198 @@
+package graphql
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testPet struct {
+	Name string `json:"name"`
+}
+
+type testPerson struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	Age     int       `json:"age"`
+	Born    time.Time `json:"born"`
+	PetIDs  []string  `json:"-"`
+	private string
+}
+
+func testSchema(batches *int) *Schema {
+	people := map[string]testPerson{
+		"1": {ID: "1", Name: "Ann", Age: 41, Born: time.Date(1980, 1, 2, 0, 0, 0, 0, time.UTC), PetIDs: []string{"a", "b"}},
+		"2": {ID: "2", Name: "Bob", Age: 7, PetIDs: []string{"c"}},
+		"3": {ID: "3", Name: "Cid"},
+	}
+	pets := map[string]testPet{"a": {"Rex"}, "b": {"Tom"}, "c": {"Kit"}}
+	pet := &Object{Name: "Pet", Fields: map[string]*Field{
+		"name": {Type: String},
+	}}
+	person := &Object{Name: "Person", Fields: map[string]*Field{
+		"id":   {Type: NonNullOf(ID)},
+		"name": {Type: String},
+		"age":  {Type: Int},
+		"born": {Type: DateTime},
+		"pets": {
+			Type: ListOf(pet),
+			Args: map[string]Type{"first": Int},
+			Batch: func(ctx context.Context, p BatchParams) ([]interface{}, error) {
+				*batches++
+				out := make([]interface{}, len(p.Sources))
+				for i, s := range p.Sources {
+					var ps []testPet
+					for _, id := range s.(testPerson).PetIDs {
+						ps = append(ps, pets[id])
+					}
+					if n, ok := p.Args["first"].(int); ok && n < len(ps) {
+						ps = ps[:n]
+					}
+					out[i] = ps
+				}
+				return out, nil
+			},
+		},
+		"secret": {
+			Type: String,
+			Resolve: func(ctx context.Context, p ResolveParams) (interface{}, error) {
+				return nil, errors.New("Forbidden")
+			},
+		},
+	}}
+	return &Schema{Query: &Object{Name: "Query", Fields: map[string]*Field{
+		"person": {
+			Type: person,
+			Args: map[string]Type{"id": NonNullOf(ID)},
+			Resolve: func(ctx context.Context, p ResolveParams) (interface{}, error) {
+				if u, ok := people[p.Args["id"].(string)]; ok {
+					return u, nil
+				}
+				return nil, nil
+			},
+		},
+		"people": {
+			Type: ListOf(person),
+			Resolve: func(ctx context.Context, p ResolveParams) (interface{}, error) {
+				return []testPerson{people["1"], people["2"], people["3"]}, nil
+			},
+		},
+	}}}
+}
+
+func execute(t *testing.T, s *Schema, r Request) (string, []*Error) {
+	res := s.Execute(context.Background(), r)
+	b, err := json.Marshal(res.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b), res.Errors
+}
+
+func TestExecute(t *testing.T) {
+	var batches int
+	s := testSchema(&batches)
+	tests := []struct {
+		req  Request
+		data string
+	}{
+		{Request{Query: `{ person(id: "1") { name age born } }`},
+			`{"person":{"name":"Ann","age":41,"born":"1980-01-02T00:00:00Z"}}`},
+		{Request{Query: `query P($id: ID!) { who: person(id: $id) { n: name, __typename } }`, Variables: map[string]interface{}{"id": "2"}},
+			`{"who":{"n":"Bob","__typename":"Person"}}`},
+		{Request{Query: `{ person(id: "404") { name } }`},
+			`{"person":null}`},
+		{Request{Query: `{ people { id ...P } } fragment P on Person { pets(first: 1) { name } }`},
+			`{"people":[{"id":"1","pets":[{"name":"Rex"}]},{"id":"2","pets":[{"name":"Kit"}]},{"id":"3","pets":null}]}`},
+		{Request{Query: `query($skip: Boolean = true) { person(id: 1) { name age @skip(if: $skip) ... on Person { id } } }`},
+			`{"person":{"name":"Ann","id":"1"}}`},
+		{Request{Query: `query A { person(id: "1") { name } } query B { person(id: "2") { name } }`, OperationName: "B"},
+			`{"person":{"name":"Bob"}}`},
+	}
+	for _, test := range tests {
+		data, errs := execute(t, s, test.req)
+		if len(errs) > 0 {
+			t.Errorf("%v: unexpected errors %v", test.req.Query, errs[0])
+		}
+		if data != test.data {
+			t.Errorf("%v: expected %v, got %v", test.req.Query, test.data, data)
+		}
+	}
+}
+
+func TestExecuteBatches(t *testing.T) {
+	var batches int
+	s := testSchema(&batches)
+	if _, errs := execute(t, s, Request{Query: `{ people { pets { name } } }`}); len(errs) > 0 {
+		t.Fatal(errs[0])
+	}
+	if batches != 1 {
+		t.Errorf("expected pets of all people to be loaded in one batch, got %v", batches)
+	}
+}
+
+func TestExecuteFieldErrors(t *testing.T) {
+	var batches int
+	data, errs := execute(t, testSchema(&batches), Request{Query: `{ people { name secret } }`})
+	if !strings.Contains(data, `{"name":"Ann","secret":null}`) {
+		t.Errorf("expected failed field to be null, got %v", data)
+	}
+	if len(errs) != 3 || errs[1].Message != "Forbidden" {
+		t.Fatalf("expected an error per person, got %v", errs)
+	}
+	if b, _ := json.Marshal(errs[1].Path); string(b) != `["people",1,"secret"]` {
+		t.Errorf("unexpected error path %s", b)
+	}
+}
+
+func TestExecuteInvalid(t *testing.T) {
+	var batches int
+	s := testSchema(&batches)
+	tests := []struct {
+		req Request
+		err string
+	}{
+		{Request{Query: `{ person(id: "1") { name `}, "Syntax Error: unexpected end of document"},
+		{Request{Query: `mutation { person }`}, "mutation operations are not supported"},
+		{Request{Query: `{ nobody { name } }`}, `Cannot query field "nobody" on type "Query".`},
+		{Request{Query: `{ person { name } }`}, `Field "person" argument "id" of type "ID!" is required but not provided.`},
+		{Request{Query: `{ person(id: "1", age: 3) { name } }`}, `Unknown argument "age" on field "Query.person".`},
+		{Request{Query: `{ person(id: "1") }`}, `Field "person" of type "Person" must have a selection of subfields.`},
+		{Request{Query: `{ person(id: "1") { name { x } } }`}, `Field "name" must not have a selection since type "String" has no subfields.`},
+		{Request{Query: `{ person(id: $id) { name } }`}, `Variable "$id" is not defined.`},
+		{Request{Query: `query($id: ID!) { person(id: $id) { name } }`}, `Variable "$id" of required type "ID!" was not provided.`},
+		{Request{Query: `{ person(id: "1") { ...F } } fragment F on Person { ...F }`}, `Cannot spread fragment "F" within itself.`},
+		{Request{Query: `{ person(id: "1") { ...F } } fragment F on Pet { name }`}, `Fragment "F" cannot be spread here as objects of type "Person" can never be of type "Pet".`},
+		{Request{Query: `query A { people { id } } query B { people { id } }`}, "Must provide operation name if query contains multiple operations."},
+	}
+	for _, test := range tests {
+		res := s.Execute(context.Background(), test.req)
+		if res.Data != nil {
+			t.Errorf("%v: expected no data, got %v", test.req.Query, res.Data)
+		}
+		if len(res.Errors) == 0 || res.Errors[0].Message != test.err {
+			t.Errorf("%v: expected %v, got %v", test.req.Query, test.err, res.Errors)
+		}
+	}
+}
+
+func TestLex(t *testing.T) {
+	toks, err := lex(`# comment
+	{ a(s: "x\"é\n", f: -1.5e3, n: 0) ... }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var vals []string
+	for _, tok := range toks {
+		vals = append(vals, tok.value)
+	}
+	if got := strings.Join(vals, "|"); got != "{|a|(|s|:|x\"é\n|f|:|-1.5e3|n|:|0|)|...|}|" {
+		t.Errorf("unexpected tokens %q", got)
+	}
+	if _, err := lex(`{ a(s: "open`); err == nil {
+		t.Error("expected unterminated string to fail")
+	}
+}
@@ -0,0 +1,162 @@
+package graphql
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokPunct
+	tokName
+	tokInt
+	tokFloat
+	tokString
+)
+
+type token struct {
+	kind  tokenKind
+	value string
+	pos   int
+}
+
+// lex splits a document into tokens, dropping whitespace, commas and
+// comments.
+func lex(src string) ([]token, error) {
+	var toks []token
+	i := 0
+	for i < len(src) {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',':
+			i++
+		case c == '#':
+			for i < len(src) && src[i] != '\n' && src[i] != '\r' {
+				i++
+			}
+		case strings.HasPrefix(src[i:], "..."):
+			toks = append(toks, token{tokPunct, "...", i})
+			i += 3
+		case strings.IndexByte("!$()[]{}:=@|&", c) >= 0:
+			toks = append(toks, token{tokPunct, string(c), i})
+			i++
+		case c == '_' || isLetter(c):
+			start := i
+			for i < len(src) && (src[i] == '_' || isLetter(src[i]) || isDigit(src[i])) {
+				i++
+			}
+			toks = append(toks, token{tokName, src[start:i], start})
+		case c == '-' || isDigit(c):
+			t, n, err := lexNumber(src, i)
+			if err != nil {
+				return nil, err
+			}
+			toks = append(toks, t)
+			i = n
+		case c == '"':
+			s, n, err := lexString(src, i)
+			if err != nil {
+				return nil, err
+			}
+			toks = append(toks, token{tokString, s, i})
+			i = n
+		default:
+			r, _ := utf8.DecodeRuneInString(src[i:])
+			return nil, fmt.Errorf("Syntax Error: unexpected character %q at %v", r, i)
+		}
+	}
+	return append(toks, token{tokEOF, "", len(src)}), nil
+}
+
+func lexNumber(src string, i int) (token, int, error) {
+	start := i
+	kind := tokInt
+	if src[i] == '-' {
+		i++
+	}
+	digits := func() {
+		for i < len(src) && isDigit(src[i]) {
+			i++
+		}
+	}
+	if i >= len(src) || !isDigit(src[i]) {
+		return token{}, 0, fmt.Errorf("Syntax Error: invalid number at %v", start)
+	}
+	digits()
+	if i < len(src) && src[i] == '.' {
+		kind = tokFloat
+		i++
+		digits()
+	}
+	if i < len(src) && (src[i] == 'e' || src[i] == 'E') {
+		kind = tokFloat
+		i++
+		if i < len(src) && (src[i] == '+' || src[i] == '-') {
+			i++
+		}
+		digits()
+	}
+	return token{kind, src[start:i], start}, i, nil
+}
+
+func lexString(src string, i int) (string, int, error) {
+	start := i
+	i++
+	var b strings.Builder
+	for i < len(src) {
+		c := src[i]
+		switch c {
+		case '"':
+			return b.String(), i + 1, nil
+		case '\n', '\r':
+			return "", 0, fmt.Errorf("Syntax Error: unterminated string at %v", start)
+		case '\\':
+			if i+1 >= len(src) {
+				return "", 0, fmt.Errorf("Syntax Error: unterminated string at %v", start)
+			}
+			i++
+			switch src[i] {
+			case '"', '\\', '/':
+				b.WriteByte(src[i])
+			case 'b':
+				b.WriteByte('\b')
+			case 'f':
+				b.WriteByte('\f')
+			case 'n':
+				b.WriteByte('\n')
+			case 'r':
+				b.WriteByte('\r')
+			case 't':
+				b.WriteByte('\t')
+			case 'u':
+				var r rune
+				if i+4 >= len(src) {
+					return "", 0, fmt.Errorf("Syntax Error: invalid escape at %v", i)
+				}
+				if _, err := fmt.Sscanf(src[i+1:i+5], "%04x", &r); err != nil {
+					return "", 0, fmt.Errorf("Syntax Error: invalid escape at %v", i)
+				}
+				b.WriteRune(r)
+				i += 4
+			default:
+				return "", 0, fmt.Errorf("Syntax Error: invalid escape at %v", i)
+			}
+			i++
+		default:
+			b.WriteByte(c)
+			i++
+		}
+	}
+	return "", 0, fmt.Errorf("Syntax Error: unterminated string at %v", start)
+}
+
+func isLetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
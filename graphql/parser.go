@@ -0,0 +1,504 @@
+package graphql
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// document is a parsed executable document.
+type document struct {
+	operations []*operation
+	fragments  map[string]*fragment
+}
+
+type operation struct {
+	name      string
+	variables []*variableDef
+	selection []selection
+}
+
+type variableDef struct {
+	name     string
+	typ      string
+	nonNull  bool
+	defValue value
+}
+
+type fragment struct {
+	name      string
+	on        string
+	selection []selection
+}
+
+// selection is a *field, *fragmentSpread or *inlineFragment.
+type selection interface{}
+
+type field struct {
+	alias      string
+	name       string
+	args       []*argument
+	directives []*directive
+	selection  []selection
+	pos        int
+}
+
+// key returns the name of the field in the response.
+func (f *field) key() string {
+	if f.alias != "" {
+		return f.alias
+	}
+	return f.name
+}
+
+type fragmentSpread struct {
+	name       string
+	directives []*directive
+}
+
+type inlineFragment struct {
+	on         string
+	directives []*directive
+	selection  []selection
+}
+
+type argument struct {
+	name  string
+	value value
+}
+
+type directive struct {
+	name string
+	args []*argument
+}
+
+// value is a literal or a variable reference.
+type value struct {
+	kind   string // Variable, Int, Float, String, Boolean, Null, Enum, List or Object
+	raw    string
+	list   []value
+	fields []*argument
+}
+
+type parser struct {
+	toks []token
+	i    int
+}
+
+// parse parses an executable document. Only query operations are accepted.
+func parse(src string) (*document, error) {
+	toks, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{toks: toks}
+	doc := &document{fragments: map[string]*fragment{}}
+	for p.peek().kind != tokEOF {
+		if err := p.definition(doc); err != nil {
+			return nil, err
+		}
+	}
+	if len(doc.operations) == 0 {
+		return nil, fmt.Errorf("Syntax Error: document has no operations")
+	}
+	return doc, nil
+}
+
+func (p *parser) peek() token {
+	return p.toks[p.i]
+}
+
+func (p *parser) next() token {
+	t := p.toks[p.i]
+	if t.kind != tokEOF {
+		p.i++
+	}
+	return t
+}
+
+func (p *parser) is(kind tokenKind, v string) bool {
+	t := p.peek()
+	return t.kind == kind && t.value == v
+}
+
+func (p *parser) skip(kind tokenKind, v string) bool {
+	if p.is(kind, v) {
+		p.i++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(kind tokenKind, v string) error {
+	if !p.skip(kind, v) {
+		return p.unexpected()
+	}
+	return nil
+}
+
+func (p *parser) name() (string, error) {
+	t := p.peek()
+	if t.kind != tokName {
+		return "", p.unexpected()
+	}
+	p.i++
+	return t.value, nil
+}
+
+func (p *parser) unexpected() error {
+	t := p.peek()
+	if t.kind == tokEOF {
+		return fmt.Errorf("Syntax Error: unexpected end of document")
+	}
+	return fmt.Errorf("Syntax Error: unexpected %q at %v", t.value, t.pos)
+}
+
+func (p *parser) definition(doc *document) error {
+	if p.is(tokPunct, "{") {
+		sel, err := p.selectionSet()
+		if err != nil {
+			return err
+		}
+		doc.operations = append(doc.operations, &operation{selection: sel})
+		return nil
+	}
+	t := p.peek()
+	if t.kind != tokName {
+		return p.unexpected()
+	}
+	switch t.value {
+	case "query":
+		p.i++
+		op, err := p.operation()
+		if err != nil {
+			return err
+		}
+		doc.operations = append(doc.operations, op)
+		return nil
+	case "fragment":
+		p.i++
+		f, err := p.fragment()
+		if err != nil {
+			return err
+		}
+		if _, ok := doc.fragments[f.name]; ok {
+			return fmt.Errorf("There can be only one fragment named %q", f.name)
+		}
+		doc.fragments[f.name] = f
+		return nil
+	case "mutation", "subscription":
+		return fmt.Errorf("%v operations are not supported", t.value)
+	}
+	return p.unexpected()
+}
+
+func (p *parser) operation() (*operation, error) {
+	op := &operation{}
+	if p.peek().kind == tokName {
+		op.name, _ = p.name()
+	}
+	if p.skip(tokPunct, "(") {
+		for !p.skip(tokPunct, ")") {
+			v, err := p.variableDef()
+			if err != nil {
+				return nil, err
+			}
+			op.variables = append(op.variables, v)
+		}
+	}
+	if _, err := p.directives(); err != nil {
+		return nil, err
+	}
+	sel, err := p.selectionSet()
+	if err != nil {
+		return nil, err
+	}
+	op.selection = sel
+	return op, nil
+}
+
+func (p *parser) variableDef() (*variableDef, error) {
+	if err := p.expect(tokPunct, "$"); err != nil {
+		return nil, err
+	}
+	name, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(tokPunct, ":"); err != nil {
+		return nil, err
+	}
+	v := &variableDef{name: name}
+	if v.typ, v.nonNull, err = p.typeRef(); err != nil {
+		return nil, err
+	}
+	if p.skip(tokPunct, "=") {
+		if v.defValue, err = p.value(true); err != nil {
+			return nil, err
+		}
+	}
+	return v, nil
+}
+
+// typeRef parses a type reference such as [ID!]!, returning its printed form
+// and whether the outer type is non null.
+func (p *parser) typeRef() (string, bool, error) {
+	var s string
+	if p.skip(tokPunct, "[") {
+		inner, _, err := p.typeRef()
+		if err != nil {
+			return "", false, err
+		}
+		if err := p.expect(tokPunct, "]"); err != nil {
+			return "", false, err
+		}
+		s = "[" + inner + "]"
+	} else {
+		name, err := p.name()
+		if err != nil {
+			return "", false, err
+		}
+		s = name
+	}
+	if p.skip(tokPunct, "!") {
+		return s + "!", true, nil
+	}
+	return s, false, nil
+}
+
+func (p *parser) fragment() (*fragment, error) {
+	name, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+	if name == "on" {
+		return nil, p.unexpected()
+	}
+	if !p.skip(tokName, "on") {
+		return nil, p.unexpected()
+	}
+	on, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := p.directives(); err != nil {
+		return nil, err
+	}
+	sel, err := p.selectionSet()
+	if err != nil {
+		return nil, err
+	}
+	return &fragment{name: name, on: on, selection: sel}, nil
+}
+
+func (p *parser) selectionSet() ([]selection, error) {
+	if err := p.expect(tokPunct, "{"); err != nil {
+		return nil, err
+	}
+	var sel []selection
+	for !p.skip(tokPunct, "}") {
+		s, err := p.selection()
+		if err != nil {
+			return nil, err
+		}
+		sel = append(sel, s)
+	}
+	if len(sel) == 0 {
+		return nil, fmt.Errorf("Syntax Error: empty selection set")
+	}
+	return sel, nil
+}
+
+func (p *parser) selection() (selection, error) {
+	if p.skip(tokPunct, "...") {
+		if p.peek().kind == tokName && p.peek().value != "on" {
+			name, _ := p.name()
+			dirs, err := p.directives()
+			if err != nil {
+				return nil, err
+			}
+			return &fragmentSpread{name: name, directives: dirs}, nil
+		}
+		f := &inlineFragment{}
+		if p.skip(tokName, "on") {
+			on, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			f.on = on
+		}
+		var err error
+		if f.directives, err = p.directives(); err != nil {
+			return nil, err
+		}
+		if f.selection, err = p.selectionSet(); err != nil {
+			return nil, err
+		}
+		return f, nil
+	}
+	pos := p.peek().pos
+	name, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+	f := &field{name: name, pos: pos}
+	if p.skip(tokPunct, ":") {
+		f.alias = name
+		if f.name, err = p.name(); err != nil {
+			return nil, err
+		}
+	}
+	if f.args, err = p.arguments(false); err != nil {
+		return nil, err
+	}
+	if f.directives, err = p.directives(); err != nil {
+		return nil, err
+	}
+	if p.is(tokPunct, "{") {
+		if f.selection, err = p.selectionSet(); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+func (p *parser) arguments(constant bool) ([]*argument, error) {
+	if !p.skip(tokPunct, "(") {
+		return nil, nil
+	}
+	var args []*argument
+	for !p.skip(tokPunct, ")") {
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(tokPunct, ":"); err != nil {
+			return nil, err
+		}
+		v, err := p.value(constant)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, &argument{name: name, value: v})
+	}
+	return args, nil
+}
+
+func (p *parser) directives() ([]*directive, error) {
+	var dirs []*directive
+	for p.skip(tokPunct, "@") {
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		args, err := p.arguments(false)
+		if err != nil {
+			return nil, err
+		}
+		dirs = append(dirs, &directive{name: name, args: args})
+	}
+	return dirs, nil
+}
+
+func (p *parser) value(constant bool) (value, error) {
+	t := p.peek()
+	switch t.kind {
+	case tokInt:
+		p.i++
+		return value{kind: "Int", raw: t.value}, nil
+	case tokFloat:
+		p.i++
+		return value{kind: "Float", raw: t.value}, nil
+	case tokString:
+		p.i++
+		return value{kind: "String", raw: t.value}, nil
+	case tokName:
+		p.i++
+		switch t.value {
+		case "true", "false":
+			return value{kind: "Boolean", raw: t.value}, nil
+		case "null":
+			return value{kind: "Null"}, nil
+		}
+		return value{kind: "Enum", raw: t.value}, nil
+	case tokPunct:
+		switch t.value {
+		case "$":
+			if constant {
+				return value{}, p.unexpected()
+			}
+			p.i++
+			name, err := p.name()
+			if err != nil {
+				return value{}, err
+			}
+			return value{kind: "Variable", raw: name}, nil
+		case "[":
+			p.i++
+			v := value{kind: "List"}
+			for !p.skip(tokPunct, "]") {
+				item, err := p.value(constant)
+				if err != nil {
+					return value{}, err
+				}
+				v.list = append(v.list, item)
+			}
+			return v, nil
+		case "{":
+			p.i++
+			v := value{kind: "Object"}
+			for !p.skip(tokPunct, "}") {
+				name, err := p.name()
+				if err != nil {
+					return value{}, err
+				}
+				if err := p.expect(tokPunct, ":"); err != nil {
+					return value{}, err
+				}
+				item, err := p.value(constant)
+				if err != nil {
+					return value{}, err
+				}
+				v.fields = append(v.fields, &argument{name: name, value: item})
+			}
+			return v, nil
+		}
+	}
+	return value{}, p.unexpected()
+}
+
+// resolve turns v into a Go value, looking variables up in vars.
+func (v value) resolve(vars map[string]interface{}) (interface{}, error) {
+	switch v.kind {
+	case "Variable":
+		return vars[v.raw], nil
+	case "Int":
+		return strconv.Atoi(v.raw)
+	case "Float":
+		return strconv.ParseFloat(v.raw, 64)
+	case "String", "Enum":
+		return v.raw, nil
+	case "Boolean":
+		return v.raw == "true", nil
+	case "List":
+		l := make([]interface{}, 0, len(v.list))
+		for _, item := range v.list {
+			r, err := item.resolve(vars)
+			if err != nil {
+				return nil, err
+			}
+			l = append(l, r)
+		}
+		return l, nil
+	case "Object":
+		m := map[string]interface{}{}
+		for _, f := range v.fields {
+			r, err := f.value.resolve(vars)
+			if err != nil {
+				return nil, err
+			}
+			m[f.name] = r
+		}
+		return m, nil
+	}
+	return nil, nil
+}
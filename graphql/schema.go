@@ -0,0 +1,321 @@
+// Package graphql implements just enough of GraphQL to serve read-only
+// queries over a fixed schema: queries with arguments, variables, aliases,
+// fragments and the @skip and @include directives. Mutations, subscriptions
+// and introspection are not supported.
+//
+// Fields are resolved level by level for all objects of a level at once, so
+// a field with a Batch resolver is called once per level with every parent
+// object rather than once per object, which is what dataloaders do for other
+// GraphQL servers.
+package graphql
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Type is the type of a field or argument: a *Scalar, an *Object or a *List
+// or *NonNull of one.
+type Type interface {
+	String() string
+}
+
+// Scalar is a leaf type.
+type Scalar struct {
+	Name string
+	// Serialize turns a resolved value into its JSON form.
+	Serialize func(interface{}) (interface{}, error)
+	// Parse coerces an argument or variable value.
+	Parse func(interface{}) (interface{}, error)
+}
+
+func (s *Scalar) String() string { return s.Name }
+
+// Object is a type with fields.
+type Object struct {
+	Name   string
+	Fields map[string]*Field
+}
+
+func (o *Object) String() string { return o.Name }
+
+// List is a list of OfType.
+type List struct {
+	OfType Type
+}
+
+func (l *List) String() string { return "[" + l.OfType.String() + "]" }
+
+// NonNull is an OfType that cannot be null.
+type NonNull struct {
+	OfType Type
+}
+
+func (n *NonNull) String() string { return n.OfType.String() + "!" }
+
+// ListOf returns a list of t.
+func ListOf(t Type) *List {
+	return &List{OfType: t}
+}
+
+// NonNullOf returns the non null type of t.
+func NonNullOf(t Type) *NonNull {
+	return &NonNull{OfType: t}
+}
+
+// Field is a field of an Object. Fields without Resolve and Batch take the
+// value of the map key or struct field of the same name from their source,
+// struct fields being matched by their json name.
+type Field struct {
+	Type Type
+	Args map[string]Type
+	// Resolve resolves the field of one source.
+	Resolve func(ctx context.Context, p ResolveParams) (interface{}, error)
+	// Batch resolves the field of all sources of a level at once,
+	// returning one value per source.
+	Batch func(ctx context.Context, p BatchParams) ([]interface{}, error)
+}
+
+// ResolveParams are passed to Resolve.
+type ResolveParams struct {
+	Source interface{}
+	Args   map[string]interface{}
+}
+
+// BatchParams are passed to Batch.
+type BatchParams struct {
+	Sources []interface{}
+	Args    map[string]interface{}
+}
+
+// Schema is the schema queries are executed against.
+type Schema struct {
+	Query *Object
+}
+
+// Built in scalars. DateTime is not part of the specification, it
+// serializes times in RFC 3339.
+var (
+	String   = &Scalar{Name: "String", Serialize: serializeString, Parse: parseString}
+	ID       = &Scalar{Name: "ID", Serialize: serializeString, Parse: parseID}
+	Int      = &Scalar{Name: "Int", Serialize: serializeInt, Parse: parseInt}
+	Float    = &Scalar{Name: "Float", Serialize: serializeFloat, Parse: parseFloat}
+	Boolean  = &Scalar{Name: "Boolean", Serialize: serializeBoolean, Parse: parseBoolean}
+	DateTime = &Scalar{Name: "DateTime", Serialize: serializeDateTime, Parse: parseString}
+)
+
+func serializeString(v interface{}) (interface{}, error) {
+	if s, ok := v.(fmt.Stringer); ok {
+		return s.String(), nil
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.String:
+		return rv.String(), nil
+	case reflect.Bool:
+		return fmt.Sprint(rv.Bool()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return fmt.Sprint(v), nil
+	}
+	return nil, fmt.Errorf("String cannot represent value: %v", v)
+}
+
+func serializeInt(v interface{}) (interface{}, error) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if n := rv.Int(); n >= math.MinInt32 && n <= math.MaxInt32 {
+			return n, nil
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if n := rv.Uint(); n <= math.MaxInt32 {
+			return int64(n), nil
+		}
+	case reflect.Float32, reflect.Float64:
+		if f := rv.Float(); f == math.Trunc(f) && f >= math.MinInt32 && f <= math.MaxInt32 {
+			return int64(f), nil
+		}
+	}
+	return nil, fmt.Errorf("Int cannot represent value: %v", v)
+}
+
+func serializeFloat(v interface{}) (interface{}, error) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(rv.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), nil
+	}
+	return nil, fmt.Errorf("Float cannot represent value: %v", v)
+}
+
+func serializeBoolean(v interface{}) (interface{}, error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Bool {
+		return rv.Bool(), nil
+	}
+	return nil, fmt.Errorf("Boolean cannot represent value: %v", v)
+}
+
+func serializeDateTime(v interface{}) (interface{}, error) {
+	switch t := v.(type) {
+	case time.Time:
+		if t.IsZero() {
+			return nil, nil
+		}
+		return t.UTC().Format(time.RFC3339Nano), nil
+	case *time.Time:
+		return serializeDateTime(*t)
+	}
+	return nil, fmt.Errorf("DateTime cannot represent value: %v", v)
+}
+
+func parseString(v interface{}) (interface{}, error) {
+	if s, ok := v.(string); ok {
+		return s, nil
+	}
+	return nil, fmt.Errorf("String cannot represent a non string value: %v", v)
+}
+
+func parseID(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case int:
+		return fmt.Sprint(v), nil
+	}
+	return nil, fmt.Errorf("ID cannot represent value: %v", v)
+}
+
+func parseInt(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case int:
+		if v >= math.MinInt32 && v <= math.MaxInt32 {
+			return v, nil
+		}
+	case float64:
+		if v == math.Trunc(v) && v >= math.MinInt32 && v <= math.MaxInt32 {
+			return int(v), nil
+		}
+	}
+	return nil, fmt.Errorf("Int cannot represent value: %v", v)
+}
+
+func parseFloat(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case int:
+		return float64(v), nil
+	case float64:
+		return v, nil
+	}
+	return nil, fmt.Errorf("Float cannot represent value: %v", v)
+}
+
+func parseBoolean(v interface{}) (interface{}, error) {
+	if b, ok := v.(bool); ok {
+		return b, nil
+	}
+	return nil, fmt.Errorf("Boolean cannot represent a non boolean value: %v", v)
+}
+
+// defaultResolve takes the field name of source, a map or a struct.
+func defaultResolve(source interface{}, name string) interface{} {
+	rv := reflect.ValueOf(source)
+	for rv.Kind() == reflect.Ptr || rv.Kind() == reflect.Interface {
+		if rv.IsNil() {
+			return nil
+		}
+		rv = rv.Elem()
+	}
+	switch rv.Kind() {
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			return nil
+		}
+		v := rv.MapIndex(reflect.ValueOf(name).Convert(rv.Type().Key()))
+		if !v.IsValid() {
+			return nil
+		}
+		return v.Interface()
+	case reflect.Struct:
+		if v, ok := structField(rv, name); ok {
+			return v.Interface()
+		}
+	}
+	return nil
+}
+
+func structField(rv reflect.Value, name string) (reflect.Value, bool) {
+	t := rv.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		tag := strings.Split(f.Tag.Get("json"), ",")[0]
+		if tag == name || tag == "" && strings.EqualFold(f.Name, name) {
+			return rv.Field(i), true
+		}
+	}
+	for i := 0; i < t.NumField(); i++ {
+		if f := t.Field(i); f.Anonymous && f.Type.Kind() == reflect.Struct {
+			if v, ok := structField(rv.Field(i), name); ok {
+				return v, true
+			}
+		}
+	}
+	return reflect.Value{}, false
+}
+
+// isNil reports whether v is nil or a nil pointer, map or slice.
+func isNil(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Slice, reflect.Interface, reflect.Func:
+		return rv.IsNil()
+	}
+	return false
+}
+
+// named returns the scalar or object at the bottom of t.
+func named(t Type) Type {
+	for {
+		switch w := t.(type) {
+		case *List:
+			t = w.OfType
+		case *NonNull:
+			t = w.OfType
+		default:
+			return t
+		}
+	}
+}
+
+// objects returns every object type reachable from o by name.
+func objects(o *Object, seen map[string]*Object) map[string]*Object {
+	if seen == nil {
+		seen = map[string]*Object{}
+	}
+	if _, ok := seen[o.Name]; ok {
+		return seen
+	}
+	seen[o.Name] = o
+	for _, f := range o.Fields {
+		if child, ok := named(f.Type).(*Object); ok {
+			objects(child, seen)
+		}
+	}
+	return seen
+}
@@ -0,0 +1,134 @@
+package graphql
+
+import (
+	"fmt"
+)
+
+// validate checks the operation against the schema before it runs.
+func (s *Schema) validate(doc *document, op *operation) []*Error {
+	v := &validator{doc: doc, types: objects(s.Query, nil), vars: map[string]bool{}}
+	for _, def := range op.variables {
+		v.vars[def.name] = true
+	}
+	for _, f := range doc.fragments {
+		if _, ok := v.types[f.on]; !ok {
+			v.errorf("Unknown type %q.", f.on)
+		}
+	}
+	v.selection(s.Query, op.selection, map[string]bool{})
+	return v.errors
+}
+
+type validator struct {
+	doc    *document
+	types  map[string]*Object
+	vars   map[string]bool
+	errors []*Error
+}
+
+func (v *validator) errorf(format string, args ...interface{}) {
+	v.errors = append(v.errors, &Error{Message: fmt.Sprintf(format, args...)})
+}
+
+func (v *validator) selection(obj *Object, sel []selection, spreading map[string]bool) {
+	for _, s := range sel {
+		switch s := s.(type) {
+		case *field:
+			v.field(obj, s, spreading)
+		case *fragmentSpread:
+			v.directives(s.directives)
+			f, ok := v.doc.fragments[s.name]
+			if !ok {
+				v.errorf("Unknown fragment %q.", s.name)
+				continue
+			}
+			if spreading[s.name] {
+				v.errorf("Cannot spread fragment %q within itself.", s.name)
+				continue
+			}
+			if f.on != obj.Name {
+				v.errorf("Fragment %q cannot be spread here as objects of type %q can never be of type %q.", s.name, obj.Name, f.on)
+				continue
+			}
+			spreading[s.name] = true
+			v.selection(obj, f.selection, spreading)
+			delete(spreading, s.name)
+		case *inlineFragment:
+			v.directives(s.directives)
+			if s.on != "" && s.on != obj.Name {
+				v.errorf("Fragment cannot be spread here as objects of type %q can never be of type %q.", obj.Name, s.on)
+				continue
+			}
+			v.selection(obj, s.selection, spreading)
+		}
+	}
+}
+
+func (v *validator) field(obj *Object, f *field, spreading map[string]bool) {
+	v.directives(f.directives)
+	if f.name == "__typename" {
+		if f.selection != nil {
+			v.errorf("Field %q must not have a selection since type \"String\" has no subfields.", f.name)
+		}
+		return
+	}
+	def, ok := obj.Fields[f.name]
+	if !ok {
+		v.errorf("Cannot query field %q on type %q.", f.name, obj.Name)
+		return
+	}
+	given := map[string]bool{}
+	for _, a := range f.args {
+		if _, ok := def.Args[a.name]; !ok {
+			v.errorf("Unknown argument %q on field %q.", a.name, obj.Name+"."+f.name)
+		}
+		given[a.name] = true
+		v.value(a.value)
+	}
+	for name, t := range def.Args {
+		if _, required := t.(*NonNull); required && !given[name] {
+			v.errorf("Field %q argument %q of type %q is required but not provided.", f.name, name, t.String())
+		}
+	}
+	switch t := named(def.Type).(type) {
+	case *Object:
+		if f.selection == nil {
+			v.errorf("Field %q of type %q must have a selection of subfields.", f.name, def.Type.String())
+			return
+		}
+		v.selection(t, f.selection, spreading)
+	default:
+		if f.selection != nil {
+			v.errorf("Field %q must not have a selection since type %q has no subfields.", f.name, def.Type.String())
+		}
+	}
+}
+
+func (v *validator) directives(dirs []*directive) {
+	for _, d := range dirs {
+		if d.name != "skip" && d.name != "include" {
+			v.errorf("Unknown directive \"@%v\".", d.name)
+			continue
+		}
+		for _, a := range d.args {
+			v.value(a.value)
+		}
+	}
+}
+
+func (v *validator) value(val value) {
+	switch val.kind {
+	case "Variable":
+		if !v.vars[val.raw] {
+			v.errorf("Variable \"$%v\" is not defined.", val.raw)
+		}
+	case "List":
+		for _, item := range val.list {
+			v.value(item)
+		}
+	case "Object":
+		for _, f := range val.fields {
+			v.value(f.value)
+		}
+	}
+}
@@ -2,9 +2,12 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/go-kit/kit/log"
+	"github.com/nats-io/nats.go"
 	stdprometheus "github.com/prometheus/client_golang/prometheus"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
@@ -12,15 +15,38 @@ import (
 	"go.opentelemetry.io/otel/sdk/resource"
 	tracesdk "go.opentelemetry.io/otel/sdk/trace"
 	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 	corelog "log"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
+	"user/address"
 	"user/api"
+	"user/archive"
+	"user/auth"
+	"user/blob"
+	"user/cardvault"
+	"user/changes"
 	"user/db"
+	"user/db/cache"
+	"user/db/dynamodb"
+	"user/db/inmem"
 	"user/db/mongodb"
+	"user/db/mysql"
+	"user/db/postgres"
+	"user/db/sqlite"
+	"user/pii"
+	"user/reminder"
+	"user/secrets"
+	"user/security"
+	"user/sms"
+	"user/webhook"
 )
 
 const (
@@ -28,8 +54,47 @@ const (
 )
 
 var (
-	port string
-	zip  string
+	port          string
+	zip           string
+	jwtKey        string
+	maxAddresses  int
+	maxCards      int
+	reminderDays  int
+	verifyAsync   bool
+	smtpAddr      string
+	smtpFrom      string
+	compressMin   int
+	compressType  string
+	corsOrigins   string
+	corsMethods   string
+	corsHeaders   string
+	corsExpose    string
+	corsMaxAge    time.Duration
+	proxies       string
+	tlsCert       string
+	tlsKey        string
+	http2On       bool
+	h2cOn         bool
+	http2Streams  uint
+	maxBody       int64
+	readTimeout   time.Duration
+	writeTimeout  time.Duration
+	routeTimes    string
+	endpointTimes string
+	readPref      string
+	endpointPrefs string
+	drainTimeout  time.Duration
+	drainDelay    time.Duration
+	natsURL       string
+	tenants       string
+	redactionFile string
+	watchDB       bool
+	relayOutbox   bool
+	guestTTL      time.Duration
+	queryTimeout  time.Duration
+	slowQuery     time.Duration
+	dbPing        time.Duration
+	dbBackoff     time.Duration
 )
 
 var (
@@ -45,10 +110,122 @@ const (
 )
 
 func init() {
-	stdprometheus.MustRegister(HTTPLatency)
+	stdprometheus.MustRegister(HTTPLatency, security.Events, security.DroppedEvents, address.DroppedGeocodes, cache.Lookups, db.SlowQueries)
 	flag.StringVar(&zip, "zipkin", os.Getenv("ZIPKIN"), "Zipkin address")
 	flag.StringVar(&port, "port", "8084", "Port on which to run")
-	db.Register("mongodb", &mongodb.Mongo{})
+	flag.StringVar(&jwtKey, "jwt-key", os.Getenv("JWT_KEY"), "Key used to sign login tokens")
+	flag.IntVar(&maxAddresses, "max-addresses", api.DefaultMaxAddresses, "Addresses a customer may have, 0 for no limit")
+	flag.IntVar(&maxCards, "max-cards", api.DefaultMaxCards, "Cards a customer may have, 0 for no limit")
+	flag.BoolVar(&verifyAsync, "card-verify-async", true, "Verify new cards in the background rather than before responding")
+	flag.IntVar(&reminderDays, "card-reminder-days", 30, "Days before expiry customers are reminded of expiring cards, 0 to never remind")
+	flag.StringVar(&smtpAddr, "smtp-addr", os.Getenv("SMTP_ADDR"), "SMTP server reminders are mailed through, no mail when empty")
+	flag.StringVar(&smtpFrom, "smtp-from", os.Getenv("SMTP_FROM"), "Sender of mailed reminders")
+	flag.IntVar(&compressMin, "compress-min-size", api.DefaultCompressMinSize, "Smallest response in bytes compressed with gzip or deflate, -1 to never compress")
+	flag.StringVar(&compressType, "compress-types", strings.Join(api.DefaultCompressTypes, ","), "Comma separated content types of the compressed responses")
+	flag.StringVar(&corsOrigins, "cors-origins", os.Getenv("CORS_ORIGINS"), "Comma separated origins browsers may call the API from, * for any, no CORS when empty")
+	flag.StringVar(&corsMethods, "cors-methods", envOr("CORS_METHODS", "GET,POST,PUT,PATCH,DELETE"), "Comma separated methods allowed to CORS requests")
+	flag.StringVar(&corsHeaders, "cors-headers", envOr("CORS_HEADERS", "Authorization,Content-Type,X-Tenant-ID"), "Comma separated request headers allowed to CORS requests, * for any")
+	flag.StringVar(&corsExpose, "cors-expose-headers", os.Getenv("CORS_EXPOSE_HEADERS"), "Comma separated response headers CORS requests may read")
+	maxAge, err := time.ParseDuration(envOr("CORS_MAX_AGE", "10m"))
+	if err != nil {
+		corelog.Fatal(err)
+	}
+	flag.DurationVar(&corsMaxAge, "cors-max-age", maxAge, "How long browsers may cache CORS preflight responses")
+	flag.StringVar(&proxies, "trusted-proxies", os.Getenv("TRUSTED_PROXIES"), "Comma separated CIDRs of the proxies whose X-Forwarded-For is believed, none when empty")
+	guests, err := time.ParseDuration(envOr("GUEST_TTL", "0"))
+	if err != nil {
+		corelog.Fatal(err)
+	}
+	flag.DurationVar(&guestTTL, "guest-ttl", guests, "How long guests who didn't register are kept, 0 to keep them")
+	flag.StringVar(&tlsCert, "tls-cert", os.Getenv("TLS_CERT"), "TLS certificate file, plain HTTP when empty")
+	flag.StringVar(&tlsKey, "tls-key", os.Getenv("TLS_KEY"), "TLS private key file")
+	flag.BoolVar(&http2On, "http2", os.Getenv("HTTP2") != "false", "Offer HTTP/2 to TLS clients")
+	flag.BoolVar(&h2cOn, "h2c", os.Getenv("H2C") == "true", "Accept HTTP/2 without TLS (h2c) besides HTTP/1.1, for in-cluster clients")
+	flag.UintVar(&http2Streams, "http2-max-streams", 250, "Concurrent streams per HTTP/2 connection")
+	flag.Int64Var(&maxBody, "max-body-size", api.DefaultMaxBodySize, "Largest request body in bytes, 0 for no limit")
+	flag.DurationVar(&readTimeout, "read-timeout", api.DefaultReadTimeout, "How long reading a request may take, 0 for no limit")
+	flag.DurationVar(&writeTimeout, "write-timeout", api.DefaultWriteTimeout, "How long serving a request may take, 0 for no limit")
+	flag.DurationVar(&queryTimeout, "query-timeout", db.DefaultQueryTimeout, "How long a database query may take, 0 for no limit")
+	flag.DurationVar(&dbPing, "db-ping-interval", db.DefaultPingInterval, "How often the database is pinged, and reconnected first after failing")
+	flag.DurationVar(&dbBackoff, "db-max-backoff", db.DefaultMaxBackoff, "Longest wait between reconnects to the database")
+	flag.DurationVar(&slowQuery, "slow-query", db.DefaultSlowQuery, "How long a database query takes before it is logged and counted as slow")
+	flag.DurationVar(&drainTimeout, "shutdown-timeout", 25*time.Second, "How long in-flight requests may take to finish on shutdown")
+	flag.DurationVar(&drainDelay, "shutdown-delay", 5*time.Second, "How long to keep serving while reporting not ready on shutdown")
+	flag.StringVar(&endpointTimes, "endpoint-timeouts", os.Getenv("ENDPOINT_TIMEOUTS"), "Comma separated \"Name=duration\" timeouts of single endpoints, like Login=500ms, 0 for none")
+	flag.StringVar(&readPref, "read-preference", envOr("READ_PREFERENCE", "primary"), "Replicas the customer listing and address and card reads are served by: primary, secondaryPreferred, secondary or nearest")
+	flag.StringVar(&endpointPrefs, "endpoint-read-preferences", os.Getenv("ENDPOINT_READ_PREFERENCES"), "Comma separated \"Name=preference\" read preferences of single read-only endpoints, like UserGet=secondaryPreferred")
+	flag.StringVar(&tenants, "tenants", os.Getenv("TENANTS"), "Comma separated tenants served besides the default one, none when empty")
+	flag.StringVar(&natsURL, "nats-url", os.Getenv("NATS_URL"), "NATS server user.get and user.login are served on, no NATS when empty")
+	flag.StringVar(&redactionFile, "redaction-policy", os.Getenv("REDACTION_POLICY"), "JSON file of the fields shown, masked or hidden per caller scope or role, no redaction when empty")
+	flag.BoolVar(&watchDB, "watch-changes", os.Getenv("WATCH_CHANGES") == "true", "Publish the changes to customers, addresses and cards from the change stream of the database, writes bypassing the service included")
+	flag.BoolVar(&relayOutbox, "outbox", os.Getenv("OUTBOX") == "true", "Publish the changes to customers, addresses and cards from the outbox of the database, recorded in the transaction of each write")
+	flag.StringVar(&routeTimes, "route-timeouts", os.Getenv("ROUTE_TIMEOUTS"), "Comma separated \"METHOD /path=duration\" read and write timeouts of single routes, 0 for none")
+}
+
+// newServer returns the HTTP server of handler on addr, speaking HTTP/2 as
+// configured: negotiated over TLS, and in cleartext with h2c.
+func newServer(addr string, handler http.Handler) (*http.Server, error) {
+	h2 := &http2.Server{MaxConcurrentStreams: uint32(http2Streams)}
+	if h2cOn {
+		handler = h2c.NewHandler(handler, h2)
+	}
+	srv := &http.Server{
+		Addr:    addr,
+		Handler: handler,
+		// The body and response deadlines are set per route by
+		// api.LimitHandler, headers must come quickly everywhere.
+		ReadHeaderTimeout: 5 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+	}
+	if tlsCert == "" {
+		return srv, nil
+	}
+	if !http2On {
+		// A non-nil empty map turns off the automatic HTTP/2 of TLS servers.
+		srv.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+		return srv, nil
+	}
+	return srv, http2.ConfigureServer(srv, h2)
+}
+
+// envOr returns the environment variable name, or def if it is empty.
+func envOr(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+// splitList splits a comma separated flag, dropping empty elements.
+func splitList(s string) []string {
+	var l []string
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			l = append(l, e)
+		}
+	}
+	return l
+}
+
+// watchChanges has broker publish the changes watch streams, store.Watch or
+// store.RelayOutbox, until stop is closed, watching again a second after
+// the stream fails.
+func watchChanges(broker *changes.Broker, watch func(context.Context, func(changes.Event)) error, stop <-chan struct{}, logger log.Logger) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stop
+		cancel()
+	}()
+	for {
+		if err := broker.Watch(ctx, watch); err != nil {
+			logger.Log("err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
 }
 
 func tracerProvider(url string) (*tracesdk.TracerProvider, error) {
@@ -61,6 +238,8 @@ func tracerProvider(url string) (*tracesdk.TracerProvider, error) {
 	tp := tracesdk.NewTracerProvider(
 		// Always be sure to batch in production.
 		tracesdk.WithBatcher(exp),
+		// Tag the spans of requests with their X-Request-ID.
+		tracesdk.WithSpanProcessor(api.RequestIDSpanProcessor{}),
 		// Record information about this application in a Resource.
 		tracesdk.WithResource(resource.NewWithAttributes(
 			semconv.SchemaURL,
@@ -102,48 +281,427 @@ func main() {
 	//host := strings.Split(localAddr.String(), ":")[0]
 	defer conn.Close()
 
-	dbconn := false
-	for !dbconn {
-		err := db.Init()
+	// Secrets.
+	if err := secrets.Init(); err != nil {
+		corelog.Fatal(err)
+	}
+	// stop ends the background jobs on shutdown.
+	stop := make(chan struct{})
+	go secrets.KeepRenewed(logger, stop)
+	if jwtKey == "" {
+		jwtKey = secrets.Value(secrets.JWTKey)
+	}
+	storeOpts := []db.StoreOption{
+		db.WithQueryTimeout(queryTimeout),
+		db.WithSlowQueries(slowQuery, log.With(logger, "component", "db")),
+	}
+	var cipher, cardCipher *pii.Cipher
+	if key := secrets.Value(secrets.CardEncryptionKey); key != "" {
+		cardCipher, err = pii.New([]byte(key))
 		if err != nil {
-			if err == db.ErrNoDatabaseSelected {
+			corelog.Fatal(err)
+		}
+		storeOpts = append(storeOpts, db.WithCardCipher(cardCipher))
+	}
+	if key := secrets.Value(secrets.PIIEncryptionKey); key != "" {
+		cipher, err = pii.New([]byte(key))
+		if err != nil {
+			corelog.Fatal(err)
+		}
+		storeOpts = append(storeOpts, db.WithCipher(cipher))
+	}
+
+	// Databases, those encrypting in their migrations or fixtures given
+	// the ciphers of the store.
+	db.Register("mongodb", &mongodb.Mongo{Cipher: cipher})
+	db.Register("postgres", &postgres.Postgres{})
+	db.Register("mysql", &mysql.MySQL{})
+	db.Register("inmem", &inmem.Memory{Cipher: cipher, CardCipher: cardCipher})
+	db.Register("sqlite", &sqlite.SQLite{})
+	db.Register("dynamodb", &dynamodb.DynamoDB{})
+	// Opening is retried with backoff, like the Supervisor reconnects.
+	var database db.Database
+	for wait := dbPing; database == nil; {
+		database, err = db.Open()
+		if err != nil {
+			if errors.As(err, new(*db.ConfigError)) {
 				corelog.Fatal(err)
 			}
 			corelog.Print(err)
+			time.Sleep(wait)
+			if wait *= 2; wait > dbBackoff {
+				wait = dbBackoff
+			}
 		} else {
 			logger.Log("DB OK")
-			dbconn = true
 		}
 	}
+	if _, ok := database.(db.Watcher); watchDB && !ok {
+		corelog.Fatal(db.ErrNotWatchable)
+	}
+	if _, ok := database.(db.Outbox); relayOutbox && !ok {
+		corelog.Fatal(db.ErrNoOutbox)
+	}
+	if watchDB && relayOutbox {
+		corelog.Fatal("-watch-changes and -outbox can't be combined")
+	}
+	store := db.NewStore(cache.New(database, logger), storeOpts...)
+	if err := store.MigrationFailure(); err != nil {
+		logger.Log("err", err, "ready", false)
+	}
+	// Deferred first, so closed after everything using it.
+	defer store.Close()
+	supervisor := &db.Supervisor{Store: store, Interval: dbPing, MaxBackoff: dbBackoff, Logger: log.With(logger, "component", "db")}
+	go supervisor.Run(stop)
 
-	// Service domain.
-	var service api.Service
-	{
-		service = api.NewFixedService()
-		service = api.LoggingMiddleware(logger)(service)
+	if err := api.BootstrapAdmin(context.Background(), store, secrets.Value(secrets.AdminUsername), secrets.Value(secrets.AdminPassword), logger); err != nil {
+		logger.Log("bootstrap", "admin", "err", err)
+	}
+
+	// Token signing.
+	var opts []api.ServiceOption
+	if jwtKey != "" {
+		signer, err := auth.NewSigner([]byte(jwtKey), api.DefaultTokenTTL)
+		if err != nil {
+			corelog.Fatal(err)
+		}
+		opts = append(opts, api.WithSigner(signer))
+	} else {
+		logger.Log("warning", "no jwt-key set, using a random key; tokens will not survive restarts")
+	}
+	clients, err := auth.ParseClients(secrets.Value(secrets.IntrospectionClients))
+	if err != nil {
+		corelog.Fatal(err)
+	}
+	opts = append(opts, api.WithIntrospectionClients(clients))
+
+	opts = append(opts, api.WithAuditLogger(log.With(logger, "audit", "security")))
+	opts = append(opts, api.WithLimits(maxAddresses, maxCards))
+
+	// Uploaded avatars.
+	blobs, err := blob.New()
+	if err != nil {
+		corelog.Fatal(err)
+	}
+	opts = append(opts, api.WithBlobStore(blobs))
+
+	// Purged users are archived, the records past their retention expired
+	// daily.
+	arch, err := archive.New()
+	if err != nil {
+		corelog.Fatal(err)
+	}
+	if arch != nil {
+		arch.Logger = logger
+		opts = append(opts, api.WithArchive(arch))
+		go arch.Every(24*time.Hour, stop)
+	}
+
+	// Card numbers are exchanged for tokens of the vault, if there is one.
+	vault, err := cardvault.New()
+	if err != nil {
+		corelog.Fatal(err)
+	}
+	if vault != nil {
+		opts = append(opts, api.WithCardVault(vault))
+	}
+	verifier, err := cardvault.NewVerifier()
+	if err != nil {
+		corelog.Fatal(err)
+	}
+	if verifier != nil {
+		opts = append(opts, api.WithCardVerifier(verifier, verifyAsync))
+	}
+
+	// Phone verification codes are texted with the SMS provider, if any.
+	sender, err := sms.New(secrets.Value(secrets.SMSAuthToken))
+	if err != nil {
+		corelog.Fatal(err)
+	}
+	if sender != nil {
+		opts = append(opts, api.WithSMS(sender))
+	}
+
+	// Posted addresses.
+	validator, err := address.New()
+	if err != nil {
+		corelog.Fatal(err)
+	}
+	opts = append(opts, api.WithAddressValidator(validator))
+	geocoder, err := address.NewGeocoder()
+	if err != nil {
+		corelog.Fatal(err)
+	}
+	if geocoder != nil {
+		geocoding := address.NewGeocoding(geocoder, 1024)
+		defer geocoding.Close()
+		opts = append(opts, api.WithGeocoding(geocoding))
+	}
+
+	// Security events go to stdout as JSON lines, apart from the logs, for the SIEM.
+	events := security.NewExporter(security.Multi{&security.JSONWriter{W: os.Stdout}, security.Counter{}}, 1024)
+	defer events.Close()
+	opts = append(opts, api.WithSecurityEvents(events))
+
+	// Instances losing their database are taken out of rotation until the
+	// supervisor reconnects it.
+	opts = append(opts, api.WithReadinessCheck("user-db-connection", supervisor.Err))
+
+	// Expiring cards of the default tenant are looked for daily, reminders
+	// go to stdout as JSON lines.
+	if reminderDays > 0 {
+		job := &reminder.CardExpiry{
+			Store:     store,
+			Within:    time.Duration(reminderDays) * 24 * time.Hour,
+			Publisher: &reminder.JSONWriter{W: os.Stdout},
+			Logger:    logger,
+		}
+		if smtpAddr != "" {
+			job.Mailer = reminder.SMTP{
+				Addr:     smtpAddr,
+				From:     smtpFrom,
+				Username: secrets.Value(secrets.SMTPUsername),
+				Password: secrets.Value(secrets.SMTPPassword),
+			}
+		}
+		go job.Every(24*time.Hour, stop)
+	}
+
+	// Endpoint timeouts, the configured ones over the defaults.
+	timeouts := map[string]time.Duration{}
+	for name, d := range api.DefaultEndpointTimeouts {
+		timeouts[name] = d
+	}
+	configured, err := api.ParseEndpointTimeouts(endpointTimes)
+	if err != nil {
+		logger.Log("err", err)
+		os.Exit(1)
+	}
+	for name, d := range configured {
+		timeouts[name] = d
+	}
+
+	// Read preferences, the configured ones over the default of the read
+	// heavy endpoints.
+	pref, err := db.ParseReadPreference(readPref)
+	if err != nil {
+		logger.Log("err", err)
+		os.Exit(1)
+	}
+	prefs := map[string]db.ReadPreference{}
+	for _, name := range api.DefaultReadPreferenceEndpoints {
+		prefs[name] = pref
+	}
+	configuredPrefs, err := api.ParseEndpointReadPreferences(endpointPrefs)
+	if err != nil {
+		logger.Log("err", err)
+		os.Exit(1)
+	}
+	for name, p := range configuredPrefs {
+		prefs[name] = p
+	}
 
+	// Responses are shaped to their caller by the redaction policy, if any.
+	var redaction api.RedactionPolicy
+	if redactionFile != "" {
+		if redaction, err = api.LoadRedactionPolicy(redactionFile); err != nil {
+			logger.Log("err", err)
+			os.Exit(1)
+		}
 	}
 
-	// Endpoint domain.
-	endpoints := api.MakeEndpoints(service)
+	// Every tenant gets its own service, endpoints and router over its own
+	// store, built on its first request.
+	makeEndpoints := func(tenant string) (api.Endpoints, error) {
+		store, err := store.Tenant(tenant)
+		if err != nil {
+			return api.Endpoints{}, err
+		}
+		logger := log.With(logger, "tenant", tenant)
+		if tenant != "" {
+			if err := api.BootstrapAdmin(context.Background(), store, secrets.Value(secrets.AdminUsername), secrets.Value(secrets.AdminPassword), logger); err != nil {
+				return api.Endpoints{}, err
+			}
+		}
 
-	// HTTP router
-	router := api.MakeHTTPHandler(endpoints, logger)
+		// Changes of the tenant are delivered to its webhooks.
+		broker := changes.NewBroker(api.DefaultChangesRetained)
+		go (&webhook.Dispatcher{Store: store, Logger: log.With(logger, "component", "webhooks")}).Run(broker, stop)
+		switch {
+		case watchDB:
+			go watchChanges(broker, store.Watch, stop, log.With(logger, "component", "changes"))
+		case relayOutbox:
+			go watchChanges(broker, store.RelayOutbox, stop, log.With(logger, "component", "outbox"))
+		}
+
+		// Service domain.
+		var service api.Service
+		{
+			service = api.NewFixedService(append(opts[:len(opts):len(opts)], api.WithTenant(tenant, store), api.WithChanges(broker))...)
+			service = api.LoggingMiddleware(logger)(service)
+		}
+
+		// Guests who never registered expire.
+		if guestTTL > 0 {
+			go (&api.AccountExpiry{
+				Service: service,
+				Guests:  guestTTL,
+				Logger:  logger,
+			}).Every(time.Hour, stop)
+		}
+
+		// Endpoint domain.
+		endpoints := api.MakeEndpoints(service).WithTimeouts(timeouts).WithReadPreferences(prefs)
+		if redaction != nil {
+			endpoints = endpoints.WithRedaction(service, redaction)
+		}
+		return endpoints, nil
+	}
+	// The default tenant is served over HTTP and NATS by the same endpoints,
+	// so its broker, webhooks and jobs run once.
+	var (
+		defaultMu        sync.Mutex
+		defaultEndpoints *api.Endpoints
+	)
+	tenantEndpoints := func(tenant string) (api.Endpoints, error) {
+		if tenant != "" {
+			return makeEndpoints(tenant)
+		}
+		defaultMu.Lock()
+		defer defaultMu.Unlock()
+		if defaultEndpoints == nil {
+			endpoints, err := makeEndpoints("")
+			if err != nil {
+				return api.Endpoints{}, err
+			}
+			defaultEndpoints = &endpoints
+		}
+		return *defaultEndpoints, nil
+	}
+	build := func(tenant string) (http.Handler, error) {
+		endpoints, err := tenantEndpoints(tenant)
+		if err != nil {
+			return nil, err
+		}
+
+		// HTTP router
+		router := api.MakeHTTPHandler(endpoints, log.With(logger, "tenant", tenant))
+		if local, ok := blobs.(*blob.Local); ok {
+			router.PathPrefix(blob.LocalPath).Handler(local)
+		}
+		return router, nil
+	}
+	served := splitList(tenants)
+	for _, t := range served {
+		if !db.ValidTenant(t) {
+			logger.Log("tenant", t, "err", db.ErrInvalidTenant)
+			os.Exit(1)
+		}
+	}
+	router := api.TenantHandler(served, build)
+	if compressMin >= 0 {
+		router = api.CompressHandler(api.Compression{MinSize: compressMin, Types: splitList(compressType)}, router)
+	}
+	if corsOrigins != "" {
+		router = api.CORSHandler(api.CORS{
+			Origins:        splitList(corsOrigins),
+			Methods:        splitList(corsMethods),
+			Headers:        splitList(corsHeaders),
+			ExposedHeaders: splitList(corsExpose),
+			MaxAge:         corsMaxAge,
+		}, router)
+	}
+	trusted, err := api.ParseTrustedProxies(proxies)
+	if err != nil {
+		logger.Log("err", err)
+		os.Exit(1)
+	}
+	router = api.ProxyHandler(trusted, router)
+	router = api.RequestIDHandler(router)
+	routeLimits, err := api.ParseRouteTimeouts(routeTimes)
+	if err != nil {
+		logger.Log("err", err)
+		os.Exit(1)
+	}
+	router = api.LimitHandler(api.Limits{
+		MaxBodySize:  maxBody,
+		ReadTimeout:  readTimeout,
+		WriteTimeout: writeTimeout,
+		Routes:       append(api.DefaultRouteLimits[:len(api.DefaultRouteLimits):len(api.DefaultRouteLimits)], routeLimits...),
+	}, router)
 
 	// Create and launch the HTTP server.
+	srv, err := newServer(fmt.Sprintf(":%v", port), router)
+	if err != nil {
+		logger.Log("err", err)
+		os.Exit(1)
+	}
+	// Event streams and WebSockets end on shutdown instead of holding it up.
+	srv.RegisterOnShutdown(api.Drain)
 	go func() {
-		logger.Log("transport", "HTTP", "port", port)
-		errc <- http.ListenAndServe(fmt.Sprintf(":%v", port), router)
+		logger.Log("transport", "HTTP", "port", port, "tls", tlsCert != "", "http2", tlsCert != "" && http2On, "h2c", h2cOn)
+		if tlsCert != "" {
+			errc <- srv.ListenAndServeTLS(tlsCert, tlsKey)
+			return
+		}
+		errc <- srv.ListenAndServe()
 	}()
 
+	// Other services may call the default tenant over NATS as well.
+	var nc *nats.Conn
+	if natsURL != "" {
+		endpoints, err := tenantEndpoints("")
+		if err != nil {
+			logger.Log("err", err)
+			os.Exit(1)
+		}
+		nc, err = nats.Connect(natsURL, nats.Name(ServiceName))
+		if err != nil {
+			logger.Log("err", err)
+			os.Exit(1)
+		}
+		if err := api.MountNATS(nc, endpoints, ServiceName, log.With(logger, "transport", "NATS")); err != nil {
+			logger.Log("err", err)
+			os.Exit(1)
+		}
+		logger.Log("transport", "NATS", "url", natsURL)
+	}
+
 	// Capture interrupts.
 	go func() {
-		c := make(chan os.Signal)
+		c := make(chan os.Signal, 1)
 		signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
-		errc <- fmt.Errorf("%s", <-c)
+		sig := <-c
+		// Report not ready but keep serving until the load balancers have
+		// noticed, so no request is sent to a closed listener.
+		api.Drain()
+		logger.Log("signal", sig, "draining", drainDelay)
+		time.Sleep(drainDelay)
+		errc <- fmt.Errorf("%s", sig)
 	}()
 
 	logger.Log("exit", <-errc)
+
+	// Stop accepting connections and let the requests in flight finish,
+	// then flush the spans. The deferred closes flush the exporters and
+	// close the database last.
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		logger.Log("shutdown", "http", "err", err)
+	}
+	if nc != nil {
+		if err := nc.Drain(); err != nil {
+			logger.Log("shutdown", "nats", "err", err)
+		}
+	}
+	close(stop)
+	if tp != nil {
+		if err := tp.Shutdown(ctx); err != nil {
+			logger.Log("shutdown", "tracer", "err", err)
+		}
+	}
+	logger.Log("shutdown", "done")
 }
 func bar(ctx context.Context) {
 	// Use the global TracerProvider.
@@ -0,0 +1,366 @@
+package patch
+
+// patch.go contains the partial updates of JSON documents: JSON Merge Patch
+// (RFC 7396), which sets and removes members, and JSON Patch (RFC 6902), a
+// list of operations precise down to single array elements that can test
+// the document before changing it.
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"strconv"
+	"strings"
+)
+
+const (
+	// MediaTypeMergePatch is the media type of JSON Merge Patch documents.
+	MediaTypeMergePatch = "application/merge-patch+json"
+	// MediaTypeJSONPatch is the media type of JSON Patch documents.
+	MediaTypeJSONPatch = "application/json-patch+json"
+)
+
+var (
+	// ErrInvalid is returned for patches that can't be applied.
+	ErrInvalid = errors.New("Invalid patch")
+	// ErrTestFailed is returned when a test operation doesn't hold.
+	ErrTestFailed = errors.New("Patch test failed")
+)
+
+// Patch changes a JSON document.
+type Patch interface {
+	// Apply returns doc with the patch applied.
+	Apply(doc []byte) ([]byte, error)
+}
+
+// Decode reads the patch of media type contentType from r. Plain JSON is a
+// merge patch.
+func Decode(contentType string, r io.Reader) (Patch, error) {
+	mt := MediaTypeMergePatch
+	if contentType != "" {
+		var err error
+		if mt, _, err = mime.ParseMediaType(contentType); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+		}
+	}
+	switch mt {
+	case MediaTypeJSONPatch:
+		var p JSONPatch
+		if err := json.NewDecoder(r).Decode(&p); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+		}
+		return p, nil
+	case MediaTypeMergePatch, "application/json":
+		var p json.RawMessage
+		if err := json.NewDecoder(r).Decode(&p); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+		}
+		return MergePatch(p), nil
+	}
+	return nil, fmt.Errorf("%w: unsupported media type %v", ErrInvalid, mt)
+}
+
+// MergePatch is a JSON Merge Patch: its members replace those of the
+// document, null ones remove them and objects are merged recursively.
+type MergePatch json.RawMessage
+
+// Apply returns doc with p merged in.
+func (p MergePatch) Apply(doc []byte) ([]byte, error) {
+	target, err := decode(doc)
+	if err != nil {
+		return nil, err
+	}
+	patch, err := decode(p)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	return json.Marshal(merge(target, patch))
+}
+
+func merge(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = map[string]interface{}{}
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+		} else {
+			t[k] = merge(t[k], v)
+		}
+	}
+	return t
+}
+
+// Operation is a single JSON Patch operation: add, remove, replace, move,
+// copy or test. Path and From are JSON Pointers (RFC 6901).
+type Operation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// JSONPatch is a JSON Patch, its operations are applied in order and all
+// of them or none are.
+type JSONPatch []Operation
+
+// Apply returns doc with the operations of p applied.
+func (p JSONPatch) Apply(doc []byte) ([]byte, error) {
+	v, err := decode(doc)
+	if err != nil {
+		return nil, err
+	}
+	for i, op := range p {
+		if v, err = op.apply(v); err != nil {
+			return nil, fmt.Errorf("operation %v: %w", i, err)
+		}
+	}
+	return json.Marshal(v)
+}
+
+func (op Operation) apply(doc interface{}) (interface{}, error) {
+	path, err := pointer(op.Path)
+	if err != nil {
+		return nil, err
+	}
+	value := func() (interface{}, error) {
+		if op.Value == nil {
+			return nil, fmt.Errorf("%w: %v without a value", ErrInvalid, op.Op)
+		}
+		return decode(op.Value)
+	}
+	switch op.Op {
+	case "add", "replace", "test":
+		v, err := value()
+		if err != nil {
+			return nil, err
+		}
+		switch op.Op {
+		case "add":
+			return add(doc, path, v)
+		case "replace":
+			return replace(doc, path, v)
+		}
+		got, err := get(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !equal(got, v) {
+			return nil, fmt.Errorf("%w: %v", ErrTestFailed, op.Path)
+		}
+		return doc, nil
+	case "remove":
+		return remove(doc, path)
+	case "move", "copy":
+		from, err := pointer(op.From)
+		if err != nil {
+			return nil, err
+		}
+		v, err := get(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		if op.Op == "copy" {
+			if v, err = clone(v); err != nil {
+				return nil, err
+			}
+			return add(doc, path, v)
+		}
+		if op.Path != op.From && strings.HasPrefix(op.Path, op.From+"/") {
+			return nil, fmt.Errorf("%w: can't move %v into itself", ErrInvalid, op.From)
+		}
+		if doc, err = remove(doc, from); err != nil {
+			return nil, err
+		}
+		return add(doc, path, v)
+	}
+	return nil, fmt.Errorf("%w: unknown operation %q", ErrInvalid, op.Op)
+}
+
+// pointer returns the reference tokens of the JSON Pointer p.
+func pointer(p string) ([]string, error) {
+	if p == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(p, "/") {
+		return nil, fmt.Errorf("%w: path %q doesn't start with /", ErrInvalid, p)
+	}
+	ts := strings.Split(p[1:], "/")
+	for i, t := range ts {
+		ts[i] = strings.ReplaceAll(strings.ReplaceAll(t, "~1", "/"), "~0", "~")
+	}
+	return ts, nil
+}
+
+// index returns the array index token t, up to max.
+func index(t string, max int) (int, error) {
+	i, err := strconv.Atoi(t)
+	if err != nil || i < 0 || i > max || (len(t) > 1 && t[0] == '0') || t[0] == '+' {
+		return 0, fmt.Errorf("%w: no index %v", ErrInvalid, t)
+	}
+	return i, nil
+}
+
+func get(doc interface{}, path []string) (interface{}, error) {
+	for _, t := range path {
+		switch c := doc.(type) {
+		case map[string]interface{}:
+			v, ok := c[t]
+			if !ok {
+				return nil, fmt.Errorf("%w: no member %v", ErrInvalid, t)
+			}
+			doc = v
+		case []interface{}:
+			i, err := index(t, len(c)-1)
+			if err != nil {
+				return nil, err
+			}
+			doc = c[i]
+		default:
+			return nil, fmt.Errorf("%w: no member %v", ErrInvalid, t)
+		}
+	}
+	return doc, nil
+}
+
+// update returns doc with the container holding the last token of path
+// replaced by what fn returns for it.
+func update(doc interface{}, path []string, fn func(container interface{}, token string) (interface{}, error)) (interface{}, error) {
+	if len(path) == 1 {
+		return fn(doc, path[0])
+	}
+	child, err := get(doc, path[:1])
+	if err != nil {
+		return nil, err
+	}
+	if child, err = update(child, path[1:], fn); err != nil {
+		return nil, err
+	}
+	switch c := doc.(type) {
+	case map[string]interface{}:
+		c[path[0]] = child
+	case []interface{}:
+		i, _ := index(path[0], len(c)-1)
+		c[i] = child
+	}
+	return doc, nil
+}
+
+func add(doc interface{}, path []string, v interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return v, nil
+	}
+	return update(doc, path, func(container interface{}, t string) (interface{}, error) {
+		switch c := container.(type) {
+		case map[string]interface{}:
+			c[t] = v
+			return c, nil
+		case []interface{}:
+			i := len(c)
+			if t != "-" {
+				var err error
+				if i, err = index(t, len(c)); err != nil {
+					return nil, err
+				}
+			}
+			c = append(c, nil)
+			copy(c[i+1:], c[i:])
+			c[i] = v
+			return c, nil
+		}
+		return nil, fmt.Errorf("%w: can't add %v to a value", ErrInvalid, t)
+	})
+}
+
+func remove(doc interface{}, path []string) (interface{}, error) {
+	if len(path) == 0 {
+		return nil, fmt.Errorf("%w: can't remove the document", ErrInvalid)
+	}
+	return update(doc, path, func(container interface{}, t string) (interface{}, error) {
+		switch c := container.(type) {
+		case map[string]interface{}:
+			if _, ok := c[t]; !ok {
+				return nil, fmt.Errorf("%w: no member %v", ErrInvalid, t)
+			}
+			delete(c, t)
+			return c, nil
+		case []interface{}:
+			i, err := index(t, len(c)-1)
+			if err != nil {
+				return nil, err
+			}
+			return append(c[:i], c[i+1:]...), nil
+		}
+		return nil, fmt.Errorf("%w: no member %v", ErrInvalid, t)
+	})
+}
+
+func replace(doc interface{}, path []string, v interface{}) (interface{}, error) {
+	if _, err := get(doc, path); err != nil {
+		return nil, err
+	}
+	return add(doc, path, v)
+}
+
+func decode(b []byte) (interface{}, error) {
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var v interface{}
+	err := d.Decode(&v)
+	return v, err
+}
+
+func clone(v interface{}) (interface{}, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return decode(b)
+}
+
+// equal reports whether the decoded JSON values a and b are equal, numbers
+// by their value.
+func equal(a, b interface{}) bool {
+	switch a := a.(type) {
+	case json.Number:
+		b, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		x, err := a.Float64()
+		y, err2 := b.Float64()
+		return err == nil && err2 == nil && x == y
+	case map[string]interface{}:
+		b, ok := b.(map[string]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for k, v := range a {
+			w, ok := b[k]
+			if !ok || !equal(v, w) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		b, ok := b.([]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !equal(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return a == b
+}
@@ -0,0 +1,88 @@
+package patch
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestMergePatch(t *testing.T) {
+	got, err := MergePatch(`{"a":"z","c":{"f":null},"n":1.50}`).Apply([]byte(`{"a":"b","c":{"d":"e","f":"g"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != `{"a":"z","c":{"d":"e"},"n":1.50}` {
+		t.Errorf("expected the members merged, got %s", got)
+	}
+	if got, _ := MergePatch(`["x"]`).Apply([]byte(`{"a":"b"}`)); string(got) != `["x"]` {
+		t.Errorf("expected a non object patch to replace the document, got %s", got)
+	}
+}
+
+func TestJSONPatch(t *testing.T) {
+	doc := `{"foo":"bar","list":["a","b"],"obj":{"x":1},"a/b":2}`
+	for _, c := range []struct {
+		ops, want string
+	}{
+		{`[{"op":"add","path":"/baz","value":"qux"}]`, `{"a/b":2,"baz":"qux","foo":"bar","list":["a","b"],"obj":{"x":1}}`},
+		{`[{"op":"add","path":"/list/1","value":"c"}]`, `{"a/b":2,"foo":"bar","list":["a","c","b"],"obj":{"x":1}}`},
+		{`[{"op":"add","path":"/list/-","value":"c"}]`, `{"a/b":2,"foo":"bar","list":["a","b","c"],"obj":{"x":1}}`},
+		{`[{"op":"remove","path":"/list/0"},{"op":"remove","path":"/a~1b"}]`, `{"foo":"bar","list":["b"],"obj":{"x":1}}`},
+		{`[{"op":"replace","path":"/obj/x","value":null}]`, `{"a/b":2,"foo":"bar","list":["a","b"],"obj":{"x":null}}`},
+		{`[{"op":"move","from":"/foo","path":"/obj/foo"}]`, `{"a/b":2,"list":["a","b"],"obj":{"foo":"bar","x":1}}`},
+		{`[{"op":"copy","from":"/list","path":"/copy"},{"op":"add","path":"/copy/0","value":"z"}]`, `{"a/b":2,"copy":["z","a","b"],"foo":"bar","list":["a","b"],"obj":{"x":1}}`},
+		{`[{"op":"test","path":"/obj","value":{"x":1.0}},{"op":"replace","path":"","value":{}}]`, `{}`},
+	} {
+		var p JSONPatch
+		if err := json.Unmarshal([]byte(c.ops), &p); err != nil {
+			t.Fatal(err)
+		}
+		got, err := p.Apply([]byte(doc))
+		if err != nil || string(got) != c.want {
+			t.Errorf("expected %v for %v, got %s %v", c.want, c.ops, got, err)
+		}
+	}
+}
+
+func TestJSONPatchErrors(t *testing.T) {
+	doc := []byte(`{"foo":"bar","list":["a"]}`)
+	for _, c := range []struct {
+		ops  string
+		want error
+	}{
+		{`[{"op":"test","path":"/foo","value":"baz"}]`, ErrTestFailed},
+		{`[{"op":"remove","path":"/missing"}]`, ErrInvalid},
+		{`[{"op":"replace","path":"/list/1","value":"b"}]`, ErrInvalid},
+		{`[{"op":"add","path":"/list/01","value":"b"}]`, ErrInvalid},
+		{`[{"op":"add","path":"/foo"}]`, ErrInvalid},
+		{`[{"op":"move","from":"/list","path":"/list/0"}]`, ErrInvalid},
+		{`[{"op":"merge","path":"/foo","value":1}]`, ErrInvalid},
+		{`[{"op":"add","path":"foo","value":1}]`, ErrInvalid},
+	} {
+		var p JSONPatch
+		if err := json.Unmarshal([]byte(c.ops), &p); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := p.Apply(doc); !errors.Is(err, c.want) {
+			t.Errorf("expected %v for %v, got %v", c.want, c.ops, err)
+		}
+	}
+}
+
+func TestDecode(t *testing.T) {
+	p, err := Decode("application/json-patch+json; charset=utf-8", strings.NewReader(`[{"op":"add","path":"/a","value":null}]`))
+	if jp, ok := p.(JSONPatch); err != nil || !ok || string(jp[0].Value) != "null" {
+		t.Errorf("expected a JSON patch with a null value, got %#v %v", p, err)
+	}
+	for _, ct := range []string{"", "application/json", MediaTypeMergePatch} {
+		if p, err := Decode(ct, strings.NewReader(`{"a":null}`)); err != nil {
+			t.Errorf("expected a merge patch for %q, got %v", ct, err)
+		} else if _, ok := p.(MergePatch); !ok {
+			t.Errorf("expected a merge patch for %q, got %T", ct, p)
+		}
+	}
+	if _, err := Decode("text/plain", strings.NewReader(`{}`)); !errors.Is(err, ErrInvalid) {
+		t.Errorf("expected other media types rejected, got %v", err)
+	}
+}
@@ -0,0 +1,170 @@
+package pii
+
+// pii.go contains field level encryption of personal data. Fields are picked
+// by a `pii` struct tag:
+//
+//	Email string `pii:"deterministic"` // same input, same ciphertext: queryable
+//	Name  string `pii:"randomized"`    // fresh nonce on every write
+//
+// Encrypted values are prefixed so plaintext written before encryption was
+// enabled is still read back as is. Input is always encrypted, whatever it
+// looks like; only values typed as Ciphertext, read back from storage, are
+// decrypted.
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"reflect"
+	"strings"
+)
+
+const (
+	// Deterministic fields encrypt equal plaintexts to equal ciphertexts.
+	Deterministic = "deterministic"
+	// Randomized fields use a random nonce for every encryption.
+	Randomized = "randomized"
+
+	prefix = "enc:v1:"
+)
+
+var (
+	//ErrNotStructPointer is returned when Encrypt or Decrypt is given anything but a struct pointer
+	ErrNotStructPointer = errors.New("pii: expected pointer to struct")
+	//ErrCorrupt is returned when a prefixed value fails to decrypt
+	ErrCorrupt = errors.New("pii: corrupt ciphertext")
+)
+
+// Ciphertext is a value EncryptString returned, or a stored value that may
+// be one.
+type Ciphertext string
+
+// Cipher encrypts and decrypts tagged fields.
+type Cipher struct {
+	aead cipher.AEAD
+	mac  []byte
+}
+
+// New returns a Cipher keyed from secret. Separate encryption and nonce
+// derivation keys are derived from it.
+func New(secret []byte) (*Cipher, error) {
+	k := sha256.Sum256(secret)
+	block, err := aes.NewCipher(derive(k[:], "enc"))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Cipher{aead: aead, mac: derive(k[:], "nonce")}, nil
+}
+
+func derive(key []byte, label string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(label))
+	return h.Sum(nil)
+}
+
+// EncryptString encrypts s in the given mode. Empty strings are returned
+// unchanged, anything else is encrypted, even when it looks encrypted.
+func (c *Cipher) EncryptString(s, mode string) Ciphertext {
+	if s == "" {
+		return ""
+	}
+	nonce := make([]byte, c.aead.NonceSize())
+	if mode == Deterministic {
+		h := hmac.New(sha256.New, c.mac)
+		h.Write([]byte(s))
+		copy(nonce, h.Sum(nil))
+	} else {
+		rand.Read(nonce)
+	}
+	ct := c.aead.Seal(nonce, nonce, []byte(s), nil)
+	return Ciphertext(prefix + base64.RawStdEncoding.EncodeToString(ct))
+}
+
+// DecryptString reverses EncryptString. Unprefixed values were stored before
+// encryption was enabled and are returned unchanged.
+func (c *Cipher) DecryptString(ct Ciphertext) (string, error) {
+	s := string(ct)
+	if !strings.HasPrefix(s, prefix) {
+		return s, nil
+	}
+	b, err := base64.RawStdEncoding.DecodeString(s[len(prefix):])
+	if err != nil || len(b) < c.aead.NonceSize() {
+		return "", ErrCorrupt
+	}
+	n := c.aead.NonceSize()
+	pt, err := c.aead.Open(nil, b[:n], b[n:], nil)
+	if err != nil {
+		return "", ErrCorrupt
+	}
+	return string(pt), nil
+}
+
+// Seal encrypts b with a random nonce, for whole documents rather than
+// fields. The nonce leads the returned ciphertext.
+func (c *Cipher) Seal(b []byte) []byte {
+	nonce := make([]byte, c.aead.NonceSize())
+	rand.Read(nonce)
+	return c.aead.Seal(nonce, nonce, b, nil)
+}
+
+// Open reverses Seal.
+func (c *Cipher) Open(b []byte) ([]byte, error) {
+	n := c.aead.NonceSize()
+	if len(b) < n {
+		return nil, ErrCorrupt
+	}
+	pt, err := c.aead.Open(nil, b[:n], b[n:], nil)
+	if err != nil {
+		return nil, ErrCorrupt
+	}
+	return pt, nil
+}
+
+// Encrypt encrypts the tagged string fields of the struct v points to. Set
+// *string fields are encrypted in place.
+func (c *Cipher) Encrypt(v interface{}) error {
+	return c.walk(v, func(s, mode string) (string, error) {
+		return string(c.EncryptString(s, mode)), nil
+	})
+}
+
+// Decrypt decrypts the tagged string fields of the struct v points to, which
+// has to be read back from storage.
+func (c *Cipher) Decrypt(v interface{}) error {
+	return c.walk(v, func(s, _ string) (string, error) {
+		return c.DecryptString(Ciphertext(s))
+	})
+}
+
+func (c *Cipher) walk(v interface{}, f func(s, mode string) (string, error)) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Struct {
+		return ErrNotStructPointer
+	}
+	rv = rv.Elem()
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		mode, ok := rt.Field(i).Tag.Lookup("pii")
+		fv := rv.Field(i)
+		if ok && fv.Kind() == reflect.Ptr && !fv.IsNil() {
+			fv = fv.Elem()
+		}
+		if !ok || fv.Kind() != reflect.String || !fv.CanSet() {
+			continue
+		}
+		s, err := f(fv.String(), mode)
+		if err != nil {
+			return err
+		}
+		fv.SetString(s)
+	}
+	return nil
+}
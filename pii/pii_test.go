@@ -0,0 +1,97 @@
+package pii
+
+import "testing"
+
+type person struct {
+	Name  string `pii:"randomized"`
+	Email string `pii:"deterministic"`
+	Login string
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	c, _ := New([]byte("secret"))
+	p := person{Name: "Eve", Email: "eve@example.com", Login: "eve"}
+	if err := c.Encrypt(&p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Name == "Eve" || p.Email == "eve@example.com" {
+		t.Error("expected tagged fields encrypted")
+	}
+	if p.Login != "eve" {
+		t.Error("expected untagged field untouched")
+	}
+	if err := c.Decrypt(&p); err != nil {
+		t.Fatal(err)
+	}
+	if (p != person{Name: "Eve", Email: "eve@example.com", Login: "eve"}) {
+		t.Errorf("unexpected round trip %v", p)
+	}
+}
+
+func TestDeterministic(t *testing.T) {
+	c, _ := New([]byte("secret"))
+	a := c.EncryptString("eve@example.com", Deterministic)
+	if a != c.EncryptString("eve@example.com", Deterministic) {
+		t.Error("expected deterministic ciphertexts to match")
+	}
+	r := c.EncryptString("Eve", Randomized)
+	if r == c.EncryptString("Eve", Randomized) {
+		t.Error("expected randomized ciphertexts to differ")
+	}
+	// Input looking encrypted is encrypted all the same.
+	b := c.EncryptString(string(a), Deterministic)
+	if b == a {
+		t.Error("expected input looking encrypted to be encrypted")
+	}
+	if s, err := c.DecryptString(b); err != nil || s != string(a) {
+		t.Errorf("expected %v back, got %v %v", a, s, err)
+	}
+	if s, err := c.DecryptString(c.EncryptString("enc:v1:junk", Randomized)); err != nil || s != "enc:v1:junk" {
+		t.Errorf("expected junk with the prefix back as given, got %v %v", s, err)
+	}
+}
+
+func TestDecryptPlaintext(t *testing.T) {
+	c, _ := New([]byte("secret"))
+	s, err := c.DecryptString("legacy")
+	if err != nil || s != "legacy" {
+		t.Error("expected plaintext passed through")
+	}
+	o, _ := New([]byte("other"))
+	if _, err := c.DecryptString(o.EncryptString("Eve", Randomized)); err != ErrCorrupt {
+		t.Error("expected corrupt error for foreign key")
+	}
+	if err := c.Encrypt(person{}); err != ErrNotStructPointer {
+		t.Error("expected struct pointer error")
+	}
+}
+
+func TestEncryptPointerFields(t *testing.T) {
+	c, _ := New([]byte("secret"))
+	name := "Eve"
+	p := struct {
+		Name  *string `pii:"randomized"`
+		Email *string `pii:"deterministic"`
+	}{Name: &name}
+	if err := c.Encrypt(&p); err != nil {
+		t.Fatal(err)
+	}
+	if name == "Eve" || p.Email != nil {
+		t.Error("expected set pointer encrypted and nil pointer skipped")
+	}
+}
+
+func TestSealOpen(t *testing.T) {
+	c, _ := New([]byte("secret"))
+	sealed := c.Seal([]byte("record"))
+	if string(sealed) == "record" || string(c.Seal([]byte("record"))) == string(sealed) {
+		t.Error("expected sealing to encrypt with a fresh nonce")
+	}
+	if b, err := c.Open(sealed); err != nil || string(b) != "record" {
+		t.Errorf("unexpected round trip %q %v", b, err)
+	}
+	other, _ := New([]byte("other"))
+	if _, err := other.Open(sealed); err != ErrCorrupt {
+		t.Errorf("expected opening with another key to fail, got %v", err)
+	}
+}
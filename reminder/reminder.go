@@ -0,0 +1,148 @@
+package reminder
+
+// reminder.go contains the scheduled job reminding customers of cards about
+// to expire. Every run publishes a card.expiring event, and optionally mails
+// the customer, once per card and expiry, so payment details can be updated
+// before checkouts start failing.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"user/users"
+)
+
+// CardExpiring is the type of the events published for expiring cards.
+const CardExpiring = "card.expiring"
+
+// Event is a published reminder.
+type Event struct {
+	Type    string    `json:"type"`
+	Time    time.Time `json:"time"`
+	UserID  string    `json:"userId"`
+	CardID  string    `json:"cardId"`
+	Brand   string    `json:"brand,omitempty"`
+	Last4   string    `json:"last4"`
+	Expires string    `json:"expires"`
+}
+
+// Publisher publishes reminder events.
+type Publisher interface {
+	Publish(e Event) error
+}
+
+// JSONWriter publishes events as JSON lines to W.
+type JSONWriter struct {
+	mtx sync.Mutex
+	W   io.Writer
+}
+
+// Publish encodes e on its own line.
+func (j *JSONWriter) Publish(e Event) error {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	return json.NewEncoder(j.W).Encode(e)
+}
+
+// Mailer sends mail to customers.
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// Store is the part of *db.Store the job uses.
+type Store interface {
+	GetCards(ctx context.Context) ([]users.Card, error)
+	OwnerOf(ctx context.Context, entity, id string) (string, error)
+	GetUser(ctx context.Context, id string) (users.User, error)
+	SetCardReminded(ctx context.Context, id, expires string) error
+}
+
+// CardExpiry finds cards expiring within Within and reminds their owners.
+// Mailer is optional.
+type CardExpiry struct {
+	Store     Store
+	Within    time.Duration
+	Publisher Publisher
+	Mailer    Mailer
+	Logger    log.Logger
+	now       func() time.Time
+}
+
+// Run reminds the owners of the cards expiring soon that haven't been
+// reminded of this expiry yet, and returns how many were reminded.
+func (j *CardExpiry) Run(ctx context.Context) (int, error) {
+	now := time.Now
+	if j.now != nil {
+		now = j.now
+	}
+	t := now()
+	cs, err := j.Store.GetCards(ctx)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, c := range cs {
+		end, err := users.ExpiryEnd(c.Expires)
+		if err != nil || !end.After(t) || end.After(t.Add(j.Within)) || c.RemindedFor == c.Expires {
+			continue
+		}
+		owner, err := j.Store.OwnerOf(ctx, "cards", c.ID)
+		if err != nil {
+			continue
+		}
+		if err := j.remind(ctx, owner, c, t); err != nil {
+			j.Logger.Log("job", "card_expiry", "card", c.ID, "err", err)
+			continue
+		}
+		if err := j.Store.SetCardReminded(ctx, c.ID, c.Expires); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+func (j *CardExpiry) remind(ctx context.Context, owner string, c users.Card, t time.Time) error {
+	last4 := c.LongNum
+	if len(last4) > 4 {
+		last4 = last4[len(last4)-4:]
+	}
+	err := j.Publisher.Publish(Event{
+		Type:    CardExpiring,
+		Time:    t.UTC(),
+		UserID:  owner,
+		CardID:  c.ID,
+		Brand:   c.Brand,
+		Last4:   last4,
+		Expires: c.Expires,
+	})
+	if err != nil || j.Mailer == nil {
+		return err
+	}
+	u, err := j.Store.GetUser(ctx, owner)
+	if err != nil || u.Email == "" {
+		return err
+	}
+	return j.Mailer.Send(u.Email, "Your card is about to expire", fmt.Sprintf(
+		"Hi %v,\n\nyour card ending in %v expires at the end of %v. Please update your payment details to keep checking out without trouble.\n",
+		u.FirstName, last4, c.Expires))
+}
+
+// Every runs the job every interval until stop is closed.
+func (j *CardExpiry) Every(interval time.Duration, stop <-chan struct{}) {
+	ctx := context.Background()
+	for {
+		n, err := j.Run(ctx)
+		j.Logger.Log("job", "card_expiry", "reminded", n, "err", err)
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
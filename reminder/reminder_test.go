@@ -0,0 +1,83 @@
+package reminder
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"user/users"
+)
+
+type fakeStore struct {
+	cards    []users.Card
+	reminded map[string]string
+}
+
+func (f *fakeStore) GetCards(ctx context.Context) ([]users.Card, error) {
+	return f.cards, nil
+}
+
+func (f *fakeStore) OwnerOf(ctx context.Context, entity, id string) (string, error) {
+	return "u-" + id, nil
+}
+
+func (f *fakeStore) GetUser(ctx context.Context, id string) (users.User, error) {
+	return users.User{UserID: id, FirstName: "Eve", Email: "eve@example.com"}, nil
+}
+
+func (f *fakeStore) SetCardReminded(ctx context.Context, id, expires string) error {
+	f.reminded[id] = expires
+	for k := range f.cards {
+		if f.cards[k].ID == id {
+			f.cards[k].RemindedFor = expires
+		}
+	}
+	return nil
+}
+
+type fakeMailer []string
+
+func (m *fakeMailer) Send(to, subject, body string) error {
+	*m = append(*m, to)
+	return nil
+}
+
+func TestCardExpiry(t *testing.T) {
+	ctx := context.Background()
+	store := &fakeStore{
+		cards: []users.Card{
+			{ID: "soon", LongNum: "4111111111111111", Expires: "06/26", Brand: users.BrandVisa},
+			{ID: "later", LongNum: "5500005555555559", Expires: "12/26"},
+			{ID: "expired", LongNum: "378282246310005", Expires: "04/26"},
+		},
+		reminded: map[string]string{},
+	}
+	var out bytes.Buffer
+	mails := &fakeMailer{}
+	j := &CardExpiry{
+		Store:     store,
+		Within:    30 * 24 * time.Hour,
+		Publisher: &JSONWriter{W: &out},
+		Mailer:    mails,
+		Logger:    log.NewNopLogger(),
+		now:       func() time.Time { return time.Date(2026, 6, 10, 0, 0, 0, 0, time.UTC) },
+	}
+	n, err := j.Run(ctx)
+	if err != nil || n != 1 {
+		t.Fatalf("expected one reminder, got %v %v", n, err)
+	}
+	var e Event
+	json.NewDecoder(&out).Decode(&e)
+	if e.Type != CardExpiring || e.CardID != "soon" || e.UserID != "u-soon" || e.Last4 != "1111" || e.Brand != users.BrandVisa {
+		t.Errorf("unexpected event %+v", e)
+	}
+	if len(*mails) != 1 || (*mails)[0] != "eve@example.com" {
+		t.Errorf("expected a mail to the owner, got %v", *mails)
+	}
+	if n, _ := j.Run(ctx); n != 0 {
+		t.Errorf("expected no second reminder for the same expiry, got %v", n)
+	}
+}
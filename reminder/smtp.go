@@ -0,0 +1,35 @@
+package reminder
+
+import (
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+)
+
+// SMTP sends mail through an SMTP server, authenticating with PLAIN when a
+// username is set.
+type SMTP struct {
+	Addr     string
+	From     string
+	Username string
+	Password string
+}
+
+// Send mails body to to.
+func (s SMTP) Send(to, subject, body string) error {
+	var auth smtp.Auth
+	if s.Username != "" {
+		host, _, _ := net.SplitHostPort(s.Addr)
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+	if strings.ContainsAny(to+subject, "\r\n") {
+		return fmt.Errorf("smtp: invalid header value")
+	}
+	msg := "From: " + s.From + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" + body
+	return smtp.SendMail(s.Addr, auth, s.From, []string{to}, []byte(msg))
+}
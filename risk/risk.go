@@ -0,0 +1,77 @@
+package risk
+
+// risk.go contains the hook used to score login attempts. An Evaluator looks
+// at who is logging in from where and returns a score, the Policy turns the
+// score into a decision.
+
+import "time"
+
+// Client describes where a request came from.
+type Client struct {
+	IP        string
+	Country   string
+	UserAgent string
+	DeviceID  string
+}
+
+// Attempt is a login attempt whose credentials have been verified.
+type Attempt struct {
+	UserID   string
+	Username string
+	Client   Client
+	Time     time.Time
+}
+
+// Assessment is the result of evaluating an attempt. Score runs from 0 (no
+// risk) to 1 (certainly malicious).
+type Assessment struct {
+	Score   float64
+	Reasons []string
+}
+
+// Evaluator scores login attempts.
+type Evaluator interface {
+	Evaluate(a Attempt) (Assessment, error)
+}
+
+// EvaluatorFunc adapts a function to the Evaluator interface.
+type EvaluatorFunc func(a Attempt) (Assessment, error)
+
+// Evaluate calls f(a).
+func (f EvaluatorFunc) Evaluate(a Attempt) (Assessment, error) {
+	return f(a)
+}
+
+// None is an Evaluator that considers every attempt safe.
+var None = EvaluatorFunc(func(Attempt) (Assessment, error) {
+	return Assessment{}, nil
+})
+
+// Decision is what to do with an attempt.
+type Decision string
+
+const (
+	Allow      Decision = "allow"
+	RequireMFA Decision = "mfa"
+	Block      Decision = "block"
+)
+
+// Policy maps scores to decisions. A zero threshold disables that decision.
+type Policy struct {
+	MFAThreshold   float64
+	BlockThreshold float64
+}
+
+// DefaultPolicy asks for MFA from 0.5 and blocks from 0.9.
+var DefaultPolicy = Policy{MFAThreshold: 0.5, BlockThreshold: 0.9}
+
+// Decide returns the decision for an assessment.
+func (p Policy) Decide(a Assessment) Decision {
+	if p.BlockThreshold > 0 && a.Score >= p.BlockThreshold {
+		return Block
+	}
+	if p.MFAThreshold > 0 && a.Score >= p.MFAThreshold {
+		return RequireMFA
+	}
+	return Allow
+}
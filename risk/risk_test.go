@@ -0,0 +1,29 @@
+package risk
+
+import "testing"
+
+func TestDecide(t *testing.T) {
+	cases := []struct {
+		policy Policy
+		score  float64
+		want   Decision
+	}{
+		{DefaultPolicy, 0, Allow},
+		{DefaultPolicy, 0.5, RequireMFA},
+		{DefaultPolicy, 0.95, Block},
+		{Policy{BlockThreshold: 0.9}, 0.7, Allow},
+		{Policy{}, 1, Allow},
+	}
+	for _, c := range cases {
+		if d := c.policy.Decide(Assessment{Score: c.score}); d != c.want {
+			t.Errorf("score %v: expected %v received %v", c.score, c.want, d)
+		}
+	}
+}
+
+func TestNone(t *testing.T) {
+	a, err := None.Evaluate(Attempt{})
+	if err != nil || a.Score != 0 {
+		t.Error("expected no risk")
+	}
+}
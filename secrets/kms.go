@@ -0,0 +1,88 @@
+package secrets
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"user/sigv4"
+)
+
+var (
+	kmsRegion string
+)
+
+func init() {
+	flag.StringVar(&kmsRegion, "kms-region", os.Getenv("AWS_REGION"), "AWS region of the KMS key")
+}
+
+// KMS decrypts secrets with AWS KMS. The base64 ciphertext of each secret is
+// read from Source, so NAME holds the KMS encrypted value of secret NAME.
+// Credentials come from the standard AWS environment variables.
+type KMS struct {
+	Endpoint     string
+	Region       string
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+	Source       Provider
+	Client       *http.Client
+	now          func() time.Time
+}
+
+// NewKMS returns a KMS provider for region decrypting values from source.
+func NewKMS(region string, source Provider) *KMS {
+	return &KMS{
+		Endpoint:     fmt.Sprintf("https://kms.%v.amazonaws.com/", region),
+		Region:       region,
+		AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		Source:       source,
+		Client:       &http.Client{Timeout: 10 * time.Second},
+		now:          time.Now,
+	}
+}
+
+// Get decrypts the ciphertext stored under name in Source.
+func (k *KMS) Get(name string) (Secret, error) {
+	ct, err := k.Source.Get(name)
+	if err != nil {
+		return Secret{}, err
+	}
+	body, err := json.Marshal(map[string]string{"CiphertextBlob": ct.Value})
+	if err != nil {
+		return Secret{}, err
+	}
+	req, err := http.NewRequest("POST", k.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return Secret{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService.Decrypt")
+	sigv4.Sign(req, body, sigv4.Credentials{AccessKey: k.AccessKey, SecretKey: k.SecretKey, SessionToken: k.SessionToken}, k.Region, "kms", k.now())
+	resp, err := k.Client.Do(req)
+	if err != nil {
+		return Secret{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Secret{}, fmt.Errorf("kms: decrypt %v returned %v", name, resp.Status)
+	}
+	var out struct {
+		Plaintext string
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return Secret{}, err
+	}
+	pt, err := base64.StdEncoding.DecodeString(out.Plaintext)
+	if err != nil {
+		return Secret{}, err
+	}
+	return Secret{Value: string(pt)}, nil
+}
@@ -0,0 +1,168 @@
+package secrets
+
+// secrets.go contains the provider abstraction used to load credentials and
+// keys. Providers are registered by name, like databases, and one is picked
+// with the -secrets flag.
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+// Names of the secrets the service loads.
+const (
+	MongoUser            = "MONGO_USER"
+	MongoPassword        = "MONGO_PASS"
+	PostgresURL          = "POSTGRES_URL"
+	MySQLDSN             = "MYSQL_DSN"
+	JWTKey               = "JWT_KEY"
+	CardEncryptionKey    = "CARD_ENCRYPTION_KEY"
+	PIIEncryptionKey     = "PII_ENCRYPTION_KEY"
+	AdminUsername        = "ADMIN_USERNAME"
+	AdminPassword        = "ADMIN_PASSWORD"
+	SMTPUsername         = "SMTP_USERNAME"
+	SMTPPassword         = "SMTP_PASSWORD"
+	SMSAuthToken         = "SMS_AUTH_TOKEN"
+	RedisPassword        = "REDIS_PASSWORD"
+	ArchiveEncryptionKey = "ARCHIVE_ENCRYPTION_KEY"
+	IntrospectionClients = "INTROSPECTION_CLIENTS"
+)
+
+// Secret is a value loaded from a provider. Leased secrets must be renewed
+// before LeaseDuration runs out.
+type Secret struct {
+	Value         string
+	LeaseDuration time.Duration
+	Renewable     bool
+}
+
+// Provider loads secrets by name.
+type Provider interface {
+	Get(name string) (Secret, error)
+}
+
+// Renewer is implemented by providers holding leases that need periodic
+// renewal. Renew returns how long the renewed lease lasts.
+type Renewer interface {
+	Renew() (time.Duration, error)
+}
+
+var (
+	provider string
+	dir      string
+	//DefaultProvider is the provider selected for the microservice
+	DefaultProvider Provider = Env{}
+	//Providers is a map of secret providers that can be used for this service
+	Providers = map[string]Provider{}
+	//ErrNoProviderFound is returned when the selected provider is not registered
+	ErrNoProviderFound = "No secrets provider with name %v registered"
+	//ErrNotFound is returned when a provider has no secret with the requested name
+	ErrNotFound = errors.New("Secret not found")
+)
+
+func init() {
+	flag.StringVar(&provider, "secrets", os.Getenv("SECRETS_PROVIDER"), "Secrets provider to use: env, file, vault or kms")
+	flag.StringVar(&dir, "secrets-dir", "/run/secrets", "Directory read by the file secrets provider")
+}
+
+// Register registers the provider in Providers
+func Register(name string, p Provider) {
+	Providers[name] = p
+}
+
+// Init registers the built in providers from their flags and selects the
+// DefaultProvider, keeping the environment when none is set.
+func Init() error {
+	if provider == "" {
+		return nil
+	}
+	Register("env", Env{})
+	Register("file", File{Dir: dir})
+	Register("vault", NewVault(vaultAddr, vaultToken, vaultPath))
+	Register("kms", NewKMS(kmsRegion, Env{}))
+	p, ok := Providers[provider]
+	if !ok {
+		return fmt.Errorf(ErrNoProviderFound, provider)
+	}
+	DefaultProvider = p
+	return nil
+}
+
+// Get invokes DefaultProvider method
+func Get(name string) (Secret, error) {
+	return DefaultProvider.Get(name)
+}
+
+// Value returns the value of the named secret, or "" if it can't be loaded.
+func Value(name string) string {
+	s, err := Get(name)
+	if err != nil {
+		return ""
+	}
+	return s.Value
+}
+
+// KeepRenewed renews the leases of the DefaultProvider until stop is closed,
+// renewing once two thirds of each lease has passed. Providers without
+// leases return immediately.
+func KeepRenewed(logger log.Logger, stop <-chan struct{}) {
+	r, ok := DefaultProvider.(Renewer)
+	if !ok {
+		return
+	}
+	wait := time.Duration(0)
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(wait):
+		}
+		lease, err := r.Renew()
+		if err != nil {
+			logger.Log("secrets", "renew", "err", err)
+			wait = time.Minute
+			continue
+		}
+		wait = lease * 2 / 3
+		if wait < time.Second {
+			wait = time.Second
+		}
+		logger.Log("secrets", "renew", "lease", lease)
+	}
+}
+
+// Env reads secrets from environment variables named after the secret.
+type Env struct{}
+
+// Get returns the environment variable called name.
+func (Env) Get(name string) (Secret, error) {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return Secret{}, ErrNotFound
+	}
+	return Secret{Value: v}, nil
+}
+
+// File reads secrets from files named after the secret in Dir, the layout
+// used by Docker and Kubernetes secret mounts.
+type File struct {
+	Dir string
+}
+
+// Get returns the trimmed contents of Dir/name.
+func (f File) Get(name string) (Secret, error) {
+	b, err := os.ReadFile(f.Dir + "/" + name)
+	if os.IsNotExist(err) {
+		return Secret{}, ErrNotFound
+	}
+	if err != nil {
+		return Secret{}, err
+	}
+	return Secret{Value: strings.TrimSpace(string(b))}, nil
+}
@@ -0,0 +1,109 @@
+package secrets
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEnv(t *testing.T) {
+	os.Setenv("SECRETS_TEST", "value")
+	defer os.Unsetenv("SECRETS_TEST")
+	s, err := Env{}.Get("SECRETS_TEST")
+	if err != nil || s.Value != "value" {
+		t.Errorf("expected env value received %v %v", s, err)
+	}
+	if _, err := (Env{}).Get("SECRETS_TEST_MISSING"); err != ErrNotFound {
+		t.Error("expected not found error")
+	}
+}
+
+func TestFile(t *testing.T) {
+	d := t.TempDir()
+	os.WriteFile(filepath.Join(d, JWTKey), []byte("key\n"), 0600)
+	s, err := File{Dir: d}.Get(JWTKey)
+	if err != nil || s.Value != "key" {
+		t.Errorf("expected trimmed file value received %q %v", s.Value, err)
+	}
+	if _, err := (File{Dir: d}).Get(MongoPassword); err != ErrNotFound {
+		t.Error("expected not found error")
+	}
+}
+
+func TestInit(t *testing.T) {
+	provider = "nosuchprovider"
+	defer func() { provider = "" }()
+	if err := Init(); err == nil {
+		t.Error("expected unregistered provider error")
+	}
+	provider = "file"
+	if err := Init(); err != nil {
+		t.Error(err)
+	}
+	if _, ok := DefaultProvider.(File); !ok {
+		t.Error("expected file provider selected")
+	}
+	DefaultProvider = Env{}
+}
+
+func TestVault(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/secret/data/user":
+			w.Write([]byte(`{"data":{"data":{"JWT_KEY":"vaultkey"}}}`))
+		case "/v1/auth/token/renew-self":
+			w.Write([]byte(`{"auth":{"lease_duration":3600,"renewable":true}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	v := NewVault(srv.URL, "token", "secret/data/user")
+	s, err := v.Get(JWTKey)
+	if err != nil || s.Value != "vaultkey" {
+		t.Errorf("expected vault value received %v %v", s, err)
+	}
+	if _, err := v.Get(MongoPassword); err != ErrNotFound {
+		t.Error("expected not found error")
+	}
+	lease, err := v.Renew()
+	if err != nil || lease != time.Hour {
+		t.Errorf("expected one hour lease received %v %v", lease, err)
+	}
+}
+
+func TestKMS(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		var in struct{ CiphertextBlob string }
+		json.NewDecoder(r.Body).Decode(&in)
+		ct, _ := base64.StdEncoding.DecodeString(in.CiphertextBlob)
+		json.NewEncoder(w).Encode(map[string]string{
+			"Plaintext": base64.StdEncoding.EncodeToString([]byte(strings.ToUpper(string(ct)))),
+		})
+	}))
+	defer srv.Close()
+	d := t.TempDir()
+	os.WriteFile(filepath.Join(d, CardEncryptionKey), []byte(base64.StdEncoding.EncodeToString([]byte("cardkey"))), 0600)
+	k := NewKMS("eu-west-1", File{Dir: d})
+	k.Endpoint = srv.URL + "/"
+	k.AccessKey = "AKID"
+	k.SecretKey = "secret"
+	s, err := k.Get(CardEncryptionKey)
+	if err != nil || s.Value != "CARDKEY" {
+		t.Errorf("expected decrypted value received %v %v", s, err)
+	}
+}
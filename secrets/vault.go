@@ -0,0 +1,100 @@
+package secrets
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	vaultAddr  string
+	vaultToken string
+	vaultPath  string
+)
+
+func init() {
+	flag.StringVar(&vaultAddr, "vault-addr", os.Getenv("VAULT_ADDR"), "Vault address")
+	flag.StringVar(&vaultToken, "vault-token", os.Getenv("VAULT_TOKEN"), "Vault token")
+	flag.StringVar(&vaultPath, "vault-path", "secret/data/user", "Vault KV v2 path holding the service secrets")
+}
+
+// Vault reads secrets from a HashiCorp Vault KV v2 path, one key per secret,
+// and keeps its token lease alive through Renew.
+type Vault struct {
+	Addr   string
+	Token  string
+	Path   string
+	Client *http.Client
+}
+
+// NewVault returns a Vault provider reading path from the server at addr.
+func NewVault(addr, token, path string) *Vault {
+	return &Vault{
+		Addr:   strings.TrimRight(addr, "/"),
+		Token:  token,
+		Path:   strings.Trim(path, "/"),
+		Client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+type vaultResponse struct {
+	LeaseDuration int  `json:"lease_duration"`
+	Renewable     bool `json:"renewable"`
+	Data          struct {
+		Data map[string]string `json:"data"`
+	} `json:"data"`
+	Auth struct {
+		LeaseDuration int  `json:"lease_duration"`
+		Renewable     bool `json:"renewable"`
+	} `json:"auth"`
+}
+
+// Get reads the key name from the configured path.
+func (v *Vault) Get(name string) (Secret, error) {
+	var r vaultResponse
+	if err := v.do("GET", "/v1/"+v.Path, &r); err != nil {
+		return Secret{}, err
+	}
+	val, ok := r.Data.Data[name]
+	if !ok {
+		return Secret{}, ErrNotFound
+	}
+	return Secret{
+		Value:         val,
+		LeaseDuration: time.Duration(r.LeaseDuration) * time.Second,
+		Renewable:     r.Renewable,
+	}, nil
+}
+
+// Renew extends the lease on the Vault token.
+func (v *Vault) Renew() (time.Duration, error) {
+	var r vaultResponse
+	if err := v.do("POST", "/v1/auth/token/renew-self", &r); err != nil {
+		return 0, err
+	}
+	return time.Duration(r.Auth.LeaseDuration) * time.Second, nil
+}
+
+func (v *Vault) do(method, path string, out interface{}) error {
+	req, err := http.NewRequest(method, v.Addr+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", v.Token)
+	resp, err := v.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("vault: %v %v returned %v", method, path, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
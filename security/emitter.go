@@ -0,0 +1,108 @@
+package security
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Emitter publishes security events. Emit must not block the caller for long.
+type Emitter interface {
+	Emit(e Event)
+}
+
+// Discard drops every event.
+var Discard Emitter = discard{}
+
+type discard struct{}
+
+func (discard) Emit(Event) {}
+
+// Multi fans events out to several emitters.
+type Multi []Emitter
+
+// Emit sends e to every emitter.
+func (m Multi) Emit(e Event) {
+	for _, em := range m {
+		em.Emit(e)
+	}
+}
+
+// JSONWriter writes events as JSON lines to W.
+type JSONWriter struct {
+	mtx sync.Mutex
+	W   io.Writer
+}
+
+// Emit encodes e on its own line.
+func (j *JSONWriter) Emit(e Event) {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	json.NewEncoder(j.W).Encode(e)
+}
+
+// Exporter decouples emitters from the request path with a buffered channel.
+// Events are dropped, and counted, when the buffer is full.
+type Exporter struct {
+	events  chan Event
+	next    Emitter
+	dropped prometheus.Counter
+	done    chan struct{}
+}
+
+// NewExporter starts an exporter delivering to next with the given buffer.
+func NewExporter(next Emitter, buffer int) *Exporter {
+	x := &Exporter{
+		events:  make(chan Event, buffer),
+		next:    next,
+		dropped: DroppedEvents,
+		done:    make(chan struct{}),
+	}
+	go x.run()
+	return x
+}
+
+// Emit queues e for delivery.
+func (x *Exporter) Emit(e Event) {
+	select {
+	case x.events <- e:
+	default:
+		x.dropped.Inc()
+	}
+}
+
+// Close delivers the queued events and stops the exporter.
+func (x *Exporter) Close() {
+	close(x.events)
+	<-x.done
+}
+
+func (x *Exporter) run() {
+	defer close(x.done)
+	for e := range x.events {
+		x.next.Emit(e)
+	}
+}
+
+var (
+	// Events counts emitted security events by type, for alerting.
+	Events = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "security_events_total",
+		Help: "Security events emitted, by type.",
+	}, []string{"type"})
+	// DroppedEvents counts events dropped by a full Exporter.
+	DroppedEvents = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "security_events_dropped_total",
+		Help: "Security events dropped because the exporter buffer was full.",
+	})
+)
+
+// Counter counts events in the Events metric.
+type Counter struct{}
+
+// Emit increments the counter for e's type.
+func (Counter) Emit(e Event) {
+	Events.WithLabelValues(string(e.Type)).Inc()
+}
@@ -0,0 +1,47 @@
+package security
+
+// events.go contains the schema of the security events we emit for SIEM
+// consumption. Events are serialised as one JSON object per line; fields are
+// only ever added, never renamed, so consumers can rely on them.
+
+import "time"
+
+// SchemaVersion is bumped when the meaning of an existing field changes.
+const SchemaVersion = 1
+
+// Type identifies what happened.
+type Type string
+
+const (
+	LoginFailed    Type = "login_failed"
+	LoginSucceeded Type = "login_succeeded"
+	AccountLocked  Type = "account_locked"
+	LockedAttempt  Type = "locked_attempt"
+	LoginBlocked   Type = "login_blocked"
+	MFARequired    Type = "mfa_required"
+	TokenReplay    Type = "token_replay"
+	TokenInvalid   Type = "token_invalid"
+	TokenExpired   Type = "token_expired"
+	// CardVerificationFailed is emitted for new cards failing their zero
+	// amount authorisation.
+	CardVerificationFailed Type = "card_verification_failed"
+)
+
+// Event is a single security relevant occurrence.
+type Event struct {
+	Schema   int               `json:"schema"`
+	Type     Type              `json:"type"`
+	Time     time.Time         `json:"time"`
+	UserID   string            `json:"userId,omitempty"`
+	Username string            `json:"username,omitempty"`
+	Locale   string            `json:"locale,omitempty"`
+	Timezone string            `json:"timezone,omitempty"`
+	IP       string            `json:"ip,omitempty"`
+	Reason   string            `json:"reason,omitempty"`
+	Details  map[string]string `json:"details,omitempty"`
+}
+
+// NewEvent returns an event of type t stamped with the current time.
+func NewEvent(t Type) Event {
+	return Event{Schema: SchemaVersion, Type: t, Time: time.Now().UTC()}
+}
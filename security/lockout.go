@@ -0,0 +1,73 @@
+package security
+
+import (
+	"sync"
+	"time"
+)
+
+// Lockout locks accounts out after too many failed logins within a window.
+// State is kept in memory per instance.
+type Lockout struct {
+	mtx      sync.Mutex
+	max      int
+	window   time.Duration
+	duration time.Duration
+	failures map[string][]time.Time
+	locked   map[string]time.Time
+	now      func() time.Time
+}
+
+// NewLockout locks an account for duration after max failures within window.
+func NewLockout(max int, window, duration time.Duration) *Lockout {
+	return &Lockout{
+		max:      max,
+		window:   window,
+		duration: duration,
+		failures: make(map[string][]time.Time),
+		locked:   make(map[string]time.Time),
+		now:      time.Now,
+	}
+}
+
+// Locked reports whether key is currently locked out.
+func (l *Lockout) Locked(key string) bool {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	until, ok := l.locked[key]
+	if !ok {
+		return false
+	}
+	if l.now().After(until) {
+		delete(l.locked, key)
+		return false
+	}
+	return true
+}
+
+// Fail records a failed attempt and reports whether it locked key out.
+func (l *Lockout) Fail(key string) bool {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	now := l.now()
+	recent := l.failures[key][:0]
+	for _, t := range l.failures[key] {
+		if now.Sub(t) < l.window {
+			recent = append(recent, t)
+		}
+	}
+	recent = append(recent, now)
+	if len(recent) >= l.max {
+		delete(l.failures, key)
+		l.locked[key] = now.Add(l.duration)
+		return true
+	}
+	l.failures[key] = recent
+	return false
+}
+
+// Succeed clears the failures recorded for key.
+func (l *Lockout) Succeed(key string) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	delete(l.failures, key)
+}
@@ -0,0 +1,70 @@
+package security
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestJSONWriter(t *testing.T) {
+	var b bytes.Buffer
+	e := NewEvent(LoginFailed)
+	e.Username = "eve"
+	(&JSONWriter{W: &b}).Emit(e)
+	var got map[string]interface{}
+	if err := json.Unmarshal(b.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got["type"] != "login_failed" || got["username"] != "eve" || got["schema"] != float64(SchemaVersion) {
+		t.Errorf("unexpected event %v", got)
+	}
+}
+
+type recorder []Event
+
+func (r *recorder) Emit(e Event) { *r = append(*r, e) }
+
+func TestExporter(t *testing.T) {
+	var r recorder
+	x := NewExporter(&r, 10)
+	x.Emit(NewEvent(TokenReplay))
+	x.Emit(NewEvent(AccountLocked))
+	x.Close()
+	if len(r) != 2 || r[0].Type != TokenReplay {
+		t.Errorf("expected two delivered events received %v", r)
+	}
+}
+
+func TestLockout(t *testing.T) {
+	now := time.Now()
+	l := NewLockout(3, time.Minute, time.Hour)
+	l.now = func() time.Time { return now }
+	if l.Fail("eve") || l.Fail("eve") {
+		t.Error("expected no lockout before three failures")
+	}
+	l.Succeed("eve")
+	l.Fail("eve")
+	l.Fail("eve")
+	if !l.Fail("eve") {
+		t.Error("expected lockout on third failure")
+	}
+	if !l.Locked("eve") || l.Locked("bob") {
+		t.Error("expected only eve locked")
+	}
+	now = now.Add(2 * time.Hour)
+	if l.Locked("eve") {
+		t.Error("expected lockout to expire")
+	}
+}
+
+func TestLockoutWindow(t *testing.T) {
+	now := time.Now()
+	l := NewLockout(2, time.Minute, time.Hour)
+	l.now = func() time.Time { return now }
+	l.Fail("eve")
+	now = now.Add(2 * time.Minute)
+	if l.Fail("eve") {
+		t.Error("expected failures outside the window to be forgotten")
+	}
+}
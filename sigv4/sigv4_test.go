@@ -0,0 +1,33 @@
+package sigv4
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSign(t *testing.T) {
+	req, _ := http.NewRequest("PUT", "https://bucket.s3.amazonaws.com/avatars/1.jpg", nil)
+	req.Header.Set("Content-Type", "image/jpeg")
+	now := time.Date(2016, 8, 1, 12, 0, 0, 0, time.UTC)
+	creds := Credentials{AccessKey: "AKID", SecretKey: "secret"}
+	Sign(req, []byte("body"), creds, "eu-west-1", "s3", now)
+	a := req.Header.Get("Authorization")
+	if !strings.HasPrefix(a, "AWS4-HMAC-SHA256 Credential=AKID/20160801/eu-west-1/s3/aws4_request, ") {
+		t.Errorf("unexpected credential scope in %v", a)
+	}
+	if !strings.Contains(a, "SignedHeaders=content-type;host;x-amz-content-sha256;x-amz-date,") {
+		t.Errorf("unexpected signed headers in %v", a)
+	}
+	if req.Header.Get("X-Amz-Date") != "20160801T120000Z" {
+		t.Error("expected amz date header")
+	}
+
+	again, _ := http.NewRequest("PUT", "https://bucket.s3.amazonaws.com/avatars/1.jpg", nil)
+	again.Header.Set("Content-Type", "image/jpeg")
+	Sign(again, []byte("body"), creds, "eu-west-1", "s3", now)
+	if again.Header.Get("Authorization") != a {
+		t.Error("expected signing to be deterministic")
+	}
+}
@@ -0,0 +1,41 @@
+package sms
+
+// sms.go contains the sending of text messages, used to verify the phone
+// numbers of customers. A provider is picked with the -sms flag.
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+var (
+	provider string
+	account  string
+	from     string
+	//ErrNoProviderFound is returned when the selected provider is unknown
+	ErrNoProviderFound = "No SMS provider with name %v"
+)
+
+func init() {
+	flag.StringVar(&provider, "sms", os.Getenv("SMS"), "Provider texting phone verification codes: twilio, phones can't be verified when empty")
+	flag.StringVar(&account, "sms-account", os.Getenv("SMS_ACCOUNT"), "Account id with the SMS provider")
+	flag.StringVar(&from, "sms-from", os.Getenv("SMS_FROM"), "Number or sender id text messages are sent from")
+}
+
+// Sender sends text messages.
+type Sender interface {
+	Send(to, body string) error
+}
+
+// New returns the provider selected by the flags, authenticating with key,
+// nil when no messages are sent.
+func New(key string) (Sender, error) {
+	switch provider {
+	case "":
+		return nil, nil
+	case "twilio":
+		return NewTwilio(account, key, from), nil
+	}
+	return nil, fmt.Errorf(ErrNoProviderFound, provider)
+}
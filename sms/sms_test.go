@@ -0,0 +1,47 @@
+package sms
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTwilio(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		user, pass, _ := r.BasicAuth()
+		if r.URL.Path != "/Accounts/AC1/Messages.json" || user != "AC1" || pass != "token" {
+			t.Errorf("unexpected request %v %v", r.URL.Path, user)
+		}
+		if r.Form.Get("To") == "+15005550001" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"message":"The 'To' number is not a valid phone number."}`))
+			return
+		}
+		if r.Form.Get("From") != "+15005550006" || r.Form.Get("Body") != "hello" {
+			t.Errorf("unexpected form %v", r.Form)
+		}
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"sid":"SM1"}`))
+	}))
+	defer ts.Close()
+	s := NewTwilio("AC1", "token", "+15005550006")
+	s.URL = ts.URL
+	if err := s.Send("+14155552671", "hello"); err != nil {
+		t.Error(err)
+	}
+	if err := s.Send("+15005550001", "hello"); err == nil {
+		t.Error("expected an invalid number to fail")
+	}
+}
+
+func TestNew(t *testing.T) {
+	if s, err := New("key"); s != nil || err != nil {
+		t.Errorf("expected no sender by default, got %v %v", s, err)
+	}
+	provider = "carrier-pigeon"
+	defer func() { provider = "" }()
+	if _, err := New("key"); err == nil {
+		t.Error("expected unknown provider to fail")
+	}
+}
@@ -0,0 +1,51 @@
+package sms
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TwilioURL is the Twilio API.
+const TwilioURL = "https://api.twilio.com/2010-04-01"
+
+// Twilio sends messages with the Twilio Messaging API.
+type Twilio struct {
+	AccountSID string
+	AuthToken  string
+	From       string
+	URL        string
+	Client     *http.Client
+}
+
+// NewTwilio returns a sender of the account sending from the given number.
+func NewTwilio(sid, token, from string) *Twilio {
+	return &Twilio{AccountSID: sid, AuthToken: token, From: from, URL: TwilioURL, Client: &http.Client{Timeout: 30 * time.Second}}
+}
+
+// Send texts body to the E.164 number to.
+func (t *Twilio) Send(to, body string) error {
+	form := url.Values{"To": {to}, "From": {t.From}, "Body": {body}}
+	req, err := http.NewRequest("POST", t.URL+"/Accounts/"+url.PathEscape(t.AccountSID)+"/Messages.json", strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(t.AccountSID, t.AuthToken)
+	resp, err := t.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		var r struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(resp.Body).Decode(&r)
+		return fmt.Errorf("twilio: returned %v: %v", resp.Status, r.Message)
+	}
+	return nil
+}
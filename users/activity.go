@@ -0,0 +1,26 @@
+package users
+
+import "time"
+
+// Activity types recorded in the activity feed of a user.
+const (
+	ActivityProfileUpdated  = "profile_updated"
+	ActivityUsernameChanged = "username_changed"
+	ActivityAddressAdded    = "address_added"
+	ActivityAddressUpdated  = "address_updated"
+	ActivityAddressRemoved  = "address_removed"
+	ActivityCardAdded       = "card_added"
+	ActivityCardUpdated     = "card_updated"
+	ActivityCardRemoved     = "card_removed"
+	ActivityPhoneVerified   = "phone_verified"
+)
+
+// Activity is an entry of the activity feed of a user. Details name what
+// changed, never the personal data itself.
+type Activity struct {
+	ID      string            `json:"id" bson:"-"`
+	UserID  string            `json:"userId" bson:"userId"`
+	Type    string            `json:"type" bson:"type"`
+	Time    time.Time         `json:"time" bson:"time"`
+	Details map[string]string `json:"details,omitempty" bson:"details,omitempty"`
+}
@@ -1,13 +1,102 @@
 package users
 
+import (
+	"fmt"
+	"time"
+)
+
+// Address types, orders ship to shipping addresses and payments are billed
+// to billing addresses. Addresses may also be untyped. A user has at most
+// one default address per type.
+const (
+	AddressBilling  = "billing"
+	AddressShipping = "shipping"
+)
+
+// Geocoding states of an address. Addresses are stored pending and geocoded
+// in the background, so writes don't wait for the geocoder.
+const (
+	GeocodePending = "pending"
+	GeocodeDone    = "done"
+	GeocodeFailed  = "failed"
+)
+
+// Location is a point in WGS84 degrees.
+type Location struct {
+	Lat float64 `json:"lat" bson:"lat"`
+	Lng float64 `json:"lng" bson:"lng"`
+}
+
+// Address is a postal address. Building, State and Prefecture are only used
+// by the countries whose addresses have them, State holding the state or
+// province and Prefecture the Japanese prefecture.
 type Address struct {
-	Street   string `json:"street" bson:"street,omitempty"`
-	Number   string `json:"number" bson:"number,omitempty"`
-	Country  string `json:"country" bson:"country,omitempty"`
-	City     string `json:"city" bson:"city,omitempty"`
-	PostCode string `json:"postcode" bson:"postcode,omitempty"`
-	ID       string `json:"id" bson:"-"`
-	Links    Links  `json:"_links"`
+	Street     string    `json:"street" bson:"street,omitempty" validate:"required,max=200"`
+	Number     string    `json:"number" bson:"number,omitempty" validate:"max=20"`
+	Building   string    `json:"building,omitempty" bson:"building,omitempty" validate:"max=100"`
+	Country    string    `json:"country" bson:"country,omitempty" validate:"required,max=100"`
+	State      string    `json:"state,omitempty" bson:"state,omitempty" validate:"max=100"`
+	Prefecture string    `json:"prefecture,omitempty" bson:"prefecture,omitempty" validate:"max=100"`
+	City       string    `json:"city" bson:"city,omitempty" validate:"required,max=100"`
+	PostCode   string    `json:"postcode" bson:"postcode,omitempty" validate:"max=20"`
+	Type       string    `json:"type,omitempty" bson:"type,omitempty" validate:"omitempty,oneof=billing shipping"`
+	Default    bool      `json:"default" bson:"default,omitempty"`
+	Validated  bool      `json:"validated" bson:"validated,omitempty"`
+	Location   *Location `json:"location,omitempty" bson:"location,omitempty"`
+	Geocode    string    `json:"geocode,omitempty" bson:"geocode,omitempty"`
+	ID         string    `json:"id" bson:"-"`
+	Links      Links     `json:"_links"`
+	CreatedAt  time.Time `json:"createdAt" bson:"createdAt,omitempty"`
+	UpdatedAt  time.Time `json:"updatedAt" bson:"updatedAt,omitempty"`
+}
+
+// ValidAddressType reports whether t is an address type, empty included.
+func ValidAddressType(t string) bool {
+	return t == "" || t == AddressBilling || t == AddressShipping
+}
+
+// Validate checks the type, only typed addresses can be a default.
+func (a Address) Validate() error {
+	if !ValidAddressType(a.Type) {
+		return fmt.Errorf(ErrInvalidField, "Type")
+	}
+	if a.Default && a.Type == "" {
+		return fmt.Errorf(ErrMissingField, "Type")
+	}
+	return nil
+}
+
+// ValidateAddresses checks each address and that there is at most one
+// default per type.
+func ValidateAddresses(as []Address) error {
+	defaults := map[string]bool{}
+	for _, a := range as {
+		if err := a.Validate(); err != nil {
+			return err
+		}
+		if a.Default {
+			if defaults[a.Type] {
+				return fmt.Errorf("more than one default %v address", a.Type)
+			}
+			defaults[a.Type] = true
+		}
+	}
+	return nil
+}
+
+// FilterAddresses returns the addresses of type t, all of them when t is
+// empty.
+func FilterAddresses(as []Address, t string) []Address {
+	if t == "" {
+		return as
+	}
+	fs := make([]Address, 0, len(as))
+	for _, a := range as {
+		if a.Type == t {
+			fs = append(fs, a)
+		}
+	}
+	return fs
 }
 
 func (a *Address) AddLinks() {
@@ -9,9 +9,35 @@ func TestAddLinksAdd(t *testing.T) {
 	domain = "mydomain"
 	a := Address{ID: "test"}
 	a.AddLinks()
-	h := Href{"http://mydomain/addresses/test"}
+	h := Href{Url: "http://mydomain/addresses/test"}
 	if !reflect.DeepEqual(a.Links["address"], h) {
 		t.Error("expected equal address links")
 	}
 
 }
+
+func TestAddressValidate(t *testing.T) {
+	if err := (Address{Type: "home"}).Validate(); err == nil {
+		t.Error("expected unknown type to be rejected")
+	}
+	if err := (Address{Default: true}).Validate(); err == nil {
+		t.Error("expected untyped default to be rejected")
+	}
+	as := []Address{{Type: AddressBilling, Default: true}, {Type: AddressShipping, Default: true}}
+	if err := ValidateAddresses(as); err != nil {
+		t.Errorf("expected a default per type to be accepted, got %v", err)
+	}
+	if err := ValidateAddresses(append(as, Address{Type: AddressBilling, Default: true})); err == nil {
+		t.Error("expected two billing defaults to be rejected")
+	}
+}
+
+func TestFilterAddresses(t *testing.T) {
+	as := []Address{{ID: "1", Type: AddressBilling}, {ID: "2", Type: AddressShipping}, {ID: "3"}}
+	if fs := FilterAddresses(as, AddressShipping); len(fs) != 1 || fs[0].ID != "2" {
+		t.Errorf("unexpected filtered addresses %v", fs)
+	}
+	if len(FilterAddresses(as, "")) != 3 {
+		t.Error("expected no filter without type")
+	}
+}
@@ -2,19 +2,241 @@ package users
 
 import (
 	"fmt"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 )
 
+// MaxHolderLength is the longest cardholder name accepted.
+const MaxHolderLength = 100
+
+var expiresPattern = regexp.MustCompile(`^(0[1-9]|1[0-2])/\d{2}$`)
+
+// Card is a payment card. Cards stored with a card vault keep only the
+// masked number locally, with the Token of the Vault provider.
 type Card struct {
-	LongNum string `json:"longNum" bson:"longNum"`
-	Expires string `json:"expires" bson:"expires"`
-	CCV     string `json:"ccv" bson:"ccv"`
-	ID      string `json:"id" bson:"-"`
-	Links   Links  `json:"_links" bson:"-"`
+	LongNum string `json:"longNum" bson:"longNum" pii:"randomized" validate:"required"`
+	Expires string `json:"expires" bson:"expires" validate:"required"`
+	Holder  string `json:"holder,omitempty" bson:"holder,omitempty" validate:"max=100"`
+	Brand   string `json:"brand,omitempty" bson:"brand,omitempty"`
+	Default bool   `json:"default" bson:"-"`
+	Token   string `json:"token,omitempty" bson:"token,omitempty"`
+	Vault   string `json:"vault,omitempty" bson:"vault,omitempty"`
+	// RemindedFor is the expiry the owner was last reminded of.
+	RemindedFor string `json:"-" bson:"remindedFor,omitempty"`
+	// Verification is the outcome of the zero amount authorisation of the
+	// card, empty when cards aren't verified.
+	Verification string `json:"verification,omitempty" bson:"verification,omitempty"`
+	// Replaces and ReplacedBy link a card to the card it replaced and the
+	// one replacing it. Deleted cards are kept masked with DeletedAt set,
+	// so orders referencing them still resolve.
+	Replaces   string     `json:"replaces,omitempty" bson:"replaces,omitempty"`
+	ReplacedBy string     `json:"replacedBy,omitempty" bson:"replacedBy,omitempty"`
+	DeletedAt  *time.Time `json:"deletedAt,omitempty" bson:"deletedAt,omitempty"`
+	// CCV is only accepted to tokenize new cards, it is never stored.
+	CCV       string    `json:"ccv,omitempty" bson:"-"`
+	ID        string    `json:"id" bson:"-"`
+	Links     Links     `json:"_links" bson:"-"`
+	CreatedAt time.Time `json:"createdAt" bson:"createdAt,omitempty"`
+	UpdatedAt time.Time `json:"updatedAt" bson:"updatedAt,omitempty"`
+}
+
+// Card verification statuses.
+const (
+	VerificationPending = "pending"
+	VerificationDone    = "verified"
+	VerificationFailed  = "failed"
+)
+
+// Card brands, as derived from the BIN by CardBrand.
+const (
+	BrandVisa       = "visa"
+	BrandMastercard = "mastercard"
+	BrandAmex       = "amex"
+	BrandDiscover   = "discover"
+	BrandDiners     = "diners"
+	BrandJCB        = "jcb"
+	BrandUnionPay   = "unionpay"
+	BrandMaestro    = "maestro"
+)
+
+// binRanges are the IIN prefix ranges of each brand, inclusive, compared on
+// as many leading digits as the bounds have. More specific ranges come
+// first.
+var binRanges = []struct {
+	from, to string
+	brand    string
+}{
+	{"4", "4", BrandVisa},
+	{"2221", "2720", BrandMastercard},
+	{"51", "55", BrandMastercard},
+	{"34", "34", BrandAmex},
+	{"37", "37", BrandAmex},
+	{"6011", "6011", BrandDiscover},
+	{"644", "649", BrandDiscover},
+	{"65", "65", BrandDiscover},
+	{"300", "305", BrandDiners},
+	{"36", "36", BrandDiners},
+	{"38", "39", BrandDiners},
+	{"3528", "3589", BrandJCB},
+	{"62", "62", BrandUnionPay},
+	{"50", "50", BrandMaestro},
+	{"56", "58", BrandMaestro},
+	{"6304", "6304", BrandMaestro},
+	{"67", "67", BrandMaestro},
+}
+
+// CardBrand returns the brand of the card number, empty when the BIN isn't
+// one we know.
+func CardBrand(pan string) string {
+	for _, r := range binRanges {
+		if len(pan) < len(r.from) {
+			continue
+		}
+		p := pan[:len(r.from)]
+		if p >= r.from && p <= r.to {
+			return r.brand
+		}
+	}
+	return ""
+}
+
+// NormalizePAN drops the spaces and dashes card numbers are often written
+// with.
+func NormalizePAN(pan string) string {
+	return strings.NewReplacer(" ", "", "-", "").Replace(pan)
+}
+
+// ValidLuhn reports whether pan is 12 to 19 digits with a valid Luhn check
+// digit.
+func ValidLuhn(pan string) bool {
+	if len(pan) < 12 || len(pan) > 19 {
+		return false
+	}
+	sum := 0
+	for i := range pan {
+		d := int(pan[len(pan)-1-i] - '0')
+		if d < 0 || d > 9 {
+			return false
+		}
+		if i%2 == 1 {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	return sum%10 == 0
+}
+
+// ExpiryEnd returns the end of the month of a MM/YY expiry, when the card
+// stops being valid.
+func ExpiryEnd(expires string) (time.Time, error) {
+	if !expiresPattern.MatchString(expires) {
+		return time.Time{}, &FieldError{Field: "expires", Reason: "not MM/YY"}
+	}
+	// Two digit years are this century, time.Parse would put 69 to 99 in
+	// the last one.
+	month, _ := strconv.Atoi(expires[:2])
+	year, _ := strconv.Atoi(expires[3:])
+	return time.Date(2000+year, time.Month(month)+1, 1, 0, 0, 0, 0, time.UTC), nil
+}
+
+// validateExpires checks expires is a MM/YY expiry that hasn't passed.
+func validateExpires(expires string) error {
+	end, err := ExpiryEnd(expires)
+	if err != nil {
+		return err
+	}
+	if !time.Now().UTC().Before(end) {
+		return &FieldError{Field: "expires", Reason: "expired"}
+	}
+	return nil
+}
+
+// Validate checks the number passes the Luhn check and the card hasn't
+// expired.
+func (c Card) Validate() error {
+	if !ValidLuhn(c.LongNum) {
+		return &FieldError{Field: "longNum", Reason: "not a card number"}
+	}
+	return validateExpires(c.Expires)
+}
+
+// MarkDefaultCard sets Default on the default card of the user and moves it
+// to the front, the other cards keep their order.
+func (u *User) MarkDefaultCard() {
+	for k := range u.Cards {
+		u.Cards[k].Default = u.DefaultCard != "" && u.Cards[k].ID == u.DefaultCard
+		if u.Cards[k].Default {
+			d := u.Cards[k]
+			copy(u.Cards[1:k+1], u.Cards[:k])
+			u.Cards[0] = d
+		}
+	}
+}
+
+// CardUpdate holds the card fields that can change after the card was
+// added. The number never changes, a new number is a new card.
+type CardUpdate struct {
+	Expires *string `json:"expires,omitempty"`
+	Holder  *string `json:"holder,omitempty"`
+}
+
+// Validate checks the update changes something, the expiry is MM/YY and
+// hasn't passed and the holder isn't too long.
+func (u CardUpdate) Validate() error {
+	if u.Expires == nil && u.Holder == nil {
+		return fmt.Errorf(ErrMissingField, "Expires or Holder")
+	}
+	if u.Expires != nil {
+		if err := validateExpires(*u.Expires); err != nil {
+			return err
+		}
+	}
+	if u.Holder != nil && (strings.TrimSpace(*u.Holder) == "" || len(*u.Holder) > MaxHolderLength) {
+		return &FieldError{Field: "holder", Reason: "empty or too long"}
+	}
+	return nil
+}
+
+// Fields returns the JSON names of the fields set on u.
+func (u CardUpdate) Fields() []string {
+	var fs []string
+	if u.Expires != nil {
+		fs = append(fs, "expires")
+	}
+	if u.Holder != nil {
+		fs = append(fs, "holder")
+	}
+	return fs
+}
+
+// cvvFields are the names the card verification value goes by.
+var cvvFields = map[string]bool{"ccv": true, "cvv": true, "cvc": true, "cvv2": true, "cvc2": true, "csc": true}
+
+// IsCVVField reports whether name, or the last part of a dotted name, refers
+// to the card verification value.
+func IsCVVField(name string) bool {
+	name = strings.TrimPrefix(name, "-")
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		name = name[i+1:]
+	}
+	return cvvFields[strings.ToLower(name)]
+}
+
+// StripCVV clears the card verification value, which may be passed on to a
+// card vault but must never be stored or logged.
+func (c *Card) StripCVV() {
+	c.CCV = ""
 }
 
 func (c *Card) MaskCC() {
 	l := len(c.LongNum) - 4
+	if l < 0 {
+		l = 0
+	}
 	c.LongNum = fmt.Sprintf("%v%v", strings.Repeat("*", l), c.LongNum[l:])
 }
 
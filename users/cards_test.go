@@ -2,20 +2,119 @@ package users
 
 import (
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestAddLinksCard(t *testing.T) {
 	domain = "mydomain"
 	c := Card{ID: "test"}
 	c.AddLinks()
-	h := Href{"http://mydomain/cards/test"}
+	h := Href{Url: "http://mydomain/cards/test"}
 	if !reflect.DeepEqual(c.Links["card"], h) {
 		t.Error("expected equal address links")
 	}
 
 }
 
+func TestCardUpdateValidate(t *testing.T) {
+	expires, holder, blank := "11/99", "Eve Smith", " "
+	if err := (CardUpdate{Expires: &expires, Holder: &holder}).Validate(); err != nil {
+		t.Errorf("expected valid update, got %v", err)
+	}
+	bad, expired := "13/29", "01/20"
+	for _, u := range []CardUpdate{{}, {Expires: &bad}, {Expires: &expired}, {Holder: &blank}} {
+		if err := u.Validate(); err == nil {
+			t.Errorf("expected %+v to be rejected", u)
+		}
+	}
+}
+
+func TestValidLuhn(t *testing.T) {
+	for _, pan := range []string{"4111111111111111", "5500005555555559", "378282246310005", "6011111111111117"} {
+		if !ValidLuhn(pan) {
+			t.Errorf("expected %v to pass", pan)
+		}
+	}
+	for _, pan := range []string{"4111111111111112", "41111111111", "4111x11111111111", ""} {
+		if ValidLuhn(pan) {
+			t.Errorf("expected %v to fail", pan)
+		}
+	}
+}
+
+func TestCardValidate(t *testing.T) {
+	cases := map[string]Card{
+		"":        {LongNum: "4111111111111111", Expires: "12/99"},
+		"longNum": {LongNum: "4111111111111112", Expires: "12/99"},
+		"expires": {LongNum: "4111111111111111", Expires: "12/2099"},
+	}
+	cases["expires "] = Card{LongNum: "4111111111111111", Expires: time.Now().AddDate(0, -1, 0).Format("01/06")}
+	for field, c := range cases {
+		err := c.Validate()
+		if field == "" {
+			if err != nil {
+				t.Errorf("expected %+v to be valid, got %v", c, err)
+			}
+			continue
+		}
+		if fe, ok := err.(*FieldError); !ok || fe.Field != strings.TrimSpace(field) {
+			t.Errorf("expected invalid %v, got %v", field, err)
+		}
+	}
+	if end, _ := ExpiryEnd("02/28"); !end.Equal(time.Date(2028, 3, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected expiry end %v", end)
+	}
+}
+
+func TestCardBrand(t *testing.T) {
+	cases := map[string]string{
+		"4111111111111111": BrandVisa,
+		"5500005555555559": BrandMastercard,
+		"2223000048400011": BrandMastercard,
+		"378282246310005":  BrandAmex,
+		"6011111111111117": BrandDiscover,
+		"30569309025904":   BrandDiners,
+		"3530111333300000": BrandJCB,
+		"6200000000000005": BrandUnionPay,
+		"1234567890123456": "",
+	}
+	for pan, brand := range cases {
+		if b := CardBrand(pan); b != brand {
+			t.Errorf("%v: expected %q received %q", pan, brand, b)
+		}
+	}
+}
+
+func TestMarkDefaultCard(t *testing.T) {
+	u := User{DefaultCard: "c", Cards: []Card{{ID: "a"}, {ID: "b"}, {ID: "c"}}}
+	u.MarkDefaultCard()
+	if u.Cards[0].ID != "c" || !u.Cards[0].Default || u.Cards[1].ID != "a" || u.Cards[2].ID != "b" || u.Cards[1].Default {
+		t.Errorf("expected default card first, got %+v", u.Cards)
+	}
+}
+
+func TestCVVNeverStored(t *testing.T) {
+	f, _ := reflect.TypeOf(Card{}).FieldByName("CCV")
+	if f.Tag.Get("bson") != "-" {
+		t.Errorf("expected the CCV never to be stored, got bson tag %q", f.Tag.Get("bson"))
+	}
+	c := Card{LongNum: "4111111111111111", CCV: "123"}
+	c.StripCVV()
+	if c.CCV != "" {
+		t.Error("expected the CCV stripped")
+	}
+	for _, name := range []string{"ccv", "CVV", "cards.cvc", "-cvv2"} {
+		if !IsCVVField(name) {
+			t.Errorf("expected %v to name the CVV", name)
+		}
+	}
+	if IsCVVField("expires") {
+		t.Error("expected expires not to name the CVV")
+	}
+}
+
 func TestMaskCC(t *testing.T) {
 	test1 := "1234567890"
 	c := Card{LongNum: test1}
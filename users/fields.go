@@ -0,0 +1,59 @@
+package users
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Fields maps the JSON names of the user fields clients can select to their
+// document fields. Fields that aren't stored, like id and _links, map to "".
+var Fields = userFields()
+
+func userFields() map[string]string {
+	fs := map[string]string{}
+	t := reflect.TypeOf(User{})
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		doc := strings.Split(t.Field(i).Tag.Get("bson"), ",")[0]
+		if doc == "-" || t.Field(i).Tag.Get("bson") == "" {
+			doc = ""
+		}
+		fs[name] = doc
+	}
+	return fs
+}
+
+// ValidateFields checks every name is one of Fields.
+func ValidateFields(names []string) error {
+	for _, n := range names {
+		if _, ok := Fields[n]; !ok {
+			return fmt.Errorf(ErrInvalidField, n)
+		}
+	}
+	return nil
+}
+
+// Select returns the JSON representation of u reduced to the given fields,
+// the id is always kept.
+func (u User) Select(names []string) (map[string]interface{}, error) {
+	b, err := json.Marshal(u)
+	if err != nil {
+		return nil, err
+	}
+	all := map[string]interface{}{}
+	if err := json.Unmarshal(b, &all); err != nil {
+		return nil, err
+	}
+	sel := map[string]interface{}{"id": all["id"]}
+	for _, n := range names {
+		if v, ok := all[n]; ok {
+			sel[n] = v
+		}
+	}
+	return sel, nil
+}
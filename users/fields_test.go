@@ -0,0 +1,29 @@
+package users
+
+import "testing"
+
+func TestFields(t *testing.T) {
+	if Fields["firstName"] != "firstName" || Fields["id"] != "" || Fields["_links"] != "" {
+		t.Errorf("unexpected fields %v", Fields)
+	}
+	if _, ok := Fields["password"]; ok {
+		t.Error("expected hidden fields left out")
+	}
+	if ValidateFields([]string{"username", "status"}) != nil {
+		t.Error("expected known fields to be valid")
+	}
+	if ValidateFields([]string{"username", "password"}) == nil {
+		t.Error("expected hidden field to be rejected")
+	}
+}
+
+func TestSelect(t *testing.T) {
+	u := User{UserID: "1", Username: "eve", FirstName: "Eve", Status: StatusActive}
+	m, err := u.Select([]string{"username", "tags"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 2 || m["id"] != "1" || m["username"] != "eve" {
+		t.Errorf("unexpected selection %v", m)
+	}
+}
@@ -0,0 +1,39 @@
+package users
+
+import (
+	"fmt"
+	"time"
+)
+
+// Group is an organization or team of users. Owners manage the group and
+// can see the profiles of its members.
+type Group struct {
+	ID        string    `json:"id" bson:"-"`
+	Name      string    `json:"name" bson:"name"`
+	Owners    []string  `json:"owners" bson:"owners"`
+	Members   []string  `json:"members" bson:"members"`
+	CreatedAt time.Time `json:"createdAt" bson:"createdAt,omitempty"`
+	Links     Links     `json:"_links" bson:"-"`
+}
+
+// Validate checks the group can be created.
+func (g *Group) Validate() error {
+	if g.Name == "" {
+		return fmt.Errorf(ErrMissingField, "Name")
+	}
+	return nil
+}
+
+// IsOwner reports whether the user owns the group.
+func (g *Group) IsOwner(userID string) bool {
+	return contains(g.Owners, userID)
+}
+
+// IsMember reports whether the user is a member or an owner of the group.
+func (g *Group) IsMember(userID string) bool {
+	return contains(g.Members, userID) || g.IsOwner(userID)
+}
+
+func (g *Group) AddLinks() {
+	g.Links.AddGroup(g.ID)
+}
@@ -0,0 +1,16 @@
+package users
+
+import "testing"
+
+func TestGroupMembership(t *testing.T) {
+	g := Group{Name: "acme", Owners: []string{"o"}, Members: []string{"m"}}
+	if !g.IsOwner("o") || g.IsOwner("m") {
+		t.Error("expected only the owner to own the group")
+	}
+	if !g.IsMember("o") || !g.IsMember("m") || g.IsMember("x") {
+		t.Error("expected owners and members to be members")
+	}
+	if err := (&Group{}).Validate(); err == nil {
+		t.Error("expected group without name to be rejected")
+	}
+}
@@ -0,0 +1,26 @@
+package users
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+)
+
+// RoleGuest is held by anonymous users created for guest checkout until
+// they register.
+const RoleGuest = "guest"
+
+// ErrNotGuest is returned when upgrading a user that is not a guest
+var ErrNotGuest = errors.New("Not a guest")
+
+// NewGuest returns an anonymous user with a generated username. Guests have
+// no password, so they can't log in.
+func NewGuest() User {
+	u := New()
+	b := make([]byte, 8)
+	rand.Read(b)
+	u.Username = "guest-" + hex.EncodeToString(b)
+	u.Roles = []string{RoleGuest}
+	u.Status = StatusActive
+	return u
+}
@@ -0,0 +1,16 @@
+package users
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNewGuest(t *testing.T) {
+	a, b := NewGuest(), NewGuest()
+	if !strings.HasPrefix(a.Username, "guest-") || a.Username == b.Username {
+		t.Errorf("expected unique guest usernames, got %v and %v", a.Username, b.Username)
+	}
+	if !a.HasRole(RoleGuest) || a.Password != "" || a.Salt == "" {
+		t.Errorf("unexpected guest %+v", a)
+	}
+}
@@ -3,7 +3,9 @@ package users
 import (
 	"flag"
 	"fmt"
+	"net/url"
 	"os"
+	"strings"
 )
 
 var (
@@ -12,20 +14,56 @@ var (
 		"customer": "customers",
 		"address":  "addresses",
 		"card":     "cards",
+		"group":    "groups",
 	}
 )
 
+// LinkTemplates are the links of each entity by relation, {id} standing for
+// its id. Links keeping variables after expansion are templated, their
+// query is RFC 6570 form-style.
+var LinkTemplates = map[string]map[string]string{
+	"customer": {
+		"self":      "/customers/{id}",
+		"customer":  "/customers/{id}",
+		"addresses": "/customers/{id}/addresses",
+		"cards":     "/customers/{id}/cards",
+		"groups":    "/customers/{id}/groups",
+		"activity":  "/customers/{id}/activity{?cursor,limit}",
+	},
+	"address": {
+		"self":    "/addresses/{id}",
+		"address": "/addresses/{id}",
+	},
+	"card": {
+		"self": "/cards/{id}",
+		"card": "/cards/{id}",
+	},
+	"group": {
+		"self":  "/groups/{id}",
+		"group": "/groups/{id}",
+	},
+}
+
 func init() {
 	flag.StringVar(&domain, "link-domain", os.Getenv("HATEAOS"), "HATEAOS link domain")
 }
 
 type Links map[string]Href
 
+// AddLinks sets the links of the entity with id from its LinkTemplates.
+func (l *Links) AddLinks(ent, id string) {
+	nl := make(Links)
+	for rel, t := range LinkTemplates[ent] {
+		nl[rel] = Expand(t, map[string]string{"id": id})
+	}
+	*l = nl
+}
+
 func (l *Links) AddLink(ent string, id string) {
 	nl := make(Links)
 	link := fmt.Sprintf("http://%v/%v/%v", domain, entitymap[ent], id)
-	nl[ent] = Href{link}
-	nl["self"] = Href{link}
+	nl[ent] = Href{Url: link}
+	nl["self"] = Href{Url: link}
 	*l = nl
 
 }
@@ -33,24 +71,40 @@ func (l *Links) AddLink(ent string, id string) {
 func (l *Links) AddAttrLink(attr string, corent string, id string) {
 	link := fmt.Sprintf("http://%v/%v/%v/%v", domain, entitymap[corent], id, entitymap[attr])
 	nl := *l
-	nl[entitymap[attr]] = Href{link}
+	nl[entitymap[attr]] = Href{Url: link}
 	*l = nl
 }
 
 func (l *Links) AddCustomer(id string) {
-	l.AddLink("customer", id)
-	l.AddAttrLink("address", "customer", id)
-	l.AddAttrLink("card", "customer", id)
+	l.AddLinks("customer", id)
 }
 
 func (l *Links) AddAddress(id string) {
-	l.AddLink("address", id)
+	l.AddLinks("address", id)
 }
 
 func (l *Links) AddCard(id string) {
-	l.AddLink("card", id)
+	l.AddLinks("card", id)
+}
+
+func (l *Links) AddGroup(id string) {
+	l.AddLinks("group", id)
+}
+
+// Expand returns the link of template on the link domain with the simple
+// {name} variables in vars filled in. Links with variables left, like
+// {?cursor,limit}, are marked templated.
+func Expand(template string, vars map[string]string) Href {
+	for k, v := range vars {
+		template = strings.ReplaceAll(template, "{"+k+"}", url.PathEscape(v))
+	}
+	return Href{
+		Url:       fmt.Sprintf("http://%v%v", domain, template),
+		Templated: strings.Contains(template, "{"),
+	}
 }
 
 type Href struct {
-	Url string `json:"href"`
+	Url       string `json:"href"`
+	Templated bool   `json:"templated,omitempty"`
 }
@@ -0,0 +1,35 @@
+package users
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+
+	// Timezones are checked against the embedded IANA database, so images
+	// without zoneinfo validate the same.
+	_ "time/tzdata"
+)
+
+// locale matches BCP 47 language tags made of a language, optional script
+// and region, and variants, e.g. en, en-GB, zh-Hant-TW or de-CH-1996.
+var locale = regexp.MustCompile(`(?i)^[a-z]{2,3}(-[a-z]{4})?(-([a-z]{2}|[0-9]{3}))?(-([a-z0-9]{5,8}|[0-9][a-z0-9]{3}))*$`)
+
+// ValidateLocale checks l is a BCP 47 language tag.
+func ValidateLocale(l string) error {
+	if !locale.MatchString(l) {
+		return fmt.Errorf(ErrInvalidField, "Locale")
+	}
+	return nil
+}
+
+// ValidateTimezone checks tz names a zone of the IANA database, like
+// Europe/Amsterdam.
+func ValidateTimezone(tz string) error {
+	if tz == "" || tz == "Local" {
+		return fmt.Errorf(ErrInvalidField, "Timezone")
+	}
+	if _, err := time.LoadLocation(tz); err != nil {
+		return fmt.Errorf(ErrInvalidField, "Timezone")
+	}
+	return nil
+}
@@ -0,0 +1,19 @@
+package users
+
+import "testing"
+
+func TestValidateLocale(t *testing.T) {
+	for l, valid := range map[string]bool{"en": true, "en-GB": true, "zh-Hant-TW": true, "es-419": true, "de-CH-1996": true, "": false, "english": false, "en_GB": false, "en-": false} {
+		if (ValidateLocale(l) == nil) != valid {
+			t.Errorf("expected locale %q valid %v", l, valid)
+		}
+	}
+}
+
+func TestValidateTimezone(t *testing.T) {
+	for tz, valid := range map[string]bool{"Europe/Amsterdam": true, "UTC": true, "America/Argentina/Buenos_Aires": true, "": false, "Local": false, "Mars/Olympus": false} {
+		if (ValidateTimezone(tz) == nil) != valid {
+			t.Errorf("expected timezone %q valid %v", tz, valid)
+		}
+	}
+}
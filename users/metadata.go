@@ -0,0 +1,44 @@
+package users
+
+import (
+	"fmt"
+	"regexp"
+)
+
+const (
+	// MaxMetadataKeys is the most metadata entries a user can carry.
+	MaxMetadataKeys = 50
+	// MaxMetadataValueLength is the longest metadata value accepted.
+	MaxMetadataValueLength = 500
+)
+
+var metadataKey = regexp.MustCompile(`^[A-Za-z0-9_-]{1,40}$`)
+
+// ValidateMetadataKey checks k can name a metadata entry: up to 40 letters,
+// digits, - and _.
+func ValidateMetadataKey(k string) error {
+	if !metadataKey.MatchString(k) {
+		return fmt.Errorf(ErrInvalidField, "Metadata key "+k)
+	}
+	return nil
+}
+
+// MergeMetadata applies the merge patch p to m: nil values remove their
+// key, others set it. The result must stay within MaxMetadataKeys.
+func MergeMetadata(m map[string]string, p map[string]*string) (map[string]string, error) {
+	merged := make(map[string]string, len(m)+len(p))
+	for k, v := range m {
+		merged[k] = v
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(merged, k)
+			continue
+		}
+		merged[k] = *v
+	}
+	if len(merged) > MaxMetadataKeys {
+		return nil, fmt.Errorf("metadata has more than %v keys", MaxMetadataKeys)
+	}
+	return merged, nil
+}
@@ -0,0 +1,29 @@
+package users
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestValidateMetadataKey(t *testing.T) {
+	for k, valid := range map[string]bool{"crm_id": true, "legacy-ID": true, "": false, "a.b": false, "$set": false} {
+		if (ValidateMetadataKey(k) == nil) != valid {
+			t.Errorf("expected key %q valid %v", k, valid)
+		}
+	}
+}
+
+func TestMergeMetadata(t *testing.T) {
+	v := "2"
+	m, err := MergeMetadata(map[string]string{"a": "1", "b": "1"}, map[string]*string{"a": nil, "c": &v})
+	if err != nil || len(m) != 2 || m["b"] != "1" || m["c"] != "2" {
+		t.Errorf("unexpected merge %v %v", m, err)
+	}
+	p := map[string]*string{}
+	for i := 0; i <= MaxMetadataKeys; i++ {
+		p[strconv.Itoa(i)] = &v
+	}
+	if _, err := MergeMetadata(nil, p); err == nil {
+		t.Error("expected too many keys to be rejected")
+	}
+}
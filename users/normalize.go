@@ -0,0 +1,14 @@
+package users
+
+import "strings"
+
+// NormalizeUsername returns the form usernames are matched by, so "Alice"
+// and "alice" name the same account. The username itself keeps its case.
+func NormalizeUsername(s string) string {
+	return strings.ToLower(s)
+}
+
+// NormalizeEmail returns the form emails are stored and matched in.
+func NormalizeEmail(s string) string {
+	return strings.ToLower(strings.TrimSpace(s))
+}
@@ -0,0 +1,41 @@
+package users
+
+import (
+	"regexp"
+	"strings"
+	"time"
+)
+
+// e164Pattern matches E.164 numbers: a plus, a country code not starting
+// with 0 and at most 15 digits in all.
+var e164Pattern = regexp.MustCompile(`^\+[1-9][0-9]{1,14}$`)
+
+// phoneSeparators are dropped from phone numbers as people write them.
+var phoneSeparators = strings.NewReplacer(" ", "", "-", "", ".", "", "(", "", ")", "")
+
+// NormalizePhone returns the form phone numbers are stored in, without the
+// spaces, dashes, dots and brackets they are often written with.
+func NormalizePhone(s string) string {
+	return phoneSeparators.Replace(strings.TrimSpace(s))
+}
+
+// ValidatePhone checks s is an E.164 number, such as +442071838750.
+func ValidatePhone(s string) error {
+	if !e164Pattern.MatchString(s) {
+		return &FieldError{Field: "phone", Reason: "expected an E.164 number such as +442071838750"}
+	}
+	return nil
+}
+
+// PhoneCode is a pending phone verification: the hash of the code texted to
+// the phone, when it expires and how often it was tried.
+type PhoneCode struct {
+	Hash     string    `bson:"hash"`
+	Expires  time.Time `bson:"expires"`
+	Attempts int       `bson:"attempts"`
+}
+
+// Expired reports whether the code can no longer be tried at t.
+func (c *PhoneCode) Expired(t time.Time, maxAttempts int) bool {
+	return c == nil || !t.Before(c.Expires) || c.Attempts >= maxAttempts
+}
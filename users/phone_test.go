@@ -0,0 +1,51 @@
+package users
+
+import (
+	"testing"
+	"time"
+)
+
+func TestValidatePhone(t *testing.T) {
+	for _, p := range []string{"+442071838750", "+14155552671", "+31612345678"} {
+		if err := ValidatePhone(p); err != nil {
+			t.Errorf("expected %v to be valid, got %v", p, err)
+		}
+	}
+	for _, p := range []string{"", "02071838750", "+0442071838750", "+44 20 7183 8750", "+4420718387501234"} {
+		if err := ValidatePhone(p); err == nil {
+			t.Errorf("expected %v to be rejected", p)
+		}
+	}
+}
+
+func TestNormalizePhone(t *testing.T) {
+	if p := NormalizePhone(" +44 (20) 7183-8750 "); p != "+442071838750" {
+		t.Errorf("unexpected normalized phone %v", p)
+	}
+}
+
+func TestPhoneCodeExpired(t *testing.T) {
+	now := time.Now()
+	c := &PhoneCode{Expires: now.Add(time.Minute)}
+	if c.Expired(now, 5) {
+		t.Error("expected code valid")
+	}
+	if !c.Expired(now.Add(time.Minute), 5) {
+		t.Error("expected code expired")
+	}
+	c.Attempts = 5
+	if !c.Expired(now, 5) {
+		t.Error("expected code used up")
+	}
+	if !(*PhoneCode)(nil).Expired(now, 5) {
+		t.Error("expected no code to be expired")
+	}
+}
+
+func TestApplyPhone(t *testing.T) {
+	u := User{Phone: "+442071838750", PhoneVerified: true, PhoneCode: &PhoneCode{}}
+	ProfileUpdate{Phone: str("+14155552671")}.Apply(&u)
+	if u.Phone != "+14155552671" || u.PhoneVerified || u.PhoneCode != nil {
+		t.Errorf("expected a new phone to need verifying, got %+v", u)
+	}
+}
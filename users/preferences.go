@@ -0,0 +1,72 @@
+package users
+
+import "fmt"
+
+const (
+	// DefaultCurrency is used until a customer picks one.
+	DefaultCurrency = "USD"
+	// DefaultTheme is used until a customer picks one.
+	DefaultTheme = "light"
+)
+
+// Themes lists the accepted theme preferences.
+var Themes = []string{"light", "dark", "system"}
+
+// Preferences are the customer's settings, stored as a nested document on
+// the user. Unset fields read back as their defaults.
+type Preferences struct {
+	Newsletter bool   `json:"newsletter" bson:"newsletter"`
+	Currency   string `json:"currency" bson:"currency,omitempty"`
+	Theme      string `json:"theme" bson:"theme,omitempty"`
+}
+
+// WithDefaults returns p with unset fields replaced by their defaults.
+func (p Preferences) WithDefaults() Preferences {
+	if p.Currency == "" {
+		p.Currency = DefaultCurrency
+	}
+	if p.Theme == "" {
+		p.Theme = DefaultTheme
+	}
+	return p
+}
+
+// Validate checks the set fields. Currency must be an ISO 4217 style code.
+func (p Preferences) Validate() error {
+	if p.Currency != "" && !isCurrencyCode(p.Currency) {
+		return fmt.Errorf(ErrInvalidField, "Currency")
+	}
+	if p.Theme != "" && !contains(Themes, p.Theme) {
+		return fmt.Errorf(ErrInvalidField, "Theme")
+	}
+	return nil
+}
+
+// GetPreferences returns the user's preferences with defaults applied.
+func (u *User) GetPreferences() Preferences {
+	if u.Preferences == nil {
+		return Preferences{}.WithDefaults()
+	}
+	return u.Preferences.WithDefaults()
+}
+
+func isCurrencyCode(s string) bool {
+	if len(s) != 3 {
+		return false
+	}
+	for _, c := range s {
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+func contains(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,26 @@
+package users
+
+import "testing"
+
+func TestPreferencesDefaults(t *testing.T) {
+	u := User{}
+	if p := u.GetPreferences(); p.Currency != DefaultCurrency || p.Theme != DefaultTheme || p.Newsletter {
+		t.Errorf("expected defaults, got %v", p)
+	}
+	u.Preferences = &Preferences{Newsletter: true, Theme: "dark"}
+	if p := u.GetPreferences(); p.Currency != DefaultCurrency || p.Theme != "dark" || !p.Newsletter {
+		t.Errorf("expected stored values kept, got %v", p)
+	}
+}
+
+func TestPreferencesValidate(t *testing.T) {
+	if err := (Preferences{Currency: "EUR", Theme: "system"}).Validate(); err != nil {
+		t.Error(err)
+	}
+	if err := (Preferences{Currency: "eur"}).Validate(); err == nil {
+		t.Error("expected lower case currency to be rejected")
+	}
+	if err := (Preferences{Theme: "pink"}).Validate(); err == nil {
+		t.Error("expected unknown theme to be rejected")
+	}
+}
@@ -0,0 +1,154 @@
+package users
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ProfileUpdate holds the profile fields that can change after
+// registration. Nil fields are left untouched.
+type ProfileUpdate struct {
+	FirstName *string `json:"firstName" pii:"randomized"`
+	LastName  *string `json:"lastName" pii:"randomized"`
+	Email     *string `json:"email" pii:"deterministic"`
+	Locale    *string `json:"locale"`
+	Timezone  *string `json:"timezone"`
+	Phone     *string `json:"phone" pii:"randomized"`
+	// PhoneVerified and PhoneCode are set by phone verification only.
+	PhoneVerified *bool      `json:"-"`
+	PhoneCode     *PhoneCode `json:"-"`
+	// Avatar is set by uploads only, never from request bodies.
+	Avatar map[string]string `json:"-"`
+	// Preferences replace the stored preferences when set.
+	Preferences *Preferences `json:"-"`
+	// Status is changed through lifecycle transitions only.
+	Status *string `json:"-"`
+	// Password and Salt are set by password resets only, the hash of the
+	// new password and its salt.
+	Password *string `json:"-"`
+	Salt     *string `json:"-"`
+	// Metadata is a merge patch of the metadata: nil values remove their
+	// key. It is set by PATCH requests only.
+	Metadata map[string]*string `json:"-"`
+}
+
+// Complete reports whether every field is set, as required for a
+// replacement of the whole profile.
+func (p ProfileUpdate) Complete() error {
+	if p.FirstName == nil {
+		return fmt.Errorf(ErrMissingField, "FirstName")
+	}
+	if p.LastName == nil {
+		return fmt.Errorf(ErrMissingField, "LastName")
+	}
+	if p.Email == nil {
+		return fmt.Errorf(ErrMissingField, "Email")
+	}
+	return nil
+}
+
+// Validate checks the fields that are set. Names can't be cleared, email,
+// locale and timezone can but must be valid otherwise.
+func (p ProfileUpdate) Validate() error {
+	if p.FirstName != nil && *p.FirstName == "" {
+		return fmt.Errorf(ErrMissingField, "FirstName")
+	}
+	if p.LastName != nil && *p.LastName == "" {
+		return fmt.Errorf(ErrMissingField, "LastName")
+	}
+	if p.Email != nil && *p.Email != "" && !strings.Contains(*p.Email, "@") {
+		return fmt.Errorf(ErrInvalidField, "Email")
+	}
+	if p.Locale != nil && *p.Locale != "" {
+		if err := ValidateLocale(*p.Locale); err != nil {
+			return err
+		}
+	}
+	if p.Timezone != nil && *p.Timezone != "" {
+		if err := ValidateTimezone(*p.Timezone); err != nil {
+			return err
+		}
+	}
+	if p.Phone != nil && *p.Phone != "" {
+		if err := ValidatePhone(*p.Phone); err != nil {
+			return err
+		}
+	}
+	for k, v := range p.Metadata {
+		if err := ValidateMetadataKey(k); err != nil {
+			return err
+		}
+		if v != nil && len(*v) > MaxMetadataValueLength {
+			return fmt.Errorf(ErrInvalidField, "Metadata "+k)
+		}
+	}
+	return nil
+}
+
+// Fields returns the names of the set fields.
+func (p ProfileUpdate) Fields() []string {
+	var fs []string
+	for _, f := range []struct {
+		name string
+		set  bool
+	}{
+		{"firstName", p.FirstName != nil},
+		{"lastName", p.LastName != nil},
+		{"email", p.Email != nil},
+		{"locale", p.Locale != nil},
+		{"timezone", p.Timezone != nil},
+		{"phone", p.Phone != nil},
+		{"avatar", p.Avatar != nil},
+		{"preferences", p.Preferences != nil},
+		{"status", p.Status != nil},
+		{"metadata", p.Metadata != nil},
+	} {
+		if f.set {
+			fs = append(fs, f.name)
+		}
+	}
+	return fs
+}
+
+// Apply copies the set fields onto u.
+func (p ProfileUpdate) Apply(u *User) {
+	if p.FirstName != nil {
+		u.FirstName = *p.FirstName
+	}
+	if p.LastName != nil {
+		u.LastName = *p.LastName
+	}
+	if p.Email != nil {
+		u.Email = *p.Email
+	}
+	if p.Locale != nil {
+		u.Locale = *p.Locale
+	}
+	if p.Timezone != nil {
+		u.Timezone = *p.Timezone
+	}
+	if p.Phone != nil {
+		u.Phone = *p.Phone
+		u.PhoneVerified = false
+		u.PhoneCode = nil
+	}
+	if p.PhoneVerified != nil {
+		u.PhoneVerified = *p.PhoneVerified
+		u.PhoneCode = nil
+	}
+	if p.PhoneCode != nil {
+		u.PhoneCode = p.PhoneCode
+	}
+	if p.Avatar != nil {
+		u.Avatar = p.Avatar
+	}
+	if p.Preferences != nil {
+		u.Preferences = p.Preferences
+	}
+	if p.Status != nil {
+		u.Status = *p.Status
+	}
+	if p.Metadata != nil {
+		u.Metadata, _ = MergeMetadata(u.Metadata, p.Metadata)
+	}
+}
@@ -0,0 +1,60 @@
+package users
+
+import (
+	"fmt"
+	"testing"
+)
+
+func str(s string) *string {
+	return &s
+}
+
+func TestProfileComplete(t *testing.T) {
+	p := ProfileUpdate{FirstName: str("a"), LastName: str("b")}
+	if err := p.Complete(); err == nil || err.Error() != fmt.Sprintf(ErrMissingField, "Email") {
+		t.Error("expected missing email error")
+	}
+	p.Email = str("")
+	if err := p.Complete(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestProfileValidate(t *testing.T) {
+	if err := (ProfileUpdate{FirstName: str("")}).Validate(); err == nil {
+		t.Error("expected empty first name to be rejected")
+	}
+	if err := (ProfileUpdate{Email: str("nope")}).Validate(); err == nil {
+		t.Error("expected invalid email to be rejected")
+	}
+	if err := (ProfileUpdate{Email: str("")}).Validate(); err != nil {
+		t.Error("expected email to be clearable")
+	}
+	if err := (ProfileUpdate{Locale: str("nl-NL"), Timezone: str("Europe/Amsterdam")}).Validate(); err != nil {
+		t.Errorf("expected locale and timezone to be accepted, got %v", err)
+	}
+	if err := (ProfileUpdate{Timezone: str("Europe/Nowhere")}).Validate(); err == nil {
+		t.Error("expected unknown timezone to be rejected")
+	}
+	if err := (ProfileUpdate{Phone: str("020 7183 8750")}).Validate(); err == nil {
+		t.Error("expected a phone without country code to be rejected")
+	}
+	if err := (ProfileUpdate{Phone: str("")}).Validate(); err != nil {
+		t.Error("expected phone to be clearable")
+	}
+}
+
+func TestProfileApply(t *testing.T) {
+	u := User{FirstName: "a", LastName: "b", Email: "c@d"}
+	ProfileUpdate{LastName: str("x")}.Apply(&u)
+	if u.FirstName != "a" || u.LastName != "x" || u.Email != "c@d" {
+		t.Errorf("expected only last name changed, got %v", u)
+	}
+}
+
+func TestProfileFields(t *testing.T) {
+	fs := ProfileUpdate{LastName: str("x"), Locale: str("")}.Fields()
+	if len(fs) != 2 || fs[0] != "lastName" || fs[1] != "locale" {
+		t.Errorf("unexpected fields %v", fs)
+	}
+}
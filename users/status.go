@@ -0,0 +1,52 @@
+package users
+
+import "errors"
+
+// Lifecycle states of a user. Users stored before states were introduced
+// have no status and count as active.
+const (
+	StatusPending   = "pending"
+	StatusActive    = "active"
+	StatusSuspended = "suspended"
+	StatusDeleted   = "deleted"
+)
+
+var (
+	//ErrInvalidStatus is returned for a status outside the lifecycle
+	ErrInvalidStatus = errors.New("Invalid status")
+	//ErrInvalidTransition is returned when a user can't move to the requested status
+	ErrInvalidTransition = errors.New("Invalid status transition")
+)
+
+// transitions lists the states each state may move to. Deleted is final.
+var transitions = map[string][]string{
+	StatusPending:   {StatusActive, StatusDeleted},
+	StatusActive:    {StatusSuspended, StatusDeleted},
+	StatusSuspended: {StatusActive, StatusDeleted},
+	StatusDeleted:   {},
+}
+
+// ValidStatus reports whether s is a lifecycle state.
+func ValidStatus(s string) bool {
+	_, ok := transitions[s]
+	return ok
+}
+
+// GetStatus returns the user's status, active when unset.
+func (u *User) GetStatus() string {
+	if u.Status == "" {
+		return StatusActive
+	}
+	return u.Status
+}
+
+// CanTransition checks the user may move to status to.
+func (u *User) CanTransition(to string) error {
+	if !ValidStatus(to) {
+		return ErrInvalidStatus
+	}
+	if !contains(transitions[u.GetStatus()], to) {
+		return ErrInvalidTransition
+	}
+	return nil
+}
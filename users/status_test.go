@@ -0,0 +1,28 @@
+package users
+
+import "testing"
+
+func TestCanTransition(t *testing.T) {
+	legacy := User{}
+	if legacy.GetStatus() != StatusActive {
+		t.Error("expected unset status to be active")
+	}
+	for _, c := range []struct {
+		from, to string
+		err      error
+	}{
+		{StatusPending, StatusActive, nil},
+		{StatusActive, StatusSuspended, nil},
+		{StatusSuspended, StatusActive, nil},
+		{"", StatusDeleted, nil},
+		{StatusPending, StatusSuspended, ErrInvalidTransition},
+		{StatusActive, StatusActive, ErrInvalidTransition},
+		{StatusDeleted, StatusActive, ErrInvalidTransition},
+		{StatusActive, "banned", ErrInvalidStatus},
+	} {
+		u := User{Status: c.from}
+		if err := u.CanTransition(c.to); err != c.err {
+			t.Errorf("%v -> %v: expected %v, got %v", c.from, c.to, c.err, err)
+		}
+	}
+}
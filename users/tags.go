@@ -0,0 +1,20 @@
+package users
+
+import "fmt"
+
+// MaxTagLength is the longest tag accepted.
+const MaxTagLength = 64
+
+// ValidateTag checks t is a usable segmentation tag: lower case letters,
+// digits and - _ : only.
+func ValidateTag(t string) error {
+	if t == "" || len(t) > MaxTagLength {
+		return fmt.Errorf(ErrInvalidField, "Tag")
+	}
+	for _, c := range t {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == ':') {
+			return fmt.Errorf(ErrInvalidField, "Tag")
+		}
+	}
+	return nil
+}
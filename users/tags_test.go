@@ -0,0 +1,16 @@
+package users
+
+import "testing"
+
+func TestValidateTag(t *testing.T) {
+	for _, ok := range []string{"vip", "churn-risk", "campaign:2016_q3"} {
+		if err := ValidateTag(ok); err != nil {
+			t.Errorf("expected %v to be valid", ok)
+		}
+	}
+	for _, bad := range []string{"", "VIP", "has space", string(make([]byte, MaxTagLength+1))} {
+		if err := ValidateTag(bad); err == nil {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+}
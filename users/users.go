@@ -12,12 +12,23 @@ import (
 var (
 	ErrNoCustomerInResponse = errors.New("Response has no matching customer")
 	ErrMissingField         = "Error missing %v"
+	ErrInvalidField         = "Error invalid %v"
 )
 
+// FieldError names the field a value was rejected for and why.
+type FieldError struct {
+	Field  string `json:"field"`
+	Reason string `json:"reason"`
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf(ErrInvalidField+": %v", e.Field, e.Reason)
+}
+
 type User struct {
-	FirstName string    `json:"firstName" bson:"firstName"`
-	LastName  string    `json:"lastName" bson:"lastName"`
-	Email     string    `json:"-" bson:"email"`
+	FirstName string    `json:"firstName" bson:"firstName" pii:"randomized"`
+	LastName  string    `json:"lastName" bson:"lastName" pii:"randomized"`
+	Email     string    `json:"-" bson:"email" pii:"deterministic"`
 	Username  string    `json:"username" bson:"username"`
 	Password  string    `json:"-" bson:"password,omitempty"`
 	Addresses []Address `json:"-,omitempty" bson:"-"`
@@ -25,6 +36,53 @@ type User struct {
 	UserID    string    `json:"id" bson:"-"`
 	Links     Links     `json:"_links"`
 	Salt      string    `json:"-" bson:"salt"`
+	Roles     []string  `json:"roles,omitempty" bson:"roles,omitempty"`
+	Status    string    `json:"status,omitempty" bson:"status,omitempty"`
+	Tags      []string  `json:"tags,omitempty" bson:"tags,omitempty"`
+	// LastLoginAt and LoginCount are kept up to date by successful logins.
+	LastLoginAt *time.Time `json:"lastLoginAt,omitempty" bson:"lastLoginAt,omitempty"`
+	LoginCount  int        `json:"loginCount" bson:"loginCount"`
+	// UsernameHistory records earlier usernames, oldest first.
+	UsernameHistory []UsernameChange `json:"usernameHistory,omitempty" bson:"usernameHistory,omitempty"`
+	CreatedAt       time.Time        `json:"createdAt" bson:"createdAt,omitempty"`
+	UpdatedAt       time.Time        `json:"updatedAt" bson:"updatedAt,omitempty"`
+	// Avatar holds the avatar URL per size name.
+	Avatar map[string]string `json:"avatar,omitempty" bson:"avatar,omitempty"`
+	// Preferences are served as the preferences subresource.
+	Preferences *Preferences `json:"-" bson:"preferences,omitempty"`
+	// Locale is a BCP 47 language tag and Timezone an IANA zone name, for
+	// notifications in the customer's language and time.
+	Locale   string `json:"locale,omitempty" bson:"locale,omitempty"`
+	Timezone string `json:"timezone,omitempty" bson:"timezone,omitempty"`
+	// Metadata holds external ids and flags of integrating services.
+	Metadata map[string]string `json:"metadata,omitempty" bson:"metadata,omitempty"`
+	// DefaultCard is the id of the preferred payment card. It is kept on the
+	// user so changing it is a single atomic write.
+	DefaultCard string `json:"defaultCard,omitempty" bson:"defaultCard,omitempty"`
+	// Phone is an E.164 number, PhoneVerified is set once a code texted to
+	// it was confirmed and cleared when it changes.
+	Phone         string     `json:"phone,omitempty" bson:"phone,omitempty" pii:"randomized"`
+	PhoneVerified bool       `json:"phoneVerified,omitempty" bson:"phoneVerified,omitempty"`
+	PhoneCode     *PhoneCode `json:"-" bson:"phoneCode,omitempty"`
+}
+
+// UsernameChange records a username given up by a rename.
+type UsernameChange struct {
+	Username  string    `json:"username" bson:"username"`
+	ChangedAt time.Time `json:"changedAt" bson:"changedAt"`
+}
+
+// RoleAdmin is held by privileged users.
+const RoleAdmin = "admin"
+
+// HasRole reports whether the user holds role.
+func (u *User) HasRole(role string) bool {
+	for _, r := range u.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
 }
 
 func New() User {
@@ -43,6 +101,11 @@ func (u *User) Validate() error {
 	if u.Username == "" {
 		return fmt.Errorf(ErrMissingField, "Username")
 	}
+	if u.Phone != "" {
+		if err := ValidatePhone(u.Phone); err != nil {
+			return err
+		}
+	}
 	if u.Password == "" {
 		return fmt.Errorf(ErrMissingField, "Password")
 	}
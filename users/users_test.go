@@ -52,3 +52,35 @@ func TestMaskCCs(t *testing.T) {
 		t.Error("Card two CC not masked")
 	}
 }
+
+func TestNormalize(t *testing.T) {
+	if NormalizeUsername("Alice") != NormalizeUsername("alice") {
+		t.Error("expected usernames to match regardless of case")
+	}
+	if NormalizeEmail(" Alice@Example.com") != "alice@example.com" {
+		t.Error("expected email lower cased and trimmed")
+	}
+}
+
+func TestHasRole(t *testing.T) {
+	u := New()
+	if u.HasRole(RoleAdmin) {
+		t.Error("expected new user without admin role")
+	}
+	u.Roles = append(u.Roles, RoleAdmin)
+	if !u.HasRole(RoleAdmin) {
+		t.Error("expected admin role")
+	}
+}
+
+func TestAddLinksCustomer(t *testing.T) {
+	domain = "mydomain"
+	u := User{UserID: "test"}
+	u.AddLinks()
+	if u.Links["self"] != (Href{Url: "http://mydomain/customers/test"}) || u.Links["cards"] != (Href{Url: "http://mydomain/customers/test/cards"}) {
+		t.Errorf("expected customer links, got %v", u.Links)
+	}
+	if u.Links["activity"] != (Href{Url: "http://mydomain/customers/test/activity{?cursor,limit}", Templated: true}) {
+		t.Errorf("expected templated activity link, got %v", u.Links["activity"])
+	}
+}
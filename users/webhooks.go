@@ -0,0 +1,61 @@
+package users
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// MinWebhookSecretLength is the shortest secret webhook deliveries are
+// signed with.
+const MinWebhookSecretLength = 16
+
+// Webhook subscribes an external system to change events, which are posted
+// to its URL signed with its secret. Events lists the event types, "*" for
+// every type.
+type Webhook struct {
+	ID        string    `json:"id" bson:"-"`
+	URL       string    `json:"url" bson:"url"`
+	Secret    string    `json:"secret,omitempty" bson:"secret" pii:"randomized"`
+	Events    []string  `json:"events" bson:"events"`
+	CreatedAt time.Time `json:"createdAt" bson:"createdAt,omitempty"`
+}
+
+// Validate checks the webhook can be created. Events are only posted over
+// https.
+func (w *Webhook) Validate() error {
+	u, err := url.Parse(w.URL)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf(ErrInvalidField, "URL")
+	}
+	if len(w.Secret) < MinWebhookSecretLength {
+		return &FieldError{Field: "secret", Reason: fmt.Sprintf("must be at least %v characters", MinWebhookSecretLength)}
+	}
+	if len(w.Events) == 0 {
+		return fmt.Errorf(ErrMissingField, "Events")
+	}
+	return nil
+}
+
+// Subscribes reports whether the webhook receives events of type t.
+func (w *Webhook) Subscribes(t string) bool {
+	return contains(w.Events, t) || contains(w.Events, "*")
+}
+
+// WebhookDelivery is an attempt to deliver an event to a webhook. Failed
+// attempts are retried with backoff, each attempt is logged.
+type WebhookDelivery struct {
+	ID        string `json:"id" bson:"-"`
+	WebhookID string `json:"webhookId" bson:"webhookId"`
+	EventID   string `json:"eventId" bson:"eventId"`
+	EventType string `json:"eventType" bson:"eventType"`
+	Attempt   int    `json:"attempt" bson:"attempt"`
+	// StatusCode is the status the webhook responded with, zero when the
+	// request failed before.
+	StatusCode int       `json:"statusCode,omitempty" bson:"statusCode,omitempty"`
+	Error      string    `json:"error,omitempty" bson:"error,omitempty"`
+	Delivered  bool      `json:"delivered" bson:"delivered"`
+	Time       time.Time `json:"time" bson:"time"`
+	// DurationMS is how long the request took in milliseconds.
+	DurationMS int64 `json:"durationMs" bson:"durationMs"`
+}
@@ -0,0 +1,32 @@
+package users
+
+import "testing"
+
+func TestWebhookValidate(t *testing.T) {
+	ok := Webhook{URL: "https://crm.example.com/hooks/user", Secret: "0123456789abcdef", Events: []string{"user.created"}}
+	if err := ok.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	for _, w := range []Webhook{
+		{URL: "crm.example.com/hooks", Secret: ok.Secret, Events: ok.Events},
+		{URL: "ftp://crm.example.com/hooks", Secret: ok.Secret, Events: ok.Events},
+		{URL: "http://crm.example.com/hooks", Secret: ok.Secret, Events: ok.Events},
+		{URL: ok.URL, Secret: "short", Events: ok.Events},
+		{URL: ok.URL, Secret: ok.Secret},
+	} {
+		if err := w.Validate(); err == nil {
+			t.Errorf("expected %+v to be invalid", w)
+		}
+	}
+}
+
+func TestWebhookSubscribes(t *testing.T) {
+	w := Webhook{Events: []string{"user.created", "card.deleted"}}
+	if !w.Subscribes("card.deleted") || w.Subscribes("user.updated") {
+		t.Error("expected only the listed events")
+	}
+	w.Events = []string{"*"}
+	if !w.Subscribes("user.updated") {
+		t.Error("expected every event")
+	}
+}
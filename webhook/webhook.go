@@ -0,0 +1,244 @@
+package webhook
+
+// webhook.go contains the delivery of change events to the webhooks
+// subscribed to them. Every event is posted as JSON, signed with the secret
+// of the webhook, and retried with exponential backoff while the webhook
+// fails with a temporary error. Each attempt is logged for the delivery
+// log endpoint. Events are only posted over https to public addresses,
+// redirects aren't followed, so webhooks can't reach into our network.
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"user/changes"
+	"user/users"
+)
+
+const (
+	// SignatureHeader carries "t=<unix time>,v1=<hex HMAC-SHA256>" of the
+	// time and body, see Sign.
+	SignatureHeader = "X-Webhook-Signature"
+	// EventHeader carries the event type.
+	EventHeader = "X-Webhook-Event"
+	// IDHeader carries the event id, the same for every attempt.
+	IDHeader = "X-Webhook-ID"
+
+	// DefaultAttempts is how often a delivery is tried at most.
+	DefaultAttempts = 5
+	// DefaultBackoff is the wait before the first retry, doubling with
+	// every further one.
+	DefaultBackoff = 30 * time.Second
+	// DefaultTimeout is how long a webhook may take to respond.
+	DefaultTimeout = 10 * time.Second
+)
+
+var (
+	// ErrInsecureURL is recorded for webhooks without an https URL.
+	ErrInsecureURL = errors.New("Webhook URL is not https")
+	// ErrPrivateAddress is returned dialing an address that isn't public.
+	ErrPrivateAddress = errors.New("Webhook address is not public")
+)
+
+// NewClient returns the client webhooks are posted with by default: it
+// times out after timeout, bypasses any proxy and refuses to connect to
+// loopback, private, link-local and other addresses that aren't public. The
+// address is checked once resolved, so no DNS answer gets around it.
+func NewClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{Timeout: timeout, Control: publicOnly}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
+
+var defaultClient = NewClient(DefaultTimeout)
+
+// publicOnly is the dialer Control of NewClient.
+func publicOnly(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !ip.IsGlobalUnicast() || ip.IsPrivate() || sharedAddresses.Contains(ip) {
+		return ErrPrivateAddress
+	}
+	return nil
+}
+
+// sharedAddresses is the carrier-grade NAT range, as private as the private
+// ones.
+var sharedAddresses = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// noRedirects makes clients return redirects as the response.
+func noRedirects(*http.Request, []*http.Request) error {
+	return http.ErrUseLastResponse
+}
+
+// Store is the part of *db.Store the dispatcher uses.
+type Store interface {
+	GetWebhooks(ctx context.Context) ([]users.Webhook, error)
+	AddWebhookDelivery(ctx context.Context, d *users.WebhookDelivery) error
+}
+
+// Dispatcher delivers the events of a broker to the webhooks of Store.
+// Client, Attempts and Backoff default to NewClient with DefaultTimeout,
+// DefaultAttempts and DefaultBackoff. Redirects aren't followed whatever the
+// client.
+type Dispatcher struct {
+	Store    Store
+	Client   *http.Client
+	Attempts int
+	Backoff  time.Duration
+	Logger   log.Logger
+}
+
+// Run delivers the events of b until stop is closed. When it falls too far
+// behind it resumes after the last event it saw.
+func (d *Dispatcher) Run(b *changes.Broker, stop <-chan struct{}) {
+	ctx := context.Background()
+	last := ""
+	for {
+		s := b.Subscribe(last)
+	receive:
+		for {
+			select {
+			case <-stop:
+				s.Close()
+				return
+			case e, ok := <-s.Events:
+				if !ok {
+					break receive
+				}
+				last = e.ID
+				d.Dispatch(ctx, e, stop)
+			}
+		}
+	}
+}
+
+// Dispatch delivers e to every webhook subscribed to its type, in the
+// background.
+func (d *Dispatcher) Dispatch(ctx context.Context, e changes.Event, stop <-chan struct{}) {
+	ws, err := d.Store.GetWebhooks(ctx)
+	if err != nil {
+		d.log("event", e.ID, "err", err)
+		return
+	}
+	var body []byte
+	for _, w := range ws {
+		if !w.Subscribes(string(e.Type)) {
+			continue
+		}
+		if body == nil {
+			if body, err = json.Marshal(e); err != nil {
+				d.log("event", e.ID, "err", err)
+				return
+			}
+		}
+		go d.deliver(ctx, w, e, body, stop)
+	}
+}
+
+// deliver tries to deliver the event until the webhook accepts it, fails
+// permanently or the attempts are used up.
+func (d *Dispatcher) deliver(ctx context.Context, w users.Webhook, e changes.Event, body []byte, stop <-chan struct{}) {
+	attempts, backoff := d.Attempts, d.Backoff
+	if attempts <= 0 {
+		attempts = DefaultAttempts
+	}
+	if backoff <= 0 {
+		backoff = DefaultBackoff
+	}
+	for attempt := 1; ; attempt++ {
+		delivery := users.WebhookDelivery{WebhookID: w.ID, EventID: e.ID, EventType: string(e.Type), Attempt: attempt}
+		retry := d.post(w, e, body, &delivery)
+		if err := d.Store.AddWebhookDelivery(ctx, &delivery); err != nil {
+			d.log("webhook", w.ID, "event", e.ID, "err", err)
+		}
+		if delivery.Delivered || !retry || attempt == attempts {
+			return
+		}
+		t := time.NewTimer(backoff << (attempt - 1))
+		select {
+		case <-stop:
+			t.Stop()
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// post posts the event to the webhook, recording the outcome in delivery.
+// It reports whether a failure is temporary.
+func (d *Dispatcher) post(w users.Webhook, e changes.Event, body []byte, delivery *users.WebhookDelivery) bool {
+	if u, err := url.Parse(w.URL); err != nil || u.Scheme != "https" {
+		delivery.Error = ErrInsecureURL.Error()
+		return false
+	}
+	r, err := http.NewRequest("POST", w.URL, bytes.NewReader(body))
+	if err != nil {
+		delivery.Error = err.Error()
+		return false
+	}
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set(EventHeader, string(e.Type))
+	r.Header.Set(IDHeader, e.ID)
+	r.Header.Set(SignatureHeader, Sign(w.Secret, time.Now(), body))
+	client := d.Client
+	if client == nil {
+		client = defaultClient
+	}
+	c := *client
+	c.CheckRedirect = noRedirects
+	begin := time.Now()
+	resp, err := c.Do(r)
+	delivery.DurationMS = time.Since(begin).Milliseconds()
+	if errors.Is(err, ErrPrivateAddress) {
+		delivery.Error = err.Error()
+		return false
+	}
+	if err != nil {
+		delivery.Error = err.Error()
+		return true
+	}
+	resp.Body.Close()
+	delivery.StatusCode = resp.StatusCode
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		delivery.Delivered = true
+		return false
+	}
+	delivery.Error = resp.Status
+	return resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusRequestTimeout
+}
+
+// Sign returns the SignatureHeader of body sent at t: the HMAC-SHA256 with
+// secret of the unix time, a dot and the body. Receivers recompute it and
+// reject old times, so deliveries can't be forged or replayed.
+func Sign(secret string, t time.Time, body []byte) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts + "."))
+	mac.Write(body)
+	return fmt.Sprintf("t=%v,v1=%v", ts, hex.EncodeToString(mac.Sum(nil)))
+}
+
+func (d *Dispatcher) log(keyvals ...interface{}) {
+	if d.Logger != nil {
+		d.Logger.Log(keyvals...)
+	}
+}
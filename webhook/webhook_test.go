@@ -0,0 +1,166 @@
+package webhook
+
+import (
+	"context"
+	"crypto/hmac"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"user/changes"
+	"user/users"
+)
+
+type fakeStore struct {
+	mtx        sync.Mutex
+	webhooks   []users.Webhook
+	deliveries []users.WebhookDelivery
+}
+
+func (s *fakeStore) GetWebhooks(ctx context.Context) ([]users.Webhook, error) {
+	return s.webhooks, nil
+}
+
+func (s *fakeStore) AddWebhookDelivery(ctx context.Context, d *users.WebhookDelivery) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.deliveries = append(s.deliveries, *d)
+	return nil
+}
+
+func TestDeliver(t *testing.T) {
+	ctx := context.Background()
+	statuses := []int{http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusNoContent}
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get(EventHeader) != "user.created" || r.Header.Get(IDHeader) != "e1" || !validSignature(r.Header.Get(SignatureHeader), body) {
+			t.Errorf("unexpected request %v %s", r.Header, body)
+		}
+		w.WriteHeader(statuses[0])
+		statuses = statuses[1:]
+	}))
+	defer srv.Close()
+	s := &fakeStore{}
+	d := &Dispatcher{Store: s, Client: srv.Client(), Backoff: time.Millisecond}
+	w := users.Webhook{ID: "w1", URL: srv.URL, Secret: "0123456789abcdef"}
+	d.deliver(ctx, w, changes.Event{ID: "e1", Type: changes.UserCreated}, []byte(`{"id":"e1"}`), nil)
+	if len(s.deliveries) != 3 {
+		t.Fatalf("expected 3 attempts, got %+v", s.deliveries)
+	}
+	if s.deliveries[0].Delivered || s.deliveries[0].StatusCode != 503 || !s.deliveries[2].Delivered || s.deliveries[2].Attempt != 3 {
+		t.Errorf("unexpected delivery log %+v", s.deliveries)
+	}
+}
+
+// validSignature recomputes the signature like a receiver does.
+func validSignature(sig string, body []byte) bool {
+	ts := strings.TrimPrefix(strings.Split(sig, ",")[0], "t=")
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || time.Since(time.Unix(unix, 0)) > time.Minute {
+		return false
+	}
+	return hmac.Equal([]byte(sig), []byte(Sign("0123456789abcdef", time.Unix(unix, 0), body)))
+}
+
+func TestDeliverPermanentFailure(t *testing.T) {
+	ctx := context.Background()
+	calls := 0
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusGone)
+	}))
+	defer srv.Close()
+	s := &fakeStore{}
+	d := &Dispatcher{Store: s, Client: srv.Client(), Backoff: time.Millisecond}
+	d.deliver(ctx, users.Webhook{ID: "w1", URL: srv.URL}, changes.Event{ID: "e1"}, []byte(`{}`), nil)
+	if calls != 1 || len(s.deliveries) != 1 || s.deliveries[0].Error == "" {
+		t.Errorf("expected a single logged attempt, got %d %+v", calls, s.deliveries)
+	}
+}
+
+func TestDispatchSubscribed(t *testing.T) {
+	ctx := context.Background()
+	got := make(chan string, 2)
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got <- r.URL.Path
+	}))
+	defer srv.Close()
+	s := &fakeStore{webhooks: []users.Webhook{
+		{ID: "w1", URL: srv.URL + "/cards", Events: []string{"card.created"}},
+		{ID: "w2", URL: srv.URL + "/all", Events: []string{"*"}},
+	}}
+	d := &Dispatcher{Store: s, Client: srv.Client()}
+	d.Dispatch(ctx, changes.Event{ID: "e1", Type: changes.UserCreated}, nil)
+	select {
+	case p := <-got:
+		if p != "/all" {
+			t.Errorf("expected only the webhook of every event, got %s", p)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected a delivery")
+	}
+	select {
+	case p := <-got:
+		t.Errorf("unexpected delivery to %s", p)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestDeliverRefused(t *testing.T) {
+	ctx := context.Background()
+	calls := 0
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		http.Redirect(w, r, "/elsewhere", http.StatusFound)
+	}))
+	defer srv.Close()
+	plain := httptest.NewServer(srv.Config.Handler)
+	defer plain.Close()
+
+	s := &fakeStore{}
+	d := &Dispatcher{Store: s, Client: srv.Client(), Backoff: time.Millisecond}
+	d.deliver(ctx, users.Webhook{ID: "w1", URL: plain.URL}, changes.Event{ID: "e1"}, []byte(`{}`), nil)
+	if calls != 0 || len(s.deliveries) != 1 || s.deliveries[0].Error != ErrInsecureURL.Error() {
+		t.Errorf("expected plain http refused, got %d %+v", calls, s.deliveries)
+	}
+
+	s.deliveries = nil
+	d.deliver(ctx, users.Webhook{ID: "w1", URL: srv.URL}, changes.Event{ID: "e1"}, []byte(`{}`), nil)
+	if calls != 1 || len(s.deliveries) != 1 || s.deliveries[0].StatusCode != http.StatusFound || s.deliveries[0].Delivered {
+		t.Errorf("expected the redirect not followed, got %d %+v", calls, s.deliveries)
+	}
+
+	s.deliveries = nil
+	d.Client = nil
+	d.deliver(ctx, users.Webhook{ID: "w1", URL: srv.URL}, changes.Event{ID: "e1"}, []byte(`{}`), nil)
+	if calls != 1 || len(s.deliveries) != 1 || !strings.Contains(s.deliveries[0].Error, ErrPrivateAddress.Error()) {
+		t.Errorf("expected loopback refused, got %d %+v", calls, s.deliveries)
+	}
+}
+
+func TestPublicOnly(t *testing.T) {
+	for address, public := range map[string]bool{
+		"93.184.216.34:443":      true,
+		"[2606:4700::1111]:443":  true,
+		"127.0.0.1:443":          false,
+		"[::1]:443":              false,
+		"10.1.2.3:443":           false,
+		"172.16.0.1:443":         false,
+		"192.168.1.1:443":        false,
+		"169.254.169.254:80":     false,
+		"[fe80::1]:443":          false,
+		"[fd00::1]:443":          false,
+		"100.64.0.1:443":         false,
+		"0.0.0.0:443":            false,
+		"[::ffff:127.0.0.1]:443": false,
+	} {
+		if err := publicOnly("tcp", address, nil); (err == nil) != public {
+			t.Errorf("%v: expected public %v, got %v", address, public, err)
+		}
+	}
+}